@@ -11,8 +11,11 @@ import (
 	"github.com/turtacn/QuantaID/internal/audit"
 	"github.com/turtacn/QuantaID/internal/domain/identity/governance"
 	"github.com/turtacn/QuantaID/internal/domain/identity/lifecycle"
+	"github.com/turtacn/QuantaID/internal/protocol/ldap"
+	"github.com/turtacn/QuantaID/internal/protocol/radius"
 	"github.com/turtacn/QuantaID/internal/server/http"
 	"github.com/turtacn/QuantaID/internal/worker"
+	"github.com/turtacn/QuantaID/pkg/auth/passwordhash"
 	"github.com/turtacn/QuantaID/pkg/kms/local"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
@@ -41,7 +44,36 @@ func main() {
 	}
 
 	// Initialize CryptoManager
-	cryptoManager := utils.NewCryptoManager("your-jwt-secret") // Use a real secret from config in production
+	jwtSecret := appCfg.JWT.Secret
+	if jwtSecret == "" {
+		jwtSecret = "your-jwt-secret" // Use a real secret from config in production
+	}
+	cryptoManager := utils.NewCryptoManager(jwtSecret)
+	cryptoManager.SetIssuer(appCfg.JWT.Issuer)
+	passwordHasher, err := newPasswordHasher(appCfg.Security.PasswordHashing)
+	if err != nil {
+		logger.Error(context.Background(), "Failed to initialize password hashing", zap.Error(err))
+		os.Exit(1)
+	}
+	cryptoManager.SetPasswordHasher(passwordHasher)
+
+	// Initialize the asymmetric signing key set unless legacy HS256 is configured
+	keyRotationCtx, keyRotationCancel := context.WithCancel(context.Background())
+	if utils.IsAsymmetricAlgorithm(appCfg.JWT.SigningAlgorithm) {
+		keyManager, err := utils.NewKeyManager(context.Background(), utils.NewFileKeyStore(appCfg.JWT.KeySetFile), utils.KeyManagerConfig{
+			Algorithm:        appCfg.JWT.SigningAlgorithm,
+			RotationInterval: appCfg.JWT.RotationInterval,
+			RetentionPeriod:  appCfg.JWT.RetentionPeriod,
+		})
+		if err != nil {
+			logger.Error(context.Background(), "Failed to initialize JWT signing keys", zap.Error(err))
+			os.Exit(1)
+		}
+		cryptoManager.SetKeyManager(keyManager)
+		go keyManager.Start(keyRotationCtx, time.Hour)
+	} else {
+		logger.Warn(context.Background(), "JWTs are signed with a shared HS256 secret; resource servers cannot verify them via JWKS")
+	}
 
 	// Initialize Data Encryption (KMS)
 	if appCfg.DataEncryption.Key != "" {
@@ -128,6 +160,30 @@ func main() {
 	lifecycleCtx, lifecycleCancel := context.WithCancel(context.Background())
 	go lifecycleJob.Start(lifecycleCtx)
 
+	// Start the LDAP and RADIUS listeners, which share the services of the HTTP server
+	var ldapServer *ldap.Server
+	if appCfg.LDAP.Enabled {
+		ldapServer, err = newLDAPServer(appCfg.LDAP, server.Services, utils.ZapLoggerFrom(logger))
+		if err == nil {
+			err = ldapServer.Start()
+		}
+		if err != nil {
+			logger.Error(context.Background(), "Failed to start LDAP server", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+	var radiusServer *radius.Server
+	if appCfg.RADIUS.Enabled {
+		radiusServer, err = newRADIUSServer(appCfg.RADIUS, server.Services, utils.ZapLoggerFrom(logger))
+		if err == nil {
+			err = radiusServer.Start(context.Background())
+		}
+		if err != nil {
+			logger.Error(context.Background(), "Failed to start RADIUS server", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
 	// Start server in a goroutine
 	go server.Start()
 
@@ -137,8 +193,37 @@ func main() {
 	<-quit
 
 	lifecycleCancel() // Stop lifecycle job
+	keyRotationCancel()
 	retentionManager.Stop()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	server.Stop(ctx)
+	if ldapServer != nil {
+		ldapServer.Stop()
+	}
+	if radiusServer != nil {
+		if err := radiusServer.Stop(ctx); err != nil {
+			logger.Error(ctx, "RADIUS server graceful shutdown failed", zap.Error(err))
+		}
+	}
+}
+
+// newPasswordHasher creates the registry passwords are hashed with in the
+// configured scheme, and imported hashes of other schemes are verified with.
+func newPasswordHasher(cfg utils.PasswordHashingConfig) (*passwordhash.Registry, error) {
+	argon2id := passwordhash.NewArgon2id(passwordhash.Argon2Params{
+		Memory:      cfg.Argon2.MemoryKiB,
+		Iterations:  cfg.Argon2.Iterations,
+		Parallelism: cfg.Argon2.Parallelism,
+		SaltLength:  cfg.Argon2.SaltLength,
+		KeyLength:   cfg.Argon2.KeyLength,
+	})
+	switch cfg.Algorithm {
+	case "", "argon2id":
+		return passwordhash.NewRegistry(argon2id, passwordhash.LegacySchemes()...), nil
+	case "bcrypt":
+		return passwordhash.NewRegistry(passwordhash.NewBcrypt(cfg.BcryptCost), append([]passwordhash.Scheme{argon2id}, passwordhash.LegacySchemes()...)...), nil
+	default:
+		return nil, fmt.Errorf("unsupported password hashing algorithm %q", cfg.Algorithm)
+	}
 }
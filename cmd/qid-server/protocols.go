@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/turtacn/QuantaID/internal/protocol/ldap"
+	"github.com/turtacn/QuantaID/internal/protocol/radius"
+	"github.com/turtacn/QuantaID/internal/server/http"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// newLDAPServer creates the LDAP server of the configured listeners, which
+// authenticates binds with the services of the HTTP server and authorizes
+// changes to the directory with its authorization service. Upstream
+// directories are proxied beside, or instead of, the local users.
+func newLDAPServer(cfg utils.LDAPConfig, services http.Services, logger *zap.Logger) (*ldap.Server, error) {
+	if cfg.Address == "" && cfg.LDAPSAddress == "" {
+		return nil, fmt.Errorf("no LDAP listener address configured")
+	}
+	var tlsConfig *tls.Config
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load LDAP certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if tlsConfig == nil && (cfg.LDAPSAddress != "" || cfg.RequireTLS) {
+		return nil, fmt.Errorf("LDAPS and require_tls need a certificate")
+	}
+
+	server := ldap.NewServer(cfg.Address, cfg.BaseDN, nil, services.IdentityDomainService, services.PasswordService, logger)
+	server.SetSearchLimits(cfg.SizeLimit, cfg.TimeLimit)
+	if services.LockoutTracker != nil {
+		server.SetLockoutTracker(services.LockoutTracker)
+	}
+	if services.AuthzService != nil {
+		server.SetAuthorizer(services.AuthzService)
+	}
+	if tlsConfig != nil {
+		if cfg.StartTLS {
+			server.EnableStartTLS(tlsConfig)
+		}
+		if cfg.LDAPSAddress != "" {
+			server.EnableLDAPS(cfg.LDAPSAddress, tlsConfig)
+		}
+	}
+	server.SetRequireTLS(cfg.RequireTLS)
+
+	if len(cfg.Upstreams) > 0 {
+		backend, err := newLDAPBackend(cfg, server.LocalBackend(), logger)
+		if err != nil {
+			return nil, err
+		}
+		if err := server.SetBackend(backend); err != nil {
+			return nil, err
+		}
+	} else if !cfg.Local {
+		return nil, fmt.Errorf("LDAP serves neither local users nor upstream directories")
+	}
+	return server, nil
+}
+
+// defaultUpstreamTimeout bounds the requests to upstream directories that
+// do not configure a timeout.
+const defaultUpstreamTimeout = 10 * time.Second
+
+// newLDAPBackend creates the backend of the upstream directories, merged
+// with the local one when local users are served.
+func newLDAPBackend(cfg utils.LDAPConfig, local ldap.Backend, logger *zap.Logger) (ldap.Backend, error) {
+	var members []ldap.Backend
+	if cfg.Local {
+		members = append(members, local)
+	}
+	for _, upstream := range cfg.Upstreams {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: upstream.InsecureSkipVerify}
+		if upstream.CAFile != "" {
+			pem, err := os.ReadFile(upstream.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA of upstream %s: %w", upstream.Name, err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in CA of upstream %s", upstream.Name)
+			}
+		}
+		timeout := upstream.Timeout
+		if timeout == 0 {
+			timeout = defaultUpstreamTimeout
+		}
+		proxy, err := ldap.NewProxyBackend(ldap.ProxyConfig{
+			Name:         upstream.Name,
+			URLs:         upstream.URLs,
+			BindDN:       upstream.BindDN,
+			BindPassword: upstream.BindPassword,
+			BaseDN:       upstream.BaseDN,
+			Suffix:       upstream.Suffix,
+			CacheTTL:     upstream.CacheTTL,
+			Timeout:      timeout,
+			TLSConfig:    tlsConfig,
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, proxy)
+	}
+	if len(members) == 1 {
+		return members[0], nil
+	}
+	return ldap.NewMergedBackend(members...), nil
+}
+
+// newRADIUSServer creates the RADIUS server, which authenticates the NAS
+// clients of the database with the services of the HTTP server. It shares
+// the codec of the RADIUS policies, which holds the vendor dictionaries.
+func newRADIUSServer(cfg utils.RADIUSConfig, services http.Services, logger *zap.Logger) (*radius.Server, error) {
+	if services.RADIUSClients == nil {
+		return nil, fmt.Errorf("RADIUS needs the postgres storage mode, where NAS clients are kept")
+	}
+
+	authenticator := radius.NewAuthenticator(services.IdentityDomainService, services.PasswordService, services.RADIUSPolicies.Codec(), radius.AuthenticatorConfig{})
+	authenticator.SetPolicyManager(services.RADIUSPolicies)
+	if services.LockoutTracker != nil {
+		authenticator.SetLockoutTracker(services.LockoutTracker)
+	}
+	if cfg.EAP.Enabled {
+		err := authenticator.EnableEAP(radius.EAPConfig{
+			Methods:         cfg.EAP.Methods,
+			CertFile:        cfg.EAP.CertFile,
+			KeyFile:         cfg.EAP.KeyFile,
+			CAFile:          cfg.EAP.CAFile,
+			CertificateUser: cfg.EAP.CertificateUser,
+			FragmentSize:    cfg.EAP.FragmentSize,
+			SessionTimeout:  cfg.EAP.SessionTimeout,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to enable EAP: %w", err)
+		}
+	}
+
+	var proxy *radius.Proxy
+	if cfg.Proxy.Enabled {
+		proxyConfig := radius.ProxyConfig{
+			RetryCount:     cfg.Proxy.RetryCount,
+			Timeout:        cfg.Proxy.Timeout,
+			StatusInterval: cfg.Proxy.StatusInterval,
+		}
+		for _, pool := range cfg.Proxy.Pools {
+			poolConfig := radius.PoolConfig{Name: pool.Name}
+			for _, upstream := range pool.Servers {
+				poolConfig.Servers = append(poolConfig.Servers, radius.UpstreamServer{
+					Address:     upstream.Address,
+					AcctAddress: upstream.AcctAddress,
+					Secret:      upstream.Secret,
+					Weight:      upstream.Weight,
+				})
+			}
+			proxyConfig.Pools = append(proxyConfig.Pools, poolConfig)
+		}
+		for _, realm := range cfg.Proxy.Realms {
+			proxyConfig.Realms = append(proxyConfig.Realms, radius.RealmConfig{
+				Name:       realm.Name,
+				Pool:       realm.Pool,
+				StripRealm: realm.StripRealm,
+			})
+		}
+		var err error
+		proxy, err = radius.NewProxy(proxyConfig, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return radius.NewServer(authenticator, services.RADIUSAccounting, services.RADIUSClients, proxy, radius.ServerConfig{
+		AuthPort:     cfg.AuthPort,
+		AcctPort:     cfg.AcctPort,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		WorkerCount:  cfg.WorkerCount,
+	}, logger), nil
+}
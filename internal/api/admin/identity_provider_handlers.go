@@ -0,0 +1,122 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/auth/federation"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/server/http/handlers"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// IdentityProviderHandler manages the upstream identity providers users can
+// sign in with.
+type IdentityProviderHandler struct {
+	repo   auth.IdentityProviderRepository
+	logger utils.Logger
+}
+
+// NewIdentityProviderHandler creates a new IdentityProviderHandler.
+func NewIdentityProviderHandler(repo auth.IdentityProviderRepository, logger utils.Logger) *IdentityProviderHandler {
+	return &IdentityProviderHandler{repo: repo, logger: logger}
+}
+
+// RegisterRoutes registers the identity provider routes on an admin router.
+func (h *IdentityProviderHandler) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("", h.CreateProvider).Methods("POST")
+	r.HandleFunc("", h.ListProviders).Methods("GET")
+	r.HandleFunc("/{id}", h.GetProvider).Methods("GET")
+	r.HandleFunc("/{id}", h.UpdateProvider).Methods("PUT")
+	r.HandleFunc("/{id}", h.DeleteProvider).Methods("DELETE")
+}
+
+// CreateProvider adds an identity provider after validating its configuration.
+func (h *IdentityProviderHandler) CreateProvider(w http.ResponseWriter, r *http.Request) {
+	var provider types.IdentityProvider
+	if err := json.NewDecoder(r.Body).Decode(&provider); err != nil {
+		handlers.WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	if provider.ID == "" {
+		provider.ID = uuid.New().String()
+	}
+	if err := federation.ValidateProvider(&provider); err != nil {
+		handlers.WriteJSONError(w, types.ErrValidation.WithDetails(map[string]string{"error": err.Error()}), http.StatusBadRequest)
+		return
+	}
+	if err := h.repo.CreateProvider(r.Context(), &provider); err != nil {
+		h.writeRepoError(w, r, "Failed to create identity provider", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusCreated, &provider)
+}
+
+// ListProviders returns all identity providers.
+func (h *IdentityProviderHandler) ListProviders(w http.ResponseWriter, r *http.Request) {
+	providers, err := h.repo.ListProviders(r.Context())
+	if err != nil {
+		h.writeRepoError(w, r, "Failed to list identity providers", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, providers)
+}
+
+// GetProvider returns one identity provider.
+func (h *IdentityProviderHandler) GetProvider(w http.ResponseWriter, r *http.Request) {
+	provider, err := h.repo.GetProviderByID(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.writeRepoError(w, r, "Failed to get identity provider", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, provider)
+}
+
+// UpdateProvider replaces an identity provider's name, state and configuration.
+func (h *IdentityProviderHandler) UpdateProvider(w http.ResponseWriter, r *http.Request) {
+	existing, err := h.repo.GetProviderByID(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.writeRepoError(w, r, "Failed to get identity provider", err)
+		return
+	}
+	var update types.IdentityProvider
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		handlers.WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	update.ID = existing.ID
+	update.CreatedAt = existing.CreatedAt
+	if err := federation.ValidateProvider(&update); err != nil {
+		handlers.WriteJSONError(w, types.ErrValidation.WithDetails(map[string]string{"error": err.Error()}), http.StatusBadRequest)
+		return
+	}
+	if err := h.repo.UpdateProvider(r.Context(), &update); err != nil {
+		h.writeRepoError(w, r, "Failed to update identity provider", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, &update)
+}
+
+// DeleteProvider removes an identity provider. Accounts it provisioned remain.
+func (h *IdentityProviderHandler) DeleteProvider(w http.ResponseWriter, r *http.Request) {
+	if err := h.repo.DeleteProvider(r.Context(), mux.Vars(r)["id"]); err != nil {
+		h.writeRepoError(w, r, "Failed to delete identity provider", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *IdentityProviderHandler) writeRepoError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	var appErr *types.Error
+	if errors.As(err, &appErr) {
+		handlers.WriteJSONError(w, appErr, http.StatusInternalServerError)
+		return
+	}
+	h.logger.Error(r.Context(), msg, zap.Error(err))
+	handlers.WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+}
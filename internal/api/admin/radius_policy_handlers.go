@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/protocol/radius"
+	"github.com/turtacn/QuantaID/internal/server/http/handlers"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// RADIUSPolicyHandler manages the RADIUS authorization policies that select
+// the reply attributes of Access-Accepts.
+type RADIUSPolicyHandler struct {
+	policies *radius.PolicyManager
+	logger   utils.Logger
+}
+
+// NewRADIUSPolicyHandler creates a new RADIUSPolicyHandler.
+func NewRADIUSPolicyHandler(policies *radius.PolicyManager, logger utils.Logger) *RADIUSPolicyHandler {
+	return &RADIUSPolicyHandler{policies: policies, logger: logger}
+}
+
+// RegisterRoutes registers the RADIUS policy routes on an admin router.
+func (h *RADIUSPolicyHandler) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("", h.CreatePolicy).Methods("POST")
+	r.HandleFunc("", h.ListPolicies).Methods("GET")
+	r.HandleFunc("/{id}", h.GetPolicy).Methods("GET")
+	r.HandleFunc("/{id}", h.UpdatePolicy).Methods("PUT")
+	r.HandleFunc("/{id}", h.DeletePolicy).Methods("DELETE")
+}
+
+// CreatePolicy adds a policy after validating its attributes and conditions.
+func (h *RADIUSPolicyHandler) CreatePolicy(w http.ResponseWriter, r *http.Request) {
+	var policy radius.Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		handlers.WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	policy.ID = ""
+	if err := h.policies.CreatePolicy(r.Context(), &policy); err != nil {
+		h.writeError(w, r, "Failed to create RADIUS policy", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusCreated, &policy)
+}
+
+// ListPolicies returns all policies in the order they are evaluated.
+func (h *RADIUSPolicyHandler) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := h.policies.ListPolicies(r.Context())
+	if err != nil {
+		h.writeError(w, r, "Failed to list RADIUS policies", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, policies)
+}
+
+// GetPolicy returns one policy.
+func (h *RADIUSPolicyHandler) GetPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := h.policies.GetPolicy(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.writeError(w, r, "Failed to get RADIUS policy", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, policy)
+}
+
+// UpdatePolicy replaces a policy.
+func (h *RADIUSPolicyHandler) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	var policy radius.Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		handlers.WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	policy.ID = mux.Vars(r)["id"]
+	if err := h.policies.UpdatePolicy(r.Context(), &policy); err != nil {
+		h.writeError(w, r, "Failed to update RADIUS policy", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, &policy)
+}
+
+// DeletePolicy removes a policy.
+func (h *RADIUSPolicyHandler) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	if err := h.policies.DeletePolicy(r.Context(), mux.Vars(r)["id"]); err != nil {
+		h.writeError(w, r, "Failed to delete RADIUS policy", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *RADIUSPolicyHandler) writeError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	var appErr *types.Error
+	if errors.As(err, &appErr) {
+		handlers.WriteJSONError(w, appErr, http.StatusInternalServerError)
+		return
+	}
+	h.logger.Error(r.Context(), msg, zap.Error(err))
+	handlers.WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+}
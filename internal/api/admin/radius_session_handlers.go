@@ -0,0 +1,119 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/protocol/radius"
+	"github.com/turtacn/QuantaID/internal/server/http/handlers"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+// RADIUSSessionHandler lists the RADIUS accounting sessions of users and
+// ends or changes them at their NAS with Disconnect-Requests and
+// CoA-Requests.
+type RADIUSSessionHandler struct {
+	dac    *radius.DAClient
+	logger utils.Logger
+}
+
+// NewRADIUSSessionHandler creates a new RADIUSSessionHandler.
+func NewRADIUSSessionHandler(dac *radius.DAClient, logger utils.Logger) *RADIUSSessionHandler {
+	return &RADIUSSessionHandler{dac: dac, logger: logger}
+}
+
+// RegisterRoutes registers the RADIUS session routes on an admin router.
+func (h *RADIUSSessionHandler) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("", h.ListSessions).Methods("GET")
+	r.HandleFunc("/disconnect", h.DisconnectUser).Methods("POST")
+	r.HandleFunc("/{id}/disconnect", h.Disconnect).Methods("POST")
+	r.HandleFunc("/{id}/coa", h.ChangeAuthorization).Methods("POST")
+}
+
+// ListSessions returns the active sessions of the user named by the
+// username query parameter.
+func (h *RADIUSSessionHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		handlers.WriteJSONError(w, types.ErrBadRequest, http.StatusBadRequest)
+		return
+	}
+	sessions, err := h.dac.ActiveSessions(r.Context(), username)
+	if err != nil {
+		h.writeError(w, r, "Failed to list RADIUS sessions", err)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, sessions)
+}
+
+// Disconnect ends a session with a Disconnect-Request to its NAS.
+func (h *RADIUSSessionHandler) Disconnect(w http.ResponseWriter, r *http.Request) {
+	if err := h.dac.Disconnect(r.Context(), mux.Vars(r)["id"]); err != nil {
+		h.writeError(w, r, "Failed to disconnect RADIUS session", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangeAuthorization sends the attributes of the request body to the NAS
+// of a session in a CoA-Request.
+func (h *RADIUSSessionHandler) ChangeAuthorization(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Attributes []radius.ReplyAttribute `json:"attributes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handlers.WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	if err := h.dac.ChangeAuthorization(r.Context(), mux.Vars(r)["id"], req.Attributes); err != nil {
+		h.writeError(w, r, "Failed to change RADIUS session authorization", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DisconnectUser ends all the active sessions of the user of the request
+// body.
+func (h *RADIUSSessionHandler) DisconnectUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		handlers.WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	disconnected, err := h.dac.DisconnectUser(r.Context(), req.Username)
+	if err != nil {
+		h.logger.Warn(r.Context(), "Failed to disconnect RADIUS sessions", zap.String("username", req.Username), zap.Error(err))
+		appErr := types.NewError("nas_request_failed", err.Error(), http.StatusBadGateway, codes.Unavailable)
+		handlers.WriteJSONError(w, appErr.WithDetails(map[string]string{"disconnected": strconv.Itoa(disconnected)}), http.StatusBadGateway)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, map[string]int{"disconnected": disconnected})
+}
+
+func (h *RADIUSSessionHandler) writeError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	var appErr *types.Error
+	if errors.As(err, &appErr) {
+		handlers.WriteJSONError(w, appErr, http.StatusInternalServerError)
+		return
+	}
+	var nak *radius.NAKError
+	switch {
+	case errors.As(err, &nak):
+		h.logger.Warn(r.Context(), msg, zap.Error(err))
+		handlers.WriteJSONError(w, types.NewError("nas_rejected", nak.Error(), http.StatusBadGateway, codes.FailedPrecondition), http.StatusBadGateway)
+	case errors.Is(err, radius.ErrNoResponse):
+		h.logger.Warn(r.Context(), msg, zap.Error(err))
+		handlers.WriteJSONError(w, types.NewError("nas_unreachable", err.Error(), http.StatusGatewayTimeout, codes.Unavailable), http.StatusGatewayTimeout)
+	default:
+		h.logger.Error(r.Context(), msg, zap.Error(err))
+		handlers.WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+	}
+}
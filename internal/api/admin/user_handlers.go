@@ -6,6 +6,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/turtacn/QuantaID/internal/audit"
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/pkg/audit/events"
 	"github.com/turtacn/QuantaID/internal/server/http/handlers"
@@ -17,6 +18,7 @@ import (
 type AdminUserHandler struct {
 	userService identity.IService
 	auditLogger *audit.AuditLogger
+	lockout     *lockout.Tracker
 }
 
 // NewAdminUserHandler creates a new AdminUserHandler.
@@ -27,6 +29,19 @@ func NewAdminUserHandler(userService identity.IService, auditLogger *audit.Audit
 	}
 }
 
+// SetLockoutTracker sets the tracker of failed logins, whose state the
+// handler shows and clears.
+func (h *AdminUserHandler) SetLockoutTracker(tracker *lockout.Tracker) {
+	h.lockout = tracker
+}
+
+// adminUser is a user as listed to administrators, with its lockout state
+// when it has failed logins.
+type adminUser struct {
+	*types.User
+	Lockout *lockout.Status `json:"lockout,omitempty"`
+}
+
 // ListUsers handles the retrieval of a paginated and searchable list of users.
 func (h *AdminUserHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
@@ -54,11 +69,22 @@ func (h *AdminUserHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	views := make([]adminUser, 0, len(users))
+	for _, u := range users {
+		view := adminUser{User: u}
+		if h.lockout != nil {
+			if status, err := h.lockout.Status(r.Context(), u.Username); err == nil && (status.Locked || status.Failures > 0) {
+				view.Lockout = status
+			}
+		}
+		views = append(views, view)
+	}
+
 	response := struct {
-		Users []*types.User `json:"users"`
-		Total int           `json:"total"`
+		Users []adminUser `json:"users"`
+		Total int         `json:"total"`
 	}{
-		Users: users,
+		Users: views,
 		Total: total,
 	}
 
@@ -106,3 +132,47 @@ func (h *AdminUserHandler) UnbanUser(w http.ResponseWriter, r *http.Request) {
 
 	handlers.WriteJSON(w, http.StatusOK, nil)
 }
+
+// GetLockout returns the lockout state of a user.
+func (h *AdminUserHandler) GetLockout(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.lockoutUser(w, r)
+	if !ok {
+		return
+	}
+	status, err := h.lockout.Status(r.Context(), user.Username)
+	if err != nil {
+		handlers.WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+		return
+	}
+	handlers.WriteJSON(w, http.StatusOK, status)
+}
+
+// UnlockUser ends the lockout of a user after failed logins. Unlike UnbanUser
+// it does not change the user's status.
+func (h *AdminUserHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.lockoutUser(w, r)
+	if !ok {
+		return
+	}
+	actor, _ := r.Context().Value(middleware.UserIDContextKey).(string)
+	if err := h.lockout.Unlock(r.Context(), user.Username, actor); err != nil {
+		handlers.WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockoutUser returns the user of a lockout request, writing the error
+// response if there is none.
+func (h *AdminUserHandler) lockoutUser(w http.ResponseWriter, r *http.Request) (*types.User, bool) {
+	if h.lockout == nil {
+		handlers.WriteJSONError(w, types.ErrNotImplemented, http.StatusNotImplemented)
+		return nil, false
+	}
+	user, err := h.userService.GetUserByID(r.Context(), mux.Vars(r)["userID"])
+	if err != nil {
+		handlers.WriteJSONError(w, types.ErrNotFound.WithCause(err), http.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
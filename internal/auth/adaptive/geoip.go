@@ -2,6 +2,7 @@ package adaptive
 
 import (
 	"net"
+	"strings"
 
 	"github.com/oschwald/geoip2-golang"
 )
@@ -10,3 +11,38 @@ type GeoIPReader interface {
 	City(ipAddress net.IP) (*geoip2.City, error)
 	Close() error
 }
+
+// GeoLocator describes where an IP address is for display to users, such
+// as in push MFA approvals.
+type GeoLocator struct {
+	reader GeoIPReader
+}
+
+// NewGeoLocator creates a new GeoLocator.
+func NewGeoLocator(reader GeoIPReader) *GeoLocator {
+	return &GeoLocator{reader: reader}
+}
+
+// Locate returns "City, Country" for an address with or without a port, or
+// an empty string when it cannot be located.
+func (l *GeoLocator) Locate(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	city, err := l.reader.City(ip)
+	if err != nil || city == nil {
+		return ""
+	}
+	var parts []string
+	if name := city.City.Names["en"]; name != "" {
+		parts = append(parts, name)
+	}
+	if name := city.Country.Names["en"]; name != "" {
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,22 @@
+package adaptive
+
+import (
+	"net"
+	"testing"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoLocator_Locate(t *testing.T) {
+	reader := new(MockGeoIPReader)
+	city := &geoip2.City{}
+	city.City.Names = map[string]string{"en": "Berlin"}
+	city.Country.Names = map[string]string{"en": "Germany"}
+	reader.On("City", net.ParseIP("203.0.113.7")).Return(city, nil)
+
+	locator := NewGeoLocator(reader)
+	assert.Equal(t, "Berlin, Germany", locator.Locate("203.0.113.7:51234"))
+	assert.Equal(t, "Berlin, Germany", locator.Locate("203.0.113.7"))
+	assert.Equal(t, "", locator.Locate("not-an-ip"))
+}
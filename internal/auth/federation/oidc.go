@@ -0,0 +1,326 @@
+package federation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// idTokenSigningAlgs are the ID token algorithms accepted from upstream providers.
+var idTokenSigningAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// maxDocumentSize bounds the discovery documents, keys and token responses
+// read from upstream providers.
+const maxDocumentSize = 1 << 20
+
+// oidcMetadata holds the endpoints of an upstream OpenID provider.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// oidcTokenResponse is the part of a token endpoint response we use.
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+// oidcMetadata returns the provider's endpoints, from its configuration when
+// they are all set there and otherwise from its discovery document. Endpoints
+// in the configuration override discovered ones.
+func (s *Service) oidcMetadata(ctx context.Context, up *upstream) (*oidcMetadata, error) {
+	cfg := up.config
+	meta := &oidcMetadata{Issuer: cfg.Issuer}
+	if cfg.AuthorizationEndpoint == "" || cfg.TokenEndpoint == "" || cfg.JWKSURI == "" {
+		discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+		cached, err := s.cache.get(discoveryURL, func() (interface{}, error) {
+			var doc oidcMetadata
+			if err := s.getJSON(ctx, discoveryURL, "", &doc); err != nil {
+				return nil, err
+			}
+			if doc.Issuer != cfg.Issuer {
+				return nil, fmt.Errorf("discovery document is for issuer %q, not %q", doc.Issuer, cfg.Issuer)
+			}
+			return &doc, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		*meta = *cached.(*oidcMetadata)
+	}
+	override(&meta.AuthorizationEndpoint, cfg.AuthorizationEndpoint)
+	override(&meta.TokenEndpoint, cfg.TokenEndpoint)
+	override(&meta.JWKSURI, cfg.JWKSURI)
+	override(&meta.UserInfoEndpoint, cfg.UserInfoEndpoint)
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("provider has no authorization, token or jwks endpoint")
+	}
+	return meta, nil
+}
+
+func override(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+// oidcAuthURL builds the authorization request that starts a login, using
+// PKCE (S256) and a nonce bound to the ID token.
+func oidcAuthURL(up *upstream, meta *oidcMetadata, state *loginState, redirectURI, loginHint string) (string, error) {
+	target, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	scopes := up.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	} else if !containsString(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+
+	query := target.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", up.config.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state.ID)
+	query.Set("nonce", state.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	if loginHint != "" {
+		query.Set("login_hint", loginHint)
+	}
+	target.RawQuery = query.Encode()
+	return target.String(), nil
+}
+
+// oidcExchange redeems an authorization code at the provider's token endpoint.
+func (s *Service) oidcExchange(ctx context.Context, up *upstream, meta *oidcMetadata, code, codeVerifier, redirectURI string) (*oidcTokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	method := up.config.TokenEndpointAuthMethod
+	if method == "" {
+		method = "client_secret_basic"
+	}
+	if method != "client_secret_basic" {
+		form.Set("client_id", up.config.ClientID)
+	}
+	if method == "client_secret_post" {
+		form.Set("client_secret", up.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if method == "client_secret_basic" {
+		req.SetBasicAuth(url.QueryEscape(up.config.ClientID), url.QueryEscape(up.config.ClientSecret))
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return &tokens, nil
+}
+
+// oidcVerifyIDToken checks an ID token's signature against the provider's
+// keys, its issuer, audience, expiry and nonce, and returns its claims.
+func (s *Service) oidcVerifyIDToken(ctx context.Context, up *upstream, meta *oidcMetadata, rawIDToken, nonce string) (jwt.MapClaims, error) {
+	keyfunc := func(refresh bool) jwt.Keyfunc {
+		return func(t *jwt.Token) (interface{}, error) {
+			keys, err := s.jwks(ctx, meta.JWKSURI, refresh)
+			if err != nil {
+				return nil, err
+			}
+			candidates := keys.Keys
+			if kid, _ := t.Header["kid"].(string); kid != "" {
+				candidates = keys.Key(kid)
+			}
+			set := jwt.VerificationKeySet{}
+			for _, k := range candidates {
+				if k.Valid() && k.IsPublic() && k.Use != "enc" {
+					set.Keys = append(set.Keys, k.Key)
+				}
+			}
+			if len(set.Keys) == 0 {
+				return nil, errUnknownSigningKey
+			}
+			return set, nil
+		}
+	}
+	parse := func(refresh bool) (*jwt.Token, error) {
+		return jwt.Parse(rawIDToken, keyfunc(refresh),
+			jwt.WithValidMethods(idTokenSigningAlgs),
+			jwt.WithIssuer(meta.Issuer),
+			jwt.WithAudience(up.config.ClientID),
+			jwt.WithExpirationRequired(),
+		)
+	}
+	token, err := parse(false)
+	if errors.Is(err, errUnknownSigningKey) {
+		// The provider may have rotated its keys since they were cached.
+		token, err = parse(true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid id_token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+var errUnknownSigningKey = errors.New("no provider key matches the token")
+
+// jwks returns the provider's signing keys, from the cache unless refresh is set.
+func (s *Service) jwks(ctx context.Context, jwksURI string, refresh bool) (*jose.JSONWebKeySet, error) {
+	if refresh {
+		s.cache.forget(jwksURI)
+	}
+	keys, err := s.cache.get(jwksURI, func() (interface{}, error) {
+		var set jose.JSONWebKeySet
+		if err := s.getJSON(ctx, jwksURI, "", &set); err != nil {
+			return nil, err
+		}
+		return &set, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys.(*jose.JSONWebKeySet), nil
+}
+
+// oidcUserInfo fetches the user's claims from the UserInfo endpoint.
+func (s *Service) oidcUserInfo(ctx context.Context, meta *oidcMetadata, accessToken string) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	if err := s.getJSON(ctx, meta.UserInfoEndpoint, accessToken, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// oidcIdentity builds the external identity from the ID token claims and,
+// when the provider has a UserInfo endpoint, the claims it returns for the
+// same subject. ID token claims take precedence.
+func (s *Service) oidcIdentity(ctx context.Context, up *upstream, meta *oidcMetadata, tokens *oidcTokenResponse, idClaims jwt.MapClaims) (*ExternalIdentity, error) {
+	claims := map[string]interface{}{}
+	if meta.UserInfoEndpoint != "" && tokens.AccessToken != "" {
+		info, err := s.oidcUserInfo(ctx, meta, tokens.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		if info["sub"] != idClaims["sub"] {
+			return nil, errors.New("userinfo subject does not match the id_token")
+		}
+		for k, v := range info {
+			claims[k] = v
+		}
+	}
+	for k, v := range idClaims {
+		claims[k] = v
+	}
+
+	ext := &ExternalIdentity{Claims: map[string][]string{}}
+	ext.Subject, _ = claims["sub"].(string)
+	for name, value := range claims {
+		ext.Claims[name] = claimStrings(value)
+	}
+	ext.AMR = claimStrings(claims["amr"])
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		ext.EmailVerified = verified
+	case string:
+		ext.EmailVerified = verified == "true"
+	}
+	return ext, nil
+}
+
+// claimStrings flattens a JSON claim value to strings.
+func claimStrings(v interface{}) []string {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{val}
+	case []interface{}:
+		var out []string
+		for _, item := range val {
+			out = append(out, claimStrings(item)...)
+		}
+		return out
+	case map[string]interface{}:
+		b, _ := json.Marshal(val)
+		return []string{string(b)}
+	default:
+		return []string{fmt.Sprint(val)}
+	}
+}
+
+// getJSON fetches a JSON document, with a bearer token when one is given.
+func (s *Service) getJSON(ctx context.Context, target, bearer string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", target, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", target, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDocumentSize)).Decode(v); err != nil {
+		return fmt.Errorf("invalid document at %s: %w", target, err)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// ProviderConfig is the configuration of an upstream identity provider, stored
+// as the Config of a types.IdentityProvider. The OIDC settings apply to
+// providers of type "oidc" and the SAML settings to providers of type "saml".
+type ProviderConfig struct {
+	// Domains are the email domains whose users are sent to this provider by
+	// home realm discovery, e.g. "contoso.com".
+	Domains []string `json:"domains,omitempty"`
+	// AttributeMapping maps upstream claim or SAML attribute names to user
+	// fields: username, email, phone or the name of a custom attribute. When
+	// empty a default mapping for the protocol is used.
+	AttributeMapping map[string]string `json:"attribute_mapping,omitempty"`
+	// LinkByEmail links a first-time upstream user to the existing account with
+	// the same email address, when the address is in one of Domains and the
+	// provider sends email_verified. Defaults to false: other users link their
+	// account by signing in upstream from a local session.
+	LinkByEmail *bool `json:"link_by_email,omitempty"`
+	// JITProvisioning creates an account for upstream users who have none.
+	// Defaults to true; when false only existing accounts can sign in.
+	JITProvisioning *bool `json:"jit_provisioning,omitempty"`
+	// TrustUpstreamAMR takes the session's acr from how the user authenticated
+	// upstream: the OIDC amr claim or the SAML authentication context class.
+	// Defaults to false, which makes federated sessions single-factor.
+	TrustUpstreamAMR bool `json:"trust_upstream_amr,omitempty"`
+
+	// OIDC: the issuer and client registration. The endpoints are read from
+	// the issuer's discovery document unless they are all set here.
+	Issuer                  string   `json:"issuer,omitempty"`
+	ClientID                string   `json:"client_id,omitempty"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	Scopes                  []string `json:"scopes,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	AuthorizationEndpoint   string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint           string   `json:"token_endpoint,omitempty"`
+	JWKSURI                 string   `json:"jwks_uri,omitempty"`
+	UserInfoEndpoint        string   `json:"userinfo_endpoint,omitempty"`
+
+	// SAML: the IdP's metadata, by URL or inline, or else its entity ID, SSO
+	// URL and signing certificate.
+	MetadataURL  string `json:"metadata_url,omitempty"`
+	Metadata     string `json:"metadata,omitempty"`
+	EntityID     string `json:"entity_id,omitempty"`
+	SSOURL       string `json:"sso_url,omitempty"`
+	Certificate  string `json:"certificate,omitempty"`
+	NameIDFormat string `json:"name_id_format,omitempty"`
+	// SubjectAttribute names the attribute that identifies the user upstream.
+	// The NameID is used when it is empty, which requires a persistent NameID.
+	SubjectAttribute string `json:"subject_attribute,omitempty"`
+}
+
+// defaultOIDCMapping releases the standard OIDC profile claims.
+var defaultOIDCMapping = map[string]string{
+	"preferred_username": "username",
+	"email":              "email",
+	"phone_number":       "phone",
+}
+
+// defaultSAMLMapping covers the attribute names used by ADFS, Azure AD and
+// most LDAP-backed IdPs.
+var defaultSAMLMapping = map[string]string{
+	"uid":             "username",
+	"username":        "username",
+	"email":           "email",
+	"mail":            "email",
+	"telephoneNumber": "phone",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/upn":          "username",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress": "email",
+}
+
+// upstream is an enabled identity provider with its parsed configuration.
+type upstream struct {
+	provider *types.IdentityProvider
+	config   ProviderConfig
+}
+
+// newUpstream parses and validates an identity provider's configuration.
+func newUpstream(provider *types.IdentityProvider) (*upstream, error) {
+	up := &upstream{provider: provider}
+	if len(provider.Config) > 0 {
+		if err := json.Unmarshal(provider.Config, &up.config); err != nil {
+			return nil, fmt.Errorf("identity provider %s: invalid config: %w", provider.ID, err)
+		}
+	}
+	cfg := &up.config
+	switch provider.Type {
+	case types.ProtocolOIDC:
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("identity provider %s: issuer and client_id are required", provider.ID)
+		}
+		switch cfg.TokenEndpointAuthMethod {
+		case "", "client_secret_basic", "client_secret_post", "none":
+		default:
+			return nil, fmt.Errorf("identity provider %s: unsupported token_endpoint_auth_method %q", provider.ID, cfg.TokenEndpointAuthMethod)
+		}
+	case types.ProtocolSAML:
+		if cfg.MetadataURL == "" && cfg.Metadata == "" && (cfg.EntityID == "" || cfg.SSOURL == "" || cfg.Certificate == "") {
+			return nil, fmt.Errorf("identity provider %s: metadata_url, metadata, or entity_id, sso_url and certificate are required", provider.ID)
+		}
+	default:
+		return nil, fmt.Errorf("identity provider %s: unsupported type %q", provider.ID, provider.Type)
+	}
+	for i, domain := range cfg.Domains {
+		cfg.Domains[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+	}
+	return up, nil
+}
+
+// ValidateProvider checks that an identity provider's configuration can be
+// used for login.
+func ValidateProvider(provider *types.IdentityProvider) error {
+	_, err := newUpstream(provider)
+	return err
+}
+
+// sourceType is the SourceType of the accounts this provider signs in. The
+// provider ID is used, as for directory sync sources, so that renaming a
+// provider keeps its users linked.
+func (up *upstream) sourceType() string {
+	return up.provider.ID
+}
+
+func (up *upstream) mapping() map[string]string {
+	if len(up.config.AttributeMapping) > 0 {
+		return up.config.AttributeMapping
+	}
+	if up.provider.Type == types.ProtocolSAML {
+		return defaultSAMLMapping
+	}
+	return defaultOIDCMapping
+}
+
+// linksEmail reports whether a first-time user with a verified email address
+// is linked to the account with that address. Only addresses in the
+// provider's own domains are, so that a provider cannot take over the
+// accounts of other organizations.
+func (up *upstream) linksEmail(email string) bool {
+	if up.config.LinkByEmail == nil || !*up.config.LinkByEmail {
+		return false
+	}
+	at := strings.LastIndex(email, "@")
+	return at >= 0 && up.servesDomain(email[at+1:])
+}
+
+func (up *upstream) jitProvisioning() bool {
+	return up.config.JITProvisioning == nil || *up.config.JITProvisioning
+}
+
+// servesDomain reports whether home realm discovery sends users of an email
+// domain to this provider.
+func (up *upstream) servesDomain(domain string) bool {
+	for _, d := range up.config.Domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
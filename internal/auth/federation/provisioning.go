@@ -0,0 +1,253 @@
+package federation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// ExternalIdentity is a user as asserted by an upstream identity provider.
+type ExternalIdentity struct {
+	// Subject identifies the user at the provider. It becomes the ExternalID
+	// of the local account.
+	Subject string
+	// Claims holds the OIDC claims or SAML attributes, as strings.
+	Claims map[string][]string
+	// EmailVerified reports whether the provider vouches for the email address.
+	EmailVerified bool
+	// AMR lists the OpenID Connect amr values (RFC 8176) of the upstream
+	// authentication, as the provider reports them.
+	AMR []string
+}
+
+// profile is the part of an ExternalIdentity the attribute mapping releases.
+type profile struct {
+	username   string
+	email      string
+	phone      string
+	attributes map[string]interface{}
+}
+
+// mapProfile applies an attribute mapping to an external identity. Claims are
+// read in name order so that the result does not depend on map iteration when
+// several claims map to the same field.
+func mapProfile(mapping map[string]string, ext *ExternalIdentity) *profile {
+	p := &profile{attributes: map[string]interface{}{}}
+	names := make([]string, 0, len(mapping))
+	for name := range mapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := ext.Claims[name]
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+		switch field := mapping[name]; field {
+		case "username":
+			setOnce(&p.username, values[0])
+		case "email":
+			setOnce(&p.email, strings.ToLower(values[0]))
+		case "phone":
+			setOnce(&p.phone, values[0])
+		case "", "id":
+			// The local ID is never taken from the provider.
+		default:
+			if _, ok := p.attributes[field]; ok {
+				continue
+			}
+			if len(values) == 1 {
+				p.attributes[field] = values[0]
+				continue
+			}
+			// Stored as they read back from the JSON column, so that
+			// applyProfile sees an unchanged list as unchanged.
+			list := make([]interface{}, len(values))
+			for i, v := range values {
+				list[i] = v
+			}
+			p.attributes[field] = list
+		}
+	}
+	return p
+}
+
+func setOnce(dst *string, v string) {
+	if *dst == "" {
+		*dst = v
+	}
+}
+
+// provision returns the local account for an external identity. A returning
+// user is found by SourceType and ExternalID. A first-time user is linked to
+// the account with the same verified email address when the provider is
+// trusted to link by email, or else given a new account when the provider
+// allows just-in-time provisioning.
+func (s *Service) provision(ctx context.Context, up *upstream, ext *ExternalIdentity) (*types.User, error) {
+	if ext.Subject == "" {
+		return nil, types.ErrValidation.WithDetails(map[string]string{"error": "identity provider did not identify the user"})
+	}
+	p := mapProfile(up.mapping(), ext)
+
+	user, err := s.identityDomain.GetUserByExternalID(ctx, ext.Subject, up.sourceType())
+	if err != nil {
+		if !errors.Is(err, types.ErrUserNotFound) {
+			return nil, err
+		}
+		user, err = s.linkOrCreate(ctx, up, ext, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if user.Status != types.UserStatusActive {
+		return nil, types.ErrUserDisabled.WithDetails(map[string]string{"userID": user.ID})
+	}
+
+	if applyProfile(user, p) {
+		if err := s.identityDomain.UpdateUser(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+	// The provider vouches for the address it released. This follows the
+	// profile update, which unverifies a changed address.
+	if ext.EmailVerified && !user.IsEmailVerified() && p.email != "" && strings.EqualFold(string(user.Email), p.email) {
+		user.EmailVerified = true
+		if err := s.identityDomain.UpdateUser(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// linkOrCreate finds or creates the account for a first-time external user.
+func (s *Service) linkOrCreate(ctx context.Context, up *upstream, ext *ExternalIdentity, p *profile) (*types.User, error) {
+	if p.email != "" && ext.EmailVerified && up.linksEmail(p.email) {
+		existing, err := s.identityDomain.GetUserRepo().GetUserByEmail(ctx, p.email)
+		switch {
+		case err == nil:
+			return s.link(ctx, up, ext, existing)
+		case !errors.Is(err, types.ErrUserNotFound):
+			return nil, types.ErrInternal.WithCause(err)
+		}
+	}
+
+	if !up.jitProvisioning() {
+		return nil, types.ErrForbidden.WithDetails(map[string]string{"error": "no account is linked to this identity"})
+	}
+	if p.email == "" {
+		return nil, types.ErrValidation.WithDetails(map[string]string{"error": "identity provider did not release an email address"})
+	}
+	username, err := s.availableUsername(ctx, up, ext, p)
+	if err != nil {
+		return nil, err
+	}
+	// Federated users sign in upstream; the local password is never disclosed.
+	password, err := utils.GenerateRandomPassword(32)
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	user, err := s.identityDomain.CreateUser(ctx, username, p.email, password)
+	if err != nil {
+		return nil, err
+	}
+	user.SourceType = up.sourceType()
+	user.ExternalID = ext.Subject
+	if err := s.identityDomain.UpdateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	s.logger.Info(ctx, "Provisioned federated user",
+		zap.String("user_id", user.ID),
+		zap.String("provider_id", up.provider.ID))
+	return user, nil
+}
+
+// link attaches an external identity to an existing account. An account has a
+// single identity source, so one already linked to a directory or another
+// provider is not taken over.
+func (s *Service) link(ctx context.Context, up *upstream, ext *ExternalIdentity, user *types.User) (*types.User, error) {
+	if user.SourceType != "" || user.ExternalID != "" {
+		return nil, types.ErrConflict.WithDetails(map[string]string{"error": "account is already linked to another identity source"})
+	}
+	user.SourceType = up.sourceType()
+	user.ExternalID = ext.Subject
+	if err := s.identityDomain.UpdateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	s.logger.Info(ctx, "Linked federated identity to existing account",
+		zap.String("user_id", user.ID),
+		zap.String("provider_id", up.provider.ID))
+	return user, nil
+}
+
+// linkSession attaches an external identity to the account of the session that
+// started a linking login. An identity already linked to another account is
+// not moved.
+func (s *Service) linkSession(ctx context.Context, up *upstream, ext *ExternalIdentity, userID string) (*types.User, error) {
+	if ext.Subject == "" {
+		return nil, types.ErrValidation.WithDetails(map[string]string{"error": "identity provider did not identify the user"})
+	}
+	linked, err := s.identityDomain.GetUserByExternalID(ctx, ext.Subject, up.sourceType())
+	switch {
+	case err == nil && linked.ID == userID:
+		return linked, nil
+	case err == nil:
+		return nil, types.ErrConflict.WithDetails(map[string]string{"error": "identity is already linked to another account"})
+	case !errors.Is(err, types.ErrUserNotFound):
+		return nil, err
+	}
+	user, err := s.identityDomain.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.link(ctx, up, ext, user)
+}
+
+// availableUsername picks the username of a new account: the mapped username,
+// else the email address. A name already taken is made unique with a suffix
+// derived from the external identity.
+func (s *Service) availableUsername(ctx context.Context, up *upstream, ext *ExternalIdentity, p *profile) (string, error) {
+	username := p.username
+	if username == "" {
+		username = p.email
+	}
+	_, err := s.identityDomain.GetUserRepo().GetUserByUsername(ctx, username)
+	if errors.Is(err, types.ErrUserNotFound) {
+		return username, nil
+	}
+	if err != nil {
+		return "", types.ErrInternal.WithCause(err)
+	}
+	sum := sha256.Sum256([]byte(up.sourceType() + "\x00" + ext.Subject))
+	return fmt.Sprintf("%s-%s", username, hex.EncodeToString(sum[:4])), nil
+}
+
+// applyProfile copies the mapped phone number and custom attributes onto an
+// account, reporting whether anything changed. Usernames and email addresses
+// are left alone after the account is created.
+func applyProfile(user *types.User, p *profile) bool {
+	changed := false
+	if p.phone != "" && string(user.Phone) != p.phone {
+		user.Phone = types.EncryptedString(p.phone)
+		changed = true
+	}
+	for name, value := range p.attributes {
+		if current, ok := user.Attributes[name]; ok && reflect.DeepEqual(current, value) {
+			continue
+		}
+		if user.Attributes == nil {
+			user.Attributes = map[string]interface{}{}
+		}
+		user.Attributes[name] = value
+		changed = true
+	}
+	return changed
+}
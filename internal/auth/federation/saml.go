@@ -0,0 +1,207 @@
+package federation
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// samlNameIDFormats maps the name_id_format setting to the format requested
+// from the IdP.
+var samlNameIDFormats = map[string]saml.NameIDFormat{
+	"":            saml.PersistentNameIDFormat,
+	"persistent":  saml.PersistentNameIDFormat,
+	"email":       saml.EmailAddressNameIDFormat,
+	"transient":   saml.TransientNameIDFormat,
+	"unspecified": saml.UnspecifiedNameIDFormat,
+}
+
+// samlServiceProvider returns the service provider that signs in to an
+// upstream SAML IdP, with the IdP's metadata.
+func (s *Service) samlServiceProvider(ctx context.Context, up *upstream) (*saml.ServiceProvider, error) {
+	idpMetadata, err := s.samlIDPMetadata(ctx, up)
+	if err != nil {
+		return nil, err
+	}
+	sp, err := s.newSAMLServiceProvider(up)
+	if err != nil {
+		return nil, err
+	}
+	sp.IDPMetadata = idpMetadata
+	return sp, nil
+}
+
+// newSAMLServiceProvider builds the service provider for an upstream SAML IdP.
+// Its entity ID is its metadata URL. AuthnRequests are signed, and encrypted
+// assertions accepted, only when a key is configured.
+func (s *Service) newSAMLServiceProvider(up *upstream) (*saml.ServiceProvider, error) {
+	metadataURL, err := url.Parse(s.endpoint(up, "metadata"))
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(s.endpoint(up, "acs"))
+	if err != nil {
+		return nil, err
+	}
+	format, ok := samlNameIDFormats[up.config.NameIDFormat]
+	if !ok {
+		format = saml.NameIDFormat(up.config.NameIDFormat)
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          metadataURL.String(),
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		HTTPClient:        s.httpClient,
+		AuthnNameIDFormat: format,
+	}
+	if s.spKey != nil {
+		sp.Key = s.spKey
+		sp.Certificate = s.spCert
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+	return sp, nil
+}
+
+// samlIDPMetadata returns the upstream IdP's metadata: fetched from its
+// metadata_url (and cached), parsed from the inline metadata, or built from
+// its entity_id, sso_url and certificate.
+func (s *Service) samlIDPMetadata(ctx context.Context, up *upstream) (*saml.EntityDescriptor, error) {
+	cfg := up.config
+	switch {
+	case cfg.MetadataURL != "":
+		metadataURL, err := url.Parse(cfg.MetadataURL)
+		if err != nil {
+			return nil, err
+		}
+		cached, err := s.cache.get(cfg.MetadataURL, func() (interface{}, error) {
+			return samlsp.FetchMetadata(ctx, s.httpClient, *metadataURL)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return cached.(*saml.EntityDescriptor), nil
+	case cfg.Metadata != "":
+		return samlsp.ParseMetadata([]byte(cfg.Metadata))
+	}
+
+	certificate, err := certificateData(cfg.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	return &saml.EntityDescriptor{
+		EntityID: cfg.EntityID,
+		IDPSSODescriptors: []saml.IDPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{
+				RoleDescriptor: saml.RoleDescriptor{
+					ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+					KeyDescriptors: []saml.KeyDescriptor{{
+						Use: "signing",
+						KeyInfo: saml.KeyInfo{
+							X509Data: saml.X509Data{X509Certificates: []saml.X509Certificate{{Data: certificate}}},
+						},
+					}},
+				},
+			},
+			SingleSignOnServices: []saml.Endpoint{{Binding: saml.HTTPRedirectBinding, Location: cfg.SSOURL}},
+		}},
+	}, nil
+}
+
+// samlIdentity builds the external identity from a verified assertion. The
+// subject is the configured subject attribute or else the NameID, which must
+// then be stable: a transient NameID cannot identify a returning user. SAML
+// has no signal that an email address is verified, so SAML identities are
+// never linked by email.
+func samlIdentity(up *upstream, assertion *saml.Assertion) (*ExternalIdentity, error) {
+	ext := &ExternalIdentity{Claims: map[string][]string{}}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			var values []string
+			for _, v := range attr.Values {
+				values = append(values, v.Value)
+			}
+			ext.Claims[attr.Name] = append(ext.Claims[attr.Name], values...)
+			if attr.FriendlyName != "" && attr.FriendlyName != attr.Name {
+				ext.Claims[attr.FriendlyName] = append(ext.Claims[attr.FriendlyName], values...)
+			}
+		}
+	}
+
+	for _, statement := range assertion.AuthnStatements {
+		if ref := statement.AuthnContext.AuthnContextClassRef; ref != nil {
+			if amr, ok := samlContextAMR[ref.Value]; ok {
+				ext.AMR = append(ext.AMR, amr...)
+			}
+		}
+	}
+
+	var nameID *saml.NameID
+	if assertion.Subject != nil {
+		nameID = assertion.Subject.NameID
+	}
+	if nameID != nil && nameID.Format == string(saml.EmailAddressNameIDFormat) && len(ext.Claims["email"]) == 0 {
+		ext.Claims["email"] = []string{nameID.Value}
+	}
+
+	if up.config.SubjectAttribute != "" {
+		if values := ext.Claims[up.config.SubjectAttribute]; len(values) > 0 {
+			ext.Subject = values[0]
+		}
+		if ext.Subject == "" {
+			return nil, fmt.Errorf("assertion has no %s attribute", up.config.SubjectAttribute)
+		}
+		return ext, nil
+	}
+	if nameID == nil || nameID.Value == "" {
+		return nil, errors.New("assertion has no NameID")
+	}
+	if nameID.Format == string(saml.TransientNameIDFormat) {
+		return nil, errors.New("assertion has a transient NameID; configure subject_attribute")
+	}
+	ext.Subject = nameID.Value
+	return ext, nil
+}
+
+// samlContextAMR maps SAML authentication context classes to amr values.
+// Classes not listed, such as PasswordProtectedTransport, map to nothing and
+// leave the session single-factor.
+var samlContextAMR = map[string][]string{
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:X509":                        {"hwk"},
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:Smartcard":                   {"hwk"},
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:SmartcardPKI":                {"hwk", "pin"},
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken":               {"otp"},
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract":     {"mfa"},
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorUnregistered": {"mfa"},
+	"http://schemas.microsoft.com/claims/multipleauthn":                  {"mfa"},
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// certificateData returns a PEM or base64 DER certificate as the base64 DER
+// used in SAML metadata.
+func certificateData(data string) (string, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(data)); block != nil {
+		der = block.Bytes
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(whitespace.ReplaceAllString(data, ""))
+		if err != nil {
+			return "", fmt.Errorf("certificate is neither PEM nor base64: %w", err)
+		}
+		der = decoded
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		return "", fmt.Errorf("invalid certificate: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
@@ -0,0 +1,677 @@
+// Package federation signs users in through upstream OpenID Connect and SAML
+// identity providers, such as a partner's Azure AD, Okta or ADFS. Providers
+// are stored with auth.IdentityProviderRepository; their users are linked to
+// local accounts, or provisioned just in time, by SourceType and ExternalID.
+package federation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// stateTTL is how long a user has to complete a login at the provider.
+	stateTTL = 10 * time.Minute
+	// stateCookieName binds a login to the browser that started it.
+	stateCookieName = "qid_federation_state"
+	// documentTTL is how long discovery documents, keys and metadata are cached.
+	documentTTL = time.Hour
+	// loginPath is the local login page, used when discovery finds no provider.
+	loginPath = "/auth/login"
+	// defaultRedirect is where users land without a return_to target.
+	defaultRedirect = "/portal/devices"
+)
+
+// AuthMethodFederated is the amr value of sessions established upstream.
+const AuthMethodFederated = "fed"
+
+// Service runs the login flow against upstream identity providers: the
+// redirect to the provider, the callback, provisioning of the local account
+// and the start of its session.
+type Service struct {
+	logger         utils.Logger
+	providers      auth.IdentityProviderRepository
+	identityDomain identity.IService
+	redis          redis.RedisClientInterface
+	sessions       *redis.SessionManager
+	httpClient     *http.Client
+	baseURL        string
+	spKey          *rsa.PrivateKey
+	spCert         *x509.Certificate
+	cache          *documentCache
+}
+
+// NewService creates a federation service whose endpoints live under baseURL,
+// e.g. https://id.example.com/auth/federation.
+func NewService(
+	logger utils.Logger,
+	providers auth.IdentityProviderRepository,
+	identityDomain identity.IService,
+	redisClient redis.RedisClientInterface,
+	sessions *redis.SessionManager,
+	baseURL string,
+) *Service {
+	return &Service{
+		logger:         logger,
+		providers:      providers,
+		identityDomain: identityDomain,
+		redis:          redisClient,
+		sessions:       sessions,
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		cache:          &documentCache{ttl: documentTTL, entries: map[string]cacheEntry{}},
+	}
+}
+
+// SetServiceProviderKey sets the key pair used with upstream SAML IdPs to
+// sign AuthnRequests and decrypt assertions.
+func (s *Service) SetServiceProviderKey(key *rsa.PrivateKey, cert *x509.Certificate) {
+	s.spKey = key
+	s.spCert = cert
+}
+
+// SetHTTPClient sets the client used to reach upstream providers.
+func (s *Service) SetHTTPClient(client *http.Client) {
+	s.httpClient = client
+}
+
+// DiscoverProvider performs home realm discovery: it returns the enabled
+// provider that serves the domain of an email address, or nil if none does.
+func (s *Service) DiscoverProvider(ctx context.Context, email string) (*types.IdentityProvider, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 || at == len(email)-1 {
+		return nil, nil
+	}
+	domain := strings.ToLower(strings.TrimSpace(email[at+1:]))
+	providers, err := s.providers.ListProviders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, provider := range providers {
+		if !provider.Enabled {
+			continue
+		}
+		up, err := newUpstream(provider)
+		if err != nil {
+			s.logger.Warn(ctx, "Skipping misconfigured identity provider", zap.Error(err))
+			continue
+		}
+		if up.servesDomain(domain) {
+			return provider, nil
+		}
+	}
+	return nil, nil
+}
+
+// HandleDiscovery sends a user to the identity provider for their email
+// domain, or to the local login page when there is none.
+func (s *Service) HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	returnTo := localReturnTo(r.URL.Query().Get("return_to"))
+	provider, err := s.DiscoverProvider(r.Context(), email)
+	if err != nil {
+		s.logger.Error(r.Context(), "Home realm discovery failed", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{"login_hint": {email}}
+	if returnTo != "" {
+		query.Set("return_to", returnTo)
+	}
+	if provider == nil {
+		http.Redirect(w, r, loginPath+"?"+query.Encode(), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, s.endpoint(&upstream{provider: provider}, "login")+"?"+query.Encode(), http.StatusFound)
+}
+
+// BeginLogin redirects the user to an identity provider to sign in. The
+// return_to parameter, a local path, is where the user lands afterwards.
+func (s *Service) BeginLogin(w http.ResponseWriter, r *http.Request, providerID string) {
+	ctx := r.Context()
+	up, err := s.upstream(ctx, providerID)
+	if err != nil {
+		s.logger.Warn(ctx, "Federated login to unavailable identity provider", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	state, err := newLoginState(up.provider.ID, localReturnTo(r.URL.Query().Get("return_to")))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	s.begin(w, r, up, state, r.URL.Query().Get("login_hint"))
+}
+
+// BeginLink redirects a signed-in user to an identity provider to link the
+// identity they sign in with there to their account. This is how accounts
+// that are not linked by email are linked. It is meant to be reached by a
+// CSRF protected POST, with return_to in the form.
+func (s *Service) BeginLink(w http.ResponseWriter, r *http.Request, providerID string) {
+	ctx := r.Context()
+	session, err := s.currentSession(r)
+	if err != nil {
+		http.Redirect(w, r, loginPath, http.StatusSeeOther)
+		return
+	}
+	up, err := s.upstream(ctx, providerID)
+	if err != nil {
+		s.logger.Warn(ctx, "Federated link to unavailable identity provider", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	state, err := newLoginState(up.provider.ID, localReturnTo(r.FormValue("return_to")))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	state.LinkUserID = session.UserID
+	state.LinkSessionID = session.ID
+	s.begin(w, r, up, state, "")
+}
+
+// begin saves the login state and sends the user to the provider.
+func (s *Service) begin(w http.ResponseWriter, r *http.Request, up *upstream, state *loginState, loginHint string) {
+	ctx := r.Context()
+	var (
+		target string
+		err    error
+	)
+	switch up.provider.Type {
+	case types.ProtocolOIDC:
+		var meta *oidcMetadata
+		meta, err = s.oidcMetadata(ctx, up)
+		if err == nil {
+			target, err = oidcAuthURL(up, meta, state, s.endpoint(up, "callback"), loginHint)
+		}
+	case types.ProtocolSAML:
+		target, err = s.samlAuthURL(ctx, up, state)
+	}
+	if err != nil {
+		s.logger.Error(ctx, "Failed to start federated login", zap.String("provider_id", up.provider.ID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if err := s.saveState(ctx, state); err != nil {
+		s.logger.Error(ctx, "Failed to save federated login state", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, s.stateCookie(r, state.ID, int(stateTTL/time.Second), up.provider.Type == types.ProtocolSAML))
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// samlAuthURL builds an HTTP-Redirect binding AuthnRequest, remembering its ID
+// so that only a response to it is accepted.
+func (s *Service) samlAuthURL(ctx context.Context, up *upstream, state *loginState) (string, error) {
+	sp, err := s.samlServiceProvider(ctx, up)
+	if err != nil {
+		return "", err
+	}
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", err
+	}
+	state.RequestID = req.ID
+	target, err := req.Redirect(state.ID, sp)
+	if err != nil {
+		return "", err
+	}
+	return target.String(), nil
+}
+
+// HandleOIDCCallback completes a login at an upstream OpenID provider: it
+// redeems the authorization code, verifies the ID token and signs the user in.
+func (s *Service) HandleOIDCCallback(w http.ResponseWriter, r *http.Request, providerID string) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	state, err := s.consumeState(ctx, query.Get("state"), providerID)
+	http.SetCookie(w, s.stateCookie(r, "", -1, false))
+	if err != nil {
+		s.logger.Warn(ctx, "Invalid federated login state", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, "Your sign-in request has expired. Please try again.", http.StatusBadRequest)
+		return
+	}
+	if !boundToBrowser(r, state) {
+		s.logger.Warn(ctx, "Federated login completed in a different browser", zap.String("provider_id", providerID))
+		http.Error(w, "Your sign-in request has expired. Please try again.", http.StatusBadRequest)
+		return
+	}
+	if upstreamErr := query.Get("error"); upstreamErr != "" {
+		s.logger.Info(ctx, "Identity provider declined federated login",
+			zap.String("provider_id", providerID),
+			zap.String("error", upstreamErr),
+			zap.String("error_description", query.Get("error_description")))
+		http.Error(w, "Sign-in was cancelled or denied by your identity provider.", http.StatusUnauthorized)
+		return
+	}
+
+	up, err := s.upstream(ctx, providerID)
+	if err == nil && up.provider.Type != types.ProtocolOIDC {
+		err = fmt.Errorf("identity provider %s is not an OIDC provider", providerID)
+	}
+	if err != nil {
+		s.logger.Warn(ctx, "Federated login to unavailable identity provider", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	ext, err := s.oidcCallback(ctx, up, state, query.Get("code"))
+	if err != nil {
+		s.logger.Warn(ctx, "Federated OIDC login failed", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, "Your identity provider's response could not be verified.", http.StatusBadGateway)
+		return
+	}
+	s.complete(w, r, up, ext, state)
+}
+
+func (s *Service) oidcCallback(ctx context.Context, up *upstream, state *loginState, code string) (*ExternalIdentity, error) {
+	if code == "" {
+		return nil, errors.New("callback has no code")
+	}
+	meta, err := s.oidcMetadata(ctx, up)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := s.oidcExchange(ctx, up, meta, code, state.CodeVerifier, s.endpoint(up, "callback"))
+	if err != nil {
+		return nil, err
+	}
+	claims, err := s.oidcVerifyIDToken(ctx, up, meta, tokens.IDToken, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return s.oidcIdentity(ctx, up, meta, tokens, claims)
+}
+
+// HandleSAMLACS is the assertion consumer service for an upstream SAML IdP.
+// Only responses to an AuthnRequest we sent, posted by the browser that sent
+// it, are accepted; IdP-initiated logins are not supported.
+func (s *Service) HandleSAMLACS(w http.ResponseWriter, r *http.Request, providerID string) {
+	ctx := r.Context()
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	state, err := s.consumeState(ctx, r.PostForm.Get("RelayState"), providerID)
+	http.SetCookie(w, s.stateCookie(r, "", -1, true))
+	if err != nil {
+		s.logger.Warn(ctx, "Invalid federated login state", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, "Your sign-in request has expired. Please try again.", http.StatusBadRequest)
+		return
+	}
+	if !boundToBrowser(r, state) {
+		s.logger.Warn(ctx, "Federated login completed in a different browser", zap.String("provider_id", providerID))
+		http.Error(w, "Your sign-in request has expired. Please try again.", http.StatusBadRequest)
+		return
+	}
+	up, err := s.upstream(ctx, providerID)
+	if err == nil && up.provider.Type != types.ProtocolSAML {
+		err = fmt.Errorf("identity provider %s is not a SAML provider", providerID)
+	}
+	if err != nil {
+		s.logger.Warn(ctx, "Federated login to unavailable identity provider", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	sp, err := s.samlServiceProvider(ctx, up)
+	if err != nil {
+		s.logger.Error(ctx, "Failed to load SAML identity provider", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	assertion, err := sp.ParseResponse(r, []string{state.RequestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		s.logger.Warn(ctx, "Rejected SAML response", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, "Your identity provider's response could not be verified.", http.StatusBadRequest)
+		return
+	}
+	ext, err := samlIdentity(up, assertion)
+	if err != nil {
+		s.logger.Warn(ctx, "Unusable SAML assertion", zap.String("provider_id", providerID), zap.Error(err))
+		http.Error(w, "Your identity provider's response could not be verified.", http.StatusBadRequest)
+		return
+	}
+	s.complete(w, r, up, ext, state)
+}
+
+// HandleSAMLMetadata serves the metadata of the service provider that signs
+// in to an upstream SAML IdP, for registering it there.
+func (s *Service) HandleSAMLMetadata(w http.ResponseWriter, r *http.Request, providerID string) {
+	up, err := s.upstream(r.Context(), providerID)
+	if err != nil || up.provider.Type != types.ProtocolSAML {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	sp, err := s.newSAMLServiceProvider(up)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	buf, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(buf)
+}
+
+// complete provisions the local account for an external identity, starts its
+// session and returns the user to where the login began. A linking login
+// instead links the identity to the account that started it.
+func (s *Service) complete(w http.ResponseWriter, r *http.Request, up *upstream, ext *ExternalIdentity, state *loginState) {
+	ctx := r.Context()
+	returnTo := state.ReturnTo
+	if returnTo == "" {
+		returnTo = defaultRedirect
+	}
+	if state.LinkUserID != "" {
+		s.completeLink(w, r, up, ext, state, returnTo)
+		return
+	}
+
+	user, err := s.provision(ctx, up, ext)
+	if err != nil {
+		status, message := provisioningFailure(err)
+		s.logger.Warn(ctx, "Federated login refused",
+			zap.String("provider_id", up.provider.ID),
+			zap.String("external_id", ext.Subject),
+			zap.Error(err))
+		http.Error(w, message, status)
+		return
+	}
+
+	amr, acr := sessionAuthentication(up, ext)
+	session, err := s.sessions.CreateSession(ctx, user.ID, r, redis.WithAuthentication(amr, acr))
+	if err != nil {
+		s.logger.Error(ctx, "Failed to create session", zap.String("user_id", user.ID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     redis.SessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	s.logger.Info(ctx, "Federated login succeeded",
+		zap.String("user_id", user.ID),
+		zap.String("provider_id", up.provider.ID))
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// completeLink links an external identity to the account that started the
+// linking login. The login state is bound to the browser that started it, so
+// the account is taken from there rather than from the session cookie, which
+// a SAML response posted across sites does not carry. The session that started
+// the link must still be valid.
+func (s *Service) completeLink(w http.ResponseWriter, r *http.Request, up *upstream, ext *ExternalIdentity, state *loginState, returnTo string) {
+	ctx := r.Context()
+	userID := state.LinkUserID
+	session, err := s.sessions.GetSession(ctx, state.LinkSessionID, r)
+	if err != nil || session.UserID != userID {
+		s.logger.Warn(ctx, "Federated link completed outside the session that started it",
+			zap.String("provider_id", up.provider.ID),
+			zap.String("user_id", userID))
+		http.Error(w, "Sign in again to link your account.", http.StatusForbidden)
+		return
+	}
+	if _, err := s.linkSession(ctx, up, ext, userID); err != nil {
+		status, message := provisioningFailure(err)
+		if errors.Is(err, types.ErrConflict) {
+			message = "This identity is already linked to another account."
+		}
+		s.logger.Warn(ctx, "Federated link refused",
+			zap.String("provider_id", up.provider.ID),
+			zap.String("user_id", userID),
+			zap.Error(err))
+		http.Error(w, message, status)
+		return
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// currentSession returns the session of the browser's session cookie.
+func (s *Service) currentSession(r *http.Request) (*types.UserSession, error) {
+	cookie, err := r.Cookie(redis.SessionCookieName)
+	if err != nil {
+		return nil, err
+	}
+	return s.sessions.GetSession(r.Context(), cookie.Value, r)
+}
+
+// provisioningFailure turns a provisioning error into what the user is told.
+func provisioningFailure(err error) (int, string) {
+	switch {
+	case errors.Is(err, types.ErrForbidden), errors.Is(err, types.ErrUserDisabled):
+		return http.StatusForbidden, "Your account is not permitted to sign in here."
+	case errors.Is(err, types.ErrConflict):
+		return http.StatusConflict, "An account with your email address already exists. Sign in to it and link your identity provider from there."
+	case errors.Is(err, types.ErrValidation):
+		return http.StatusBadRequest, "Your identity provider did not release the details needed to sign you in."
+	}
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+}
+
+// upstream loads an enabled identity provider.
+func (s *Service) upstream(ctx context.Context, providerID string) (*upstream, error) {
+	provider, err := s.providers.GetProviderByID(ctx, providerID)
+	if err != nil {
+		return nil, err
+	}
+	if !provider.Enabled {
+		return nil, types.ErrNotFound.WithDetails(map[string]string{"id": providerID})
+	}
+	return newUpstream(provider)
+}
+
+// endpoint returns the URL of one of a provider's federation endpoints.
+func (s *Service) endpoint(up *upstream, name string) string {
+	return s.baseURL + "/" + url.PathEscape(up.provider.ID) + "/" + name
+}
+
+// stateCookie returns the cookie that binds a login state to the browser.
+// SAML responses are posted to the ACS from the IdP's site, so for them the
+// cookie must be sent cross-site, which browsers only allow for Secure cookies.
+func (s *Service) stateCookie(r *http.Request, value string, maxAge int, crossSite bool) *http.Cookie {
+	path := "/"
+	if u, err := url.Parse(s.baseURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	cookie := &http.Cookie{
+		Name:     stateCookieName,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if crossSite {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+// boundToBrowser reports whether the request comes from the browser that
+// started the login, so that a response cannot be completed in another.
+func boundToBrowser(r *http.Request, state *loginState) bool {
+	cookie, err := r.Cookie(stateCookieName)
+	return err == nil && cookie.Value == state.ID
+}
+
+// loginState is what a login remembers while the user is at the provider.
+type loginState struct {
+	ID           string `json:"-"`
+	ProviderID   string `json:"provider_id"`
+	ReturnTo     string `json:"return_to,omitempty"`
+	Nonce        string `json:"nonce,omitempty"`
+	CodeVerifier string `json:"code_verifier,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+	// LinkUserID is the account a linking login links to, and LinkSessionID
+	// the session it was started from.
+	LinkUserID    string `json:"link_user_id,omitempty"`
+	LinkSessionID string `json:"link_session_id,omitempty"`
+}
+
+func newLoginState(providerID, returnTo string) (*loginState, error) {
+	state := &loginState{ProviderID: providerID, ReturnTo: returnTo}
+	for _, field := range []*string{&state.ID, &state.Nonce, &state.CodeVerifier} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		*field = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return state, nil
+}
+
+func stateKey(id string) string {
+	return "federation_state:" + id
+}
+
+func (s *Service) saveState(ctx context.Context, state *loginState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.redis.Set(ctx, stateKey(state.ID), data, stateTTL)
+}
+
+// consumeState fetches and deletes a login state, so that each can complete
+// one login, and checks that it belongs to the provider.
+func (s *Service) consumeState(ctx context.Context, id, providerID string) (*loginState, error) {
+	if id == "" {
+		return nil, errors.New("missing state")
+	}
+	data, err := s.redis.Client().GetDel(ctx, stateKey(id)).Result()
+	if err != nil {
+		if errors.Is(err, goredis.Nil) {
+			return nil, errors.New("unknown or expired state")
+		}
+		return nil, err
+	}
+	var state loginState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, err
+	}
+	if state.ProviderID != providerID {
+		return nil, fmt.Errorf("state was issued for provider %s", state.ProviderID)
+	}
+	state.ID = id
+	return &state, nil
+}
+
+// localReturnTo only allows local, path-absolute return targets so that the
+// login flow cannot be used as an open redirect.
+func localReturnTo(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return ""
+	}
+	return target
+}
+
+// documentCache holds documents fetched from upstream providers.
+type documentCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// get returns the cached document for key, loading it when it is missing or stale.
+func (c *documentCache) get(key string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return value, nil
+}
+
+func (c *documentCache) forget(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+// sessionAuthentication returns the amr and acr of a federated session. The
+// upstream amr values count only for providers trusted to report them;
+// otherwise upstream MFA is not visible to us and the session is
+// single-factor.
+func sessionAuthentication(up *upstream, ext *ExternalIdentity) ([]string, string) {
+	amr := []string{AuthMethodFederated}
+	if !up.config.TrustUpstreamAMR {
+		return amr, mfa.ACRPassword
+	}
+	acr := mfa.ACRPassword
+	for _, method := range ext.AMR {
+		switch method {
+		case "hwk":
+			acr = mfa.ACRPhishingResistant
+		case "mfa", "otp", "sms", "swk":
+			if acr == mfa.ACRPassword {
+				acr = mfa.ACRMFA
+			}
+		default:
+			continue
+		}
+		if !hasString(amr, method) {
+			amr = append(amr, method)
+		}
+	}
+	return amr, acr
+}
+
+func hasString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
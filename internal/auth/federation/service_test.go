@@ -0,0 +1,691 @@
+package federation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/crewjam/saml"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	samlidp "github.com/turtacn/QuantaID/internal/protocols/saml"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+type fakeProviderRepository struct {
+	auth.IdentityProviderRepository
+	providers []*types.IdentityProvider
+}
+
+func (f *fakeProviderRepository) GetProviderByID(ctx context.Context, id string) (*types.IdentityProvider, error) {
+	for _, p := range f.providers {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return nil, types.ErrNotFound
+}
+
+func (f *fakeProviderRepository) ListProviders(ctx context.Context) ([]*types.IdentityProvider, error) {
+	return f.providers, nil
+}
+
+// testEnv is a QuantaID server with federation endpoints and a /done page.
+type testEnv struct {
+	server    *httptest.Server
+	service   *Service
+	providers *fakeProviderRepository
+	users     *memory.IdentityMemoryRepository
+	sessions  *redis.SessionManager
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	mr := miniredis.RunT(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+	env := &testEnv{
+		providers: &fakeProviderRepository{},
+		users:     memory.NewIdentityMemoryRepository(),
+		sessions: redis.NewSessionManager(client, redis.SessionConfig{DefaultTTL: time.Hour}, zap.NewNop(),
+			&redis.GoogleUUIDGenerator{}, &redis.RealClock{}, redis.NewMetrics("federation_test", prometheus.NewRegistry())),
+	}
+	logger := utils.NewZapLoggerWrapper(zap.NewNop())
+	identityService := identity.NewService(env.users, env.users, utils.NewCryptoManager("test-secret"), logger)
+
+	router := mux.NewRouter()
+	env.server = httptest.NewServer(router)
+	t.Cleanup(env.server.Close)
+	env.service = NewService(logger, env.providers, identityService, client, env.sessions, env.server.URL+"/auth/federation")
+
+	router.HandleFunc("/auth/federation/discover", env.service.HandleDiscovery)
+	router.HandleFunc("/auth/federation/{id}/login", func(w http.ResponseWriter, r *http.Request) {
+		env.service.BeginLogin(w, r, mux.Vars(r)["id"])
+	})
+	router.HandleFunc("/auth/federation/{id}/link", func(w http.ResponseWriter, r *http.Request) {
+		env.service.BeginLink(w, r, mux.Vars(r)["id"])
+	})
+	router.HandleFunc("/auth/federation/{id}/callback", func(w http.ResponseWriter, r *http.Request) {
+		env.service.HandleOIDCCallback(w, r, mux.Vars(r)["id"])
+	})
+	router.HandleFunc("/auth/federation/{id}/acs", func(w http.ResponseWriter, r *http.Request) {
+		env.service.HandleSAMLACS(w, r, mux.Vars(r)["id"])
+	})
+	router.HandleFunc("/auth/federation/{id}/metadata", func(w http.ResponseWriter, r *http.Request) {
+		env.service.HandleSAMLMetadata(w, r, mux.Vars(r)["id"])
+	})
+	router.HandleFunc(loginPath, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("login"))
+	})
+	router.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("done"))
+	})
+	return env
+}
+
+func (env *testEnv) addProvider(t *testing.T, id string, typ types.ProtocolType, cfg ProviderConfig) {
+	raw, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	env.providers.providers = append(env.providers.providers, &types.IdentityProvider{ID: id, Name: id, Type: typ, Enabled: true, Config: raw})
+}
+
+// sessionUser returns the user signed in to env in the browser's cookie jar.
+func (env *testEnv) sessionUser(t *testing.T, browser *http.Client) *types.UserSession {
+	u, _ := url.Parse(env.server.URL)
+	for _, c := range browser.Jar.Cookies(u) {
+		if c.Name == redis.SessionCookieName {
+			session, err := env.sessions.GetSession(context.Background(), c.Value, httptest.NewRequest("GET", "/", nil))
+			require.NoError(t, err)
+			return session
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return &http.Client{Jar: jar}
+}
+
+// fakeOIDC is an upstream OpenID provider that signs in whoever is in claims.
+type fakeOIDC struct {
+	server     *httptest.Server
+	key        *rsa.PrivateKey
+	claims     jwt.MapClaims
+	userinfo   map[string]interface{}
+	challenges map[string]string
+	nonces     map[string]string
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	op := &fakeOIDC{key: key, challenges: map[string]string{}, nonces: map[string]string{}}
+	router := http.NewServeMux()
+	op.server = httptest.NewServer(router)
+	t.Cleanup(op.server.Close)
+
+	router.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 op.server.URL,
+			"authorization_endpoint": op.server.URL + "/authorize",
+			"token_endpoint":         op.server.URL + "/token",
+			"jwks_uri":               op.server.URL + "/jwks",
+			"userinfo_endpoint":      op.server.URL + "/userinfo",
+		})
+	})
+	router.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, "client-1", q.Get("client_id"))
+		assert.Equal(t, "S256", q.Get("code_challenge_method"))
+		code := "code-" + q.Get("state")[:8]
+		op.challenges[code] = q.Get("code_challenge")
+		op.nonces[code] = q.Get("nonce")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	router.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		code := r.PostFormValue("code")
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != "client-1" || secret != "secret-1" || op.challenges[code] != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":   op.server.URL,
+			"aud":   "client-1",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": op.nonces[code],
+		}
+		for k, v := range op.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		idToken, err := token.SignedString(op.key)
+		require.NoError(t, err)
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "at-" + code, "id_token": idToken, "token_type": "Bearer"})
+	})
+	router.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &op.key.PublicKey, KeyID: "k1", Algorithm: "RS256", Use: "sig"}}})
+	})
+	router.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		info := map[string]interface{}{"sub": op.claims["sub"]}
+		for k, v := range op.userinfo {
+			info[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(info)
+	})
+	return op
+}
+
+func (op *fakeOIDC) config() ProviderConfig {
+	return ProviderConfig{
+		Issuer:           op.server.URL,
+		ClientID:         "client-1",
+		ClientSecret:     "secret-1",
+		Domains:          []string{"contoso.com"},
+		AttributeMapping: map[string]string{"preferred_username": "username", "email": "email", "phone_number": "phone", "dept": "department"},
+	}
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	env := newTestEnv(t)
+	op := newFakeOIDC(t)
+	env.addProvider(t, "azure", types.ProtocolOIDC, op.config())
+	op.claims = jwt.MapClaims{"sub": "azure-sub-1", "preferred_username": "carol", "email": "Carol@contoso.com", "email_verified": true, "dept": "sales"}
+	op.userinfo = map[string]interface{}{"phone_number": "+15551234"}
+
+	browser := newBrowser(t)
+	resp, err := browser.Get(env.server.URL + "/auth/federation/azure/login?return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/done", resp.Request.URL.Path)
+
+	user, err := env.users.GetUserByExternalID(context.Background(), "azure-sub-1", "azure")
+	require.NoError(t, err)
+	assert.Equal(t, "carol", user.Username)
+	assert.Equal(t, "carol@contoso.com", string(user.Email))
+	assert.Equal(t, "+15551234", string(user.Phone))
+	assert.Equal(t, "sales", user.Attributes["department"])
+
+	session := env.sessionUser(t, browser)
+	assert.Equal(t, user.ID, session.UserID)
+	assert.Equal(t, []string{AuthMethodFederated}, session.AuthMethods)
+
+	// A returning user signs in to the same account, with refreshed attributes.
+	op.claims["dept"] = "marketing"
+	browser = newBrowser(t)
+	resp, err = browser.Get(env.server.URL + "/auth/federation/azure/login?return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, user.ID, env.sessionUser(t, browser).UserID)
+	assert.Equal(t, "marketing", user.Attributes["department"])
+}
+
+func TestOIDCLoginTakesACRFromTrustedAMR(t *testing.T) {
+	env := newTestEnv(t)
+	op := newFakeOIDC(t)
+	trusted := op.config()
+	trusted.TrustUpstreamAMR = true
+	env.addProvider(t, "azure", types.ProtocolOIDC, trusted)
+	env.addProvider(t, "okta", types.ProtocolOIDC, op.config())
+	op.claims = jwt.MapClaims{"sub": "azure-sub-3", "email": "frank@contoso.com", "amr": []string{"pwd", "hwk"}}
+
+	browser := newBrowser(t)
+	resp, err := browser.Get(env.server.URL + "/auth/federation/azure/login?return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	session := env.sessionUser(t, browser)
+	assert.Equal(t, []string{AuthMethodFederated, "hwk"}, session.AuthMethods)
+	assert.Equal(t, mfa.ACRPhishingResistant, session.ACR)
+
+	// A provider not trusted to report amr yields a single-factor session.
+	op.claims = jwt.MapClaims{"sub": "okta-grace", "email": "grace@contoso.com", "amr": []string{"pwd", "hwk"}}
+	browser = newBrowser(t)
+	resp, err = browser.Get(env.server.URL + "/auth/federation/okta/login?return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	session = env.sessionUser(t, browser)
+	assert.Equal(t, []string{AuthMethodFederated}, session.AuthMethods)
+	assert.Equal(t, mfa.ACRPassword, session.ACR)
+}
+
+func TestOIDCLoginLinksAccountByVerifiedEmail(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	op := newFakeOIDC(t)
+	cfg := op.config()
+	env.addProvider(t, "default", types.ProtocolOIDC, cfg)
+	linkByEmail := true
+	cfg.LinkByEmail = &linkByEmail
+	env.addProvider(t, "okta", types.ProtocolOIDC, cfg)
+	existing := &types.User{Username: "dave", Email: "dave@contoso.com", Status: types.UserStatusActive}
+	require.NoError(t, env.users.CreateUser(ctx, existing))
+	admin := &types.User{Username: "admin", Email: "admin@quantaid.example", Status: types.UserStatusActive}
+	require.NoError(t, env.users.CreateUser(ctx, admin))
+	login := func(provider string) *http.Response {
+		resp, err := newBrowser(t).Get(env.server.URL + "/auth/federation/" + provider + "/login")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// Providers do not link by email unless configured to.
+	op.claims = jwt.MapClaims{"sub": "okta-dave", "email": "dave@contoso.com", "email_verified": true}
+	assert.Equal(t, http.StatusConflict, login("default").StatusCode)
+	assert.Empty(t, existing.ExternalID)
+
+	// An unverified address does not take over the account.
+	op.claims["email_verified"] = false
+	assert.Equal(t, http.StatusConflict, login("okta").StatusCode)
+	assert.Empty(t, existing.ExternalID)
+
+	// Nor does a verified address outside the provider's domains.
+	op.claims = jwt.MapClaims{"sub": "okta-admin", "email": "admin@quantaid.example", "email_verified": true}
+	assert.Equal(t, http.StatusConflict, login("okta").StatusCode)
+	assert.Empty(t, admin.ExternalID)
+
+	op.claims = jwt.MapClaims{"sub": "okta-dave", "email": "dave@contoso.com", "email_verified": true}
+	browser := newBrowser(t)
+	resp, err := browser.Get(env.server.URL + "/auth/federation/okta/login?return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, existing.ID, env.sessionUser(t, browser).UserID)
+	assert.Equal(t, "okta", existing.SourceType)
+	assert.Equal(t, "okta-dave", existing.ExternalID)
+}
+
+func TestOIDCLinkFromSession(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	op := newFakeOIDC(t)
+	env.addProvider(t, "partner", types.ProtocolOIDC, op.config())
+	erin := &types.User{Username: "erin", Email: "erin@example.com", Status: types.UserStatusActive}
+	require.NoError(t, env.users.CreateUser(ctx, erin))
+	op.claims = jwt.MapClaims{"sub": "partner-erin", "email": "erin@partner.example"}
+
+	// Linking needs a session.
+	resp, err := newBrowser(t).PostForm(env.server.URL+"/auth/federation/partner/link", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, loginPath, resp.Request.URL.Path)
+
+	browser := newBrowser(t)
+	session, err := env.sessions.CreateSession(ctx, erin.ID, httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	u, _ := url.Parse(env.server.URL)
+	browser.Jar.SetCookies(u, []*http.Cookie{{Name: redis.SessionCookieName, Value: session.ID}})
+
+	resp, err = browser.PostForm(env.server.URL+"/auth/federation/partner/link", url.Values{"return_to": {"/done"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/done", resp.Request.URL.Path)
+	assert.Equal(t, "partner", erin.SourceType)
+	assert.Equal(t, "partner-erin", erin.ExternalID)
+
+	// The identity now signs in to the linked account.
+	browser = newBrowser(t)
+	resp, err = browser.Get(env.server.URL + "/auth/federation/partner/login?return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, erin.ID, env.sessionUser(t, browser).UserID)
+}
+
+func TestOIDCLoginWithoutProvisioning(t *testing.T) {
+	env := newTestEnv(t)
+	op := newFakeOIDC(t)
+	cfg := op.config()
+	disabled := false
+	cfg.JITProvisioning = &disabled
+	env.addProvider(t, "azure", types.ProtocolOIDC, cfg)
+	op.claims = jwt.MapClaims{"sub": "stranger", "email": "stranger@contoso.com", "email_verified": true}
+
+	resp, err := newBrowser(t).Get(env.server.URL + "/auth/federation/azure/login")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestOIDCCallbackIsBoundToBrowserAndUsedOnce(t *testing.T) {
+	env := newTestEnv(t)
+	op := newFakeOIDC(t)
+	env.addProvider(t, "azure", types.ProtocolOIDC, op.config())
+	op.claims = jwt.MapClaims{"sub": "azure-sub-2", "email": "erin@contoso.com", "email_verified": true}
+
+	// Stop at the callback, as an attacker capturing it would.
+	browser := newBrowser(t)
+	browser.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host == op.server.Listener.Addr().String() {
+			return nil
+		}
+		return http.ErrUseLastResponse
+	}
+	resp, err := browser.Get(env.server.URL + "/auth/federation/azure/login?return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	require.Contains(t, callback, "/auth/federation/azure/callback?")
+
+	resp, err = newBrowser(t).Get(callback)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "callback from another browser")
+
+	resp, err = browser.Get(callback)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "state was consumed by the first attempt")
+
+	resp, err = newBrowser(t).Get(env.server.URL + "/auth/federation/azure/callback?state=forged&code=x")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// fakeSAMLIdP is an upstream SAML IdP that signs in whoever is in session.
+type fakeSAMLIdP struct {
+	idp        *saml.IdentityProvider
+	server     *httptest.Server
+	spMetadata *saml.EntityDescriptor
+	session    *saml.Session
+}
+
+func (f *fakeSAMLIdP) GetServiceProvider(r *http.Request, id string) (*saml.EntityDescriptor, error) {
+	if f.spMetadata == nil || f.spMetadata.EntityID != id {
+		return nil, os.ErrNotExist
+	}
+	return f.spMetadata, nil
+}
+
+func (f *fakeSAMLIdP) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	return f.session
+}
+
+func newFakeSAMLIdP(t *testing.T) *fakeSAMLIdP {
+	f := &fakeSAMLIdP{}
+	mux := http.NewServeMux()
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	key, cert, err := samlidp.GenerateKeyPair("upstream", time.Hour)
+	require.NoError(t, err)
+	metadataURL, _ := url.Parse(f.server.URL + "/metadata")
+	ssoURL, _ := url.Parse(f.server.URL + "/sso")
+	f.idp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: f,
+		SessionProvider:         f,
+	}
+	mux.HandleFunc("/sso", f.idp.ServeSSO)
+	return f
+}
+
+var formField = regexp.MustCompile(`name="(\w+)" value="([^"]*)"`)
+var formAction = regexp.MustCompile(`action="([^"]+)"`)
+
+// submitForm posts the auto-submitting form of a SAML POST binding page.
+func submitForm(t *testing.T, browser *http.Client, page *http.Response) *http.Response {
+	defer page.Body.Close()
+	body, err := io.ReadAll(page.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, page.StatusCode, string(body))
+	action := formAction.FindStringSubmatch(string(body))
+	require.NotNil(t, action, string(body))
+	form := url.Values{}
+	for _, field := range formField.FindAllStringSubmatch(string(body), -1) {
+		form.Set(field[1], html.UnescapeString(field[2]))
+	}
+	resp, err := browser.PostForm(html.UnescapeString(action[1]), form)
+	require.NoError(t, err)
+	return resp
+}
+
+// addSAMLProvider registers a fake SAML IdP with env, and env's service
+// provider with the IdP.
+func (env *testEnv) addSAMLProvider(t *testing.T, id string) *fakeSAMLIdP {
+	upstreamIdP := newFakeSAMLIdP(t)
+	metadata, err := xml.Marshal(upstreamIdP.idp.Metadata())
+	require.NoError(t, err)
+	env.addProvider(t, id, types.ProtocolSAML, ProviderConfig{
+		Metadata: string(metadata),
+		AttributeMapping: map[string]string{
+			"uid":        "username",
+			"mail":       "email",
+			"department": "department",
+		},
+	})
+	// Sign requests and have the IdP encrypt its assertions.
+	spKey, spCert, err := samlidp.GenerateKeyPair("sp", time.Hour)
+	require.NoError(t, err)
+	env.service.SetServiceProviderKey(spKey, spCert)
+
+	resp, err := http.Get(env.server.URL + "/auth/federation/" + id + "/metadata")
+	require.NoError(t, err)
+	spMetadata, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	upstreamIdP.spMetadata = &saml.EntityDescriptor{}
+	require.NoError(t, xml.Unmarshal(spMetadata, upstreamIdP.spMetadata))
+	return upstreamIdP
+}
+
+func TestSAMLLoginProvisionsUser(t *testing.T) {
+	env := newTestEnv(t)
+	upstreamIdP := env.addSAMLProvider(t, "adfs")
+	assert.Equal(t, env.server.URL+"/auth/federation/adfs/metadata", upstreamIdP.spMetadata.EntityID)
+
+	upstreamIdP.session = &saml.Session{
+		ID:           "s1",
+		CreateTime:   time.Now(),
+		ExpireTime:   time.Now().Add(time.Hour),
+		Index:        "1",
+		NameID:       "S-1-5-21-frank",
+		NameIDFormat: string(saml.PersistentNameIDFormat),
+		UserName:     "frank",
+		UserEmail:    "frank@fabrikam.com",
+		CustomAttributes: []saml.Attribute{{
+			Name:   "department",
+			Values: []saml.AttributeValue{{Type: "xs:string", Value: "finance"}},
+		}},
+	}
+
+	browser := newBrowser(t)
+	page, err := browser.Get(env.server.URL + "/auth/federation/adfs/login?return_to=/done")
+	require.NoError(t, err)
+	resp := submitForm(t, browser, page)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/done", resp.Request.URL.Path)
+
+	user, err := env.users.GetUserByExternalID(context.Background(), "S-1-5-21-frank", "adfs")
+	require.NoError(t, err)
+	assert.Equal(t, "frank", user.Username)
+	assert.Equal(t, "frank@fabrikam.com", string(user.Email))
+	assert.Equal(t, "finance", user.Attributes["department"])
+	assert.Equal(t, user.ID, env.sessionUser(t, browser).UserID)
+
+	// A response is only accepted from the browser that started the login,
+	// so it cannot be posted into a victim's browser, and only once.
+	page, err = browser.Get(env.server.URL + "/auth/federation/adfs/login")
+	require.NoError(t, err)
+	defer page.Body.Close()
+	body, _ := io.ReadAll(page.Body)
+	form := url.Values{}
+	for _, field := range formField.FindAllStringSubmatch(string(body), -1) {
+		form.Set(field[1], html.UnescapeString(field[2]))
+	}
+	resp, err = newBrowser(t).PostForm(env.server.URL+"/auth/federation/adfs/acs", form)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "response posted from another browser")
+
+	resp, err = browser.PostForm(env.server.URL+"/auth/federation/adfs/acs", form)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "state was consumed by the first attempt")
+}
+
+func TestSAMLLinkFromSession(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	upstreamIdP := env.addSAMLProvider(t, "adfs")
+	erin := &types.User{Username: "erin", Email: "erin@example.com", Status: types.UserStatusActive}
+	require.NoError(t, env.users.CreateUser(ctx, erin))
+	upstreamIdP.session = &saml.Session{
+		ID:           "s1",
+		CreateTime:   time.Now(),
+		ExpireTime:   time.Now().Add(time.Hour),
+		Index:        "1",
+		NameID:       "S-1-5-21-erin",
+		NameIDFormat: string(saml.PersistentNameIDFormat),
+		UserEmail:    "erin@fabrikam.com",
+	}
+
+	browser := newBrowser(t)
+	session, err := env.sessions.CreateSession(ctx, erin.ID, httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	u, _ := url.Parse(env.server.URL)
+	browser.Jar.SetCookies(u, []*http.Cookie{{Name: redis.SessionCookieName, Value: session.ID}})
+
+	// The state cookie must reach the ACS in the IdP's cross-site POST.
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := browser.PostForm(env.server.URL+"/auth/federation/adfs/link", url.Values{"return_to": {"/done"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	var stateCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == stateCookieName {
+			stateCookie = c
+		}
+	}
+	require.NotNil(t, stateCookie)
+	assert.Equal(t, http.SameSiteNoneMode, stateCookie.SameSite)
+	assert.True(t, stateCookie.Secure)
+
+	browser.CheckRedirect = nil
+	page, err := browser.Get(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	// Browsers leave the SameSite=Lax session cookie off that POST.
+	browser.Jar.SetCookies(u, []*http.Cookie{{Name: redis.SessionCookieName, MaxAge: -1}})
+	resp = submitForm(t, browser, page)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/done", resp.Request.URL.Path)
+	assert.Equal(t, "adfs", erin.SourceType)
+	assert.Equal(t, "S-1-5-21-erin", erin.ExternalID)
+
+	// A link started from a session that has since ended is refused.
+	other := &types.User{Username: "frank", Email: "frank@example.com", Status: types.UserStatusActive}
+	require.NoError(t, env.users.CreateUser(ctx, other))
+	upstreamIdP.session.NameID = "S-1-5-21-frank"
+	browser = newBrowser(t)
+	session, err = env.sessions.CreateSession(ctx, other.ID, httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	browser.Jar.SetCookies(u, []*http.Cookie{{Name: redis.SessionCookieName, Value: session.ID}})
+	page, err = browser.PostForm(env.server.URL+"/auth/federation/adfs/link", nil)
+	require.NoError(t, err)
+	require.NoError(t, env.sessions.DeleteSession(ctx, other.ID, session.ID))
+	resp = submitForm(t, browser, page)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, other.ExternalID)
+}
+
+func TestSAMLLoginRejectsTransientNameID(t *testing.T) {
+	up := &upstream{provider: &types.IdentityProvider{ID: "adfs", Type: types.ProtocolSAML}}
+	_, err := samlIdentity(up, &saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{
+		Format: string(saml.TransientNameIDFormat), Value: "_abc",
+	}}})
+	assert.Error(t, err)
+
+	up.config.SubjectAttribute = "objectGUID"
+	ext, err := samlIdentity(up, &saml.Assertion{
+		Subject: &saml.Subject{NameID: &saml.NameID{Format: string(saml.TransientNameIDFormat), Value: "_abc"}},
+		AttributeStatements: []saml.AttributeStatement{{Attributes: []saml.Attribute{{
+			Name: "objectGUID", Values: []saml.AttributeValue{{Value: "guid-1"}},
+		}}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "guid-1", ext.Subject)
+}
+
+func TestHomeRealmDiscovery(t *testing.T) {
+	env := newTestEnv(t)
+	op := newFakeOIDC(t)
+	env.addProvider(t, "azure", types.ProtocolOIDC, op.config())
+	browser := newBrowser(t)
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	resp, err := browser.Get(env.server.URL + "/auth/federation/discover?email=gina@Contoso.com&return_to=/done")
+	require.NoError(t, err)
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/auth/federation/azure/login", location.Path)
+	assert.Equal(t, "gina@Contoso.com", location.Query().Get("login_hint"))
+	assert.Equal(t, "/done", location.Query().Get("return_to"))
+
+	resp, err = browser.Get(env.server.URL + "/auth/federation/discover?email=gina@example.org&return_to=//evil.example")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "/auth/login?login_hint=gina%40example.org", resp.Header.Get("Location"))
+}
+
+func TestValidateProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     types.ProtocolType
+		config  string
+		wantErr bool
+	}{
+		{"oidc", types.ProtocolOIDC, `{"issuer":"https://login.example.com","client_id":"c"}`, false},
+		{"oidc without client", types.ProtocolOIDC, `{"issuer":"https://login.example.com"}`, true},
+		{"oidc bad auth method", types.ProtocolOIDC, `{"issuer":"https://i","client_id":"c","token_endpoint_auth_method":"private_key_jwt"}`, true},
+		{"saml metadata url", types.ProtocolSAML, `{"metadata_url":"https://adfs.example.com/metadata"}`, false},
+		{"saml without metadata", types.ProtocolSAML, `{"entity_id":"https://adfs.example.com"}`, true},
+		{"ldap", types.ProtocolLDAP, `{}`, true},
+		{"invalid json", types.ProtocolOIDC, `{`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateProvider(&types.IdentityProvider{ID: "p", Type: tt.typ, Config: json.RawMessage(tt.config)})
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
@@ -0,0 +1,352 @@
+// Package lockout counts failed logins across the protocols that check
+// passwords, and refuses further attempts once there are too many: it delays
+// the attempts on an account exponentially, locks the account for a while,
+// and blocks source addresses that fail too often or spray passwords across
+// many accounts.
+package lockout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"go.uber.org/zap"
+)
+
+// Config holds the thresholds of the tracker. Zero values take the defaults.
+type Config struct {
+	// MaxFailures is the number of failures within FailureWindow after which
+	// an account is locked.
+	MaxFailures int
+	// FailureWindow is how long a failure counts.
+	FailureWindow time.Duration
+	// LockoutDuration is how long an account stays locked.
+	LockoutDuration time.Duration
+	// ThrottleAfter is the number of failures after which each further
+	// attempt on an account must wait, BaseDelay after the first and twice
+	// as long after each further failure, up to MaxDelay.
+	ThrottleAfter int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	// SourceMaxFailures is the number of failures within FailureWindow after
+	// which a source address is blocked.
+	SourceMaxFailures int
+	// SprayThreshold is the number of distinct accounts failing from one
+	// source address within FailureWindow that is taken for password spraying.
+	SprayThreshold int
+	// SourceBlockDuration is how long a source address stays blocked.
+	SourceBlockDuration time.Duration
+}
+
+const (
+	defaultMaxFailures         = 10
+	defaultFailureWindow       = 15 * time.Minute
+	defaultLockoutDuration     = 15 * time.Minute
+	defaultThrottleAfter       = 3
+	defaultBaseDelay           = time.Second
+	defaultMaxDelay            = time.Minute
+	defaultSourceMaxFailures   = 100
+	defaultSprayThreshold      = 20
+	defaultSourceBlockDuration = time.Hour
+)
+
+var (
+	// ErrAccountLocked refuses an attempt on a locked account.
+	ErrAccountLocked = errors.New("account is temporarily locked")
+	// ErrThrottled refuses an attempt made before the delay after the last failure has passed.
+	ErrThrottled = errors.New("too many failed logins, retry later")
+	// ErrSourceBlocked refuses an attempt from a blocked source address.
+	ErrSourceBlocked = errors.New("too many failed logins from this address")
+)
+
+// RefusedError is returned for an attempt the tracker refuses. Reason is one
+// of ErrAccountLocked, ErrThrottled and ErrSourceBlocked.
+type RefusedError struct {
+	Reason     error
+	RetryAfter time.Duration
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.Reason, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RefusedError) Unwrap() error {
+	return e.Reason
+}
+
+// Auditor records the security events of the tracker.
+type Auditor interface {
+	RecordAccountLocked(ctx context.Context, username, source string, failures int, until time.Time)
+	RecordAccountUnlocked(ctx context.Context, username, actor string)
+	RecordPasswordSpray(ctx context.Context, source string, usernames []string)
+}
+
+// Status is the lockout state of an account.
+type Status struct {
+	Failures    int        `json:"failures"`
+	Locked      bool       `json:"locked"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// Tracker keeps the failure counts in Redis, so that all protocols and all
+// server instances share them. Accounts are identified by username, whether
+// or not the user exists, so that a refusal does not reveal it.
+type Tracker struct {
+	redis   redis.RedisClientInterface
+	config  Config
+	logger  *zap.Logger
+	auditor Auditor
+	now     func() time.Time
+}
+
+// NewTracker creates a tracker.
+func NewTracker(client redis.RedisClientInterface, config Config, logger *zap.Logger) *Tracker {
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = defaultMaxFailures
+	}
+	if config.FailureWindow <= 0 {
+		config.FailureWindow = defaultFailureWindow
+	}
+	if config.LockoutDuration <= 0 {
+		config.LockoutDuration = defaultLockoutDuration
+	}
+	if config.ThrottleAfter <= 0 {
+		config.ThrottleAfter = defaultThrottleAfter
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = defaultBaseDelay
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = defaultMaxDelay
+	}
+	if config.SourceMaxFailures <= 0 {
+		config.SourceMaxFailures = defaultSourceMaxFailures
+	}
+	if config.SprayThreshold <= 0 {
+		config.SprayThreshold = defaultSprayThreshold
+	}
+	if config.SourceBlockDuration <= 0 {
+		config.SourceBlockDuration = defaultSourceBlockDuration
+	}
+	return &Tracker{redis: client, config: config, logger: logger, now: time.Now}
+}
+
+// SetAuditor sets the recorder of lockout and password spraying events.
+func (t *Tracker) SetAuditor(auditor Auditor) {
+	t.auditor = auditor
+}
+
+// Check tells whether a login attempt may go ahead. It returns a
+// *RefusedError if the account is locked or throttled or the source address
+// is blocked. The tracker fails open: if Redis cannot be read the attempt is
+// allowed.
+func (t *Tracker) Check(ctx context.Context, username, source string) error {
+	username, source = normalizeUsername(username), normalizeSource(source)
+	client := t.redis.Client()
+
+	if source != "" {
+		ttl, err := client.PTTL(ctx, sourceBlockKey(source)).Result()
+		if err != nil {
+			t.logger.Warn("Failed to read login source block", zap.String("source", source), zap.Error(err))
+		} else if ttl > 0 {
+			return &RefusedError{Reason: ErrSourceBlocked, RetryAfter: ttl}
+		}
+	}
+
+	ttl, err := client.PTTL(ctx, lockKey(username)).Result()
+	if err != nil {
+		t.logger.Warn("Failed to read account lockout", zap.String("username", username), zap.Error(err))
+		return nil
+	}
+	if ttl > 0 {
+		return &RefusedError{Reason: ErrAccountLocked, RetryAfter: ttl}
+	}
+
+	failures, last, err := t.failures(ctx, username)
+	if err != nil {
+		t.logger.Warn("Failed to read login failures", zap.String("username", username), zap.Error(err))
+		return nil
+	}
+	if wait := last.Add(t.delay(failures)).Sub(t.now()); wait > 0 {
+		return &RefusedError{Reason: ErrThrottled, RetryAfter: wait}
+	}
+	return nil
+}
+
+// RecordFailure counts a failed login of an account from a source address.
+// It locks the account and blocks the source address when they reach their
+// thresholds.
+func (t *Tracker) RecordFailure(ctx context.Context, username, source string) {
+	username, source = normalizeUsername(username), normalizeSource(source)
+	client := t.redis.Client()
+	now := t.now()
+
+	var failures *goredis.IntCmd
+	_, err := client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		failures = pipe.HIncrBy(ctx, failuresKey(username), "count", 1)
+		pipe.HSet(ctx, failuresKey(username), "last", now.UnixNano())
+		pipe.Expire(ctx, failuresKey(username), t.config.FailureWindow)
+		return nil
+	})
+	if err != nil {
+		t.logger.Warn("Failed to record login failure", zap.String("username", username), zap.Error(err))
+		return
+	}
+
+	if n := int(failures.Val()); n >= t.config.MaxFailures {
+		until := now.Add(t.config.LockoutDuration)
+		locked, err := client.SetNX(ctx, lockKey(username), until.Unix(), t.config.LockoutDuration).Result()
+		if err != nil {
+			t.logger.Warn("Failed to lock account", zap.String("username", username), zap.Error(err))
+		} else if locked {
+			// Counting starts over once the lockout ends.
+			client.Del(ctx, failuresKey(username))
+			t.logger.Warn("Account locked after failed logins", zap.String("username", username), zap.String("source", source), zap.Int("failures", n))
+			if t.auditor != nil {
+				t.auditor.RecordAccountLocked(ctx, username, source, n, until)
+			}
+		}
+	}
+
+	if source != "" {
+		t.recordSourceFailure(ctx, username, source)
+	}
+}
+
+func (t *Tracker) recordSourceFailure(ctx context.Context, username, source string) {
+	client := t.redis.Client()
+
+	var failures, accounts *goredis.IntCmd
+	_, err := client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		failures = pipe.Incr(ctx, sourceFailuresKey(source))
+		pipe.Expire(ctx, sourceFailuresKey(source), t.config.FailureWindow)
+		pipe.SAdd(ctx, sourceAccountsKey(source), username)
+		pipe.Expire(ctx, sourceAccountsKey(source), t.config.FailureWindow)
+		accounts = pipe.SCard(ctx, sourceAccountsKey(source))
+		return nil
+	})
+	if err != nil {
+		t.logger.Warn("Failed to record login failure of source", zap.String("source", source), zap.Error(err))
+		return
+	}
+
+	spraying := int(accounts.Val()) >= t.config.SprayThreshold
+	if !spraying && int(failures.Val()) < t.config.SourceMaxFailures {
+		return
+	}
+	blocked, err := client.SetNX(ctx, sourceBlockKey(source), "1", t.config.SourceBlockDuration).Result()
+	if err != nil || !blocked {
+		return
+	}
+	t.logger.Warn("Login source blocked after failed logins", zap.String("source", source),
+		zap.Int64("failures", failures.Val()), zap.Int64("accounts", accounts.Val()), zap.Bool("password_spray", spraying))
+	if spraying && t.auditor != nil {
+		usernames, _ := client.SMembers(ctx, sourceAccountsKey(source)).Result()
+		t.auditor.RecordPasswordSpray(ctx, source, usernames)
+	}
+}
+
+// RecordSuccess clears the failures of an account after a successful login.
+func (t *Tracker) RecordSuccess(ctx context.Context, username string) {
+	if err := t.redis.Del(ctx, failuresKey(normalizeUsername(username))); err != nil {
+		t.logger.Warn("Failed to clear login failures", zap.String("username", username), zap.Error(err))
+	}
+}
+
+// Status returns the lockout state of an account.
+func (t *Tracker) Status(ctx context.Context, username string) (*Status, error) {
+	username = normalizeUsername(username)
+	failures, _, err := t.failures(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{Failures: failures}
+
+	ttl, err := t.redis.Client().PTTL(ctx, lockKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		until := t.now().Add(ttl).Truncate(time.Second)
+		status.Locked = true
+		status.LockedUntil = &until
+	}
+	return status, nil
+}
+
+// Unlock ends the lockout of an account and clears its failures. The actor
+// is the administrator who unlocked it.
+func (t *Tracker) Unlock(ctx context.Context, username, actor string) error {
+	username = normalizeUsername(username)
+	if err := t.redis.Del(ctx, lockKey(username), failuresKey(username)); err != nil {
+		return err
+	}
+	if t.auditor != nil {
+		t.auditor.RecordAccountUnlocked(ctx, username, actor)
+	}
+	return nil
+}
+
+// failures returns the recent failures of an account and the time of the last one.
+func (t *Tracker) failures(ctx context.Context, username string) (int, time.Time, error) {
+	values, err := t.redis.HGetAll(ctx, failuresKey(username)).Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	count, _ := strconv.Atoi(values["count"])
+	last, _ := strconv.ParseInt(values["last"], 10, 64)
+	return count, time.Unix(0, last), nil
+}
+
+// delay returns how long an account must wait after its last failure.
+func (t *Tracker) delay(failures int) time.Duration {
+	if failures < t.config.ThrottleAfter {
+		return 0
+	}
+	delay := t.config.BaseDelay
+	for i := t.config.ThrottleAfter; i < failures && delay < t.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.config.MaxDelay {
+		delay = t.config.MaxDelay
+	}
+	return delay
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// normalizeSource strips the port from a remote address.
+func normalizeSource(source string) string {
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		return host
+	}
+	return source
+}
+
+func failuresKey(username string) string {
+	return "lockout:failures:" + username
+}
+
+func lockKey(username string) string {
+	return "lockout:locked:" + username
+}
+
+func sourceFailuresKey(source string) string {
+	return "lockout:source:failures:" + source
+}
+
+func sourceAccountsKey(source string) string {
+	return "lockout:source:accounts:" + source
+}
+
+func sourceBlockKey(source string) string {
+	return "lockout:source:blocked:" + source
+}
@@ -0,0 +1,137 @@
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"go.uber.org/zap"
+)
+
+type recordingAuditor struct {
+	locked   []string
+	unlocked []string
+	sprays   map[string][]string
+}
+
+func (a *recordingAuditor) RecordAccountLocked(ctx context.Context, username, source string, failures int, until time.Time) {
+	a.locked = append(a.locked, username)
+}
+
+func (a *recordingAuditor) RecordAccountUnlocked(ctx context.Context, username, actor string) {
+	a.unlocked = append(a.unlocked, username+" by "+actor)
+}
+
+func (a *recordingAuditor) RecordPasswordSpray(ctx context.Context, source string, usernames []string) {
+	if a.sprays == nil {
+		a.sprays = map[string][]string{}
+	}
+	a.sprays[source] = usernames
+}
+
+// newTestTracker returns a tracker on miniredis whose clock the test moves.
+func newTestTracker(t *testing.T, config Config) (*Tracker, *recordingAuditor, *miniredis.Miniredis, *time.Time) {
+	mr := miniredis.RunT(t)
+	tracker := NewTracker(redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})), config, zap.NewNop())
+	auditor := &recordingAuditor{}
+	tracker.SetAuditor(auditor)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+	return tracker, auditor, mr, &now
+}
+
+func TestTracker_ThrottlesWithExponentialDelay(t *testing.T) {
+	ctx := context.Background()
+	tracker, _, _, now := newTestTracker(t, Config{ThrottleAfter: 2, BaseDelay: time.Second, MaxDelay: 5 * time.Second, MaxFailures: 100})
+
+	tracker.RecordFailure(ctx, "alice", "10.0.0.1:5000")
+	assert.NoError(t, tracker.Check(ctx, "alice", "10.0.0.1"))
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		tracker.RecordFailure(ctx, "alice", "10.0.0.1")
+		err := tracker.Check(ctx, "Alice", "10.0.0.1")
+		var refused *RefusedError
+		require.ErrorAs(t, err, &refused)
+		assert.ErrorIs(t, err, ErrThrottled)
+		assert.Equal(t, want, refused.RetryAfter)
+
+		*now = now.Add(want)
+		assert.NoError(t, tracker.Check(ctx, "alice", "10.0.0.1"))
+	}
+
+	tracker.RecordSuccess(ctx, "alice")
+	status, err := tracker.Status(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 0, status.Failures)
+}
+
+func TestTracker_LocksAccount(t *testing.T) {
+	ctx := context.Background()
+	tracker, auditor, mr, _ := newTestTracker(t, Config{MaxFailures: 3, ThrottleAfter: 100, LockoutDuration: 10 * time.Minute})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, tracker.Check(ctx, "bob", "10.0.0.2"))
+		tracker.RecordFailure(ctx, "bob", "10.0.0.2")
+	}
+	err := tracker.Check(ctx, "bob", "10.0.0.9")
+	assert.ErrorIs(t, err, ErrAccountLocked)
+	assert.Equal(t, []string{"bob"}, auditor.locked)
+
+	status, err := tracker.Status(ctx, "bob")
+	require.NoError(t, err)
+	assert.True(t, status.Locked)
+	require.NotNil(t, status.LockedUntil)
+
+	// Other accounts are not affected.
+	assert.NoError(t, tracker.Check(ctx, "carol", "10.0.0.2"))
+
+	// The lockout ends by itself...
+	mr.FastForward(10 * time.Minute)
+	assert.NoError(t, tracker.Check(ctx, "bob", "10.0.0.2"))
+
+	// ...or when an administrator unlocks the account.
+	for i := 0; i < 3; i++ {
+		tracker.RecordFailure(ctx, "bob", "10.0.0.2")
+	}
+	assert.ErrorIs(t, tracker.Check(ctx, "bob", "10.0.0.2"), ErrAccountLocked)
+	require.NoError(t, tracker.Unlock(ctx, "Bob", "admin-1"))
+	assert.NoError(t, tracker.Check(ctx, "bob", "10.0.0.2"))
+	assert.Equal(t, []string{"bob by admin-1"}, auditor.unlocked)
+}
+
+func TestTracker_DetectsPasswordSpray(t *testing.T) {
+	ctx := context.Background()
+	tracker, auditor, _, _ := newTestTracker(t, Config{SprayThreshold: 5, SourceBlockDuration: time.Hour})
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, tracker.Check(ctx, fmt.Sprintf("user%d", i), "192.0.2.7"))
+		tracker.RecordFailure(ctx, fmt.Sprintf("user%d", i), "192.0.2.7:40000")
+	}
+
+	err := tracker.Check(ctx, "someone", "192.0.2.7")
+	var refused *RefusedError
+	require.ErrorAs(t, err, &refused)
+	assert.ErrorIs(t, err, ErrSourceBlocked)
+	assert.Equal(t, time.Hour, refused.RetryAfter)
+	assert.Len(t, auditor.sprays["192.0.2.7"], 5)
+
+	// The accounts themselves are not locked.
+	assert.NoError(t, tracker.Check(ctx, "user0", "198.51.100.1"))
+}
+
+func TestTracker_BlocksNoisySource(t *testing.T) {
+	ctx := context.Background()
+	tracker, auditor, _, _ := newTestTracker(t, Config{SourceMaxFailures: 4, MaxFailures: 100, ThrottleAfter: 100})
+
+	for i := 0; i < 4; i++ {
+		tracker.RecordFailure(ctx, "dave", "203.0.113.5")
+	}
+	assert.ErrorIs(t, tracker.Check(ctx, "erin", "203.0.113.5"), ErrSourceBlocked)
+	assert.Empty(t, auditor.sprays, "failures for one account are not spraying")
+}
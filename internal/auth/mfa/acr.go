@@ -0,0 +1,116 @@
+package mfa
+
+// Authentication context class references (acr) advertised to OpenID Connect
+// clients. Each class corresponds to an MFA strength level; a session satisfies
+// a class when it was authenticated at that level or higher.
+const (
+	// ACRPassword is a single-factor login.
+	ACRPassword = "urn:quantaid:acr:pwd"
+	// ACRMFA is a login completed with a StrengthLevelNormal factor such as TOTP.
+	ACRMFA = "urn:quantaid:acr:mfa"
+	// ACRPhishingResistant is a login completed with a StrengthLevelStrong factor such as WebAuthn.
+	ACRPhishingResistant = "urn:quantaid:acr:phr"
+)
+
+// SupportedACRValues lists the acr values from weakest to strongest.
+var SupportedACRValues = []string{ACRPassword, ACRMFA, ACRPhishingResistant}
+
+// ACRForStrength returns the acr value for an MFA strength level. An empty
+// level means no second factor was presented.
+func ACRForStrength(level StrengthLevel) string {
+	switch level {
+	case StrengthLevelStrong:
+		return ACRPhishingResistant
+	case StrengthLevelNormal:
+		return ACRMFA
+	default:
+		return ACRPassword
+	}
+}
+
+// StrengthForACR returns the MFA strength level required by an acr value.
+// ok is false for acr values this server does not support.
+func StrengthForACR(acr string) (level StrengthLevel, ok bool) {
+	switch acr {
+	case ACRPhishingResistant:
+		return StrengthLevelStrong, true
+	case ACRMFA:
+		return StrengthLevelNormal, true
+	case ACRPassword:
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+// SatisfiesACR reports whether a session authenticated at acr meets the
+// requested acr value.
+func SatisfiesACR(acr, requested string) bool {
+	have, want := acrRank(acr), acrRank(requested)
+	return have >= 0 && want >= 0 && have >= want
+}
+
+// SelectACR picks the acr to report for a session: the strongest of the
+// requested values the session satisfies, or the session's own acr when none
+// of them is met.
+func SelectACR(acr string, requested []string) string {
+	selected := ""
+	for _, r := range requested {
+		if SatisfiesACR(acr, r) && (selected == "" || acrRank(r) > acrRank(selected)) {
+			selected = r
+		}
+	}
+	if selected == "" {
+		return acr
+	}
+	return selected
+}
+
+// RequiredACR returns the acr a login must reach to satisfy the requested
+// acr values: the weakest of them this server supports, since any of them
+// is acceptable. It is empty when none is supported.
+func RequiredACR(requested []string) string {
+	required := ""
+	for _, r := range requested {
+		if rank := acrRank(r); rank >= 0 && (required == "" || rank < acrRank(required)) {
+			required = r
+		}
+	}
+	return required
+}
+
+func acrRank(acr string) int {
+	for i, v := range SupportedACRValues {
+		if v == acr {
+			return i
+		}
+	}
+	return -1
+}
+
+// strengthRank orders strength levels, with no second factor the weakest.
+func strengthRank(level StrengthLevel) int {
+	switch level {
+	case StrengthLevelStrong:
+		return 2
+	case StrengthLevelNormal:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// AMRForProvider returns the OpenID Connect amr value (RFC 8176) of the
+// factor an MFA provider verifies.
+func AMRForProvider(provider string) string {
+	switch provider {
+	case "webauthn":
+		return "hwk"
+	case "sms":
+		return "sms"
+	case "push":
+		return "swk"
+	default:
+		return "otp"
+	}
+}
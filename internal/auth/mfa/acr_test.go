@@ -0,0 +1,37 @@
+package mfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACRStrengthMapping(t *testing.T) {
+	for _, level := range []StrengthLevel{"", StrengthLevelNormal, StrengthLevelStrong} {
+		got, ok := StrengthForACR(ACRForStrength(level))
+		assert.True(t, ok)
+		assert.Equal(t, level, got)
+	}
+	_, ok := StrengthForACR("urn:example:unknown")
+	assert.False(t, ok)
+}
+
+func TestSelectACR(t *testing.T) {
+	assert.True(t, SatisfiesACR(ACRPhishingResistant, ACRMFA))
+	assert.False(t, SatisfiesACR(ACRPassword, ACRMFA))
+	assert.False(t, SatisfiesACR(ACRMFA, "urn:example:unknown"))
+
+	// The strongest satisfied value wins.
+	assert.Equal(t, ACRMFA, SelectACR(ACRMFA, []string{ACRPassword, ACRMFA, ACRPhishingResistant}))
+	// Nothing satisfied: report what the session actually achieved.
+	assert.Equal(t, ACRPassword, SelectACR(ACRPassword, []string{ACRPhishingResistant}))
+	assert.Equal(t, ACRPassword, SelectACR(ACRPassword, nil))
+}
+
+func TestRequiredACR(t *testing.T) {
+	// Any requested value is acceptable, so the weakest supported one is required.
+	assert.Equal(t, ACRMFA, RequiredACR([]string{ACRPhishingResistant, ACRMFA}))
+	assert.Equal(t, ACRPhishingResistant, RequiredACR([]string{"urn:example:unknown", ACRPhishingResistant}))
+	assert.Equal(t, "", RequiredACR([]string{"urn:example:unknown"}))
+	assert.Equal(t, "", RequiredACR(nil))
+}
@@ -0,0 +1,293 @@
+package mfa
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// ChallengeConfig configures the MFA challenges of the second step of a login.
+type ChallengeConfig struct {
+	// TTL is how long a challenge can be answered.
+	TTL time.Duration
+	// MaxAttempts is the number of wrong codes after which a challenge is discarded.
+	MaxAttempts int
+	// UsedCodeTTL is how long a verified code is remembered to refuse its
+	// replay. It should outlive the validity window of a TOTP code.
+	UsedCodeTTL time.Duration
+	// StepUpTTL is how long a step-up verification allows sensitive changes
+	// to the user's factors.
+	StepUpTTL time.Duration
+}
+
+const (
+	defaultChallengeTTL         = 5 * time.Minute
+	defaultChallengeMaxAttempts = 5
+	defaultUsedCodeTTL          = 3 * time.Minute
+)
+
+var (
+	// ErrNoEnrolledFactors is returned when a challenge is requested for a user without an enrolled factor.
+	ErrNoEnrolledFactors = errors.New("user has no enrolled MFA factor")
+	// ErrChallengeNotFound is returned for an unknown, expired or already answered challenge.
+	ErrChallengeNotFound = errors.New("MFA challenge not found or expired")
+	// ErrProviderNotAllowed is returned when a provider is not one the challenge can be answered with.
+	ErrProviderNotAllowed = errors.New("MFA provider not allowed for this challenge")
+	// ErrInvalidCode is returned when the code does not verify.
+	ErrInvalidCode = errors.New("invalid MFA code")
+	// ErrCodeReplayed is returned when a code that was already accepted is presented again.
+	ErrCodeReplayed = errors.New("MFA code already used")
+	// ErrTooManyAttempts is returned when the attempts of a challenge are exhausted; the challenge is discarded.
+	ErrTooManyAttempts = errors.New("too many failed MFA attempts")
+)
+
+// LoginChallenge is the server-side state of an MFA challenge, kept in Redis
+// until it is answered or expires. The number of attempts is counted next to
+// it so that concurrent attempts cannot exceed the limit.
+type LoginChallenge struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	RiskLevel string    `json:"risk_level"`
+	Providers []string  `json:"providers"`
+	Provider  string    `json:"provider"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Allows reports whether the challenge can be answered with a provider.
+func (c *LoginChallenge) Allows(provider string) bool {
+	for _, p := range c.Providers {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// SetChallengeStore sets the Redis client challenges are persisted in.
+func (m *MFAManager) SetChallengeStore(client redis.RedisClientInterface, config ChallengeConfig) {
+	if config.TTL <= 0 {
+		config.TTL = defaultChallengeTTL
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultChallengeMaxAttempts
+	}
+	if config.UsedCodeTTL <= 0 {
+		config.UsedCodeTTL = defaultUsedCodeTTL
+	}
+	if config.StepUpTTL <= 0 {
+		config.StepUpTTL = defaultStepUpTTL
+	}
+	m.redisClient = client
+	m.challengeConfig = config
+}
+
+// EnrolledProviders returns the names of the providers for which the user has
+// an enrolled factor, including email and SMS one-time codes, in a stable
+// order.
+func (m *MFAManager) EnrolledProviders(ctx context.Context, user *types.User) ([]string, error) {
+	factors, err := m.ListFactors(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range factors {
+		if len(names) == 0 || names[len(names)-1] != f.Provider {
+			names = append(names, f.Provider)
+		}
+	}
+	return names, nil
+}
+
+// Challenge starts the MFA step of a login. The challenge is limited to the
+// providers the user has enrolled; providerName selects the one to challenge
+// with first, or the provider of the user's default factor when empty. The returned challenge ID
+// is the handle the client answers with.
+func (m *MFAManager) Challenge(ctx context.Context, user *types.User, riskLevel, providerName string) (*types.MFAChallenge, error) {
+	return m.ChallengeAtStrength(ctx, user, riskLevel, providerName, "")
+}
+
+// ChallengeAtStrength is Challenge limited to the providers of at least the
+// given strength, for logins that must reach an acr value. It returns
+// ErrNoEnrolledFactors when the user has no factor that strong.
+func (m *MFAManager) ChallengeAtStrength(ctx context.Context, user *types.User, riskLevel, providerName string, minStrength StrengthLevel) (*types.MFAChallenge, error) {
+	if m.redisClient == nil {
+		return nil, fmt.Errorf("MFA challenge store not configured")
+	}
+
+	enrolled, err := m.EnrolledProviders(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	var providers []string
+	for _, name := range enrolled {
+		if strengthRank(m.ProviderStrength(name)) >= strengthRank(minStrength) {
+			providers = append(providers, name)
+		}
+	}
+	if len(providers) == 0 {
+		return nil, ErrNoEnrolledFactors
+	}
+	if providerName == "" {
+		providerName = m.preferredProvider(ctx, user, providers)
+	}
+
+	now := time.Now()
+	state := &LoginChallenge{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		RiskLevel: riskLevel,
+		Providers: providers,
+		Provider:  providerName,
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.challengeConfig.TTL),
+	}
+	if !state.Allows(providerName) {
+		return nil, ErrProviderNotAllowed
+	}
+
+	challenge, err := m.sendChallenge(ctx, user, providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode MFA challenge: %w", err)
+	}
+	if err := m.redisClient.Set(ctx, challengeKey(state.ID), data, m.challengeConfig.TTL); err != nil {
+		return nil, fmt.Errorf("failed to store MFA challenge: %w", err)
+	}
+
+	options := map[string]interface{}{}
+	if challenge != nil {
+		for k, v := range challenge.Options {
+			options[k] = v
+		}
+	}
+	options["providers"] = providers
+	options["expires_in"] = int(m.challengeConfig.TTL.Seconds())
+
+	return &types.MFAChallenge{
+		ChallengeID: state.ID,
+		MFAProvider: types.AuthMethod(providerName),
+		Options:     options,
+	}, nil
+}
+
+// PendingChallenge returns the state of a challenge that has not been answered yet.
+func (m *MFAManager) PendingChallenge(ctx context.Context, challengeID string) (*LoginChallenge, error) {
+	if m.redisClient == nil || challengeID == "" {
+		return nil, ErrChallengeNotFound
+	}
+	data, err := m.redisClient.Get(ctx, challengeKey(challengeID))
+	if err != nil {
+		return nil, ErrChallengeNotFound
+	}
+	var state LoginChallenge
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, fmt.Errorf("failed to decode MFA challenge: %w", err)
+	}
+	return &state, nil
+}
+
+// Verify checks the user's answer to a challenge. providerName may name any
+// provider the challenge allows and defaults to the one challenged with.
+// Every call counts as an attempt; the challenge is discarded once the
+// attempts are exhausted, and consumed once a code verifies, so that it can
+// be answered only once. A verified code is remembered for a while and
+// refused if it is presented again, even for another challenge.
+func (m *MFAManager) Verify(ctx context.Context, challengeID string, user *types.User, providerName, code string) (*LoginChallenge, error) {
+	state, err := m.PendingChallenge(ctx, challengeID)
+	if err != nil {
+		return nil, err
+	}
+	if state.UserID != user.ID {
+		return nil, ErrChallengeNotFound
+	}
+	if providerName == "" {
+		providerName = state.Provider
+	}
+	if !state.Allows(providerName) {
+		return nil, ErrProviderNotAllowed
+	}
+
+	client := m.redisClient.Client()
+	attempts, err := client.Incr(ctx, attemptsKey(challengeID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count MFA attempt: %w", err)
+	}
+	if attempts == 1 {
+		client.ExpireAt(ctx, attemptsKey(challengeID), state.ExpiresAt)
+	}
+	if attempts > int64(m.challengeConfig.MaxAttempts) {
+		m.discardChallenge(ctx, challengeID)
+		return nil, ErrTooManyAttempts
+	}
+
+	ok, err := m.verifyCode(ctx, user, providerName, code)
+	if errors.Is(err, ErrApprovalPending) {
+		// Polling for an out-of-band approval is not a wrong answer.
+		client.Decr(ctx, attemptsKey(challengeID))
+		return nil, err
+	}
+	if errors.Is(err, ErrApprovalDenied) {
+		m.discardChallenge(ctx, challengeID)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if attempts == int64(m.challengeConfig.MaxAttempts) {
+			m.discardChallenge(ctx, challengeID)
+			return nil, ErrTooManyAttempts
+		}
+		return nil, ErrInvalidCode
+	}
+
+	fresh, err := m.redisClient.SetNX(ctx, usedCodeKey(user.ID, providerName, code), challengeID, m.challengeConfig.UsedCodeTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record used MFA code: %w", err)
+	}
+	if !fresh {
+		return nil, ErrCodeReplayed
+	}
+
+	// Only the attempt that deletes the challenge may complete the login.
+	deleted, err := client.Del(ctx, challengeKey(challengeID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume MFA challenge: %w", err)
+	}
+	client.Del(ctx, attemptsKey(challengeID))
+	if deleted == 0 {
+		return nil, ErrChallengeNotFound
+	}
+	return state, nil
+}
+
+func (m *MFAManager) discardChallenge(ctx context.Context, challengeID string) {
+	_ = m.redisClient.Del(ctx, challengeKey(challengeID), attemptsKey(challengeID))
+}
+
+func challengeKey(id string) string {
+	return "mfa:challenge:" + id
+}
+
+func attemptsKey(id string) string {
+	return "mfa:challenge:" + id + ":attempts"
+}
+
+// usedCodeKey identifies a verified code without storing it.
+func usedCodeKey(userID, provider, code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return fmt.Sprintf("mfa:used:%s:%s:%s", userID, provider, hex.EncodeToString(sum[:]))
+}
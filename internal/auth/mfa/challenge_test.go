@@ -0,0 +1,197 @@
+package mfa
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp/totp"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/notification"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+// newChallengeManager returns a manager with a TOTP provider and a user with
+// an enrolled TOTP factor, and the factor's secret.
+func newChallengeManager(t *testing.T, config ChallengeConfig) (*MFAManager, *miniredis.Miniredis, *types.User, string) {
+	repo := memory.NewMFAFactorMemoryRepository()
+	provider := NewTOTPProvider(repo, utils.NewCryptoManager("test-secret"))
+	user := &types.User{ID: "550e8400-e29b-41d4-a716-446655440000", Username: "alice"}
+
+	enrollment, err := provider.Enroll(context.Background(), user)
+	require.NoError(t, err)
+	factors, err := repo.GetMFAFactorsByUserID(context.Background(), user.ID)
+	require.NoError(t, err)
+	factors[0].Status = "enrolled"
+
+	mr := miniredis.RunT(t)
+	manager := NewMFAManager()
+	manager.RegisterProvider("totp", provider)
+	manager.SetChallengeStore(redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})), config)
+	return manager, mr, user, enrollment.Secret
+}
+
+func TestChallenge_LimitedToEnrolledFactors(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user, _ := newChallengeManager(t, ChallengeConfig{})
+
+	challenge, err := manager.Challenge(ctx, user, "medium", "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, challenge.ChallengeID)
+	assert.Equal(t, types.AuthMethod("totp"), challenge.MFAProvider)
+	assert.Equal(t, []string{"totp"}, challenge.Options["providers"])
+
+	state, err := manager.PendingChallenge(ctx, challenge.ChallengeID)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, state.UserID)
+	assert.Equal(t, "medium", state.RiskLevel)
+
+	_, err = manager.Challenge(ctx, user, "medium", "webauthn")
+	assert.ErrorIs(t, err, ErrProviderNotAllowed)
+
+	other := &types.User{ID: "650e8400-e29b-41d4-a716-446655440000"}
+	_, err = manager.Challenge(ctx, other, "medium", "")
+	assert.ErrorIs(t, err, ErrNoEnrolledFactors)
+}
+
+func TestChallengeAtStrength(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user, _ := newChallengeManager(t, ChallengeConfig{})
+
+	challenge, err := manager.ChallengeAtStrength(ctx, user, "low", "", StrengthLevelNormal)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"totp"}, challenge.Options["providers"])
+
+	// TOTP is not phishing resistant, so a login that must be has no factor left.
+	_, err = manager.ChallengeAtStrength(ctx, user, "low", "", StrengthLevelStrong)
+	assert.ErrorIs(t, err, ErrNoEnrolledFactors)
+}
+
+func TestVerify_ConsumesChallenge(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user, secret := newChallengeManager(t, ChallengeConfig{})
+	challenge, err := manager.Challenge(ctx, user, "medium", "")
+	require.NoError(t, err)
+
+	_, err = manager.Verify(ctx, challenge.ChallengeID, user, "", "000000")
+	assert.ErrorIs(t, err, ErrInvalidCode)
+
+	_, err = manager.Verify(ctx, challenge.ChallengeID, &types.User{ID: "someone-else"}, "", "000000")
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	state, err := manager.Verify(ctx, challenge.ChallengeID, user, "totp", code)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, state.UserID)
+
+	_, err = manager.Verify(ctx, challenge.ChallengeID, user, "totp", code)
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+func TestVerify_RefusesReplayedCode(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user, secret := newChallengeManager(t, ChallengeConfig{})
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+
+	first, err := manager.Challenge(ctx, user, "medium", "")
+	require.NoError(t, err)
+	_, err = manager.Verify(ctx, first.ChallengeID, user, "", code)
+	require.NoError(t, err)
+
+	second, err := manager.Challenge(ctx, user, "medium", "")
+	require.NoError(t, err)
+	_, err = manager.Verify(ctx, second.ChallengeID, user, "", code)
+	assert.ErrorIs(t, err, ErrCodeReplayed)
+}
+
+func TestVerify_AttemptLimit(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user, secret := newChallengeManager(t, ChallengeConfig{MaxAttempts: 3})
+	challenge, err := manager.Challenge(ctx, user, "high", "")
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = manager.Verify(ctx, challenge.ChallengeID, user, "", "000000")
+		assert.ErrorIs(t, err, ErrInvalidCode)
+	}
+	_, err = manager.Verify(ctx, challenge.ChallengeID, user, "", "000000")
+	assert.ErrorIs(t, err, ErrTooManyAttempts)
+
+	// The challenge is gone, even for the right code.
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	_, err = manager.Verify(ctx, challenge.ChallengeID, user, "", code)
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+func TestVerify_ExpiredChallenge(t *testing.T) {
+	ctx := context.Background()
+	manager, mr, user, secret := newChallengeManager(t, ChallengeConfig{TTL: time.Minute})
+	challenge, err := manager.Challenge(ctx, user, "medium", "")
+	require.NoError(t, err)
+
+	mr.FastForward(2 * time.Minute)
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	_, err = manager.Verify(ctx, challenge.ChallengeID, user, "", code)
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+// capturingNotifier records the messages it is asked to send.
+type capturingNotifier struct {
+	kind     string
+	messages []notification.Message
+}
+
+func (n *capturingNotifier) Send(ctx context.Context, msg notification.Message) error {
+	n.messages = append(n.messages, msg)
+	return nil
+}
+
+func (n *capturingNotifier) Type() string {
+	return n.kind
+}
+
+func TestChallenge_IncludesOTPFactors(t *testing.T) {
+	ctx := context.Background()
+	manager, repo, user := newFactorManager(t)
+	user.Email = "alice@example.com"
+	emails := &capturingNotifier{kind: "email"}
+	otpRedis := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()}))
+	manager.SetOTPProvider(NewOTPProvider(otpRedis, notification.NewManager(emails), utils.NewCryptoManager("test-secret"), OTPConfig{TTL: time.Minute, Length: 6}))
+
+	_, err := manager.Challenge(ctx, user, "medium", "")
+	assert.ErrorIs(t, err, ErrNoEnrolledFactors)
+
+	// A user whose only factor is email one-time codes is challenged by email.
+	require.NoError(t, repo.CreateMFAFactor(ctx, &types.MFAFactor{UserID: uuid.MustParse(user.ID), Type: "email", Status: "enrolled"}))
+	providers, err := manager.EnrolledProviders(ctx, user)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"email"}, providers)
+
+	challenge, err := manager.Challenge(ctx, user, "medium", "")
+	require.NoError(t, err)
+	assert.Equal(t, types.AuthMethod("email"), challenge.MFAProvider)
+	require.Len(t, emails.messages, 1)
+	assert.Equal(t, "alice@example.com", emails.messages[0].Recipient)
+
+	code, err := otpRedis.Get(ctx, "mfa:otp:"+user.ID)
+	require.NoError(t, err)
+	_, err = manager.Verify(ctx, challenge.ChallengeID, user, "", code)
+	require.NoError(t, err)
+
+	// Without an address to send the code to, the factor does not count.
+	user.Email = ""
+	providers, err = manager.EnrolledProviders(ctx, user)
+	require.NoError(t, err)
+	assert.Empty(t, providers)
+}
@@ -0,0 +1,342 @@
+package mfa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// StepUpRiskLevel marks challenges that re-verify a signed-in user before a
+// sensitive change, rather than completing a login.
+const StepUpRiskLevel = "step_up"
+
+const (
+	defaultStepUpTTL = 5 * time.Minute
+	// recoveryProvider is the name recovery codes are registered under. They
+	// are a fallback and never chosen for a challenge unless asked for.
+	recoveryProvider = "recovery"
+)
+
+var (
+	// ErrFactorNotFound is returned for a factor the user does not have.
+	ErrFactorNotFound = errors.New("MFA factor not found")
+	// ErrStepUpRequired is returned when a factor is changed without a recent step-up verification.
+	ErrStepUpRequired = errors.New("a recent MFA verification is required")
+	// ErrSessionRequired is returned for a step-up outside of a session, which
+	// it could not be recorded against.
+	ErrSessionRequired = errors.New("a step-up needs a session")
+)
+
+// FactorStore stores the MFA factors of all providers.
+type FactorStore interface {
+	MFAFactorRepository
+	DeleteMFAFactor(ctx context.Context, factorID uuid.UUID) error
+}
+
+// Factor describes an enrolled MFA factor of a user.
+type Factor struct {
+	ID         string        `json:"id"`
+	Type       string        `json:"type"`
+	Provider   string        `json:"provider"`
+	Strength   StrengthLevel `json:"strength"`
+	Default    bool          `json:"default"`
+	CreatedAt  time.Time     `json:"created_at"`
+	LastUsedAt *time.Time    `json:"last_used_at,omitempty"`
+}
+
+// SetFactorStore sets the store factors are managed in.
+func (m *MFAManager) SetFactorStore(store FactorStore) {
+	m.factorStore = store
+}
+
+// Provider returns the provider registered under a name.
+func (m *MFAManager) Provider(name string) (MFAProvider, bool) {
+	provider, ok := m.providers[name]
+	return provider, ok
+}
+
+// ProviderStrength returns the strength of the factors a provider verifies,
+// or an empty level for an unknown provider.
+func (m *MFAManager) ProviderStrength(name string) StrengthLevel {
+	if provider, ok := m.providers[name]; ok {
+		return provider.GetStrength()
+	}
+	if name == "email" || name == "sms" {
+		return StrengthLevelNormal
+	}
+	return ""
+}
+
+// ListFactors returns the enrolled factors of the user from every registered
+// provider and the email and SMS one-time code factors, ordered by provider
+// name.
+func (m *MFAManager) ListFactors(ctx context.Context, user *types.User) ([]*Factor, error) {
+	stored := map[string]*types.MFAFactor{}
+	var storedFactors []*types.MFAFactor
+	if m.factorStore != nil {
+		factors, err := m.factorStore.GetMFAFactorsByUserID(ctx, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get MFA factors: %w", err)
+		}
+		storedFactors = factors
+		for _, f := range factors {
+			stored[f.ID.String()] = f
+		}
+	}
+
+	names := make([]string, 0, len(m.providers))
+	for name := range m.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var factors []*Factor
+	for _, name := range names {
+		provider := m.providers[name]
+		methods, err := provider.ListMethods(ctx, user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s methods: %w", name, err)
+		}
+		for _, method := range methods {
+			factor := &Factor{
+				ID:       method.ID,
+				Type:     method.Type,
+				Provider: name,
+				Strength: provider.GetStrength(),
+			}
+			if f, ok := stored[method.ID]; ok {
+				factor.Default = f.IsDefault
+				factor.CreatedAt = f.CreatedAt
+				factor.LastUsedAt = f.LastUsedAt
+			}
+			factors = append(factors, factor)
+		}
+	}
+	factors = append(factors, m.otpFactors(user, storedFactors)...)
+	sort.SliceStable(factors, func(i, j int) bool { return factors[i].Provider < factors[j].Provider })
+	return factors, nil
+}
+
+// otpFactors returns the enrolled email and SMS factors of the user. They
+// are not backed by a registered provider: the OTP provider sends the code
+// to the user's email address or phone number, so a factor only counts while
+// the user has one.
+func (m *MFAManager) otpFactors(user *types.User, stored []*types.MFAFactor) []*Factor {
+	if m.otpProvider == nil {
+		return nil
+	}
+	var factors []*Factor
+	for _, f := range stored {
+		if f.Status != "enrolled" || !otpReachable(user, f.Type) {
+			continue
+		}
+		factors = append(factors, &Factor{
+			ID:         f.ID.String(),
+			Type:       f.Type,
+			Provider:   f.Type,
+			Strength:   StrengthLevelNormal,
+			Default:    f.IsDefault,
+			CreatedAt:  f.CreatedAt,
+			LastUsedAt: f.LastUsedAt,
+		})
+	}
+	return factors
+}
+
+// otpReachable reports whether a one-time code for an OTP provider can be
+// sent to the user.
+func otpReachable(user *types.User, provider string) bool {
+	switch provider {
+	case "email":
+		return user.Email != ""
+	case "sms":
+		return user.Phone != ""
+	default:
+		return false
+	}
+}
+
+// SetDefaultFactor makes a factor the one challenged first at login.
+// Recovery codes cannot be the default.
+func (m *MFAManager) SetDefaultFactor(ctx context.Context, user *types.User, factorID string) (*Factor, error) {
+	if m.factorStore == nil {
+		return nil, fmt.Errorf("MFA factor store not configured")
+	}
+	factor, err := m.findFactor(ctx, user, factorID)
+	if err != nil {
+		return nil, err
+	}
+	if factor.Provider == recoveryProvider {
+		return nil, ErrFactorNotFound
+	}
+
+	stored, err := m.factorStore.GetMFAFactorsByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MFA factors: %w", err)
+	}
+	for _, f := range stored {
+		isDefault := f.ID.String() == factorID
+		if f.IsDefault == isDefault {
+			continue
+		}
+		f.IsDefault = isDefault
+		if err := m.factorStore.UpdateMFAFactor(ctx, f); err != nil {
+			return nil, fmt.Errorf("failed to update MFA factor: %w", err)
+		}
+	}
+	factor.Default = true
+	return factor, nil
+}
+
+// DeleteFactor removes a factor of the user. It needs a step-up verification
+// in the session within the step-up TTL. When the last factor other than
+// recovery codes is removed, the recovery codes go with it, as they would be
+// the only factor.
+func (m *MFAManager) DeleteFactor(ctx context.Context, user *types.User, sessionID, factorID string) (*Factor, error) {
+	if m.factorStore == nil {
+		return nil, fmt.Errorf("MFA factor store not configured")
+	}
+	if !m.SteppedUp(ctx, user, sessionID) {
+		return nil, ErrStepUpRequired
+	}
+
+	factors, err := m.ListFactors(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	var deleted *Factor
+	remaining := 0
+	for _, f := range factors {
+		switch {
+		case f.ID == factorID:
+			deleted = f
+		case f.Provider != recoveryProvider:
+			remaining++
+		}
+	}
+	if deleted == nil {
+		return nil, ErrFactorNotFound
+	}
+
+	if err := m.deleteStoredFactor(ctx, deleted.ID); err != nil {
+		return nil, err
+	}
+	if remaining == 0 {
+		for _, f := range factors {
+			if f.Provider == recoveryProvider && f.ID != deleted.ID {
+				if err := m.deleteStoredFactor(ctx, f.ID); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MFAManager) deleteStoredFactor(ctx context.Context, factorID string) error {
+	id, err := uuid.Parse(factorID)
+	if err != nil {
+		return ErrFactorNotFound
+	}
+	if err := m.factorStore.DeleteMFAFactor(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete MFA factor: %w", err)
+	}
+	return nil
+}
+
+func (m *MFAManager) findFactor(ctx context.Context, user *types.User, factorID string) (*Factor, error) {
+	factors, err := m.ListFactors(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range factors {
+		if f.ID == factorID {
+			return f, nil
+		}
+	}
+	return nil, ErrFactorNotFound
+}
+
+// preferredProvider picks the provider to challenge with first: the one of
+// the user's default factor, or else the first enrolled one that is not
+// recovery codes.
+func (m *MFAManager) preferredProvider(ctx context.Context, user *types.User, providers []string) string {
+	if m.factorStore != nil {
+		if factors, err := m.ListFactors(ctx, user); err == nil {
+			for _, f := range factors {
+				if f.Default && contains(providers, f.Provider) {
+					return f.Provider
+				}
+			}
+		}
+	}
+	for _, name := range providers {
+		if name != recoveryProvider {
+			return name
+		}
+	}
+	return providers[0]
+}
+
+// BeginStepUp challenges a signed-in user to verify a factor again before
+// a sensitive change.
+func (m *MFAManager) BeginStepUp(ctx context.Context, user *types.User, providerName string) (*types.MFAChallenge, error) {
+	return m.Challenge(ctx, user, StepUpRiskLevel, providerName)
+}
+
+// CompleteStepUp verifies the answer to a step-up challenge. On success the
+// session it was answered in counts as stepped up for the step-up TTL; the
+// user's other sessions do not.
+func (m *MFAManager) CompleteStepUp(ctx context.Context, challengeID string, user *types.User, sessionID, providerName, code string) error {
+	if sessionID == "" {
+		return ErrSessionRequired
+	}
+	state, err := m.PendingChallenge(ctx, challengeID)
+	if err != nil {
+		return err
+	}
+	if state.RiskLevel != StepUpRiskLevel {
+		return ErrChallengeNotFound
+	}
+	if _, err := m.Verify(ctx, challengeID, user, providerName, code); err != nil {
+		return err
+	}
+	if err := m.redisClient.Set(ctx, stepUpKey(sessionID), user.ID, m.challengeConfig.StepUpTTL); err != nil {
+		return fmt.Errorf("failed to record step-up: %w", err)
+	}
+	return nil
+}
+
+// SteppedUp reports whether the user completed a step-up in the session
+// within the step-up TTL.
+func (m *MFAManager) SteppedUp(ctx context.Context, user *types.User, sessionID string) bool {
+	if m.redisClient == nil || sessionID == "" {
+		return false
+	}
+	userID, err := m.redisClient.Get(ctx, stepUpKey(sessionID))
+	return err == nil && userID == user.ID
+}
+
+// AuthorizeEnrollment checks that a factor may be added for the user. The
+// first factor is enrolled on the strength of the login alone; once the user
+// has one, adding another needs a step-up in the session, so that a stolen
+// password cannot be turned into a second factor.
+func (m *MFAManager) AuthorizeEnrollment(ctx context.Context, user *types.User, sessionID string) error {
+	factors, err := m.ListFactors(ctx, user)
+	if err != nil {
+		return err
+	}
+	if len(factors) > 0 && !m.SteppedUp(ctx, user, sessionID) {
+		return ErrStepUpRequired
+	}
+	return nil
+}
+
+func stepUpKey(sessionID string) string {
+	return "mfa:stepup:" + sessionID
+}
@@ -0,0 +1,191 @@
+package mfa
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pquerna/otp/totp"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+// newFactorManager returns a manager with TOTP and recovery code providers
+// over an in-memory factor store, and a user without factors.
+func newFactorManager(t *testing.T) (*MFAManager, *memory.MFAFactorMemoryRepository, *types.User) {
+	repo := memory.NewMFAFactorMemoryRepository()
+	crypto := utils.NewCryptoManager("test-secret")
+	manager := NewMFAManager()
+	manager.RegisterProvider("totp", NewTOTPProvider(repo, crypto))
+	manager.RegisterProvider("recovery", NewRecoveryCodeProvider(repo, crypto))
+	manager.SetFactorStore(repo)
+	manager.SetChallengeStore(redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()})), ChallengeConfig{})
+	return manager, repo, &types.User{ID: "550e8400-e29b-41d4-a716-446655440000", Username: "alice"}
+}
+
+// enrollTOTP enrolls and confirms a TOTP factor and returns its secret.
+func enrollTOTP(t *testing.T, manager *MFAManager, user *types.User) (*types.MFAFactor, string) {
+	provider, _ := manager.Provider("totp")
+	enrollment, err := provider.Enroll(context.Background(), user)
+	require.NoError(t, err)
+	code, err := totp.GenerateCode(enrollment.Secret, time.Now())
+	require.NoError(t, err)
+	factor, err := provider.(*TOTPProvider).Confirm(context.Background(), user, code)
+	require.NoError(t, err)
+	return factor, enrollment.Secret
+}
+
+func TestTOTPProvider_EnrollmentNeedsConfirmation(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user := newFactorManager(t)
+	provider, _ := manager.Provider("totp")
+	totpProvider := provider.(*TOTPProvider)
+
+	_, err := totpProvider.Confirm(ctx, user, "123456")
+	assert.ErrorIs(t, err, ErrNoPendingEnrollment)
+
+	enrollment, err := provider.Enroll(ctx, user)
+	require.NoError(t, err)
+	assert.Contains(t, enrollment.QRCode, "data:image/png;base64,")
+
+	// A pending factor is neither listed nor accepted.
+	code, _ := totp.GenerateCode(enrollment.Secret, time.Now())
+	ok, err := provider.Verify(ctx, user, code)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	factors, err := manager.ListFactors(ctx, user)
+	require.NoError(t, err)
+	assert.Empty(t, factors)
+
+	_, err = totpProvider.Confirm(ctx, user, "000000")
+	assert.ErrorIs(t, err, ErrInvalidCode)
+	factor, err := totpProvider.Confirm(ctx, user, code)
+	require.NoError(t, err)
+	assert.Equal(t, "enrolled", factor.Status)
+
+	factors, err = manager.ListFactors(ctx, user)
+	require.NoError(t, err)
+	require.Len(t, factors, 1)
+	assert.Equal(t, factor.ID.String(), factors[0].ID)
+	assert.Equal(t, StrengthLevelNormal, factors[0].Strength)
+}
+
+func TestRecoveryCodeProvider_Regenerate(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user := newFactorManager(t)
+	provider, _ := manager.Provider("recovery")
+	recovery := provider.(*RecoveryCodeProvider)
+
+	first, err := recovery.Regenerate(ctx, user)
+	require.NoError(t, err)
+	second, err := recovery.Regenerate(ctx, user)
+	require.NoError(t, err)
+
+	ok, err := recovery.Verify(ctx, user, first[0])
+	require.NoError(t, err)
+	assert.False(t, ok, "earlier codes stop working")
+	ok, err = recovery.Verify(ctx, user, second[0])
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	remaining, err := recovery.Remaining(ctx, user)
+	require.NoError(t, err)
+	assert.Equal(t, len(second)-1, remaining)
+	methods, err := recovery.ListMethods(ctx, user)
+	require.NoError(t, err)
+	assert.Len(t, methods, 1)
+}
+
+func TestChallenge_PrefersDefaultFactor(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user := newFactorManager(t)
+	factor, _ := enrollTOTP(t, manager, user)
+	recovery, _ := manager.Provider("recovery")
+	_, err := recovery.Enroll(ctx, user)
+	require.NoError(t, err)
+
+	// Recovery codes sort first but are only a fallback.
+	challenge, err := manager.Challenge(ctx, user, "medium", "")
+	require.NoError(t, err)
+	assert.Equal(t, types.AuthMethod("totp"), challenge.MFAProvider)
+	assert.Equal(t, []string{"recovery", "totp"}, challenge.Options["providers"])
+
+	factors, err := manager.ListFactors(ctx, user)
+	require.NoError(t, err)
+	for _, f := range factors {
+		if f.Provider == "recovery" {
+			_, err := manager.SetDefaultFactor(ctx, user, f.ID)
+			assert.ErrorIs(t, err, ErrFactorNotFound)
+		}
+	}
+
+	defaultFactor, err := manager.SetDefaultFactor(ctx, user, factor.ID.String())
+	require.NoError(t, err)
+	assert.True(t, defaultFactor.Default)
+	_, err = manager.SetDefaultFactor(ctx, user, "6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	assert.ErrorIs(t, err, ErrFactorNotFound)
+}
+
+func TestDeleteFactor_RequiresStepUp(t *testing.T) {
+	ctx := context.Background()
+	manager, repo, user := newFactorManager(t)
+	factor, secret := enrollTOTP(t, manager, user)
+	recovery, _ := manager.Provider("recovery")
+	_, err := recovery.Enroll(ctx, user)
+	require.NoError(t, err)
+
+	_, err = manager.DeleteFactor(ctx, user, "session-1", factor.ID.String())
+	assert.ErrorIs(t, err, ErrStepUpRequired)
+
+	// A login challenge cannot be used to step up.
+	login, err := manager.Challenge(ctx, user, "medium", "totp")
+	require.NoError(t, err)
+	code, _ := totp.GenerateCode(secret, time.Now())
+	assert.ErrorIs(t, manager.CompleteStepUp(ctx, login.ChallengeID, user, "session-1", "totp", code), ErrChallengeNotFound)
+
+	stepUp, err := manager.BeginStepUp(ctx, user, "totp")
+	require.NoError(t, err)
+	assert.ErrorIs(t, manager.CompleteStepUp(ctx, stepUp.ChallengeID, user, "", "totp", code), ErrSessionRequired)
+	assert.ErrorIs(t, manager.CompleteStepUp(ctx, stepUp.ChallengeID, user, "session-1", "totp", "000000"), ErrInvalidCode)
+	require.NoError(t, manager.CompleteStepUp(ctx, stepUp.ChallengeID, user, "session-1", "totp", code))
+	assert.True(t, manager.SteppedUp(ctx, user, "session-1"))
+
+	// The step-up holds for the session it was made in only.
+	assert.False(t, manager.SteppedUp(ctx, user, "session-2"))
+	assert.False(t, manager.SteppedUp(ctx, &types.User{ID: "someone-else"}, "session-1"))
+	_, err = manager.DeleteFactor(ctx, user, "session-2", factor.ID.String())
+	assert.ErrorIs(t, err, ErrStepUpRequired)
+
+	deleted, err := manager.DeleteFactor(ctx, user, "session-1", factor.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, "totp", deleted.Type)
+
+	// The recovery codes went with the last other factor.
+	stored, err := repo.GetMFAFactorsByUserID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+	_, err = manager.DeleteFactor(ctx, user, "session-1", factor.ID.String())
+	assert.ErrorIs(t, err, ErrFactorNotFound)
+}
+
+func TestAuthorizeEnrollment(t *testing.T) {
+	ctx := context.Background()
+	manager, _, user := newFactorManager(t)
+
+	// The first factor needs no step-up.
+	require.NoError(t, manager.AuthorizeEnrollment(ctx, user, ""))
+	_, secret := enrollTOTP(t, manager, user)
+
+	assert.ErrorIs(t, manager.AuthorizeEnrollment(ctx, user, "session-1"), ErrStepUpRequired)
+	stepUp, err := manager.BeginStepUp(ctx, user, "totp")
+	require.NoError(t, err)
+	code, _ := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, manager.CompleteStepUp(ctx, stepUp.ChallengeID, user, "session-1", "totp", code))
+	assert.NoError(t, manager.AuthorizeEnrollment(ctx, user, "session-1"))
+}
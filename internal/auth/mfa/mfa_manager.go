@@ -3,6 +3,7 @@ package mfa
 import (
 	"context"
 	"fmt"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/notification"
 )
@@ -12,6 +13,9 @@ type MFAManager struct {
 	providers       map[string]MFAProvider
 	otpProvider     *OTPProvider
 	notifierManager notification.Manager
+	redisClient     redis.RedisClientInterface
+	challengeConfig ChallengeConfig
+	factorStore     FactorStore
 }
 
 // NewMFAManager creates a new MFAManager.
@@ -56,8 +60,8 @@ func (m *MFAManager) GetAvailableMFAMethods(ctx context.Context, user *types.Use
 	return availableMethods, nil
 }
 
-// Challenge generates an MFA challenge for the user.
-func (m *MFAManager) Challenge(ctx context.Context, user *types.User, providerName string) (*types.MFAChallenge, error) {
+// sendChallenge asks a provider to challenge the user, e.g. by sending an OTP.
+func (m *MFAManager) sendChallenge(ctx context.Context, user *types.User, providerName string) (*types.MFAChallenge, error) {
 	// Handle OTP providers (Email, SMS) specifically if they are not in the standard provider map
 	// Or assuming "email" and "sms" are passed as providerName
 	if providerName == "email" || providerName == "sms" {
@@ -101,8 +105,8 @@ func (m *MFAManager) Challenge(ctx context.Context, user *types.User, providerNa
 	return provider.Challenge(ctx, user)
 }
 
-// Verify verifies the user's response to an MFA challenge.
-func (m *MFAManager) Verify(ctx context.Context, user *types.User, providerName, code string) (bool, error) {
+// verifyCode asks a provider to verify the user's response to its challenge.
+func (m *MFAManager) verifyCode(ctx context.Context, user *types.User, providerName, code string) (bool, error) {
 	if providerName == "email" || providerName == "sms" {
 		if m.otpProvider == nil {
 			return false, fmt.Errorf("otp provider not configured")
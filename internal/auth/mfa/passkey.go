@@ -0,0 +1,253 @@
+package mfa
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gorm.io/datatypes"
+)
+
+const (
+	defaultPasskeyName   = "Passkey"
+	maxPasskeyNameLength = 64
+)
+
+var (
+	// ErrAttestationNotAllowed is returned when a credential is registered
+	// with an attestation or from an authenticator model the policy refuses.
+	ErrAttestationNotAllowed = errors.New("authenticator not allowed by the attestation policy")
+	// ErrPasskeyNotFound is returned for a passkey the user does not have.
+	ErrPasskeyNotFound = errors.New("passkey not found")
+	// ErrCloneWarning is returned when the signature counter of a credential
+	// went backwards, which suggests a cloned authenticator.
+	ErrCloneWarning = errors.New("authenticator signature counter suggests a cloned credential")
+)
+
+// AttestationPolicy decides which authenticators may register credentials.
+type AttestationPolicy struct {
+	// Conveyance is the attestation asked of authenticators: "none" (the
+	// default), "indirect" or "direct". With "direct", credentials without an
+	// attestation statement are refused.
+	Conveyance string
+	// AllowedAAGUIDs, when set, restricts registration to the authenticator
+	// models with these AAGUIDs. It needs an indirect or direct conveyance,
+	// as browsers hide the AAGUID otherwise.
+	AllowedAAGUIDs []string
+}
+
+func (a AttestationPolicy) parse() (protocol.ConveyancePreference, map[uuid.UUID]bool, error) {
+	conveyance := protocol.ConveyancePreference(strings.ToLower(a.Conveyance))
+	switch conveyance {
+	case "":
+		conveyance = protocol.PreferNoAttestation
+	case protocol.PreferNoAttestation, protocol.PreferIndirectAttestation, protocol.PreferDirectAttestation:
+	default:
+		return "", nil, fmt.Errorf("unsupported attestation conveyance %q", a.Conveyance)
+	}
+	if len(a.AllowedAAGUIDs) == 0 {
+		return conveyance, nil, nil
+	}
+	if conveyance == protocol.PreferNoAttestation {
+		return "", nil, fmt.Errorf("allowed AAGUIDs need an indirect or direct attestation conveyance")
+	}
+	allowed := make(map[uuid.UUID]bool, len(a.AllowedAAGUIDs))
+	for _, s := range a.AllowedAAGUIDs {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid AAGUID %q: %w", s, err)
+		}
+		allowed[id] = true
+	}
+	return conveyance, allowed, nil
+}
+
+// checkAttestation enforces the attestation policy on a new credential.
+func (p *WebAuthnProvider) checkAttestation(credential *webauthn.Credential) error {
+	if p.conveyance == protocol.PreferDirectAttestation && (credential.AttestationType == "" || credential.AttestationType == "none") {
+		return fmt.Errorf("%w: an attestation statement is required", ErrAttestationNotAllowed)
+	}
+	if p.allowedAAGUIDs == nil {
+		return nil
+	}
+	aaguid, err := uuid.FromBytes(credential.Authenticator.AAGUID)
+	if err != nil || !p.allowedAAGUIDs[aaguid] {
+		return fmt.Errorf("%w: AAGUID %s", ErrAttestationNotAllowed, aaguid)
+	}
+	return nil
+}
+
+// credentialMetadata is what is stored about a WebAuthn credential besides
+// its ID and public key.
+type credentialMetadata struct {
+	Name            string `json:",omitempty"`
+	AttestationType string
+	Transport       []protocol.AuthenticatorTransport
+	Flags           struct {
+		UserPresent    bool `json:"userPresent"`
+		UserVerified   bool `json:"userVerified"`
+		BackupEligible bool `json:"backupEligible"`
+		BackupState    bool `json:"backupState"`
+	}
+	Authenticator webauthn.Authenticator
+}
+
+// Passkey describes a registered WebAuthn credential of a user.
+type Passkey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	AAGUID     string     `json:"aaguid,omitempty"`
+	Synced     bool       `json:"synced"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// BeginDiscoverableLogin starts a login without a username: the
+// authenticator offers the passkeys it holds for the relying party, and the
+// one chosen identifies the user. With conditional set the browser offers
+// them in the autofill of the username field instead of a modal dialog.
+// User verification is required, so that the passkey alone is enough.
+func (p *WebAuthnProvider) BeginDiscoverableLogin(ctx context.Context, conditional bool) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	mediation := protocol.MediationDefault
+	if conditional {
+		mediation = protocol.MediationConditional
+	}
+	return p.w.BeginDiscoverableMediatedLogin(mediation, webauthn.WithUserVerification(protocol.VerificationRequired))
+}
+
+// FinishDiscoverableLogin verifies the response to a discoverable login and
+// returns the user, resolved with lookup from the user handle of the passkey.
+func (p *WebAuthnProvider) FinishDiscoverableLogin(ctx context.Context, lookup func(ctx context.Context, userID string) (*types.User, error), sessionData webauthn.SessionData, r *http.Request) (*types.User, *webauthn.Credential, error) {
+	var user *types.User
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		u, err := lookup(ctx, string(userHandle))
+		if err != nil {
+			return nil, fmt.Errorf("unknown passkey user: %w", err)
+		}
+		creds, err := p.loadCredentials(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		user = u
+		return WebAuthnUserAdapter{user: u, credentials: creds}, nil
+	}
+
+	_, credential, err := p.w.FinishPasskeyLogin(handler, sessionData, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, nil, ErrCloneWarning
+	}
+	p.recordUse(ctx, user, credential)
+	return user, credential, nil
+}
+
+// recordUse stores when a credential was last used and its signature
+// counter, against which the next login is checked for cloning.
+func (p *WebAuthnProvider) recordUse(ctx context.Context, user *types.User, credential *webauthn.Credential) {
+	factor, meta, err := p.findPasskey(ctx, user.ID, func(f *types.MFAFactor) bool {
+		return f.CredentialID == base64.RawURLEncoding.EncodeToString(credential.ID)
+	})
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	factor.LastUsedAt = &now
+	meta.Authenticator.SignCount = credential.Authenticator.SignCount
+	meta.Flags.BackupState = credential.Flags.BackupState
+	if data, err := json.Marshal(meta); err == nil {
+		factor.Metadata = datatypes.JSON(data)
+	}
+	_ = p.mfaRepo.UpdateFactor(ctx, factor)
+}
+
+// ListPasskeys returns the passkeys of a user.
+func (p *WebAuthnProvider) ListPasskeys(ctx context.Context, userID string) ([]*Passkey, error) {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user id: %w", err)
+	}
+	factors, err := p.mfaRepo.GetUserFactorsByType(ctx, id, "webauthn")
+	if err != nil {
+		return nil, err
+	}
+	passkeys := make([]*Passkey, 0, len(factors))
+	for _, f := range factors {
+		var meta credentialMetadata
+		_ = json.Unmarshal(f.Metadata, &meta)
+		passkey := &Passkey{
+			ID:         f.ID.String(),
+			Name:       meta.Name,
+			Synced:     meta.Flags.BackupState,
+			CreatedAt:  f.CreatedAt,
+			LastUsedAt: f.LastUsedAt,
+		}
+		if passkey.Name == "" {
+			passkey.Name = defaultPasskeyName
+		}
+		if aaguid, err := uuid.FromBytes(meta.Authenticator.AAGUID); err == nil && aaguid != uuid.Nil {
+			passkey.AAGUID = aaguid.String()
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, nil
+}
+
+// RenamePasskey changes the name a user gave a passkey.
+func (p *WebAuthnProvider) RenamePasskey(ctx context.Context, userID, passkeyID, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxPasskeyNameLength {
+		return fmt.Errorf("passkey name must have 1 to %d characters", maxPasskeyNameLength)
+	}
+	factor, meta, err := p.findPasskey(ctx, userID, func(f *types.MFAFactor) bool { return f.ID.String() == passkeyID })
+	if err != nil {
+		return err
+	}
+	meta.Name = name
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	factor.Metadata = datatypes.JSON(data)
+	return p.mfaRepo.UpdateFactor(ctx, factor)
+}
+
+// DeletePasskey removes a passkey of a user, who can no longer sign in with it.
+func (p *WebAuthnProvider) DeletePasskey(ctx context.Context, userID, passkeyID string) error {
+	factor, _, err := p.findPasskey(ctx, userID, func(f *types.MFAFactor) bool { return f.ID.String() == passkeyID })
+	if err != nil {
+		return err
+	}
+	return p.mfaRepo.DeleteFactor(ctx, factor.ID)
+}
+
+// findPasskey returns the first WebAuthn factor of the user that matches,
+// so that users can only reach their own passkeys.
+func (p *WebAuthnProvider) findPasskey(ctx context.Context, userID string, match func(*types.MFAFactor) bool) (*types.MFAFactor, *credentialMetadata, error) {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, nil, ErrPasskeyNotFound
+	}
+	factors, err := p.mfaRepo.GetUserFactorsByType(ctx, id, "webauthn")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range factors {
+		if match(f) {
+			var meta credentialMetadata
+			_ = json.Unmarshal(f.Metadata, &meta)
+			return f, &meta, nil
+		}
+	}
+	return nil, nil, ErrPasskeyNotFound
+}
@@ -0,0 +1,124 @@
+package mfa
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gorm.io/datatypes"
+)
+
+type memoryWebAuthnRepository struct {
+	factors []*types.MFAFactor
+}
+
+func (r *memoryWebAuthnRepository) GetUserFactorsByType(ctx context.Context, userID uuid.UUID, factorType string) ([]*types.MFAFactor, error) {
+	var out []*types.MFAFactor
+	for _, f := range r.factors {
+		if f.UserID == userID && f.Type == factorType {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryWebAuthnRepository) CreateFactor(ctx context.Context, factor *types.MFAFactor) error {
+	factor.ID = uuid.New()
+	r.factors = append(r.factors, factor)
+	return nil
+}
+
+func (r *memoryWebAuthnRepository) UpdateFactor(ctx context.Context, factor *types.MFAFactor) error {
+	return nil
+}
+
+func (r *memoryWebAuthnRepository) DeleteFactor(ctx context.Context, factorID uuid.UUID) error {
+	for i, f := range r.factors {
+		if f.ID == factorID {
+			r.factors = append(r.factors[:i], r.factors[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func newTestWebAuthnProvider(t *testing.T, policy AttestationPolicy, repo MFARepository) *WebAuthnProvider {
+	provider, err := NewWebAuthnProvider(WebAuthnConfig{
+		RPID:          "localhost",
+		RPOrigin:      "http://localhost:8080",
+		RPDisplayName: "QuantaID",
+		Attestation:   policy,
+	}, repo)
+	require.NoError(t, err)
+	return provider
+}
+
+func TestAttestationPolicy(t *testing.T) {
+	yubikey := "cb69481e-8ff7-4039-93ec-0a2729a154a8"
+
+	_, err := NewWebAuthnProvider(WebAuthnConfig{RPID: "localhost", RPOrigin: "http://localhost", RPDisplayName: "Q", Attestation: AttestationPolicy{Conveyance: "enterprise-ish"}}, nil)
+	assert.Error(t, err)
+	_, err = NewWebAuthnProvider(WebAuthnConfig{RPID: "localhost", RPOrigin: "http://localhost", RPDisplayName: "Q", Attestation: AttestationPolicy{AllowedAAGUIDs: []string{yubikey}}}, nil)
+	assert.Error(t, err, "an AAGUID list needs attestation")
+
+	provider := newTestWebAuthnProvider(t, AttestationPolicy{Conveyance: "direct", AllowedAAGUIDs: []string{yubikey}}, nil)
+	allowed := uuid.MustParse(yubikey)
+	assert.NoError(t, provider.checkAttestation(&webauthn.Credential{AttestationType: "packed", Authenticator: webauthn.Authenticator{AAGUID: allowed[:]}}))
+	assert.ErrorIs(t, provider.checkAttestation(&webauthn.Credential{AttestationType: "none", Authenticator: webauthn.Authenticator{AAGUID: allowed[:]}}), ErrAttestationNotAllowed)
+	other := uuid.New()
+	assert.ErrorIs(t, provider.checkAttestation(&webauthn.Credential{AttestationType: "packed", Authenticator: webauthn.Authenticator{AAGUID: other[:]}}), ErrAttestationNotAllowed)
+
+	open := newTestWebAuthnProvider(t, AttestationPolicy{}, nil)
+	assert.NoError(t, open.checkAttestation(&webauthn.Credential{AttestationType: "none"}))
+}
+
+func TestBeginDiscoverableLogin(t *testing.T) {
+	provider := newTestWebAuthnProvider(t, AttestationPolicy{}, nil)
+
+	options, session, err := provider.BeginDiscoverableLogin(context.Background(), true)
+	require.NoError(t, err)
+	assert.Empty(t, session.UserID)
+	assert.Equal(t, protocol.MediationConditional, options.Mediation)
+	assert.Empty(t, options.Response.AllowedCredentials)
+	assert.Equal(t, protocol.VerificationRequired, options.Response.UserVerification)
+
+	options, _, err = provider.BeginDiscoverableLogin(context.Background(), false)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.MediationDefault, options.Mediation)
+}
+
+func TestPasskeyManagement(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := uuid.New(), uuid.New()
+	meta, _ := json.Marshal(credentialMetadata{AttestationType: "none"})
+	repo := &memoryWebAuthnRepository{}
+	require.NoError(t, repo.CreateFactor(ctx, &types.MFAFactor{UserID: alice, Type: "webauthn", Metadata: datatypes.JSON(meta)}))
+	require.NoError(t, repo.CreateFactor(ctx, &types.MFAFactor{UserID: bob, Type: "webauthn"}))
+	provider := newTestWebAuthnProvider(t, AttestationPolicy{}, repo)
+
+	passkeys, err := provider.ListPasskeys(ctx, alice.String())
+	require.NoError(t, err)
+	require.Len(t, passkeys, 1)
+	assert.Equal(t, "Passkey", passkeys[0].Name)
+	id := passkeys[0].ID
+
+	require.NoError(t, provider.RenamePasskey(ctx, alice.String(), id, "  Work laptop "))
+	assert.Error(t, provider.RenamePasskey(ctx, alice.String(), id, " "))
+	passkeys, _ = provider.ListPasskeys(ctx, alice.String())
+	assert.Equal(t, "Work laptop", passkeys[0].Name)
+
+	// Users reach only their own passkeys.
+	assert.ErrorIs(t, provider.RenamePasskey(ctx, bob.String(), id, "Mine"), ErrPasskeyNotFound)
+	assert.ErrorIs(t, provider.DeletePasskey(ctx, bob.String(), id), ErrPasskeyNotFound)
+
+	require.NoError(t, provider.DeletePasskey(ctx, alice.String(), id))
+	passkeys, _ = provider.ListPasskeys(ctx, alice.String())
+	assert.Empty(t, passkeys)
+	passkeys, _ = provider.ListPasskeys(ctx, bob.String())
+	assert.Len(t, passkeys, 1)
+}
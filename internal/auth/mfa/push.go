@@ -0,0 +1,425 @@
+package mfa
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gorm.io/datatypes"
+)
+
+// Decisions a device can send in answer to a push approval.
+const (
+	PushDecisionApprove = "approve"
+	PushDecisionDeny    = "deny"
+)
+
+const (
+	pushStatusPending  = "pending"
+	pushStatusApproved = "approved"
+	pushStatusDenied   = "denied"
+
+	defaultPushTTL = 2 * time.Minute
+)
+
+var (
+	// ErrApprovalPending is returned while the user has not answered a push approval yet.
+	ErrApprovalPending = errors.New("push approval pending")
+	// ErrApprovalDenied is returned when the user denied a push approval or
+	// entered the wrong number on their device.
+	ErrApprovalDenied = errors.New("push approval denied")
+	// ErrApprovalNotFound is returned for an unknown, expired or already answered approval.
+	ErrApprovalNotFound = errors.New("push approval not found or expired")
+	// ErrInvalidDeviceKey is returned when a device registers a key that is not an Ed25519 public key.
+	ErrInvalidDeviceKey = errors.New("device public key must be an Ed25519 key")
+	// ErrInvalidDeviceSignature is returned when a response is not signed by the device's key.
+	ErrInvalidDeviceSignature = errors.New("invalid device signature")
+)
+
+// ApprovalContext describes the login a push approval is for, so that the
+// user can tell it is theirs.
+type ApprovalContext struct {
+	IPAddress   string `json:"ip_address,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Application string `json:"application,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+type approvalContextKey struct{}
+
+// WithApprovalContext returns a context that carries the login context
+// shown with push approvals.
+func WithApprovalContext(ctx context.Context, ac ApprovalContext) context.Context {
+	return context.WithValue(ctx, approvalContextKey{}, ac)
+}
+
+func approvalContextFrom(ctx context.Context) ApprovalContext {
+	ac, _ := ctx.Value(approvalContextKey{}).(ApprovalContext)
+	return ac
+}
+
+// PushNotification is what a gateway delivers to a device. It does not carry
+// the number to match; the user reads it from the login screen.
+type PushNotification struct {
+	ApprovalID  string          `json:"approval_id"`
+	DeviceID    string          `json:"device_id"`
+	DeviceToken string          `json:"device_token"`
+	Username    string          `json:"username"`
+	Context     ApprovalContext `json:"context"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+}
+
+// PushGateway delivers push notifications to devices, e.g. through APNs or FCM.
+type PushGateway interface {
+	Send(ctx context.Context, notification *PushNotification) error
+}
+
+// PushResponse is a device's signed answer to a push approval.
+type PushResponse struct {
+	ApprovalID string `json:"approval_id"`
+	DeviceID   string `json:"device_id"`
+	Decision   string `json:"decision"`
+	Number     int    `json:"number"`
+	// Signature is the device's Ed25519 signature of SignedMessage, in base64.
+	Signature []byte `json:"signature"`
+}
+
+// SignedMessage returns the bytes a device signs for its response.
+func (r *PushResponse) SignedMessage() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s:%d", r.ApprovalID, r.DeviceID, r.Decision, r.Number))
+}
+
+// PushConfig configures push approvals.
+type PushConfig struct {
+	// TTL is how long an approval can be answered.
+	TTL time.Duration
+}
+
+// pushApproval is the server-side state of a push approval, kept in Redis
+// until it is verified or expires.
+type pushApproval struct {
+	ID        string          `json:"id"`
+	UserID    string          `json:"user_id"`
+	Number    int             `json:"number"`
+	Status    string          `json:"status"`
+	Devices   []string        `json:"devices"`
+	DeviceID  string          `json:"device_id,omitempty"`
+	Context   ApprovalContext `json:"context"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// pushDeviceMetadata is what is stored about a push device besides its key.
+type pushDeviceMetadata struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// PushProvider implements MFAProvider with out-of-band approvals on a
+// registered device. The login screen shows a number that the user enters
+// on the device, which signs its approve or deny decision with its key.
+type PushProvider struct {
+	repo    MFAFactorRepository
+	client  redis.RedisClientInterface
+	gateway PushGateway
+	config  PushConfig
+	now     func() time.Time
+}
+
+// NewPushProvider creates a new PushProvider.
+func NewPushProvider(repo MFAFactorRepository, client redis.RedisClientInterface, gateway PushGateway, config PushConfig) *PushProvider {
+	if config.TTL <= 0 {
+		config.TTL = defaultPushTTL
+	}
+	return &PushProvider{
+		repo:    repo,
+		client:  client,
+		gateway: gateway,
+		config:  config,
+		now:     time.Now,
+	}
+}
+
+// RegisterDevice enrolls a device of the user. token is the gateway's
+// address of the device and publicKey the Ed25519 key it signs responses with.
+func (p *PushProvider) RegisterDevice(ctx context.Context, user *types.User, name, token string, publicKey []byte) (*types.MFAFactor, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrInvalidDeviceKey
+	}
+	userID, err := uuid.Parse(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+	if name == "" {
+		name = "Mobile device"
+	}
+	meta, err := json.Marshal(pushDeviceMetadata{Name: name, Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	factor := &types.MFAFactor{
+		UserID:    userID,
+		Type:      "push",
+		Status:    "enrolled",
+		PublicKey: publicKey,
+		Metadata:  datatypes.JSON(meta),
+		CreatedAt: p.now(),
+	}
+	if err := p.repo.CreateMFAFactor(ctx, factor); err != nil {
+		return nil, fmt.Errorf("failed to save MFA factor: %w", err)
+	}
+	return factor, nil
+}
+
+// Enroll is not used for push; devices enroll with RegisterDevice.
+func (p *PushProvider) Enroll(ctx context.Context, user *types.User) (*types.MFAEnrollment, error) {
+	return nil, fmt.Errorf("push devices enroll with RegisterDevice")
+}
+
+// Challenge creates a pending approval and sends it to the user's devices,
+// with the approval context of ctx. The number to enter on the device and
+// the approval ID to verify with are in the challenge options.
+func (p *PushProvider) Challenge(ctx context.Context, user *types.User) (*types.MFAChallenge, error) {
+	devices, err := p.devices(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, ErrNoEnrolledFactors
+	}
+	number, err := rand.Int(rand.Reader, big.NewInt(90))
+	if err != nil {
+		return nil, err
+	}
+
+	now := p.now()
+	approval := &pushApproval{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Number:    int(number.Int64()) + 10,
+		Status:    pushStatusPending,
+		Context:   approvalContextFrom(ctx),
+		CreatedAt: now,
+		ExpiresAt: now.Add(p.config.TTL),
+	}
+	for _, d := range devices {
+		approval.Devices = append(approval.Devices, d.ID.String())
+	}
+	if err := p.save(ctx, approval); err != nil {
+		return nil, err
+	}
+
+	sent := 0
+	var sendErr error
+	for _, d := range devices {
+		var meta pushDeviceMetadata
+		_ = json.Unmarshal(d.Metadata, &meta)
+		err := p.gateway.Send(ctx, &PushNotification{
+			ApprovalID:  approval.ID,
+			DeviceID:    d.ID.String(),
+			DeviceToken: meta.Token,
+			Username:    user.Username,
+			Context:     approval.Context,
+			ExpiresAt:   approval.ExpiresAt,
+		})
+		if err != nil {
+			sendErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		_ = p.client.Del(ctx, pushApprovalKey(approval.ID))
+		return nil, fmt.Errorf("failed to send push approval: %w", sendErr)
+	}
+
+	return &types.MFAChallenge{
+		ChallengeID: approval.ID,
+		MFAProvider: "push",
+		Options: map[string]interface{}{
+			"approval_id": approval.ID,
+			"number":      approval.Number,
+		},
+	}, nil
+}
+
+// Respond records a device's answer to an approval. The response must be
+// signed by one of the devices the approval was sent to, and only the first
+// answer counts. Approving with the wrong number denies the approval.
+func (p *PushProvider) Respond(ctx context.Context, resp *PushResponse) error {
+	approval, err := p.load(ctx, resp.ApprovalID)
+	if err != nil {
+		return err
+	}
+	if approval.Status != pushStatusPending || !contains(approval.Devices, resp.DeviceID) {
+		return ErrApprovalNotFound
+	}
+	if resp.Decision != PushDecisionApprove && resp.Decision != PushDecisionDeny {
+		return fmt.Errorf("unknown decision %q", resp.Decision)
+	}
+
+	device, err := p.device(ctx, approval.UserID, resp.DeviceID)
+	if err != nil {
+		return err
+	}
+	if len(device.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(device.PublicKey, resp.SignedMessage(), resp.Signature) {
+		return ErrInvalidDeviceSignature
+	}
+
+	first, err := p.client.SetNX(ctx, pushApprovalKey(approval.ID)+":answered", resp.DeviceID, approval.ExpiresAt.Sub(p.now())).Result()
+	if err != nil {
+		return fmt.Errorf("failed to record push response: %w", err)
+	}
+	if !first {
+		return ErrApprovalNotFound
+	}
+
+	approval.Status = pushStatusDenied
+	if resp.Decision == PushDecisionApprove && resp.Number == approval.Number {
+		approval.Status = pushStatusApproved
+	}
+	approval.DeviceID = resp.DeviceID
+	return p.save(ctx, approval)
+}
+
+// Verify checks the approval with the ID in code. It returns
+// ErrApprovalPending until the user answers, and ErrApprovalDenied if they
+// deny it. An approved approval verifies once.
+func (p *PushProvider) Verify(ctx context.Context, user *types.User, code string) (bool, error) {
+	approval, err := p.load(ctx, code)
+	if errors.Is(err, ErrApprovalNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if approval.UserID != user.ID {
+		return false, nil
+	}
+
+	switch approval.Status {
+	case pushStatusPending:
+		return false, ErrApprovalPending
+	case pushStatusDenied:
+		p.discard(ctx, approval.ID)
+		return false, ErrApprovalDenied
+	}
+
+	deleted, err := p.client.Client().Del(ctx, pushApprovalKey(approval.ID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to consume push approval: %w", err)
+	}
+	if deleted == 0 {
+		return false, nil
+	}
+	if device, err := p.device(ctx, user.ID, approval.DeviceID); err == nil {
+		now := p.now()
+		device.LastUsedAt = &now
+		_ = p.repo.UpdateMFAFactor(ctx, device)
+	}
+	return true, nil
+}
+
+// ListMethods returns the registered push devices of the user.
+func (p *PushProvider) ListMethods(ctx context.Context, user *types.User) ([]*types.MFAMethod, error) {
+	devices, err := p.devices(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	var methods []*types.MFAMethod
+	for _, d := range devices {
+		methods = append(methods, &types.MFAMethod{
+			ID:   d.ID.String(),
+			Type: "push",
+		})
+	}
+	return methods, nil
+}
+
+// GetStrength returns the strength of the push provider.
+func (p *PushProvider) GetStrength() StrengthLevel {
+	return StrengthLevelNormal
+}
+
+func (p *PushProvider) devices(ctx context.Context, user *types.User) ([]*types.MFAFactor, error) {
+	factors, err := p.repo.GetMFAFactorsByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MFA factors: %w", err)
+	}
+	var devices []*types.MFAFactor
+	for _, f := range factors {
+		if f.Type == "push" && f.Status == "enrolled" {
+			devices = append(devices, f)
+		}
+	}
+	return devices, nil
+}
+
+func (p *PushProvider) device(ctx context.Context, userID, deviceID string) (*types.MFAFactor, error) {
+	devices, err := p.devices(ctx, &types.User{ID: userID})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if d.ID.String() == deviceID {
+			return d, nil
+		}
+	}
+	return nil, ErrApprovalNotFound
+}
+
+func (p *PushProvider) save(ctx context.Context, approval *pushApproval) error {
+	ttl := approval.ExpiresAt.Sub(p.now())
+	if ttl <= 0 {
+		return ErrApprovalNotFound
+	}
+	data, err := json.Marshal(approval)
+	if err != nil {
+		return fmt.Errorf("failed to encode push approval: %w", err)
+	}
+	if err := p.client.Set(ctx, pushApprovalKey(approval.ID), data, ttl); err != nil {
+		return fmt.Errorf("failed to store push approval: %w", err)
+	}
+	return nil
+}
+
+func (p *PushProvider) load(ctx context.Context, approvalID string) (*pushApproval, error) {
+	if approvalID == "" {
+		return nil, ErrApprovalNotFound
+	}
+	data, err := p.client.Get(ctx, pushApprovalKey(approvalID))
+	if err != nil {
+		return nil, ErrApprovalNotFound
+	}
+	var approval pushApproval
+	if err := json.Unmarshal([]byte(data), &approval); err != nil {
+		return nil, fmt.Errorf("failed to decode push approval: %w", err)
+	}
+	return &approval, nil
+}
+
+func (p *PushProvider) discard(ctx context.Context, approvalID string) {
+	_ = p.client.Del(ctx, pushApprovalKey(approvalID), pushApprovalKey(approvalID)+":answered")
+}
+
+func pushApprovalKey(id string) string {
+	return "mfa:push:" + id
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
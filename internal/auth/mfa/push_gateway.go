@@ -0,0 +1,49 @@
+package mfa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HTTPPushGateway is a stand-in PushGateway that posts notifications as JSON
+// to a callback URL instead of a push service. It lets a device simulator or
+// a test receive approvals without APNs or FCM credentials.
+type HTTPPushGateway struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPPushGateway creates a gateway that posts notifications to url.
+func NewHTTPPushGateway(url string, client *http.Client) *HTTPPushGateway {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &HTTPPushGateway{url: url, client: client}
+}
+
+// Send posts the notification to the callback URL.
+func (g *HTTPPushGateway) Send(ctx context.Context, notification *PushNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to encode push notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create push request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send push notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("push gateway returned status %d", resp.StatusCode)
+	}
+	return nil
+}
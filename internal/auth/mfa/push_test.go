@@ -0,0 +1,146 @@
+package mfa
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// pushDevice simulates a device that receives approvals through the HTTP
+// stand-in gateway and answers them with its key.
+type pushDevice struct {
+	id            string
+	key           ed25519.PrivateKey
+	notifications chan *PushNotification
+}
+
+func (d *pushDevice) answer(approvalID, decision string, number int) *PushResponse {
+	resp := &PushResponse{ApprovalID: approvalID, DeviceID: d.id, Decision: decision, Number: number}
+	resp.Signature = ed25519.Sign(d.key, resp.SignedMessage())
+	return resp
+}
+
+// newPushManager returns a manager with TOTP, recovery code and push
+// providers, and a registered push device of the user.
+func newPushManager(t *testing.T) (*MFAManager, *PushProvider, *pushDevice, *types.User) {
+	manager, repo, user := newFactorManager(t)
+	device := &pushDevice{notifications: make(chan *PushNotification, 4)}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n PushNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		device.notifications <- &n
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(gateway.Close)
+
+	provider := NewPushProvider(repo, manager.redisClient, NewHTTPPushGateway(gateway.URL, nil), PushConfig{})
+	manager.RegisterProvider("push", provider)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	factor, err := provider.RegisterDevice(context.Background(), user, "Phone", "device-token", public)
+	require.NoError(t, err)
+	device.id = factor.ID.String()
+	device.key = private
+	return manager, provider, device, user
+}
+
+func pushChallenge(t *testing.T, manager *MFAManager, user *types.User) (*types.MFAChallenge, string, int) {
+	ctx := WithApprovalContext(context.Background(), ApprovalContext{
+		IPAddress:   "203.0.113.7",
+		Location:    "Berlin, Germany",
+		Application: "Payroll",
+	})
+	challenge, err := manager.Challenge(ctx, user, "medium", "push")
+	require.NoError(t, err)
+	return challenge, challenge.Options["approval_id"].(string), challenge.Options["number"].(int)
+}
+
+func TestPushProvider_RegisterDeviceNeedsEd25519Key(t *testing.T) {
+	manager, _, user := newFactorManager(t)
+	provider := NewPushProvider(nil, manager.redisClient, nil, PushConfig{})
+	_, err := provider.RegisterDevice(context.Background(), user, "Phone", "token", []byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidDeviceKey)
+}
+
+func TestPushProvider_ApproveWithMatchingNumber(t *testing.T) {
+	ctx := context.Background()
+	manager, provider, device, user := newPushManager(t)
+	challenge, approvalID, number := pushChallenge(t, manager, user)
+
+	notification := <-device.notifications
+	assert.Equal(t, approvalID, notification.ApprovalID)
+	assert.Equal(t, "device-token", notification.DeviceToken)
+	assert.Equal(t, "alice", notification.Username)
+	assert.Equal(t, "Berlin, Germany", notification.Context.Location)
+	assert.Equal(t, "Payroll", notification.Context.Application)
+
+	// Polling before the user answers does not use up attempts.
+	for i := 0; i < defaultChallengeMaxAttempts+1; i++ {
+		_, err := manager.Verify(ctx, challenge.ChallengeID, user, "push", approvalID)
+		require.ErrorIs(t, err, ErrApprovalPending)
+	}
+
+	forged := device.answer(approvalID, PushDecisionApprove, number)
+	forged.Signature[0] ^= 0xff
+	assert.ErrorIs(t, provider.Respond(ctx, forged), ErrInvalidDeviceSignature)
+
+	require.NoError(t, provider.Respond(ctx, device.answer(approvalID, PushDecisionApprove, number)))
+	assert.ErrorIs(t, provider.Respond(ctx, device.answer(approvalID, PushDecisionDeny, number)), ErrApprovalNotFound)
+
+	state, err := manager.Verify(ctx, challenge.ChallengeID, user, "push", approvalID)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, state.UserID)
+
+	factors, err := manager.ListFactors(ctx, user)
+	require.NoError(t, err)
+	require.Len(t, factors, 1)
+	assert.NotNil(t, factors[0].LastUsedAt)
+}
+
+func TestPushProvider_WrongNumberDenies(t *testing.T) {
+	ctx := context.Background()
+	manager, provider, device, user := newPushManager(t)
+	challenge, approvalID, number := pushChallenge(t, manager, user)
+	<-device.notifications
+
+	require.NoError(t, provider.Respond(ctx, device.answer(approvalID, PushDecisionApprove, number%99+1)))
+	_, err := manager.Verify(ctx, challenge.ChallengeID, user, "push", approvalID)
+	assert.ErrorIs(t, err, ErrApprovalDenied)
+
+	// A denied approval ends the login challenge.
+	_, err = manager.Verify(ctx, challenge.ChallengeID, user, "push", approvalID)
+	assert.ErrorIs(t, err, ErrChallengeNotFound)
+}
+
+func TestPushProvider_Deny(t *testing.T) {
+	ctx := context.Background()
+	manager, provider, device, user := newPushManager(t)
+	challenge, approvalID, number := pushChallenge(t, manager, user)
+	<-device.notifications
+
+	require.NoError(t, provider.Respond(ctx, device.answer(approvalID, PushDecisionDeny, number)))
+	_, err := manager.Verify(ctx, challenge.ChallengeID, user, "push", approvalID)
+	assert.ErrorIs(t, err, ErrApprovalDenied)
+}
+
+func TestPushProvider_UnknownDevice(t *testing.T) {
+	ctx := context.Background()
+	manager, provider, device, user := newPushManager(t)
+	_, approvalID, number := pushChallenge(t, manager, user)
+	<-device.notifications
+
+	other := &pushDevice{id: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", key: device.key}
+	assert.ErrorIs(t, provider.Respond(ctx, other.answer(approvalID, PushDecisionApprove, number)), ErrApprovalNotFound)
+	assert.ErrorIs(t, provider.Respond(ctx, device.answer("unknown", PushDecisionApprove, number)), ErrApprovalNotFound)
+}
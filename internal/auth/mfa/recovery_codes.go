@@ -4,11 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/google/uuid"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 )
 
 // RecoveryCodeProvider handles the generation and verification of MFA recovery codes.
+// It implements MFAProvider, so that recovery codes can answer a challenge
+// when the user's other factors are unavailable.
 type RecoveryCodeProvider struct {
 	repo   MFAFactorRepository
 	crypto utils.CryptoManagerInterface
@@ -91,3 +96,104 @@ func (p *RecoveryCodeProvider) Verify(ctx context.Context, user *types.User, cod
 
 	return false, nil
 }
+
+// Regenerate replaces the recovery codes of a user with a new set, kept in
+// a "recovery" factor of their own, and returns the plaintext codes.
+// Previously issued codes stop working.
+func (p *RecoveryCodeProvider) Regenerate(ctx context.Context, user *types.User) ([]string, error) {
+	factors, err := p.repo.GetMFAFactorsByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MFA factors: %w", err)
+	}
+
+	var recovery *types.MFAFactor
+	for _, factor := range factors {
+		if factor.Type == "recovery" {
+			recovery = factor
+			continue
+		}
+		if len(factor.BackupCodes) > 0 {
+			factor.BackupCodes = nil
+			if err := p.repo.UpdateMFAFactor(ctx, factor); err != nil {
+				return nil, fmt.Errorf("failed to revoke recovery codes: %w", err)
+			}
+		}
+	}
+
+	if recovery == nil {
+		userID, err := uuid.Parse(user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID: %w", err)
+		}
+		recovery = &types.MFAFactor{
+			UserID:    userID,
+			Type:      "recovery",
+			Status:    "enrolled",
+			CreatedAt: time.Now(),
+		}
+		if err := p.repo.CreateMFAFactor(ctx, recovery); err != nil {
+			return nil, fmt.Errorf("failed to save MFA factor: %w", err)
+		}
+	}
+
+	return p.GenerateAndStore(ctx, recovery)
+}
+
+// Remaining returns the number of unused recovery codes of a user.
+func (p *RecoveryCodeProvider) Remaining(ctx context.Context, user *types.User) (int, error) {
+	factors, err := p.repo.GetMFAFactorsByUserID(ctx, user.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get MFA factors: %w", err)
+	}
+
+	remaining := 0
+	for _, factor := range factors {
+		var hashedCodes []string
+		if len(factor.BackupCodes) > 0 && json.Unmarshal(factor.BackupCodes, &hashedCodes) == nil {
+			remaining += len(hashedCodes)
+		}
+	}
+	return remaining, nil
+}
+
+// Enroll issues a new set of recovery codes.
+func (p *RecoveryCodeProvider) Enroll(ctx context.Context, user *types.User) (*types.MFAEnrollment, error) {
+	codes, err := p.Regenerate(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return &types.MFAEnrollment{RecoveryCodes: codes}, nil
+}
+
+// Challenge returns an implicit challenge; the user answers with one of their codes.
+func (p *RecoveryCodeProvider) Challenge(ctx context.Context, user *types.User) (*types.MFAChallenge, error) {
+	return &types.MFAChallenge{
+		ChallengeID: "recovery-challenge",
+		MFAProvider: "recovery",
+	}, nil
+}
+
+// ListMethods returns the recovery factor of the user while it has unused codes.
+func (p *RecoveryCodeProvider) ListMethods(ctx context.Context, user *types.User) ([]*types.MFAMethod, error) {
+	factors, err := p.repo.GetMFAFactorsByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MFA factors: %w", err)
+	}
+
+	var methods []*types.MFAMethod
+	for _, factor := range factors {
+		var hashedCodes []string
+		if factor.Type == "recovery" && json.Unmarshal(factor.BackupCodes, &hashedCodes) == nil && len(hashedCodes) > 0 {
+			methods = append(methods, &types.MFAMethod{
+				ID:   factor.ID.String(),
+				Type: "recovery",
+			})
+		}
+	}
+	return methods, nil
+}
+
+// GetStrength returns the strength of the recovery code provider.
+func (p *RecoveryCodeProvider) GetStrength() StrengthLevel {
+	return StrengthLevelNormal
+}
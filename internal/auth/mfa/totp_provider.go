@@ -1,8 +1,14 @@
 package mfa
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"image/png"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/pquerna/otp/totp"
 	"github.com/turtacn/QuantaID/pkg/types"
@@ -16,6 +22,10 @@ type MFAFactorRepository interface {
 	UpdateMFAFactor(ctx context.Context, factor *types.MFAFactor) error
 }
 
+// ErrNoPendingEnrollment is returned when a TOTP enrollment is confirmed for a
+// user who has not started one.
+var ErrNoPendingEnrollment = errors.New("no pending TOTP enrollment")
+
 // TOTPProvider implements the MFAProvider interface for Time-based One-Time Passwords.
 type TOTPProvider struct {
 	repo   MFAFactorRepository
@@ -30,7 +40,9 @@ func NewTOTPProvider(repo MFAFactorRepository, crypto utils.CryptoManagerInterfa
 	}
 }
 
-// Enroll starts the enrollment process for a new TOTP factor.
+// Enroll starts the enrollment process for a new TOTP factor. The factor is
+// pending, and neither listed nor accepted at login, until it is confirmed
+// with a code from the authenticator app.
 func (p *TOTPProvider) Enroll(ctx context.Context, user *types.User) (*types.MFAEnrollment, error) {
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      "QuantaID",
@@ -51,20 +63,61 @@ func (p *TOTPProvider) Enroll(ctx context.Context, user *types.User) (*types.MFA
 	}
 
 	factor := &types.MFAFactor{
-		UserID: userID,
-		Type:   "totp",
-		Status: "pending",
-		Secret: encryptedSecret,
+		UserID:    userID,
+		Type:      "totp",
+		Status:    "pending",
+		Secret:    encryptedSecret,
+		CreatedAt: time.Now(),
 	}
 
 	if err := p.repo.CreateMFAFactor(ctx, factor); err != nil {
 		return nil, fmt.Errorf("failed to save MFA factor: %w", err)
 	}
 
-	return &types.MFAEnrollment{
+	enrollment := &types.MFAEnrollment{
 		Secret: key.Secret(),
 		URL:    key.URL(),
-	}, nil
+	}
+	if img, err := key.Image(200, 200); err == nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err == nil {
+			enrollment.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+	return enrollment, nil
+}
+
+// Confirm completes the latest pending TOTP enrollment of the user if the
+// code verifies against its secret, and returns the enrolled factor.
+func (p *TOTPProvider) Confirm(ctx context.Context, user *types.User, code string) (*types.MFAFactor, error) {
+	factors, err := p.repo.GetMFAFactorsByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MFA factors: %w", err)
+	}
+
+	var pending *types.MFAFactor
+	for _, factor := range factors {
+		if factor.Type == "totp" && factor.Status == "pending" && (pending == nil || factor.CreatedAt.After(pending.CreatedAt)) {
+			pending = factor
+		}
+	}
+	if pending == nil {
+		return nil, ErrNoPendingEnrollment
+	}
+
+	secret, err := p.crypto.Decrypt(pending.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+	if !totp.Validate(code, secret) {
+		return nil, ErrInvalidCode
+	}
+
+	pending.Status = "enrolled"
+	if err := p.repo.UpdateMFAFactor(ctx, pending); err != nil {
+		return nil, fmt.Errorf("failed to enroll MFA factor: %w", err)
+	}
+	return pending, nil
 }
 
 // Challenge generates a new TOTP challenge.
@@ -76,7 +129,7 @@ func (p *TOTPProvider) Challenge(ctx context.Context, user *types.User) (*types.
 	}, nil
 }
 
-// Verify validates a TOTP code.
+// Verify validates a TOTP code against the enrolled factors of the user.
 func (p *TOTPProvider) Verify(ctx context.Context, user *types.User, code string) (bool, error) {
 	factors, err := p.repo.GetMFAFactorsByUserID(ctx, user.ID)
 	if err != nil {
@@ -84,7 +137,7 @@ func (p *TOTPProvider) Verify(ctx context.Context, user *types.User, code string
 	}
 
 	for _, factor := range factors {
-		if factor.Type == "totp" {
+		if factor.Type == "totp" && factor.Status == "enrolled" {
 			secret, err := p.crypto.Decrypt(factor.Secret)
 			if err != nil {
 				// Log the error, but don't reveal that the secret was invalid
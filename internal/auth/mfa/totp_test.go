@@ -58,6 +58,9 @@ func TestTOTPProvider_Verify(t *testing.T) {
 
 	enrollment, err := provider.Enroll(context.Background(), user)
 	assert.NoError(t, err)
+	factors, err := repo.GetMFAFactorsByUserID(context.Background(), user.ID)
+	assert.NoError(t, err)
+	factors[0].Status = "enrolled"
 
 	validCode, err := totp.GenerateCode(enrollment.Secret, time.Now())
 	assert.NoError(t, err)
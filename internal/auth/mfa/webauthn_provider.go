@@ -21,6 +21,7 @@ type MFARepository interface {
 	GetUserFactorsByType(ctx context.Context, userID uuid.UUID, factorType string) ([]*types.MFAFactor, error)
 	CreateFactor(ctx context.Context, factor *types.MFAFactor) error
 	UpdateFactor(ctx context.Context, factor *types.MFAFactor) error
+	DeleteFactor(ctx context.Context, factorID uuid.UUID) error
 }
 
 // WebAuthnConfig holds the configuration for WebAuthn.
@@ -28,28 +29,39 @@ type WebAuthnConfig struct {
 	RPID          string
 	RPDisplayName string
 	RPOrigin      string
+	// Attestation is the attestation policy of the relying party.
+	Attestation AttestationPolicy
 }
 
 // WebAuthnProvider implements the MFAProvider interface for WebAuthn.
 type WebAuthnProvider struct {
-	w       *webauthn.WebAuthn
-	mfaRepo MFARepository
+	w              *webauthn.WebAuthn
+	mfaRepo        MFARepository
+	conveyance     protocol.ConveyancePreference
+	allowedAAGUIDs map[uuid.UUID]bool
 }
 
 // NewWebAuthnProvider creates a new WebAuthnProvider.
 func NewWebAuthnProvider(cfg WebAuthnConfig, mfaRepo MFARepository) (*WebAuthnProvider, error) {
+	conveyance, allowed, err := cfg.Attestation.parse()
+	if err != nil {
+		return nil, err
+	}
 	w, err := webauthn.New(&webauthn.Config{
-		RPDisplayName: cfg.RPDisplayName,
-		RPID:          cfg.RPID,
-		RPOrigins:     []string{cfg.RPOrigin},
+		RPDisplayName:         cfg.RPDisplayName,
+		RPID:                  cfg.RPID,
+		RPOrigins:             []string{cfg.RPOrigin},
+		AttestationPreference: conveyance,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize webauthn: %w", err)
 	}
 
 	return &WebAuthnProvider{
-		w:       w,
-		mfaRepo: mfaRepo,
+		w:              w,
+		mfaRepo:        mfaRepo,
+		conveyance:     conveyance,
+		allowedAAGUIDs: allowed,
 	}, nil
 }
 
@@ -107,18 +119,7 @@ func (p *WebAuthnProvider) loadCredentials(ctx context.Context, user *types.User
 
 		// Load metadata
 		if len(f.Metadata) > 0 {
-			type CredMetadata struct {
-				AttestationType string
-				Transport       []protocol.AuthenticatorTransport
-				Flags           struct {
-					UserPresent    bool `json:"userPresent"`
-					UserVerified   bool `json:"userVerified"`
-					BackupEligible bool `json:"backupEligible"`
-					BackupState    bool `json:"backupState"`
-				}
-				Authenticator webauthn.Authenticator
-			}
-			var meta CredMetadata
+			var meta credentialMetadata
 			if err := json.Unmarshal(f.Metadata, &meta); err == nil {
 				cred.AttestationType = meta.AttestationType
 				cred.Transport = meta.Transport
@@ -157,7 +158,10 @@ func (p *WebAuthnProvider) BeginRegistration(ctx context.Context, user *types.Us
 		}
 	}
 
-	return p.w.BeginRegistration(adapter, registerOptions)
+	// Ask for a discoverable credential, so that it can sign in without a username.
+	return p.w.BeginRegistration(adapter, registerOptions,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithConveyancePreference(p.conveyance))
 }
 
 // FinishRegistration completes the WebAuthn registration process.
@@ -171,36 +175,24 @@ func (p *WebAuthnProvider) FinishRegistration(ctx context.Context, user *types.U
 		return nil, err
 	}
 
+	if err := p.checkAttestation(credential); err != nil {
+		return nil, err
+	}
+
 	// Persist the credential
 	userID, _ := uuid.Parse(user.ID)
 
 	// Serialize metadata
-	meta := struct {
-		AttestationType string
-		Transport       []protocol.AuthenticatorTransport
-		Flags           struct {
-			UserPresent    bool `json:"userPresent"`
-			UserVerified   bool `json:"userVerified"`
-			BackupEligible bool `json:"backupEligible"`
-			BackupState    bool `json:"backupState"`
-		}
-		Authenticator webauthn.Authenticator
-	}{
+	meta := credentialMetadata{
+		Name:            defaultPasskeyName,
 		AttestationType: credential.AttestationType,
 		Transport:       credential.Transport,
-		Flags: struct {
-			UserPresent    bool `json:"userPresent"`
-			UserVerified   bool `json:"userVerified"`
-			BackupEligible bool `json:"backupEligible"`
-			BackupState    bool `json:"backupState"`
-		}{
-			UserPresent:    credential.Flags.UserPresent,
-			UserVerified:   credential.Flags.UserVerified,
-			BackupEligible: credential.Flags.BackupEligible,
-			BackupState:    credential.Flags.BackupState,
-		},
-		Authenticator: credential.Authenticator,
+		Authenticator:   credential.Authenticator,
 	}
+	meta.Flags.UserPresent = credential.Flags.UserPresent
+	meta.Flags.UserVerified = credential.Flags.UserVerified
+	meta.Flags.BackupEligible = credential.Flags.BackupEligible
+	meta.Flags.BackupState = credential.Flags.BackupState
 	metaBytes, _ := json.Marshal(meta)
 
 	factor := &types.MFAFactor{
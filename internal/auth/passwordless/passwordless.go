@@ -0,0 +1,465 @@
+// Package passwordless signs users in with a single-use magic link or a
+// numeric code sent to their email address instead of a password. A flow is
+// started for an address and completed with the link or the code before its
+// lifetime ends; what happens next, such as the risk evaluation and the
+// session, is up to the caller.
+package passwordless
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math/big"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/notification"
+	"go.uber.org/zap"
+)
+
+// Method is how the user proves they own the email address.
+type Method string
+
+const (
+	// MethodLink sends a magic link.
+	MethodLink Method = "link"
+	// MethodCode sends a numeric one-time code.
+	MethodCode Method = "code"
+)
+
+// Config holds the settings of the passwordless flows. Zero values take the defaults.
+type Config struct {
+	// TTL is the maximum lifetime of a flow and of its link or code.
+	TTL time.Duration
+	// CodeLength is the number of digits of a code.
+	CodeLength int
+	// MaxAttempts is the number of wrong codes after which a flow is discarded.
+	MaxAttempts int
+	// SendLimit is the number of flows that may be started for one email
+	// address within SendWindow.
+	SendLimit int
+	// SourceLimit is the number of flows that may be started from one source
+	// address within SendWindow.
+	SourceLimit int
+	SendWindow  time.Duration
+	// LinkURL is the URL of the magic link, to which the token is added as
+	// the "token" query parameter.
+	LinkURL string
+	// SigningKey signs the tokens of the magic links.
+	SigningKey []byte
+}
+
+const (
+	defaultTTL         = 10 * time.Minute
+	defaultCodeLength  = 6
+	defaultMaxAttempts = 5
+	defaultSendLimit   = 5
+	defaultSourceLimit = 20
+	defaultSendWindow  = 15 * time.Minute
+)
+
+var (
+	// ErrFlowNotFound is returned for an unknown, expired or already completed flow.
+	ErrFlowNotFound = errors.New("passwordless flow not found or expired")
+	// ErrInvalidToken is returned for a magic link token that is malformed,
+	// badly signed or expired.
+	ErrInvalidToken = errors.New("invalid magic link token")
+	// ErrInvalidCode is returned when the code does not match.
+	ErrInvalidCode = errors.New("invalid passwordless code")
+	// ErrTooManyAttempts is returned when the attempts of a flow are exhausted; the flow is discarded.
+	ErrTooManyAttempts = errors.New("too many failed passwordless attempts")
+	// ErrDeviceMismatch is returned when a same-device flow is completed
+	// without the flow ID held by the device that started it.
+	ErrDeviceMismatch = errors.New("passwordless flow started on another device")
+	// ErrRateLimited refuses a flow started too often for an email or source address.
+	ErrRateLimited = errors.New("too many passwordless sign-in requests")
+)
+
+// RateLimitedError is returned for a flow refused by the rate limits.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", ErrRateLimited, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// StartRequest starts a flow for a user.
+type StartRequest struct {
+	// UserID is the user the email address belongs to. Without one no
+	// message is sent, but a flow ID is returned all the same so that
+	// callers do not reveal which addresses are known.
+	UserID string
+	Email  string
+	Method Method
+	// SameDevice requires the flow to be completed with its flow ID, which
+	// only the device that started it holds. Otherwise a magic link alone
+	// completes it on any device.
+	SameDevice bool
+	Source     string
+}
+
+// CompleteRequest completes a flow with a magic link token or with the flow
+// ID and a code.
+type CompleteRequest struct {
+	FlowID string
+	Token  string
+	Code   string
+}
+
+// Flow is the server-side state of a passwordless sign-in, kept in Redis
+// until it is completed or expires.
+type Flow struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Email      string    `json:"email"`
+	Method     Method    `json:"method"`
+	SameDevice bool      `json:"same_device"`
+	CodeHash   string    `json:"code_hash,omitempty"`
+	LinkID     string    `json:"link_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Service starts and completes passwordless flows.
+type Service struct {
+	redis         redis.RedisClientInterface
+	notifications notification.Manager
+	config        Config
+	logger        *zap.Logger
+	now           func() time.Time
+}
+
+// NewService creates a passwordless service that sends its messages through
+// the email notifier of the manager.
+func NewService(client redis.RedisClientInterface, notifications notification.Manager, config Config, logger *zap.Logger) *Service {
+	if config.TTL <= 0 {
+		config.TTL = defaultTTL
+	}
+	if config.CodeLength <= 0 {
+		config.CodeLength = defaultCodeLength
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.SendLimit <= 0 {
+		config.SendLimit = defaultSendLimit
+	}
+	if config.SourceLimit <= 0 {
+		config.SourceLimit = defaultSourceLimit
+	}
+	if config.SendWindow <= 0 {
+		config.SendWindow = defaultSendWindow
+	}
+	return &Service{redis: client, notifications: notifications, config: config, logger: logger, now: time.Now}
+}
+
+// TTL returns the lifetime of a flow.
+func (s *Service) TTL() time.Duration {
+	return s.config.TTL
+}
+
+// Start starts a flow and sends its link or code to the email address. It
+// returns a *RateLimitedError if too many flows were started for the address
+// or from the source address.
+func (s *Service) Start(ctx context.Context, req StartRequest) (*Flow, error) {
+	if req.Method == "" {
+		req.Method = MethodLink
+	}
+	if req.Method != MethodLink && req.Method != MethodCode {
+		return nil, fmt.Errorf("unsupported passwordless method %q", req.Method)
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if err := s.checkRate(ctx, emailRateKey(email), s.config.SendLimit); err != nil {
+		return nil, err
+	}
+	if source := normalizeSource(req.Source); source != "" {
+		if err := s.checkRate(ctx, sourceRateKey(source), s.config.SourceLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	now := s.now()
+	flow := &Flow{
+		ID:         randomID(),
+		UserID:     req.UserID,
+		Email:      email,
+		Method:     req.Method,
+		SameDevice: req.SameDevice,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(s.config.TTL),
+	}
+	if req.UserID == "" {
+		return flow, nil
+	}
+
+	var msg notification.Message
+	switch req.Method {
+	case MethodCode:
+		code, err := randomCode(s.config.CodeLength)
+		if err != nil {
+			return nil, err
+		}
+		flow.CodeHash = hashCode(flow.ID, code)
+		msg = notification.Message{
+			Subject: "Your sign-in code",
+			Body:    fmt.Sprintf("<p>Your sign-in code is <strong>%s</strong>.</p><p>It expires in %d minutes. If you did not try to sign in, ignore this email.</p>", code, int(s.config.TTL.Minutes())),
+		}
+	case MethodLink:
+		flow.LinkID = randomID()
+		link := s.linkURL(s.signToken(flow.LinkID, flow.ExpiresAt))
+		msg = notification.Message{
+			Subject: "Your sign-in link",
+			Body:    fmt.Sprintf("<p><a href=\"%s\">Sign in</a></p><p>The link can be used once and expires in %d minutes. If you did not try to sign in, ignore this email.</p>", html.EscapeString(link), int(s.config.TTL.Minutes())),
+		}
+	}
+
+	data, err := json.Marshal(flow)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode passwordless flow: %w", err)
+	}
+	_, err = s.redis.Client().TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Set(ctx, flowKey(flow.ID), data, s.config.TTL)
+		if flow.LinkID != "" {
+			pipe.Set(ctx, linkKey(flow.LinkID), flow.ID, s.config.TTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store passwordless flow: %w", err)
+	}
+
+	notifier, err := s.notifications.GetNotifier("email")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email notifier: %w", err)
+	}
+	msg.Recipient = email
+	msg.Type = notification.MessageTypeOTP
+	msg.Metadata = map[string]string{"flow_id": flow.ID, "method": string(flow.Method)}
+	if err := notifier.Send(ctx, msg); err != nil {
+		s.redis.Del(ctx, flowKey(flow.ID), linkKey(flow.LinkID))
+		return nil, fmt.Errorf("failed to send passwordless %s: %w", flow.Method, err)
+	}
+	return flow, nil
+}
+
+// Complete completes a flow with its magic link token or its code and
+// returns it. A flow can be completed only once; a flow whose attempts are
+// exhausted is discarded.
+func (s *Service) Complete(ctx context.Context, req CompleteRequest) (*Flow, error) {
+	if req.Token != "" {
+		return s.completeLink(ctx, req)
+	}
+	return s.completeCode(ctx, req)
+}
+
+func (s *Service) completeLink(ctx context.Context, req CompleteRequest) (*Flow, error) {
+	linkID, err := s.verifyToken(req.Token)
+	if err != nil {
+		return nil, err
+	}
+	flowID, err := s.redis.Get(ctx, linkKey(linkID))
+	if err != nil {
+		return nil, ErrFlowNotFound
+	}
+	flow, err := s.flow(ctx, flowID)
+	if err != nil {
+		return nil, err
+	}
+	if flow.Method != MethodLink || flow.LinkID != linkID {
+		return nil, ErrFlowNotFound
+	}
+	if flow.SameDevice && subtle.ConstantTimeCompare([]byte(req.FlowID), []byte(flow.ID)) != 1 {
+		return nil, ErrDeviceMismatch
+	}
+	return s.consume(ctx, flow)
+}
+
+func (s *Service) completeCode(ctx context.Context, req CompleteRequest) (*Flow, error) {
+	if req.FlowID == "" || req.Code == "" {
+		return nil, ErrFlowNotFound
+	}
+	flow, err := s.flow(ctx, req.FlowID)
+	if err != nil {
+		return nil, err
+	}
+	if flow.Method != MethodCode {
+		return nil, ErrFlowNotFound
+	}
+
+	client := s.redis.Client()
+	attempts, err := client.Incr(ctx, attemptsKey(flow.ID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count passwordless attempts: %w", err)
+	}
+	client.Expire(ctx, attemptsKey(flow.ID), s.config.TTL)
+	if int(attempts) > s.config.MaxAttempts {
+		s.redis.Del(ctx, flowKey(flow.ID), attemptsKey(flow.ID))
+		return nil, ErrTooManyAttempts
+	}
+	if subtle.ConstantTimeCompare([]byte(hashCode(flow.ID, req.Code)), []byte(flow.CodeHash)) != 1 {
+		return nil, ErrInvalidCode
+	}
+	return s.consume(ctx, flow)
+}
+
+// consume deletes a flow, and returns it only to the caller that deleted it.
+func (s *Service) consume(ctx context.Context, flow *Flow) (*Flow, error) {
+	deleted, err := s.redis.Client().Del(ctx, flowKey(flow.ID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume passwordless flow: %w", err)
+	}
+	if deleted != 1 {
+		return nil, ErrFlowNotFound
+	}
+	s.redis.Del(ctx, linkKey(flow.LinkID), attemptsKey(flow.ID))
+	if s.now().After(flow.ExpiresAt) {
+		return nil, ErrFlowNotFound
+	}
+	return flow, nil
+}
+
+func (s *Service) flow(ctx context.Context, flowID string) (*Flow, error) {
+	data, err := s.redis.Get(ctx, flowKey(flowID))
+	if err != nil {
+		return nil, ErrFlowNotFound
+	}
+	var flow Flow
+	if err := json.Unmarshal([]byte(data), &flow); err != nil {
+		return nil, fmt.Errorf("failed to decode passwordless flow: %w", err)
+	}
+	return &flow, nil
+}
+
+// checkRate counts a flow towards a limit and refuses it once the limit is
+// exceeded. Like the lockout tracker it fails open if Redis cannot be written.
+func (s *Service) checkRate(ctx context.Context, key string, limit int) error {
+	client := s.redis.Client()
+	count, err := client.Incr(ctx, key).Result()
+	if err != nil {
+		s.logger.Warn("Failed to count passwordless requests", zap.String("key", key), zap.Error(err))
+		return nil
+	}
+	if count == 1 {
+		client.Expire(ctx, key, s.config.SendWindow)
+	}
+	if int(count) > limit {
+		ttl, _ := client.PTTL(ctx, key).Result()
+		return &RateLimitedError{RetryAfter: ttl}
+	}
+	return nil
+}
+
+// signToken returns the token of a magic link: the link ID and its expiry,
+// signed with the signing key.
+func (s *Service) signToken(linkID string, expiresAt time.Time) string {
+	payload := linkID + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + s.sign(payload)
+}
+
+// verifyToken checks the signature and expiry of a magic link token and
+// returns its link ID.
+func (s *Service) verifyToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(payload))) {
+		return "", ErrInvalidToken
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !s.now().Before(time.Unix(expiresAt, 0)) {
+		return "", ErrInvalidToken
+	}
+	return parts[0], nil
+}
+
+func (s *Service) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.config.SigningKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) linkURL(token string) string {
+	u, err := url.Parse(s.config.LinkURL)
+	if err != nil {
+		return s.config.LinkURL + "?token=" + url.QueryEscape(token)
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func randomID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randomCode(length int) (string, error) {
+	var code strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate passwordless code: %w", err)
+		}
+		code.WriteByte(byte('0' + n.Int64()))
+	}
+	return code.String(), nil
+}
+
+// hashCode hashes a code with the ID of its flow, so that the stored hash
+// cannot be matched against the hashes of all codes at once.
+func hashCode(flowID, code string) string {
+	sum := sha256.Sum256([]byte(flowID + ":" + strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeSource strips the port from a remote address.
+func normalizeSource(source string) string {
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		return host
+	}
+	return source
+}
+
+func flowKey(flowID string) string {
+	return "passwordless:flow:" + flowID
+}
+
+func linkKey(linkID string) string {
+	return "passwordless:link:" + linkID
+}
+
+func attemptsKey(flowID string) string {
+	return "passwordless:attempts:" + flowID
+}
+
+func emailRateKey(email string) string {
+	return "passwordless:rate:email:" + email
+}
+
+func sourceRateKey(source string) string {
+	return "passwordless:rate:source:" + source
+}
@@ -0,0 +1,164 @@
+package passwordless
+
+import (
+	"context"
+	"html"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/notification"
+	"go.uber.org/zap"
+)
+
+type recordingNotifier struct {
+	sent []notification.Message
+}
+
+func (n *recordingNotifier) Send(ctx context.Context, msg notification.Message) error {
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+func (n *recordingNotifier) Type() string {
+	return "email"
+}
+
+// newTestService returns a service on miniredis whose clock the test moves.
+func newTestService(t *testing.T, config Config) (*Service, *recordingNotifier, *time.Time) {
+	mr := miniredis.RunT(t)
+	notifier := &recordingNotifier{}
+	config.LinkURL = "https://id.example.com/api/v1/auth/passwordless/complete"
+	config.SigningKey = []byte("test-key")
+	svc := NewService(redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})), notification.NewManager(notifier), config, zap.NewNop())
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+	return svc, notifier, &now
+}
+
+var (
+	codePattern = regexp.MustCompile(`<strong>(\d+)</strong>`)
+	linkPattern = regexp.MustCompile(`href="([^"]+)"`)
+)
+
+func sentCode(t *testing.T, msg notification.Message) string {
+	match := codePattern.FindStringSubmatch(msg.Body)
+	require.Len(t, match, 2, msg.Body)
+	return match[1]
+}
+
+func sentToken(t *testing.T, msg notification.Message) string {
+	match := linkPattern.FindStringSubmatch(msg.Body)
+	require.Len(t, match, 2, msg.Body)
+	link, err := url.Parse(html.UnescapeString(match[1]))
+	require.NoError(t, err)
+	assert.Equal(t, "id.example.com", link.Host)
+	return link.Query().Get("token")
+}
+
+func TestService_CompletesWithCodeOnce(t *testing.T) {
+	ctx := context.Background()
+	svc, notifier, _ := newTestService(t, Config{})
+
+	flow, err := svc.Start(ctx, StartRequest{UserID: "u1", Email: "Alice@Example.com", Method: MethodCode})
+	require.NoError(t, err)
+	require.Len(t, notifier.sent, 1)
+	assert.Equal(t, "alice@example.com", notifier.sent[0].Recipient)
+	code := sentCode(t, notifier.sent[0])
+	assert.Len(t, code, 6)
+
+	_, err = svc.Complete(ctx, CompleteRequest{FlowID: flow.ID, Code: "000000x"})
+	assert.ErrorIs(t, err, ErrInvalidCode)
+
+	completed, err := svc.Complete(ctx, CompleteRequest{FlowID: flow.ID, Code: code})
+	require.NoError(t, err)
+	assert.Equal(t, "u1", completed.UserID)
+
+	_, err = svc.Complete(ctx, CompleteRequest{FlowID: flow.ID, Code: code})
+	assert.ErrorIs(t, err, ErrFlowNotFound)
+}
+
+func TestService_DiscardsFlowAfterTooManyAttempts(t *testing.T) {
+	ctx := context.Background()
+	svc, notifier, _ := newTestService(t, Config{MaxAttempts: 2})
+
+	flow, err := svc.Start(ctx, StartRequest{UserID: "u1", Email: "alice@example.com", Method: MethodCode})
+	require.NoError(t, err)
+	code := sentCode(t, notifier.sent[0])
+
+	for i := 0; i < 2; i++ {
+		_, err = svc.Complete(ctx, CompleteRequest{FlowID: flow.ID, Code: "wrong"})
+		assert.ErrorIs(t, err, ErrInvalidCode)
+	}
+	_, err = svc.Complete(ctx, CompleteRequest{FlowID: flow.ID, Code: code})
+	assert.ErrorIs(t, err, ErrTooManyAttempts)
+	_, err = svc.Complete(ctx, CompleteRequest{FlowID: flow.ID, Code: code})
+	assert.ErrorIs(t, err, ErrFlowNotFound)
+}
+
+func TestService_SameDeviceLinkNeedsFlowID(t *testing.T) {
+	ctx := context.Background()
+	svc, notifier, _ := newTestService(t, Config{})
+
+	flow, err := svc.Start(ctx, StartRequest{UserID: "u1", Email: "alice@example.com", Method: MethodLink, SameDevice: true})
+	require.NoError(t, err)
+	token := sentToken(t, notifier.sent[0])
+
+	_, err = svc.Complete(ctx, CompleteRequest{Token: token})
+	assert.ErrorIs(t, err, ErrDeviceMismatch)
+
+	completed, err := svc.Complete(ctx, CompleteRequest{Token: token, FlowID: flow.ID})
+	require.NoError(t, err)
+	assert.Equal(t, "u1", completed.UserID)
+
+	_, err = svc.Complete(ctx, CompleteRequest{Token: token, FlowID: flow.ID})
+	assert.ErrorIs(t, err, ErrFlowNotFound)
+}
+
+func TestService_CrossDeviceLinkAndSignature(t *testing.T) {
+	ctx := context.Background()
+	svc, notifier, now := newTestService(t, Config{TTL: time.Minute})
+
+	_, err := svc.Start(ctx, StartRequest{UserID: "u1", Email: "alice@example.com"})
+	require.NoError(t, err)
+	token := sentToken(t, notifier.sent[0])
+
+	_, err = svc.Complete(ctx, CompleteRequest{Token: token + "x"})
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	*now = now.Add(2 * time.Minute)
+	_, err = svc.Complete(ctx, CompleteRequest{Token: token})
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	*now = now.Add(-2 * time.Minute)
+	completed, err := svc.Complete(ctx, CompleteRequest{Token: token})
+	require.NoError(t, err)
+	assert.Equal(t, "u1", completed.UserID)
+}
+
+func TestService_RateLimitsAndHidesUnknownUsers(t *testing.T) {
+	ctx := context.Background()
+	svc, notifier, _ := newTestService(t, Config{SendLimit: 2})
+
+	for i := 0; i < 2; i++ {
+		flow, err := svc.Start(ctx, StartRequest{Email: "nobody@example.com", Source: "10.0.0.1:4000"})
+		require.NoError(t, err)
+		assert.NotEmpty(t, flow.ID)
+	}
+	assert.Empty(t, notifier.sent)
+
+	_, err := svc.Start(ctx, StartRequest{Email: "NOBODY@example.com", Source: "10.0.0.1:4001"})
+	var limited *RateLimitedError
+	require.ErrorAs(t, err, &limited)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Greater(t, limited.RetryAfter, time.Duration(0))
+
+	_, err = svc.Start(ctx, StartRequest{UserID: "u2", Email: "bob@example.com", Source: "10.0.0.1"})
+	assert.NoError(t, err)
+}
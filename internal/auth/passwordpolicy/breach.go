@@ -0,0 +1,91 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// prefixLength is the length of the SHA-1 hash prefix breached passwords are
+// looked up by, as in the k-anonymity range API of Have I Been Pwned.
+const prefixLength = 5
+
+// RangeSource returns the hash suffixes of the breached passwords whose
+// upper-case hex SHA-1 hash starts with a prefix. Only the prefix of a
+// password's hash leaves the engine, so a source may be a remote service.
+type RangeSource interface {
+	Range(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Breached reports whether the password is in the source.
+func Breached(ctx context.Context, source RangeSource, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := source.Range(ctx, hash[:prefixLength])
+	if err != nil {
+		return false, err
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[prefixLength:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Corpus is an offline corpus of breached password hashes held in memory.
+type Corpus struct {
+	ranges map[string][]string
+	size   int
+}
+
+// LoadCorpus reads a corpus from a file with one SHA-1 hash of a breached
+// password per line, in hex and optionally followed by ":" and a count, as in
+// the downloads of Have I Been Pwned. Blank lines and lines starting with "#"
+// are skipped.
+func LoadCorpus(path string) (*Corpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	corpus := &Corpus{ranges: map[string][]string{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		prefix := hash[:prefixLength]
+		corpus.ranges[prefix] = append(corpus.ranges[prefix], hash[prefixLength:])
+		corpus.size++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, suffixes := range corpus.ranges {
+		sort.Strings(suffixes)
+	}
+	return corpus, nil
+}
+
+// Range returns the suffixes of the hashes in the corpus starting with prefix.
+func (c *Corpus) Range(ctx context.Context, prefix string) ([]string, error) {
+	return c.ranges[strings.ToUpper(prefix)], nil
+}
+
+// Len returns the number of hashes in the corpus.
+func (c *Corpus) Len() int {
+	return c.size
+}
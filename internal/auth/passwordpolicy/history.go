@@ -0,0 +1,52 @@
+package passwordpolicy
+
+import (
+	"context"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+)
+
+// HistoryStore keeps the hashes of the earlier passwords of users.
+type HistoryStore interface {
+	// Recent returns the hashes of the user's last n passwords, newest first.
+	Recent(ctx context.Context, userID string, n int) ([]string, error)
+	// Add records a hash of the user's, keeping at most the last keep.
+	Add(ctx context.Context, userID, hash string, keep int) error
+}
+
+// RedisHistoryStore keeps password histories in Redis lists.
+type RedisHistoryStore struct {
+	client redis.RedisClientInterface
+}
+
+// NewRedisHistoryStore creates a history store on the Redis client.
+func NewRedisHistoryStore(client redis.RedisClientInterface) *RedisHistoryStore {
+	return &RedisHistoryStore{client: client}
+}
+
+func historyKey(userID string) string {
+	return "password:history:" + userID
+}
+
+// Recent returns the hashes of the user's last n passwords, newest first.
+func (s *RedisHistoryStore) Recent(ctx context.Context, userID string, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	return s.client.Client().LRange(ctx, historyKey(userID), 0, int64(n-1)).Result()
+}
+
+// Add records a hash of the user's, keeping at most the last keep.
+func (s *RedisHistoryStore) Add(ctx context.Context, userID, hash string, keep int) error {
+	key := historyKey(userID)
+	if keep <= 0 {
+		return s.client.Del(ctx, key)
+	}
+	_, err := s.client.Client().TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.LPush(ctx, key, hash)
+		pipe.LTrim(ctx, key, 0, int64(keep-1))
+		return nil
+	})
+	return err
+}
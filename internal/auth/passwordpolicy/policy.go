@@ -0,0 +1,338 @@
+// Package passwordpolicy enforces the rules passwords must meet whenever they
+// are set: length and character classes, an estimated strength, reuse of
+// earlier passwords, a maximum age, and membership in a corpus of breached
+// passwords. Policies are configured per tenant and per group.
+package passwordpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/turtacn/QuantaID/internal/multitenant"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// User attributes in which the engine keeps the password's state.
+const (
+	// AttrChangedAt holds the RFC 3339 time the password was last set.
+	AttrChangedAt = "password_changed_at"
+	// AttrChangeRequired is true when the password must be changed at the
+	// next login, e.g. after an administrator set it.
+	AttrChangeRequired = "password_change_required"
+	// AttrTenant names the tenant of a user, unless the context carries one.
+	AttrTenant = "tenant_id"
+)
+
+// Policy is the set of rules for a password. Zero values disable a rule.
+type Policy struct {
+	MinLength        int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	// MinStrength is the lowest acceptable score of Strength, from 0 to 4.
+	MinStrength int
+	// HistorySize is the number of earlier passwords that may not be reused.
+	HistorySize int
+	// MaxAge is how long a password is valid before it must be changed.
+	MaxAge time.Duration
+	// CheckBreached refuses passwords found in the breached-password corpus.
+	CheckBreached bool
+}
+
+// Stricter returns the policy that enforces the rules of both p and other.
+func (p Policy) Stricter(other Policy) Policy {
+	p.MinLength = max(p.MinLength, other.MinLength)
+	p.RequireUppercase = p.RequireUppercase || other.RequireUppercase
+	p.RequireLowercase = p.RequireLowercase || other.RequireLowercase
+	p.RequireDigit = p.RequireDigit || other.RequireDigit
+	p.RequireSymbol = p.RequireSymbol || other.RequireSymbol
+	p.MinStrength = max(p.MinStrength, other.MinStrength)
+	p.HistorySize = max(p.HistorySize, other.HistorySize)
+	if p.MaxAge == 0 || (other.MaxAge > 0 && other.MaxAge < p.MaxAge) {
+		p.MaxAge = other.MaxAge
+	}
+	p.CheckBreached = p.CheckBreached || other.CheckBreached
+	return p
+}
+
+// Config holds the policies of the engine. The policy of a user is the one
+// of their tenant, or Default if the tenant has none, tightened by the
+// policies of every group the user belongs to.
+type Config struct {
+	Default Policy
+	// Tenants maps tenant IDs to their policies.
+	Tenants map[string]Policy
+	// Groups maps group IDs or names to their policies.
+	Groups map[string]Policy
+}
+
+// Violation is a rule a password does not meet.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Hasher hashes passwords and checks them against hashes.
+type Hasher interface {
+	HashPassword(password string) (string, error)
+	CheckPasswordHash(password, hash string) bool
+}
+
+// GroupSource looks up the groups of a user.
+type GroupSource interface {
+	GetUserGroups(ctx context.Context, userID string) ([]*types.UserGroup, error)
+}
+
+// Engine validates passwords against the policy of their user and sets them.
+type Engine struct {
+	config  Config
+	hasher  Hasher
+	groups  GroupSource
+	history HistoryStore
+	breach  RangeSource
+	logger  *zap.Logger
+	now     func() time.Time
+}
+
+// NewEngine creates an engine for the given policies.
+func NewEngine(config Config, hasher Hasher, logger *zap.Logger) *Engine {
+	return &Engine{
+		config: config,
+		hasher: hasher,
+		logger: logger,
+		now:    time.Now,
+	}
+}
+
+// SetGroupSource sets where the groups of users are looked up, for the
+// group policies. Without it only the groups loaded on the user are used.
+func (e *Engine) SetGroupSource(groups GroupSource) {
+	e.groups = groups
+}
+
+// SetHistoryStore sets the store of earlier password hashes.
+func (e *Engine) SetHistoryStore(history HistoryStore) {
+	e.history = history
+}
+
+// SetBreachCorpus sets the corpus breached passwords are looked up in.
+func (e *Engine) SetBreachCorpus(breach RangeSource) {
+	e.breach = breach
+}
+
+// Resolve returns the policy that applies to the user.
+func (e *Engine) Resolve(ctx context.Context, user *types.User) Policy {
+	policy := e.config.Default
+	if tenant := tenantOf(ctx, user); tenant != "" {
+		if tenantPolicy, ok := e.config.Tenants[tenant]; ok {
+			policy = tenantPolicy
+		}
+	}
+	if len(e.config.Groups) == 0 {
+		return policy
+	}
+	for _, group := range e.groupsOf(ctx, user) {
+		if groupPolicy, ok := e.config.Groups[group.ID]; ok {
+			policy = policy.Stricter(groupPolicy)
+		} else if groupPolicy, ok := e.config.Groups[group.Name]; ok {
+			policy = policy.Stricter(groupPolicy)
+		}
+	}
+	return policy
+}
+
+// Validate returns the rules of the user's policy the password does not meet.
+func (e *Engine) Validate(ctx context.Context, user *types.User, password string) []Violation {
+	policy := e.Resolve(ctx, user)
+	var violations []Violation
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n := len([]rune(password)); n < policy.MinLength {
+		add("min_length", "must be at least %d characters long", policy.MinLength)
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if policy.RequireUppercase && !upper {
+		add("uppercase", "must contain an uppercase letter")
+	}
+	if policy.RequireLowercase && !lower {
+		add("lowercase", "must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		add("digit", "must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		add("symbol", "must contain a symbol")
+	}
+	if policy.MinStrength > 0 && Strength(password, userInputs(user)...) < policy.MinStrength {
+		add("strength", "is too easy to guess")
+	}
+	if policy.HistorySize > 0 && e.reused(ctx, user, password, policy.HistorySize) {
+		add("history", "must not be one of the last %d passwords", policy.HistorySize)
+	}
+	if policy.CheckBreached && e.breached(ctx, password) {
+		add("breached", "has appeared in a data breach")
+	}
+	return violations
+}
+
+// Check validates the password against the user's policy. Violations are
+// returned as types.ErrPasswordPolicy with the rules in the details.
+func (e *Engine) Check(ctx context.Context, user *types.User, password string) error {
+	if violations := e.Validate(ctx, user, password); len(violations) > 0 {
+		return violationError(violations)
+	}
+	return nil
+}
+
+// SetPassword checks the password against the user's policy and, if it meets
+// it, hashes it onto the user and records the previous password in the
+// history. The caller persists the user.
+func (e *Engine) SetPassword(ctx context.Context, user *types.User, password string) error {
+	if err := e.Check(ctx, user, password); err != nil {
+		return err
+	}
+	hash, err := e.hasher.HashPassword(password)
+	if err != nil {
+		return types.ErrInternal.WithCause(err)
+	}
+
+	if user.Password != "" && e.history != nil {
+		if err := e.history.Add(ctx, user.ID, user.Password, e.Resolve(ctx, user).HistorySize); err != nil {
+			e.logger.Warn("Failed to record password history", zap.String("userID", user.ID), zap.Error(err))
+		}
+	}
+	user.Password = hash
+	if user.Attributes == nil {
+		user.Attributes = map[string]interface{}{}
+	}
+	user.Attributes[AttrChangedAt] = e.now().UTC().Format(time.RFC3339)
+	delete(user.Attributes, AttrChangeRequired)
+	return nil
+}
+
+// ChangeRequired reports whether the user must change their password before
+// signing in, and why.
+func (e *Engine) ChangeRequired(ctx context.Context, user *types.User) (bool, string) {
+	if required, _ := user.Attributes[AttrChangeRequired].(bool); required {
+		return true, "password change required"
+	}
+	maxAge := e.Resolve(ctx, user).MaxAge
+	if maxAge <= 0 {
+		return false, ""
+	}
+	changedAt := user.CreatedAt
+	if value, ok := user.Attributes[AttrChangedAt].(string); ok {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			changedAt = t
+		}
+	}
+	if !changedAt.IsZero() && e.now().Sub(changedAt) > maxAge {
+		return true, "password expired"
+	}
+	return false, ""
+}
+
+// reused reports whether the password is the user's current one or one of
+// their last n.
+func (e *Engine) reused(ctx context.Context, user *types.User, password string, n int) bool {
+	if user.Password != "" && e.hasher.CheckPasswordHash(password, user.Password) {
+		return true
+	}
+	if e.history == nil || user.ID == "" {
+		return false
+	}
+	hashes, err := e.history.Recent(ctx, user.ID, n)
+	if err != nil {
+		e.logger.Warn("Failed to read password history", zap.String("userID", user.ID), zap.Error(err))
+		return false
+	}
+	for _, hash := range hashes {
+		if e.hasher.CheckPasswordHash(password, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// breached reports whether the password is in the breach corpus.
+func (e *Engine) breached(ctx context.Context, password string) bool {
+	if e.breach == nil {
+		return false
+	}
+	found, err := Breached(ctx, e.breach, password)
+	if err != nil {
+		e.logger.Warn("Failed to look up breached passwords", zap.Error(err))
+		return false
+	}
+	return found
+}
+
+func (e *Engine) groupsOf(ctx context.Context, user *types.User) []types.UserGroup {
+	if len(user.Groups) > 0 || e.groups == nil || user.ID == "" {
+		return user.Groups
+	}
+	groups, err := e.groups.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		if !errors.Is(err, types.ErrUserNotFound) {
+			e.logger.Warn("Failed to look up groups for password policy", zap.String("userID", user.ID), zap.Error(err))
+		}
+		return nil
+	}
+	result := make([]types.UserGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, *group)
+	}
+	return result
+}
+
+func tenantOf(ctx context.Context, user *types.User) string {
+	if tenant, ok := multitenant.GetTenantID(ctx); ok && tenant != "" {
+		return tenant
+	}
+	tenant, _ := user.Attributes[AttrTenant].(string)
+	return tenant
+}
+
+// userInputs returns the parts of the user's profile a password should not
+// be built from.
+func userInputs(user *types.User) []string {
+	inputs := []string{user.Username}
+	if email := string(user.Email); email != "" {
+		local, _, _ := strings.Cut(email, "@")
+		inputs = append(inputs, local)
+	}
+	return inputs
+}
+
+func violationError(violations []Violation) error {
+	rules := make([]string, len(violations))
+	messages := make([]string, len(violations))
+	for i, v := range violations {
+		rules[i] = v.Rule
+		messages[i] = "password " + v.Message
+	}
+	return types.ErrPasswordPolicy.WithDetails(map[string]string{
+		"violations": strings.Join(rules, ","),
+		"message":    strings.Join(messages, "; "),
+	})
+}
@@ -0,0 +1,144 @@
+package passwordpolicy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/multitenant"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+func rules(violations []Violation) []string {
+	var names []string
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+	return names
+}
+
+func TestValidate_LengthAndClasses(t *testing.T) {
+	engine := NewEngine(Config{Default: Policy{MinLength: 10, RequireUppercase: true, RequireDigit: true, RequireSymbol: true}}, utils.NewCryptoManager("test-secret"), zap.NewNop())
+	user := &types.User{ID: "u1", Username: "alice"}
+
+	assert.Equal(t, []string{"min_length", "uppercase", "digit", "symbol"}, rules(engine.Validate(context.Background(), user, "short")))
+	assert.Empty(t, engine.Validate(context.Background(), user, "Grapes-and-7-pears"))
+
+	err := engine.Check(context.Background(), user, "grapes-and-pears")
+	require.ErrorIs(t, err, types.ErrPasswordPolicy)
+	assert.Equal(t, "uppercase,digit", types.ErrPasswordPolicy.Details["violations"])
+}
+
+func TestResolve_TenantAndGroups(t *testing.T) {
+	engine := NewEngine(Config{
+		Default: Policy{MinLength: 8},
+		Tenants: map[string]Policy{"acme": {MinLength: 10, MaxAge: 90 * 24 * time.Hour}},
+		Groups: map[string]Policy{
+			"admins": {MinLength: 16, MinStrength: 3, MaxAge: 30 * 24 * time.Hour},
+			"g-ops":  {RequireSymbol: true, HistorySize: 5},
+		},
+	}, utils.NewCryptoManager("test-secret"), zap.NewNop())
+
+	user := &types.User{ID: "u1"}
+	assert.Equal(t, Policy{MinLength: 8}, engine.Resolve(context.Background(), user))
+
+	ctx := multitenant.WithTenantID(context.Background(), "acme")
+	assert.Equal(t, Policy{MinLength: 10, MaxAge: 90 * 24 * time.Hour}, engine.Resolve(ctx, user))
+
+	user.Groups = []types.UserGroup{{ID: "g-1", Name: "admins"}, {ID: "g-ops", Name: "operations"}}
+	assert.Equal(t, Policy{
+		MinLength:     16,
+		RequireSymbol: true,
+		MinStrength:   3,
+		HistorySize:   5,
+		MaxAge:        30 * 24 * time.Hour,
+	}, engine.Resolve(ctx, user))
+}
+
+func TestSetPassword_DeniesReuse(t *testing.T) {
+	ctx := context.Background()
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()}))
+	engine := NewEngine(Config{Default: Policy{HistorySize: 2}}, utils.NewCryptoManager("test-secret"), zap.NewNop())
+	engine.SetHistoryStore(NewRedisHistoryStore(client))
+	user := &types.User{ID: "u1", Username: "alice"}
+
+	for _, password := range []string{"first-secret", "second-secret", "third-secret"} {
+		require.NoError(t, engine.SetPassword(ctx, user, password))
+	}
+	assert.NotEmpty(t, user.Attributes[AttrChangedAt])
+
+	// The current password and the last two are refused, older ones are not.
+	assert.ErrorIs(t, engine.SetPassword(ctx, user, "third-secret"), types.ErrPasswordPolicy)
+	assert.ErrorIs(t, engine.SetPassword(ctx, user, "second-secret"), types.ErrPasswordPolicy)
+	require.NoError(t, engine.SetPassword(ctx, user, "fourth-secret"))
+	assert.NoError(t, engine.SetPassword(ctx, user, "first-secret"))
+}
+
+func TestValidate_BreachedPasswords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	// SHA-1 of "password1" and "qwerty", as in the Have I Been Pwned downloads.
+	corpus := "# breached\nE38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D:2427158\nb1b3773a05c0ed0176787a4f1574ff0075f7521e\n"
+	require.NoError(t, os.WriteFile(path, []byte(corpus), 0o600))
+
+	loaded, err := LoadCorpus(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, loaded.Len())
+
+	engine := NewEngine(Config{Default: Policy{CheckBreached: true}}, utils.NewCryptoManager("test-secret"), zap.NewNop())
+	engine.SetBreachCorpus(loaded)
+	user := &types.User{ID: "u1"}
+	assert.Equal(t, []string{"breached"}, rules(engine.Validate(context.Background(), user, "password1")))
+	assert.Equal(t, []string{"breached"}, rules(engine.Validate(context.Background(), user, "qwerty")))
+	assert.Empty(t, engine.Validate(context.Background(), user, "a password nobody leaked"))
+
+	require.NoError(t, os.WriteFile(path, []byte("not-a-hash\n"), 0o600))
+	_, err = LoadCorpus(path)
+	assert.Error(t, err)
+}
+
+func TestChangeRequired(t *testing.T) {
+	ctx := context.Background()
+	engine := NewEngine(Config{Default: Policy{MaxAge: 24 * time.Hour}}, utils.NewCryptoManager("test-secret"), zap.NewNop())
+	now := time.Now()
+	engine.now = func() time.Time { return now }
+
+	user := &types.User{ID: "u1"}
+	require.NoError(t, engine.SetPassword(ctx, user, "a-new-password"))
+	required, _ := engine.ChangeRequired(ctx, user)
+	assert.False(t, required)
+
+	now = now.Add(25 * time.Hour)
+	required, reason := engine.ChangeRequired(ctx, user)
+	assert.True(t, required)
+	assert.Equal(t, "password expired", reason)
+
+	// An administrator may demand a change regardless of age.
+	require.NoError(t, engine.SetPassword(ctx, user, "another-password"))
+	user.Attributes[AttrChangeRequired] = true
+	required, _ = engine.ChangeRequired(ctx, user)
+	assert.True(t, required)
+}
+
+func TestStrength(t *testing.T) {
+	for password, want := range map[string]int{
+		"password":                     0,
+		"aaaaaaaaaa":                   0,
+		"12345678":                     0,
+		"qwertyuiop":                   0,
+		"P@ssw0rd":                     0,
+		"alice2024":                    1,
+		"Password1!":                   2,
+		"correct horse battery staple": 4,
+	} {
+		assert.Equal(t, want, Strength(password, "alice"), password)
+	}
+}
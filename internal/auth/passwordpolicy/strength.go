@@ -0,0 +1,194 @@
+package passwordpolicy
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonPasswords are passwords and words attackers try first. A password
+// built from one of them is only as strong as the characters around it.
+var commonPasswords = []string{
+	"password", "passw0rd", "123456", "12345678", "qwerty", "abc123", "letmein",
+	"welcome", "monkey", "dragon", "master", "login", "admin", "administrator",
+	"iloveyou", "sunshine", "princess", "football", "baseball", "superman",
+	"batman", "trustno1", "shadow", "michael", "jennifer", "hunter", "access",
+	"secret", "freedom", "whatever", "starwars", "computer", "summer", "winter",
+	"spring", "autumn", "hello", "charlie", "changeme", "default", "root",
+	"guest", "user", "test", "pass", "love", "god", "money", "company", "qazwsx",
+	"zaq1", "asdf", "zxcv", "1q2w3e", "q1w2e3", "111111", "000000", "654321",
+}
+
+// keyboardRows are sequences of adjacent keys.
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm", "1234567890"}
+
+// leet maps common character substitutions back to letters.
+var leet = strings.NewReplacer("4", "a", "@", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+// Strength estimates how hard the password is to guess and scores it from
+// 0 (trivially guessable) to 4 (very unlikely to be guessed), on the scale of
+// zxcvbn. Like zxcvbn, it splits the password into the cheapest patterns an
+// attacker would try (dictionary words including the user inputs, repeated
+// characters, sequences, keyboard runs and years) and brute-forces the rest.
+func Strength(password string, userInputs ...string) int {
+	guesses := math.Log10(estimateGuesses(password, userInputs))
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// estimateGuesses returns the estimated number of guesses for the password.
+func estimateGuesses(password string, userInputs []string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 1
+	}
+	lower := []rune(strings.ToLower(password))
+	plain := []rune(leet.Replace(string(lower)))
+	if len(plain) != len(lower) {
+		plain = lower
+	}
+
+	var words []string
+	for _, input := range userInputs {
+		if input = strings.ToLower(input); len([]rune(input)) >= 3 {
+			words = append(words, input)
+		}
+	}
+	inputCount := len(words)
+	words = append(words, commonPasswords...)
+
+	cardinality := float64(charsetSize(password))
+	guesses := 1.0
+	for i := 0; i < len(runes); {
+		n, g := matchAt(runes, lower, plain, i, words, inputCount)
+		if n == 0 {
+			n, g = 1, cardinality
+		}
+		guesses *= g
+		i += n
+	}
+	return guesses
+}
+
+// matchAt returns the length of the longest pattern starting at i and its
+// guesses, or 0 if none starts there.
+func matchAt(runes, lower, plain []rune, i int, words []string, inputCount int) (int, float64) {
+	best, bestGuesses := 0, 0.0
+	consider := func(n int, guesses float64) {
+		if n > best || (n == best && guesses < bestGuesses) {
+			best, bestGuesses = n, guesses
+		}
+	}
+
+	// Dictionary words, including leetspeak and capitalized variants.
+	for k, word := range words {
+		w := []rune(word)
+		if i+len(w) > len(plain) {
+			continue
+		}
+		if string(plain[i:i+len(w)]) != word && string(lower[i:i+len(w)]) != word {
+			continue
+		}
+		g := float64(len(words) - inputCount)
+		if k < inputCount {
+			g = 10
+		}
+		for _, r := range runes[i : i+len(w)] {
+			if unicode.IsUpper(r) {
+				g *= 2
+				break
+			}
+		}
+		if string(lower[i:i+len(w)]) != word {
+			g *= 2
+		}
+		consider(len(w), g)
+	}
+
+	// Repeated characters.
+	j := i + 1
+	for j < len(lower) && lower[j] == lower[i] {
+		j++
+	}
+	if j-i >= 3 {
+		consider(j-i, float64(charsetSize(string(runes[i])))*float64(j-i))
+	}
+
+	// Ascending or descending sequences, such as "abcd" or "4321".
+	if i+2 < len(lower) {
+		if step := lower[i+1] - lower[i]; step == 1 || step == -1 {
+			j = i + 1
+			for j+1 < len(lower) && lower[j+1]-lower[j] == step {
+				j++
+			}
+			if j-i+1 >= 3 {
+				consider(j-i+1, 10*float64(j-i+1))
+			}
+		}
+	}
+
+	// Runs of adjacent keys.
+	for _, row := range keyboardRows {
+		n := 0
+		for i+n < len(lower) && strings.Contains(row, string(lower[i:i+n+1])) {
+			n++
+		}
+		if n >= 4 {
+			consider(n, 20*float64(n))
+		}
+	}
+
+	// Recent years.
+	if i+4 <= len(lower) {
+		if year := string(lower[i : i+4]); (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && strings.Trim(year, "0123456789") == "" {
+			consider(4, 100)
+		}
+	}
+	return best, bestGuesses
+}
+
+// charsetSize returns the size of the character classes used in s.
+func charsetSize(s string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < 128:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	return size
+}
@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// MFAFactors is the MFA enrollment of a user.
+type MFAFactors struct {
+	Factors                []*mfa.Factor `json:"factors"`
+	RecoveryCodesRemaining int           `json:"recovery_codes_remaining"`
+}
+
+// TOTPConfirmation is the result of a confirmed TOTP enrollment. It carries
+// the user's first recovery codes when they had none.
+type TOTPConfirmation struct {
+	Factor        *mfa.Factor `json:"factor"`
+	RecoveryCodes []string    `json:"recovery_codes,omitempty"`
+}
+
+// ListMFAFactors returns the enrolled factors of a user.
+func (s *Service) ListMFAFactors(ctx context.Context, userID string) (*MFAFactors, error) {
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	factors, err := s.mfaManager.ListFactors(ctx, user)
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	result := &MFAFactors{Factors: factors}
+	if recovery := s.recoveryCodes(); recovery != nil {
+		if result.RecoveryCodesRemaining, err = recovery.Remaining(ctx, user); err != nil {
+			return nil, s.mfaFactorError(ctx, user, err)
+		}
+	}
+	return result, nil
+}
+
+// EnrollTOTP starts the enrollment of a TOTP authenticator app. The factor is
+// used only once ConfirmTOTP verifies a code from the app. Users who already
+// have a factor need a recent step-up in the session.
+func (s *Service) EnrollTOTP(ctx context.Context, userID, sessionID string) (*types.MFAEnrollment, error) {
+	provider, ok := s.totpProvider()
+	if !ok {
+		return nil, types.ErrNotImplemented.WithDetails(map[string]string{"reason": "TOTP is not enabled"})
+	}
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	if err := s.mfaManager.AuthorizeEnrollment(ctx, user, sessionID); err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	enrollment, err := provider.Enroll(ctx, user)
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	return enrollment, nil
+}
+
+// ConfirmTOTP completes a TOTP enrollment with a code from the app, under the
+// same step-up rule as EnrollTOTP. Users without recovery codes are issued
+// their first set.
+func (s *Service) ConfirmTOTP(ctx context.Context, userID, sessionID, code string) (*TOTPConfirmation, error) {
+	provider, ok := s.totpProvider()
+	if !ok {
+		return nil, types.ErrNotImplemented.WithDetails(map[string]string{"reason": "TOTP is not enabled"})
+	}
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	if err := s.mfaManager.AuthorizeEnrollment(ctx, user, sessionID); err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	factor, err := provider.Confirm(ctx, user, code)
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+
+	confirmation := &TOTPConfirmation{Factor: &mfa.Factor{
+		ID:        factor.ID.String(),
+		Type:      factor.Type,
+		Provider:  "totp",
+		Strength:  provider.GetStrength(),
+		CreatedAt: factor.CreatedAt,
+	}}
+	if recovery := s.recoveryCodes(); recovery != nil {
+		remaining, err := recovery.Remaining(ctx, user)
+		if err != nil {
+			return nil, s.mfaFactorError(ctx, user, err)
+		}
+		if remaining == 0 {
+			if confirmation.RecoveryCodes, err = recovery.Regenerate(ctx, user); err != nil {
+				return nil, s.mfaFactorError(ctx, user, err)
+			}
+		}
+	}
+	return confirmation, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user. As the codes
+// can stand in for the user's other factors, it needs a recent step-up in the
+// session.
+func (s *Service) RegenerateRecoveryCodes(ctx context.Context, userID, sessionID string) ([]string, error) {
+	recovery := s.recoveryCodes()
+	if recovery == nil {
+		return nil, types.ErrNotImplemented.WithDetails(map[string]string{"reason": "recovery codes are not enabled"})
+	}
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	if !s.mfaManager.SteppedUp(ctx, user, sessionID) {
+		return nil, types.ErrStepUpRequired
+	}
+	codes, err := recovery.Regenerate(ctx, user)
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	return codes, nil
+}
+
+// SetDefaultMFAFactor makes a factor the one a login challenges first.
+func (s *Service) SetDefaultMFAFactor(ctx context.Context, userID, factorID string) (*mfa.Factor, error) {
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	factor, err := s.mfaManager.SetDefaultFactor(ctx, user, factorID)
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	return factor, nil
+}
+
+// BeginMFAStepUp challenges a signed-in user to verify one of their factors
+// before a sensitive change.
+func (s *Service) BeginMFAStepUp(ctx context.Context, userID, provider string) (*types.MFAChallenge, error) {
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	challenge, err := s.mfaManager.BeginStepUp(ctx, user, provider)
+	if errors.Is(err, mfa.ErrNoEnrolledFactors) {
+		return nil, types.ErrBadRequest.WithDetails(map[string]string{"reason": "no MFA factor is enrolled"})
+	}
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	return challenge, nil
+}
+
+// CompleteMFAStepUp verifies the answer to a step-up challenge, stepping up
+// the session it is answered in.
+func (s *Service) CompleteMFAStepUp(ctx context.Context, userID, sessionID string, req *types.VerifyMFARequest) error {
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return types.ErrUserNotFound.WithCause(err)
+	}
+	if err := s.mfaManager.CompleteStepUp(ctx, req.ChallengeID, user, sessionID, req.Provider, req.Code); err != nil {
+		return s.mfaFactorError(ctx, user, err)
+	}
+	return nil
+}
+
+// DeleteMFAFactor removes a factor of a user after a recent step-up in the
+// session.
+func (s *Service) DeleteMFAFactor(ctx context.Context, userID, sessionID, factorID string) (*mfa.Factor, error) {
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	factor, err := s.mfaManager.DeleteFactor(ctx, user, sessionID, factorID)
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	return factor, nil
+}
+
+// RegisterPushDevice enrolls a device for push approvals. token addresses the
+// device at the push gateway and publicKey is the Ed25519 key it signs its
+// responses with. Users who already have a factor need a recent step-up in
+// the session.
+func (s *Service) RegisterPushDevice(ctx context.Context, userID, sessionID, name, token string, publicKey []byte) (*mfa.Factor, error) {
+	provider, ok := s.pushProvider()
+	if !ok {
+		return nil, types.ErrNotImplemented.WithDetails(map[string]string{"reason": "push approvals are not enabled"})
+	}
+	user, err := s.identityService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, types.ErrUserNotFound.WithCause(err)
+	}
+	if err := s.mfaManager.AuthorizeEnrollment(ctx, user, sessionID); err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	factor, err := provider.RegisterDevice(ctx, user, name, token, publicKey)
+	if err != nil {
+		return nil, s.mfaFactorError(ctx, user, err)
+	}
+	return &mfa.Factor{
+		ID:        factor.ID.String(),
+		Type:      factor.Type,
+		Provider:  "push",
+		Strength:  provider.GetStrength(),
+		CreatedAt: factor.CreatedAt,
+	}, nil
+}
+
+// RespondPushApproval records a device's signed answer to a push approval.
+func (s *Service) RespondPushApproval(ctx context.Context, resp *mfa.PushResponse) error {
+	provider, ok := s.pushProvider()
+	if !ok {
+		return types.ErrNotImplemented.WithDetails(map[string]string{"reason": "push approvals are not enabled"})
+	}
+	err := provider.Respond(ctx, resp)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, mfa.ErrApprovalNotFound):
+		return types.ErrNotFound.WithCause(err)
+	case errors.Is(err, mfa.ErrInvalidDeviceSignature):
+		return types.ErrUnauthorized.WithCause(err)
+	default:
+		s.logger.Error(ctx, "Failed to record push approval response", zap.Error(err), zap.String("approvalID", resp.ApprovalID))
+		return types.ErrInternal.WithCause(err)
+	}
+}
+
+func (s *Service) totpProvider() (*mfa.TOTPProvider, bool) {
+	provider, ok := s.mfaManager.Provider("totp")
+	if !ok {
+		return nil, false
+	}
+	totp, ok := provider.(*mfa.TOTPProvider)
+	return totp, ok
+}
+
+func (s *Service) pushProvider() (*mfa.PushProvider, bool) {
+	provider, ok := s.mfaManager.Provider("push")
+	if !ok {
+		return nil, false
+	}
+	push, ok := provider.(*mfa.PushProvider)
+	return push, ok
+}
+
+func (s *Service) recoveryCodes() *mfa.RecoveryCodeProvider {
+	provider, ok := s.mfaManager.Provider("recovery")
+	if !ok {
+		return nil
+	}
+	recovery, _ := provider.(*mfa.RecoveryCodeProvider)
+	return recovery
+}
+
+// mfaFactorError maps an error of factor management to an API error.
+func (s *Service) mfaFactorError(ctx context.Context, user *types.User, err error) error {
+	switch {
+	case errors.Is(err, mfa.ErrFactorNotFound):
+		return types.ErrNotFound.WithCause(err)
+	case errors.Is(err, mfa.ErrStepUpRequired):
+		return types.ErrStepUpRequired
+	case errors.Is(err, mfa.ErrSessionRequired):
+		return types.ErrBadRequest.WithDetails(map[string]string{"reason": err.Error()})
+	case errors.Is(err, mfa.ErrNoPendingEnrollment):
+		return types.ErrBadRequest.WithDetails(map[string]string{"reason": "no TOTP enrollment was started"})
+	case errors.Is(err, mfa.ErrApprovalPending):
+		return types.ErrAuthorizationPending
+	case errors.Is(err, mfa.ErrApprovalDenied):
+		return types.ErrAccessDenied
+	case errors.Is(err, mfa.ErrInvalidDeviceKey):
+		return types.ErrBadRequest.WithDetails(map[string]string{"reason": err.Error()})
+	case errors.Is(err, mfa.ErrInvalidCode), errors.Is(err, mfa.ErrCodeReplayed):
+		return types.ErrMfaCodeInvalid
+	case errors.Is(err, mfa.ErrChallengeNotFound), errors.Is(err, mfa.ErrProviderNotAllowed), errors.Is(err, mfa.ErrTooManyAttempts):
+		return types.ErrMfaChallengeInvalid.WithCause(err)
+	default:
+		s.logger.Error(ctx, "MFA factor management failed", zap.Error(err), zap.String("userID", user.ID))
+		return types.ErrInternal.WithCause(err)
+	}
+}
@@ -102,8 +102,8 @@ func (m *MockTokenFamilyRepository) GetFamilyByID(ctx context.Context, familyID
 	return args.Get(0).(*TokenFamily), args.Error(1)
 }
 
-func (m *MockTokenFamilyRepository) UpdateFamily(ctx context.Context, family *TokenFamily) error {
-	args := m.Called(ctx, family)
+func (m *MockTokenFamilyRepository) RotateFamily(ctx context.Context, familyID, current, next string) error {
+	args := m.Called(ctx, familyID, current, next)
 	return args.Error(0)
 }
 
@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// LoginWithPasskey creates a session and tokens for a user who signed in
+// with a user-verified passkey. The passkey proves both possession and the
+// user's PIN or biometric, so the login needs no further MFA step and is
+// recorded as a phishing-resistant hardware key login.
+func (s *Service) LoginWithPasskey(ctx context.Context, user *types.User, serviceConfig Config) (*types.AuthResult, error) {
+	if user.Status != types.UserStatusActive {
+		s.logAuthFailure(ctx, user.ID, "login_passkey", "user_not_active")
+		return nil, types.ErrUserDisabled
+	}
+	return s.createSessionAndTokens(ctx, user, "login_passkey", []string{"hwk", "user"}, mfa.ACRPhishingResistant, serviceConfig)
+}
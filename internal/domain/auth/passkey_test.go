@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+func TestLoginWithPasskey_IsPhishingResistant(t *testing.T) {
+	// Arrange
+	mockSessionRepo := new(MockSessionRepository)
+	mockTokenRepo := new(MockTokenRepository)
+	mockAuditRepo := new(MockAuditLogRepository)
+	mockCrypto := new(utils.MockCryptoManager)
+
+	service := NewService(new(identity.MockIService), mockSessionRepo, mockTokenRepo, mockAuditRepo, nil, mockCrypto, new(utils.MockLogger), nil, nil, nil, nil, nil)
+
+	user := &types.User{ID: "user1", Username: "test", Status: types.UserStatusActive}
+	mockCrypto.On("GenerateUUID").Return("session-1")
+	mockCrypto.On("GenerateJWT", user.ID, mock.Anything, mock.MatchedBy(func(claims jwt.MapClaims) bool {
+		return claims["acr"] == mfa.ACRPhishingResistant && assert.ObjectsAreEqual([]string{"hwk", "user"}, claims["amr"])
+	})).Return("access_token", nil)
+	mockTokenRepo.On("StoreRefreshToken", mock.Anything, mock.Anything, user.ID, mock.Anything).Return(nil)
+	mockSessionRepo.On("CreateSession", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+
+	// Act
+	result, err := service.LoginWithPasskey(context.Background(), user, Config{})
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "access_token", result.Token.AccessToken)
+	assert.Equal(t, []string{"hwk", "user"}, result.Session.AuthMethods)
+	assert.Equal(t, mfa.ACRPhishingResistant, result.Session.ACR)
+}
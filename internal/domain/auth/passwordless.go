@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/turtacn/QuantaID/internal/auth/passwordless"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// PasswordlessStartRequest asks for a magic link or a code to be emailed.
+type PasswordlessStartRequest struct {
+	Email      string `json:"email"`
+	Method     string `json:"method"`
+	SameDevice bool   `json:"same_device"`
+	IPAddress  string `json:"-"`
+}
+
+// PasswordlessCompleteRequest completes a passwordless login with the token
+// of a magic link, or with the flow ID and the emailed code.
+type PasswordlessCompleteRequest struct {
+	FlowID        string `json:"flow_id"`
+	Token         string `json:"token"`
+	Code          string `json:"code"`
+	IPAddress     string `json:"-"`
+	IsKnownDevice bool   `json:"-"`
+}
+
+// PasswordlessStart is the response to a started passwordless login. The
+// flow ID completes a login by code, and a same-device login by magic link.
+type PasswordlessStart struct {
+	FlowID     string `json:"flow_id"`
+	Method     string `json:"method"`
+	SameDevice bool   `json:"same_device"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// SetPasswordless sets the service of the passwordless logins by email.
+func (s *Service) SetPasswordless(service *passwordless.Service) {
+	s.passwordless = service
+}
+
+// StartPasswordless emails a magic link or a code to the active user with the
+// email address. The response is the same whether or not there is such a
+// user, so that it does not reveal which addresses are registered.
+func (s *Service) StartPasswordless(ctx context.Context, req PasswordlessStartRequest) (*PasswordlessStart, error) {
+	if s.passwordless == nil {
+		return nil, types.ErrNotImplemented.WithDetails(map[string]string{"reason": "passwordless login is disabled"})
+	}
+	if req.Email == "" {
+		return nil, types.ErrBadRequest.WithDetails(map[string]string{"email": "is required"})
+	}
+	method := passwordless.Method(req.Method)
+	if method == "" {
+		method = passwordless.MethodLink
+	}
+	if method != passwordless.MethodLink && method != passwordless.MethodCode {
+		return nil, types.ErrBadRequest.WithDetails(map[string]string{"method": "must be link or code"})
+	}
+
+	start := passwordless.StartRequest{Email: req.Email, Method: method, SameDevice: req.SameDevice, Source: req.IPAddress}
+	if user, err := s.identityService.GetUserRepo().GetUserByEmail(ctx, req.Email); err == nil && user.Status == types.UserStatusActive {
+		start.UserID = user.ID
+	}
+	flow, err := s.passwordless.Start(ctx, start)
+	if err != nil {
+		var limited *passwordless.RateLimitedError
+		if errors.As(err, &limited) {
+			retryAfter := strconv.Itoa(int(limited.RetryAfter.Round(time.Second).Seconds()))
+			return nil, types.ErrTooManyRequests.WithDetails(map[string]string{"retry_after": retryAfter}).WithCause(err)
+		}
+		s.logger.Error(ctx, "Failed to start passwordless login", zap.Error(err), zap.String("userID", start.UserID))
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	return &PasswordlessStart{
+		FlowID:     flow.ID,
+		Method:     string(flow.Method),
+		SameDevice: flow.SameDevice,
+		ExpiresIn:  int(s.passwordless.TTL().Seconds()),
+	}, nil
+}
+
+// CompletePasswordless verifies the magic link or code of a passwordless
+// login and, like a password login, evaluates its risk before challenging
+// for MFA or creating a session and tokens.
+func (s *Service) CompletePasswordless(ctx context.Context, req PasswordlessCompleteRequest, serviceConfig Config) (*types.AuthResult, error) {
+	if s.passwordless == nil {
+		return nil, types.ErrNotImplemented.WithDetails(map[string]string{"reason": "passwordless login is disabled"})
+	}
+	flow, err := s.passwordless.Complete(ctx, passwordless.CompleteRequest{FlowID: req.FlowID, Token: req.Token, Code: req.Code})
+	if err != nil {
+		switch {
+		case errors.Is(err, passwordless.ErrInvalidCode):
+			return nil, types.ErrInvalidCredentials.WithCause(err)
+		case errors.Is(err, passwordless.ErrDeviceMismatch):
+			return nil, types.ErrDeviceMismatch.WithDetails(map[string]string{"reason": "open the link on the device that requested it"}).WithCause(err)
+		case errors.Is(err, passwordless.ErrInvalidToken), errors.Is(err, passwordless.ErrFlowNotFound), errors.Is(err, passwordless.ErrTooManyAttempts):
+			return nil, types.ErrInvalidToken.WithCause(err)
+		default:
+			s.logger.Error(ctx, "Failed to complete passwordless login", zap.Error(err))
+			return nil, types.ErrInternal.WithCause(err)
+		}
+	}
+
+	user, err := s.identityService.GetUserByID(ctx, flow.UserID)
+	if err != nil {
+		return nil, types.ErrInvalidCredentials.WithCause(err)
+	}
+	if user.Status != types.UserStatusActive {
+		s.logAuthFailure(ctx, user.ID, "login_passwordless", "user_not_active")
+		return nil, types.ErrUserDisabled
+	}
+	// The link or code reached the user's inbox, which proves the address.
+	if !user.IsEmailVerified() {
+		user.EmailVerified = true
+		if err := s.identityService.UpdateUser(ctx, user); err != nil {
+			s.logger.Warn(ctx, "Failed to mark email address verified", zap.Error(err), zap.String("userID", user.ID))
+		}
+	}
+
+	authContext := AuthContext{
+		UserID:        user.ID,
+		IPAddress:     req.IPAddress,
+		Timestamp:     time.Now(),
+		IsKnownDevice: req.IsKnownDevice,
+	}
+	return s.completeLogin(ctx, user, authContext, "login_passwordless", []string{"otp"}, serviceConfig)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/types"
@@ -24,6 +25,7 @@ type RecoveryService struct {
 	cryptoManager  *utils.CryptoManager
 	sessionManager *redis.SessionManager
 	logger         *zap.Logger
+	passwords      *passwordpolicy.Engine
 }
 
 // NewRecoveryService creates a new RecoveryService.
@@ -43,6 +45,11 @@ func NewRecoveryService(
 	}
 }
 
+// SetPasswordPolicy sets the policy new passwords are validated against.
+func (s *RecoveryService) SetPasswordPolicy(engine *passwordpolicy.Engine) {
+	s.passwords = engine
+}
+
 // InitiateRecovery starts the password recovery process by sending an OTP to the user's email.
 func (s *RecoveryService) InitiateRecovery(ctx context.Context, email string) error {
 	user, err := s.userRepo.GetUserByEmail(ctx, email)
@@ -78,6 +85,13 @@ func (s *RecoveryService) VerifyAndReset(ctx context.Context, email, code, newPa
 		return err
 	}
 
+	// Refuse a password the policy rejects before the code is used up.
+	if s.passwords != nil {
+		if err := s.passwords.Check(ctx, user, newPassword); err != nil {
+			return err
+		}
+	}
+
 	// Verify OTP
 	valid, err := s.otpProvider.Verify(ctx, user.ID, code)
 	if err != nil {
@@ -89,13 +103,19 @@ func (s *RecoveryService) VerifyAndReset(ctx context.Context, email, code, newPa
 	}
 
 	// Hash new password
-	hashedPassword, err := s.cryptoManager.HashPassword(newPassword)
-	if err != nil {
-		return fmt.Errorf("failed to hash password: %w", err)
+	if s.passwords != nil {
+		if err := s.passwords.SetPassword(ctx, user, newPassword); err != nil {
+			return err
+		}
+	} else {
+		hashedPassword, err := s.cryptoManager.HashPassword(newPassword)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		user.Password = hashedPassword
 	}
 
 	// Update password
-	user.Password = hashedPassword
 	if err := s.userRepo.UpdateUser(ctx, user); err != nil {
 		return fmt.Errorf("failed to update user password: %w", err)
 	}
@@ -0,0 +1,15 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HashRefreshToken returns the hash under which a refresh token is stored.
+// Token stores and token families keep only this hash, so a leaked database
+// or Redis dump holds no usable refresh tokens. Refresh tokens are long random
+// strings, so an unsalted SHA-256 cannot be reversed by guessing.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
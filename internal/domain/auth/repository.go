@@ -19,8 +19,15 @@ type SessionRepository interface {
 	GetUserSessions(ctx context.Context, userID string) ([]*types.UserSession, error)
 }
 
+// SessionRevoker ends all sessions of a user, such as after their password
+// changed.
+type SessionRevoker interface {
+	RevokeAllUserSessions(ctx context.Context, userID string) error
+}
+
 // TokenRepository defines the interface for managing refresh tokens and JWT deny lists.
 // This is crucial for handling token revocation and refresh mechanics.
+// Refresh tokens are passed as HashRefreshToken hashes.
 type TokenRepository interface {
 	// StoreRefreshToken saves a refresh token and associates it with a user ID.
 	StoreRefreshToken(ctx context.Context, token string, userID string, duration time.Duration) error
@@ -60,28 +67,26 @@ type AuditLogRepository interface {
 	GetLogsByAction(ctx context.Context, action string, pq types.PaginationQuery) ([]*types.AuditLog, error)
 }
 
-// TokenFamily represents a chain of rotated refresh tokens.
-type TokenFamily struct {
-    FamilyID       string
-    OriginalToken  string
-    CurrentToken   string
-    IssuedTokens   []string // All refresh tokens issued in this family.
-    UserID         string
-    ClientID       string
-    RevokedAt      *time.Time
-}
+// TokenFamily represents a chain of rotated refresh tokens. It is defined in
+// pkg/types so that storage packages can implement TokenFamilyRepository.
+type TokenFamily = types.TokenFamily
 
 // TokenFamilyRepository defines the interface for managing refresh token families.
 // This is essential for implementing refresh token rotation and detecting replay attacks.
+// Tokens are passed and stored as HashRefreshToken hashes, never in plaintext.
 type TokenFamilyRepository interface {
     // CreateFamily creates a new token family when a refresh token is first issued.
     CreateFamily(ctx context.Context, family *TokenFamily) error
     // GetFamilyByToken retrieves the token family associated with a given refresh token.
+    // It returns types.ErrNotFound if no family has issued the token.
     GetFamilyByToken(ctx context.Context, token string) (*TokenFamily, error)
     // GetFamilyByID retrieves a token family by its unique ID.
     GetFamilyByID(ctx context.Context, familyID string) (*TokenFamily, error)
-    // UpdateFamily updates an existing token family, typically to add a new token during rotation.
-    UpdateFamily(ctx context.Context, family *TokenFamily) error
+    // RotateFamily makes next the current token of a family and records it as
+    // issued, in one atomic step that succeeds only while current is still the
+    // family's current token and the family is not revoked. Otherwise it
+    // returns types.ErrConflict: a concurrent refresh or a revocation won.
+    RotateFamily(ctx context.Context, familyID, current, next string) error
     // RevokeFamily marks an entire token family as revoked, invalidating all its tokens.
     RevokeFamily(ctx context.Context, familyID string) error
 }
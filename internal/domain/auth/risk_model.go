@@ -16,6 +16,17 @@ type AuthContext struct {
 	Timestamp         time.Time
 	DeviceFingerprint string
 	IsKnownDevice     bool
+	// ClientID is the application the user is signing in to, if any.
+	ClientID string
+	// Location is where the login comes from, such as "Berlin, Germany".
+	Location string
+	// RequiredACR is the acr the login must reach, if any.
+	RequiredACR string
+}
+
+// GeoLocator describes where an IP address is for display to users.
+type GeoLocator interface {
+	Locate(address string) string
 }
 
 // RiskEngine evaluates the risk of an authentication attempt.
@@ -2,12 +2,19 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
 	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/auth/passwordless"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/security/automator"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 	"go.uber.org/zap"
+	"strconv"
 	"time"
 )
 
@@ -26,6 +33,12 @@ type Service struct {
 	mfaManager        *mfa.MFAManager
 	appRepo           types.ApplicationRepository
 	redisClient       redis.RedisClientInterface
+	lockout           *lockout.Tracker
+	passwordPolicy    *passwordpolicy.Engine
+	sessionRevoker    SessionRevoker
+	passwordless      *passwordless.Service
+	geoLocator        GeoLocator
+	automator         *automator.Engine
 }
 
 // Config holds configuration for the auth service, specifically token and session lifetimes.
@@ -41,6 +54,24 @@ type AuthnRequest struct {
 	IPAddress         string
 	DeviceFingerprint string
 	IsKnownDevice     bool
+	UserAgent         string
+	// ClientID is the application the login is for, shown with push MFA approvals.
+	ClientID string
+	// ACRValues are the acr values the application requested. A login that
+	// would not reach one of them is challenged for MFA strong enough to.
+	ACRValues []string
+}
+
+// ChangePasswordRequest is a user's request to replace their password.
+type ChangePasswordRequest struct {
+	Username        string
+	CurrentPassword string
+	NewPassword     string
+	IPAddress       string
+	// UserID and SessionID name the signed-in user and session the change is
+	// made from. Both are empty for a user whose password has expired.
+	UserID    string
+	SessionID string
 }
 
 // NewService creates a new authentication service instance.
@@ -74,6 +105,37 @@ func NewService(
 	}
 }
 
+// SetLockoutTracker sets the tracker that counts failed password logins and
+// refuses attempts on locked or throttled accounts.
+func (s *Service) SetLockoutTracker(tracker *lockout.Tracker) {
+	s.lockout = tracker
+}
+
+// SetPasswordPolicy sets the policy that new passwords are validated against
+// and that decides when a password has expired.
+func (s *Service) SetPasswordPolicy(engine *passwordpolicy.Engine) {
+	s.passwordPolicy = engine
+}
+
+// SetSessionRevoker sets what ends the sessions of a user whose password
+// was changed.
+func (s *Service) SetSessionRevoker(revoker SessionRevoker) {
+	s.sessionRevoker = revoker
+}
+
+// SetGeoLocator sets the locator that resolves the location of a login for
+// display in push MFA approvals.
+func (s *Service) SetGeoLocator(locator GeoLocator) {
+	s.geoLocator = locator
+}
+
+// SetSecurityAutomator sets the engine that runs the configured security
+// actions, such as blocking the source IP or disconnecting the user's
+// network sessions, on the risk score of every login.
+func (s *Service) SetSecurityAutomator(engine *automator.Engine) {
+	s.automator = engine
+}
+
 // GetUserRepo returns the user repository.
 func (s *Service) GetUserRepo() identity.UserRepository {
 	return s.identityService.GetUserRepo()
@@ -96,8 +158,15 @@ func (s *Service) GetCryptoManager() utils.CryptoManagerInterface {
 
 // LoginWithPassword handles the traditional username and password authentication flow.
 func (s *Service) LoginWithPassword(ctx context.Context, req AuthnRequest, serviceConfig Config) (*types.AuthResult, error) {
+	if s.lockout != nil {
+		if err := s.lockout.Check(ctx, req.Username, req.IPAddress); err != nil {
+			return nil, refusedLoginError(err)
+		}
+	}
+
 	user, err := s.identityService.GetUserByUsername(ctx, req.Username)
 	if err != nil {
+		s.recordLoginFailure(ctx, req)
 		return nil, types.ErrInvalidCredentials.WithCause(err)
 	}
 
@@ -108,76 +177,346 @@ func (s *Service) LoginWithPassword(ctx context.Context, req AuthnRequest, servi
 
 	if !s.crypto.CheckPasswordHash(req.Password, user.Password) {
 		s.logAuthFailure(ctx, user.ID, "login_password", "invalid_password")
+		s.recordLoginFailure(ctx, req)
 		return nil, types.ErrInvalidCredentials
 	}
+	if s.lockout != nil {
+		s.lockout.RecordSuccess(ctx, req.Username)
+	}
+	s.rehashPassword(ctx, user, req.Password)
+	if s.passwordPolicy != nil {
+		if required, reason := s.passwordPolicy.ChangeRequired(ctx, user); required {
+			s.logAuthFailure(ctx, user.ID, "login_password", "password_change_required")
+			return nil, types.ErrPasswordExpired.WithDetails(map[string]string{"reason": reason})
+		}
+	}
 
 	authContext := AuthContext{
 		UserID:        user.ID,
 		IPAddress:     req.IPAddress,
+		UserAgent:     req.UserAgent,
 		Timestamp:     time.Now(),
 		IsKnownDevice: req.IsKnownDevice,
+		ClientID:      req.ClientID,
+		RequiredACR:   mfa.RequiredACR(req.ACRValues),
 	}
-	_, level, err := s.riskEngine.Evaluate(ctx, authContext)
+	return s.completeLogin(ctx, user, authContext, "login_password", []string{"pwd"}, serviceConfig)
+}
+
+// completeLogin finishes the login of an authenticated user: it evaluates the
+// risk of the login and either challenges the user for MFA or creates a
+// session and tokens. Every first factor ends its login here; amr lists the
+// OpenID Connect amr values of the first factor. A login that must reach an
+// acr stronger than a single factor is always challenged, with factors of
+// the strength the acr requires.
+func (s *Service) completeLogin(ctx context.Context, user *types.User, authContext AuthContext, method string, amr []string, serviceConfig Config) (*types.AuthResult, error) {
+	score, level, err := s.riskEngine.Evaluate(ctx, authContext)
 	if err != nil {
 		return nil, types.ErrInternal.WithCause(err)
 	}
+	if s.automator != nil {
+		blocking, err := s.automator.Execute(ctx, automator.ActionInput{
+			UserID:    user.ID,
+			IP:        authContext.IPAddress,
+			RiskScore: float64(score),
+			Metadata:  map[string]any{"user_agent": authContext.UserAgent},
+		})
+		if err != nil {
+			// A failed response action does not decide the login.
+			s.logger.Warn(ctx, "Security response to login failed", zap.Error(err), zap.String("userID", user.ID))
+		}
+		if blocking {
+			s.logAuthFailure(ctx, user.ID, method, "blocked_by_security_policy")
+			return nil, types.ErrForbidden.WithDetails(map[string]string{"reason": "login blocked by security policy"})
+		}
+	}
 
+	minStrength, _ := mfa.StrengthForACR(authContext.RequiredACR)
 	policyDecision := s.policyEngine.Decide(level, authContext)
-	if policyDecision == "REQUIRE_MFA" {
-		// In a real implementation, we would check the user's enrolled MFA methods.
+	if policyDecision == "REQUIRE_MFA" || minStrength != "" {
+		ctx = mfa.WithApprovalContext(ctx, s.approvalContext(ctx, authContext))
+		challenge, err := s.mfaManager.ChallengeAtStrength(ctx, user, string(level), "", minStrength)
+		if errors.Is(err, mfa.ErrNoEnrolledFactors) {
+			s.logAuthFailure(ctx, user.ID, method, "mfa_not_enrolled")
+			reason := "no MFA factor is enrolled"
+			if minStrength != "" {
+				reason = "no MFA factor is enrolled that is strong enough for the application"
+			}
+			return nil, types.ErrMfaRequired.WithDetails(map[string]string{"reason": reason})
+		}
+		if err != nil {
+			s.logger.Error(ctx, "Failed to create MFA challenge", zap.Error(err), zap.String("userID", user.ID))
+			return nil, types.ErrInternal.WithCause(err)
+		}
 		return &types.AuthResult{
 			IsMfaRequired: true,
-			MFAChallenge: &types.MFAChallenge{
-				ChallengeID: "challenge-id-placeholder",
-				MFAProvider: "totp",
-			},
-			User: user,
+			MFAChallenge:  challenge,
+			User:          user,
 		}, nil
 	}
 
-	return s.createSessionAndTokens(ctx, user, serviceConfig)
+	return s.createSessionAndTokens(ctx, user, method, amr, mfa.ACRPassword, serviceConfig)
+}
+
+// approvalContext describes a login for out-of-band MFA approvals, so that
+// users can recognise the login they are asked to approve.
+func (s *Service) approvalContext(ctx context.Context, authContext AuthContext) mfa.ApprovalContext {
+	ac := mfa.ApprovalContext{
+		IPAddress: authContext.IPAddress,
+		Location:  authContext.Location,
+		UserAgent: authContext.UserAgent,
+	}
+	if ac.Location == "" && s.geoLocator != nil {
+		ac.Location = s.geoLocator.Locate(authContext.IPAddress)
+	}
+	if authContext.ClientID != "" && s.appRepo != nil {
+		ac.Application = authContext.ClientID
+		if app, err := s.appRepo.GetApplicationByClientID(ctx, authContext.ClientID); err == nil && app.Name != "" {
+			ac.Application = app.Name
+		}
+	}
+	return ac
 }
 
-// VerifyMFAChallenge verifies an MFA challenge and, if successful, creates a session and tokens.
+// ChangePassword replaces the password of a user who proves the current one
+// in a signed-in session, stepped up when the user has MFA factors. Users
+// whose password has expired cannot sign in, so they change it with the
+// current password alone unless they have factors, which the login they
+// were refused would have asked for. Failures count towards the lockout like
+// failed logins, and the user's sessions are ended once the password changed.
+func (s *Service) ChangePassword(ctx context.Context, req ChangePasswordRequest) error {
+	login := AuthnRequest{Username: req.Username, IPAddress: req.IPAddress}
+	if s.lockout != nil {
+		if err := s.lockout.Check(ctx, req.Username, req.IPAddress); err != nil {
+			return refusedLoginError(err)
+		}
+	}
+
+	user, err := s.identityService.GetUserByUsername(ctx, req.Username)
+	if err != nil {
+		s.recordLoginFailure(ctx, login)
+		return types.ErrInvalidCredentials.WithCause(err)
+	}
+	if user.Status != types.UserStatusActive {
+		s.logAuthFailure(ctx, user.ID, "password_change", "user_not_active")
+		return types.ErrUserDisabled
+	}
+	if !s.crypto.CheckPasswordHash(req.CurrentPassword, user.Password) {
+		s.logAuthFailure(ctx, user.ID, "password_change", "invalid_password")
+		s.recordLoginFailure(ctx, login)
+		return types.ErrInvalidCredentials
+	}
+	if s.lockout != nil {
+		s.lockout.RecordSuccess(ctx, req.Username)
+	}
+	if err := s.authorizePasswordChange(ctx, user, req); err != nil {
+		s.logAuthFailure(ctx, user.ID, "password_change", "not_authorized")
+		return err
+	}
+
+	if s.passwordPolicy != nil {
+		if err := s.passwordPolicy.SetPassword(ctx, user, req.NewPassword); err != nil {
+			return err
+		}
+	} else {
+		hashedPassword, err := s.crypto.HashPassword(req.NewPassword)
+		if err != nil {
+			return types.ErrInternal.WithCause(err)
+		}
+		user.Password = hashedPassword
+	}
+	if err := s.identityService.UpdateUser(ctx, user); err != nil {
+		s.logger.Error(ctx, "Failed to update password", zap.Error(err), zap.String("userID", user.ID))
+		return types.ErrInternal.WithCause(err)
+	}
+	if s.sessionRevoker != nil {
+		// The password is already changed, so this does not fail the request.
+		if err := s.sessionRevoker.RevokeAllUserSessions(ctx, user.ID); err != nil {
+			s.logger.Warn(ctx, "Failed to revoke sessions after password change", zap.Error(err), zap.String("userID", user.ID))
+		}
+	}
+	return nil
+}
+
+// authorizePasswordChange checks that a user who proved their password may
+// change it: from their own session, stepped up if they have MFA factors, or
+// without one only when the password expired and they have no factors.
+func (s *Service) authorizePasswordChange(ctx context.Context, user *types.User, req ChangePasswordRequest) error {
+	var factors []*mfa.Factor
+	if s.mfaManager != nil {
+		var err error
+		if factors, err = s.mfaManager.ListFactors(ctx, user); err != nil {
+			s.logger.Error(ctx, "Failed to list MFA factors", zap.Error(err), zap.String("userID", user.ID))
+			return types.ErrInternal.WithCause(err)
+		}
+	}
+
+	if req.SessionID != "" && req.UserID == user.ID {
+		if len(factors) > 0 && !s.mfaManager.SteppedUp(ctx, user, req.SessionID) {
+			return types.ErrStepUpRequired
+		}
+		return nil
+	}
+
+	expired := false
+	if s.passwordPolicy != nil {
+		expired, _ = s.passwordPolicy.ChangeRequired(ctx, user)
+	}
+	if !expired || len(factors) > 0 {
+		return types.ErrUnauthorized
+	}
+	return nil
+}
+
+// rehashPassword replaces a password hash in a legacy scheme or with outdated
+// parameters by one in the preferred scheme, now that the password is known.
+// Failing to do so does not fail the login.
+func (s *Service) rehashPassword(ctx context.Context, user *types.User, password string) {
+	if !s.crypto.NeedsRehash(user.Password) {
+		return
+	}
+	hash, err := s.crypto.HashPassword(password)
+	if err != nil {
+		s.logger.Warn(ctx, "Failed to rehash password", zap.Error(err), zap.String("userID", user.ID))
+		return
+	}
+	user.Password = hash
+	if err := s.identityService.UpdateUser(ctx, user); err != nil {
+		s.logger.Warn(ctx, "Failed to store rehashed password", zap.Error(err), zap.String("userID", user.ID))
+	}
+}
+
+// recordLoginFailure counts a failed password login towards the lockout of
+// the account and the source address.
+func (s *Service) recordLoginFailure(ctx context.Context, req AuthnRequest) {
+	if s.lockout != nil {
+		s.lockout.RecordFailure(ctx, req.Username, req.IPAddress)
+	}
+}
+
+// refusedLoginError maps an attempt refused by the lockout tracker to the
+// error returned to the client.
+func refusedLoginError(err error) error {
+	var refused *lockout.RefusedError
+	if !errors.As(err, &refused) {
+		return types.ErrInternal.WithCause(err)
+	}
+	details := map[string]string{"retry_after": strconv.Itoa(int(refused.RetryAfter.Round(time.Second).Seconds()))}
+	if errors.Is(err, lockout.ErrAccountLocked) {
+		return types.ErrUserLocked.WithDetails(details).WithCause(err)
+	}
+	return types.ErrTooManyRequests.WithDetails(details).WithCause(err)
+}
+
+// PendingMFAChallenge returns the MFA challenge of a login that is still to
+// be answered, so that the user can be offered its providers.
+func (s *Service) PendingMFAChallenge(ctx context.Context, challengeID string) (*mfa.LoginChallenge, error) {
+	challenge, err := s.mfaManager.PendingChallenge(ctx, challengeID)
+	if err != nil {
+		return nil, types.ErrMfaChallengeInvalid.WithCause(err)
+	}
+	if challenge.RiskLevel == mfa.StepUpRiskLevel {
+		return nil, types.ErrMfaChallengeInvalid
+	}
+	return challenge, nil
+}
+
+// VerifyMFAChallenge verifies the answer to the MFA challenge of a login and,
+// only if it verifies, creates a session and tokens. The user is the one the
+// challenge was issued for; a user ID in the request must match it.
 func (s *Service) VerifyMFAChallenge(ctx context.Context, req *types.VerifyMFARequest, serviceConfig Config) (*types.AuthResult, error) {
-	// In a real implementation, we would validate the challenge ID and the code.
-	// For now, we'll assume the challenge is valid and proceed with creating the session.
+	challenge, err := s.mfaManager.PendingChallenge(ctx, req.ChallengeID)
+	if err != nil {
+		return nil, types.ErrMfaChallengeInvalid.WithCause(err)
+	}
+	if (req.UserID != "" && req.UserID != challenge.UserID) || challenge.RiskLevel == mfa.StepUpRiskLevel {
+		return nil, types.ErrMfaChallengeInvalid
+	}
 
-	user, err := s.identityService.GetUserByID(ctx, req.UserID)
+	user, err := s.identityService.GetUserByID(ctx, challenge.UserID)
 	if err != nil {
 		return nil, types.ErrInvalidCredentials.WithCause(err)
 	}
+	if user.Status != types.UserStatusActive {
+		s.logAuthFailure(ctx, user.ID, "login_mfa", "user_not_active")
+		return nil, types.ErrUserDisabled
+	}
+
+	provider := req.Provider
+	if provider == "" {
+		provider = challenge.Provider
+	}
+	if _, err := s.mfaManager.Verify(ctx, req.ChallengeID, user, provider, req.Code); err != nil {
+		switch {
+		case errors.Is(err, mfa.ErrInvalidCode):
+			s.logAuthFailure(ctx, user.ID, "login_mfa", "invalid_code")
+			return nil, types.ErrMfaCodeInvalid
+		case errors.Is(err, mfa.ErrCodeReplayed):
+			s.logAuthFailure(ctx, user.ID, "login_mfa", "code_replayed")
+			return nil, types.ErrMfaCodeInvalid
+		case errors.Is(err, mfa.ErrApprovalPending):
+			return nil, types.ErrAuthorizationPending
+		case errors.Is(err, mfa.ErrApprovalDenied):
+			s.logAuthFailure(ctx, user.ID, "login_mfa", "push_denied")
+			return nil, types.ErrAccessDenied
+		case errors.Is(err, mfa.ErrTooManyAttempts):
+			s.logAuthFailure(ctx, user.ID, "login_mfa", "too_many_attempts")
+			return nil, types.ErrMfaChallengeInvalid.WithCause(err)
+		case errors.Is(err, mfa.ErrChallengeNotFound), errors.Is(err, mfa.ErrProviderNotAllowed):
+			return nil, types.ErrMfaChallengeInvalid.WithCause(err)
+		default:
+			s.logger.Error(ctx, "Failed to verify MFA challenge", zap.Error(err), zap.String("userID", user.ID))
+			return nil, types.ErrInternal.WithCause(err)
+		}
+	}
 
-	return s.createSessionAndTokens(ctx, user, serviceConfig)
+	amr := []string{mfa.AMRForProvider(provider), "mfa"}
+	acr := mfa.ACRForStrength(s.mfaManager.ProviderStrength(provider))
+	return s.createSessionAndTokens(ctx, user, "login_mfa", amr, acr, serviceConfig)
 }
 
 // createSessionAndTokens is a helper function that generates JWTs, creates a user session,
-// and constructs the final authentication response.
-func (s *Service) createSessionAndTokens(ctx context.Context, user *types.User, serviceConfig Config) (*types.AuthResult, error) {
-	accessToken, err := s.crypto.GenerateJWT(user.ID, serviceConfig.AccessTokenDuration, nil)
+// and constructs the final authentication response. The method is the one
+// recorded in the audit log.
+func (s *Service) createSessionAndTokens(ctx context.Context, user *types.User, method string, amr []string, acr string, serviceConfig Config) (*types.AuthResult, error) {
+	// The access token names its session, which step-ups are recorded
+	// against, and tells resource servers how the user authenticated.
+	sessionID := s.crypto.GenerateUUID()
+	authTime := time.Now()
+	claims := jwt.MapClaims{"sid": sessionID, "auth_time": authTime.Unix()}
+	if acr != "" {
+		claims["acr"] = acr
+	}
+	if len(amr) > 0 {
+		claims["amr"] = amr
+	}
+	accessToken, err := s.crypto.GenerateJWT(user.ID, serviceConfig.AccessTokenDuration, claims)
 	if err != nil {
 		s.logger.Error(ctx, "Failed to generate access token", zap.Error(err), zap.String("userID", user.ID))
 		return nil, types.ErrInternal.WithCause(err)
 	}
 
 	refreshToken := s.crypto.GenerateUUID()
-	if err := s.tokenRepo.StoreRefreshToken(ctx, refreshToken, user.ID, serviceConfig.RefreshTokenDuration); err != nil {
+	if err := s.tokenRepo.StoreRefreshToken(ctx, HashRefreshToken(refreshToken), user.ID, serviceConfig.RefreshTokenDuration); err != nil {
 		s.logger.Error(ctx, "Failed to store refresh token", zap.Error(err), zap.String("userID", user.ID))
 		return nil, types.ErrInternal.WithCause(err)
 	}
 
 	session := &types.UserSession{
-		ID:        s.crypto.GenerateUUID(),
-		UserID:    user.ID,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(serviceConfig.SessionDuration),
+		ID:        sessionID,
+		UserID:      user.ID,
+		CreatedAt:   authTime,
+		ExpiresAt:   authTime.Add(serviceConfig.SessionDuration),
+		AuthTime:    authTime,
+		AuthMethods: amr,
+		ACR:         acr,
 	}
 	if err := s.sessionRepo.CreateSession(ctx, session, serviceConfig.SessionDuration); err != nil {
 		s.logger.Error(ctx, "Failed to create session", zap.Error(err), zap.String("userID", user.ID))
 		return nil, types.ErrInternal.WithCause(err)
 	}
 
-	s.logAuthSuccess(ctx, user.ID, "login_password")
+	s.logAuthSuccess(ctx, user.ID, method)
 
 	return &types.AuthResult{
 		Session: session,
@@ -233,12 +572,13 @@ func (s *Service) logAuthSuccess(ctx context.Context, userID, method string) {
 // RefreshAccessToken handles the process of issuing a new access token using a refresh token.
 // It implements refresh token rotation to enhance security.
 func (s *Service) RefreshAccessToken(ctx context.Context, refreshToken string, serviceConfig Config) (*types.Token, error) {
-	userID, err := s.tokenRepo.GetRefreshTokenUserID(ctx, refreshToken)
+	tokenHash := HashRefreshToken(refreshToken)
+	userID, err := s.tokenRepo.GetRefreshTokenUserID(ctx, tokenHash)
 	if err != nil {
 		return nil, types.ErrInvalidGrant.WithCause(err)
 	}
 
-	family, err := s.tokenFamilyRepo.GetFamilyByToken(ctx, refreshToken)
+	family, err := s.tokenFamilyRepo.GetFamilyByToken(ctx, tokenHash)
 	if err != nil {
 		return nil, types.ErrInternal.WithCause(err)
 	}
@@ -255,19 +595,21 @@ func (s *Service) RefreshAccessToken(ctx context.Context, refreshToken string, s
 		return nil, types.ErrInternal.WithCause(err)
 	}
 	newRefreshToken := s.crypto.GenerateUUID()
-	if err := s.tokenRepo.StoreRefreshToken(ctx, newRefreshToken, userID, serviceConfig.RefreshTokenDuration); err != nil {
+
+	// Rotate the token family. Of several concurrent refreshes with the
+	// same token only one gets past this point.
+	if err := s.tokenFamilyRepo.RotateFamily(ctx, family.FamilyID, tokenHash, HashRefreshToken(newRefreshToken)); err != nil {
+		if errors.Is(err, types.ErrConflict) {
+			return nil, types.ErrInvalidGrant
+		}
 		return nil, types.ErrInternal.WithCause(err)
 	}
-
-	// Update the token family.
-	family.IssuedTokens = append(family.IssuedTokens, newRefreshToken)
-	family.CurrentToken = newRefreshToken
-	if err := s.tokenFamilyRepo.UpdateFamily(ctx, family); err != nil {
+	if err := s.tokenRepo.StoreRefreshToken(ctx, HashRefreshToken(newRefreshToken), userID, serviceConfig.RefreshTokenDuration); err != nil {
 		return nil, types.ErrInternal.WithCause(err)
 	}
 
 	// Revoke the old refresh token.
-	if err := s.tokenRepo.DeleteRefreshToken(ctx, refreshToken); err != nil {
+	if err := s.tokenRepo.DeleteRefreshToken(ctx, tokenHash); err != nil {
 		s.logger.Warn(ctx, "Failed to delete old refresh token", zap.Error(err))
 	}
 
@@ -282,11 +624,12 @@ func (s *Service) RefreshAccessToken(ctx context.Context, refreshToken string, s
 // RevokeToken handles the revocation of a token (either access or refresh).
 func (s *Service) RevokeToken(ctx context.Context, token, tokenTypeHint string) error {
 	if tokenTypeHint == "refresh_token" {
-		family, err := s.tokenFamilyRepo.GetFamilyByToken(ctx, token)
+		tokenHash := HashRefreshToken(token)
+		family, err := s.tokenFamilyRepo.GetFamilyByToken(ctx, tokenHash)
 		if err == nil && family != nil {
 			return s.tokenFamilyRepo.RevokeFamily(ctx, family.FamilyID)
 		}
-		return s.tokenRepo.DeleteRefreshToken(ctx, token)
+		return s.tokenRepo.DeleteRefreshToken(ctx, tokenHash)
 	}
 
 	claims, err := s.crypto.ValidateJWT(token)
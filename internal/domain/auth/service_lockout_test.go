@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+func TestLoginWithPassword_LocksAccountAfterFailures(t *testing.T) {
+	// Arrange
+	mockIdentityService := new(identity.MockIService)
+	mockAuditRepo := new(MockAuditLogRepository)
+	mockLogger := new(utils.MockLogger)
+	mockCrypto := new(utils.MockCryptoManager)
+
+	service := NewService(mockIdentityService, nil, nil, mockAuditRepo, nil, mockCrypto, mockLogger, nil, nil, nil, nil, nil)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()}))
+	service.SetLockoutTracker(lockout.NewTracker(client, lockout.Config{MaxFailures: 2, ThrottleAfter: 100}, zap.NewNop()))
+
+	user := &types.User{ID: "user1", Username: "test", Password: "hashed_password", Status: types.UserStatusActive}
+	mockIdentityService.On("GetUserByUsername", mock.Anything, "test").Return(user, nil)
+	mockCrypto.On("CheckPasswordHash", "wrong", "hashed_password").Return(false)
+	mockCrypto.On("GenerateUUID").Return("log-id")
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+
+	// Act
+	for i := 0; i < 2; i++ {
+		_, err := service.LoginWithPassword(context.Background(), AuthnRequest{Username: "test", Password: "wrong", IPAddress: "10.0.0.1:1234"}, Config{})
+		assert.ErrorIs(t, err, types.ErrInvalidCredentials)
+	}
+	_, err := service.LoginWithPassword(context.Background(), AuthnRequest{Username: "test", Password: "password", IPAddress: "10.0.0.1:1234"}, Config{})
+
+	// Assert
+	require.ErrorIs(t, err, types.ErrUserLocked)
+	assert.NotEmpty(t, types.ErrUserLocked.Details["retry_after"])
+	mockIdentityService.AssertNumberOfCalls(t, "GetUserByUsername", 2)
+}
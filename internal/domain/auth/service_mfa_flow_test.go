@@ -2,12 +2,25 @@ package auth
 
 import (
 	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pquerna/otp/totp"
+	goredis "github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/config"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/security/automator"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
-	"testing"
+	"go.uber.org/zap"
 )
 
 // MockRiskEngine is a mock implementation of the RiskEngine interface for testing.
@@ -46,6 +59,7 @@ func TestLoginWithPassword_NoMFAForLowRisk(t *testing.T) {
 	user := &types.User{ID: "user1", Username: "test", Password: "hashed_password", Status: types.UserStatusActive}
 	mockIdentityService.On("GetUserByUsername", mock.Anything, "test").Return(user, nil)
 	mockCrypto.On("CheckPasswordHash", "password", "hashed_password").Return(true)
+	mockCrypto.On("NeedsRehash", "hashed_password").Return(false)
 	mockRiskEngine.On("Evaluate", mock.Anything, mock.Anything).Return(RiskScore(0.2), RiskLevelLow, nil)
 	mockPolicyEngine.On("Decide", RiskLevelLow, mock.Anything).Return("ALLOW")
 	mockCrypto.On("GenerateJWT", mock.Anything, mock.Anything, mock.Anything).Return("access_token", nil)
@@ -63,6 +77,67 @@ func TestLoginWithPassword_NoMFAForLowRisk(t *testing.T) {
 	assert.NotNil(t, authResult.Token)
 }
 
+// recordingAction is a security action that remembers what it was run for.
+type recordingAction struct {
+	input *automator.ActionInput
+}
+
+func (a *recordingAction) ID() string { return "record" }
+
+func (a *recordingAction) Execute(ctx context.Context, input automator.ActionInput) error {
+	a.input = &input
+	return nil
+}
+
+func TestLoginWithPassword_BlockedBySecurityPolicy(t *testing.T) {
+	mockIdentityService := new(identity.MockIService)
+	mockAuditRepo := new(MockAuditLogRepository)
+	mockRiskEngine := new(MockRiskEngine)
+	mockCrypto := new(utils.MockCryptoManager)
+	service := NewService(mockIdentityService, new(MockSessionRepository), new(MockTokenRepository), mockAuditRepo, nil, mockCrypto, utils.NewZapLoggerWrapper(zap.NewNop()), mockRiskEngine, new(MockPolicyEngine), nil, nil, nil)
+
+	engine := automator.NewEngine(&config.SecurityConfig{ResponsePolicies: []config.ResponsePolicy{
+		{Name: "Block high risk", RiskThreshold: 0.9, ActionIDs: []string{"record"}, IsBlocking: true},
+	}}, zap.NewNop())
+	action := &recordingAction{}
+	engine.RegisterAction(action)
+	service.SetSecurityAutomator(engine)
+
+	user := &types.User{ID: "user1", Username: "test", Password: "hashed_password", Status: types.UserStatusActive}
+	mockIdentityService.On("GetUserByUsername", mock.Anything, "test").Return(user, nil)
+	mockCrypto.On("CheckPasswordHash", "password", "hashed_password").Return(true)
+	mockCrypto.On("NeedsRehash", "hashed_password").Return(false)
+	mockCrypto.On("GenerateUUID").Return("audit-id")
+	mockRiskEngine.On("Evaluate", mock.Anything, mock.Anything).Return(RiskScore(0.95), RiskLevelHigh, nil)
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+
+	_, err := service.LoginWithPassword(context.Background(), AuthnRequest{Username: "test", Password: "password", IPAddress: "203.0.113.7"}, Config{})
+	assert.ErrorIs(t, err, types.ErrForbidden)
+	require.NotNil(t, action.input)
+	assert.Equal(t, "user1", action.input.UserID)
+	assert.Equal(t, "203.0.113.7", action.input.IP)
+	assert.Equal(t, 0.95, action.input.RiskScore)
+}
+
+// newTOTPManager returns an MFA manager backed by miniredis and a user with an
+// enrolled TOTP factor, and the factor's secret.
+func newTOTPManager(t *testing.T) (*mfa.MFAManager, *types.User, string) {
+	repo := memory.NewMFAFactorMemoryRepository()
+	provider := mfa.NewTOTPProvider(repo, utils.NewCryptoManager("test-secret"))
+	user := &types.User{ID: "550e8400-e29b-41d4-a716-446655440000", Username: "test", Password: "hashed_password", Status: types.UserStatusActive}
+
+	enrollment, err := provider.Enroll(context.Background(), user)
+	require.NoError(t, err)
+	factors, err := repo.GetMFAFactorsByUserID(context.Background(), user.ID)
+	require.NoError(t, err)
+	factors[0].Status = "enrolled"
+
+	manager := mfa.NewMFAManager()
+	manager.RegisterProvider("totp", provider)
+	manager.SetChallengeStore(redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()})), mfa.ChallengeConfig{})
+	return manager, user, enrollment.Secret
+}
+
 func TestLoginWithPassword_ReturnMFAChallengeForMediumRisk(t *testing.T) {
 	// Arrange
 	mockIdentityService := new(identity.MockIService)
@@ -70,12 +145,13 @@ func TestLoginWithPassword_ReturnMFAChallengeForMediumRisk(t *testing.T) {
 	mockPolicyEngine := new(MockPolicyEngine)
 	mockLogger := new(utils.MockLogger)
 	mockCrypto := new(utils.MockCryptoManager)
+	mfaManager, user, _ := newTOTPManager(t)
 
-	service := NewService(mockIdentityService, nil, nil, nil, nil, mockCrypto, mockLogger, mockRiskEngine, mockPolicyEngine, nil, nil, nil)
+	service := NewService(mockIdentityService, nil, nil, nil, nil, mockCrypto, mockLogger, mockRiskEngine, mockPolicyEngine, mfaManager, nil, nil)
 
-	user := &types.User{ID: "user1", Username: "test", Password: "hashed_password", Status: types.UserStatusActive}
 	mockIdentityService.On("GetUserByUsername", mock.Anything, "test").Return(user, nil)
 	mockCrypto.On("CheckPasswordHash", "password", "hashed_password").Return(true)
+	mockCrypto.On("NeedsRehash", "hashed_password").Return(false)
 	mockRiskEngine.On("Evaluate", mock.Anything, mock.Anything).Return(RiskScore(0.6), RiskLevelMedium, nil)
 	mockPolicyEngine.On("Decide", RiskLevelMedium, mock.Anything).Return("REQUIRE_MFA")
 
@@ -85,7 +161,14 @@ func TestLoginWithPassword_ReturnMFAChallengeForMediumRisk(t *testing.T) {
 	// Assert
 	assert.NoError(t, err)
 	assert.True(t, authResult.IsMfaRequired)
-	assert.NotNil(t, authResult.MFAChallenge)
+	assert.Nil(t, authResult.Token)
+	require.NotNil(t, authResult.MFAChallenge)
+	assert.Equal(t, types.AuthMethod("totp"), authResult.MFAChallenge.MFAProvider)
+
+	challenge, err := mfaManager.PendingChallenge(context.Background(), authResult.MFAChallenge.ChallengeID)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, challenge.UserID)
+	assert.Equal(t, string(RiskLevelMedium), challenge.RiskLevel)
 }
 
 func TestVerifyMFAChallenge_SuccessCreatesSessionAndTokens(t *testing.T) {
@@ -96,22 +179,96 @@ func TestVerifyMFAChallenge_SuccessCreatesSessionAndTokens(t *testing.T) {
 	mockAuditRepo := new(MockAuditLogRepository)
 	mockLogger := new(utils.MockLogger)
 	mockCrypto := new(utils.MockCryptoManager)
+	mfaManager, user, secret := newTOTPManager(t)
 
-	service := NewService(mockIdentityService, mockSessionRepo, mockTokenRepo, mockAuditRepo, nil, mockCrypto, mockLogger, nil, nil, nil, nil, nil)
+	service := NewService(mockIdentityService, mockSessionRepo, mockTokenRepo, mockAuditRepo, nil, mockCrypto, mockLogger, nil, nil, mfaManager, nil, nil)
 
-	user := &types.User{ID: "user1", Username: "test"}
-	mockIdentityService.On("GetUserByID", mock.Anything, "user1").Return(user, nil)
+	mockIdentityService.On("GetUserByID", mock.Anything, user.ID).Return(user, nil)
 	mockCrypto.On("GenerateJWT", mock.Anything, mock.Anything, mock.Anything).Return("access_token", nil)
 	mockCrypto.On("GenerateUUID").Return("refresh_token")
 	mockSessionRepo.On("CreateSession", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	mockTokenRepo.On("StoreRefreshToken", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
 
+	challenge, err := mfaManager.Challenge(context.Background(), user, string(RiskLevelMedium), "")
+	require.NoError(t, err)
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+
 	// Act
-	authResult, err := service.VerifyMFAChallenge(context.Background(), &types.VerifyMFARequest{UserID: "user1", Code: "123456"}, Config{})
+	authResult, err := service.VerifyMFAChallenge(context.Background(), &types.VerifyMFARequest{ChallengeID: challenge.ChallengeID, Code: code}, Config{})
 
 	// Assert
 	assert.NoError(t, err)
 	assert.False(t, authResult.IsMfaRequired)
 	assert.NotNil(t, authResult.Token)
+	assert.Equal(t, []string{"otp", "mfa"}, authResult.Session.AuthMethods)
+	assert.Equal(t, mfa.ACRMFA, authResult.Session.ACR)
+	// The access token reports how the user authenticated.
+	mockCrypto.AssertCalled(t, "GenerateJWT", user.ID, mock.Anything, mock.MatchedBy(func(claims jwt.MapClaims) bool {
+		amr, _ := claims["amr"].([]string)
+		return claims["acr"] == mfa.ACRMFA && len(amr) == 2 && amr[0] == "otp" && claims["sid"] == authResult.Session.ID
+	}))
+
+	// The challenge can be answered only once.
+	_, err = service.VerifyMFAChallenge(context.Background(), &types.VerifyMFARequest{ChallengeID: challenge.ChallengeID, Code: code}, Config{})
+	assert.ErrorIs(t, err, types.ErrMfaChallengeInvalid)
+}
+
+func TestLoginWithPassword_StepsUpToRequestedACR(t *testing.T) {
+	mockIdentityService := new(identity.MockIService)
+	mockRiskEngine := new(MockRiskEngine)
+	mockPolicyEngine := new(MockPolicyEngine)
+	mockAuditRepo := new(MockAuditLogRepository)
+	mockCrypto := new(utils.MockCryptoManager)
+	mfaManager, user, _ := newTOTPManager(t)
+
+	service := NewService(mockIdentityService, nil, nil, mockAuditRepo, nil, mockCrypto, new(utils.MockLogger), mockRiskEngine, mockPolicyEngine, mfaManager, nil, nil)
+
+	mockIdentityService.On("GetUserByUsername", mock.Anything, "test").Return(user, nil)
+	mockCrypto.On("CheckPasswordHash", "password", "hashed_password").Return(true)
+	mockCrypto.On("NeedsRehash", "hashed_password").Return(false)
+	mockRiskEngine.On("Evaluate", mock.Anything, mock.Anything).Return(RiskScore(0.1), RiskLevelLow, nil)
+	mockPolicyEngine.On("Decide", RiskLevelLow, mock.Anything).Return("ALLOW")
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+	mockCrypto.On("GenerateUUID").Return("log-id")
+
+	// A low-risk login needs no MFA, but the application asked for it.
+	authResult, err := service.LoginWithPassword(context.Background(), AuthnRequest{Username: "test", Password: "password", ACRValues: []string{mfa.ACRMFA}}, Config{})
+	require.NoError(t, err)
+	assert.True(t, authResult.IsMfaRequired)
+	require.NotNil(t, authResult.MFAChallenge)
+	assert.Equal(t, types.AuthMethod("totp"), authResult.MFAChallenge.MFAProvider)
+
+	// TOTP cannot reach a phishing-resistant login.
+	_, err = service.LoginWithPassword(context.Background(), AuthnRequest{Username: "test", Password: "password", ACRValues: []string{mfa.ACRPhishingResistant}}, Config{})
+	assert.ErrorIs(t, err, types.ErrMfaRequired)
+}
+
+func TestVerifyMFAChallenge_RejectsWithoutValidCode(t *testing.T) {
+	// Arrange
+	mockIdentityService := new(identity.MockIService)
+	mockAuditRepo := new(MockAuditLogRepository)
+	mockLogger := new(utils.MockLogger)
+	mockCrypto := new(utils.MockCryptoManager)
+	mfaManager, user, _ := newTOTPManager(t)
+
+	service := NewService(mockIdentityService, nil, nil, mockAuditRepo, nil, mockCrypto, mockLogger, nil, nil, mfaManager, nil, nil)
+
+	mockIdentityService.On("GetUserByID", mock.Anything, user.ID).Return(user, nil)
+	mockCrypto.On("GenerateUUID").Return("log-id")
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+
+	challenge, err := mfaManager.Challenge(context.Background(), user, string(RiskLevelHigh), "")
+	require.NoError(t, err)
+
+	// Act & Assert
+	_, err = service.VerifyMFAChallenge(context.Background(), &types.VerifyMFARequest{UserID: user.ID, Code: "123456"}, Config{})
+	assert.ErrorIs(t, err, types.ErrMfaChallengeInvalid, "a code without a challenge issues no tokens")
+
+	_, err = service.VerifyMFAChallenge(context.Background(), &types.VerifyMFARequest{ChallengeID: challenge.ChallengeID, UserID: "someone-else", Code: "123456"}, Config{})
+	assert.ErrorIs(t, err, types.ErrMfaChallengeInvalid)
+
+	_, err = service.VerifyMFAChallenge(context.Background(), &types.VerifyMFARequest{ChallengeID: challenge.ChallengeID, Code: "000000"}, Config{})
+	assert.ErrorIs(t, err, types.ErrMfaCodeInvalid)
 }
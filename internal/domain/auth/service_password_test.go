@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+func TestLoginWithPassword_ExpiredPasswordMustBeChanged(t *testing.T) {
+	// Arrange
+	mockIdentityService := new(identity.MockIService)
+	mockAuditRepo := new(MockAuditLogRepository)
+	crypto := utils.NewCryptoManager("test-secret")
+
+	service := NewService(mockIdentityService, nil, nil, mockAuditRepo, nil, crypto, new(utils.MockLogger), nil, nil, nil, nil, nil)
+	service.SetPasswordPolicy(passwordpolicy.NewEngine(passwordpolicy.Config{
+		Default: passwordpolicy.Policy{MinLength: 12, MaxAge: 90 * 24 * time.Hour},
+	}, crypto, zap.NewNop()))
+
+	hash, err := crypto.HashPassword("old-password")
+	require.NoError(t, err)
+	user := &types.User{
+		ID:         "user1",
+		Username:   "test",
+		Password:   hash,
+		Status:     types.UserStatusActive,
+		Attributes: map[string]interface{}{passwordpolicy.AttrChangedAt: time.Now().Add(-100 * 24 * time.Hour).Format(time.RFC3339)},
+	}
+	mockIdentityService.On("GetUserByUsername", mock.Anything, "test").Return(user, nil)
+	mockIdentityService.On("UpdateUser", mock.Anything, user).Return(nil)
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+
+	// Act & Assert
+	_, err = service.LoginWithPassword(context.Background(), AuthnRequest{Username: "test", Password: "old-password"}, Config{})
+	require.ErrorIs(t, err, types.ErrPasswordExpired)
+
+	err = service.ChangePassword(context.Background(), ChangePasswordRequest{Username: "test", CurrentPassword: "wrong", NewPassword: "a-brand-new-password"})
+	assert.ErrorIs(t, err, types.ErrInvalidCredentials)
+
+	err = service.ChangePassword(context.Background(), ChangePasswordRequest{Username: "test", CurrentPassword: "old-password", NewPassword: "short"})
+	assert.ErrorIs(t, err, types.ErrPasswordPolicy)
+
+	err = service.ChangePassword(context.Background(), ChangePasswordRequest{Username: "test", CurrentPassword: "old-password", NewPassword: "a-brand-new-password"})
+	require.NoError(t, err)
+	assert.True(t, crypto.CheckPasswordHash("a-brand-new-password", user.Password))
+	mockIdentityService.AssertCalled(t, "UpdateUser", mock.Anything, user)
+}
+
+type recordingRevoker struct {
+	revoked []string
+}
+
+func (r *recordingRevoker) RevokeAllUserSessions(ctx context.Context, userID string) error {
+	r.revoked = append(r.revoked, userID)
+	return nil
+}
+
+func TestChangePassword_NeedsSteppedUpSession(t *testing.T) {
+	// Arrange
+	mockIdentityService := new(identity.MockIService)
+	mockAuditRepo := new(MockAuditLogRepository)
+	crypto := utils.NewCryptoManager("test-secret")
+	mfaManager, user, secret := newTOTPManager(t)
+	revoker := &recordingRevoker{}
+
+	service := NewService(mockIdentityService, nil, nil, mockAuditRepo, nil, crypto, new(utils.MockLogger), nil, nil, mfaManager, nil, nil)
+	service.SetSessionRevoker(revoker)
+
+	hash, err := crypto.HashPassword("old-password")
+	require.NoError(t, err)
+	user.Password = hash
+	mockIdentityService.On("GetUserByUsername", mock.Anything, "test").Return(user, nil)
+	mockIdentityService.On("GetUserByID", mock.Anything, user.ID).Return(user, nil)
+	mockIdentityService.On("UpdateUser", mock.Anything, user).Return(nil)
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+	ctx := context.Background()
+	req := ChangePasswordRequest{Username: "test", CurrentPassword: "old-password", NewPassword: "a-brand-new-password"}
+
+	// Act & Assert
+	// The current password alone does not change a password that has not expired.
+	assert.ErrorIs(t, service.ChangePassword(ctx, req), types.ErrUnauthorized)
+
+	other := req
+	other.UserID, other.SessionID = "someone-else", "session-2"
+	assert.ErrorIs(t, service.ChangePassword(ctx, other), types.ErrUnauthorized)
+
+	req.UserID, req.SessionID = user.ID, "session-1"
+	assert.ErrorIs(t, service.ChangePassword(ctx, req), types.ErrStepUpRequired)
+	assert.True(t, crypto.CheckPasswordHash("old-password", user.Password))
+	assert.Empty(t, revoker.revoked)
+
+	challenge, err := service.BeginMFAStepUp(ctx, user.ID, "totp")
+	require.NoError(t, err)
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, service.CompleteMFAStepUp(ctx, user.ID, req.SessionID, &types.VerifyMFARequest{ChallengeID: challenge.ChallengeID, Provider: "totp", Code: code}))
+
+	require.NoError(t, service.ChangePassword(ctx, req))
+	assert.True(t, crypto.CheckPasswordHash("a-brand-new-password", user.Password))
+	assert.Equal(t, []string{user.ID}, revoker.revoked)
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/auth/passwordless"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/notification"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+type recordingNotifier struct {
+	sent []notification.Message
+}
+
+func (n *recordingNotifier) Send(ctx context.Context, msg notification.Message) error {
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+func (n *recordingNotifier) Type() string {
+	return "email"
+}
+
+func TestPasswordless_CodeLoginRunsThroughRiskEngine(t *testing.T) {
+	ctx := context.Background()
+	user := &types.User{Username: "test", Email: "test@example.com", Status: types.UserStatusActive}
+	repo := memory.NewIdentityMemoryRepository()
+	require.NoError(t, repo.CreateUser(ctx, user))
+	logger := utils.NewZapLoggerWrapper(zap.NewNop())
+
+	mockSessionRepo := new(MockSessionRepository)
+	mockTokenRepo := new(MockTokenRepository)
+	mockAuditRepo := new(MockAuditLogRepository)
+	mockRiskEngine := new(MockRiskEngine)
+	mockPolicyEngine := new(MockPolicyEngine)
+	mockCrypto := new(utils.MockCryptoManager)
+	service := NewService(identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), logger), mockSessionRepo, mockTokenRepo, mockAuditRepo, nil, mockCrypto, logger, mockRiskEngine, mockPolicyEngine, nil, nil, nil)
+	notifier := &recordingNotifier{}
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()}))
+	service.SetPasswordless(passwordless.NewService(client, notification.NewManager(notifier), passwordless.Config{SigningKey: []byte("k")}, zap.NewNop()))
+
+	mockRiskEngine.On("Evaluate", mock.Anything, mock.MatchedBy(func(ac AuthContext) bool {
+		return ac.UserID == user.ID && ac.IPAddress == "10.0.0.1:4000"
+	})).Return(RiskScore(0.2), RiskLevelLow, nil)
+	mockPolicyEngine.On("Decide", RiskLevelLow, mock.Anything).Return("ALLOW")
+	mockCrypto.On("GenerateJWT", user.ID, mock.Anything, mock.Anything).Return("access_token", nil)
+	mockCrypto.On("GenerateUUID").Return("refresh_token")
+	mockSessionRepo.On("CreateSession", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockTokenRepo.On("StoreRefreshToken", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockAuditRepo.On("CreateLogEntry", mock.Anything, mock.Anything).Return(nil)
+
+	start, err := service.StartPasswordless(ctx, PasswordlessStartRequest{Email: "test@example.com", Method: "code", IPAddress: "10.0.0.1:4000"})
+	require.NoError(t, err)
+	require.Len(t, notifier.sent, 1)
+	code := regexp.MustCompile(`<strong>(\d+)</strong>`).FindStringSubmatch(notifier.sent[0].Body)[1]
+
+	_, err = service.CompletePasswordless(ctx, PasswordlessCompleteRequest{FlowID: start.FlowID, Code: "wrong"}, Config{})
+	assert.ErrorIs(t, err, types.ErrInvalidCredentials)
+
+	result, err := service.CompletePasswordless(ctx, PasswordlessCompleteRequest{FlowID: start.FlowID, Code: code, IPAddress: "10.0.0.1:4000"}, Config{})
+	require.NoError(t, err)
+	assert.False(t, result.IsMfaRequired)
+	require.NotNil(t, result.Token)
+	assert.Equal(t, "access_token", result.Token.AccessToken)
+	mockRiskEngine.AssertExpectations(t)
+
+	// Unknown addresses get a flow all the same, but no email.
+	start, err = service.StartPasswordless(ctx, PasswordlessStartRequest{Email: "nobody@example.com"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, start.FlowID)
+	assert.Len(t, notifier.sent, 1)
+}
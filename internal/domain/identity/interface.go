@@ -2,6 +2,7 @@ package identity
 
 import (
 	"context"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 	"github.com/turtacn/QuantaID/pkg/types"
 )
 
@@ -22,6 +23,8 @@ type IService interface {
 	GetUserGroups(ctx context.Context, userID string) ([]*types.UserGroup, error)
 	// AddUserToGroup adds a user to a specified group.
 	AddUserToGroup(ctx context.Context, userID, groupID string) error
+	// RemoveUserFromGroup removes a user from a group.
+	RemoveUserFromGroup(ctx context.Context, userID, groupID string) error
 	// ChangeUserStatus updates the status of a user's account (e.g., active, locked).
 	ChangeUserStatus(ctx context.Context, userID string, newStatus types.UserStatus) error
 	// UpdateUser updates an existing user's details.
@@ -40,4 +43,7 @@ type IService interface {
 	UpdateGroup(ctx context.Context, group *types.UserGroup) error
 	DeleteGroup(ctx context.Context, groupID string) error
 	ListGroups(ctx context.Context, offset, limit int) ([]*types.UserGroup, error)
+
+	// SetPasswordPolicy sets the policy new passwords are validated against.
+	SetPasswordPolicy(engine *passwordpolicy.Engine)
 }
@@ -3,6 +3,7 @@ package identity
 import (
 	"context"
 	"github.com/stretchr/testify/mock"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 	"github.com/turtacn/QuantaID/pkg/types"
 )
 
@@ -40,6 +41,11 @@ func (m *MockIService) AddUserToGroup(ctx context.Context, userID, groupID strin
 	return args.Error(0)
 }
 
+func (m *MockIService) RemoveUserFromGroup(ctx context.Context, userID, groupID string) error {
+	args := m.Called(ctx, userID, groupID)
+	return args.Error(0)
+}
+
 func (m *MockIService) ChangeUserStatus(ctx context.Context, userID string, newStatus types.UserStatus) error {
 	args := m.Called(ctx, userID, newStatus)
 	return args.Error(0)
@@ -93,3 +99,5 @@ func (m *MockIService) ListGroups(ctx context.Context, offset, limit int) ([]*ty
 func (m *MockIService) GetUserRepo() UserRepository {
 	return nil
 }
+
+func (m *MockIService) SetPasswordPolicy(engine *passwordpolicy.Engine) {}
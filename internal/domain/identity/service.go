@@ -3,6 +3,7 @@ package identity
 import (
 	"context"
 	"errors"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 	pkg_types "github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 	"go.uber.org/zap"
@@ -15,6 +16,7 @@ type service struct {
 	groupRepo GroupRepository
 	crypto    *utils.CryptoManager
 	logger    utils.Logger
+	passwords *passwordpolicy.Engine
 }
 
 // NewService creates a new identity service instance.
@@ -38,9 +40,16 @@ func NewService(userRepo UserRepository, groupRepo GroupRepository, crypto *util
 	}
 }
 
+// SetPasswordPolicy sets the policy passwords are validated against when
+// they are set.
+func (s *service) SetPasswordPolicy(engine *passwordpolicy.Engine) {
+	s.passwords = engine
+}
+
 // CreateUser handles the business logic for creating a new user.
 // It validates input, checks for existing users with the same username or email,
-// hashes the password, and persists the new user to the repository.
+// checks the password against the password policy and hashes it, and persists
+// the new user to the repository.
 //
 // Parameters:
 //   - ctx: The context for the request.
@@ -71,19 +80,24 @@ func (s *service) CreateUser(ctx context.Context, username, email, password stri
 		return nil, pkg_types.ErrInternal.WithCause(err)
 	}
 
-	hashedPassword, err := s.crypto.HashPassword(password)
-	if err != nil {
-		s.logger.Error(ctx, "Failed to hash password", zap.Error(err))
-		return nil, pkg_types.ErrInternal.WithCause(err)
-	}
-
 	user := &pkg_types.User{
 		ID:       s.crypto.GenerateUUID(),
 		Username: username,
 		Email:    pkg_types.EncryptedString(email),
-		Password: hashedPassword,
 		Status:   pkg_types.UserStatusActive,
 	}
+	if s.passwords != nil {
+		if err := s.passwords.SetPassword(ctx, user, password); err != nil {
+			return nil, err
+		}
+	} else {
+		hashedPassword, err := s.crypto.HashPassword(password)
+		if err != nil {
+			s.logger.Error(ctx, "Failed to hash password", zap.Error(err))
+			return nil, pkg_types.ErrInternal.WithCause(err)
+		}
+		user.Password = hashedPassword
+	}
 
 	if err := s.userRepo.CreateUser(ctx, user); err != nil {
 		s.logger.Error(ctx, "Failed to create user in repository", zap.Error(err))
@@ -199,6 +213,16 @@ func (s *service) AddUserToGroup(ctx context.Context, userID, groupID string) er
 	return nil
 }
 
+// RemoveUserFromGroup removes the membership link between a user and a group.
+func (s *service) RemoveUserFromGroup(ctx context.Context, userID, groupID string) error {
+	if err := s.groupRepo.RemoveUserFromGroup(ctx, userID, groupID); err != nil {
+		s.logger.Error(ctx, "Failed to remove user from group", zap.Error(err), zap.String("userID", userID), zap.String("groupID", groupID))
+		return pkg_types.ErrInternal.WithCause(err)
+	}
+	s.logger.Info(ctx, "User removed from group", zap.String("userID", userID), zap.String("groupID", groupID))
+	return nil
+}
+
 // ChangeUserStatus updates the status of a user's account.
 //
 // Parameters:
@@ -224,7 +248,8 @@ func (s *service) ChangeUserStatus(ctx context.Context, userID string, newStatus
 	return nil
 }
 
-// UpdateUser updates an existing user's details.
+// UpdateUser updates an existing user's details. A changed email address
+// is no longer verified.
 //
 // Parameters:
 //   - ctx: The context for the request.
@@ -233,6 +258,12 @@ func (s *service) ChangeUserStatus(ctx context.Context, userID string, newStatus
 // Returns:
 //   An error if the update fails.
 func (s *service) UpdateUser(ctx context.Context, user *pkg_types.User) error {
+	if user.IsEmailVerified() {
+		if current, err := s.userRepo.GetUserByID(ctx, user.ID); err == nil && current.Email != user.Email {
+			user.EmailVerified = false
+			delete(user.Attributes, "email_verified")
+		}
+	}
 	if err := s.userRepo.UpdateUser(ctx, user); err != nil {
 		s.logger.Error(ctx, "Failed to update user", zap.Error(err), zap.String("userID", user.ID))
 		return pkg_types.ErrInternal.WithCause(err)
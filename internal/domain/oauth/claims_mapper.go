@@ -32,6 +32,48 @@ type Condition struct {
 // TransformFunc is a function that transforms a claim value.
 type TransformFunc func(value interface{}) (interface{}, error)
 
+// DefaultMappingRules returns the standard OpenID Connect scope to claim
+// mapping (OpenID Connect Core 1.0, section 5.4).
+func DefaultMappingRules() []MappingRule {
+	return []MappingRule{
+		{Scope: "profile", Claims: []string{
+			"name", "family_name", "given_name", "middle_name", "nickname", "preferred_username",
+			"profile", "picture", "website", "gender", "birthdate", "zoneinfo", "locale", "updated_at",
+		}},
+		{Scope: "email", Claims: []string{"email", "email_verified"}},
+		{Scope: "address", Claims: []string{"address"}},
+		{Scope: "phone", Claims: []string{"phone_number", "phone_number_verified"}},
+	}
+}
+
+// Scopes returns the scopes the mapper has rules for, in rule order.
+func (m *ClaimsMapper) Scopes() []string {
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, rule := range m.rules {
+		if !seen[rule.Scope] {
+			seen[rule.Scope] = true
+			scopes = append(scopes, rule.Scope)
+		}
+	}
+	return scopes
+}
+
+// Claims returns every claim name the mapper can release, in rule order.
+func (m *ClaimsMapper) Claims() []string {
+	var claims []string
+	seen := make(map[string]bool)
+	for _, rule := range m.rules {
+		for _, c := range rule.Claims {
+			if !seen[c] {
+				seen[c] = true
+				claims = append(claims, c)
+			}
+		}
+	}
+	return claims
+}
+
 // NewClaimsMapper creates a new ClaimsMapper.
 func NewClaimsMapper(rules []MappingRule) *ClaimsMapper {
 	mapper := &ClaimsMapper{
@@ -54,6 +96,10 @@ func (m *ClaimsMapper) MapClaims(ctx context.Context, user *types.User, scopes [
 
 			for _, claimName := range rule.Claims {
 				value := m.extractUserAttribute(user, claimName)
+				if value == nil {
+					// Claims the user has no value for are omitted rather than released as null.
+					continue
+				}
 
 				if transformName, ok := rule.Transforms[claimName]; ok {
 					if transformFunc, exists := m.transforms[transformName]; exists {
@@ -88,13 +134,35 @@ func (m *ClaimsMapper) evaluateConditions(user *types.User, conditions []Conditi
 	return true
 }
 
+// extractUserAttribute resolves a claim from the user's core fields, falling
+// back to the custom attribute of the same name.
 func (m *ClaimsMapper) extractUserAttribute(user *types.User, claimName string) interface{} {
-	// TODO: Implement logic to extract user attributes, including nested ones.
 	switch claimName {
 	case "email":
+		if user.Email == "" {
+			return nil
+		}
 		return user.Email
-	case "username":
+	case "email_verified":
+		if user.Email == "" {
+			return nil
+		}
+		return user.IsEmailVerified()
+	case "username", "preferred_username":
 		return user.Username
+	case "phone_number":
+		if user.Phone == "" {
+			return nil
+		}
+		return user.Phone
+	case "updated_at":
+		if user.UpdatedAt.IsZero() {
+			return nil
+		}
+		return user.UpdatedAt.Unix()
+	}
+	if v, ok := user.Attributes[claimName]; ok {
+		return v
 	}
 	return nil
 }
@@ -54,3 +54,25 @@ func TestClaimsMapper_TransformFunction(t *testing.T) {
 	// Usually claims in JWT are strings.
 	assert.Equal(t, types.EncryptedString("t***@example.com"), claims["email"])
 }
+
+func TestClaimsMapper_EmailVerified(t *testing.T) {
+	mapper := NewClaimsMapper(DefaultMappingRules())
+	tests := []struct {
+		name string
+		user *types.User
+		want interface{}
+	}{
+		{"verified", &types.User{Email: "a@example.com", EmailVerified: true}, true},
+		{"unverified", &types.User{Email: "a@example.com"}, false},
+		{"verified before the column", &types.User{Email: "a@example.com", Attributes: map[string]interface{}{"email_verified": true}}, true},
+		{"no email", &types.User{EmailVerified: true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.user.ID = "user123"
+			claims, err := mapper.MapClaims(context.Background(), tt.user, []string{"email"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, claims["email_verified"])
+		})
+	}
+}
@@ -2,71 +2,597 @@ package oauth
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/turtacn/QuantaID/pkg/types"
+	"gopkg.in/square/go-jose.v2"
 )
 
-// ClientRegistry handles dynamic client registration.
+// Token endpoint authentication methods a client may register.
+const (
+	AuthMethodNone              = "none"
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodPrivateKeyJWT     = "private_key_jwt"
+)
+
+// ProtocolConfig keys used for dynamically registered clients, besides the
+// client metadata itself.
+const (
+	registrationTokenHashKey = "registration_access_token_hash"
+	clientIDIssuedAtKey      = "client_id_issued_at"
+)
+
+// ClientSecretHashKey is the ProtocolConfig key holding the hash of a
+// registered client's secret. The secret itself is only returned to the
+// client when it is issued.
+const ClientSecretHashKey = "client_secret_hash"
+
+// errUntrustedSoftwareStatement is returned for software statements signed by
+// a key that is not among the trusted publisher keys.
+var errUntrustedSoftwareStatement = errors.New("no trusted key matches the software statement")
+
+// ClientRegistry handles dynamic client registration (RFC 7591) and the
+// management of registered clients (RFC 7592). Clients are stored as
+// applications, with their metadata in the application's ProtocolConfig.
 type ClientRegistry struct {
-	repo   ClientRepository
+	repo   types.ApplicationRepository
 	config ClientRegistryConfig
+	keys   *jose.JSONWebKeySet
 }
 
 // ClientRegistryConfig holds the configuration for client registration.
 type ClientRegistryConfig struct {
+	// Enabled exposes the registration endpoint.
+	Enabled bool `yaml:"enabled" mapstructure:"enabled"`
 	// DefaultGrantTypes is a list of grant types assigned to new clients if not specified.
-	DefaultGrantTypes []string `yaml:"defaultGrantTypes"`
+	DefaultGrantTypes []string `yaml:"defaultGrantTypes" mapstructure:"default_grant_types"`
 	// DefaultResponseTypes is a list of response types assigned to new clients if not specified.
-	DefaultResponseTypes []string `yaml:"defaultResponseTypes"`
+	DefaultResponseTypes []string `yaml:"defaultResponseTypes" mapstructure:"default_response_types"`
 	// DefaultScopes is a list of scopes assigned to new clients if not specified.
-	DefaultScopes []string `yaml:"defaultScopes"`
+	DefaultScopes []string `yaml:"defaultScopes" mapstructure:"default_scopes"`
+	// AllowedGrantTypes limits the grant types clients may register.
+	AllowedGrantTypes []string `yaml:"allowedGrantTypes" mapstructure:"allowed_grant_types"`
+	// AllowedScopes, when set, limits the scopes clients may register.
+	AllowedScopes []string `yaml:"allowedScopes" mapstructure:"allowed_scopes"`
+	// AllowHTTPRedirectURIs permits plain http redirect URIs on any host.
+	// Without it, http is only accepted for loopback addresses.
+	AllowHTTPRedirectURIs bool `yaml:"allowHttpRedirectUris" mapstructure:"allow_http_redirect_uris"`
+	// InitialAccessTokens are the bearer tokens that authorize a caller to
+	// register a client.
+	InitialAccessTokens []string `yaml:"initialAccessTokens" mapstructure:"initial_access_tokens"`
+	// OpenRegistration lets anyone register a client without an initial
+	// access token.
+	OpenRegistration bool `yaml:"openRegistration" mapstructure:"open_registration"`
+	// SoftwareStatementJWKS is the JSON Web Key Set of the publishers whose
+	// software statements are trusted.
+	SoftwareStatementJWKS string `yaml:"softwareStatementJwks" mapstructure:"software_statement_jwks"`
+	// RequireSoftwareStatement rejects registrations without a trusted software statement.
+	RequireSoftwareStatement bool `yaml:"requireSoftwareStatement" mapstructure:"require_software_statement"`
 }
 
-// ClientRepository defines the interface for storing and retrieving OAuth clients.
-type ClientRepository interface {
-	CreateClient(ctx context.Context, client *types.Client) error
-	GetClient(ctx context.Context, clientID string) (*types.Client, error)
-}
+// NewClientRegistry creates a new ClientRegistry. Unset defaults and the
+// grant type policy fall back to the authorization code flow and the grants
+// this server implements.
+func NewClientRegistry(repo types.ApplicationRepository, config ClientRegistryConfig) (*ClientRegistry, error) {
+	if len(config.DefaultGrantTypes) == 0 {
+		config.DefaultGrantTypes = []string{"authorization_code"}
+	}
+	if len(config.DefaultResponseTypes) == 0 {
+		config.DefaultResponseTypes = []string{"code"}
+	}
+	if len(config.AllowedGrantTypes) == 0 {
+		config.AllowedGrantTypes = []string{"authorization_code", "refresh_token", "client_credentials", DeviceCodeGrantType}
+	}
 
-// NewClientRegistry creates a new ClientRegistry.
-func NewClientRegistry(repo ClientRepository, config ClientRegistryConfig) *ClientRegistry {
-	return &ClientRegistry{repo: repo, config: config}
+	r := &ClientRegistry{repo: repo, config: config}
+	if config.SoftwareStatementJWKS != "" {
+		var keys jose.JSONWebKeySet
+		if err := json.Unmarshal([]byte(config.SoftwareStatementJWKS), &keys); err != nil {
+			return nil, fmt.Errorf("invalid software statement jwks: %w", err)
+		}
+		r.keys = &keys
+	}
+	return r, nil
 }
 
-// RegisterClient registers a new OAuth client.
-func (r *ClientRegistry) RegisterClient(ctx context.Context, req *types.ClientMetadata) (*types.Client, error) {
-	// TODO: Add validation for client metadata (e.g., redirect URIs, grant types).
+// AuthorizeRegistration checks the initial access token presented to the
+// registration endpoint. Without OpenRegistration, a configured token is
+// required, so registration is closed when no tokens are configured.
+func (r *ClientRegistry) AuthorizeRegistration(token string) error {
+	if r.config.OpenRegistration {
+		return nil
+	}
+	for _, allowed := range r.config.InitialAccessTokens {
+		if subtle.ConstantTimeCompare([]byte(allowed), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return types.ErrInvalidToken.WithDetails(map[string]string{"error": "a valid initial access token is required"})
+}
 
-	client := &types.Client{
-		ID:           generateClientID(),
-		Secret:       generateClientSecret(),
-		RedirectURIs: req.RedirectURIs,
-		GrantTypes:   req.GrantTypes,
-		ResponseTypes: req.ResponseTypes,
-		ClientName:   req.ClientName,
-		TokenEndpointAuthMethod: req.TokenEndpointAuthMethod,
+// RegisterClient registers a new OAuth client. The returned information
+// carries the client's secret and its registration access token, which are
+// not shown again.
+func (r *ClientRegistry) RegisterClient(ctx context.Context, req *types.ClientMetadata) (*types.ClientInformation, error) {
+	metadata, err := r.validate(req)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(client.GrantTypes) == 0 {
-		client.GrantTypes = r.config.DefaultGrantTypes
+	clientID, err := generateSecureCode(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate client id: %w", err)
+	}
+	registrationToken, err := generateSecureCode(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate registration access token: %w", err)
+	}
+	info := &types.ClientInformation{
+		ClientMetadata:          *metadata,
+		ClientID:                clientID,
+		ClientIDIssuedAt:        time.Now().Unix(),
+		RegistrationAccessToken: registrationToken,
 	}
-	if len(client.ResponseTypes) == 0 {
-		client.ResponseTypes = r.config.DefaultResponseTypes
+	secretHash, err := assignSecret(info, "")
+	if err != nil {
+		return nil, err
 	}
 
-	if err := r.repo.CreateClient(ctx, client); err != nil {
+	app, err := r.toApplication(ctx, info, secretHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.repo.CreateApplication(ctx, app); err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
+	return info, nil
+}
+
+// GetClient returns a registered client's current information. The client
+// secret is not included, since only its hash is stored.
+func (r *ClientRegistry) GetClient(ctx context.Context, clientID, registrationToken string) (*types.ClientInformation, error) {
+	app, err := r.authorizedApplication(ctx, clientID, registrationToken)
+	if err != nil {
+		return nil, err
+	}
+	info, err := clientInformation(app)
+	if err != nil {
+		return nil, err
+	}
+	info.RegistrationAccessToken = registrationToken
+	return info, nil
+}
+
+// UpdateClient replaces a registered client's metadata. Omitted fields are
+// reset to their defaults, as RFC 7592 section 2.2 requires.
+func (r *ClientRegistry) UpdateClient(ctx context.Context, clientID, registrationToken string, req *types.ClientInformation) (*types.ClientInformation, error) {
+	app, err := r.authorizedApplication(ctx, clientID, registrationToken)
+	if err != nil {
+		return nil, err
+	}
+	if req.ClientID != clientID {
+		return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "client_id does not match the registration"})
+	}
+	current, err := clientInformation(app)
+	if err != nil {
+		return nil, err
+	}
+	currentHash, _ := app.ProtocolConfig[ClientSecretHashKey].(string)
+	if req.ClientSecret != "" && subtle.ConstantTimeCompare([]byte(hashToken(req.ClientSecret)), []byte(currentHash)) != 1 {
+		return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "client_secret does not match the registration"})
+	}
+
+	metadata, err := r.validate(&req.ClientMetadata)
+	if err != nil {
+		return nil, err
+	}
+	info := &types.ClientInformation{
+		ClientMetadata:          *metadata,
+		ClientID:                clientID,
+		ClientIDIssuedAt:        current.ClientIDIssuedAt,
+		RegistrationAccessToken: registrationToken,
+	}
+	secretHash, err := assignSecret(info, currentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := r.toApplication(ctx, info, secretHash)
+	if err != nil {
+		return nil, err
+	}
+	updated.CreatedAt = app.CreatedAt
+	if err := r.repo.UpdateApplication(ctx, updated); err != nil {
+		return nil, fmt.Errorf("failed to update client: %w", err)
+	}
+	return info, nil
+}
+
+// DeleteClient deregisters a client.
+func (r *ClientRegistry) DeleteClient(ctx context.Context, clientID, registrationToken string) error {
+	if _, err := r.authorizedApplication(ctx, clientID, registrationToken); err != nil {
+		return err
+	}
+	if err := r.repo.DeleteApplication(ctx, clientID); err != nil {
+		return fmt.Errorf("failed to delete client: %w", err)
+	}
+	return nil
+}
+
+// authorizedApplication loads a dynamically registered client, checking the
+// registration access token. Unknown clients and bad tokens are reported
+// alike, so the endpoint does not reveal which client IDs exist.
+func (r *ClientRegistry) authorizedApplication(ctx context.Context, clientID, registrationToken string) (*types.Application, error) {
+	invalid := types.ErrInvalidToken.WithDetails(map[string]string{"error": "invalid registration access token"})
+	if clientID == "" || registrationToken == "" {
+		return nil, invalid
+	}
+	app, err := r.repo.GetApplicationByClientID(ctx, clientID)
+	if err != nil || app == nil {
+		return nil, invalid
+	}
+	hash, _ := app.ProtocolConfig[registrationTokenHashKey].(string)
+	if hash == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(registrationToken))) != 1 {
+		return nil, invalid
+	}
+	return app, nil
+}
+
+// validate applies the software statement and defaults to the requested
+// metadata and checks the result against the server's policy.
+func (r *ClientRegistry) validate(req *types.ClientMetadata) (*types.ClientMetadata, error) {
+	metadata, err := r.applySoftwareStatement(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadata.GrantTypes) == 0 {
+		metadata.GrantTypes = r.config.DefaultGrantTypes
+	}
+	if len(metadata.ResponseTypes) == 0 && contains(metadata.GrantTypes, "authorization_code") {
+		metadata.ResponseTypes = r.config.DefaultResponseTypes
+	}
+	if metadata.TokenEndpointAuthMethod == "" {
+		metadata.TokenEndpointAuthMethod = AuthMethodClientSecretBasic
+	}
+	if metadata.Scope == "" {
+		metadata.Scope = strings.Join(r.config.DefaultScopes, " ")
+	}
+
+	for _, grantType := range metadata.GrantTypes {
+		if !contains(r.config.AllowedGrantTypes, grantType) {
+			return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "grant type " + grantType + " is not allowed"})
+		}
+	}
+	for _, responseType := range metadata.ResponseTypes {
+		if responseType != "code" {
+			return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "response type " + responseType + " is not supported"})
+		}
+	}
+	if len(metadata.ResponseTypes) > 0 && !contains(metadata.GrantTypes, "authorization_code") {
+		return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "response type code requires the authorization_code grant"})
+	}
+	if len(r.config.AllowedScopes) > 0 {
+		for _, scope := range strings.Fields(metadata.Scope) {
+			if !contains(r.config.AllowedScopes, scope) {
+				return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "scope " + scope + " is not allowed"})
+			}
+		}
+	}
+
+	switch metadata.TokenEndpointAuthMethod {
+	case AuthMethodNone:
+		if contains(metadata.GrantTypes, "client_credentials") {
+			return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "public clients cannot use client_credentials"})
+		}
+	case AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+	case AuthMethodPrivateKeyJWT:
+		if metadata.JWKSURI == "" && len(metadata.JWKS) == 0 {
+			return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "private_key_jwt requires jwks or jwks_uri"})
+		}
+	default:
+		return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "unsupported token_endpoint_auth_method"})
+	}
+	if metadata.JWKSURI != "" && len(metadata.JWKS) > 0 {
+		return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "jwks and jwks_uri are mutually exclusive"})
+	}
+	if metadata.JWKSURI != "" {
+		if err := validateJWKSURI(metadata.JWKSURI); err != nil {
+			return nil, err
+		}
+	}
+	if len(metadata.JWKS) > 0 {
+		var keys jose.JSONWebKeySet
+		if err := json.Unmarshal(metadata.JWKS, &keys); err != nil || len(keys.Keys) == 0 {
+			return nil, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "jwks is not a valid JSON Web Key Set"})
+		}
+	}
 
-	return client, nil
+	if contains(metadata.GrantTypes, "authorization_code") && len(metadata.RedirectURIs) == 0 {
+		return nil, types.ErrInvalidRedirectURI.WithDetails(map[string]string{"error": "redirect_uris are required for the authorization_code grant"})
+	}
+	for _, uri := range metadata.RedirectURIs {
+		if err := r.validateRedirectURI(uri, metadata.TokenEndpointAuthMethod == AuthMethodNone); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
+// validateRedirectURI requires absolute URIs without fragments. Web
+// redirects must use https, except to loopback addresses. Public clients,
+// which include native apps, may also use private-use URI schemes.
+func (r *ClientRegistry) validateRedirectURI(raw string, public bool) error {
+	invalid := func(reason string) error {
+		return types.ErrInvalidRedirectURI.WithDetails(map[string]string{"error": raw + ": " + reason})
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return invalid("must be an absolute URI")
+	}
+	if u.Fragment != "" || strings.Contains(raw, "#") {
+		return invalid("must not contain a fragment")
+	}
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return invalid("must have a host")
+		}
+	case "http":
+		if !r.config.AllowHTTPRedirectURIs && !isLoopbackHost(u.Hostname()) {
+			return invalid("must use https")
+		}
+	case "javascript", "data", "file", "vbscript":
+		return invalid("scheme is not allowed")
+	default:
+		if !public {
+			return invalid("private-use schemes are only allowed for public clients")
+		}
+	}
+	return nil
 }
 
-// TODO: Implement these functions with proper random string generation.
-func generateClientID() string {
-	return "temp_client_id"
+// validateJWKSURI requires an https jwks_uri on a public host. The server
+// fetches the URI itself, so it must not name the server's own network. The
+// token endpoint checks the resolved addresses again when it connects.
+func validateJWKSURI(raw string) error {
+	invalid := func(reason string) error {
+		return types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "jwks_uri " + raw + ": " + reason})
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return invalid("must be an absolute URI")
+	}
+	if u.Scheme != "https" {
+		return invalid("must use https")
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return invalid("must have a host")
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".internal") || strings.HasSuffix(host, ".local") {
+		return invalid("must be a public host")
+	}
+	if ip := net.ParseIP(host); ip != nil && (!ip.IsGlobalUnicast() || ip.IsPrivate()) {
+		return invalid("must be a public host")
+	}
+	return nil
 }
 
-func generateClientSecret() string {
-	return "temp_client_secret"
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// applySoftwareStatement verifies the request's software statement and
+// returns the metadata with the statement's values taking precedence.
+func (r *ClientRegistry) applySoftwareStatement(req *types.ClientMetadata) (*types.ClientMetadata, error) {
+	metadata := *req
+	if req.SoftwareStatement == "" {
+		if r.config.RequireSoftwareStatement {
+			return nil, types.ErrInvalidSoftwareStatement.WithDetails(map[string]string{"error": "a software statement is required"})
+		}
+		return &metadata, nil
+	}
+	if r.keys == nil {
+		return nil, types.ErrUnapprovedSoftwareStatement.WithDetails(map[string]string{"error": "software statements are not accepted"})
+	}
+
+	token, err := jwt.Parse(req.SoftwareStatement, func(t *jwt.Token) (interface{}, error) {
+		candidates := r.keys.Keys
+		if kid, _ := t.Header["kid"].(string); kid != "" {
+			candidates = r.keys.Key(kid)
+		}
+		set := jwt.VerificationKeySet{}
+		for _, k := range candidates {
+			if k.Valid() && k.IsPublic() {
+				set.Keys = append(set.Keys, k.Key)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, errUntrustedSoftwareStatement
+		}
+		return set, nil
+	}, jwt.WithValidMethods([]string{"RS256", "PS256", "ES256", "EdDSA"}))
+	if err != nil {
+		if errors.Is(err, errUntrustedSoftwareStatement) {
+			return nil, types.ErrUnapprovedSoftwareStatement.WithCause(err)
+		}
+		return nil, types.ErrInvalidSoftwareStatement.WithCause(err)
+	}
+
+	// Overlay the statement's claims on the request's metadata.
+	merged, err := json.Marshal(req)
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(merged, &fields); err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	for name, value := range token.Claims.(jwt.MapClaims) {
+		switch name {
+		case "iss", "sub", "aud", "exp", "nbf", "iat", "jti":
+			continue
+		}
+		fields[name] = value
+	}
+	merged, err = json.Marshal(fields)
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	metadata = types.ClientMetadata{}
+	if err := json.Unmarshal(merged, &metadata); err != nil {
+		return nil, types.ErrInvalidSoftwareStatement.WithCause(err)
+	}
+	metadata.SoftwareStatement = req.SoftwareStatement
+	return &metadata, nil
+}
+
+// assignSecret gives clients that authenticate with a secret one and returns
+// the hash to store for it. A client keeping its current secret hash is not
+// issued a new secret. Clients that do not use a secret get none.
+func assignSecret(info *types.ClientInformation, currentHash string) (string, error) {
+	info.ClientSecret = ""
+	switch info.TokenEndpointAuthMethod {
+	case AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+		if currentHash != "" {
+			return currentHash, nil
+		}
+		secret, err := generateSecureCode(32)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate client secret: %w", err)
+		}
+		info.ClientSecret = secret
+		return hashToken(secret), nil
+	default:
+		return "", nil
+	}
+}
+
+// HasClientSecret reports whether an application's protocol config holds a
+// client secret, either hashed or, for statically configured applications,
+// in plain text.
+func HasClientSecret(config types.JSONB) bool {
+	hash, _ := config[ClientSecretHashKey].(string)
+	secret, _ := config["client_secret"].(string)
+	return hash != "" || secret != ""
+}
+
+// CheckClientSecret reports whether secret is the client secret held in an
+// application's protocol config.
+func CheckClientSecret(config types.JSONB, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if hash, _ := config[ClientSecretHashKey].(string); hash != "" {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(secret))) == 1
+	}
+	stored, _ := config["client_secret"].(string)
+	return stored != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) == 1
+}
+
+// toApplication converts client information to the application stored for it.
+func (r *ClientRegistry) toApplication(ctx context.Context, info *types.ClientInformation, secretHash string) (*types.Application, error) {
+	raw, err := json.Marshal(info.ClientMetadata)
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	var config types.JSONB
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	if len(info.JWKS) > 0 {
+		// The token endpoint reads inline keys as a JSON string.
+		config["jwks"] = string(info.JWKS)
+	}
+	if secretHash != "" {
+		config[ClientSecretHashKey] = secretHash
+	}
+	config[clientIDIssuedAtKey] = info.ClientIDIssuedAt
+	config[registrationTokenHashKey] = hashToken(info.RegistrationAccessToken)
+
+	clientType := types.ClientTypeConfidential
+	if info.TokenEndpointAuthMethod == AuthMethodNone {
+		clientType = types.ClientTypePublic
+	}
+	return &types.Application{
+		ID:             info.ClientID,
+		Name:           r.applicationName(ctx, info),
+		Status:         types.ApplicationStatusActive,
+		ClientType:     clientType,
+		Protocol:       types.ProtocolOIDC,
+		ProtocolConfig: config,
+	}, nil
+}
+
+// applicationName returns a unique application name for a client, preferring
+// its client_name.
+func (r *ClientRegistry) applicationName(ctx context.Context, info *types.ClientInformation) string {
+	if info.ClientName == "" {
+		return info.ClientID
+	}
+	existing, err := r.repo.GetApplicationByName(ctx, info.ClientName)
+	if err != nil || existing == nil || existing.ID == "" || existing.ID == info.ClientID {
+		return info.ClientName
+	}
+	return fmt.Sprintf("%s (%s)", info.ClientName, info.ClientID)
+}
+
+// clientInformation reads the registered metadata back from an application.
+func clientInformation(app *types.Application) (*types.ClientInformation, error) {
+	config := make(map[string]interface{}, len(app.ProtocolConfig))
+	for k, v := range app.ProtocolConfig {
+		config[k] = v
+	}
+	jwks, _ := config["jwks"].(string)
+	delete(config, "jwks")
+
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	var info types.ClientInformation
+	if err := json.Unmarshal(raw, &info.ClientMetadata); err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	if jwks != "" {
+		info.JWKS = json.RawMessage(jwks)
+	}
+	info.ClientID = app.ID
+	switch issuedAt := config[clientIDIssuedAtKey].(type) {
+	case float64:
+		info.ClientIDIssuedAt = int64(issuedAt)
+	case int64:
+		info.ClientIDIssuedAt = issuedAt
+	}
+	return &info, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,241 @@
+package oauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// fakeApplicationRepository keeps applications in memory, round-tripping them
+// through JSON like the database does.
+type fakeApplicationRepository map[string][]byte
+
+func (r fakeApplicationRepository) CreateApplication(ctx context.Context, app *types.Application) error {
+	data, err := json.Marshal(app)
+	r[app.ID] = data
+	return err
+}
+
+func (r fakeApplicationRepository) GetApplicationByID(ctx context.Context, id string) (*types.Application, error) {
+	data, ok := r[id]
+	if !ok {
+		return nil, fmt.Errorf("application %s not found", id)
+	}
+	var app types.Application
+	err := json.Unmarshal(data, &app)
+	return &app, err
+}
+
+func (r fakeApplicationRepository) GetApplicationByClientID(ctx context.Context, clientID string) (*types.Application, error) {
+	return r.GetApplicationByID(ctx, clientID)
+}
+
+func (r fakeApplicationRepository) GetApplicationByName(ctx context.Context, name string) (*types.Application, error) {
+	for id := range r {
+		if app, _ := r.GetApplicationByID(ctx, id); app.Name == name {
+			return app, nil
+		}
+	}
+	return nil, fmt.Errorf("application %s not found", name)
+}
+
+func (r fakeApplicationRepository) UpdateApplication(ctx context.Context, app *types.Application) error {
+	return r.CreateApplication(ctx, app)
+}
+
+func (r fakeApplicationRepository) DeleteApplication(ctx context.Context, id string) error {
+	delete(r, id)
+	return nil
+}
+
+func (r fakeApplicationRepository) ListApplications(ctx context.Context, pq types.PaginationQuery) ([]*types.Application, error) {
+	return nil, nil
+}
+
+func TestClientRegistry_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	repo := fakeApplicationRepository{}
+	registry, err := NewClientRegistry(repo, ClientRegistryConfig{DefaultScopes: []string{"openid"}})
+	require.NoError(t, err)
+	assert.ErrorIs(t, registry.AuthorizeRegistration(""), types.ErrInvalidToken, "registration is closed by default")
+
+	info, err := registry.RegisterClient(ctx, &types.ClientMetadata{
+		ClientName:   "Photo App",
+		RedirectURIs: []string{"https://photos.example.com/cb"},
+		GrantTypes:   []string{"authorization_code", "refresh_token"},
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.ClientID)
+	assert.NotEmpty(t, info.ClientSecret)
+	assert.NotEmpty(t, info.RegistrationAccessToken)
+	assert.Equal(t, []string{"code"}, info.ResponseTypes)
+	assert.Equal(t, AuthMethodClientSecretBasic, info.TokenEndpointAuthMethod)
+	assert.Equal(t, "openid", info.Scope)
+
+	app, err := repo.GetApplicationByClientID(ctx, info.ClientID)
+	require.NoError(t, err)
+	assert.Equal(t, "Photo App", app.Name)
+	assert.Equal(t, types.ClientTypeConfidential, app.ClientType)
+	assert.NotContains(t, fmt.Sprint(app.ProtocolConfig), info.ClientSecret, "only a hash of the client secret is stored")
+	assert.True(t, CheckClientSecret(app.ProtocolConfig, info.ClientSecret))
+	assert.False(t, CheckClientSecret(app.ProtocolConfig, "wrong-secret"))
+	assert.NotContains(t, fmt.Sprint(app.ProtocolConfig), info.RegistrationAccessToken, "only a hash of the registration token is stored")
+
+	_, err = registry.GetClient(ctx, info.ClientID, "wrong-token")
+	assert.ErrorIs(t, err, types.ErrInvalidToken)
+
+	got, err := registry.GetClient(ctx, info.ClientID, info.RegistrationAccessToken)
+	require.NoError(t, err)
+	assert.Empty(t, got.ClientSecret, "the secret is not shown again")
+	assert.Equal(t, info.RedirectURIs, got.RedirectURIs)
+
+	// Updating a confidential client keeps its secret.
+	kept, err := registry.UpdateClient(ctx, info.ClientID, info.RegistrationAccessToken, &types.ClientInformation{
+		ClientID:       info.ClientID,
+		ClientSecret:   info.ClientSecret,
+		ClientMetadata: types.ClientMetadata{ClientName: "Photo App", RedirectURIs: info.RedirectURIs},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, kept.ClientSecret)
+	app, _ = repo.GetApplicationByClientID(ctx, info.ClientID)
+	assert.True(t, CheckClientSecret(app.ProtocolConfig, info.ClientSecret))
+
+	_, err = registry.UpdateClient(ctx, info.ClientID, info.RegistrationAccessToken, &types.ClientInformation{
+		ClientID:       info.ClientID,
+		ClientSecret:   "wrong-secret",
+		ClientMetadata: types.ClientMetadata{RedirectURIs: info.RedirectURIs},
+	})
+	assert.ErrorIs(t, err, types.ErrInvalidClientMetadata)
+	assert.Equal(t, info.ClientIDIssuedAt, got.ClientIDIssuedAt)
+
+	// Switching to a public client drops the secret.
+	updated, err := registry.UpdateClient(ctx, info.ClientID, info.RegistrationAccessToken, &types.ClientInformation{
+		ClientID: info.ClientID,
+		ClientMetadata: types.ClientMetadata{
+			ClientName:              "Photo App",
+			RedirectURIs:            []string{"com.example.photos:/cb"},
+			TokenEndpointAuthMethod: AuthMethodNone,
+		},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, updated.ClientSecret)
+	app, _ = repo.GetApplicationByClientID(ctx, info.ClientID)
+	assert.Equal(t, types.ClientTypePublic, app.ClientType)
+	assert.Nil(t, app.ProtocolConfig[ClientSecretHashKey])
+
+	require.NoError(t, registry.DeleteClient(ctx, info.ClientID, info.RegistrationAccessToken))
+	_, err = registry.GetClient(ctx, info.ClientID, info.RegistrationAccessToken)
+	assert.ErrorIs(t, err, types.ErrInvalidToken)
+}
+
+func TestClientRegistry_Policy(t *testing.T) {
+	ctx := context.Background()
+	registry, err := NewClientRegistry(fakeApplicationRepository{}, ClientRegistryConfig{
+		AllowedGrantTypes:   []string{"authorization_code", "refresh_token"},
+		InitialAccessTokens: []string{"let-me-in"},
+	})
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, registry.AuthorizeRegistration(""), types.ErrInvalidToken)
+	assert.NoError(t, registry.AuthorizeRegistration("let-me-in"))
+
+	tests := []struct {
+		name     string
+		metadata types.ClientMetadata
+		code     string
+	}{
+		{"grant type not allowed", types.ClientMetadata{GrantTypes: []string{"client_credentials"}}, "invalid_client_metadata"},
+		{"missing redirect uris", types.ClientMetadata{}, "invalid_redirect_uri"},
+		{"http redirect", types.ClientMetadata{RedirectURIs: []string{"http://app.example.com/cb"}}, "invalid_redirect_uri"},
+		{"fragment", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb#x"}}, "invalid_redirect_uri"},
+		{"custom scheme for confidential client", types.ClientMetadata{RedirectURIs: []string{"com.example.app:/cb"}}, "invalid_redirect_uri"},
+		{"implicit", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, ResponseTypes: []string{"token"}}, "invalid_client_metadata"},
+		{"unknown auth method", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: "tls_client_auth"}, "invalid_client_metadata"},
+		{"http jwks_uri", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT, JWKSURI: "http://app.example.com/jwks"}, "invalid_client_metadata"},
+		{"loopback jwks_uri", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT, JWKSURI: "https://127.0.0.1/jwks"}, "invalid_client_metadata"},
+		{"metadata service jwks_uri", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT, JWKSURI: "https://169.254.169.254/latest"}, "invalid_client_metadata"},
+		{"private jwks_uri", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT, JWKSURI: "https://10.0.0.5/jwks"}, "invalid_client_metadata"},
+		{"localhost jwks_uri", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT, JWKSURI: "https://localhost/jwks"}, "invalid_client_metadata"},
+		{"private_key_jwt without keys", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT}, "invalid_client_metadata"},
+		{"software statement not accepted", types.ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, SoftwareStatement: "a.b.c"}, "unapproved_software_statement"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := registry.RegisterClient(ctx, &tt.metadata)
+			var appErr *types.Error
+			if assert.ErrorAs(t, err, &appErr) {
+				assert.Equal(t, tt.code, appErr.Code)
+			}
+		})
+	}
+
+	_, err = registry.RegisterClient(ctx, &types.ClientMetadata{RedirectURIs: []string{"http://127.0.0.1:8400/cb"}})
+	assert.NoError(t, err, "http is allowed for loopback redirects")
+
+	_, err = registry.RegisterClient(ctx, &types.ClientMetadata{
+		RedirectURIs:            []string{"https://app.example.com/cb"},
+		TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT,
+		JWKSURI:                 "https://app.example.com/jwks",
+	})
+	assert.NoError(t, err)
+
+	open, err := NewClientRegistry(fakeApplicationRepository{}, ClientRegistryConfig{OpenRegistration: true})
+	require.NoError(t, err)
+	assert.NoError(t, open.AuthorizeRegistration(""))
+}
+
+func TestClientRegistry_SoftwareStatement(t *testing.T) {
+	ctx := context.Background()
+	publisher, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &publisher.PublicKey, KeyID: "publisher", Algorithm: "ES256", Use: "sig"}}})
+	require.NoError(t, err)
+
+	registry, err := NewClientRegistry(fakeApplicationRepository{}, ClientRegistryConfig{
+		SoftwareStatementJWKS:    string(jwks),
+		RequireSoftwareStatement: true,
+	})
+	require.NoError(t, err)
+
+	sign := func(key *ecdsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss":           "https://publisher.example.com",
+			"software_id":   "photo-app",
+			"client_name":   "Official Photo App",
+			"redirect_uris": []string{"https://photos.example.com/cb"},
+		})
+		token.Header["kid"] = "publisher"
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	_, err = registry.RegisterClient(ctx, &types.ClientMetadata{RedirectURIs: []string{"https://photos.example.com/cb"}})
+	assert.ErrorIs(t, err, types.ErrInvalidSoftwareStatement)
+
+	// Statement values take precedence over the plain request values.
+	info, err := registry.RegisterClient(ctx, &types.ClientMetadata{
+		ClientName:        "Knockoff",
+		RedirectURIs:      []string{"https://evil.example.com/cb"},
+		SoftwareStatement: sign(publisher),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Official Photo App", info.ClientName)
+	assert.Equal(t, "photo-app", info.SoftwareID)
+	assert.Equal(t, []string{"https://photos.example.com/cb"}, info.RedirectURIs)
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = registry.RegisterClient(ctx, &types.ClientMetadata{SoftwareStatement: sign(other)})
+	assert.ErrorIs(t, err, types.ErrInvalidSoftwareStatement, "a bad signature with a known kid is invalid")
+}
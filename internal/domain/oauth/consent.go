@@ -0,0 +1,50 @@
+package oauth
+
+import (
+	"context"
+	"time"
+)
+
+// Consent records the scopes a user has granted to an OAuth client.
+type Consent struct {
+	UserID    string    `json:"user_id"`
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// Covers reports whether every requested scope has already been granted.
+func (c *Consent) Covers(scopes []string) bool {
+	if c == nil {
+		return false
+	}
+	granted := make(map[string]bool, len(c.Scopes))
+	for _, s := range c.Scopes {
+		granted[s] = true
+	}
+	for _, s := range scopes {
+		if !granted[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// Grant adds scopes to the consent, keeping previously granted scopes.
+func (c *Consent) Grant(scopes []string, at time.Time) {
+	for _, s := range scopes {
+		if !c.Covers([]string{s}) {
+			c.Scopes = append(c.Scopes, s)
+		}
+	}
+	c.GrantedAt = at
+}
+
+// ConsentRepository defines the interface for storing user consent grants.
+type ConsentRepository interface {
+	// GetConsent returns the consent a user granted to a client, or nil if there is none.
+	GetConsent(ctx context.Context, userID, clientID string) (*Consent, error)
+	SaveConsent(ctx context.Context, consent *Consent) error
+	ListConsents(ctx context.Context, userID string) ([]*Consent, error)
+	RevokeConsent(ctx context.Context, userID, clientID string) error
+}
@@ -0,0 +1,27 @@
+package oauth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsent_CoversAndGrant(t *testing.T) {
+	var none *Consent
+	assert.False(t, none.Covers([]string{"openid"}))
+
+	c := &Consent{UserID: "user-1", ClientID: "client-1"}
+	assert.True(t, c.Covers(nil))
+	assert.False(t, c.Covers([]string{"openid"}))
+
+	now := time.Now()
+	c.Grant([]string{"openid", "profile"}, now)
+	assert.True(t, c.Covers([]string{"openid"}))
+	assert.True(t, c.Covers([]string{"profile", "openid"}))
+	assert.False(t, c.Covers([]string{"openid", "email"}))
+
+	c.Grant([]string{"email", "openid"}, now)
+	assert.Equal(t, []string{"openid", "profile", "email"}, c.Scopes)
+	assert.Equal(t, now, c.GrantedAt)
+}
@@ -2,12 +2,33 @@ package oauth
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/turtacn/QuantaID/pkg/types"
 )
 
+// DeviceCodeGrantType is the grant_type of device access token requests (RFC 8628).
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Device code statuses.
+const (
+	DeviceCodeStatusPending    = "pending"
+	DeviceCodeStatusAuthorized = "authorized"
+	DeviceCodeStatusDenied     = "denied"
+	DeviceCodeStatusExpired    = "expired"
+)
+
+// slowDownIncrement is added to a device's polling interval each time it
+// polls too fast (RFC 8628 section 3.5).
+const slowDownIncrement = 5
+
 // DeviceFlowHandler manages the Device Authorization Grant flow.
 type DeviceFlowHandler struct {
 	deviceCodeRepo DeviceCodeRepository
@@ -17,12 +38,25 @@ type DeviceFlowHandler struct {
 
 // DeviceFlowConfig holds the configuration for the Device Authorization Grant.
 type DeviceFlowConfig struct {
-	DeviceCodeLength   int           `yaml:"deviceCodeLength"`
-	UserCodeLength     int           `yaml:"userCodeLength"`
-	UserCodeCharset    string        `yaml:"userCodeCharset"`
-	ExpiresIn          time.Duration `yaml:"expiresIn"`
-	PollingInterval    int           `yaml:"pollingInterval"`
-	VerificationURI    string        `yaml:"verificationUri"`
+	DeviceCodeLength int           `yaml:"deviceCodeLength" mapstructure:"device_code_length"`
+	UserCodeLength   int           `yaml:"userCodeLength" mapstructure:"user_code_length"`
+	UserCodeCharset  string        `yaml:"userCodeCharset" mapstructure:"user_code_charset"`
+	ExpiresIn        time.Duration `yaml:"expiresIn" mapstructure:"expires_in"`
+	PollingInterval  int           `yaml:"pollingInterval" mapstructure:"polling_interval"`
+	VerificationURI  string        `yaml:"verificationUri" mapstructure:"verification_uri"`
+}
+
+// DefaultDeviceFlowConfig returns the settings used for any unset field of a
+// DeviceFlowConfig. The user code charset omits vowels and look-alike
+// characters, as RFC 8628 section 6.1 suggests.
+func DefaultDeviceFlowConfig() DeviceFlowConfig {
+	return DeviceFlowConfig{
+		DeviceCodeLength: 32,
+		UserCodeLength:   8,
+		UserCodeCharset:  "BCDFGHJKLMNPQRSTVWXZ",
+		ExpiresIn:        10 * time.Minute,
+		PollingInterval:  5,
+	}
 }
 
 // DeviceAuthorizationResponse is the response from the device authorization endpoint.
@@ -45,15 +79,28 @@ type DeviceCodeRecord struct {
 	UserID     string
 	ExpiresAt  time.Time
 	CreatedAt  time.Time
+	// Interval is the minimum number of seconds between polls; it grows when the device polls too fast.
+	Interval     int
+	LastPolledAt time.Time
+	// SessionID and AuthTime describe the login session the user approved the device from.
+	SessionID string
+	AuthTime  time.Time
 }
 
 // DeviceCodeRepository defines the interface for storing and retrieving device codes.
+// User codes are looked up in the normalized form returned by NormalizeUserCode.
 type DeviceCodeRepository interface {
 	Create(ctx context.Context, record *DeviceCodeRecord) error
 	GetByDeviceCode(ctx context.Context, deviceCode string) (*DeviceCodeRecord, error)
 	GetByUserCode(ctx context.Context, userCode string) (*DeviceCodeRecord, error)
 	UpdateStatus(ctx context.Context, deviceCode, status string) error
+	// MarkUsed deletes a record in one atomic step, so that a device code is
+	// redeemed once. It returns types.ErrNotFound if the code is already used.
 	MarkUsed(ctx context.Context, deviceCode string) error
+	// Update sets record fields by key: "status", "user_id", "session_id",
+	// "auth_time", "interval" and "last_polled_at". It returns
+	// types.ErrNotFound for a used code and types.ErrConflict if the record
+	// changed while it was being updated.
 	Update(ctx context.Context, deviceCode string, updates map[string]interface{}) error
 }
 
@@ -62,12 +109,29 @@ type TokenService interface {
 	IssueTokens(ctx context.Context, req types.TokenRequest) (*types.Token, error)
 }
 
-// NewDeviceFlowHandler creates a new DeviceFlowHandler.
+// NewDeviceFlowHandler creates a new DeviceFlowHandler. Unset config fields
+// take their values from DefaultDeviceFlowConfig.
 func NewDeviceFlowHandler(
 	deviceCodeRepo DeviceCodeRepository,
 	tokenService TokenService,
 	config DeviceFlowConfig,
 ) *DeviceFlowHandler {
+	defaults := DefaultDeviceFlowConfig()
+	if config.DeviceCodeLength <= 0 {
+		config.DeviceCodeLength = defaults.DeviceCodeLength
+	}
+	if config.UserCodeLength <= 0 {
+		config.UserCodeLength = defaults.UserCodeLength
+	}
+	if config.UserCodeCharset == "" {
+		config.UserCodeCharset = defaults.UserCodeCharset
+	}
+	if config.ExpiresIn <= 0 {
+		config.ExpiresIn = defaults.ExpiresIn
+	}
+	if config.PollingInterval <= 0 {
+		config.PollingInterval = defaults.PollingInterval
+	}
 	return &DeviceFlowHandler{
 		deviceCodeRepo: deviceCodeRepo,
 		tokenService:   tokenService,
@@ -77,16 +141,25 @@ func NewDeviceFlowHandler(
 
 // HandleDeviceAuthorizationRequest handles the initial request to the device authorization endpoint.
 func (h *DeviceFlowHandler) HandleDeviceAuthorizationRequest(ctx context.Context, clientID, scope string) (*DeviceAuthorizationResponse, error) {
-	deviceCode := generateSecureCode(h.config.DeviceCodeLength)
-	userCode := generateUserFriendlyCode(h.config.UserCodeLength, h.config.UserCodeCharset)
+	deviceCode, err := generateSecureCode(h.config.DeviceCodeLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate device code: %w", err)
+	}
+	userCode, err := generateUserFriendlyCode(h.config.UserCodeLength, h.config.UserCodeCharset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate user code: %w", err)
+	}
 
+	now := time.Now()
 	record := &DeviceCodeRecord{
 		DeviceCode: deviceCode,
-		UserCode:   userCode,
+		UserCode:   NormalizeUserCode(userCode),
 		ClientID:   clientID,
 		Scope:      scope,
-		Status:     "pending",
-		ExpiresAt:  time.Now().Add(h.config.ExpiresIn),
+		Status:     DeviceCodeStatusPending,
+		ExpiresAt:  now.Add(h.config.ExpiresIn),
+		CreatedAt:  now,
+		Interval:   h.config.PollingInterval,
 	}
 
 	if err := h.deviceCodeRepo.Create(ctx, record); err != nil {
@@ -97,7 +170,7 @@ func (h *DeviceFlowHandler) HandleDeviceAuthorizationRequest(ctx context.Context
 		DeviceCode:              deviceCode,
 		UserCode:                userCode,
 		VerificationURI:         h.config.VerificationURI,
-		VerificationURIComplete: fmt.Sprintf("%s?user_code=%s", h.config.VerificationURI, userCode),
+		VerificationURIComplete: fmt.Sprintf("%s?user_code=%s", h.config.VerificationURI, url.QueryEscape(userCode)),
 		ExpiresIn:               int(h.config.ExpiresIn.Seconds()),
 		Interval:                h.config.PollingInterval,
 	}, nil
@@ -105,58 +178,175 @@ func (h *DeviceFlowHandler) HandleDeviceAuthorizationRequest(ctx context.Context
 
 // HandleDeviceTokenRequest handles the token request from the device.
 func (h *DeviceFlowHandler) HandleDeviceTokenRequest(ctx context.Context, deviceCode, clientID string) (*types.Token, error) {
+	record, err := h.PollDeviceCode(ctx, deviceCode, clientID)
+	if err != nil {
+		return nil, err
+	}
+	return h.tokenService.IssueTokens(ctx, types.TokenRequest{
+		GrantType: DeviceCodeGrantType,
+		ClientID:  record.ClientID,
+		UserID:    record.UserID,
+		Scope:     record.Scope,
+	})
+}
+
+// PollDeviceCode handles one poll of the token endpoint by a device. It
+// returns the authorized record, consuming the device code, once the user has
+// approved it. Until then it returns authorization_pending, or slow_down when
+// the device polls faster than its interval allows.
+func (h *DeviceFlowHandler) PollDeviceCode(ctx context.Context, deviceCode, clientID string) (*DeviceCodeRecord, error) {
 	record, err := h.deviceCodeRepo.GetByDeviceCode(ctx, deviceCode)
 	if err != nil {
 		return nil, types.ErrInvalidGrant
 	}
+	if record.ClientID != clientID {
+		return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "device code was issued to another client"})
+	}
 
-	if time.Now().After(record.ExpiresAt) {
-		h.deviceCodeRepo.UpdateStatus(ctx, deviceCode, "expired")
+	now := time.Now()
+	if now.After(record.ExpiresAt) {
+		h.deviceCodeRepo.UpdateStatus(ctx, deviceCode, DeviceCodeStatusExpired)
 		return nil, types.ErrExpiredToken
 	}
 
+	interval := record.Interval
+	if interval <= 0 {
+		interval = h.config.PollingInterval
+	}
+	if !record.LastPolledAt.IsZero() && now.Sub(record.LastPolledAt) < time.Duration(interval)*time.Second {
+		if err := h.deviceCodeRepo.Update(ctx, deviceCode, map[string]interface{}{
+			"interval":       interval + slowDownIncrement,
+			"last_polled_at": now,
+		}); err != nil {
+			return nil, pollError(err)
+		}
+		return nil, types.ErrSlowDown
+	}
+
 	switch record.Status {
-	case "pending":
+	case DeviceCodeStatusPending:
+		if err := h.deviceCodeRepo.Update(ctx, deviceCode, map[string]interface{}{"last_polled_at": now}); err != nil {
+			return nil, pollError(err)
+		}
 		return nil, types.ErrAuthorizationPending
-	case "denied":
+	case DeviceCodeStatusDenied:
+		h.deviceCodeRepo.MarkUsed(ctx, deviceCode)
 		return nil, types.ErrAccessDenied
-	case "authorized":
-		tokens, err := h.tokenService.IssueTokens(ctx, types.TokenRequest{
-			GrantType: "urn:ietf:params:oauth:grant-type:device_code",
-			ClientID:  record.ClientID,
-			UserID:    record.UserID,
-			Scope:     record.Scope,
-		})
-		if err != nil {
-			return nil, err
+	case DeviceCodeStatusAuthorized:
+		// Only the poll that deletes the code issues tokens for it.
+		if err := h.deviceCodeRepo.MarkUsed(ctx, deviceCode); err != nil {
+			return nil, pollError(err)
 		}
-
-		h.deviceCodeRepo.MarkUsed(ctx, deviceCode)
-		return tokens, nil
+		return record, nil
 	default:
 		return nil, types.ErrInvalidGrant
 	}
 }
 
+// pollError maps a failure to store the outcome of a poll to the error the
+// device is told. A code redeemed by a concurrent poll is no longer valid,
+// and a record changed by one means the device polls too fast.
+func pollError(err error) error {
+	switch {
+	case errors.Is(err, types.ErrNotFound):
+		return types.ErrInvalidGrant
+	case errors.Is(err, types.ErrConflict):
+		return types.ErrSlowDown
+	default:
+		return types.ErrInternal.WithCause(err)
+	}
+}
+
+// LookupUserCode returns the pending request for a user code, so the user can
+// see which client is asking for access before approving it.
+func (h *DeviceFlowHandler) LookupUserCode(ctx context.Context, userCode string) (*DeviceCodeRecord, error) {
+	record, err := h.deviceCodeRepo.GetByUserCode(ctx, NormalizeUserCode(userCode))
+	if err != nil {
+		return nil, types.ErrNotFound.WithCause(err)
+	}
+	if record.Status != DeviceCodeStatusPending || time.Now().After(record.ExpiresAt) {
+		return nil, types.ErrNotFound
+	}
+	return record, nil
+}
+
 // ActivateDeviceCode is called when the user authorizes the device.
 func (h *DeviceFlowHandler) ActivateDeviceCode(ctx context.Context, userCode, userID string) error {
-	record, err := h.deviceCodeRepo.GetByUserCode(ctx, userCode)
+	return h.ActivateDeviceCodeForSession(ctx, userCode, userID, "", time.Time{})
+}
+
+// ActivateDeviceCodeForSession authorizes the device on behalf of a user
+// logged in with the given session, which the issued tokens are linked to.
+func (h *DeviceFlowHandler) ActivateDeviceCodeForSession(ctx context.Context, userCode, userID, sessionID string, authTime time.Time) error {
+	record, err := h.LookupUserCode(ctx, userCode)
 	if err != nil {
 		return fmt.Errorf("invalid user code: %w", err)
 	}
 
 	updates := map[string]interface{}{
-		"status":  "authorized",
+		"status":  DeviceCodeStatusAuthorized,
 		"user_id": userID,
 	}
-	return h.deviceCodeRepo.Update(ctx, record.DeviceCode, updates)
+	if sessionID != "" {
+		updates["session_id"] = sessionID
+	}
+	if !authTime.IsZero() {
+		updates["auth_time"] = authTime
+	}
+	if err := h.deviceCodeRepo.Update(ctx, record.DeviceCode, updates); err != nil {
+		return err
+	}
+	DeviceFlowActivationsTotal.WithLabelValues(DeviceCodeStatusAuthorized).Inc()
+	return nil
 }
 
-// TODO: Implement these functions with proper random string generation.
-func generateSecureCode(length int) string {
-	return "temp_device_code"
+// DenyDeviceCode records that the user refused the device's request.
+func (h *DeviceFlowHandler) DenyDeviceCode(ctx context.Context, userCode string) error {
+	record, err := h.LookupUserCode(ctx, userCode)
+	if err != nil {
+		return fmt.Errorf("invalid user code: %w", err)
+	}
+	if err := h.deviceCodeRepo.UpdateStatus(ctx, record.DeviceCode, DeviceCodeStatusDenied); err != nil {
+		return err
+	}
+	DeviceFlowActivationsTotal.WithLabelValues(DeviceCodeStatusDenied).Inc()
+	return nil
+}
+
+// NormalizeUserCode returns the canonical form of a user code as typed by a
+// user: upper case, without the separator or spaces.
+func NormalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
 }
 
-func generateUserFriendlyCode(length int, charset string) string {
-	return "ABCD-EFGH"
+// generateSecureCode returns a random URL-safe device code carrying length bytes of entropy.
+func generateSecureCode(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// generateUserFriendlyCode returns a random user code drawn from charset,
+// split into two halves with a hyphen for readability, e.g. "WDJB-MJHT".
+func generateUserFriendlyCode(length int, charset string) (string, error) {
+	code := make([]byte, 0, length+1)
+	max := big.NewInt(int64(len(charset)))
+	for i := 0; i < length; i++ {
+		if i == length/2 && length >= 4 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, charset[n.Int64()])
+	}
+	return string(code), nil
 }
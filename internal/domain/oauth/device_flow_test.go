@@ -78,3 +78,128 @@ func TestDeviceFlow_GenerateCode(t *testing.T) {
 	assert.NotEmpty(t, resp.DeviceCode)
 	assert.NotEmpty(t, resp.UserCode)
 }
+
+func TestDeviceFlow_UserCodeFormat(t *testing.T) {
+	code, err := generateUserFriendlyCode(8, "BCDFGHJKLMNPQRSTVWXZ")
+	assert.NoError(t, err)
+	assert.Len(t, code, 9)
+	assert.Equal(t, byte('-'), code[4])
+	assert.Equal(t, "WDJBMJHT", NormalizeUserCode("wdjb-mjht"))
+	assert.Equal(t, "WDJBMJHT", NormalizeUserCode(" WDJB MJHT "))
+}
+
+func TestDeviceFlow_PollDeviceCode(t *testing.T) {
+	ctx := context.Background()
+	newRecord := func(status string) *DeviceCodeRecord {
+		return &DeviceCodeRecord{
+			DeviceCode: "device-code",
+			UserCode:   "WDJBMJHT",
+			ClientID:   "tv",
+			Status:     status,
+			UserID:     "user-123",
+			ExpiresAt:  time.Now().Add(time.Minute),
+			Interval:   5,
+		}
+	}
+
+	t.Run("pending", func(t *testing.T) {
+		repo := new(MockDeviceCodeRepository)
+		handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+		repo.On("GetByDeviceCode", ctx, "device-code").Return(newRecord(DeviceCodeStatusPending), nil)
+		repo.On("Update", ctx, "device-code", mock.Anything).Return(nil)
+
+		_, err := handler.PollDeviceCode(ctx, "device-code", "tv")
+		assert.ErrorIs(t, err, types.ErrAuthorizationPending)
+	})
+
+	t.Run("slow down", func(t *testing.T) {
+		repo := new(MockDeviceCodeRepository)
+		handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+		record := newRecord(DeviceCodeStatusPending)
+		record.LastPolledAt = time.Now().Add(-time.Second)
+		repo.On("GetByDeviceCode", ctx, "device-code").Return(record, nil)
+		repo.On("Update", ctx, "device-code", mock.MatchedBy(func(updates map[string]interface{}) bool {
+			return updates["interval"] == 10
+		})).Return(nil)
+
+		_, err := handler.PollDeviceCode(ctx, "device-code", "tv")
+		assert.ErrorIs(t, err, types.ErrSlowDown)
+		repo.AssertExpectations(t)
+	})
+
+	t.Run("other client", func(t *testing.T) {
+		repo := new(MockDeviceCodeRepository)
+		handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+		repo.On("GetByDeviceCode", ctx, "device-code").Return(newRecord(DeviceCodeStatusAuthorized), nil)
+
+		_, err := handler.PollDeviceCode(ctx, "device-code", "other")
+		var appErr *types.Error
+		if assert.ErrorAs(t, err, &appErr) {
+			assert.Equal(t, types.ErrInvalidGrant.Code, appErr.Code)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		repo := new(MockDeviceCodeRepository)
+		handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+		record := newRecord(DeviceCodeStatusPending)
+		record.ExpiresAt = time.Now().Add(-time.Second)
+		repo.On("GetByDeviceCode", ctx, "device-code").Return(record, nil)
+		repo.On("UpdateStatus", ctx, "device-code", DeviceCodeStatusExpired).Return(nil)
+
+		_, err := handler.PollDeviceCode(ctx, "device-code", "tv")
+		assert.ErrorIs(t, err, types.ErrExpiredToken)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		repo := new(MockDeviceCodeRepository)
+		handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+		repo.On("GetByDeviceCode", ctx, "device-code").Return(newRecord(DeviceCodeStatusDenied), nil)
+		repo.On("MarkUsed", ctx, "device-code").Return(nil)
+
+		_, err := handler.PollDeviceCode(ctx, "device-code", "tv")
+		assert.ErrorIs(t, err, types.ErrAccessDenied)
+	})
+
+	t.Run("authorized", func(t *testing.T) {
+		repo := new(MockDeviceCodeRepository)
+		handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+		repo.On("GetByDeviceCode", ctx, "device-code").Return(newRecord(DeviceCodeStatusAuthorized), nil)
+		repo.On("MarkUsed", ctx, "device-code").Return(nil)
+
+		record, err := handler.PollDeviceCode(ctx, "device-code", "tv")
+		assert.NoError(t, err)
+		assert.Equal(t, "user-123", record.UserID)
+		repo.AssertCalled(t, "MarkUsed", ctx, "device-code")
+	})
+
+	t.Run("redeemed by a concurrent poll", func(t *testing.T) {
+		repo := new(MockDeviceCodeRepository)
+		handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+		repo.On("GetByDeviceCode", ctx, "device-code").Return(newRecord(DeviceCodeStatusAuthorized), nil)
+		repo.On("MarkUsed", ctx, "device-code").Return(types.ErrNotFound)
+
+		record, err := handler.PollDeviceCode(ctx, "device-code", "tv")
+		assert.ErrorIs(t, err, types.ErrInvalidGrant)
+		assert.Nil(t, record)
+	})
+}
+
+func TestDeviceFlow_ActivateAndDeny(t *testing.T) {
+	ctx := context.Background()
+	repo := new(MockDeviceCodeRepository)
+	handler := NewDeviceFlowHandler(repo, nil, DeviceFlowConfig{})
+	record := &DeviceCodeRecord{DeviceCode: "device-code", UserCode: "WDJBMJHT", ClientID: "tv", Status: DeviceCodeStatusPending, ExpiresAt: time.Now().Add(time.Minute)}
+	repo.On("GetByUserCode", ctx, "WDJBMJHT").Return(record, nil)
+	repo.On("Update", ctx, "device-code", mock.MatchedBy(func(updates map[string]interface{}) bool {
+		return updates["status"] == DeviceCodeStatusAuthorized && updates["user_id"] == "user-123" && updates["session_id"] == "session-1"
+	})).Return(nil)
+	repo.On("UpdateStatus", ctx, "device-code", DeviceCodeStatusDenied).Return(nil)
+
+	assert.NoError(t, handler.ActivateDeviceCodeForSession(ctx, "wdjb-mjht", "user-123", "session-1", time.Now()))
+	assert.NoError(t, handler.DenyDeviceCode(ctx, "WDJB-MJHT"))
+
+	record.Status = DeviceCodeStatusAuthorized
+	_, err := handler.LookupUserCode(ctx, "WDJB-MJHT")
+	assert.Error(t, err, "codes that are no longer pending cannot be looked up")
+}
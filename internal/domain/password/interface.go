@@ -2,6 +2,8 @@ package password
 
 import (
 	"context"
+
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 )
 
 // IService defines the contract for password operations.
@@ -10,4 +12,14 @@ type IService interface {
 	Verify(ctx context.Context, userID, password string) (bool, error)
 	// Hash hashes a password.
 	Hash(password string) (string, error)
+	// SetPasswordPolicy sets the policy new passwords are validated against
+	// and expired passwords are refused by.
+	SetPasswordPolicy(engine *passwordpolicy.Engine)
+}
+
+// Setter is implemented by password services that can replace passwords.
+type Setter interface {
+	// SetPassword checks a new password against the password policy and
+	// stores it as the password of the user.
+	SetPassword(ctx context.Context, userID, password string) error
 }
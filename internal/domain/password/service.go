@@ -0,0 +1,102 @@
+package password
+
+import (
+	"context"
+	"errors"
+
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// service implements the IService interface on the stored password hashes
+// of users, in any scheme the crypto manager verifies.
+type service struct {
+	userRepo identity.UserRepository
+	crypto   *utils.CryptoManager
+	logger   utils.Logger
+	policy   *passwordpolicy.Engine
+}
+
+// NewService creates a password service that verifies the passwords of the
+// users in the repository. Hashes imported from other systems are replaced
+// by hashes in the preferred scheme once their password verifies.
+func NewService(userRepo identity.UserRepository, crypto *utils.CryptoManager, logger utils.Logger) IService {
+	return &service{
+		userRepo: userRepo,
+		crypto:   crypto,
+		logger:   logger,
+	}
+}
+
+// SetPasswordPolicy sets the policy new passwords are validated against and
+// expired passwords are refused by.
+func (s *service) SetPasswordPolicy(engine *passwordpolicy.Engine) {
+	s.policy = engine
+}
+
+// Verify checks if the provided password matches the stored password for the user.
+// A matching password that has expired, or that the user must change, is
+// refused with types.ErrPasswordExpired.
+func (s *service) Verify(ctx context.Context, userID, password string) (bool, error) {
+	user, err := s.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, types.ErrUserNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if user.Password == "" || !s.crypto.CheckPasswordHash(password, user.Password) {
+		return false, nil
+	}
+	if s.policy != nil {
+		if required, reason := s.policy.ChangeRequired(ctx, user); required {
+			return false, types.ErrPasswordExpired.WithDetails(map[string]string{"reason": reason})
+		}
+	}
+
+	if s.crypto.NeedsRehash(user.Password) {
+		hash, err := s.crypto.HashPassword(password)
+		if err != nil {
+			s.logger.Warn(ctx, "Failed to rehash password", zap.Error(err), zap.String("userID", user.ID))
+			return true, nil
+		}
+		user.Password = hash
+		if err := s.userRepo.UpdateUser(ctx, user); err != nil {
+			s.logger.Warn(ctx, "Failed to store rehashed password", zap.Error(err), zap.String("userID", user.ID))
+		}
+	}
+	return true, nil
+}
+
+// Hash hashes a password.
+func (s *service) Hash(password string) (string, error) {
+	return s.crypto.HashPassword(password)
+}
+
+// SetPassword replaces the password of a user, after checking it against
+// the password policy when one is set.
+func (s *service) SetPassword(ctx context.Context, userID, password string) error {
+	user, err := s.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if s.policy != nil {
+		if err := s.policy.SetPassword(ctx, user, password); err != nil {
+			return err
+		}
+	} else {
+		hash, err := s.crypto.HashPassword(password)
+		if err != nil {
+			return types.ErrInternal.WithCause(err)
+		}
+		user.Password = hash
+	}
+	if err := s.userRepo.UpdateUser(ctx, user); err != nil {
+		s.logger.Error(ctx, "Failed to store password", zap.Error(err), zap.String("userID", user.ID))
+		return types.ErrInternal.WithCause(err)
+	}
+	return nil
+}
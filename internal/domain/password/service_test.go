@@ -0,0 +1,77 @@
+package password
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+func TestVerify_UpgradesImportedHash(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	// An OpenLDAP salted SHA-1 hash of "correct horse".
+	user := &types.User{Username: "alice", Email: "alice@example.com", Password: "{SSHA}qITZK2p4w2s2QGYCc5XrYthNLFJzNGx0"}
+	require.NoError(t, repo.CreateUser(ctx, user))
+	svc := NewService(repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))
+
+	ok, err := svc.Verify(ctx, user.ID, "wrong")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	stored, err := repo.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Password, "{SSHA}"))
+
+	ok, err = svc.Verify(ctx, user.ID, "correct horse")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	stored, err = repo.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Password, "$argon2id$"), stored.Password)
+
+	ok, err = svc.Verify(ctx, user.ID, "correct horse")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, _ = svc.Verify(ctx, "unknown", "correct horse")
+	assert.False(t, ok)
+}
+
+func TestVerify_RefusesExpiredPassword(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	crypto := utils.NewCryptoManager("test-secret")
+	hash, err := crypto.HashPassword("correct horse")
+	require.NoError(t, err)
+	user := &types.User{
+		Username:   "alice",
+		Email:      "alice@example.com",
+		Password:   hash,
+		Attributes: map[string]interface{}{passwordpolicy.AttrChangedAt: time.Now().Add(-100 * 24 * time.Hour).Format(time.RFC3339)},
+	}
+	require.NoError(t, repo.CreateUser(ctx, user))
+	svc := NewService(repo, crypto, utils.NewZapLoggerWrapper(zap.NewNop()))
+
+	ok, err := svc.Verify(ctx, user.ID, "correct horse")
+	require.NoError(t, err)
+	assert.True(t, ok, "without a policy passwords do not expire")
+
+	svc.SetPasswordPolicy(passwordpolicy.NewEngine(passwordpolicy.Config{
+		Default: passwordpolicy.Policy{MaxAge: 90 * 24 * time.Hour},
+	}, crypto, zap.NewNop()))
+	ok, err = svc.Verify(ctx, user.ID, "correct horse")
+	assert.ErrorIs(t, err, types.ErrPasswordExpired)
+	assert.False(t, ok)
+
+	ok, err = svc.Verify(ctx, user.ID, "wrong")
+	require.NoError(t, err, "a wrong password does not reveal that it expired")
+	assert.False(t, ok)
+}
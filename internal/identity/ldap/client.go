@@ -3,9 +3,16 @@ package ldap
 import (
 	"context"
 	"crypto/tls"
+	"net"
+	"time"
+
 	"github.com/go-ldap/ldap/v3"
 )
 
+// searchPageSize is the page size of SearchScope, below the 1000 entries
+// Active Directory returns to a search by default.
+const searchPageSize = 500
+
 type LDAPClientInterface interface {
 	Connect() error
 	Search(ctx context.Context, baseDN string, filter string, attributes []string) ([]*ldap.Entry, error)
@@ -19,6 +26,9 @@ type LDAPClient struct {
 	url  string
 	user string
 	pass string
+
+	tlsConfig *tls.Config
+	timeout   time.Duration
 }
 
 func NewLDAPClient(url, user, pass string) *LDAPClient {
@@ -29,11 +39,30 @@ func NewLDAPClient(url, user, pass string) *LDAPClient {
 	}
 }
 
+// SetTLSConfig sets the TLS configuration of ldaps:// URLs. Without one,
+// the certificate of the server is not verified.
+func (c *LDAPClient) SetTLSConfig(config *tls.Config) {
+	c.tlsConfig = config
+}
+
+// SetTimeout bounds the time taken to connect and by each request. 0 leaves
+// them unbounded.
+func (c *LDAPClient) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
 func (c *LDAPClient) Connect() error {
-	l, err := ldap.DialURL(c.url, ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	tlsConfig := c.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	l, err := ldap.DialURL(c.url, ldap.DialWithTLSConfig(tlsConfig), ldap.DialWithDialer(&net.Dialer{Timeout: c.timeout}))
 	if err != nil {
 		return err
 	}
+	if c.timeout > 0 {
+		l.SetTimeout(c.timeout)
+	}
 	c.conn = l
 	return c.conn.Bind(c.user, c.pass)
 }
@@ -59,6 +88,23 @@ func (c *LDAPClient) Search(ctx context.Context, baseDN string, filter string, a
 	return sr.Entries, nil
 }
 
+// SearchScope returns the entries of a search with a scope, read a page at a
+// time so that server size limits do not cut it short.
+func (c *LDAPClient) SearchScope(ctx context.Context, baseDN string, scope int, filter string, attributes []string) ([]*ldap.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		scope, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		attributes,
+		nil,
+	)
+	sr, err := c.conn.SearchWithPaging(searchRequest, searchPageSize)
+	if err != nil {
+		return nil, err
+	}
+	return sr.Entries, nil
+}
+
 func (c *LDAPClient) SearchPaged(ctx context.Context, baseDN string, filter string, pageSize uint32, cookie string) ([]*ldap.Entry, string, error) {
 	searchRequest := ldap.NewSearchRequest(
 		baseDN,
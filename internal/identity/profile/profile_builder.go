@@ -178,11 +178,7 @@ func (b *ProfileBuilder) buildQualityDetails(ctx context.Context, userID string)
 
 	hasMFA, _ := b.mfaService.HasAnyMethod(ctx, userID)
 
-	// Check user verification status if available in Attributes, or assume false if fields missing
-	emailVerified := false
-	if v, ok := user.Attributes["email_verified"].(bool); ok {
-		emailVerified = v
-	}
+	emailVerified := user.IsEmailVerified()
 
 	phoneVerified := false
 	if v, ok := user.Attributes["phone_verified"].(bool); ok {
@@ -0,0 +1,181 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Backend is a source of the entries of the tree.
+type Backend interface {
+	// SearchPage returns up to limit entries matching a search, starting at
+	// a cursor, and the cursor of the next page, nil when the search is
+	// complete. A limit of 0 returns all entries. If ctx is done before the
+	// page is complete, the entries found so far are returned with the
+	// context's error.
+	SearchPage(ctx context.Context, req *SearchRequest, from Cursor, limit int) ([]*Entry, *Cursor, error)
+}
+
+// Binder is implemented by backends that authenticate binds to their own
+// entries rather than to local users.
+type Binder interface {
+	// Bind checks the password of a DN. handled is false when the DN is not
+	// an entry of the backend. A wrong password is ErrInvalidCredentials.
+	Bind(ctx context.Context, dn, password string) (handled bool, err error)
+}
+
+// SetBackend sets the backend of the tree, such as a merged backend of the
+// local backend and proxies of upstream directories. The suffixes of
+// proxies must not overlap, nor overlap the local entries when they are
+// served.
+func (vt *VirtualTree) SetBackend(backend Backend) error {
+	vt.backend = backend
+	local := vt.servesLocal()
+	var suffixes []string
+	for _, b := range backends(backend) {
+		proxy, ok := b.(*ProxyBackend)
+		if !ok {
+			continue
+		}
+		suffix := proxy.suffix
+		if local {
+			if !isUnder(suffix, vt.base) || suffix == vt.base {
+				return fmt.Errorf("suffix %s of upstream %s is not below %s", proxy.suffix, proxy.name, vt.baseDN)
+			}
+			for _, ou := range []string{usersOU, groupsOU} {
+				if isUnder(suffix, normalizeDN(ou+","+vt.baseDN)) {
+					return fmt.Errorf("suffix %s of upstream %s is below the local %s", proxy.suffix, proxy.name, ou)
+				}
+			}
+		}
+		for _, other := range suffixes {
+			if isUnder(suffix, other) || isUnder(other, suffix) {
+				return fmt.Errorf("suffix %s of upstream %s overlaps %s", proxy.suffix, proxy.name, other)
+			}
+		}
+		suffixes = append(suffixes, suffix)
+	}
+	return nil
+}
+
+// Local returns the backend of the local users and groups.
+func (vt *VirtualTree) Local() Backend {
+	return vt.local
+}
+
+// servesLocal reports whether the tree serves the local users and groups,
+// which can then be bound to and changed.
+func (vt *VirtualTree) servesLocal() bool {
+	for _, b := range backends(vt.backend) {
+		if b == vt.local {
+			return true
+		}
+	}
+	return false
+}
+
+// localBackend serves the users and groups of the identity service as the
+// entries below ou=users and ou=groups.
+type localBackend struct {
+	vt *VirtualTree
+}
+
+func (b *localBackend) SearchPage(ctx context.Context, req *SearchRequest, from Cursor, limit int) ([]*Entry, *Cursor, error) {
+	vt := b.vt
+	q := vt.queryForScope(req.BaseDN, req.Scope).and(vt.queryForFilter(req.Filter))
+	s := &treeSearch{
+		vt:    vt,
+		req:   req,
+		q:     q,
+		base:  normalizeDN(req.BaseDN),
+		limit: limit,
+	}
+	if req.BaseDN == "" {
+		s.base = vt.base
+	}
+
+	sections := []func(context.Context, int) (int, error){s.structure, s.groups, s.users}
+	for section := from.Section; section < len(sections); section++ {
+		offset := 0
+		if section == from.Section {
+			offset = from.Offset
+		}
+		next, err := sections[section](ctx, offset)
+		if err != nil {
+			return s.entries, nil, err
+		}
+		if s.full() {
+			return s.entries, &Cursor{Section: section, Offset: next}, nil
+		}
+	}
+	return s.entries, nil, nil
+}
+
+// mergedBackend serves the entries of several backends, one after the
+// other.
+type mergedBackend struct {
+	backends []Backend
+}
+
+// NewMergedBackend returns a backend serving the entries of backends, whose
+// subtrees should not overlap.
+func NewMergedBackend(members ...Backend) Backend {
+	m := &mergedBackend{}
+	for _, b := range members {
+		// A merged member is flattened, as cursors hold one backend index.
+		m.backends = append(m.backends, backends(b)...)
+	}
+	return m
+}
+
+func (m *mergedBackend) SearchPage(ctx context.Context, req *SearchRequest, from Cursor, limit int) ([]*Entry, *Cursor, error) {
+	var entries []*Entry
+	for i := from.Backend; i < len(m.backends); i++ {
+		cursor := Cursor{}
+		if i == from.Backend {
+			cursor = Cursor{Section: from.Section, Offset: from.Offset}
+		}
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - len(entries)
+		}
+		page, next, err := m.backends[i].SearchPage(ctx, req, cursor, remaining)
+		entries = append(entries, page...)
+		if err != nil {
+			return entries, nil, err
+		}
+		if next != nil {
+			next.Backend = i
+			return entries, next, nil
+		}
+		if limit > 0 && len(entries) >= limit && i+1 < len(m.backends) {
+			return entries, &Cursor{Backend: i + 1}, nil
+		}
+	}
+	return entries, nil, nil
+}
+
+// Bind passes a bind to the first backend whose entry the DN is.
+func (m *mergedBackend) Bind(ctx context.Context, dn, password string) (bool, error) {
+	for _, b := range m.backends {
+		if binder, ok := b.(Binder); ok {
+			if handled, err := binder.Bind(ctx, dn, password); handled {
+				return true, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// backends returns the backends a backend is made of.
+func backends(b Backend) []Backend {
+	if m, ok := b.(*mergedBackend); ok {
+		return m.backends
+	}
+	return []Backend{b}
+}
+
+// isUnder reports whether a normalized DN is at or below another.
+func isUnder(dn, base string) bool {
+	return dn == base || strings.HasSuffix(dn, ","+base)
+}
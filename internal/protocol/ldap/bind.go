@@ -2,13 +2,23 @@ package ldap
 
 import (
 	"context"
+	"errors"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
 	"github.com/go-ldap/ldap/v3"
+	"github.com/turtacn/QuantaID/pkg/types"
 	"go.uber.org/zap"
 )
 
-func (s *Server) HandleBind(ctx context.Context, messageID int64, req *ber.Packet) *ber.Packet {
+// HandleBind handles a bind request from the client at the source address.
+func (s *Server) HandleBind(ctx context.Context, messageID int64, req *ber.Packet, source string) *ber.Packet {
+	resp, _ := s.bind(ctx, messageID, req, source)
+	return resp
+}
+
+// bind handles a bind request and returns the user it authenticated, or nil
+// for a failed or anonymous bind.
+func (s *Server) bind(ctx context.Context, messageID int64, req *ber.Packet, source string) (*ber.Packet, *types.User) {
 	// BindRequest ::= [APPLICATION 0] SEQUENCE {
 	//     version                 INTEGER (1 .. 127),
 	//     name                    LDAPDN,
@@ -18,7 +28,7 @@ func (s *Server) HandleBind(ctx context.Context, messageID int64, req *ber.Packe
 	//     ... }
 
 	if len(req.Children) < 3 {
-		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultProtocolError, "", "Invalid BindRequest")
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultProtocolError, "", "Invalid BindRequest"), nil
 	}
 
 	version := req.Children[0].Value.(int64)
@@ -28,7 +38,7 @@ func (s *Server) HandleBind(ctx context.Context, messageID int64, req *ber.Packe
 	s.logger.Debug("Bind Request", zap.Int64("version", version), zap.String("dn", dn))
 
 	if version != 3 {
-		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultProtocolError, "", "Only LDAPv3 supported")
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultProtocolError, "", "Only LDAPv3 supported"), nil
 	}
 
 	if authChoice.Tag == 0 { // Simple Bind
@@ -42,14 +52,14 @@ func (s *Server) HandleBind(ctx context.Context, messageID int64, req *ber.Packe
 		} else if len(authChoice.Data.Bytes()) > 0 {
 			password = string(authChoice.Data.Bytes())
 		}
-		return s.doSimpleBind(ctx, messageID, dn, password)
+		return s.doSimpleBind(ctx, messageID, dn, password, source)
 	}
 
 	// SASL not fully implemented yet, or other types
-	return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultAuthMethodNotSupported, "", "Unsupported auth method")
+	return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultAuthMethodNotSupported, "", "Unsupported auth method"), nil
 }
 
-func (s *Server) doSimpleBind(ctx context.Context, messageID int64, dn string, passwordStr string) *ber.Packet {
+func (s *Server) doSimpleBind(ctx context.Context, messageID int64, dn string, passwordStr string, source string) (*ber.Packet, *types.User) {
 	// Parse DN to find username
 	// Assuming DN format: uid=username,ou=users,dc=example,dc=com
 	// or cn=username,ou=users...
@@ -60,43 +70,98 @@ func (s *Server) doSimpleBind(ctx context.Context, messageID int64, dn string, p
 		// Anonymous bind allowed? Let's say yes for now, or configurable.
 		// If password is also empty.
 		if passwordStr == "" {
-			return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultSuccess, "", "")
+			return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultSuccess, "", ""), nil
 		}
 	}
 
 	parsedDN, err := ldap.ParseDN(dn)
 	if err != nil || len(parsedDN.RDNs) == 0 {
 		s.logger.Warn("Bind failed: invalid DN", zap.String("dn", dn), zap.Error(err))
-		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid DN")
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid DN"), nil
 	}
 
 	// Extract the first RDN. Assuming uid=username or cn=username
 	// For AD/LDAP, it's usually the first component of the DN.
 	firstRDN := parsedDN.RDNs[0]
 	if len(firstRDN.Attributes) == 0 {
-		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid RDN")
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid RDN"), nil
 	}
 
 	val := firstRDN.Attributes[0].Value
 
+	if s.lockout != nil {
+		if err := s.lockout.Check(ctx, val, source); err != nil {
+			s.logger.Warn("Bind refused", zap.String("username", val), zap.String("source", source), zap.Error(err))
+			// A refusal looks like a wrong password, so it tells an attacker nothing.
+			return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials"), nil
+		}
+	}
+
+	// Entries of upstream directories are bound to upstream.
+	if binder, ok := s.virtualTree.backend.(Binder); ok {
+		if handled, err := binder.Bind(ctx, dn, passwordStr); handled {
+			return s.upstreamBindResult(ctx, messageID, dn, val, source, err), nil
+		}
+	}
+	if !s.virtualTree.servesLocal() {
+		s.logger.Warn("Bind failed: no upstream directory holds the DN", zap.String("dn", dn))
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials"), nil
+	}
+
 	// Lookup user
 	user, err := s.userService.GetUserByUsername(ctx, val)
 	if err != nil {
 		// Differentiate not found vs error? To be safe, just invalid credentials
 		s.logger.Warn("Bind failed: user not found", zap.String("username", val), zap.Error(err))
-		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials")
+		s.recordBindFailure(ctx, val, source)
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials"), nil
 	}
 
 	// Verify password
 	valid, err := s.pwdService.Verify(ctx, user.ID, passwordStr)
+	if errors.Is(err, types.ErrPasswordExpired) {
+		// The password is right, so the client may tell the user to change it.
+		s.logger.Warn("Bind failed: password expired", zap.String("username", val), zap.String("source", source))
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Password expired"), nil
+	}
 	if err != nil {
 		s.logger.Warn("Bind failed: verify error", zap.String("username", val), zap.Error(err))
-		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials")
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials"), nil
 	}
 	if !valid {
-		s.logger.Warn("Bind failed: invalid password", zap.String("username", val), zap.String("password_received", passwordStr))
+		s.logger.Warn("Bind failed: invalid password", zap.String("username", val), zap.String("source", source))
+		s.recordBindFailure(ctx, val, source)
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials"), nil
+	}
+
+	if s.lockout != nil {
+		s.lockout.RecordSuccess(ctx, val)
+	}
+	return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultSuccess, "", ""), user
+}
+
+// upstreamBindResult answers a bind passed through to an upstream
+// directory. An upstream that cannot be reached is not held against the
+// user.
+func (s *Server) upstreamBindResult(ctx context.Context, messageID int64, dn, username, source string, err error) *ber.Packet {
+	switch {
+	case err == nil:
+		if s.lockout != nil {
+			s.lockout.RecordSuccess(ctx, username)
+		}
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultSuccess, "", "")
+	case errors.Is(err, ErrInvalidCredentials):
+		s.logger.Warn("Bind failed: invalid upstream password", zap.String("dn", dn), zap.String("source", source))
+		s.recordBindFailure(ctx, username, source)
 		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultInvalidCredentials, "", "Invalid Credentials")
+	default:
+		s.logger.Error("Bind failed: upstream error", zap.String("dn", dn), zap.Error(err))
+		return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultUnavailable, "", "Upstream directory unavailable")
 	}
+}
 
-	return encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultSuccess, "", "")
+func (s *Server) recordBindFailure(ctx context.Context, username, source string) {
+	if s.lockout != nil {
+		s.lockout.RecordFailure(ctx, username, source)
+	}
 }
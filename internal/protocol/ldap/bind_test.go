@@ -0,0 +1,76 @@
+package ldap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-ldap/ldap/v3"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+// staticPasswords verifies the passwords of users by ID.
+type staticPasswords map[string]string
+
+func (p staticPasswords) Verify(ctx context.Context, userID, password string) (bool, error) {
+	return p[userID] == password, nil
+}
+
+func (p staticPasswords) Hash(password string) (string, error) {
+	return password, nil
+}
+
+func (p staticPasswords) SetPasswordPolicy(engine *passwordpolicy.Engine) {}
+
+func (p staticPasswords) SetPassword(ctx context.Context, userID, password string) error {
+	p[userID] = password
+	return nil
+}
+
+func TestBindLockout(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	user := &types.User{Username: "alice", Email: "alice@example.com", Status: types.UserStatusActive}
+	require.NoError(t, repo.CreateUser(ctx, user))
+	svc := identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))
+
+	server := NewServer("127.0.0.1:0", "dc=example,dc=com", nil, svc, staticPasswords{user.ID: "secret"}, zap.NewNop())
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()}))
+	tracker := lockout.NewTracker(client, lockout.Config{MaxFailures: 3, ThrottleAfter: 100, LockoutDuration: time.Minute}, zap.NewNop())
+	server.SetLockoutTracker(tracker)
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+
+	bind := func(password string) error {
+		conn, err := ldap.DialURL("ldap://" + server.listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.Bind("uid=alice,ou=users,dc=example,dc=com", password)
+	}
+
+	require.NoError(t, bind("secret"))
+	for i := 0; i < 3; i++ {
+		assert.True(t, ldap.IsErrorWithCode(bind("wrong"), ldap.LDAPResultInvalidCredentials))
+	}
+
+	// The right password no longer helps while the account is locked.
+	assert.True(t, ldap.IsErrorWithCode(bind("secret"), ldap.LDAPResultInvalidCredentials))
+	status, err := tracker.Status(ctx, "alice")
+	require.NoError(t, err)
+	assert.True(t, status.Locked)
+
+	require.NoError(t, tracker.Unlock(ctx, "alice", "admin"))
+	assert.NoError(t, bind("secret"))
+}
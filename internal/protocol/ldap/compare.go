@@ -0,0 +1,73 @@
+package ldap
+
+import (
+	"context"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// dnAttributes are the attributes whose values are DNs, compared after
+// normalization.
+var dnAttributes = map[string]bool{
+	"member":       true,
+	"uniquemember": true,
+	"memberof":     true,
+}
+
+// HandleCompare handles a CompareRequest, which asks whether an entry has
+// an attribute value.
+func (s *Server) HandleCompare(ctx context.Context, messageID int64, req *ber.Packet) *ber.Packet {
+	// CompareRequest ::= [APPLICATION 14] SEQUENCE {
+	//     entry           LDAPDN,
+	//     ava             AttributeValueAssertion }
+	//
+	// AttributeValueAssertion ::= SEQUENCE {
+	//     attributeDesc   AttributeDescription,
+	//     assertionValue  AssertionValue }
+	dn, ok := requestDN(req)
+	if !ok || len(req.Children) < 2 || len(req.Children[1].Children) < 2 {
+		return encodeLDAPResult(messageID, ApplicationCompareResponse, LDAPResultProtocolError, "", "Invalid CompareRequest")
+	}
+	attr := packetString(req.Children[1].Children[0])
+	value := packetString(req.Children[1].Children[1])
+
+	entry, err := s.entryAt(ctx, dn)
+	if err != nil {
+		code, msg := s.errorResult(err)
+		return encodeLDAPResult(messageID, ApplicationCompareResponse, code, "", msg)
+	}
+	values, ok := entry.values(attr)
+	if !ok {
+		return encodeLDAPResult(messageID, ApplicationCompareResponse, LDAPResultNoSuchAttribute, "", "")
+	}
+	for _, v := range values {
+		if dnAttributes[strings.ToLower(attr)] {
+			if normalizeDN(v) == normalizeDN(value) {
+				return encodeLDAPResult(messageID, ApplicationCompareResponse, LDAPResultCompareTrue, "", "")
+			}
+		} else if strings.EqualFold(v, value) {
+			return encodeLDAPResult(messageID, ApplicationCompareResponse, LDAPResultCompareTrue, "", "")
+		}
+	}
+	return encodeLDAPResult(messageID, ApplicationCompareResponse, LDAPResultCompareFalse, "", "")
+}
+
+// entryAt returns the entry of the tree a DN names, from whichever backend
+// serves it.
+func (s *Server) entryAt(ctx context.Context, dn string) (*Entry, error) {
+	filter, err := ldap.CompileFilter("(objectClass=*)")
+	if err != nil {
+		return nil, err
+	}
+	req := &SearchRequest{BaseDN: dn, Scope: ScopeBaseObject, Filter: filter}
+	entries, _, err := s.virtualTree.SearchPage(ctx, req, Cursor{}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ldapErrorf(LDAPResultNoSuchObject, "No such object")
+	}
+	return entries[0], nil
+}
@@ -0,0 +1,282 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/turtacn/QuantaID/internal/domain/password"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// The names of the supported extended operations.
+const (
+	// StartTLSOID is the StartTLS operation (RFC 4511, section 4.14).
+	StartTLSOID = "1.3.6.1.4.1.1466.20037"
+	// WhoAmIOID is the "Who am I?" operation (RFC 4532).
+	WhoAmIOID = "1.3.6.1.4.1.4203.1.11.3"
+	// PasswordModifyOID is the Password Modify operation (RFC 3062).
+	PasswordModifyOID = "1.3.6.1.4.1.4203.1.11.1"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake that follows a StartTLS
+// response.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// connState is the state of a client connection.
+type connState struct {
+	conn net.Conn
+	// secure is set once the connection is protected by TLS, from the start
+	// for LDAPS or after StartTLS.
+	secure bool
+	// user is the user of the last successful bind, nil when the connection
+	// is anonymous or bound to an upstream directory.
+	user *types.User
+	// dn is the DN of the last successful bind, empty when the connection
+	// is anonymous.
+	dn string
+}
+
+// extendedRequestName returns the requestName of an ExtendedRequest.
+func extendedRequestName(req *ber.Packet) string {
+	// ExtendedRequest ::= [APPLICATION 23] SEQUENCE {
+	//     requestName      [0] LDAPOID,
+	//     requestValue     [1] OCTET STRING OPTIONAL }
+	if len(req.Children) == 0 || req.Children[0].ClassType != ber.ClassContext || req.Children[0].Tag != 0 {
+		return ""
+	}
+	return string(req.Children[0].Data.Bytes())
+}
+
+// encodeExtendedResponse encodes an ExtendedResponse, with the responseName
+// when it is not empty and the responseValue when it is given.
+func encodeExtendedResponse(messageID int64, resultCode int, errorMessage string, responseName string, responseValue ...*ber.Packet) *ber.Packet {
+	var extra []*ber.Packet
+	if responseName != "" {
+		// responseName [10] LDAPOID OPTIONAL
+		extra = append(extra, ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, responseName, "ResponseName"))
+	}
+	// responseValue [11] OCTET STRING OPTIONAL
+	extra = append(extra, responseValue...)
+	return encodeLDAPResult(messageID, ApplicationExtendedResponse, resultCode, "", errorMessage, extra...)
+}
+
+// handleStartTLS answers a StartTLS request and, when it succeeds, runs the
+// TLS handshake on the connection. The error is set when the connection can
+// no longer be used.
+func (s *Server) handleStartTLS(state *connState, messageID int64) error {
+	var resp *ber.Packet
+	switch {
+	case s.startTLSConfig == nil:
+		resp = encodeExtendedResponse(messageID, LDAPResultUnavailable, "StartTLS is not available", StartTLSOID)
+	case state.secure:
+		resp = encodeExtendedResponse(messageID, LDAPResultOperationsError, "TLS is already established", StartTLSOID)
+	default:
+		resp = encodeExtendedResponse(messageID, LDAPResultSuccess, "", StartTLSOID)
+	}
+	if _, err := state.conn.Write(resp.Bytes()); err != nil {
+		return err
+	}
+	if s.startTLSConfig == nil || state.secure {
+		return nil
+	}
+
+	conn := tls.Server(state.conn, s.startTLSConfig)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		s.logger.Debug("StartTLS handshake failed", zap.Error(err))
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	state.conn = conn
+	state.secure = true
+	return nil
+}
+
+// bindName returns the name of a BindRequest.
+func bindName(req *ber.Packet) string {
+	if len(req.Children) < 2 {
+		return ""
+	}
+	name, _ := req.Children[1].Value.(string)
+	return name
+}
+
+// isAnonymousBind reports whether a BindRequest is a simple bind without a
+// name and password.
+func isAnonymousBind(req *ber.Packet) bool {
+	if len(req.Children) < 3 {
+		return false
+	}
+	name, _ := req.Children[1].Value.(string)
+	auth := req.Children[2]
+	return name == "" && auth.Tag == 0 && len(auth.Data.Bytes()) == 0
+}
+
+// handleWhoAmI answers a "Who am I?" request with the DN of the bound user,
+// or an empty authorization identity for an anonymous connection.
+func (s *Server) handleWhoAmI(state *connState, messageID int64) *ber.Packet {
+	authzID := ""
+	if state.user != nil {
+		authzID = "dn:" + s.virtualTree.userDN(state.user.Username)
+	} else if state.dn != "" {
+		authzID = "dn:" + state.dn
+	}
+	return encodeExtendedResponse(messageID, LDAPResultSuccess, "", "", ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, authzID, "ResponseValue"))
+}
+
+// passwordModifyRequest is the value of a Password Modify request. Absent
+// fields are empty.
+type passwordModifyRequest struct {
+	userIdentity string
+	oldPassword  string
+	newPassword  string
+}
+
+// decodePasswordModifyRequest decodes the requestValue of a Password Modify
+// request:
+//
+//	PasswdModifyRequestValue ::= SEQUENCE {
+//	     userIdentity    [0]  OCTET STRING OPTIONAL
+//	     oldPasswd       [1]  OCTET STRING OPTIONAL
+//	     newPasswd       [2]  OCTET STRING OPTIONAL }
+func decodePasswordModifyRequest(req *ber.Packet) (*passwordModifyRequest, bool) {
+	pm := &passwordModifyRequest{}
+	if len(req.Children) < 2 {
+		return pm, true
+	}
+	value, err := ber.DecodePacketErr(req.Children[1].Data.Bytes())
+	if err != nil {
+		return nil, false
+	}
+	for _, field := range value.Children {
+		if field.ClassType != ber.ClassContext {
+			return nil, false
+		}
+		switch field.Tag {
+		case 0:
+			pm.userIdentity = string(field.Data.Bytes())
+		case 1:
+			pm.oldPassword = string(field.Data.Bytes())
+		case 2:
+			pm.newPassword = string(field.Data.Bytes())
+		default:
+			return nil, false
+		}
+	}
+	return pm, true
+}
+
+// HandlePasswordModify handles a Password Modify request. Bound users can
+// change their own password by giving the old one; setting a password
+// without it, or the password of another user, needs ActionPasswordReset.
+func (s *Server) HandlePasswordModify(ctx context.Context, state *connState, messageID int64, req *ber.Packet) *ber.Packet {
+	pm, ok := decodePasswordModifyRequest(req)
+	if !ok {
+		return encodeExtendedResponse(messageID, LDAPResultProtocolError, "Invalid Password Modify request", "")
+	}
+	err := s.passwordModify(ctx, state, pm)
+	recordWrite("password_modify", err)
+	if err != nil {
+		code, msg := s.errorResult(err)
+		return encodeExtendedResponse(messageID, code, msg, "")
+	}
+	return encodeExtendedResponse(messageID, LDAPResultSuccess, "", "")
+}
+
+func (s *Server) passwordModify(ctx context.Context, state *connState, pm *passwordModifyRequest) error {
+	if s.requireTLS && !state.secure {
+		return ldapErrorf(LDAPResultConfidentialityRequired, "TLS is required to change passwords")
+	}
+	if state.user == nil {
+		return ldapErrorf(LDAPResultInsufficientAccessRights, "Bind to change passwords")
+	}
+	if pm.newPassword == "" {
+		return ldapErrorf(LDAPResultUnwillingToPerform, "A new password is required")
+	}
+
+	user := state.user
+	if pm.userIdentity != "" {
+		t, err := s.passwordTarget(ctx, pm.userIdentity)
+		if err != nil {
+			return err
+		}
+		user = t.user
+	}
+	source := state.conn.RemoteAddr().String()
+
+	// Authorization comes first, so the old password check cannot be used
+	// to guess the passwords of other users.
+	if pm.oldPassword == "" || user.ID != state.user.ID {
+		t := &target{dn: s.virtualTree.userDN(user.Username), kind: "user", user: user}
+		if err := s.authorize(ctx, state, ActionPasswordReset, t.resource(nil)); err != nil {
+			return err
+		}
+	}
+	if pm.oldPassword != "" {
+		if err := s.verifyOldPassword(ctx, user, pm.oldPassword, source); err != nil {
+			return err
+		}
+	}
+	return s.setPassword(ctx, user.ID, pm.newPassword)
+}
+
+// verifyOldPassword checks the old password of a Password Modify request
+// like a bind, under the same lockout.
+func (s *Server) verifyOldPassword(ctx context.Context, user *types.User, oldPassword, source string) error {
+	if s.lockout != nil {
+		if err := s.lockout.Check(ctx, user.Username, source); err != nil {
+			s.logger.Warn("Password modify refused", zap.String("username", user.Username), zap.String("source", source), zap.Error(err))
+			return ldapErrorf(LDAPResultInvalidCredentials, "Invalid Credentials")
+		}
+	}
+	// Users whose password expired change it here, so an expired old
+	// password is accepted.
+	valid, err := s.pwdService.Verify(ctx, user.ID, oldPassword)
+	if errors.Is(err, types.ErrPasswordExpired) {
+		valid, err = true, nil
+	}
+	if err != nil {
+		return err
+	}
+	if !valid {
+		s.logger.Warn("Password modify failed: invalid old password", zap.String("username", user.Username), zap.String("source", source))
+		s.recordBindFailure(ctx, user.Username, source)
+		return ldapErrorf(LDAPResultInvalidCredentials, "Invalid Credentials")
+	}
+	if s.lockout != nil {
+		s.lockout.RecordSuccess(ctx, user.Username)
+	}
+	return nil
+}
+
+// passwordTarget returns the user a userIdentity names: a DN, optionally
+// prefixed with "dn:", or a username prefixed with "u:".
+func (s *Server) passwordTarget(ctx context.Context, identity string) (*target, error) {
+	if username, ok := strings.CutPrefix(identity, "u:"); ok {
+		user, err := s.userService.GetUserByUsername(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		return &target{dn: s.virtualTree.userDN(user.Username), kind: "user", user: user}, nil
+	}
+	dn := strings.TrimPrefix(identity, "dn:")
+	if _, ok := s.virtualTree.childName(dn, usersOU, "uid"); !ok {
+		return nil, ldapErrorf(LDAPResultNoSuchObject, "%s is not a user", dn)
+	}
+	return s.resolve(ctx, dn)
+}
+
+// setPassword sets the password of a user through the password service.
+func (s *Server) setPassword(ctx context.Context, userID, newPassword string) error {
+	setter, ok := s.pwdService.(password.Setter)
+	if !ok {
+		return ldapErrorf(LDAPResultUnwillingToPerform, "Passwords cannot be changed")
+	}
+	return setter.SetPassword(ctx, userID, newPassword)
+}
@@ -30,11 +30,11 @@ func MatchesFilter(entry *Entry, filter *ber.Packet) bool {
 		})
 	case FilterSubstrings:
 		// Sequence { type, substrings }
-		attrType := filter.Children[0].Value.(string)
+		attrType := packetString(filter.Children[0])
 		// substrings sequence
 		seq := filter.Children[1]
 
-		vals, ok := entry.Attributes[attrType]
+		vals, ok := entry.values(attrType)
 		if !ok {
 			return false
 		}
@@ -45,7 +45,7 @@ func MatchesFilter(entry *Entry, filter *ber.Packet) bool {
 			// Real impl needs to handle sequence of initial, any, final
 			matched := true
 			for _, sub := range seq.Children {
-				subVal := sub.Value.(string)
+				subVal := packetString(sub)
 				// sub.Tag: 0=initial, 1=any, 2=final
 				switch sub.Tag {
 				case 0:
@@ -69,8 +69,7 @@ func MatchesFilter(entry *Entry, filter *ber.Packet) bool {
 		return false
 
 	case FilterPresent:
-		attrType := filter.Data.String()
-		_, ok := entry.Attributes[attrType]
+		_, ok := entry.values(packetString(filter))
 		return ok
 	default:
 		// Unsupported filter type, default to true or false?
@@ -86,10 +85,10 @@ func checkAttributeMatch(entry *Entry, filter *ber.Packet, matcher func(string,
 	if len(filter.Children) < 2 {
 		return false
 	}
-	attr := filter.Children[0].Value.(string)
-	val := filter.Children[1].Value.(string)
+	attr := packetString(filter.Children[0])
+	val := packetString(filter.Children[1])
 
-	entryVals, ok := entry.Attributes[attr]
+	entryVals, ok := entry.values(attr)
 	if !ok {
 		// objectClass check is special?
 		// No, objectClass is just an attribute
@@ -103,3 +102,13 @@ func checkAttributeMatch(entry *Entry, filter *ber.Packet, matcher func(string,
 	}
 	return false
 }
+
+// packetString returns the string value of a packet. Context-specific
+// primitives, such as substring components and present filters, are not
+// decoded by the BER reader and carry their value only in Data.
+func packetString(p *ber.Packet) string {
+	if v, ok := p.Value.(string); ok {
+		return v
+	}
+	return p.Data.String()
+}
@@ -0,0 +1,121 @@
+package ldap
+
+import (
+	"errors"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// BindsTotal counts bind requests by outcome.
+	BindsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_ldap_binds_total",
+			Help: "Total number of LDAP bind requests",
+		},
+		[]string{"result"}, // "success", "anonymous" or "failure"
+	)
+
+	// SearchesTotal counts search requests by outcome.
+	SearchesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_ldap_searches_total",
+			Help: "Total number of LDAP search requests",
+		},
+		[]string{"result"}, // "success", "limit_exceeded" or "failure"
+	)
+
+	// WritesTotal counts add, modify, delete and password modify requests
+	// by outcome.
+	WritesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_ldap_writes_total",
+			Help: "Total number of LDAP write requests",
+		},
+		[]string{"operation", "result"}, // result is "success", "denied" or "failure"
+	)
+
+	// ProxyCacheTotal counts the lookups of the search cache of upstream
+	// directories.
+	ProxyCacheTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_ldap_proxy_cache_total",
+			Help: "Total number of LDAP proxy search cache lookups",
+		},
+		[]string{"upstream", "result"}, // result is "hit" or "miss"
+	)
+
+	// ProxyFailoversTotal counts the failovers from an upstream server to
+	// the next.
+	ProxyFailoversTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_ldap_proxy_failovers_total",
+			Help: "Total number of LDAP proxy failovers between upstream servers",
+		},
+		[]string{"upstream"},
+	)
+
+	// SearchDuration is a histogram of the time taken by searches.
+	SearchDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "quantaid_ldap_search_duration_seconds",
+			Help:    "LDAP search duration in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+)
+
+// resultCode returns the result code of a response. For several responses,
+// it is the code of the last, the SearchResultDone of a search.
+func resultCode(resp *ber.Packet) int64 {
+	if resp.ClassType == ber.ClassContext && resp.Description == "MultiResponse" {
+		if len(resp.Children) == 0 {
+			return LDAPResultOther
+		}
+		resp = resp.Children[len(resp.Children)-1]
+	}
+	if len(resp.Children) < 2 || len(resp.Children[1].Children) == 0 {
+		return LDAPResultOther
+	}
+	code, ok := resp.Children[1].Children[0].Value.(int64)
+	if !ok {
+		return LDAPResultOther
+	}
+	return code
+}
+
+func recordBind(req, resp *ber.Packet) {
+	switch {
+	case resultCode(resp) != LDAPResultSuccess:
+		BindsTotal.WithLabelValues("failure").Inc()
+	case isAnonymousBind(req):
+		BindsTotal.WithLabelValues("anonymous").Inc()
+	default:
+		BindsTotal.WithLabelValues("success").Inc()
+	}
+}
+
+func recordSearch(resp *ber.Packet) {
+	switch resultCode(resp) {
+	case LDAPResultSuccess:
+		SearchesTotal.WithLabelValues("success").Inc()
+	case LDAPResultSizeLimitExceeded, LDAPResultTimeLimitExceeded:
+		SearchesTotal.WithLabelValues("limit_exceeded").Inc()
+	default:
+		SearchesTotal.WithLabelValues("failure").Inc()
+	}
+}
+
+func recordWrite(operation string, err error) {
+	var le *ldapError
+	switch {
+	case err == nil:
+		WritesTotal.WithLabelValues(operation, "success").Inc()
+	case errors.As(err, &le) && le.code == LDAPResultInsufficientAccessRights:
+		WritesTotal.WithLabelValues(operation, "denied").Inc()
+	default:
+		WritesTotal.WithLabelValues(operation, "failure").Inc()
+	}
+}
@@ -0,0 +1,114 @@
+package ldap
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// pagingCookie is the state of a paged search (RFC 2696), returned to the
+// client as the opaque cookie of each page. The server keeps no state: the
+// cookie carries the cursor of the next page, the number of entries returned
+// so far for the size limit, and a digest of the search it belongs to.
+type pagingCookie struct {
+	cursor   Cursor
+	returned int
+	digest   [8]byte
+}
+
+const pagingCookieSize = 4*4 + 8
+
+func (c *pagingCookie) encode() []byte {
+	b := make([]byte, 0, pagingCookieSize)
+	b = binary.BigEndian.AppendUint32(b, uint32(c.cursor.Backend))
+	b = binary.BigEndian.AppendUint32(b, uint32(c.cursor.Section))
+	b = binary.BigEndian.AppendUint32(b, uint32(c.cursor.Offset))
+	b = binary.BigEndian.AppendUint32(b, uint32(c.returned))
+	return append(b, c.digest[:]...)
+}
+
+// decodePagingCookie decodes a cookie and checks that it belongs to a search.
+func decodePagingCookie(b []byte, req *SearchRequest) (*pagingCookie, bool) {
+	if len(b) != pagingCookieSize {
+		return nil, false
+	}
+	c := &pagingCookie{
+		cursor: Cursor{
+			Backend: int(binary.BigEndian.Uint32(b[0:4])),
+			Section: int(binary.BigEndian.Uint32(b[4:8])),
+			Offset:  int(binary.BigEndian.Uint32(b[8:12])),
+		},
+		returned: int(binary.BigEndian.Uint32(b[12:16])),
+	}
+	copy(c.digest[:], b[16:])
+	if c.digest != searchDigest(req) {
+		return nil, false
+	}
+	return c, true
+}
+
+// searchDigest identifies a search, so that a cookie cannot continue a
+// different one.
+func searchDigest(req *SearchRequest) [8]byte {
+	h := sha256.New()
+	h.Write([]byte(normalizeDN(req.BaseDN)))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(req.Scope)))
+	h.Write([]byte{0})
+	h.Write(req.Filter.Bytes())
+	h.Write([]byte{0})
+	h.Write([]byte(strings.ToLower(strings.Join(req.Attributes, ","))))
+	var digest [8]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// decodeControls decodes the controls of a request. It returns the paged
+// results control, if any, and whether a critical control is not supported.
+func decodeControls(controls []*ber.Packet) (paging *ldap.ControlPaging, unsupported bool) {
+	for _, packet := range controls {
+		control, err := ldap.DecodeControl(packet)
+		if err != nil {
+			unsupported = unsupported || controlCriticality(packet)
+			continue
+		}
+		if c, ok := control.(*ldap.ControlPaging); ok {
+			paging = c
+			continue
+		}
+		unsupported = unsupported || controlCriticality(packet)
+	}
+	return paging, unsupported
+}
+
+func controlCriticality(packet *ber.Packet) bool {
+	if len(packet.Children) < 2 {
+		return false
+	}
+	critical, _ := packet.Children[1].Value.(bool)
+	return critical
+}
+
+// encodePagingControl returns the paged results control of a page's result.
+// An empty cookie tells the client the search is complete.
+func encodePagingControl(cookie []byte) *ber.Packet {
+	control := &ldap.ControlPaging{Cookie: cookie}
+	if cookie == nil {
+		control.Cookie = []byte{}
+	}
+	return control.Encode()
+}
+
+// withControls appends controls to an LDAP message.
+func withControls(message *ber.Packet, controls ...*ber.Packet) *ber.Packet {
+	container := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	for _, c := range controls {
+		container.AppendChild(c)
+	}
+	message.AppendChild(container)
+	return message
+}
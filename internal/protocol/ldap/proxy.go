@@ -0,0 +1,405 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	idldap "github.com/turtacn/QuantaID/internal/identity/ldap"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidCredentials is the error of a bind with a wrong password.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// proxyCacheSize bounds the number of searches a proxy caches.
+const proxyCacheSize = 1000
+
+// proxyDNAttributes are the attributes whose values are DNs, rewritten
+// between the upstream directory and the tree.
+var proxyDNAttributes = map[string]bool{
+	"member":            true,
+	"uniquemember":      true,
+	"memberof":          true,
+	"manager":           true,
+	"owner":             true,
+	"seealso":           true,
+	"distinguishedname": true,
+}
+
+// ProxyConfig configures the proxy of an upstream directory, such as Active
+// Directory.
+type ProxyConfig struct {
+	Name string
+	// URLs are the ldap:// or ldaps:// URLs of the servers of the
+	// directory. The first that answers is used, the next when it fails.
+	URLs []string
+	// BindDN and BindPassword are the service account searches are made
+	// with.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the upstream entry served as Suffix in the tree; the DNs
+	// below it are rewritten accordingly.
+	BaseDN string
+	Suffix string
+	// CacheTTL is how long search results are reused. 0 disables caching.
+	CacheTTL time.Duration
+	// Timeout bounds connections and requests to the upstream servers.
+	Timeout time.Duration
+	// TLSConfig is the TLS configuration of ldaps:// URLs.
+	TLSConfig *tls.Config
+}
+
+// ProxyBackend serves an upstream directory below a suffix of the tree and
+// passes binds to its entries through to it.
+type ProxyBackend struct {
+	name         string
+	urls         []string
+	bindDN       string
+	bindPassword string
+	baseDN       *ldap.DN
+	suffixDN     *ldap.DN
+	suffix       string // normalized Suffix
+	cacheTTL     time.Duration
+	timeout      time.Duration
+	tlsConfig    *tls.Config
+	logger       *zap.Logger
+
+	mu      sync.Mutex
+	clients []*idldap.LDAPClient // connections by URL, nil until used
+	current int                  // index of the URL in use
+	cache   map[string]cachedSearch
+}
+
+// cachedSearch is the result of an upstream search, rewritten for the
+// tree.
+type cachedSearch struct {
+	entries []*Entry
+	expires time.Time
+}
+
+// NewProxyBackend creates the proxy of an upstream directory.
+func NewProxyBackend(config ProxyConfig, logger *zap.Logger) (*ProxyBackend, error) {
+	if len(config.URLs) == 0 {
+		return nil, fmt.Errorf("upstream %s has no URLs", config.Name)
+	}
+	baseDN, err := ldap.ParseDN(config.BaseDN)
+	if err != nil || len(baseDN.RDNs) == 0 {
+		return nil, fmt.Errorf("upstream %s has an invalid base DN %q", config.Name, config.BaseDN)
+	}
+	suffixDN, err := ldap.ParseDN(config.Suffix)
+	if err != nil || len(suffixDN.RDNs) == 0 {
+		return nil, fmt.Errorf("upstream %s has an invalid suffix %q", config.Name, config.Suffix)
+	}
+	return &ProxyBackend{
+		name:         config.Name,
+		urls:         config.URLs,
+		bindDN:       config.BindDN,
+		bindPassword: config.BindPassword,
+		baseDN:       baseDN,
+		suffixDN:     suffixDN,
+		suffix:       normalizeDN(config.Suffix),
+		cacheTTL:     config.CacheTTL,
+		timeout:      config.Timeout,
+		tlsConfig:    config.TLSConfig,
+		logger:       logger,
+		clients:      make([]*idldap.LDAPClient, len(config.URLs)),
+		cache:        make(map[string]cachedSearch),
+	}, nil
+}
+
+// SearchPage searches the upstream directory, when the search reaches the
+// suffix, and pages through the results, which are cached so that the
+// following pages are read from the cache.
+func (p *ProxyBackend) SearchPage(ctx context.Context, req *SearchRequest, from Cursor, limit int) ([]*Entry, *Cursor, error) {
+	base, scope, ok := p.upstreamScope(req.BaseDN, req.Scope)
+	if !ok {
+		return nil, nil, nil
+	}
+	filter, err := p.upstreamFilter(req.Filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := p.cachedSearch(ctx, base, scope, filter, req.Attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if from.Offset >= len(entries) {
+		return nil, nil, nil
+	}
+	entries = entries[from.Offset:]
+	if limit > 0 && len(entries) > limit {
+		return entries[:limit], &Cursor{Offset: from.Offset + limit}, nil
+	}
+	return entries, nil, nil
+}
+
+// upstreamScope returns the upstream base and scope of a search of the
+// tree. ok is false when the search does not reach the suffix.
+func (p *ProxyBackend) upstreamScope(baseDN string, scope int) (string, int, bool) {
+	base := normalizeDN(baseDN)
+	if baseDN != "" && isUnder(base, p.suffix) {
+		upstream, ok := rebase(baseDN, p.suffixDN, p.baseDN)
+		return upstream, scope, ok
+	}
+	if baseDN != "" && !isUnder(p.suffix, base) {
+		return "", 0, false
+	}
+	// The suffix is below the search base.
+	switch scope {
+	case ScopeWholeSubtree:
+		return p.baseDN.String(), ScopeWholeSubtree, true
+	case ScopeSingleLevel:
+		parent := normalizeDN((&ldap.DN{RDNs: p.suffixDN.RDNs[1:]}).String())
+		if parent == base {
+			return p.baseDN.String(), ScopeBaseObject, true
+		}
+	}
+	return "", 0, false
+}
+
+// upstreamFilter returns the string form of a filter, with the DNs of
+// equality matches on DN-valued attributes rewritten for the upstream
+// directory.
+func (p *ProxyBackend) upstreamFilter(filter *ber.Packet) (string, error) {
+	switch filter.Tag {
+	case FilterAnd, FilterOr:
+		var b strings.Builder
+		b.WriteString("(")
+		if filter.Tag == FilterAnd {
+			b.WriteString("&")
+		} else {
+			b.WriteString("|")
+		}
+		for _, child := range filter.Children {
+			s, err := p.upstreamFilter(child)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		}
+		b.WriteString(")")
+		return b.String(), nil
+	case FilterNot:
+		if len(filter.Children) != 1 {
+			return "", fmt.Errorf("invalid not filter")
+		}
+		s, err := p.upstreamFilter(filter.Children[0])
+		if err != nil {
+			return "", err
+		}
+		return "(!" + s + ")", nil
+	case FilterEqualityMatch:
+		if len(filter.Children) == 2 {
+			attr, value := packetString(filter.Children[0]), packetString(filter.Children[1])
+			if proxyDNAttributes[strings.ToLower(attr)] {
+				if upstream, ok := rebase(value, p.suffixDN, p.baseDN); ok {
+					return "(" + attr + "=" + ldap.EscapeFilter(upstream) + ")", nil
+				}
+			}
+		}
+	}
+	return ldap.DecompileFilter(filter)
+}
+
+// cachedSearch returns the entries of an upstream search, from the cache
+// while they are fresh.
+func (p *ProxyBackend) cachedSearch(ctx context.Context, base string, scope int, filter string, attrs []string) ([]*Entry, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%s\x00%s", strings.ToLower(base), scope, filter, strings.ToLower(strings.Join(attrs, ",")))
+	now := time.Now()
+	if p.cacheTTL > 0 {
+		p.mu.Lock()
+		cached, ok := p.cache[key]
+		p.mu.Unlock()
+		if ok && now.Before(cached.expires) {
+			ProxyCacheTotal.WithLabelValues(p.name, "hit").Inc()
+			return cached.entries, nil
+		}
+		ProxyCacheTotal.WithLabelValues(p.name, "miss").Inc()
+	}
+
+	upstream, err := p.search(ctx, base, scope, filter, attrs)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(upstream))
+	for _, e := range upstream {
+		if entry, ok := p.entry(e); ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	if p.cacheTTL > 0 {
+		p.mu.Lock()
+		if len(p.cache) >= proxyCacheSize {
+			for k, c := range p.cache {
+				if now.After(c.expires) {
+					delete(p.cache, k)
+				}
+			}
+		}
+		if len(p.cache) >= proxyCacheSize {
+			// Still full of fresh results: start over rather than track
+			// their use.
+			p.cache = make(map[string]cachedSearch)
+		}
+		p.cache[key] = cachedSearch{entries: entries, expires: now.Add(p.cacheTTL)}
+		p.mu.Unlock()
+	}
+	return entries, nil
+}
+
+// entry rewrites an upstream entry for the tree. ok is false for entries
+// outside the upstream base, which have no place in the tree.
+func (p *ProxyBackend) entry(e *ldap.Entry) (*Entry, bool) {
+	dn, ok := rebase(e.DN, p.baseDN, p.suffixDN)
+	if !ok {
+		return nil, false
+	}
+	entry := &Entry{DN: dn, Attributes: make(map[string][]string, len(e.Attributes))}
+	for _, attr := range e.Attributes {
+		values := attr.Values
+		if proxyDNAttributes[strings.ToLower(attr.Name)] {
+			values = make([]string, len(attr.Values))
+			for i, v := range attr.Values {
+				if rebased, ok := rebase(v, p.baseDN, p.suffixDN); ok {
+					v = rebased
+				}
+				values[i] = v
+			}
+		}
+		entry.Attributes[attr.Name] = values
+	}
+	return entry, true
+}
+
+// search runs a search on the upstream servers, failing over to the next
+// server when one cannot be reached. A base that does not exist upstream
+// has no entries.
+func (p *ProxyBackend) search(ctx context.Context, base string, scope int, filter string, attrs []string) ([]*ldap.Entry, error) {
+	var lastErr error
+	for attempt := 0; attempt < len(p.urls); attempt++ {
+		i, client, err := p.client()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		entries, err := client.SearchScope(ctx, base, scope, filter, attrs)
+		switch {
+		case err == nil:
+			return entries, nil
+		case ldap.IsErrorWithCode(err, LDAPResultNoSuchObject):
+			return nil, nil
+		case !ldap.IsErrorWithCode(err, ldap.ErrorNetwork):
+			return nil, err
+		}
+		p.fail(i, client, err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("upstream %s unavailable: %w", p.name, lastErr)
+}
+
+// client returns the connection to the server in use, connecting to it
+// first if needed. When it cannot be reached, the next server is used.
+func (p *ProxyBackend) client() (int, *idldap.LDAPClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.current
+	if p.clients[i] != nil {
+		return i, p.clients[i], nil
+	}
+	client := p.newClient(p.urls[i], p.bindDN, p.bindPassword)
+	if err := client.Connect(); err != nil {
+		client.Close()
+		p.failover(i, err)
+		return i, nil, err
+	}
+	p.clients[i] = client
+	return i, client, nil
+}
+
+// fail drops the connection to a server that failed and moves to the next.
+func (p *ProxyBackend) fail(i int, client *idldap.LDAPClient, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients[i] == client {
+		client.Close()
+		p.clients[i] = nil
+		p.failover(i, err)
+	}
+}
+
+// failover moves to the server after a failed one. The caller must hold
+// the lock.
+func (p *ProxyBackend) failover(i int, err error) {
+	if p.current != i {
+		return
+	}
+	p.current = (i + 1) % len(p.urls)
+	ProxyFailoversTotal.WithLabelValues(p.name).Inc()
+	p.logger.Warn("Upstream LDAP server failed", zap.String("upstream", p.name), zap.String("url", p.urls[i]), zap.String("next", p.urls[p.current]), zap.Error(err))
+}
+
+func (p *ProxyBackend) newClient(url, user, password string) *idldap.LDAPClient {
+	client := idldap.NewLDAPClient(url, user, password)
+	client.SetTLSConfig(p.tlsConfig)
+	client.SetTimeout(p.timeout)
+	return client
+}
+
+// Bind passes a bind to an entry below the suffix through to the upstream
+// servers, starting with the one in use.
+func (p *ProxyBackend) Bind(ctx context.Context, dn, password string) (bool, error) {
+	upstreamDN, ok := rebase(dn, p.suffixDN, p.baseDN)
+	if !ok {
+		return false, nil
+	}
+	if password == "" {
+		// Would be an unauthenticated bind upstream, which proves nothing.
+		return true, ErrInvalidCredentials
+	}
+
+	p.mu.Lock()
+	start := p.current
+	p.mu.Unlock()
+	var lastErr error
+	for attempt := 0; attempt < len(p.urls); attempt++ {
+		url := p.urls[(start+attempt)%len(p.urls)]
+		client := p.newClient(url, upstreamDN, password)
+		err := client.Connect()
+		client.Close()
+		switch {
+		case err == nil:
+			return true, nil
+		case ldap.IsErrorWithCode(err, LDAPResultInvalidCredentials):
+			return true, ErrInvalidCredentials
+		case !ldap.IsErrorWithCode(err, ldap.ErrorNetwork):
+			return true, err
+		}
+		p.logger.Warn("Upstream LDAP server failed a bind", zap.String("upstream", p.name), zap.String("url", url), zap.Error(err))
+		lastErr = err
+	}
+	return true, fmt.Errorf("upstream %s unavailable: %w", p.name, lastErr)
+}
+
+// rebase moves a DN from below one base to below another. ok is false when
+// the DN is not at or below from.
+func rebase(dn string, from, to *ldap.DN) (string, bool) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", false
+	}
+	n := len(parsed.RDNs) - len(from.RDNs)
+	if n < 0 || !(&ldap.DN{RDNs: parsed.RDNs[n:]}).EqualFold(from) {
+		return "", false
+	}
+	rdns := append(parsed.RDNs[:n:n], to.RDNs...)
+	return (&ldap.DN{RDNs: rdns}).String(), true
+}
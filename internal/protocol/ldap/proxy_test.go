@@ -0,0 +1,170 @@
+package ldap
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+const (
+	corpSuffix = "ou=corp,dc=example,dc=com"
+	jdoeDN     = "uid=jdoe,ou=users,ou=corp,dc=example,dc=com"
+	staffDN    = "cn=staff,ou=groups,ou=corp,dc=example,dc=com"
+)
+
+// newUpstream starts the server of an upstream directory at
+// dc=corp,dc=example,dc=com, with a service account, user jdoe and group
+// staff, and returns its URL. The caller stops it.
+func newUpstream(t *testing.T) (*Server, string) {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	svc := &types.User{ID: "svc-id", Username: "svc", Email: "svc@corp.example.com", Status: types.UserStatusActive}
+	jdoe := &types.User{ID: "jdoe-id", Username: "jdoe", Email: "jdoe@corp.example.com", Status: types.UserStatusActive}
+	require.NoError(t, repo.CreateUser(ctx, svc))
+	require.NoError(t, repo.CreateUser(ctx, jdoe))
+	staff := &types.UserGroup{Name: "staff"}
+	require.NoError(t, repo.CreateGroup(ctx, staff))
+	require.NoError(t, repo.AddUserToGroup(ctx, jdoe.ID, staff.ID))
+
+	identitySvc := identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))
+	server := NewServer("127.0.0.1:0", "dc=corp,dc=example,dc=com", nil, identitySvc, staticPasswords{svc.ID: "svc-secret", jdoe.ID: "jdoe-secret"}, zap.NewNop())
+	require.NoError(t, server.Start())
+	return server, "ldap://" + server.listener.Addr().String()
+}
+
+func newTestProxy(t *testing.T, name string, urls ...string) *ProxyBackend {
+	proxy, err := NewProxyBackend(ProxyConfig{
+		Name:         name,
+		URLs:         urls,
+		BindDN:       "uid=svc,ou=users,dc=corp,dc=example,dc=com",
+		BindPassword: "svc-secret",
+		BaseDN:       "dc=corp,dc=example,dc=com",
+		Suffix:       corpSuffix,
+		CacheTTL:     time.Minute,
+		Timeout:      5 * time.Second,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	return proxy
+}
+
+func TestProxyMergedWithLocal(t *testing.T) {
+	upstream, upstreamURL := newUpstream(t)
+	t.Cleanup(upstream.Stop)
+	server := newTLSTestServer(t, "127.0.0.1:0")
+	require.NoError(t, server.SetBackend(NewMergedBackend(server.LocalBackend(), newTestProxy(t, "merged", upstreamURL))))
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+
+	conn, err := ldap.DialURL("ldap://" + server.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	d := &directory{conn: conn}
+
+	// Upstream entries are found below the suffix, with DNs rewritten.
+	entries := d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree, "(uid=jdoe)")
+	require.Len(t, entries, 1)
+	assert.Equal(t, jdoeDN, entries[0].DN)
+	assert.Equal(t, []string{staffDN}, entries[0].GetAttributeValues("memberOf"))
+	entries = d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree, "(memberOf="+staffDN+")")
+	assert.Equal(t, []string{jdoeDN}, dns(entries))
+	entries = d.search(t, "dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=*)")
+	assert.ElementsMatch(t, []string{"ou=users,dc=example,dc=com", "ou=groups,dc=example,dc=com", corpSuffix}, dns(entries))
+
+	// Paged searches run across the local and upstream entries.
+	all := d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree, "(objectClass=*)")
+	paged, err := conn.SearchWithPaging(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil), 2)
+	require.NoError(t, err)
+	assert.Equal(t, dns(all), dns(paged.Entries))
+	assert.Contains(t, dns(all), aliceDN)
+	assert.Contains(t, dns(all), staffDN)
+
+	// Binds to upstream entries pass through, local binds are unchanged.
+	assert.True(t, ldap.IsErrorWithCode(conn.Bind(jdoeDN, "wrong"), ldap.LDAPResultInvalidCredentials))
+	require.NoError(t, conn.Bind(jdoeDN, "jdoe-secret"))
+	who, err := conn.WhoAmI(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "dn:"+jdoeDN, who.AuthzID)
+	assert.NoError(t, conn.Bind(aliceDN, "secret"))
+
+	matched, err := conn.Compare(staffDN, "member", jdoeDN)
+	require.NoError(t, err)
+	assert.True(t, matched)
+}
+
+func TestProxyFailoverAndCache(t *testing.T) {
+	upstream, upstreamURL := newUpstream(t)
+	var stopped sync.Once
+	stopUpstream := func() { stopped.Do(upstream.Stop) }
+	t.Cleanup(stopUpstream)
+	proxy := newTestProxy(t, "failover", "ldap://127.0.0.1:1", upstreamURL)
+	server := newTLSTestServer(t, "127.0.0.1:0")
+	require.NoError(t, server.SetBackend(proxy))
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+
+	conn, err := ldap.DialURL("ldap://" + server.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	d := &directory{conn: conn}
+
+	failovers := testutil.ToFloat64(ProxyFailoversTotal.WithLabelValues("failover"))
+	entries := d.search(t, corpSuffix, ldap.ScopeWholeSubtree, "(uid=jdoe)")
+	assert.Equal(t, []string{jdoeDN}, dns(entries))
+	assert.Equal(t, failovers+1, testutil.ToFloat64(ProxyFailoversTotal.WithLabelValues("failover")))
+
+	// Cached results outlive the upstream.
+	hits := testutil.ToFloat64(ProxyCacheTotal.WithLabelValues("failover", "hit"))
+	stopUpstream()
+	entries = d.search(t, corpSuffix, ldap.ScopeWholeSubtree, "(uid=jdoe)")
+	assert.Equal(t, []string{jdoeDN}, dns(entries))
+	assert.Equal(t, hits+1, testutil.ToFloat64(ProxyCacheTotal.WithLabelValues("failover", "hit")))
+
+	// Without local users, local binds and writes are refused, and binds to
+	// an unreachable upstream are not taken for wrong passwords.
+	assert.True(t, ldap.IsErrorWithCode(conn.Bind(aliceDN, "secret"), ldap.LDAPResultInvalidCredentials))
+	assert.True(t, ldap.IsErrorWithCode(conn.Bind(jdoeDN, "jdoe-secret"), ldap.LDAPResultUnavailable))
+}
+
+func TestSetBackendChecksSuffixes(t *testing.T) {
+	server := newTLSTestServer(t, "127.0.0.1:0")
+	proxy := func(suffix string) *ProxyBackend {
+		p, err := NewProxyBackend(ProxyConfig{Name: suffix, URLs: []string{"ldap://127.0.0.1:1"}, BaseDN: "dc=corp,dc=example,dc=com", Suffix: suffix}, zap.NewNop())
+		require.NoError(t, err)
+		return p
+	}
+
+	assert.NoError(t, server.SetBackend(NewMergedBackend(server.LocalBackend(), proxy(corpSuffix))))
+	assert.Error(t, server.SetBackend(NewMergedBackend(server.LocalBackend(), proxy("ou=corp,ou=users,dc=example,dc=com"))))
+	assert.Error(t, server.SetBackend(NewMergedBackend(server.LocalBackend(), proxy("dc=example,dc=com"))))
+	assert.Error(t, server.SetBackend(NewMergedBackend(proxy(corpSuffix), proxy("ou=eu,"+corpSuffix))))
+	// A pure proxy can serve an upstream at the base of the tree.
+	assert.NoError(t, server.SetBackend(proxy("dc=example,dc=com")))
+}
+
+func TestRebase(t *testing.T) {
+	from, err := ldap.ParseDN("DC=corp,DC=example,DC=com")
+	require.NoError(t, err)
+	to, err := ldap.ParseDN("ou=corp,dc=quantaid,dc=local")
+	require.NoError(t, err)
+
+	dn, ok := rebase("CN=John Doe,OU=Staff,dc=CORP,dc=example,dc=com", from, to)
+	assert.True(t, ok)
+	assert.Equal(t, "cn=John Doe,ou=Staff,ou=corp,dc=quantaid,dc=local", dn)
+	dn, ok = rebase("DC=corp,DC=example,DC=com", from, to)
+	assert.True(t, ok)
+	assert.Equal(t, "ou=corp,dc=quantaid,dc=local", dn)
+	_, ok = rebase("cn=other,dc=example,dc=com", from, to)
+	assert.False(t, ok)
+}
@@ -0,0 +1,232 @@
+package ldap
+
+import (
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// searchQuery is what a search requires of the entries it can match, in terms
+// the repositories can look up. It is derived from the search base and filter
+// and may match more entries than the filter does: every candidate is still
+// checked against the filter. Nil lists leave a property unconstrained.
+type searchQuery struct {
+	noUsers  bool
+	noGroups bool
+
+	usernames []string
+	emails    []string
+	substring string
+	memberOf  string // name of a group users must belong to
+
+	groupNames []string
+	members    []string // usernames of which groups must contain one
+}
+
+// userOnlyAttributes and groupOnlyAttributes are present on one kind of entry
+// only, so filters on them rule out the other kind.
+var (
+	userOnlyAttributes  = []string{"uid", "mail", "sn", "givenname", "memberof"}
+	groupOnlyAttributes = []string{"member", "uniquemember"}
+)
+
+// queryForFilter derives the search query of a filter.
+func (vt *VirtualTree) queryForFilter(filter *ber.Packet) searchQuery {
+	switch filter.Tag {
+	case FilterAnd:
+		q := searchQuery{}
+		for _, child := range filter.Children {
+			q = q.and(vt.queryForFilter(child))
+		}
+		return q
+	case FilterOr:
+		children := make([]searchQuery, 0, len(filter.Children))
+		for _, child := range filter.Children {
+			children = append(children, vt.queryForFilter(child))
+		}
+		return or(children)
+	case FilterEqualityMatch:
+		if len(filter.Children) < 2 {
+			return searchQuery{}
+		}
+		return vt.queryForEquality(strings.ToLower(packetString(filter.Children[0])), packetString(filter.Children[1]))
+	case FilterSubstrings:
+		if len(filter.Children) < 2 {
+			return searchQuery{}
+		}
+		attr := strings.ToLower(packetString(filter.Children[0]))
+		q := queryForAttribute(attr)
+		if attr == "uid" || attr == "mail" {
+			// The longest component narrows the candidates the most.
+			for _, sub := range filter.Children[1].Children {
+				if v := packetString(sub); len(v) > len(q.substring) {
+					q.substring = v
+				}
+			}
+		}
+		return q
+	case FilterPresent:
+		return queryForAttribute(strings.ToLower(packetString(filter)))
+	default:
+		return searchQuery{}
+	}
+}
+
+func (vt *VirtualTree) queryForEquality(attr, value string) searchQuery {
+	q := queryForAttribute(attr)
+	switch attr {
+	case "objectclass":
+		q.noUsers = !containsFold(userObjectClasses, value)
+		q.noGroups = !containsFold(groupObjectClasses, value)
+	case "uid":
+		q.usernames = []string{value}
+	case "mail":
+		q.emails = []string{value}
+	case "cn":
+		q.groupNames = []string{value}
+	case "memberof":
+		if name, ok := vt.childName(value, groupsOU, "cn"); ok {
+			q.memberOf = name
+		} else {
+			q.noUsers = true
+		}
+	case "member", "uniquemember":
+		if name, ok := vt.childName(value, usersOU, "uid"); ok {
+			q.members = []string{name}
+		} else {
+			q.noGroups = true
+		}
+	}
+	return q
+}
+
+// queryForAttribute rules out the entries that cannot have an attribute.
+func queryForAttribute(attr string) searchQuery {
+	return searchQuery{
+		noUsers:  containsFold(groupOnlyAttributes, attr),
+		noGroups: containsFold(userOnlyAttributes, attr),
+	}
+}
+
+// and combines the queries of the parts of an AND filter.
+func (q searchQuery) and(o searchQuery) searchQuery {
+	r := searchQuery{
+		noUsers:    q.noUsers || o.noUsers,
+		noGroups:   q.noGroups || o.noGroups,
+		usernames:  intersect(q.usernames, o.usernames),
+		emails:     intersect(q.emails, o.emails),
+		groupNames: intersect(q.groupNames, o.groupNames),
+		members:    intersect(q.members, o.members),
+		substring:  q.substring,
+		memberOf:   q.memberOf,
+	}
+	if len(o.substring) > len(r.substring) {
+		r.substring = o.substring
+	}
+	if r.memberOf == "" {
+		r.memberOf = o.memberOf
+	}
+	if isEmpty(r.usernames) || isEmpty(r.emails) {
+		r.noUsers = true
+	}
+	if isEmpty(r.groupNames) || isEmpty(r.members) {
+		r.noGroups = true
+	}
+	return r
+}
+
+// or combines the queries of the parts of an OR filter. Only a list of
+// alternatives for the same property, as in (|(uid=a)(uid=b)), constrains the
+// result; anything else leaves it unconstrained.
+func or(queries []searchQuery) searchQuery {
+	r := searchQuery{noUsers: true, noGroups: true}
+	var users, groups []searchQuery
+	for _, q := range queries {
+		if !q.noUsers {
+			users = append(users, q)
+		}
+		if !q.noGroups {
+			groups = append(groups, q)
+		}
+	}
+	if len(users) > 0 {
+		r.noUsers = false
+		r.usernames = union(users, func(q searchQuery) []string { return q.usernames }, func(q searchQuery) bool {
+			return q.emails == nil && q.substring == "" && q.memberOf == ""
+		})
+		r.emails = union(users, func(q searchQuery) []string { return q.emails }, func(q searchQuery) bool {
+			return q.usernames == nil && q.substring == "" && q.memberOf == ""
+		})
+	}
+	if len(groups) > 0 {
+		r.noGroups = false
+		r.groupNames = union(groups, func(q searchQuery) []string { return q.groupNames }, func(q searchQuery) bool {
+			return q.members == nil
+		})
+		r.members = union(groups, func(q searchQuery) []string { return q.members }, func(q searchQuery) bool {
+			return q.groupNames == nil
+		})
+	}
+	return r
+}
+
+// union joins one list of every query, or returns nil when a query does not
+// have that list as its only constraint.
+func union(queries []searchQuery, list func(searchQuery) []string, only func(searchQuery) bool) []string {
+	var values []string
+	for _, q := range queries {
+		if list(q) == nil || !only(q) {
+			return nil
+		}
+		values = append(values, list(q)...)
+	}
+	return values
+}
+
+// intersect returns the values in both lists, treating nil as "anything".
+func intersect(a, b []string) []string {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	values := []string{}
+	for _, v := range a {
+		if containsFold(b, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// isEmpty reports whether a list constrains a property to no value at all.
+func isEmpty(values []string) bool {
+	return values != nil && len(values) == 0
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterUses reports whether a filter tests an attribute.
+func filterUses(filter *ber.Packet, attr string) bool {
+	switch filter.Tag {
+	case FilterAnd, FilterOr, FilterNot:
+		for _, child := range filter.Children {
+			if filterUses(child, attr) {
+				return true
+			}
+		}
+		return false
+	case FilterPresent:
+		return strings.EqualFold(packetString(filter), attr)
+	default:
+		return len(filter.Children) > 0 && strings.EqualFold(packetString(filter.Children[0]), attr)
+	}
+}
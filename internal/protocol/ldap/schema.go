@@ -98,8 +98,11 @@ type ServerConfig struct {
 	BaseDN   string
 }
 
-// Helper to write LDAP Result
-func encodeLDAPResult(messageID int64, appTag ber.Tag, resultCode int, matchedDN string, errorMessage string) *ber.Packet {
+// Helper to write LDAP Result. The fields that follow the LDAPResult in some
+// responses, such as the responseName of an ExtendedResponse, are passed as
+// extra; they must be added before the operation is added to the message,
+// whose encoding does not follow later changes to its children.
+func encodeLDAPResult(messageID int64, appTag ber.Tag, resultCode int, matchedDN string, errorMessage string, extra ...*ber.Packet) *ber.Packet {
 	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
 	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
 
@@ -107,6 +110,9 @@ func encodeLDAPResult(messageID int64, appTag ber.Tag, resultCode int, matchedDN
 	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), "ResultCode"))
 	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, matchedDN, "MatchedDN"))
 	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, errorMessage, "ErrorMessage"))
+	for _, field := range extra {
+		op.AppendChild(field)
+	}
 
 	packet.AppendChild(op)
 	return packet
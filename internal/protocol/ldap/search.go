@@ -2,6 +2,9 @@ package ldap
 
 import (
 	"context"
+	"errors"
+	"strings"
+	"time"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
 	"go.uber.org/zap"
@@ -12,7 +15,10 @@ type Entry struct {
 	Attributes map[string][]string
 }
 
-func (s *Server) HandleSearch(ctx context.Context, messageID int64, req *ber.Packet) *ber.Packet {
+// HandleSearch answers a SearchRequest. It honours the size and time limits
+// of the request, capped by the server's, and the Simple Paged Results
+// control (RFC 2696) among the request's controls.
+func (s *Server) HandleSearch(ctx context.Context, messageID int64, req *ber.Packet, controls []*ber.Packet) *ber.Packet {
 	// SearchRequest ::= [APPLICATION 3] SEQUENCE {
 	//     baseObject      LDAPDN,
 	//     scope           ENUMERATED { baseObject (0), singleLevel (1), wholeSubtree (2) },
@@ -30,8 +36,8 @@ func (s *Server) HandleSearch(ctx context.Context, messageID int64, req *ber.Pac
 	baseObject := req.Children[0].Value.(string)
 	scope := req.Children[1].Value.(int64)
 	// derefAliases := req.Children[2].Value.(int64)
-	// sizeLimit := req.Children[3].Value.(int64)
-	// timeLimit := req.Children[4].Value.(int64)
+	sizeLimit, _ := req.Children[3].Value.(int64)
+	timeLimit, _ := req.Children[4].Value.(int64)
 	// typesOnly := req.Children[5].Value.(bool)
 	filterPacket := req.Children[6]
 	attributesPacket := req.Children[7]
@@ -43,18 +49,82 @@ func (s *Server) HandleSearch(ctx context.Context, messageID int64, req *ber.Pac
 
 	s.logger.Debug("Search Request", zap.String("base", baseObject), zap.Int64("scope", scope))
 
-	entries, err := s.virtualTree.Search(ctx, baseObject, int(scope), filterPacket, requestedAttrs)
-	if err != nil {
+	paging, unsupported := decodeControls(controls)
+	if unsupported {
+		return encodeLDAPResult(messageID, ApplicationSearchResultDone, LDAPResultUnavailableCriticalExtension, "", "Unsupported critical control")
+	}
+
+	search := &SearchRequest{BaseDN: baseObject, Scope: int(scope), Filter: filterPacket, Attributes: requestedAttrs}
+	size := effectiveLimit(int(sizeLimit), s.maxSizeLimit)
+	if limit := effectiveLimit(int(timeLimit), int(s.maxTimeLimit/time.Second)); limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(limit)*time.Second)
+		defer cancel()
+	}
+
+	// A page is read one entry past the size limit to tell whether the
+	// limit was exceeded.
+	var cookie *pagingCookie
+	limit := 0
+	if size > 0 {
+		limit = size + 1
+	}
+	if paging != nil {
+		cookie = &pagingCookie{digest: searchDigest(search)}
+		if len(paging.Cookie) > 0 {
+			var ok bool
+			if cookie, ok = decodePagingCookie(paging.Cookie, search); !ok {
+				return encodeLDAPResult(messageID, ApplicationSearchResultDone, LDAPResultUnwillingToPerform, "", "Invalid paged results cookie")
+			}
+		}
+		if paging.PagingSize == 0 {
+			// A page size of 0 abandons the paged search.
+			return withControls(encodeLDAPResult(messageID, ApplicationSearchResultDone, LDAPResultSuccess, "", ""), encodePagingControl(nil))
+		}
+		if size > 0 && size-cookie.returned < int(paging.PagingSize) {
+			limit = size - cookie.returned + 1
+		} else {
+			limit = int(paging.PagingSize)
+		}
+	}
+
+	from := Cursor{}
+	if cookie != nil {
+		from = cookie.cursor
+	}
+	entries, next, err := s.virtualTree.SearchPage(ctx, search, from, limit)
+	resultCode, message := LDAPResultSuccess, ""
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		resultCode, message, next = LDAPResultTimeLimitExceeded, "Time limit exceeded", nil
+	case err != nil:
 		s.logger.Error("Search error", zap.Error(err))
 		return encodeLDAPResult(messageID, ApplicationSearchResultDone, LDAPResultOperationsError, "", err.Error())
 	}
+	returned := len(entries)
+	if cookie != nil {
+		returned += cookie.returned
+	}
+	if size > 0 && returned > size {
+		entries = entries[:len(entries)-(returned-size)]
+		resultCode, message, next = LDAPResultSizeLimitExceeded, "Size limit exceeded", nil
+	}
 
 	var responses []*ber.Packet
 	for _, entry := range entries {
 		responses = append(responses, encodeSearchResultEntry(messageID, entry))
 	}
 
-	responses = append(responses, encodeLDAPResult(messageID, ApplicationSearchResultDone, LDAPResultSuccess, "", ""))
+	done := encodeLDAPResult(messageID, ApplicationSearchResultDone, resultCode, "", message)
+	if paging != nil {
+		var nextCookie []byte
+		if next != nil {
+			cookie.cursor, cookie.returned = *next, returned
+			nextCookie = cookie.encode()
+		}
+		done = withControls(done, encodePagingControl(nextCookie))
+	}
+	responses = append(responses, done)
 
 	// Hack: We need to return multiple packets, but the interface returns one.
 	// We will return a special sequence that handleConnection will need to unwrap,
@@ -73,6 +143,29 @@ func (s *Server) HandleSearch(ctx context.Context, messageID int64, req *ber.Pac
 	return container
 }
 
+// effectiveLimit returns the smaller of a requested and a configured limit,
+// where 0 means no limit.
+func effectiveLimit(requested, max int) int {
+	if requested <= 0 || (max > 0 && requested > max) {
+		return max
+	}
+	return requested
+}
+
+// values returns the values of an attribute, whose name is matched
+// case-insensitively.
+func (e *Entry) values(attr string) ([]string, bool) {
+	if vals, ok := e.Attributes[attr]; ok {
+		return vals, true
+	}
+	for name, vals := range e.Attributes {
+		if strings.EqualFold(name, attr) {
+			return vals, true
+		}
+	}
+	return nil, false
+}
+
 // Helper to encode Entry
 func encodeSearchResultEntry(messageID int64, entry *Entry) *ber.Packet {
 	// LDAP Message Sequence
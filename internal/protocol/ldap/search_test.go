@@ -0,0 +1,224 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+// recordingIdentity records the user filters a search asks the repository for.
+type recordingIdentity struct {
+	identity.IService
+	filters []types.UserFilter
+}
+
+func (r *recordingIdentity) ListUsers(ctx context.Context, filter types.UserFilter) ([]*types.User, int, error) {
+	r.filters = append(r.filters, filter)
+	return r.IService.ListUsers(ctx, filter)
+}
+
+type directory struct {
+	conn     *ldap.Conn
+	identity *recordingIdentity
+	users    *memory.IdentityMemoryRepository
+}
+
+func newDirectory(t *testing.T) *directory {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	svc := &recordingIdentity{IService: identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))}
+
+	userIDs := map[string]string{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		u := &types.User{Username: name, Email: types.EncryptedString(name + "@example.com"), Status: types.UserStatusActive}
+		require.NoError(t, repo.CreateUser(ctx, u))
+		userIDs[name] = u.ID
+	}
+	for group, members := range map[string][]string{"admins": {"alice"}, "developers": {"alice", "bob"}} {
+		g := &types.UserGroup{Name: group, Description: group + " group"}
+		require.NoError(t, repo.CreateGroup(ctx, g))
+		for _, m := range members {
+			require.NoError(t, repo.AddUserToGroup(ctx, userIDs[m], g.ID))
+		}
+	}
+
+	server := NewServer("127.0.0.1:0", "dc=example,dc=com", nil, svc, nil, zap.NewNop())
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+	conn, err := ldap.DialURL("ldap://" + server.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &directory{conn: conn, identity: svc, users: repo}
+}
+
+func (d *directory) search(t *testing.T, base string, scope int, filter string, attrs ...string) []*ldap.Entry {
+	sr, err := d.conn.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, 0, 0, false, filter, attrs, nil))
+	require.NoError(t, err)
+	return sr.Entries
+}
+
+func dns(entries []*ldap.Entry) []string {
+	var dns []string
+	for _, e := range entries {
+		dns = append(dns, e.DN)
+	}
+	return dns
+}
+
+func TestSearchGroups(t *testing.T) {
+	d := newDirectory(t)
+
+	entries := d.search(t, "ou=groups,dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=groupOfNames)", "cn", "member", "uniqueMember")
+	require.Len(t, entries, 2)
+	assert.Equal(t, "cn=admins,ou=groups,dc=example,dc=com", entries[0].DN)
+	assert.Equal(t, []string{"uid=alice,ou=users,dc=example,dc=com"}, entries[0].GetAttributeValues("member"))
+	assert.Equal(t, []string{"uid=alice,ou=users,dc=example,dc=com", "uid=bob,ou=users,dc=example,dc=com"}, entries[1].GetAttributeValues("uniqueMember"))
+
+	// The group search of Jenkins and GitLab: the groups of one user.
+	entries = d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree,
+		"(&(objectClass=groupOfUniqueNames)(uniqueMember=uid=bob,ou=users,dc=example,dc=com))", "cn")
+	assert.Equal(t, []string{"cn=developers,ou=groups,dc=example,dc=com"}, dns(entries))
+	assert.Equal(t, map[string][]string{"cn": {"developers"}}, attributes(entries[0]))
+
+	entries = d.search(t, "cn=admins,ou=groups,dc=example,dc=com", ldap.ScopeBaseObject, "(objectClass=*)", "description")
+	require.Len(t, entries, 1)
+	assert.Equal(t, "admins group", entries[0].GetAttributeValue("description"))
+}
+
+func TestSearchMemberOf(t *testing.T) {
+	d := newDirectory(t)
+
+	entries := d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree, "(uid=alice)", "memberOf")
+	require.Len(t, entries, 1)
+	assert.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=developers,ou=groups,dc=example,dc=com"}, entries[0].GetAttributeValues("memberOf"))
+
+	entries = d.search(t, "ou=users,dc=example,dc=com", ldap.ScopeSingleLevel, "(memberOf=cn=developers,ou=groups,dc=example,dc=com)", "uid")
+	assert.Equal(t, []string{"uid=alice,ou=users,dc=example,dc=com", "uid=bob,ou=users,dc=example,dc=com"}, dns(entries))
+	assert.Equal(t, "developers", d.lastGroupFilter(t))
+
+	entries = d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree, "(memberOf=cn=nobody,ou=groups,dc=example,dc=com)")
+	assert.Empty(t, entries)
+}
+
+// lastGroupFilter returns the name of the group the last user listing was
+// restricted to.
+func (d *directory) lastGroupFilter(t *testing.T) string {
+	require.NotEmpty(t, d.identity.filters)
+	groupID := d.identity.filters[len(d.identity.filters)-1].GroupID
+	group, err := d.users.GetGroupByID(context.Background(), groupID)
+	require.NoError(t, err)
+	return group.Name
+}
+
+func TestSearchPushesFilterToRepository(t *testing.T) {
+	d := newDirectory(t)
+
+	tests := []struct {
+		filter string
+		want   types.UserFilter
+		dns    []string
+	}{
+		{"(uid=Bob)", types.UserFilter{Usernames: []string{"Bob"}}, []string{"uid=bob,ou=users,dc=example,dc=com"}},
+		{"(|(uid=alice)(uid=carol))", types.UserFilter{Usernames: []string{"alice", "carol"}},
+			[]string{"uid=alice,ou=users,dc=example,dc=com", "uid=carol,ou=users,dc=example,dc=com"}},
+		{"(&(objectClass=inetOrgPerson)(mail=carol@example.com))", types.UserFilter{Emails: []string{"carol@example.com"}},
+			[]string{"uid=carol,ou=users,dc=example,dc=com"}},
+		{"(mail=*ob@exa*)", types.UserFilter{Query: "ob@exa"}, []string{"uid=bob,ou=users,dc=example,dc=com"}},
+		{"(&(uid=alice)(uid=bob))", types.UserFilter{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			d.identity.filters = nil
+			assert.Equal(t, tt.dns, dns(d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree, tt.filter, "uid")))
+			if tt.dns == nil {
+				assert.Empty(t, d.identity.filters, "a filter that cannot match reads no users")
+				return
+			}
+			require.Len(t, d.identity.filters, 1)
+			got := d.identity.filters[0]
+			assert.Equal(t, tt.want.Usernames, got.Usernames)
+			assert.Equal(t, tt.want.Emails, got.Emails)
+			assert.Equal(t, tt.want.Query, got.Query)
+		})
+	}
+}
+
+func TestSearchScopes(t *testing.T) {
+	d := newDirectory(t)
+
+	assert.Equal(t, []string{"dc=example,dc=com"}, dns(d.search(t, "dc=example,dc=com", ldap.ScopeBaseObject, "(objectClass=*)")))
+	assert.Equal(t, []string{"ou=users,dc=example,dc=com", "ou=groups,dc=example,dc=com"},
+		dns(d.search(t, "DC=Example, DC=com", ldap.ScopeSingleLevel, "(objectClass=*)")))
+	assert.Len(t, d.search(t, "dc=example,dc=com", ldap.ScopeWholeSubtree, "(objectClass=*)"), 3+2+3)
+	assert.Equal(t, []string{"uid=carol,ou=users,dc=example,dc=com"}, dns(d.search(t, "uid=carol,ou=users,dc=example,dc=com", ldap.ScopeBaseObject, "(objectClass=*)")))
+	assert.Empty(t, d.search(t, "dc=other,dc=com", ldap.ScopeWholeSubtree, "(objectClass=*)"))
+}
+
+func TestSearchPagedResults(t *testing.T) {
+	d := newDirectory(t)
+	ctx := context.Background()
+	for i := 0; i < 2*searchBatchSize+50; i++ {
+		require.NoError(t, d.users.CreateUser(ctx, &types.User{Username: fmt.Sprintf("user%03d", i), Email: types.EncryptedString(fmt.Sprintf("user%03d@example.com", i))}))
+	}
+
+	req := ldap.NewSearchRequest("ou=users,dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=person)", []string{"uid"}, nil)
+	sr, err := d.conn.SearchWithPaging(req, 100)
+	require.NoError(t, err)
+	seen := map[string]bool{}
+	for _, e := range sr.Entries {
+		assert.False(t, seen[e.DN], "duplicate %s", e.DN)
+		seen[e.DN] = true
+	}
+	assert.Len(t, seen, 3+2*searchBatchSize+50)
+
+	// A cookie belongs to the search it was issued for.
+	paging := ldap.NewControlPaging(10)
+	req.Controls = []ldap.Control{paging}
+	sr, err = d.conn.Search(req)
+	require.NoError(t, err)
+	cookie := ldap.FindControl(sr.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging).Cookie
+	require.NotEmpty(t, cookie)
+	other := ldap.NewSearchRequest("ou=users,dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=*)", []string{"uid"}, nil)
+	paging.SetCookie(cookie)
+	other.Controls = []ldap.Control{paging}
+	_, err = d.conn.Search(other)
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform), err)
+}
+
+func TestSearchSizeLimit(t *testing.T) {
+	d := newDirectory(t)
+
+	req := ldap.NewSearchRequest("ou=users,dc=example,dc=com", ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 2, 0, false, "(objectClass=*)", nil, nil)
+	sr, err := d.conn.Search(req)
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded), err)
+	assert.Len(t, sr.Entries, 2)
+
+	// The size limit spans the pages of a paged search.
+	sr, err = d.conn.SearchWithPaging(req, 1)
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded), err)
+	assert.Len(t, sr.Entries, 2)
+
+	req.SizeLimit = 3
+	req.Controls = nil
+	sr, err = d.conn.Search(req)
+	require.NoError(t, err)
+	assert.Len(t, sr.Entries, 3)
+}
+
+func attributes(e *ldap.Entry) map[string][]string {
+	attrs := map[string][]string{}
+	for _, a := range e.Attributes {
+		attrs[a.Name] = a.Values
+	}
+	return attrs
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/internal/domain/password"
 	"go.uber.org/zap"
@@ -24,6 +25,21 @@ type Server struct {
 	logger      *zap.Logger
 	wg          sync.WaitGroup
 	quit        chan struct{}
+
+	maxSizeLimit int
+	maxTimeLimit time.Duration
+
+	lockout    *lockout.Tracker
+	authorizer Authorizer
+
+	startTLSConfig *tls.Config
+	ldapsAddr      string
+	ldapsConfig    *tls.Config
+	ldapsListener  net.Listener
+	requireTLS     bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
 }
 
 func NewServer(addr string, baseDN string, tlsConfig *tls.Config, userService identity.IService, pwdService password.IService, logger *zap.Logger) *Server {
@@ -37,34 +53,95 @@ func NewServer(addr string, baseDN string, tlsConfig *tls.Config, userService id
 		virtualTree: vt,
 		logger:      logger,
 		quit:        make(chan struct{}),
+		conns:       make(map[net.Conn]struct{}),
 	}
 }
 
-func (s *Server) Start() error {
-	var l net.Listener
-	var err error
+// SetSearchLimits caps the number of entries and the time a search may
+// take. Clients can ask for lower limits; 0 leaves a limit to the client.
+func (s *Server) SetSearchLimits(sizeLimit int, timeLimit time.Duration) {
+	s.maxSizeLimit = sizeLimit
+	s.maxTimeLimit = timeLimit
+}
 
-	if s.tlsConfig != nil {
-		l, err = tls.Listen("tcp", s.addr, s.tlsConfig)
-	} else {
-		l, err = net.Listen("tcp", s.addr)
-	}
+// SetLockoutTracker sets the tracker that counts failed binds and refuses
+// binds to locked or throttled accounts.
+func (s *Server) SetLockoutTracker(tracker *lockout.Tracker) {
+	s.lockout = tracker
+}
+
+// EnableStartTLS lets clients of the plain listener upgrade their
+// connection with the StartTLS extended operation.
+func (s *Server) EnableStartTLS(config *tls.Config) {
+	s.startTLSConfig = config
+}
+
+// EnableLDAPS adds a listener at addr that serves LDAP over TLS.
+func (s *Server) EnableLDAPS(addr string, config *tls.Config) {
+	s.ldapsAddr = addr
+	s.ldapsConfig = config
+}
+
+// SetBackend sets the source of the entries of the directory, by default
+// the local backend. See VirtualTree.SetBackend.
+func (s *Server) SetBackend(backend Backend) error {
+	return s.virtualTree.SetBackend(backend)
+}
 
-	if err != nil {
-		return err
+// LocalBackend returns the backend of the local users and groups, to merge
+// with proxies of upstream directories.
+func (s *Server) LocalBackend() Backend {
+	return s.virtualTree.Local()
+}
+
+// SetRequireTLS refuses binds with credentials on connections that are not
+// protected by TLS. Anonymous binds are still allowed.
+func (s *Server) SetRequireTLS(require bool) {
+	s.requireTLS = require
+}
+
+// Start opens the listeners: the one at the server address, which serves
+// LDAPS when the server was created with a TLS configuration, and the LDAPS
+// listener when it is enabled. An empty address leaves a listener out.
+func (s *Server) Start() error {
+	if s.addr != "" {
+		var l net.Listener
+		var err error
+		if s.tlsConfig != nil {
+			l, err = tls.Listen("tcp", s.addr, s.tlsConfig)
+		} else {
+			l, err = net.Listen("tcp", s.addr)
+		}
+		if err != nil {
+			return err
+		}
+		s.listener = l
+		s.logger.Info("LDAP server started", zap.String("addr", s.addr), zap.String("baseDN", s.baseDN),
+			zap.Bool("tls", s.tlsConfig != nil), zap.Bool("startTLS", s.tlsConfig == nil && s.startTLSConfig != nil))
+		s.wg.Add(1)
+		go s.serve(l, s.tlsConfig != nil)
 	}
-	s.listener = l
-	s.logger.Info("LDAP server started", zap.String("addr", s.addr), zap.String("baseDN", s.baseDN), zap.Bool("tls", s.tlsConfig != nil))
 
-	s.wg.Add(1)
-	go s.serve()
+	if s.ldapsAddr != "" {
+		l, err := tls.Listen("tcp", s.ldapsAddr, s.ldapsConfig)
+		if err != nil {
+			if s.listener != nil {
+				s.listener.Close()
+			}
+			return err
+		}
+		s.ldapsListener = l
+		s.logger.Info("LDAPS server started", zap.String("addr", s.ldapsAddr), zap.String("baseDN", s.baseDN))
+		s.wg.Add(1)
+		go s.serve(l, true)
+	}
 	return nil
 }
 
-func (s *Server) serve() {
+func (s *Server) serve(listener net.Listener, secure bool) {
 	defer s.wg.Done()
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-s.quit:
@@ -75,28 +152,55 @@ func (s *Server) serve() {
 				continue
 			}
 		}
+		s.mu.Lock()
+		select {
+		case <-s.quit:
+			// Stop has already closed the open connections.
+			s.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		go s.handleConnection(conn, secure)
 	}
 }
 
+// Stop closes the listeners and the client connections, and waits for the
+// operations in progress to end.
 func (s *Server) Stop() {
 	close(s.quit)
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	if s.ldapsListener != nil {
+		s.ldapsListener.Close()
+	}
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
 	s.wg.Wait()
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn net.Conn, secure bool) {
 	defer s.wg.Done()
-	defer conn.Close()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
 
 	s.logger.Debug("New LDAP connection", zap.String("remote", conn.RemoteAddr().String()))
 
+	state := &connState{conn: conn, secure: secure}
 	for {
 		// Read BER packet
-		packet, err := ber.ReadPacket(conn)
+		packet, err := ber.ReadPacket(state.conn)
 		if err != nil {
 			// EOF or error
 			if err.Error() != "EOF" {
@@ -124,15 +228,62 @@ func (s *Server) handleConnection(conn net.Conn) {
 			return
 		}
 
+		// Controls ::= [0] SEQUENCE OF Control, following the ProtocolOp.
+		var controls []*ber.Packet
+		if len(packet.Children) > 2 && packet.Children[2].ClassType == ber.ClassContext && packet.Children[2].Tag == 0 {
+			controls = packet.Children[2].Children
+		}
+
 		ctx := context.Background() // In real app, maybe with timeout
 
 		var resp *ber.Packet
 
 		switch protocolOp.Tag {
 		case ApplicationBindRequest:
-			resp = s.HandleBind(ctx, messageID, protocolOp)
+			if s.requireTLS && !state.secure && !isAnonymousBind(protocolOp) {
+				resp = encodeLDAPResult(messageID, ApplicationBindResponse, LDAPResultConfidentialityRequired, "", "TLS is required to bind")
+				state.user, state.dn = nil, ""
+			} else {
+				resp, state.user = s.bind(ctx, messageID, protocolOp, conn.RemoteAddr().String())
+				state.dn = ""
+				if resultCode(resp) == LDAPResultSuccess {
+					state.dn = bindName(protocolOp)
+				}
+			}
+			recordBind(protocolOp, resp)
 		case ApplicationSearchRequest:
-			resp = s.HandleSearch(ctx, messageID, protocolOp)
+			start := time.Now()
+			resp = s.HandleSearch(ctx, messageID, protocolOp, controls)
+			SearchDuration.Observe(time.Since(start).Seconds())
+			recordSearch(resp)
+		case ApplicationCompareRequest:
+			resp = s.HandleCompare(ctx, messageID, protocolOp)
+		case ApplicationAddRequest:
+			resp = s.HandleAdd(ctx, state, messageID, protocolOp)
+		case ApplicationModifyRequest:
+			resp = s.HandleModify(ctx, state, messageID, protocolOp)
+		case ApplicationDelRequest:
+			resp = s.HandleDelete(ctx, state, messageID, protocolOp)
+		case ApplicationModifyDNRequest:
+			resp = encodeLDAPResult(messageID, ApplicationModifyDNResponse, LDAPResultUnwillingToPerform, "", "Entries cannot be renamed")
+		case ApplicationAbandonRequest:
+			// Operations complete before the next request is read, so there
+			// is nothing to abandon, and no response.
+			continue
+		case ApplicationExtendedRequest:
+			switch extendedRequestName(protocolOp) {
+			case StartTLSOID:
+				if err := s.handleStartTLS(state, messageID); err != nil {
+					return
+				}
+				continue
+			case WhoAmIOID:
+				resp = s.handleWhoAmI(state, messageID)
+			case PasswordModifyOID:
+				resp = s.HandlePasswordModify(ctx, state, messageID, protocolOp)
+			default:
+				resp = encodeExtendedResponse(messageID, LDAPResultProtocolError, "Unsupported extended operation", "")
+			}
 		case ApplicationUnbindRequest:
 			// No response needed, just close
 			return
@@ -148,14 +299,14 @@ func (s *Server) handleConnection(conn net.Conn) {
 				s.logger.Debug("Writing MultiResponse", zap.Int("count", len(resp.Children)))
 				for i, child := range resp.Children {
 					s.logger.Debug("Writing child packet", zap.Int("index", i), zap.Uint64("tag", uint64(child.Tag)))
-					if _, err := conn.Write(child.Bytes()); err != nil {
+					if _, err := state.conn.Write(child.Bytes()); err != nil {
 						s.logger.Error("Write response error", zap.Error(err))
 						return
 					}
 				}
 			} else {
 				s.logger.Debug("Writing SingleResponse", zap.Uint64("tag", uint64(resp.Tag)))
-				if _, err := conn.Write(resp.Bytes()); err != nil {
+				if _, err := state.conn.Write(resp.Bytes()); err != nil {
 					s.logger.Error("Write response error", zap.Error(err))
 					return
 				}
@@ -0,0 +1,133 @@
+package ldap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+const aliceDN = "uid=alice,ou=users,dc=example,dc=com"
+
+// newTestTLS returns a server configuration with a self-signed certificate
+// for 127.0.0.1 and a client configuration that trusts it.
+func newTestTLS(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ldap.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+func newTLSTestServer(t *testing.T, addr string) *Server {
+	repo := memory.NewIdentityMemoryRepository()
+	user := &types.User{Username: "alice", Email: "alice@example.com", Status: types.UserStatusActive}
+	require.NoError(t, repo.CreateUser(context.Background(), user))
+	svc := identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))
+	return NewServer(addr, "dc=example,dc=com", nil, svc, staticPasswords{user.ID: "secret"}, zap.NewNop())
+}
+
+func TestStartTLSRequiredForBind(t *testing.T) {
+	serverTLS, clientTLS := newTestTLS(t)
+	server := newTLSTestServer(t, "127.0.0.1:0")
+	server.EnableStartTLS(serverTLS)
+	server.SetRequireTLS(true)
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+
+	conn, err := ldap.DialURL("ldap://" + server.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Credentials are refused in the clear, anonymous binds are not.
+	failures := testutil.ToFloat64(BindsTotal.WithLabelValues("failure"))
+	err = conn.Bind(aliceDN, "secret")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultConfidentialityRequired), "got %v", err)
+	assert.Equal(t, failures+1, testutil.ToFloat64(BindsTotal.WithLabelValues("failure")))
+	assert.NoError(t, conn.UnauthenticatedBind(""))
+
+	require.NoError(t, conn.StartTLS(clientTLS))
+	successes := testutil.ToFloat64(BindsTotal.WithLabelValues("success"))
+	assert.NoError(t, conn.Bind(aliceDN, "secret"))
+	assert.Equal(t, successes+1, testutil.ToFloat64(BindsTotal.WithLabelValues("success")))
+
+	searches := testutil.ToFloat64(SearchesTotal.WithLabelValues("success"))
+	result, err := conn.Search(ldap.NewSearchRequest("ou=users,dc=example,dc=com", ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, "(uid=alice)", []string{"uid"}, nil))
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 1)
+	assert.Equal(t, searches+1, testutil.ToFloat64(SearchesTotal.WithLabelValues("success")))
+}
+
+func TestStartTLSUnavailable(t *testing.T) {
+	_, clientTLS := newTestTLS(t)
+	server := newTLSTestServer(t, "127.0.0.1:0")
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+
+	conn, err := ldap.DialURL("ldap://" + server.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.StartTLS(clientTLS)
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailable), "got %v", err)
+}
+
+func TestLDAPS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLS(t)
+	server := newTLSTestServer(t, "")
+	server.EnableLDAPS("127.0.0.1:0", serverTLS)
+	server.SetRequireTLS(true)
+	require.NoError(t, server.Start())
+	assert.Nil(t, server.listener)
+
+	conn, err := ldap.DialURL("ldaps://"+server.ldapsListener.Addr().String(), ldap.DialWithTLSConfig(clientTLS))
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, conn.Bind(aliceDN, "secret"))
+
+	// Stop closes idle client connections instead of waiting for them.
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
@@ -3,82 +3,366 @@ package ldap
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/pkg/types"
 )
 
-// VirtualTree represents the logical directory structure
+const (
+	usersOU  = "ou=users"
+	groupsOU = "ou=groups"
+
+	// searchBatchSize is the number of users or groups read from the
+	// repository at a time.
+	searchBatchSize = 200
+)
+
+var (
+	userObjectClasses  = []string{"top", "person", "organizationalPerson", "inetOrgPerson"}
+	groupObjectClasses = []string{"top", "groupOfNames", "groupOfUniqueNames"}
+)
+
+// VirtualTree represents the logical directory structure:
+//
+//	dc=example,dc=com
+//	  ou=users
+//	    uid=jdoe      (memberOf: cn=admins,ou=groups,dc=example,dc=com)
+//	  ou=groups
+//	    cn=admins     (member: uid=jdoe,ou=users,dc=example,dc=com)
 type VirtualTree struct {
 	baseDN      string
+	base        string // normalized baseDN
 	userService identity.IService
+
+	// local serves the users and groups of userService; backend serves the
+	// tree, from local alone unless upstream directories are added.
+	local   Backend
+	backend Backend
+}
+
+// SearchRequest is a search of the tree.
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     *ber.Packet
+	Attributes []string
+}
+
+// Cursor is a position in the results of a search. Backend is the index of
+// the backend of a merged search. The local backend lists the base and
+// organizational unit entries, then groups by name, then users by username;
+// Offset counts the candidates of a Section already examined.
+type Cursor struct {
+	Backend int
+	Section int
+	Offset  int
 }
 
 func NewVirtualTree(baseDN string, userService identity.IService) *VirtualTree {
-	return &VirtualTree{
+	vt := &VirtualTree{
 		baseDN:      baseDN,
+		base:        normalizeDN(baseDN),
 		userService: userService,
 	}
+	vt.local = &localBackend{vt: vt}
+	vt.backend = vt.local
+	return vt
 }
 
+// Search returns all entries matching a search.
 func (vt *VirtualTree) Search(ctx context.Context, baseDN string, scope int, filter *ber.Packet, attrs []string) ([]*Entry, error) {
-	// Simplified Virtual Tree:
-	// BaseDN: dc=example,dc=com (configurable)
-	// ou=users
-	//   uid=jdoe
-	// ou=groups
-	//   cn=admin
-
-	// Normalize BaseDN
-	baseDN = strings.ToLower(baseDN)
-	serverBase := strings.ToLower(vt.baseDN)
-
-	if !strings.HasSuffix(baseDN, serverBase) && baseDN != "" {
-		// Out of scope?
-		return nil, nil
-	}
-
-	var entries []*Entry
-
-	// Check if we are searching for Users
-	// Simplification: Always search users if scope includes ou=users
-	// We really need to parse the filter to see what we are looking for.
-	// But `ListUsers` gives all users.
-	// Let's implement basic "All Users" then filter manually.
-	// This is inefficient but functional for small scale.
-
-	// Fetch all users
-	// TODO: Pagination?
-	users, _, err := vt.userService.ListUsers(ctx, types.UserFilter{})
+	entries, _, err := vt.SearchPage(ctx, &SearchRequest{BaseDN: baseDN, Scope: scope, Filter: filter, Attributes: attrs}, Cursor{}, 0)
+	return entries, err
+}
+
+// SearchPage returns up to limit entries matching a search, starting at a
+// cursor, and the cursor of the next page, from the backend of the tree.
+// The next cursor is nil when the search is complete. A limit of 0 returns
+// all entries. If ctx is done before the page is complete, the entries
+// found so far are returned with the context's error.
+func (vt *VirtualTree) SearchPage(ctx context.Context, req *SearchRequest, from Cursor, limit int) ([]*Entry, *Cursor, error) {
+	return vt.backend.SearchPage(ctx, req, from, limit)
+}
+
+// queryForScope rules out the entries a search base and scope cannot reach.
+func (vt *VirtualTree) queryForScope(baseDN string, scope int) searchQuery {
+	none := searchQuery{noUsers: true, noGroups: true}
+	base := normalizeDN(baseDN)
+	if baseDN == "" {
+		// The root: only a subtree search reaches the tree.
+		if scope != ScopeWholeSubtree {
+			return none
+		}
+		base = vt.base
+	}
+
+	switch base {
+	case vt.base:
+		if scope == ScopeWholeSubtree {
+			return searchQuery{}
+		}
+		return none
+	case normalizeDN(usersOU + "," + vt.baseDN):
+		if scope == ScopeBaseObject {
+			return none
+		}
+		return searchQuery{noGroups: true}
+	case normalizeDN(groupsOU + "," + vt.baseDN):
+		if scope == ScopeBaseObject {
+			return none
+		}
+		return searchQuery{noUsers: true}
+	}
+	if scope == ScopeSingleLevel {
+		return none
+	}
+	if name, ok := vt.childName(baseDN, usersOU, "uid"); ok {
+		return searchQuery{noGroups: true, usernames: []string{name}}
+	}
+	if name, ok := vt.childName(baseDN, groupsOU, "cn"); ok {
+		return searchQuery{noUsers: true, groupNames: []string{name}}
+	}
+	return none
+}
+
+// treeSearch collects the entries of one page of a search.
+type treeSearch struct {
+	vt      *VirtualTree
+	req     *SearchRequest
+	q       searchQuery
+	base    string
+	limit   int
+	entries []*Entry
+}
+
+func (s *treeSearch) full() bool {
+	return s.limit > 0 && len(s.entries) >= s.limit
+}
+
+// add adds an entry to the page if it is in scope and matches the filter.
+func (s *treeSearch) add(entry *Entry) {
+	if isDNInScope(normalizeDN(entry.DN), s.base, s.req.Scope) && MatchesFilter(entry, s.req.Filter) {
+		s.entries = append(s.entries, selectAttributes(entry, s.req.Attributes))
+	}
+}
+
+// needs reports whether an attribute is requested or tested by the filter.
+func (s *treeSearch) needs(attr string) bool {
+	return requested(s.req.Attributes, attr) || filterUses(s.req.Filter, attr)
+}
+
+func (s *treeSearch) structure(ctx context.Context, offset int) (int, error) {
+	entries := s.vt.structuralEntries()
+	for i := offset; i < len(entries); i++ {
+		s.add(entries[i])
+		if s.full() {
+			return i + 1, nil
+		}
+	}
+	return len(entries), nil
+}
+
+func (s *treeSearch) groups(ctx context.Context, offset int) (int, error) {
+	if s.q.noGroups {
+		return 0, nil
+	}
+	groups, err := s.candidateGroups(ctx)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	for i := offset; i < len(groups); i++ {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		var members []*types.User
+		if s.needs("member") || s.needs("uniqueMember") {
+			if members, err = s.vt.groupMembers(ctx, groups[i].ID); err != nil {
+				return i, err
+			}
+		}
+		s.add(s.vt.ConvertGroupToEntry(groups[i], members))
+		if s.full() {
+			return i + 1, nil
+		}
+	}
+	return len(groups), nil
+}
+
+// candidateGroups returns the groups that may match, ordered by name: the
+// groups of the members the query names, or else all groups.
+func (s *treeSearch) candidateGroups(ctx context.Context) ([]*types.UserGroup, error) {
+	var groups []*types.UserGroup
+	if s.q.members != nil {
+		seen := map[string]bool{}
+		for _, username := range s.q.members {
+			user, err := s.vt.userService.GetUserByUsername(ctx, username)
+			if err != nil {
+				continue
+			}
+			userGroups, err := s.vt.userService.GetUserGroups(ctx, user.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, g := range userGroups {
+				if !seen[g.ID] {
+					seen[g.ID] = true
+					groups = append(groups, g)
+				}
+			}
+		}
+	} else {
+		all, err := s.vt.allGroups(ctx)
+		if err != nil {
+			return nil, err
+		}
+		groups = all
+	}
+
+	candidates := groups[:0]
+	for _, g := range groups {
+		if s.q.groupNames == nil || containsFold(s.q.groupNames, g.Name) {
+			candidates = append(candidates, g)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+	return candidates, nil
+}
+
+func (s *treeSearch) users(ctx context.Context, offset int) (int, error) {
+	if s.q.noUsers {
+		return 0, nil
+	}
+	filter := types.UserFilter{
+		Query:     s.q.substring,
+		Usernames: s.q.usernames,
+		Emails:    s.q.emails,
+		SortBy:    "username",
+		PageSize:  searchBatchSize,
+	}
+	if s.q.memberOf != "" {
+		group, err := s.vt.groupByName(ctx, s.q.memberOf)
+		if err != nil {
+			return 0, err
+		}
+		if group == nil {
+			return 0, nil
+		}
+		filter.GroupID = group.ID
 	}
 
-	for _, u := range users {
-		entry := vt.ConvertUserToEntry(u)
-		if entry == nil {
-			continue
+	withGroups := s.needs("memberOf")
+	for {
+		if err := ctx.Err(); err != nil {
+			return offset, err
+		}
+		filter.Page = offset/searchBatchSize + 1
+		batchStart := (filter.Page - 1) * searchBatchSize
+		users, _, err := s.vt.userService.ListUsers(ctx, filter)
+		if err != nil {
+			return offset, err
+		}
+		for i := offset - batchStart; i < len(users); i++ {
+			var groups []*types.UserGroup
+			if withGroups {
+				if groups, err = s.vt.userService.GetUserGroups(ctx, users[i].ID); err != nil {
+					return batchStart + i, err
+				}
+			}
+			s.add(s.vt.convertUser(users[i], groups))
+			if s.full() {
+				return batchStart + i + 1, nil
+			}
+		}
+		offset = batchStart + len(users)
+		if len(users) < searchBatchSize {
+			return offset, nil
 		}
+	}
+}
 
-		// Check Scope
-		if !isDNInScope(entry.DN, baseDN, scope) {
-			continue
+// allGroups reads every group, a batch at a time.
+func (vt *VirtualTree) allGroups(ctx context.Context) ([]*types.UserGroup, error) {
+	var groups []*types.UserGroup
+	for offset := 0; ; offset += searchBatchSize {
+		batch, err := vt.userService.ListGroups(ctx, offset, searchBatchSize)
+		if err != nil {
+			return nil, err
 		}
+		groups = append(groups, batch...)
+		if len(batch) < searchBatchSize {
+			return groups, nil
+		}
+	}
+}
+
+// groupByName returns the group with a name, or nil if there is none.
+func (vt *VirtualTree) groupByName(ctx context.Context, name string) (*types.UserGroup, error) {
+	groups, err := vt.allGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if strings.EqualFold(g.Name, name) {
+			return g, nil
+		}
+	}
+	return nil, nil
+}
 
-		// Check Filter
-		if MatchesFilter(entry, filter) {
-			entries = append(entries, entry)
+// groupMembers reads every member of a group, a batch at a time.
+func (vt *VirtualTree) groupMembers(ctx context.Context, groupID string) ([]*types.User, error) {
+	var members []*types.User
+	filter := types.UserFilter{GroupID: groupID, SortBy: "username", PageSize: searchBatchSize}
+	for filter.Page = 1; ; filter.Page++ {
+		batch, _, err := vt.userService.ListUsers(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, batch...)
+		if len(batch) < searchBatchSize {
+			return members, nil
 		}
 	}
+}
 
-	return entries, nil
+// structuralEntries returns the base entry and the organizational units.
+func (vt *VirtualTree) structuralEntries() []*Entry {
+	base := &Entry{DN: vt.baseDN, Attributes: map[string][]string{"objectClass": {"top", "organization"}}}
+	if dn, err := ldap.ParseDN(vt.baseDN); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+		rdn := dn.RDNs[0].Attributes[0]
+		if strings.EqualFold(rdn.Type, "dc") {
+			base.Attributes["objectClass"] = []string{"top", "domain"}
+		}
+		base.Attributes[rdn.Type] = []string{rdn.Value}
+	}
+	ou := func(name string) *Entry {
+		return &Entry{
+			DN: fmt.Sprintf("ou=%s,%s", name, vt.baseDN),
+			Attributes: map[string][]string{
+				"objectClass": {"top", "organizationalUnit"},
+				"ou":          {name},
+			},
+		}
+	}
+	return []*Entry{base, ou("users"), ou("groups")}
 }
 
 // ConvertUserToEntry maps a domain User to an LDAP Entry
 func (vt *VirtualTree) ConvertUserToEntry(u *types.User) *Entry {
-	dn := fmt.Sprintf("uid=%s,ou=users,%s", u.Username, vt.baseDN)
+	groups := make([]*types.UserGroup, len(u.Groups))
+	for i := range u.Groups {
+		groups[i] = &u.Groups[i]
+	}
+	return vt.convertUser(u, groups)
+}
+
+// convertUser maps a domain User and the groups it belongs to to an LDAP Entry.
+func (vt *VirtualTree) convertUser(u *types.User, groups []*types.UserGroup) *Entry {
+	dn := vt.userDN(u.Username)
 
 	// Fetch attributes from map if available
 	sn := u.Username
@@ -92,12 +376,15 @@ func (vt *VirtualTree) ConvertUserToEntry(u *types.User) *Entry {
 	}
 
 	attrs := map[string][]string{
-		"objectClass": {"top", "person", "organizationalPerson", "inetOrgPerson"},
+		"objectClass": userObjectClasses,
 		"uid":         {u.Username},
 		"cn":          {cn},
 		"sn":          {sn},
 		"mail":        {string(u.Email)},
 	}
+	if u.Phone != "" {
+		attrs["telephoneNumber"] = []string{string(u.Phone)}
+	}
 
 	if val, ok := u.Attributes["firstName"].(string); ok {
 		attrs["givenName"] = []string{val}
@@ -106,12 +393,81 @@ func (vt *VirtualTree) ConvertUserToEntry(u *types.User) *Entry {
 		attrs["sn"] = []string{val}
 	}
 
+	if len(groups) > 0 {
+		memberOf := make([]string, 0, len(groups))
+		for _, g := range groups {
+			memberOf = append(memberOf, vt.groupDN(g.Name))
+		}
+		sort.Strings(memberOf)
+		attrs["memberOf"] = memberOf
+	}
+
 	return &Entry{
 		DN:         dn,
 		Attributes: attrs,
 	}
 }
 
+// ConvertGroupToEntry maps a domain UserGroup and its members to an LDAP
+// Entry. The members are listed both as member and as uniqueMember, as
+// clients look for either.
+func (vt *VirtualTree) ConvertGroupToEntry(g *types.UserGroup, members []*types.User) *Entry {
+	attrs := map[string][]string{
+		"objectClass": groupObjectClasses,
+		"cn":          {g.Name},
+	}
+	if g.Description != "" {
+		attrs["description"] = []string{g.Description}
+	}
+	if len(members) > 0 {
+		dns := make([]string, 0, len(members))
+		for _, u := range members {
+			dns = append(dns, vt.userDN(u.Username))
+		}
+		attrs["member"] = dns
+		attrs["uniqueMember"] = dns
+	}
+	return &Entry{
+		DN:         vt.groupDN(g.Name),
+		Attributes: attrs,
+	}
+}
+
+func (vt *VirtualTree) userDN(username string) string {
+	return fmt.Sprintf("uid=%s,%s,%s", ldap.EscapeDN(username), usersOU, vt.baseDN)
+}
+
+func (vt *VirtualTree) groupDN(name string) string {
+	return fmt.Sprintf("cn=%s,%s,%s", ldap.EscapeDN(name), groupsOU, vt.baseDN)
+}
+
+// childName returns the value of the naming attribute of a DN directly below
+// an organizational unit of the tree, e.g. "jdoe" for
+// uid=jdoe,ou=users,dc=example,dc=com. An empty attr matches any naming
+// attribute.
+func (vt *VirtualTree) childName(dn, ou, attr string) (string, bool) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) < 2 || len(parsed.RDNs[0].Attributes) != 1 {
+		return "", false
+	}
+	rdn := parsed.RDNs[0].Attributes[0]
+	parent := &ldap.DN{RDNs: parsed.RDNs[1:]}
+	if (attr != "" && !strings.EqualFold(rdn.Type, attr)) || normalizeDN(parent.String()) != normalizeDN(ou+","+vt.baseDN) {
+		return "", false
+	}
+	return rdn.Value, true
+}
+
+// normalizeDN returns a DN in a form that can be compared as a string:
+// lowercase, without spaces around separators.
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	return strings.ToLower(parsed.String())
+}
+
 func isDNInScope(dn, base string, scope int) bool {
 	dn = strings.ToLower(dn)
 	base = strings.ToLower(base)
@@ -134,8 +490,33 @@ func isDNInScope(dn, base string, scope int) bool {
 	parts := strings.Split(remaining, ",")
 
 	if scope == ScopeSingleLevel {
-		return len(parts) == 1
+		return len(parts) == 1 && remaining != dn
 	}
 
 	return true
 }
+
+// requested reports whether a search returns an attribute: when it is
+// listed, or when no attributes or "*" are listed.
+func requested(attrs []string, attr string) bool {
+	if len(attrs) == 0 {
+		return true
+	}
+	for _, a := range attrs {
+		if a == "*" || strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectAttributes returns an entry with only the requested attributes.
+func selectAttributes(entry *Entry, attrs []string) *Entry {
+	selected := &Entry{DN: entry.DN, Attributes: map[string][]string{}}
+	for name, values := range entry.Attributes {
+		if requested(attrs, name) {
+			selected.Attributes[name] = values
+		}
+	}
+	return selected
+}
@@ -0,0 +1,708 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/turtacn/QuantaID/internal/domain/policy"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// Authorizer decides whether a bound user may change the directory. The
+// authorization service implements it.
+type Authorizer interface {
+	Authorize(ctx context.Context, evalCtx policy.EvaluationContext) (policy.Decision, error)
+}
+
+// The actions authorized for changes to the directory. The resource is the
+// user or group changed, with its DN in the "dn" attribute and, for
+// modifications, the attributes changed in "attributes".
+const (
+	ActionAdd    policy.Action = "ldap.add"
+	ActionModify policy.Action = "ldap.modify"
+	ActionDelete policy.Action = "ldap.delete"
+	// ActionPasswordReset sets a password without proving the old one.
+	ActionPasswordReset policy.Action = "ldap.password.reset"
+)
+
+// Modify operations (RFC 4511, section 4.6).
+const (
+	modifyAdd     = 0
+	modifyDelete  = 1
+	modifyReplace = 2
+)
+
+// SetAuthorizer sets the authorizer of changes to the directory. Without
+// one, the directory is read-only.
+func (s *Server) SetAuthorizer(authorizer Authorizer) {
+	s.authorizer = authorizer
+}
+
+// ldapError is a failed operation, with its result code and diagnostic
+// message.
+type ldapError struct {
+	code    int
+	message string
+}
+
+func (e *ldapError) Error() string {
+	return e.message
+}
+
+func ldapErrorf(code int, format string, args ...interface{}) error {
+	return &ldapError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// errorResult returns the result code and diagnostic message of an error
+// returned by an operation or by the services behind it.
+func (s *Server) errorResult(err error) (int, string) {
+	var le *ldapError
+	if errors.As(err, &le) {
+		return le.code, le.message
+	}
+	var appErr *types.Error
+	if errors.As(err, &appErr) {
+		switch appErr.Code {
+		case types.ErrConflict.Code:
+			if appErr.Details["field"] == "email" {
+				return LDAPResultConstraintViolation, "mail is already in use"
+			}
+			return LDAPResultEntryAlreadyExists, "Entry already exists"
+		case types.ErrNotFound.Code, types.ErrUserNotFound.Code:
+			return LDAPResultNoSuchObject, "No such object"
+		case types.ErrPasswordPolicy.Code:
+			if msg := appErr.Details["message"]; msg != "" {
+				return LDAPResultConstraintViolation, msg
+			}
+			return LDAPResultConstraintViolation, appErr.Message
+		case types.ErrValidation.Code:
+			return LDAPResultConstraintViolation, appErr.Message
+		}
+	}
+	s.logger.Error("LDAP operation failed", zap.Error(err))
+	return LDAPResultOperationsError, "Internal error"
+}
+
+// target is the user or group entry a DN names.
+type target struct {
+	dn    string
+	kind  string // "user" or "group"
+	user  *types.User
+	group *types.UserGroup
+}
+
+// resolve finds the user or group a DN names. Other entries of the tree,
+// which cannot be changed, are refused.
+func (s *Server) resolve(ctx context.Context, dn string) (*target, error) {
+	if !s.virtualTree.servesLocal() {
+		return nil, ldapErrorf(LDAPResultUnwillingToPerform, "Upstream directories cannot be changed")
+	}
+	if name, ok := s.virtualTree.childName(dn, usersOU, "uid"); ok {
+		user, err := s.userService.GetUserByUsername(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return &target{dn: dn, kind: "user", user: user}, nil
+	}
+	if name, ok := s.virtualTree.childName(dn, groupsOU, "cn"); ok {
+		group, err := s.virtualTree.groupByName(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if group == nil {
+			return nil, ldapErrorf(LDAPResultNoSuchObject, "No such object")
+		}
+		return &target{dn: dn, kind: "group", group: group}, nil
+	}
+	return nil, ldapErrorf(LDAPResultUnwillingToPerform, "Only users and groups can be changed")
+}
+
+// resource describes the target to the authorizer.
+func (t *target) resource(attrs []string) policy.Resource {
+	r := policy.Resource{Type: t.kind, Attributes: map[string]string{"dn": t.dn}}
+	if t.user != nil {
+		r.ID = t.user.ID
+	} else if t.group != nil {
+		r.ID = t.group.ID
+	}
+	if len(attrs) > 0 {
+		r.Attributes["attributes"] = strings.Join(attrs, ",")
+	}
+	return r
+}
+
+// authorize checks that the user bound to a connection may take an action
+// on a resource.
+func (s *Server) authorize(ctx context.Context, state *connState, action policy.Action, resource policy.Resource) error {
+	if s.authorizer == nil {
+		return ldapErrorf(LDAPResultUnwillingToPerform, "The directory is read-only")
+	}
+	if state.user == nil {
+		return ldapErrorf(LDAPResultInsufficientAccessRights, "Anonymous connections cannot change the directory")
+	}
+	groups, err := s.userService.GetUserGroups(ctx, state.user.ID)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = g.Name
+	}
+	ip := state.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	decision, err := s.authorizer.Authorize(ctx, policy.EvaluationContext{
+		Subject:     policy.Subject{UserID: state.user.ID, Groups: names},
+		Resource:    resource,
+		Action:      action,
+		Environment: policy.Environment{IP: ip, Time: time.Now().UTC()},
+	})
+	if err != nil {
+		return err
+	}
+	if decision != policy.DecisionAllow {
+		s.logger.Warn("LDAP write denied", zap.String("user", state.user.Username), zap.String("action", string(action)), zap.String("dn", resource.Attributes["dn"]))
+		return ldapErrorf(LDAPResultInsufficientAccessRights, "Insufficient access rights")
+	}
+	return nil
+}
+
+// attribute is an attribute of an AddRequest or a change of a
+// ModifyRequest.
+type attribute struct {
+	op     int64
+	name   string
+	values []string
+}
+
+// decodeAttribute decodes an Attribute or PartialAttribute:
+//
+//	Attribute ::= SEQUENCE {
+//	     type       AttributeDescription,
+//	     vals       SET OF value AttributeValue }
+func decodeAttribute(packet *ber.Packet) (attribute, bool) {
+	if len(packet.Children) < 2 {
+		return attribute{}, false
+	}
+	name, ok := packet.Children[0].Value.(string)
+	if !ok || name == "" {
+		return attribute{}, false
+	}
+	attr := attribute{name: name}
+	for _, v := range packet.Children[1].Children {
+		attr.values = append(attr.values, string(v.Data.Bytes()))
+	}
+	return attr, true
+}
+
+// requestDN returns the DN a request starts with.
+func requestDN(req *ber.Packet) (string, bool) {
+	if len(req.Children) == 0 {
+		return "", false
+	}
+	dn, ok := req.Children[0].Value.(string)
+	return dn, ok
+}
+
+// HandleAdd handles an AddRequest, which creates a user below ou=users or a
+// group below ou=groups.
+func (s *Server) HandleAdd(ctx context.Context, state *connState, messageID int64, req *ber.Packet) *ber.Packet {
+	// AddRequest ::= [APPLICATION 8] SEQUENCE {
+	//     entry           LDAPDN,
+	//     attributes      AttributeList }
+	dn, ok := requestDN(req)
+	if !ok || len(req.Children) < 2 {
+		return encodeLDAPResult(messageID, ApplicationAddResponse, LDAPResultProtocolError, "", "Invalid AddRequest")
+	}
+	attrs := make(map[string]attribute)
+	for _, child := range req.Children[1].Children {
+		attr, ok := decodeAttribute(child)
+		if !ok {
+			return encodeLDAPResult(messageID, ApplicationAddResponse, LDAPResultProtocolError, "", "Invalid attribute")
+		}
+		attrs[strings.ToLower(attr.name)] = attr
+	}
+
+	err := s.add(ctx, state, dn, attrs)
+	recordWrite("add", err)
+	if err != nil {
+		code, msg := s.errorResult(err)
+		return encodeLDAPResult(messageID, ApplicationAddResponse, code, "", msg)
+	}
+	return encodeLDAPResult(messageID, ApplicationAddResponse, LDAPResultSuccess, "", "")
+}
+
+func (s *Server) add(ctx context.Context, state *connState, dn string, attrs map[string]attribute) error {
+	if !s.virtualTree.servesLocal() {
+		return ldapErrorf(LDAPResultUnwillingToPerform, "Upstream directories cannot be changed")
+	}
+	if name, ok := s.virtualTree.childName(dn, usersOU, "uid"); ok {
+		t := &target{dn: dn, kind: "user"}
+		if err := s.authorize(ctx, state, ActionAdd, t.resource(nil)); err != nil {
+			return err
+		}
+		return s.addUser(ctx, name, attrs)
+	}
+	if name, ok := s.virtualTree.childName(dn, groupsOU, "cn"); ok {
+		t := &target{dn: dn, kind: "group"}
+		if err := s.authorize(ctx, state, ActionAdd, t.resource(nil)); err != nil {
+			return err
+		}
+		return s.addGroup(ctx, name, attrs)
+	}
+	if _, ok := s.virtualTree.childName(dn, usersOU, ""); ok {
+		return ldapErrorf(LDAPResultNamingViolation, "Users are named by uid")
+	}
+	if _, ok := s.virtualTree.childName(dn, groupsOU, ""); ok {
+		return ldapErrorf(LDAPResultNamingViolation, "Groups are named by cn")
+	}
+	return ldapErrorf(LDAPResultUnwillingToPerform, "Entries can only be added below %s and %s", usersOU, groupsOU)
+}
+
+func (s *Server) addUser(ctx context.Context, username string, attrs map[string]attribute) error {
+	changes := newUserChanges()
+	var mail, password string
+	for name, attr := range attrs {
+		switch name {
+		case "objectclass":
+		case "uid":
+			if len(attr.values) != 1 || attr.values[0] != username {
+				return ldapErrorf(LDAPResultNamingViolation, "uid must match the DN")
+			}
+		case "mail":
+			if len(attr.values) != 1 {
+				return ldapErrorf(LDAPResultConstraintViolation, "mail takes one value")
+			}
+			mail = attr.values[0]
+		case "userpassword":
+			if len(attr.values) != 1 {
+				return ldapErrorf(LDAPResultConstraintViolation, "userPassword takes one value")
+			}
+			password = attr.values[0]
+		default:
+			attr.op = modifyAdd
+			if err := changes.apply(attr, &types.User{}); err != nil {
+				return err
+			}
+		}
+	}
+	if mail == "" || password == "" {
+		return ldapErrorf(LDAPResultObjectClassViolation, "mail and userPassword are required")
+	}
+
+	user, err := s.userService.CreateUser(ctx, username, mail, password)
+	if err != nil {
+		return err
+	}
+	if changes.empty() {
+		return nil
+	}
+	changes.update(user)
+	return s.userService.UpdateUser(ctx, user)
+}
+
+func (s *Server) addGroup(ctx context.Context, name string, attrs map[string]attribute) error {
+	group := &types.UserGroup{ID: utils.GenerateUUID(), Name: name}
+	var members []*types.User
+	for attrName, attr := range attrs {
+		switch attrName {
+		case "objectclass":
+		case "cn":
+			if len(attr.values) != 1 || attr.values[0] != name {
+				return ldapErrorf(LDAPResultNamingViolation, "cn must match the DN")
+			}
+		case "description":
+			if len(attr.values) != 1 {
+				return ldapErrorf(LDAPResultConstraintViolation, "description takes one value")
+			}
+			group.Description = attr.values[0]
+		case "member", "uniquemember":
+			for _, dn := range attr.values {
+				user, err := s.memberUser(ctx, dn)
+				if err != nil {
+					return err
+				}
+				members = append(members, user)
+			}
+		default:
+			return ldapErrorf(LDAPResultUndefinedAttributeType, "%s cannot be set on groups", attr.name)
+		}
+	}
+
+	existing, err := s.virtualTree.groupByName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ldapErrorf(LDAPResultEntryAlreadyExists, "Entry already exists")
+	}
+	if err := s.userService.CreateGroup(ctx, group); err != nil {
+		return err
+	}
+	for _, user := range members {
+		if err := s.userService.AddUserToGroup(ctx, user.ID, group.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberUser returns the user a member DN names.
+func (s *Server) memberUser(ctx context.Context, dn string) (*types.User, error) {
+	name, ok := s.virtualTree.childName(dn, usersOU, "uid")
+	if !ok {
+		return nil, ldapErrorf(LDAPResultConstraintViolation, "member %s is not a user", dn)
+	}
+	user, err := s.userService.GetUserByUsername(ctx, name)
+	if err != nil {
+		return nil, ldapErrorf(LDAPResultConstraintViolation, "member %s does not exist", dn)
+	}
+	return user, nil
+}
+
+// HandleModify handles a ModifyRequest. The changes of a request are all
+// checked before any is made.
+func (s *Server) HandleModify(ctx context.Context, state *connState, messageID int64, req *ber.Packet) *ber.Packet {
+	// ModifyRequest ::= [APPLICATION 6] SEQUENCE {
+	//     object          LDAPDN,
+	//     changes         SEQUENCE OF change SEQUENCE {
+	//          operation       ENUMERATED { add (0), delete (1), replace (2), ... },
+	//          modification    PartialAttribute } }
+	dn, ok := requestDN(req)
+	if !ok || len(req.Children) < 2 {
+		return encodeLDAPResult(messageID, ApplicationModifyResponse, LDAPResultProtocolError, "", "Invalid ModifyRequest")
+	}
+	var changes []attribute
+	for _, child := range req.Children[1].Children {
+		if len(child.Children) < 2 {
+			return encodeLDAPResult(messageID, ApplicationModifyResponse, LDAPResultProtocolError, "", "Invalid change")
+		}
+		op, ok := child.Children[0].Value.(int64)
+		attr, valid := decodeAttribute(child.Children[1])
+		if !ok || !valid {
+			return encodeLDAPResult(messageID, ApplicationModifyResponse, LDAPResultProtocolError, "", "Invalid change")
+		}
+		attr.op = op
+		changes = append(changes, attr)
+	}
+
+	err := s.modify(ctx, state, dn, changes)
+	recordWrite("modify", err)
+	if err != nil {
+		code, msg := s.errorResult(err)
+		return encodeLDAPResult(messageID, ApplicationModifyResponse, code, "", msg)
+	}
+	return encodeLDAPResult(messageID, ApplicationModifyResponse, LDAPResultSuccess, "", "")
+}
+
+func (s *Server) modify(ctx context.Context, state *connState, dn string, changes []attribute) error {
+	t, err := s.resolve(ctx, dn)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(changes))
+	setsPassword := false
+	for _, c := range changes {
+		names = append(names, c.name)
+		setsPassword = setsPassword || strings.EqualFold(c.name, "userPassword")
+	}
+	if err := s.authorize(ctx, state, ActionModify, t.resource(names)); err != nil {
+		return err
+	}
+	// Replacing userPassword sets it without the old one, like a reset.
+	if setsPassword && t.user != nil {
+		if err := s.authorize(ctx, state, ActionPasswordReset, t.resource(nil)); err != nil {
+			return err
+		}
+	}
+	if t.user != nil {
+		return s.modifyUser(ctx, t.user, changes)
+	}
+	return s.modifyGroup(ctx, t.group, changes)
+}
+
+func (s *Server) modifyUser(ctx context.Context, user *types.User, changes []attribute) error {
+	updates := newUserChanges()
+	var password *string
+	for _, c := range changes {
+		switch strings.ToLower(c.name) {
+		case "userpassword":
+			if c.op == modifyDelete || len(c.values) != 1 {
+				return ldapErrorf(LDAPResultUnwillingToPerform, "userPassword can only be replaced with one value")
+			}
+			password = &c.values[0]
+		default:
+			if err := updates.apply(c, user); err != nil {
+				return err
+			}
+		}
+	}
+
+	if updates.mail != nil {
+		if err := s.checkMailUnused(ctx, user.ID, *updates.mail); err != nil {
+			return err
+		}
+	}
+	// The password is set first, as it is the change most likely to be
+	// refused, by the password policy.
+	if password != nil {
+		if err := s.setPassword(ctx, user.ID, *password); err != nil {
+			return err
+		}
+	}
+	if updates.empty() {
+		return nil
+	}
+	fresh, err := s.userService.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	updates.update(fresh)
+	return s.userService.UpdateUser(ctx, fresh)
+}
+
+// checkMailUnused refuses a mail address another user has.
+func (s *Server) checkMailUnused(ctx context.Context, userID, mail string) error {
+	users, _, err := s.userService.ListUsers(ctx, types.UserFilter{Emails: []string{mail}, Page: 1, PageSize: 2})
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.ID != userID {
+			return ldapErrorf(LDAPResultConstraintViolation, "mail %s is already in use", mail)
+		}
+	}
+	return nil
+}
+
+// userAttributeKeys are the keys of user attributes that hold the values of
+// LDAP attributes.
+var userAttributeKeys = map[string]string{
+	"cn":        "displayName",
+	"sn":        "lastName",
+	"givenname": "firstName",
+}
+
+// userChanges are the new values of the LDAP attributes of a user; nil
+// values are unchanged and empty values are removed.
+type userChanges struct {
+	mail       *string
+	phone      *string
+	attributes map[string]*string
+}
+
+func newUserChanges() *userChanges {
+	return &userChanges{attributes: make(map[string]*string)}
+}
+
+func (u *userChanges) empty() bool {
+	return u.mail == nil && u.phone == nil && len(u.attributes) == 0
+}
+
+// apply applies a change to the values of the user, or to the values of
+// earlier changes.
+func (u *userChanges) apply(c attribute, user *types.User) error {
+	current := func(changed *string, value string) string {
+		if changed != nil {
+			return *changed
+		}
+		return value
+	}
+	name := strings.ToLower(c.name)
+	switch name {
+	case "mail":
+		value, err := applySingleValued(c, current(u.mail, string(user.Email)))
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			return ldapErrorf(LDAPResultConstraintViolation, "mail is required")
+		}
+		u.mail = &value
+	case "telephonenumber":
+		value, err := applySingleValued(c, current(u.phone, string(user.Phone)))
+		if err != nil {
+			return err
+		}
+		u.phone = &value
+	case "cn", "sn", "givenname":
+		key := userAttributeKeys[name]
+		existing, _ := user.Attributes[key].(string)
+		value, err := applySingleValued(c, current(u.attributes[key], existing))
+		if err != nil {
+			return err
+		}
+		u.attributes[key] = &value
+	case "uid":
+		return ldapErrorf(LDAPResultNotAllowedOnRDN, "uid names the entry")
+	case "objectclass", "memberof":
+		return ldapErrorf(LDAPResultUnwillingToPerform, "%s cannot be changed", c.name)
+	default:
+		return ldapErrorf(LDAPResultUndefinedAttributeType, "%s cannot be set on users", c.name)
+	}
+	return nil
+}
+
+// update sets the changed values on a user.
+func (u *userChanges) update(user *types.User) {
+	if u.mail != nil {
+		user.Email = types.EncryptedString(*u.mail)
+	}
+	if u.phone != nil {
+		user.Phone = types.EncryptedString(*u.phone)
+	}
+	if len(u.attributes) > 0 && user.Attributes == nil {
+		user.Attributes = make(map[string]interface{})
+	}
+	for key, value := range u.attributes {
+		if *value == "" {
+			delete(user.Attributes, key)
+		} else {
+			user.Attributes[key] = *value
+		}
+	}
+}
+
+// applySingleValued applies a change to an attribute with at most one
+// value, and returns the new value, empty when there is none.
+func applySingleValued(c attribute, current string) (string, error) {
+	switch c.op {
+	case modifyAdd:
+		if len(c.values) != 1 {
+			return "", ldapErrorf(LDAPResultConstraintViolation, "%s takes one value", c.name)
+		}
+		if current != "" {
+			return "", ldapErrorf(LDAPResultAttributeOrValueExists, "%s already has a value", c.name)
+		}
+		return c.values[0], nil
+	case modifyReplace:
+		if len(c.values) > 1 {
+			return "", ldapErrorf(LDAPResultConstraintViolation, "%s takes one value", c.name)
+		}
+		if len(c.values) == 0 {
+			return "", nil
+		}
+		return c.values[0], nil
+	case modifyDelete:
+		if current == "" || len(c.values) > 1 || (len(c.values) == 1 && c.values[0] != current) {
+			return "", ldapErrorf(LDAPResultNoSuchAttribute, "%s has no such value", c.name)
+		}
+		return "", nil
+	}
+	return "", ldapErrorf(LDAPResultUnwillingToPerform, "Unsupported modify operation %d", c.op)
+}
+
+func (s *Server) modifyGroup(ctx context.Context, group *types.UserGroup, changes []attribute) error {
+	current, err := s.virtualTree.groupMembers(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	members := make(map[string]bool, len(current))
+	for _, u := range current {
+		members[u.ID] = true
+	}
+	description := group.Description
+
+	for _, c := range changes {
+		switch strings.ToLower(c.name) {
+		case "description":
+			if description, err = applySingleValued(c, description); err != nil {
+				return err
+			}
+		case "member", "uniquemember":
+			users := make([]*types.User, 0, len(c.values))
+			for _, dn := range c.values {
+				user, err := s.memberUser(ctx, dn)
+				if err != nil {
+					return err
+				}
+				users = append(users, user)
+			}
+			switch c.op {
+			case modifyAdd:
+				for _, u := range users {
+					members[u.ID] = true
+				}
+			case modifyDelete:
+				if len(users) == 0 {
+					members = map[string]bool{}
+				}
+				for _, u := range users {
+					if !members[u.ID] {
+						return ldapErrorf(LDAPResultNoSuchAttribute, "%s is not a member", u.Username)
+					}
+					delete(members, u.ID)
+				}
+			case modifyReplace:
+				members = map[string]bool{}
+				for _, u := range users {
+					members[u.ID] = true
+				}
+			default:
+				return ldapErrorf(LDAPResultUnwillingToPerform, "Unsupported modify operation %d", c.op)
+			}
+		case "cn":
+			return ldapErrorf(LDAPResultNotAllowedOnRDN, "cn names the entry")
+		case "objectclass":
+			return ldapErrorf(LDAPResultUnwillingToPerform, "%s cannot be changed", c.name)
+		default:
+			return ldapErrorf(LDAPResultUndefinedAttributeType, "%s cannot be set on groups", c.name)
+		}
+	}
+
+	if description != group.Description {
+		group.Description = description
+		if err := s.userService.UpdateGroup(ctx, group); err != nil {
+			return err
+		}
+	}
+	for _, u := range current {
+		if !members[u.ID] {
+			if err := s.userService.RemoveUserFromGroup(ctx, u.ID, group.ID); err != nil {
+				return err
+			}
+		}
+		delete(members, u.ID)
+	}
+	for userID := range members {
+		if err := s.userService.AddUserToGroup(ctx, userID, group.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleDelete handles a DelRequest, which deletes a user or a group.
+func (s *Server) HandleDelete(ctx context.Context, state *connState, messageID int64, req *ber.Packet) *ber.Packet {
+	// DelRequest ::= [APPLICATION 10] LDAPDN
+	err := s.delete(ctx, state, string(req.Data.Bytes()))
+	recordWrite("delete", err)
+	if err != nil {
+		code, msg := s.errorResult(err)
+		return encodeLDAPResult(messageID, ApplicationDelResponse, code, "", msg)
+	}
+	return encodeLDAPResult(messageID, ApplicationDelResponse, LDAPResultSuccess, "", "")
+}
+
+func (s *Server) delete(ctx context.Context, state *connState, dn string) error {
+	t, err := s.resolve(ctx, dn)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(ctx, state, ActionDelete, t.resource(nil)); err != nil {
+		return err
+	}
+	if t.user != nil {
+		return s.userService.DeleteUser(ctx, t.user.ID)
+	}
+	return s.userService.DeleteGroup(ctx, t.group.ID)
+}
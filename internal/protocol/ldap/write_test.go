@@ -0,0 +1,296 @@
+package ldap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/domain/policy"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+const (
+	adminDN = "uid=admin,ou=users,dc=example,dc=com"
+	usersDN = "ou=users,dc=example,dc=com"
+)
+
+// groupAuthorizer allows every action to the members of the admins group.
+type groupAuthorizer struct {
+	requests []policy.EvaluationContext
+}
+
+func (a *groupAuthorizer) Authorize(ctx context.Context, evalCtx policy.EvaluationContext) (policy.Decision, error) {
+	a.requests = append(a.requests, evalCtx)
+	for _, g := range evalCtx.Subject.Groups {
+		if g == "admins" {
+			return policy.DecisionAllow, nil
+		}
+	}
+	return policy.DecisionDeny, nil
+}
+
+// actionAuthorizer allows the listed actions to everyone.
+type actionAuthorizer map[policy.Action]bool
+
+func (a actionAuthorizer) Authorize(ctx context.Context, evalCtx policy.EvaluationContext) (policy.Decision, error) {
+	if a[evalCtx.Action] {
+		return policy.DecisionAllow, nil
+	}
+	return policy.DecisionDeny, nil
+}
+
+type writeFixture struct {
+	server     *Server
+	svc        identity.IService
+	passwords  staticPasswords
+	authorizer *groupAuthorizer
+	alice      *types.User
+	admin      *types.User
+}
+
+func newWriteFixture(t *testing.T) *writeFixture {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	alice := &types.User{ID: "alice-id", Username: "alice", Email: "alice@example.com", Status: types.UserStatusActive}
+	admin := &types.User{ID: "admin-id", Username: "admin", Email: "admin@example.com", Status: types.UserStatusActive}
+	require.NoError(t, repo.CreateUser(ctx, alice))
+	require.NoError(t, repo.CreateUser(ctx, admin))
+	admins := &types.UserGroup{Name: "admins"}
+	require.NoError(t, repo.CreateGroup(ctx, admins))
+	require.NoError(t, repo.AddUserToGroup(ctx, admin.ID, admins.ID))
+
+	svc := identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))
+	passwords := staticPasswords{alice.ID: "secret", admin.ID: "admin-secret"}
+	server := NewServer("127.0.0.1:0", "dc=example,dc=com", nil, svc, passwords, zap.NewNop())
+	authorizer := &groupAuthorizer{}
+	server.SetAuthorizer(authorizer)
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+	return &writeFixture{server: server, svc: svc, passwords: passwords, authorizer: authorizer, alice: alice, admin: admin}
+}
+
+func (f *writeFixture) dial(t *testing.T, dn, password string) *ldap.Conn {
+	conn, err := ldap.DialURL("ldap://" + f.server.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	if dn != "" {
+		require.NoError(t, conn.Bind(dn, password))
+	}
+	return conn
+}
+
+func TestModifyUser(t *testing.T) {
+	f := newWriteFixture(t)
+	conn := f.dial(t, adminDN, "admin-secret")
+
+	modify := ldap.NewModifyRequest(aliceDN, nil)
+	modify.Replace("mail", []string{"alice@example.org"})
+	modify.Add("telephoneNumber", []string{"+1 555 0100"})
+	modify.Replace("cn", []string{"Alice Liddell"})
+	require.NoError(t, conn.Modify(modify))
+
+	user, err := f.svc.GetUserByUsername(context.Background(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, types.EncryptedString("alice@example.org"), user.Email)
+	assert.Equal(t, types.EncryptedString("+1 555 0100"), user.Phone)
+	assert.Equal(t, "Alice Liddell", user.Attributes["displayName"])
+
+	request := f.authorizer.requests[len(f.authorizer.requests)-1]
+	assert.Equal(t, ActionModify, request.Action)
+	assert.Equal(t, f.admin.ID, request.Subject.UserID)
+	assert.Equal(t, policy.Resource{Type: "user", ID: f.alice.ID, Attributes: map[string]string{"dn": aliceDN, "attributes": "mail,telephoneNumber,cn"}}, request.Resource)
+
+	result, err := conn.Search(ldap.NewSearchRequest(aliceDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"mail", "telephoneNumber"}, nil))
+	require.NoError(t, err)
+	require.Len(t, result.Entries, 1)
+	assert.Equal(t, "+1 555 0100", result.Entries[0].GetAttributeValue("telephoneNumber"))
+
+	// Another user's address, a second phone number and renames are refused.
+	taken := ldap.NewModifyRequest(aliceDN, nil)
+	taken.Replace("mail", []string{"admin@example.com"})
+	assert.True(t, ldap.IsErrorWithCode(conn.Modify(taken), ldap.LDAPResultConstraintViolation))
+	phone := ldap.NewModifyRequest(aliceDN, nil)
+	phone.Add("telephoneNumber", []string{"+1 555 0199"})
+	assert.True(t, ldap.IsErrorWithCode(conn.Modify(phone), ldap.LDAPResultAttributeOrValueExists))
+	rename := ldap.NewModifyRequest(aliceDN, nil)
+	rename.Replace("uid", []string{"alicia"})
+	assert.True(t, ldap.IsErrorWithCode(conn.Modify(rename), ldap.LDAPResultNotAllowedOnRDN))
+
+	// Passwords are set through the password service.
+	password := ldap.NewModifyRequest(aliceDN, nil)
+	password.Replace("userPassword", []string{"new-secret"})
+	require.NoError(t, conn.Modify(password))
+	assert.Equal(t, "new-secret", f.passwords[f.alice.ID])
+	assert.Equal(t, ActionPasswordReset, f.authorizer.requests[len(f.authorizer.requests)-1].Action)
+
+	// Replacing a password needs the reset permission, not just modify.
+	f.server.SetAuthorizer(actionAuthorizer{ActionModify: true})
+	password = ldap.NewModifyRequest(aliceDN, nil)
+	password.Replace("userPassword", []string{"modify-only"})
+	assert.True(t, ldap.IsErrorWithCode(conn.Modify(password), ldap.LDAPResultInsufficientAccessRights))
+	assert.Equal(t, "new-secret", f.passwords[f.alice.ID])
+}
+
+func TestWritesNeedAuthorization(t *testing.T) {
+	f := newWriteFixture(t)
+	modify := ldap.NewModifyRequest(adminDN, nil)
+	modify.Replace("mail", []string{"mallory@example.com"})
+
+	denied := testutil.ToFloat64(WritesTotal.WithLabelValues("modify", "denied"))
+	anonymous := f.dial(t, "", "")
+	assert.True(t, ldap.IsErrorWithCode(anonymous.Modify(modify), ldap.LDAPResultInsufficientAccessRights))
+	alice := f.dial(t, aliceDN, "secret")
+	assert.True(t, ldap.IsErrorWithCode(alice.Modify(modify), ldap.LDAPResultInsufficientAccessRights))
+	assert.True(t, ldap.IsErrorWithCode(alice.Del(ldap.NewDelRequest(adminDN, nil)), ldap.LDAPResultInsufficientAccessRights))
+	assert.Equal(t, denied+2, testutil.ToFloat64(WritesTotal.WithLabelValues("modify", "denied")))
+
+	// Without an authorizer, the directory is read-only.
+	f.server.SetAuthorizer(nil)
+	admin := f.dial(t, adminDN, "admin-secret")
+	assert.True(t, ldap.IsErrorWithCode(admin.Modify(modify), ldap.LDAPResultUnwillingToPerform))
+
+	user, err := f.svc.GetUserByUsername(context.Background(), "admin")
+	require.NoError(t, err)
+	assert.Equal(t, types.EncryptedString("admin@example.com"), user.Email)
+}
+
+func TestAddAndDelete(t *testing.T) {
+	f := newWriteFixture(t)
+	ctx := context.Background()
+	conn := f.dial(t, adminDN, "admin-secret")
+	bobDN := "uid=bob,ou=users,dc=example,dc=com"
+	opsDN := "cn=ops,ou=groups,dc=example,dc=com"
+
+	add := ldap.NewAddRequest(bobDN, nil)
+	add.Attribute("objectClass", []string{"inetOrgPerson"})
+	add.Attribute("uid", []string{"bob"})
+	add.Attribute("mail", []string{"bob@example.com"})
+	add.Attribute("userPassword", []string{"bob-secret"})
+	add.Attribute("givenName", []string{"Bob"})
+	require.NoError(t, conn.Add(add))
+	assert.True(t, ldap.IsErrorWithCode(conn.Add(add), ldap.LDAPResultEntryAlreadyExists))
+
+	bob, err := f.svc.GetUserByUsername(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "Bob", bob.Attributes["firstName"])
+
+	noMail := ldap.NewAddRequest("uid=carol,ou=users,dc=example,dc=com", nil)
+	noMail.Attribute("userPassword", []string{"carol-secret"})
+	assert.True(t, ldap.IsErrorWithCode(conn.Add(noMail), ldap.LDAPResultObjectClassViolation))
+	misnamed := ldap.NewAddRequest("cn=carol,ou=users,dc=example,dc=com", nil)
+	assert.True(t, ldap.IsErrorWithCode(conn.Add(misnamed), ldap.LDAPResultNamingViolation))
+
+	group := ldap.NewAddRequest(opsDN, nil)
+	group.Attribute("objectClass", []string{"groupOfNames"})
+	group.Attribute("description", []string{"Operations"})
+	group.Attribute("member", []string{aliceDN})
+	require.NoError(t, conn.Add(group))
+
+	// Membership changes are made through the identity service.
+	members := ldap.NewModifyRequest(opsDN, nil)
+	members.Add("member", []string{bobDN})
+	members.Delete("member", []string{aliceDN})
+	require.NoError(t, conn.Modify(members))
+	groups, err := f.svc.GetUserGroups(ctx, bob.ID)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, "ops", groups[0].Name)
+	groups, err = f.svc.GetUserGroups(ctx, f.alice.ID)
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+
+	require.NoError(t, conn.Del(ldap.NewDelRequest(opsDN, nil)))
+	require.NoError(t, conn.Del(ldap.NewDelRequest(bobDN, nil)))
+	_, err = f.svc.GetUserByUsername(ctx, "bob")
+	assert.Error(t, err)
+	assert.True(t, ldap.IsErrorWithCode(conn.Del(ldap.NewDelRequest(bobDN, nil)), ldap.LDAPResultNoSuchObject))
+	assert.True(t, ldap.IsErrorWithCode(conn.Del(ldap.NewDelRequest(usersDN, nil)), ldap.LDAPResultUnwillingToPerform))
+}
+
+func TestPasswordModify(t *testing.T) {
+	f := newWriteFixture(t)
+	alice := f.dial(t, aliceDN, "secret")
+
+	// Users change their own password with the old one.
+	_, err := alice.PasswordModify(ldap.NewPasswordModifyRequest("", "wrong", "changed"))
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials), "got %v", err)
+	_, err = alice.PasswordModify(ldap.NewPasswordModifyRequest("", "secret", "changed"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed", f.passwords[f.alice.ID])
+
+	// Other passwords need the reset permission, which is checked before an
+	// old password, so the request cannot be used to guess it.
+	_, err = alice.PasswordModify(ldap.NewPasswordModifyRequest(adminDN, "", "mine-now"))
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights), "got %v", err)
+	_, err = alice.PasswordModify(ldap.NewPasswordModifyRequest(adminDN, "wrong", "mine-now"))
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights), "got %v", err)
+	_, err = alice.PasswordModify(ldap.NewPasswordModifyRequest(adminDN, "admin-secret", "mine-now"))
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights), "got %v", err)
+	assert.Equal(t, "admin-secret", f.passwords[f.admin.ID])
+
+	admin := f.dial(t, adminDN, "admin-secret")
+	_, err = admin.PasswordModify(ldap.NewPasswordModifyRequest("u:alice", "", "reset"))
+	require.NoError(t, err)
+	assert.Equal(t, "reset", f.passwords[f.alice.ID])
+	assert.Equal(t, ActionPasswordReset, f.authorizer.requests[len(f.authorizer.requests)-1].Action)
+
+	anonymous := f.dial(t, "", "")
+	_, err = anonymous.PasswordModify(ldap.NewPasswordModifyRequest(aliceDN, "reset", "anonymous"))
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights), "got %v", err)
+}
+
+func TestPasswordModifyLockout(t *testing.T) {
+	f := newWriteFixture(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()}))
+	tracker := lockout.NewTracker(client, lockout.Config{MaxFailures: 3, ThrottleAfter: 100, LockoutDuration: time.Minute}, zap.NewNop())
+	f.server.SetLockoutTracker(tracker)
+	alice := f.dial(t, aliceDN, "secret")
+
+	for i := 0; i < 3; i++ {
+		_, err := alice.PasswordModify(ldap.NewPasswordModifyRequest("", "wrong", "changed"))
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials), "got %v", err)
+	}
+
+	// The right old password no longer helps while the account is locked.
+	_, err := alice.PasswordModify(ldap.NewPasswordModifyRequest("", "secret", "changed"))
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials), "got %v", err)
+	assert.Equal(t, "secret", f.passwords[f.alice.ID])
+}
+
+func TestWhoAmIAndCompare(t *testing.T) {
+	f := newWriteFixture(t)
+	conn := f.dial(t, "", "")
+
+	who, err := conn.WhoAmI(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", who.AuthzID)
+	require.NoError(t, conn.Bind(aliceDN, "secret"))
+	who, err = conn.WhoAmI(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "dn:"+aliceDN, who.AuthzID)
+
+	matched, err := conn.Compare(aliceDN, "mail", "ALICE@example.com")
+	require.NoError(t, err)
+	assert.True(t, matched)
+	matched, err = conn.Compare("cn=admins,ou=groups,dc=example,dc=com", "member", "UID=admin, ou=users,dc=example,dc=com")
+	require.NoError(t, err)
+	assert.True(t, matched)
+	matched, err = conn.Compare(aliceDN, "memberOf", "cn=admins,ou=groups,dc=example,dc=com")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute), "got %v", err)
+	assert.False(t, matched)
+	_, err = conn.Compare("uid=nobody,ou=users,dc=example,dc=com", "mail", "x")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), "got %v", err)
+}
@@ -3,12 +3,14 @@ package radius
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"time"
 	"fmt"
 	"net"
 
 	"gorm.io/gorm"
 	"github.com/turtacn/QuantaID/internal/storage/postgresql/models"
+	"github.com/turtacn/QuantaID/pkg/types"
 )
 
 type AccountingHandler struct {
@@ -42,17 +44,26 @@ func (h *AccountingHandler) Handle(ctx context.Context, request *Packet, client
 
 	// Create record object
 	record := models.RadiusAccounting{
-		ID:            fmt.Sprintf("%s-%d", sessionID, time.Now().UnixNano()), // Simple ID generation
-		SessionID:     sessionID,
-		Username:      username,
-		StatusType:    statusType,
-		NASIdentifier: request.GetString(AttrNASIdentifier),
-		NASIPAddress:  request.GetString(AttrNASIPAddress), // Or use client IP
-		CreatedAt:     time.Now(),
+		ID:             fmt.Sprintf("%s-%d", sessionID, time.Now().UnixNano()), // Simple ID generation
+		SessionID:      sessionID,
+		Username:       username,
+		StatusType:     statusType,
+		NASIdentifier:  request.GetString(AttrNASIdentifier),
+		NASIPAddress:   ipAttribute(request, AttrNASIPAddress),
+		FramedIP:       ipAttribute(request, AttrFramedIPAddress),
+		CalledStation:  request.GetString(AttrCalledStationId),
+		CallingStation: request.GetString(AttrCallingStationId),
+		CreatedAt:      time.Now(),
+	}
+	if val := request.GetAttribute(AttrNASPort); val != nil && len(val.Value) == 4 {
+		record.NASPort = int(binary.BigEndian.Uint32(val.Value))
 	}
 
-	if record.NASIPAddress == "" && remoteAddr != nil {
-		record.NASIPAddress = remoteAddr.IP.String()
+	if remoteAddr != nil {
+		record.ClientAddress = remoteAddr.IP.String()
+		if record.NASIPAddress == "" {
+			record.NASIPAddress = record.ClientAddress
+		}
 	}
 
 	// Parse other accounting metrics
@@ -100,3 +111,48 @@ func (h *AccountingHandler) Handle(ctx context.Context, request *Packet, client
 	response := request.CreateResponse(CodeAccountingResponse)
 	return response, nil
 }
+
+// GetSession returns the latest record of an accounting session, or
+// types.ErrNotFound.
+func (h *AccountingHandler) GetSession(ctx context.Context, sessionID string) (*models.RadiusAccounting, error) {
+	var record models.RadiusAccounting
+	err := h.db.WithContext(ctx).Where("session_id = ?", sessionID).Order("created_at DESC").First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, types.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// ActiveSessions returns the latest record of each session of a user that
+// has not stopped.
+func (h *AccountingHandler) ActiveSessions(ctx context.Context, username string) ([]*models.RadiusAccounting, error) {
+	var records []*models.RadiusAccounting
+	err := h.db.WithContext(ctx).Where("username = ?", username).Order("created_at DESC").Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	active := make([]*models.RadiusAccounting, 0)
+	for _, record := range records {
+		if seen[record.SessionID] {
+			continue
+		}
+		seen[record.SessionID] = true
+		if record.StatusType != AcctStatusStop {
+			active = append(active, record)
+		}
+	}
+	return active, nil
+}
+
+// ipAttribute returns the address of an IPv4 address attribute, or "".
+func ipAttribute(p *Packet, attrType byte) string {
+	attr := p.GetAttribute(attrType)
+	if attr == nil || len(attr.Value) != net.IPv4len {
+		return ""
+	}
+	return net.IP(attr.Value).String()
+}
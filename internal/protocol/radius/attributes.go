@@ -54,11 +54,14 @@ const (
 	AttrTunnelMediumType  = 65
 	AttrTunnelClientEndpoint = 66
 	AttrTunnelServerEndpoint = 67
+	AttrTunnelPassword    = 69
 	AttrConnectInfo       = 77
 	AttrEAPMessage        = 79
 	AttrMessageAuthenticator = 80
 	AttrTunnelPrivateGroupID = 81
+	AttrAcctInterimInterval  = 85
 	AttrNASPortId         = 87
+	AttrErrorCause        = 101
 )
 
 // Accounting Attributes (RFC 2866)
@@ -118,11 +121,17 @@ type AttrDefinition struct {
 	Name    string
 	Type    AttrValueType
 	Encrypt bool // Whether to encrypt (like User-Password)
+	// Tagged attributes carry a tag that groups them (RFC 2868).
+	Tagged bool
+	// Values names the values of an integer attribute.
+	Values map[string]uint32
 }
 
 type AttributeCodec struct {
 	dictionary map[byte]AttrDefinition
 	vendors    map[uint32]map[byte]AttrDefinition
+	// vendorIDs maps vendor names to their IDs.
+	vendorIDs map[string]uint32
 }
 
 // NewAttributeCodec creates a new attribute codec with standard definitions.
@@ -130,6 +139,7 @@ func NewAttributeCodec() *AttributeCodec {
 	c := &AttributeCodec{
 		dictionary: make(map[byte]AttrDefinition),
 		vendors:    make(map[uint32]map[byte]AttrDefinition),
+		vendorIDs:  make(map[string]uint32),
 	}
 	c.loadStandardAttributes()
 	c.loadMicrosoftAttributes()
@@ -143,16 +153,33 @@ func (c *AttributeCodec) loadStandardAttributes() {
 		AttrCHAPPassword:     {Name: "CHAP-Password", Type: AttrTypeOctets},
 		AttrNASIPAddress:     {Name: "NAS-IP-Address", Type: AttrTypeIPAddr},
 		AttrNASPort:          {Name: "NAS-Port", Type: AttrTypeInteger},
-		AttrServiceType:      {Name: "Service-Type", Type: AttrTypeInteger},
+		AttrServiceType: {Name: "Service-Type", Type: AttrTypeInteger, Values: map[string]uint32{
+			"Login-User": 1, "Framed-User": 2, "Callback-Login-User": 3, "Callback-Framed-User": 4,
+			"Outbound-User": 5, "Administrative-User": 6, "NAS-Prompt-User": 7, "Authenticate-Only": 8,
+			"Call-Check": 10, "Authorize-Only": 17,
+		}},
+		AttrFramedProtocol:   {Name: "Framed-Protocol", Type: AttrTypeInteger, Values: map[string]uint32{"PPP": 1, "SLIP": 2}},
 		AttrFramedIPAddress:  {Name: "Framed-IP-Address", Type: AttrTypeIPAddr},
+		AttrFramedIPNetmask:  {Name: "Framed-IP-Netmask", Type: AttrTypeIPAddr},
+		AttrFilterId:         {Name: "Filter-Id", Type: AttrTypeString},
+		AttrFramedMTU:        {Name: "Framed-MTU", Type: AttrTypeInteger},
 		AttrReplyMessage:     {Name: "Reply-Message", Type: AttrTypeString},
 		AttrState:            {Name: "State", Type: AttrTypeOctets},
 		AttrClass:            {Name: "Class", Type: AttrTypeOctets},
 		AttrSessionTimeout:   {Name: "Session-Timeout", Type: AttrTypeInteger},
 		AttrIdleTimeout:      {Name: "Idle-Timeout", Type: AttrTypeInteger},
+		AttrTerminationAction: {Name: "Termination-Action", Type: AttrTypeInteger, Values: map[string]uint32{"Default": 0, "RADIUS-Request": 1}},
+		AttrCalledStationId:  {Name: "Called-Station-Id", Type: AttrTypeString},
+		AttrCallingStationId: {Name: "Calling-Station-Id", Type: AttrTypeString},
 		AttrNASIdentifier:    {Name: "NAS-Identifier", Type: AttrTypeString},
 		AttrCHAPChallenge:    {Name: "CHAP-Challenge", Type: AttrTypeOctets},
 		AttrNASPortType:      {Name: "NAS-Port-Type", Type: AttrTypeInteger},
+		AttrTunnelType:       {Name: "Tunnel-Type", Type: AttrTypeInteger, Tagged: true, Values: map[string]uint32{"PPTP": 1, "L2TP": 3, "GRE": 10, "VLAN": 13}},
+		AttrTunnelMediumType: {Name: "Tunnel-Medium-Type", Type: AttrTypeInteger, Tagged: true, Values: map[string]uint32{"IPv4": 1, "IPv6": 2, "IEEE-802": 6}},
+		AttrTunnelPrivateGroupID: {Name: "Tunnel-Private-Group-Id", Type: AttrTypeString, Tagged: true},
+		AttrEAPMessage:       {Name: "EAP-Message", Type: AttrTypeOctets},
+		AttrMessageAuthenticator: {Name: "Message-Authenticator", Type: AttrTypeOctets},
+		AttrAcctInterimInterval: {Name: "Acct-Interim-Interval", Type: AttrTypeInteger},
 		AttrAcctStatusType:   {Name: "Acct-Status-Type", Type: AttrTypeInteger},
 		AttrAcctSessionId:    {Name: "Acct-Session-Id", Type: AttrTypeString},
 		AttrAcctSessionTime:  {Name: "Acct-Session-Time", Type: AttrTypeInteger},
@@ -162,11 +189,16 @@ func (c *AttributeCodec) loadStandardAttributes() {
 func (c *AttributeCodec) loadMicrosoftAttributes() {
 	// Microsoft Vendor attributes could be added here if we need to parse them by name.
 	// For now, we often handle VSA manually or by ID.
+	c.vendorIDs["Microsoft"] = VendorMicrosoft
 	c.vendors[VendorMicrosoft] = map[byte]AttrDefinition{
 		MSCHAPChallenge: {Name: "MS-CHAP-Challenge", Type: AttrTypeOctets},
 		MSCHAP2Response: {Name: "MS-CHAP2-Response", Type: AttrTypeOctets},
 		MSCHAP2Success:  {Name: "MS-CHAP2-Success", Type: AttrTypeOctets},
 		MSCHAPError:     {Name: "MS-CHAP-Error", Type: AttrTypeString},
+		MSMPPESendKey:   {Name: "MS-MPPE-Send-Key", Type: AttrTypeOctets, Encrypt: true},
+		MSMPPERecvKey:   {Name: "MS-MPPE-Recv-Key", Type: AttrTypeOctets, Encrypt: true},
+		MSMPPEEncryptionPolicy: {Name: "MS-MPPE-Encryption-Policy", Type: AttrTypeInteger, Values: map[string]uint32{"Encryption-Allowed": 1, "Encryption-Required": 2}},
+		MSMPPEEncryptionTypes:  {Name: "MS-MPPE-Encryption-Types", Type: AttrTypeInteger},
 	}
 }
 
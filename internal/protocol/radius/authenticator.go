@@ -5,9 +5,11 @@ import (
 	"crypto/md5"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/internal/domain/password"
 	"github.com/turtacn/QuantaID/pkg/types"
@@ -27,6 +29,9 @@ type Authenticator struct {
 	codec           *AttributeCodec
 	config          AuthenticatorConfig
 	mschap          *MSCHAPHandler
+	lockout         *lockout.Tracker
+	eap             *EAPHandler
+	policies        *PolicyManager
 }
 
 func NewAuthenticator(userService identity.IService, passwordService password.IService, codec *AttributeCodec, config AuthenticatorConfig) *Authenticator {
@@ -37,14 +42,61 @@ func NewAuthenticator(userService identity.IService, passwordService password.IS
 		config:          config,
 	}
 	auth.mschap = NewMSCHAPHandler(userService, passwordService, codec)
+	auth.mschap.authorize = auth.authorize
 	return auth
 }
 
+// SetPolicyManager sets the policies that authorize accepted users and
+// select the reply attributes of their Access-Accepts.
+func (a *Authenticator) SetPolicyManager(policies *PolicyManager) {
+	a.policies = policies
+}
+
+// SetLockoutTracker sets the tracker that counts failed authentications and
+// rejects requests for locked or throttled accounts.
+func (a *Authenticator) SetLockoutTracker(tracker *lockout.Tracker) {
+	a.lockout = tracker
+}
+
+// Authenticate authenticates an Access-Request. When a lockout tracker is
+// set, the outcome counts towards the lockout of the account and of the
+// calling station, the client behind the NAS. EAP methods apply the lockout
+// to the identity they authenticate themselves, as the outer User-Name of a
+// tunneled method is usually an anonymous one shared by all users.
 func (a *Authenticator) Authenticate(ctx context.Context, request *Packet, client *RADIUSClient) (*Packet, error) {
 	username := request.GetString(AttrUserName)
 	if username == "" {
 		return a.createReject(request, "Missing username"), nil
 	}
+	if a.lockout == nil || request.GetAttribute(AttrEAPMessage) != nil {
+		return a.authenticate(ctx, request, client, username)
+	}
+
+	station := request.GetString(AttrCallingStationId)
+	if err := a.lockout.Check(ctx, username, station); err != nil {
+		return a.createReject(request, "Invalid credentials"), nil
+	}
+	response, err := a.authenticate(ctx, request, client, username)
+	if err == nil && response != nil {
+		switch response.Code {
+		case CodeAccessAccept:
+			a.lockout.RecordSuccess(ctx, username)
+		case CodeAccessReject:
+			a.lockout.RecordFailure(ctx, username, station)
+		}
+	}
+	return response, err
+}
+
+func (a *Authenticator) authenticate(ctx context.Context, request *Packet, client *RADIUSClient, username string) (*Packet, error) {
+
+	// 0. EAP (802.1X) when enabled
+	if request.GetAttribute(AttrEAPMessage) != nil {
+		if a.eap == nil {
+			return a.createReject(request, "EAP not supported"), nil
+		}
+		return a.eap.Handle(ctx, request, client)
+	}
 
 	// 1. Check for CHAP
 	if chapPassword := request.GetAttribute(AttrCHAPPassword); chapPassword != nil {
@@ -89,6 +141,9 @@ func (a *Authenticator) authenticatePAP(ctx context.Context, request *Packet, cl
 	// Verify password
 	// Assuming password service has Verify method
 	valid, err := a.passwordService.Verify(ctx, u.ID, passwordStr)
+	if errors.Is(err, types.ErrPasswordExpired) {
+		return a.createReject(request, "Password expired"), nil
+	}
 	if err != nil || !valid {
 		return a.createReject(request, "Invalid credentials"), nil
 	}
@@ -96,7 +151,7 @@ func (a *Authenticator) authenticatePAP(ctx context.Context, request *Packet, cl
 	// MFA Verification (Placeholder)
 	// if a.config.RequireMFA { ... }
 
-	return a.createAccept(request, u), nil
+	return a.authorize(ctx, request, client, u, a.createAccept(request, u)), nil
 }
 
 func (a *Authenticator) authenticateCHAP(ctx context.Context, request *Packet, client *RADIUSClient, username string, chapPassword *Attribute) (*Packet, error) {
@@ -136,7 +191,7 @@ func (a *Authenticator) authenticateCHAP(ctx context.Context, request *Packet, c
 		return a.createReject(request, "Invalid credentials"), nil
 	}
 
-	return a.createAccept(request, u), nil
+	return a.authorize(ctx, request, client, u, a.createAccept(request, u)), nil
 }
 
 func (a *Authenticator) isMSCHAPRequest(request *Packet) bool {
@@ -182,6 +237,42 @@ func (a *Authenticator) createAccept(request *Packet, user *types.User) *Packet
 	return response
 }
 
+// authorize applies the policies to the Access-Accept of user. Policy
+// attributes replace standard attributes of the same type the accept already
+// has, such as the default Session-Timeout. It returns an Access-Reject when
+// a policy denies access or the policies cannot be evaluated.
+func (a *Authenticator) authorize(ctx context.Context, request *Packet, client *RADIUSClient, user *types.User, accept *Packet) *Packet {
+	if a.policies == nil {
+		return accept
+	}
+	groups, err := a.userService.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		return a.createReject(request, "Authorization failed")
+	}
+	authz, err := a.policies.Authorize(ctx, client, groups)
+	if err != nil {
+		return a.createReject(request, "Authorization failed")
+	}
+	if authz.Deny {
+		return a.createReject(request, "Access denied")
+	}
+
+	replaced := make(map[byte]bool)
+	for _, attr := range authz.Attributes {
+		if attr.Type != AttrVendorSpecific {
+			replaced[attr.Type] = true
+		}
+	}
+	attributes := accept.Attributes[:0]
+	for _, attr := range accept.Attributes {
+		if !replaced[attr.Type] {
+			attributes = append(attributes, attr)
+		}
+	}
+	accept.Attributes = append(attributes, authz.Attributes...)
+	return accept
+}
+
 func (a *Authenticator) createReject(request *Packet, message string) *Packet {
 	response := request.CreateResponse(CodeAccessReject)
 	response.AddAttribute(AttrReplyMessage, []byte(message))
@@ -0,0 +1,272 @@
+package radius
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAttributeValue is the longest value of an attribute, and of a
+// vendor-specific attribute inside the Vendor-Specific value.
+const (
+	maxAttributeValue = 253
+	maxVendorValue    = maxAttributeValue - 6
+)
+
+// LoadDictionaryFile loads attribute definitions from a dictionary file. See
+// LoadDictionary.
+func (c *AttributeCodec) LoadDictionaryFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := c.LoadDictionary(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadDictionary loads attribute definitions in the FreeRADIUS dictionary
+// format: VENDOR, BEGIN-VENDOR, END-VENDOR, ATTRIBUTE with the has_tag and
+// encrypt flags, and VALUE. Attribute types other than string, integer,
+// ipaddr, date and octets are read as octets. Definitions replace those of
+// the same code. Dictionaries must be loaded before the codec is used.
+func (c *AttributeCodec) LoadDictionary(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var vendor uint32
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := c.parseDictionaryLine(fields, &vendor); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *AttributeCodec) parseDictionaryLine(fields []string, vendor *uint32) error {
+	switch fields[0] {
+	case "VENDOR":
+		if len(fields) < 3 {
+			return fmt.Errorf("VENDOR needs a name and an ID")
+		}
+		id, err := strconv.ParseUint(fields[2], 0, 32)
+		if err != nil || id == 0 {
+			return fmt.Errorf("invalid vendor ID %q", fields[2])
+		}
+		if len(fields) > 3 && fields[3] != "format=1,1" {
+			return fmt.Errorf("unsupported vendor %s", fields[3])
+		}
+		c.vendorIDs[fields[1]] = uint32(id)
+		if c.vendors[uint32(id)] == nil {
+			c.vendors[uint32(id)] = make(map[byte]AttrDefinition)
+		}
+	case "BEGIN-VENDOR":
+		if len(fields) < 2 {
+			return fmt.Errorf("BEGIN-VENDOR needs a vendor")
+		}
+		id, ok := c.vendorIDs[fields[1]]
+		if !ok {
+			return fmt.Errorf("unknown vendor %q", fields[1])
+		}
+		*vendor = id
+	case "END-VENDOR":
+		*vendor = 0
+	case "ATTRIBUTE":
+		if len(fields) < 4 {
+			return fmt.Errorf("ATTRIBUTE needs a name, a code and a type")
+		}
+		code, err := strconv.ParseUint(fields[2], 0, 8)
+		if err != nil || code == 0 {
+			return fmt.Errorf("invalid attribute code %q", fields[2])
+		}
+		def := AttrDefinition{Name: fields[1], Type: dictionaryType(fields[3])}
+		target := *vendor
+		for _, option := range fields[4:] {
+			for _, flag := range strings.Split(option, ",") {
+				switch {
+				case flag == "has_tag":
+					def.Tagged = true
+				case strings.HasPrefix(flag, "encrypt="):
+					def.Encrypt = true
+				default:
+					// The old format names the vendor after the type.
+					id, ok := c.vendorIDs[flag]
+					if !ok {
+						return fmt.Errorf("unsupported attribute flag %q", flag)
+					}
+					target = id
+				}
+			}
+		}
+		c.define(target, byte(code), def)
+	case "VALUE":
+		if len(fields) < 4 {
+			return fmt.Errorf("VALUE needs an attribute, a name and a number")
+		}
+		n, err := strconv.ParseUint(fields[3], 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid value %q", fields[3])
+		}
+		vendor, code, def, ok := c.lookup(fields[1])
+		if !ok {
+			return fmt.Errorf("VALUE of unknown attribute %q", fields[1])
+		}
+		if def.Values == nil {
+			def.Values = make(map[string]uint32)
+		}
+		def.Values[fields[2]] = uint32(n)
+		c.define(vendor, code, def)
+	default:
+		return fmt.Errorf("unsupported keyword %q", fields[0])
+	}
+	return nil
+}
+
+func dictionaryType(name string) AttrValueType {
+	switch name {
+	case "string":
+		return AttrTypeString
+	case "integer":
+		return AttrTypeInteger
+	case "ipaddr":
+		return AttrTypeIPAddr
+	case "date":
+		return AttrTypeDate
+	default:
+		return AttrTypeOctets
+	}
+}
+
+func (c *AttributeCodec) define(vendor uint32, code byte, def AttrDefinition) {
+	if vendor == 0 {
+		c.dictionary[code] = def
+		return
+	}
+	if c.vendors[vendor] == nil {
+		c.vendors[vendor] = make(map[byte]AttrDefinition)
+	}
+	c.vendors[vendor][code] = def
+}
+
+// lookup finds an attribute by its name, ignoring case. vendor is 0 for
+// standard attributes.
+func (c *AttributeCodec) lookup(name string) (vendor uint32, code byte, def AttrDefinition, ok bool) {
+	for code, def := range c.dictionary {
+		if strings.EqualFold(def.Name, name) {
+			return 0, code, def, true
+		}
+	}
+	for vendor, defs := range c.vendors {
+		for code, def := range defs {
+			if strings.EqualFold(def.Name, name) {
+				return vendor, code, def, true
+			}
+		}
+	}
+	return 0, 0, AttrDefinition{}, false
+}
+
+// EncodeAttribute encodes the attribute with the given dictionary name and a
+// value in text form: integers as numbers or value names, IP addresses in
+// dotted form, dates as RFC 3339 or Unix time, and octets as 0x-prefixed hex
+// or text. Vendor attributes are wrapped in a Vendor-Specific attribute. tag
+// groups tagged attributes; 0 leaves it out where the format allows.
+func (c *AttributeCodec) EncodeAttribute(name string, tag byte, value string) (Attribute, error) {
+	vendor, code, def, ok := c.lookup(name)
+	if !ok {
+		return Attribute{}, fmt.Errorf("unknown attribute %q", name)
+	}
+	if def.Encrypt {
+		return Attribute{}, fmt.Errorf("attribute %q is encrypted per request", def.Name)
+	}
+	if tag > 0 && !def.Tagged {
+		return Attribute{}, fmt.Errorf("attribute %q has no tag", def.Name)
+	}
+	if tag > 0x1f {
+		return Attribute{}, fmt.Errorf("invalid tag %d", tag)
+	}
+
+	data, err := encodeAttributeValue(def, value)
+	if err != nil {
+		return Attribute{}, fmt.Errorf("attribute %q: %w", def.Name, err)
+	}
+	if def.Tagged {
+		if def.Type == AttrTypeInteger {
+			// The tag takes the high byte of a tagged integer.
+			if data[0] != 0 {
+				return Attribute{}, fmt.Errorf("attribute %q: value does not fit in 24 bits", def.Name)
+			}
+			data[0] = tag
+		} else if tag > 0 {
+			data = append([]byte{tag}, data...)
+		}
+	}
+
+	if vendor != 0 {
+		if len(data) > maxVendorValue {
+			return Attribute{}, fmt.Errorf("attribute %q: value too long", def.Name)
+		}
+		data = c.EncodeVendorSpecific(vendor, code, data)
+		code = AttrVendorSpecific
+	} else if len(data) > maxAttributeValue {
+		return Attribute{}, fmt.Errorf("attribute %q: value too long", def.Name)
+	}
+	return Attribute{Type: code, Length: byte(2 + len(data)), Value: data}, nil
+}
+
+func encodeAttributeValue(def AttrDefinition, value string) ([]byte, error) {
+	switch def.Type {
+	case AttrTypeInteger:
+		n, ok := def.Values[value]
+		if !ok {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer %q", value)
+			}
+			n = uint32(parsed)
+		}
+		return binary.BigEndian.AppendUint32(nil, n), nil
+	case AttrTypeIPAddr:
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", value)
+		}
+		return ip, nil
+	case AttrTypeDate:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return binary.BigEndian.AppendUint32(nil, uint32(t.Unix())), nil
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", value)
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(n)), nil
+	case AttrTypeOctets:
+		if strings.HasPrefix(value, "0x") {
+			data, err := hex.DecodeString(value[2:])
+			if err != nil || len(data) == 0 {
+				return nil, fmt.Errorf("invalid hex %q", value)
+			}
+			return data, nil
+		}
+	}
+	if value == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	return []byte(value), nil
+}
@@ -0,0 +1,261 @@
+package radius
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/turtacn/QuantaID/internal/storage/postgresql/models"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultDynamicAuthorizationPort is the port NAS listen on for
+	// dynamic authorization requests (RFC 5176).
+	DefaultDynamicAuthorizationPort = 3799
+
+	defaultDynamicAuthorizationTimeout = 3 * time.Second
+)
+
+// errorCauses names the Error-Cause values of RFC 5176, section 3.5.
+var errorCauses = map[uint32]string{
+	201: "Residual Session Context Removed",
+	202: "Invalid EAP Packet",
+	401: "Unsupported Attribute",
+	402: "Missing Attribute",
+	403: "NAS Identification Mismatch",
+	404: "Invalid Request",
+	405: "Unsupported Service",
+	406: "Unsupported Extension",
+	407: "Invalid Attribute Value",
+	501: "Administratively Prohibited",
+	502: "Request Not Routable (Proxy)",
+	503: "Session Context Not Found",
+	504: "Session Context Not Removable",
+	505: "Other Proxy Processing Error",
+	506: "Resources Unavailable",
+	507: "Request Initiated",
+	508: "Multiple Session Selection Unsupported",
+}
+
+// NAKError is the Disconnect-NAK or CoA-NAK of a NAS.
+type NAKError struct {
+	Code byte
+	// Cause is the Error-Cause of the NAK, 0 when it has none.
+	Cause uint32
+}
+
+func (e *NAKError) Error() string {
+	name := "Disconnect-NAK"
+	if e.Code == CodeCoANAK {
+		name = "CoA-NAK"
+	}
+	if e.Cause == 0 {
+		return "NAS answered " + name
+	}
+	cause, ok := errorCauses[e.Cause]
+	if !ok {
+		cause = "Unknown"
+	}
+	return fmt.Sprintf("NAS answered %s: %s (%d)", name, cause, e.Cause)
+}
+
+// SessionStore finds the accounting sessions of the NAS clients. It is
+// implemented by AccountingHandler.
+type SessionStore interface {
+	// GetSession returns the latest record of a session, or
+	// types.ErrNotFound.
+	GetSession(ctx context.Context, sessionID string) (*models.RadiusAccounting, error)
+	// ActiveSessions returns the latest record of each session of a user
+	// that has not stopped.
+	ActiveSessions(ctx context.Context, username string) ([]*models.RadiusAccounting, error)
+}
+
+// DAClientConfig configures a DAClient.
+type DAClientConfig struct {
+	// Port is the dynamic authorization port of the NAS, 3799 by default.
+	Port int
+	// Timeout is how long an ACK or NAK is waited for, 3s by default.
+	Timeout time.Duration
+	// RetryCount is how many times a request is retransmitted to a NAS
+	// that does not answer.
+	RetryCount int
+}
+
+// DAClient is a Dynamic Authorization Client (RFC 5176): it asks the NAS of
+// accounting sessions to end them with Disconnect-Requests, or to change
+// their authorization with CoA-Requests.
+type DAClient struct {
+	sessions SessionStore
+	clients  ClientRepository
+	codec    *AttributeCodec
+	config   DAClientConfig
+	logger   *zap.Logger
+}
+
+// NewDAClient creates a DAClient. Requests for a session go to the RADIUS
+// client its accounting came from, whose secret signs them. codec encodes
+// the attributes of CoA-Requests.
+func NewDAClient(sessions SessionStore, clients ClientRepository, codec *AttributeCodec, config DAClientConfig, logger *zap.Logger) *DAClient {
+	if config.Port == 0 {
+		config.Port = DefaultDynamicAuthorizationPort
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultDynamicAuthorizationTimeout
+	}
+	return &DAClient{
+		sessions: sessions,
+		clients:  clients,
+		codec:    codec,
+		config:   config,
+		logger:   logger,
+	}
+}
+
+// ActiveSessions returns the sessions of a user that have not stopped.
+func (c *DAClient) ActiveSessions(ctx context.Context, username string) ([]*models.RadiusAccounting, error) {
+	return c.sessions.ActiveSessions(ctx, username)
+}
+
+// Disconnect asks the NAS of a session to end it. A NAK is a *NAKError.
+func (c *DAClient) Disconnect(ctx context.Context, sessionID string) error {
+	session, err := c.activeSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, CodeDisconnectRequest, session, nil)
+}
+
+// ChangeAuthorization asks the NAS of a session to apply attributes, such
+// as a Filter-Id or a Session-Timeout, to it. A NAK is a *NAKError.
+func (c *DAClient) ChangeAuthorization(ctx context.Context, sessionID string, attributes []ReplyAttribute) error {
+	if len(attributes) == 0 {
+		return types.ErrValidation.WithDetails(map[string]string{"attributes": "a CoA-Request needs attributes"})
+	}
+	encoded := make([]Attribute, 0, len(attributes))
+	for _, attr := range attributes {
+		a, err := c.codec.EncodeAttribute(attr.Name, attr.Tag, attr.Value)
+		if err != nil {
+			return types.ErrValidation.WithDetails(map[string]string{"attributes": err.Error()})
+		}
+		encoded = append(encoded, a)
+	}
+	session, err := c.activeSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, CodeCoARequest, session, encoded)
+}
+
+// DisconnectUser ends the active sessions of a user and returns how many
+// were ended. The sessions that could not be ended are reported together.
+func (c *DAClient) DisconnectUser(ctx context.Context, username string) (int, error) {
+	sessions, err := c.sessions.ActiveSessions(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	disconnected := 0
+	for _, session := range sessions {
+		if err := c.send(ctx, CodeDisconnectRequest, session, nil); err != nil {
+			errs = append(errs, fmt.Errorf("session %s: %w", session.SessionID, err))
+			continue
+		}
+		disconnected++
+	}
+	return disconnected, errors.Join(errs...)
+}
+
+func (c *DAClient) activeSession(ctx context.Context, sessionID string) (*models.RadiusAccounting, error) {
+	session, err := c.sessions.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.StatusType == AcctStatusStop {
+		return nil, fmt.Errorf("session %s has stopped: %w", sessionID, types.ErrNotFound)
+	}
+	return session, nil
+}
+
+// send sends a request for a session, identified by its Acct-Session-Id,
+// User-Name and the addresses known of it, to the session's NAS.
+func (c *DAClient) send(ctx context.Context, code byte, session *models.RadiusAccounting, attributes []Attribute) error {
+	operation := "disconnect"
+	if code == CodeCoARequest {
+		operation = "coa"
+	}
+	err := c.exchange(ctx, code, session, attributes)
+	recordDynamicAuthorization(operation, err)
+	if err != nil {
+		c.logger.Warn("dynamic authorization request failed", zap.String("operation", operation),
+			zap.String("session_id", session.SessionID), zap.String("nas", session.NASIPAddress), zap.Error(err))
+		return err
+	}
+	c.logger.Info("dynamic authorization request acknowledged", zap.String("operation", operation),
+		zap.String("session_id", session.SessionID), zap.String("nas", session.NASIPAddress))
+	return nil
+}
+
+func (c *DAClient) exchange(ctx context.Context, code byte, session *models.RadiusAccounting, attributes []Attribute) error {
+	// The NAS-IP-Address is only what the NAS says of itself, and behind a
+	// proxy it is not the address the NAS can be reached at. Sessions
+	// recorded before the client address was kept fall back to it.
+	target := session.ClientAddress
+	if target == "" {
+		target = session.NASIPAddress
+	}
+	client, err := c.clients.GetByIP(ctx, target)
+	if err != nil || client == nil {
+		return fmt.Errorf("NAS %s of session %s is not a known client", target, session.SessionID)
+	}
+
+	request := &Packet{Code: code, Secret: []byte(client.Secret)}
+	request.AddAttribute(AttrAcctSessionId, []byte(session.SessionID))
+	if session.Username != "" {
+		request.AddAttribute(AttrUserName, []byte(session.Username))
+	}
+	if ip := net.ParseIP(session.NASIPAddress).To4(); ip != nil {
+		request.AddAttribute(AttrNASIPAddress, ip)
+	}
+	if session.NASIdentifier != "" {
+		request.AddAttribute(AttrNASIdentifier, []byte(session.NASIdentifier))
+	}
+	if session.CallingStation != "" {
+		request.AddAttribute(AttrCallingStationId, []byte(session.CallingStation))
+	}
+	if ip := net.ParseIP(session.FramedIP).To4(); ip != nil {
+		request.AddAttribute(AttrFramedIPAddress, ip)
+	}
+	request.Attributes = append(request.Attributes, attributes...)
+	request.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+
+	address := net.JoinHostPort(target, strconv.Itoa(c.config.Port))
+	conn, err := dialUpstream(address, request.Secret)
+	if err != nil {
+		return err
+	}
+	defer conn.conn.Close()
+	response, err := conn.exchange(ctx, request, c.config.Timeout, c.config.RetryCount)
+	if err != nil {
+		return fmt.Errorf("NAS %s: %w", address, err)
+	}
+
+	switch response.Code {
+	case CodeDisconnectACK, CodeCoAACK:
+		return nil
+	case CodeDisconnectNAK, CodeCoANAK:
+		nak := &NAKError{Code: response.Code}
+		if attr := response.GetAttribute(AttrErrorCause); attr != nil && len(attr.Value) == 4 {
+			nak.Cause = binary.BigEndian.Uint32(attr.Value)
+		}
+		return nak
+	default:
+		return fmt.Errorf("unexpected response code %d from NAS %s", response.Code, target)
+	}
+}
@@ -0,0 +1,200 @@
+package radius
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/storage/postgresql/models"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+type memorySessions map[string]*models.RadiusAccounting
+
+func (m memorySessions) GetSession(ctx context.Context, sessionID string) (*models.RadiusAccounting, error) {
+	session, ok := m[sessionID]
+	if !ok {
+		return nil, types.ErrNotFound
+	}
+	return session, nil
+}
+
+func (m memorySessions) ActiveSessions(ctx context.Context, username string) ([]*models.RadiusAccounting, error) {
+	var active []*models.RadiusAccounting
+	for _, session := range m {
+		if session.Username == username && session.StatusType != AcctStatusStop {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+// fakeNAS answers dynamic authorization requests after dropping the first
+// ones, with a NAK for the sessions it does not know.
+type fakeNAS struct {
+	conn     *net.UDPConn
+	secret   []byte
+	sessions map[string]bool
+	drop     atomic.Int32
+
+	mu       sync.Mutex
+	requests []*Packet
+}
+
+func newFakeNAS(t *testing.T, secret string, sessions ...string) *fakeNAS {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	nas := &fakeNAS{conn: conn, secret: []byte(secret), sessions: make(map[string]bool)}
+	for _, id := range sessions {
+		nas.sessions[id] = true
+	}
+	go nas.serve()
+	return nas
+}
+
+func (n *fakeNAS) port() int {
+	return n.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (n *fakeNAS) received() []*Packet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*Packet(nil), n.requests...)
+}
+
+func (n *fakeNAS) serve() {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request, err := ParsePacket(buf[:size], n.secret)
+		if err != nil || request.Authenticator != request.CalculateResponseAuthenticator([16]byte{}) ||
+			!request.VerifyMessageAuthenticator([16]byte{}) {
+			continue
+		}
+		n.mu.Lock()
+		n.requests = append(n.requests, request)
+		n.mu.Unlock()
+		if n.drop.Add(-1) >= 0 {
+			continue
+		}
+
+		ack, nak := byte(CodeDisconnectACK), byte(CodeDisconnectNAK)
+		if request.Code == CodeCoARequest {
+			ack, nak = CodeCoAACK, CodeCoANAK
+		}
+		response := request.CreateResponse(ack)
+		if !n.sessions[request.GetString(AttrAcctSessionId)] {
+			response = request.CreateResponse(nak)
+			cause := make([]byte, 4)
+			binary.BigEndian.PutUint32(cause, 503)
+			response.AddAttribute(AttrErrorCause, cause)
+		}
+		response.Authenticator = response.CalculateResponseAuthenticator(request.Authenticator)
+		data, _ := response.Encode()
+		n.conn.WriteToUDP(data, addr)
+	}
+}
+
+func newTestDAClient(t *testing.T, nas *fakeNAS, sessions memorySessions) *DAClient {
+	clients := NewClientManager(nil)
+	clients.cache["127.0.0.1"] = &RADIUSClient{IPAddress: "127.0.0.1", Secret: string(nas.secret)}
+	codec := NewAttributeCodec()
+	require.NoError(t, codec.LoadDictionary(strings.NewReader(ciscoDictionary)))
+	return NewDAClient(sessions, clients, codec, DAClientConfig{Port: nas.port(), Timeout: 200 * time.Millisecond, RetryCount: 1}, zap.NewNop())
+}
+
+func TestDAClient_Disconnect(t *testing.T) {
+	nas := newFakeNAS(t, "testing123", "s-1", "s-2")
+	sessions := memorySessions{
+		"s-1":    {SessionID: "s-1", Username: "alice", NASIPAddress: "127.0.0.1", CallingStation: "00-11-22-33-44-55", FramedIP: "10.0.0.5", StatusType: AcctStatusStart},
+		"s-2":    {SessionID: "s-2", Username: "alice", NASIPAddress: "127.0.0.1", StatusType: AcctStatusInterimUpdate},
+		"gone":   {SessionID: "gone", Username: "alice", NASIPAddress: "127.0.0.1", StatusType: AcctStatusStart},
+		"closed": {SessionID: "closed", Username: "alice", NASIPAddress: "127.0.0.1", StatusType: AcctStatusStop},
+	}
+	dac := newTestDAClient(t, nas, sessions)
+	ctx := context.Background()
+
+	acks := testutil.ToFloat64(DynamicAuthorizationTotal.WithLabelValues("disconnect", "ack"))
+	require.NoError(t, dac.Disconnect(ctx, "s-1"))
+	request := nas.received()[0]
+	assert.Equal(t, byte(CodeDisconnectRequest), request.Code)
+	assert.Equal(t, "alice", request.GetString(AttrUserName))
+	assert.Equal(t, "00-11-22-33-44-55", request.GetString(AttrCallingStationId))
+	assert.Equal(t, []byte{10, 0, 0, 5}, request.GetAttribute(AttrFramedIPAddress).Value)
+	assert.Equal(t, []byte{127, 0, 0, 1}, request.GetAttribute(AttrNASIPAddress).Value)
+	assert.Equal(t, acks+1, testutil.ToFloat64(DynamicAuthorizationTotal.WithLabelValues("disconnect", "ack")))
+
+	var nak *NAKError
+	err := dac.Disconnect(ctx, "gone")
+	require.True(t, errors.As(err, &nak))
+	assert.Equal(t, uint32(503), nak.Cause)
+	assert.Equal(t, "NAS answered Disconnect-NAK: Session Context Not Found (503)", nak.Error())
+
+	assert.ErrorIs(t, dac.Disconnect(ctx, "closed"), types.ErrNotFound)
+	assert.ErrorIs(t, dac.Disconnect(ctx, "unknown"), types.ErrNotFound)
+
+	// The sessions of a user are ended together, and failures reported.
+	disconnected, err := dac.DisconnectUser(ctx, "alice")
+	assert.Equal(t, 2, disconnected)
+	require.True(t, errors.As(err, &nak))
+	assert.Contains(t, err.Error(), "session gone")
+}
+
+func TestDAClient_SendsToTheAccountingClient(t *testing.T) {
+	nas := newFakeNAS(t, "testing123", "s-1")
+	// The NAS reports an address it cannot be reached at, such as behind a
+	// proxy; the request goes to the client the accounting came from and
+	// still names the NAS.
+	dac := newTestDAClient(t, nas, memorySessions{
+		"s-1": {SessionID: "s-1", Username: "alice", NASIPAddress: "192.0.2.10", ClientAddress: "127.0.0.1", StatusType: AcctStatusStart},
+	})
+
+	require.NoError(t, dac.Disconnect(context.Background(), "s-1"))
+	request := nas.received()[0]
+	assert.Equal(t, []byte{192, 0, 2, 10}, request.GetAttribute(AttrNASIPAddress).Value)
+}
+
+func TestDAClient_ChangeAuthorizationRetries(t *testing.T) {
+	nas := newFakeNAS(t, "testing123", "s-1")
+	dac := newTestDAClient(t, nas, memorySessions{
+		"s-1": {SessionID: "s-1", Username: "alice", NASIPAddress: "127.0.0.1", StatusType: AcctStatusStart},
+	})
+	ctx := context.Background()
+
+	// The first request is lost and retransmitted.
+	nas.drop.Store(1)
+	require.NoError(t, dac.ChangeAuthorization(ctx, "s-1", []ReplyAttribute{
+		{Name: "Filter-Id", Value: "quarantine"},
+		{Name: "Cisco-AVPair", Value: "subscriber:command=reauthenticate"},
+	}))
+	received := nas.received()
+	require.Len(t, received, 2)
+	assert.Equal(t, received[0].Identifier, received[1].Identifier)
+	assert.Equal(t, byte(CodeCoARequest), received[1].Code)
+	assert.Equal(t, "quarantine", received[1].GetString(AttrFilterId))
+	assert.NotNil(t, received[1].GetAttribute(AttrVendorSpecific))
+
+	assert.ErrorIs(t, dac.ChangeAuthorization(ctx, "s-1", nil), types.ErrValidation)
+	assert.ErrorIs(t, dac.ChangeAuthorization(ctx, "s-1", []ReplyAttribute{{Name: "No-Such-Attribute", Value: "x"}}), types.ErrValidation)
+
+	// A NAS that does not answer times out after the retries.
+	timeouts := testutil.ToFloat64(DynamicAuthorizationTotal.WithLabelValues("disconnect", "timeout"))
+	nas.drop.Store(2)
+	assert.ErrorIs(t, dac.Disconnect(ctx, "s-1"), ErrNoResponse)
+	assert.Equal(t, timeouts+1, testutil.ToFloat64(DynamicAuthorizationTotal.WithLabelValues("disconnect", "timeout")))
+}
@@ -0,0 +1,495 @@
+package radius
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// EAP codes (RFC 3748)
+const (
+	EAPCodeRequest  = 1
+	EAPCodeResponse = 2
+	EAPCodeSuccess  = 3
+	EAPCodeFailure  = 4
+)
+
+// EAP method types
+const (
+	EAPTypeIdentity     = 1
+	EAPTypeNotification = 2
+	EAPTypeNak          = 3
+	EAPTypeTLS          = 13
+	EAPTypeTTLS         = 21
+	EAPTypePEAP         = 25
+	EAPTypeMSCHAPv2     = 26
+	EAPTypeExtensions   = 33
+)
+
+const (
+	// maxEAPMessageChunk is the most EAP data one EAP-Message attribute holds.
+	maxEAPMessageChunk = 253
+
+	defaultEAPFragmentSize   = 1000
+	defaultEAPSessionTimeout = time.Minute
+)
+
+// eapMethodNames maps the method names used in configuration to EAP types.
+var eapMethodNames = map[string]byte{
+	"tls":  EAPTypeTLS,
+	"peap": EAPTypePEAP,
+	"ttls": EAPTypeTTLS,
+}
+
+// EAPConfig configures EAP authentication (RFC 3579) for 802.1X.
+type EAPConfig struct {
+	// Methods are the EAP methods offered, in order of preference: "peap",
+	// "ttls" and "tls".
+	Methods []string
+	// CertFile and KeyFile are the server certificate presented in the TLS
+	// handshake of every method.
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CAs that client certificates of EAP-TLS must chain to.
+	CAFile string
+	// CertificateUser selects the client certificate field that names the
+	// user in EAP-TLS: "common_name" (the default) or "email".
+	CertificateUser string
+	// FragmentSize is the most TLS data sent in one EAP packet.
+	FragmentSize int
+	// SessionTimeout is how long a conversation may wait for the next request.
+	SessionTimeout time.Duration
+}
+
+// EAPPacket is an EAP packet. Type and Data are only set for requests and
+// responses.
+type EAPPacket struct {
+	Code       byte
+	Identifier byte
+	Type       byte
+	Data       []byte
+}
+
+// ParseEAPPacket parses an EAP packet.
+func ParseEAPPacket(data []byte) (*EAPPacket, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("EAP packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < 4 || length > len(data) {
+		return nil, fmt.Errorf("invalid EAP length")
+	}
+	packet := &EAPPacket{Code: data[0], Identifier: data[1]}
+	if packet.Code == EAPCodeRequest || packet.Code == EAPCodeResponse {
+		if length < 5 {
+			return nil, fmt.Errorf("EAP packet without type")
+		}
+		packet.Type = data[4]
+		packet.Data = append([]byte(nil), data[5:length]...)
+	}
+	return packet, nil
+}
+
+// Encode serializes the EAP packet.
+func (e *EAPPacket) Encode() []byte {
+	length := 4
+	if e.Code == EAPCodeRequest || e.Code == EAPCodeResponse {
+		length += 1 + len(e.Data)
+	}
+	data := make([]byte, 4, length)
+	data[0] = e.Code
+	data[1] = e.Identifier
+	binary.BigEndian.PutUint16(data[2:4], uint16(length))
+	if length > 4 {
+		data = append(data, e.Type)
+		data = append(data, e.Data...)
+	}
+	return data
+}
+
+// GetEAPMessage returns the EAP packet carried in the EAP-Message
+// attributes of a RADIUS packet, which are concatenated in order.
+func (p *Packet) GetEAPMessage() []byte {
+	var message []byte
+	for _, attr := range p.Attributes {
+		if attr.Type == AttrEAPMessage {
+			message = append(message, attr.Value...)
+		}
+	}
+	return message
+}
+
+// AddEAPMessage adds an EAP packet to a RADIUS packet, split over as many
+// EAP-Message attributes as it needs.
+func (p *Packet) AddEAPMessage(message []byte) {
+	for len(message) > maxEAPMessageChunk {
+		p.AddAttribute(AttrEAPMessage, message[:maxEAPMessageChunk])
+		message = message[maxEAPMessageChunk:]
+	}
+	p.AddAttribute(AttrEAPMessage, message)
+}
+
+// eapResult is the outcome of an EAP method.
+type eapResult struct {
+	user *types.User
+	// msk is the master session key the MPPE keys are derived from.
+	msk []byte
+}
+
+// EAPHandler authenticates 802.1X supplicants with EAP carried in RADIUS.
+// A conversation spans several Access-Request/Access-Challenge round trips
+// that are tied together by the State attribute.
+type EAPHandler struct {
+	authenticator *Authenticator
+	config        EAPConfig
+	methods       []byte
+	certificate   tls.Certificate
+	clientCAs     *x509.CertPool
+	sessions      map[string]*eapSession
+	mu            sync.Mutex
+}
+
+// EnableEAP makes the authenticator accept EAP with the configured methods.
+func (a *Authenticator) EnableEAP(config EAPConfig) error {
+	handler, err := newEAPHandler(a, config)
+	if err != nil {
+		return err
+	}
+	a.eap = handler
+	return nil
+}
+
+func newEAPHandler(a *Authenticator, config EAPConfig) (*EAPHandler, error) {
+	if config.FragmentSize <= 0 {
+		config.FragmentSize = defaultEAPFragmentSize
+	}
+	if config.SessionTimeout <= 0 {
+		config.SessionTimeout = defaultEAPSessionTimeout
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []string{"peap", "ttls", "tls"}
+	}
+
+	h := &EAPHandler{
+		authenticator: a,
+		config:        config,
+		sessions:      make(map[string]*eapSession),
+	}
+	for _, name := range config.Methods {
+		method, ok := eapMethodNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown EAP method %q", name)
+		}
+		h.methods = append(h.methods, method)
+	}
+
+	var err error
+	h.certificate, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load EAP server certificate: %w", err)
+	}
+	if h.offers(EAPTypeTLS) {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EAP-TLS client CA file: %w", err)
+		}
+		h.clientCAs = x509.NewCertPool()
+		if !h.clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in EAP-TLS client CA file")
+		}
+	}
+	return h, nil
+}
+
+// Handle processes an Access-Request that carries an EAP-Message. It answers
+// with an Access-Challenge until the method completes, and then with an
+// Access-Accept that carries the MPPE keys, or an Access-Reject.
+func (h *EAPHandler) Handle(ctx context.Context, request *Packet, client *RADIUSClient) (*Packet, error) {
+	// RFC 3579 requires a Message-Authenticator on every packet with EAP.
+	if !request.VerifyMessageAuthenticator(request.Authenticator) {
+		return h.createReject(request, nil), nil
+	}
+
+	message := request.GetEAPMessage()
+	// An EAP-Message with an empty packet is EAP-Start: the NAS asks the
+	// server to begin with the identity of the supplicant.
+	if len(message) == 2 {
+		return h.start(request), nil
+	}
+	eap, err := ParseEAPPacket(message)
+	if err != nil || eap.Code != EAPCodeResponse {
+		return h.createReject(request, nil), nil
+	}
+
+	state := request.GetAttribute(AttrState)
+	if state == nil {
+		if eap.Type != EAPTypeIdentity {
+			return h.createReject(request, eap), nil
+		}
+		return h.begin(ctx, request, client, eap), nil
+	}
+
+	session := h.session(string(state.Value))
+	if session == nil {
+		return h.createReject(request, eap), nil
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	// A retransmitted request is answered with the same response.
+	if session.lastResponse != nil && request.Authenticator == session.lastRequest {
+		return session.lastResponse, nil
+	}
+	if eap.Identifier != session.identifier {
+		return h.finish(request, session, nil), nil
+	}
+
+	response := h.continueSession(request, session, eap)
+	session.lastRequest = request.Authenticator
+	session.lastResponse = response
+	return response, nil
+}
+
+// start asks the supplicant for its identity.
+func (h *EAPHandler) start(request *Packet) *Packet {
+	response := request.CreateResponse(CodeAccessChallenge)
+	identifier := make([]byte, 1)
+	_, _ = rand.Read(identifier)
+	response.AddEAPMessage((&EAPPacket{Code: EAPCodeRequest, Identifier: identifier[0], Type: EAPTypeIdentity}).Encode())
+	response.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+	return response
+}
+
+// begin starts a conversation for the identity in an EAP-Response/Identity
+// with the most preferred method.
+func (h *EAPHandler) begin(ctx context.Context, request *Packet, client *RADIUSClient, eap *EAPPacket) *Packet {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return h.createReject(request, eap)
+	}
+	session := &eapSession{
+		id:         hex.EncodeToString(id),
+		ctx:        context.WithoutCancel(ctx),
+		client:     client,
+		station:    request.GetString(AttrCallingStationId),
+		identity:   string(eap.Data),
+		identifier: eap.Identifier,
+		expiresAt:  time.Now().Add(h.config.SessionTimeout),
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	h.mu.Lock()
+	h.expireSessions()
+	h.sessions[session.id] = session
+	h.mu.Unlock()
+
+	response := h.startMethod(request, session, h.methods[0])
+	session.lastRequest = request.Authenticator
+	session.lastResponse = response
+	return response
+}
+
+// continueSession answers the next EAP-Response of a conversation.
+func (h *EAPHandler) continueSession(request *Packet, session *eapSession, eap *EAPPacket) *Packet {
+	session.expiresAt = time.Now().Add(h.config.SessionTimeout)
+
+	if eap.Type == EAPTypeNak {
+		// The supplicant asks for another method, which it may do only
+		// before the method started.
+		if session.tunnel != nil && session.tunnel.started {
+			return h.finish(request, session, nil)
+		}
+		for _, wanted := range eap.Data {
+			if h.offers(wanted) {
+				return h.startMethod(request, session, wanted)
+			}
+		}
+		return h.finish(request, session, nil)
+	}
+	if session.tunnel == nil || eap.Type != session.method {
+		return h.finish(request, session, nil)
+	}
+
+	data, complete, err := session.tunnel.receive(eap.Data)
+	if err != nil {
+		return h.finish(request, session, nil)
+	}
+	if !complete {
+		// Acknowledge a fragment of a message that is not complete yet.
+		return h.challenge(request, session, session.tunnel.ack())
+	}
+	if fragment := session.tunnel.next(data); fragment != nil {
+		return h.challenge(request, session, fragment)
+	}
+	return h.finish(request, session, session.tunnel.result())
+}
+
+// startMethod sends the start of a TLS-based method.
+func (h *EAPHandler) startMethod(request *Packet, session *eapSession, method byte) *Packet {
+	if session.tunnel != nil {
+		session.tunnel.stop()
+	}
+	tunnel, err := h.newTunnel(session, method)
+	if err != nil {
+		return h.finish(request, session, nil)
+	}
+	session.method = method
+	session.tunnel = tunnel
+	return h.challenge(request, session, tunnel.startPacket())
+}
+
+// challenge sends the next EAP-Request of a conversation.
+func (h *EAPHandler) challenge(request *Packet, session *eapSession, data []byte) *Packet {
+	session.identifier++
+	response := request.CreateResponse(CodeAccessChallenge)
+	response.AddEAPMessage((&EAPPacket{
+		Code:       EAPCodeRequest,
+		Identifier: session.identifier,
+		Type:       session.method,
+		Data:       data,
+	}).Encode())
+	response.AddAttribute(AttrState, []byte(session.id))
+	response.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+	return response
+}
+
+// finish ends a conversation with an Access-Accept if the method succeeded
+// and with an Access-Reject otherwise.
+func (h *EAPHandler) finish(request *Packet, session *eapSession, result *eapResult) *Packet {
+	h.mu.Lock()
+	delete(h.sessions, session.id)
+	h.mu.Unlock()
+	if session.tunnel != nil {
+		session.tunnel.stop()
+	}
+
+	last := &EAPPacket{Identifier: session.identifier}
+	if result == nil || result.user == nil || result.user.Status != types.UserStatusActive {
+		return h.createReject(request, last)
+	}
+
+	response := h.authenticator.authorize(session.ctx, request, session.client, result.user, h.authenticator.createAccept(request, result.user))
+	if response.Code != CodeAccessAccept {
+		return h.createReject(request, last)
+	}
+	response.AddAttribute(AttrUserName, []byte(result.user.Username))
+	response.AddEAPMessage((&EAPPacket{Code: EAPCodeSuccess, Identifier: last.Identifier}).Encode())
+	if len(result.msk) >= 64 {
+		codec := h.authenticator.codec
+		secret := request.Secret
+		recvKey := encodeMPPEKey(result.msk[:32], secret, request.Authenticator)
+		sendKey := encodeMPPEKey(result.msk[32:64], secret, request.Authenticator)
+		response.AddAttribute(AttrVendorSpecific, codec.EncodeVendorSpecific(VendorMicrosoft, MSMPPERecvKey, recvKey))
+		response.AddAttribute(AttrVendorSpecific, codec.EncodeVendorSpecific(VendorMicrosoft, MSMPPESendKey, sendKey))
+	}
+	response.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+	return response
+}
+
+// createReject rejects a request with an EAP-Failure for the given EAP packet.
+func (h *EAPHandler) createReject(request *Packet, eap *EAPPacket) *Packet {
+	response := h.authenticator.createReject(request, "Authentication failed")
+	if eap != nil {
+		response.AddEAPMessage((&EAPPacket{Code: EAPCodeFailure, Identifier: eap.Identifier}).Encode())
+	}
+	response.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+	return response
+}
+
+func (h *EAPHandler) offers(method byte) bool {
+	for _, m := range h.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *EAPHandler) session(id string) *eapSession {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expireSessions()
+	return h.sessions[id]
+}
+
+// expireSessions drops abandoned conversations. The caller holds h.mu.
+func (h *EAPHandler) expireSessions() {
+	now := time.Now()
+	for id, session := range h.sessions {
+		if now.After(session.expiresAt) {
+			delete(h.sessions, id)
+			go session.close()
+		}
+	}
+}
+
+// eapSession is the state of one EAP conversation.
+type eapSession struct {
+	mu  sync.Mutex
+	id  string
+	ctx context.Context
+	// client is the NAS the conversation goes through.
+	client *RADIUSClient
+	// station is the calling station of the conversation, which failed
+	// inner authentications count towards the lockout of.
+	station string
+	// identity is the outer identity, which tunneled methods may hide.
+	identity string
+	// identifier is the identifier of the last EAP-Request.
+	identifier byte
+	method     byte
+	tunnel     *tlsTunnel
+	expiresAt  time.Time
+
+	lastRequest  [16]byte
+	lastResponse *Packet
+}
+
+func (s *eapSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnel != nil {
+		s.tunnel.stop()
+	}
+}
+
+// encodeMPPEKey encrypts an MS-MPPE-Send-Key or MS-MPPE-Recv-Key value
+// (RFC 2548, section 2.4.2) with the client secret and request authenticator.
+func encodeMPPEKey(key, secret []byte, requestAuth [16]byte) []byte {
+	salt := make([]byte, 2)
+	_, _ = rand.Read(salt)
+	salt[0] |= 0x80
+
+	plain := append([]byte{byte(len(key))}, key...)
+	if pad := len(plain) % 16; pad != 0 {
+		plain = append(plain, make([]byte, 16-pad)...)
+	}
+
+	result := append([]byte(nil), salt...)
+	prev := append(append([]byte(nil), requestAuth[:]...), salt...)
+	for i := 0; i < len(plain); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		block := make([]byte, 16)
+		for j := range block {
+			block[j] = plain[i+j] ^ b[j]
+		}
+		result = append(result, block...)
+		prev = block
+	}
+	return result
+}
@@ -0,0 +1,358 @@
+package radius
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// Keying material labels of the methods (RFC 5216, RFC 5281). PEAPv0 uses
+// the label of EAP-TLS.
+const (
+	eapTLSKeyLabel  = "client EAP encryption"
+	eapTTLSKeyLabel = "ttls keying material"
+)
+
+// Op-codes of EAP-MSCHAPv2 packets.
+const (
+	mschapv2OpChallenge = 1
+	mschapv2OpResponse  = 2
+	mschapv2OpSuccess   = 3
+	mschapv2OpFailure   = 4
+)
+
+// Diameter AVP codes of EAP-TTLS (RFC 5281) and the AVP flags.
+const (
+	avpUserName     = 1
+	avpUserPassword = 2
+
+	avpFlagVendor    = 0x80
+	avpFlagMandatory = 0x40
+)
+
+// mschapv2ServerName is the name the server gives in MS-CHAPv2 challenges.
+const mschapv2ServerName = "QuantaID"
+
+// newTunnel starts the server end of a TLS-based method.
+func (h *EAPHandler) newTunnel(session *eapSession, method byte) (*tlsTunnel, error) {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{h.certificate},
+		// The methods are defined for TLS 1.2; TLS 1.3 in EAP (RFC 9190)
+		// needs a different end of the handshake.
+		MinVersion:             tls.VersionTLS12,
+		MaxVersion:             tls.VersionTLS12,
+		SessionTicketsDisabled: true,
+	}
+
+	var inner func(conn *tls.Conn, e *tlsEngine) (*eapResult, error)
+	switch method {
+	case EAPTypeTLS:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = h.clientCAs
+		inner = func(conn *tls.Conn, e *tlsEngine) (*eapResult, error) {
+			return h.completeTLS(session.ctx, conn)
+		}
+	case EAPTypePEAP:
+		inner = func(conn *tls.Conn, e *tlsEngine) (*eapResult, error) {
+			return h.runPEAP(session, conn, e)
+		}
+	case EAPTypeTTLS:
+		inner = func(conn *tls.Conn, e *tlsEngine) (*eapResult, error) {
+			return h.runTTLS(session, conn)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported EAP method %d", method)
+	}
+
+	engine, err := startTLSEngine(func(e *tlsEngine) (*eapResult, error) {
+		conn := tls.Server(e, config)
+		if err := conn.Handshake(); err != nil {
+			return nil, err
+		}
+		return inner(conn, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tlsTunnel{engine: engine, fragmentSize: h.config.FragmentSize}, nil
+}
+
+// completeTLS maps the verified client certificate of EAP-TLS to a user.
+func (h *EAPHandler) completeTLS(ctx context.Context, conn *tls.Conn) (*eapResult, error) {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	cert := state.PeerCertificates[0]
+
+	var user *types.User
+	var err error
+	switch h.config.CertificateUser {
+	case "email":
+		if len(cert.EmailAddresses) == 0 {
+			return nil, fmt.Errorf("client certificate has no email address")
+		}
+		user, err = h.authenticator.userService.GetUserRepo().GetUserByEmail(ctx, cert.EmailAddresses[0])
+	default:
+		user, err = h.authenticator.userService.GetUserByUsername(ctx, cert.Subject.CommonName)
+	}
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("no user for client certificate %q", cert.Subject.String())
+	}
+	return keyedResult(conn, user, eapTLSKeyLabel)
+}
+
+// runPEAP runs PEAPv0 with EAP-MSCHAPv2 inside the tunnel: the inner
+// identity, the MS-CHAPv2 exchange and the result TLV that ends it.
+func (h *EAPHandler) runPEAP(session *eapSession, conn *tls.Conn, e *tlsEngine) (*eapResult, error) {
+	ctx := session.ctx
+	// The peer acknowledges the end of the handshake before phase 2.
+	if err := e.awaitRound(); err != nil {
+		return nil, err
+	}
+	inner := &peapConn{conn: conn}
+
+	if err := inner.write(EAPTypeIdentity, nil); err != nil {
+		return nil, err
+	}
+	identity, err := inner.read()
+	if err != nil {
+		return nil, err
+	}
+	if identity.Type != EAPTypeIdentity || len(identity.Data) == 0 {
+		return nil, fmt.Errorf("expected inner identity")
+	}
+
+	challenge := make([]byte, 16)
+	msID := make([]byte, 1)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(msID); err != nil {
+		return nil, err
+	}
+	if err := inner.write(EAPTypeMSCHAPv2, mschapv2Packet(mschapv2OpChallenge, msID[0], append(append([]byte{16}, challenge...), mschapv2ServerName...))); err != nil {
+		return nil, err
+	}
+	response, err := inner.read()
+	if err != nil {
+		return nil, err
+	}
+	// Op-Code, MS-CHAPv2-ID, MS-Length, Value-Size and the 49 byte response
+	// of peer challenge, reserved bytes, NT-Response and flags.
+	if response.Type != EAPTypeMSCHAPv2 || len(response.Data) < 54 || response.Data[0] != mschapv2OpResponse {
+		return nil, fmt.Errorf("expected MS-CHAPv2 response")
+	}
+	peerChallenge := response.Data[5:21]
+	ntResponse := response.Data[29:53]
+	name := string(response.Data[54:])
+
+	account := accountName(string(identity.Data))
+	var user *types.User
+	var authResponse string
+	err = h.verifyInner(session, account, func() error {
+		var err error
+		user, authResponse, err = h.authenticator.mschap.verify(ctx, account, accountName(name), challenge, peerChallenge, ntResponse)
+		return err
+	})
+	if err != nil {
+		failure := fmt.Sprintf("E=691 R=0 C=%X V=3 M=Authentication failed", challenge)
+		if inner.write(EAPTypeMSCHAPv2, mschapv2Packet(mschapv2OpFailure, msID[0], []byte(failure))) == nil {
+			_, _ = inner.read()
+			_ = inner.writeResult(false)
+		}
+		return nil, err
+	}
+
+	if err := inner.write(EAPTypeMSCHAPv2, mschapv2Packet(mschapv2OpSuccess, msID[0], []byte(authResponse+" M=Authentication succeeded"))); err != nil {
+		return nil, err
+	}
+	ack, err := inner.read()
+	if err != nil {
+		return nil, err
+	}
+	if ack.Type != EAPTypeMSCHAPv2 || len(ack.Data) < 1 || ack.Data[0] != mschapv2OpSuccess {
+		return nil, fmt.Errorf("peer did not accept the MS-CHAPv2 success")
+	}
+	if err := inner.writeResult(true); err != nil {
+		return nil, err
+	}
+	result, err := inner.read()
+	if err != nil {
+		return nil, err
+	}
+	if !resultTLVSuccess(result) {
+		return nil, fmt.Errorf("peer did not confirm the PEAP result")
+	}
+	return keyedResult(conn, user, eapTLSKeyLabel)
+}
+
+// runTTLS verifies the User-Name and User-Password AVPs that EAP-TTLS/PAP
+// sends in the tunnel.
+func (h *EAPHandler) runTTLS(session *eapSession, conn *tls.Conn) (*eapResult, error) {
+	ctx := session.ctx
+	buf := make([]byte, 16384)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	avps, err := parseDiameterAVPs(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	username := string(avps[avpUserName])
+	password, ok := avps[avpUserPassword]
+	if username == "" || !ok {
+		return nil, fmt.Errorf("EAP-TTLS inner method is not PAP")
+	}
+
+	var user *types.User
+	err = h.verifyInner(session, username, func() error {
+		user, err = h.authenticator.userService.GetUserByUsername(ctx, username)
+		if err != nil || user == nil {
+			return fmt.Errorf("user not found")
+		}
+		valid, err := h.authenticator.passwordService.Verify(ctx, user.ID, string(bytes.TrimRight(password, "\x00")))
+		if err != nil || !valid {
+			return fmt.Errorf("invalid password")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keyedResult(conn, user, eapTTLSKeyLabel)
+}
+
+// verifyInner verifies the credentials of the inner identity of a tunneled
+// method under the lockout. The outer User-Name is usually an anonymous one,
+// so the inner identity is checked and its outcome recorded here.
+func (h *EAPHandler) verifyInner(session *eapSession, username string, verify func() error) error {
+	tracker := h.authenticator.lockout
+	if tracker == nil {
+		return verify()
+	}
+	if err := tracker.Check(session.ctx, username, session.station); err != nil {
+		return err
+	}
+	if err := verify(); err != nil {
+		tracker.RecordFailure(session.ctx, username, session.station)
+		return err
+	}
+	tracker.RecordSuccess(session.ctx, username)
+	return nil
+}
+
+// keyedResult derives the MSK of a method from the TLS master secret.
+func keyedResult(conn *tls.Conn, user *types.User, label string) (*eapResult, error) {
+	state := conn.ConnectionState()
+	keys, err := state.ExportKeyingMaterial(label, nil, 128)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive EAP keys: %w", err)
+	}
+	return &eapResult{user: user, msk: keys[:64]}, nil
+}
+
+// peapConn carries inner EAP packets in a PEAPv0 tunnel. Their headers are
+// left out, except for those of EAP-TLV extensions.
+type peapConn struct {
+	conn       *tls.Conn
+	identifier byte
+}
+
+func (c *peapConn) write(eapType byte, data []byte) error {
+	c.identifier++
+	if eapType == EAPTypeExtensions {
+		_, err := c.conn.Write((&EAPPacket{Code: EAPCodeRequest, Identifier: c.identifier, Type: eapType, Data: data}).Encode())
+		return err
+	}
+	_, err := c.conn.Write(append([]byte{eapType}, data...))
+	return err
+}
+
+func (c *peapConn) read() (*EAPPacket, error) {
+	buf := make([]byte, 16384)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	data := buf[:n]
+	if len(data) >= 5 && data[0] == EAPCodeResponse && int(binary.BigEndian.Uint16(data[2:4])) == len(data) && data[4] == EAPTypeExtensions {
+		return ParseEAPPacket(data)
+	}
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty inner EAP packet")
+	}
+	return &EAPPacket{Code: EAPCodeResponse, Identifier: c.identifier, Type: data[0], Data: data[1:]}, nil
+}
+
+// writeResult sends the result TLV that ends phase 2.
+func (c *peapConn) writeResult(success bool) error {
+	return c.write(EAPTypeExtensions, resultTLV(success))
+}
+
+// resultTLV is a mandatory Result TLV with the status of phase 2.
+func resultTLV(success bool) []byte {
+	status := byte(2)
+	if success {
+		status = 1
+	}
+	return []byte{0x80, 0x03, 0x00, 0x02, 0x00, status}
+}
+
+func resultTLVSuccess(packet *EAPPacket) bool {
+	return packet.Type == EAPTypeExtensions && bytes.Equal(packet.Data, resultTLV(true))
+}
+
+// mschapv2Packet builds an EAP-MSCHAPv2 packet. MS-Length counts from the
+// op-code to the end.
+func mschapv2Packet(opCode, id byte, value []byte) []byte {
+	data := []byte{opCode, id, 0, 0}
+	data = append(data, value...)
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	return data
+}
+
+// accountName strips the domain from a DOMAIN\user name.
+func accountName(name string) string {
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// parseDiameterAVPs parses the AVPs of EAP-TTLS by code. Vendor AVPs are
+// skipped.
+func parseDiameterAVPs(data []byte) (map[uint32][]byte, error) {
+	avps := make(map[uint32][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated AVP header")
+		}
+		code := binary.BigEndian.Uint32(data[0:4])
+		flags := data[4]
+		length := int(data[5])<<16 | int(data[6])<<8 | int(data[7])
+		header := 8
+		if flags&avpFlagVendor != 0 {
+			header = 12
+		}
+		if length < header || length > len(data) {
+			return nil, fmt.Errorf("invalid AVP length")
+		}
+		if flags&avpFlagVendor == 0 {
+			avps[code] = data[header:length]
+		}
+		padded := (length + 3) &^ 3
+		if padded > len(data) {
+			padded = len(data)
+		}
+		data = data[padded:]
+	}
+	return avps, nil
+}
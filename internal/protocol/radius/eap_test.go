@@ -0,0 +1,492 @@
+package radius
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/md4"
+
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+// eapPasswords verifies the passwords of users by ID and provides their NT
+// hashes for MS-CHAPv2.
+type eapPasswords map[string]string
+
+func (p eapPasswords) Verify(ctx context.Context, userID, password string) (bool, error) {
+	return p[userID] == password, nil
+}
+
+func (p eapPasswords) Hash(password string) (string, error) {
+	return password, nil
+}
+
+func (p eapPasswords) SetPasswordPolicy(engine *passwordpolicy.Engine) {}
+
+func (p eapPasswords) GetNTHash(ctx context.Context, userID string) ([]byte, error) {
+	return ntHash(p[userID]), nil
+}
+
+func ntHash(password string) []byte {
+	h := md4.New()
+	for _, c := range utf16.Encode([]rune(password)) {
+		h.Write([]byte{byte(c), byte(c >> 8)})
+	}
+	return h.Sum(nil)
+}
+
+// testPKI is a CA with a server certificate and client certificates.
+type testPKI struct {
+	dir    string
+	pool   *x509.CertPool
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pki := &testPKI{dir: t.TempDir(), pool: x509.NewCertPool(), ca: ca, caKey: key, serial: 1}
+	pki.pool.AddCert(ca)
+	require.NoError(t, os.WriteFile(pki.path("ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return pki
+}
+
+func (p *testPKI) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// issue issues a certificate and writes it and its key to name.pem and name.key.
+func (p *testPKI) issue(t *testing.T, name string, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p.serial++
+	template.SerialNumber = big.NewInt(p.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(p.path(name+".pem"), certPEM, 0600))
+	require.NoError(t, os.WriteFile(p.path(name+".key"), keyPEM, 0600))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+type eapFixture struct {
+	auth   *Authenticator
+	client *RADIUSClient
+	pki    *testPKI
+	user   *types.User
+}
+
+func newEAPFixture(t *testing.T, config EAPConfig) *eapFixture {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	user := &types.User{Username: "alice", Email: "alice@example.com", Status: types.UserStatusActive}
+	require.NoError(t, repo.CreateUser(ctx, user))
+	svc := identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))
+
+	pki := newTestPKI(t)
+	pki.issue(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "radius.example.com"},
+		DNSNames:    []string{"radius.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	config.CertFile = pki.path("server.pem")
+	config.KeyFile = pki.path("server.key")
+	config.CAFile = pki.path("ca.pem")
+
+	auth := NewAuthenticator(svc, eapPasswords{user.ID: "secret"}, NewAttributeCodec(), AuthenticatorConfig{})
+	require.NoError(t, auth.EnableEAP(config))
+	return &eapFixture{
+		auth:   auth,
+		client: &RADIUSClient{Name: "switch", IPAddress: "127.0.0.1", Secret: "testing123"},
+		pki:    pki,
+		user:   user,
+	}
+}
+
+// supplicant is the peer of an EAP conversation, as run by an 802.1X client
+// behind the NAS. It uses the same TLS tunnel framing as the server.
+type supplicant struct {
+	t        *testing.T
+	fixture  *eapFixture
+	identity string
+	method   byte
+	config   *tls.Config
+	inner    func(conn *tls.Conn) (*eapResult, error)
+
+	tunnel      *tlsTunnel
+	state       []byte
+	lastRequest *Packet
+}
+
+func (f *eapFixture) supplicant(t *testing.T, method byte, inner func(conn *tls.Conn) (*eapResult, error)) *supplicant {
+	return &supplicant{
+		t:        t,
+		fixture:  f,
+		identity: "anonymous",
+		method:   method,
+		config: &tls.Config{
+			RootCAs:    f.pki.pool,
+			ServerName: "radius.example.com",
+		},
+		inner: inner,
+	}
+}
+
+// send sends an EAP response in an Access-Request and returns the answer.
+func (s *supplicant) send(eap *EAPPacket, withMessageAuthenticator bool) *Packet {
+	request := &Packet{Code: CodeAccessRequest, Secret: []byte(s.fixture.client.Secret)}
+	_, _ = rand.Read(request.Authenticator[:])
+	request.AddAttribute(AttrUserName, []byte(s.identity))
+	request.AddEAPMessage(eap.Encode())
+	if s.state != nil {
+		request.AddAttribute(AttrState, s.state)
+	}
+	if withMessageAuthenticator {
+		request.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+		request.SignMessageAuthenticator(request.Authenticator)
+	}
+
+	response, err := s.fixture.auth.Authenticate(context.Background(), request, s.fixture.client)
+	require.NoError(s.t, err)
+	response.SignMessageAuthenticator(request.Authenticator)
+	require.True(s.t, response.VerifyMessageAuthenticator(request.Authenticator))
+	s.lastRequest = request
+	return response
+}
+
+// run authenticates and returns the final Access-Accept or Access-Reject.
+func (s *supplicant) run(fragmentSize int) *Packet {
+	response := s.send(&EAPPacket{Code: EAPCodeResponse, Identifier: 1, Type: EAPTypeIdentity, Data: []byte(s.identity)}, true)
+	for round := 0; round < 200 && response.Code == CodeAccessChallenge; round++ {
+		s.state = response.GetAttribute(AttrState).Value
+		request, err := ParseEAPPacket(response.GetEAPMessage())
+		require.NoError(s.t, err)
+		require.Equal(s.t, byte(EAPCodeRequest), request.Code)
+
+		reply := &EAPPacket{Code: EAPCodeResponse, Identifier: request.Identifier, Type: request.Type}
+		if request.Type != s.method {
+			reply.Type = EAPTypeNak
+			reply.Data = []byte{s.method}
+			response = s.send(reply, true)
+			continue
+		}
+		if request.Data[0]&tlsFlagStart != 0 {
+			engine, err := startTLSEngine(func(e *tlsEngine) (*eapResult, error) {
+				conn := tls.Client(e, s.config)
+				if err := conn.Handshake(); err != nil {
+					return nil, err
+				}
+				return s.inner(conn)
+			})
+			require.NoError(s.t, err)
+			s.tunnel = &tlsTunnel{engine: engine, fragmentSize: fragmentSize}
+			s.t.Cleanup(s.tunnel.stop)
+		}
+
+		message, complete, err := s.tunnel.receive(request.Data)
+		require.NoError(s.t, err)
+		switch {
+		case !complete:
+			reply.Data = s.tunnel.ack()
+		default:
+			if reply.Data = s.tunnel.next(message); reply.Data == nil {
+				reply.Data = s.tunnel.ack()
+			}
+		}
+		response = s.send(reply, true)
+	}
+	return response
+}
+
+// keys returns the MSK the supplicant derived.
+func (s *supplicant) keys() []byte {
+	result := s.tunnel.result()
+	require.NotNil(s.t, result)
+	return result.msk
+}
+
+// decodeMPPEKey reverses encodeMPPEKey.
+func decodeMPPEKey(value, secret []byte, requestAuth [16]byte) []byte {
+	salt, cipher := value[:2], value[2:]
+	prev := append(append([]byte(nil), requestAuth[:]...), salt...)
+	var plain []byte
+	for i := 0; i+16 <= len(cipher); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			plain = append(plain, cipher[i+j]^b[j])
+		}
+		prev = cipher[i : i+16]
+	}
+	return plain[1 : 1+int(plain[0])]
+}
+
+func (s *supplicant) assertAccepted(response *Packet) {
+	require.Equal(s.t, byte(CodeAccessAccept), response.Code)
+	success, err := ParseEAPPacket(response.GetEAPMessage())
+	require.NoError(s.t, err)
+	assert.Equal(s.t, byte(EAPCodeSuccess), success.Code)
+	assert.Equal(s.t, "alice", response.GetString(AttrUserName))
+
+	msk := s.keys()
+	secret := []byte(s.fixture.client.Secret)
+	recvKey := getVendorAttribute(response, VendorMicrosoft, MSMPPERecvKey)
+	sendKey := getVendorAttribute(response, VendorMicrosoft, MSMPPESendKey)
+	require.NotNil(s.t, recvKey)
+	require.NotNil(s.t, sendKey)
+	assert.Equal(s.t, msk[:32], decodeMPPEKey(recvKey.Value, secret, s.lastRequest.Authenticator))
+	assert.Equal(s.t, msk[32:64], decodeMPPEKey(sendKey.Value, secret, s.lastRequest.Authenticator))
+}
+
+func (s *supplicant) assertRejected(response *Packet) {
+	require.Equal(s.t, byte(CodeAccessReject), response.Code)
+	failure, err := ParseEAPPacket(response.GetEAPMessage())
+	require.NoError(s.t, err)
+	assert.Equal(s.t, byte(EAPCodeFailure), failure.Code)
+}
+
+// peapClient runs EAP-MSCHAPv2 in a PEAPv0 tunnel.
+func peapClient(username, password string) func(conn *tls.Conn) (*eapResult, error) {
+	return func(conn *tls.Conn) (*eapResult, error) {
+		buf := make([]byte, 4096)
+		read := func() ([]byte, error) {
+			n, err := conn.Read(buf)
+			return buf[:n], err
+		}
+
+		if data, err := read(); err != nil || data[0] != EAPTypeIdentity {
+			return nil, fmt.Errorf("expected identity request: %v", err)
+		}
+		if _, err := conn.Write(append([]byte{EAPTypeIdentity}, username...)); err != nil {
+			return nil, err
+		}
+
+		challenge, err := read()
+		if err != nil || challenge[0] != EAPTypeMSCHAPv2 || challenge[1] != mschapv2OpChallenge {
+			return nil, fmt.Errorf("expected MS-CHAPv2 challenge: %v", err)
+		}
+		msID, authChallenge := challenge[2], challenge[6:22]
+		peerChallenge := make([]byte, 16)
+		_, _ = rand.Read(peerChallenge)
+		// The challenge hash covers the user name without the domain.
+		ntResponse := (&MSCHAPHandler{}).generateNTResponse(authChallenge, peerChallenge, accountName(username), ntHash(password))
+		value := append([]byte{49}, peerChallenge...)
+		value = append(value, make([]byte, 8)...)
+		value = append(value, ntResponse...)
+		value = append(value, 0)
+		value = append(value, username...)
+		if _, err := conn.Write(append([]byte{EAPTypeMSCHAPv2}, mschapv2Packet(mschapv2OpResponse, msID, value)...)); err != nil {
+			return nil, err
+		}
+
+		outcome, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write([]byte{EAPTypeMSCHAPv2, outcome[1]}); err != nil {
+			return nil, err
+		}
+
+		data, err := read()
+		if err != nil {
+			return nil, err
+		}
+		result, err := ParseEAPPacket(data)
+		if err != nil {
+			return nil, err
+		}
+		echo := &EAPPacket{Code: EAPCodeResponse, Identifier: result.Identifier, Type: EAPTypeExtensions, Data: result.Data}
+		if _, err := conn.Write(echo.Encode()); err != nil {
+			return nil, err
+		}
+		if !resultTLVSuccess(result) {
+			return nil, fmt.Errorf("PEAP failed")
+		}
+		return keyedResult(conn, nil, eapTLSKeyLabel)
+	}
+}
+
+// ttlsClient sends PAP credentials in an EAP-TTLS tunnel.
+func ttlsClient(username, password string) func(conn *tls.Conn) (*eapResult, error) {
+	avp := func(code uint32, value []byte) []byte {
+		data := binary.BigEndian.AppendUint32(nil, code)
+		length := 8 + len(value)
+		data = append(data, avpFlagMandatory, byte(length>>16), byte(length>>8), byte(length))
+		data = append(data, value...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+		return data
+	}
+	return func(conn *tls.Conn) (*eapResult, error) {
+		padded := []byte(password)
+		for len(padded)%16 != 0 {
+			padded = append(padded, 0)
+		}
+		if _, err := conn.Write(append(avp(avpUserName, []byte(username)), avp(avpUserPassword, padded)...)); err != nil {
+			return nil, err
+		}
+		return keyedResult(conn, nil, eapTTLSKeyLabel)
+	}
+}
+
+func TestEAP_PEAPMSCHAPv2(t *testing.T) {
+	// A small fragment size makes both ends fragment the handshake.
+	f := newEAPFixture(t, EAPConfig{Methods: []string{"peap"}, FragmentSize: 200})
+
+	s := f.supplicant(t, EAPTypePEAP, peapClient("EXAMPLE\\alice", "secret"))
+	s.assertAccepted(s.run(200))
+
+	s = f.supplicant(t, EAPTypePEAP, peapClient("alice", "wrong"))
+	s.assertRejected(s.run(1000))
+}
+
+func TestEAP_TTLSPAP(t *testing.T) {
+	// The supplicant asks for EAP-TTLS with a Nak of the offered PEAP.
+	f := newEAPFixture(t, EAPConfig{Methods: []string{"peap", "ttls"}})
+
+	s := f.supplicant(t, EAPTypeTTLS, ttlsClient("alice", "secret"))
+	s.assertAccepted(s.run(1000))
+
+	s = f.supplicant(t, EAPTypeTTLS, ttlsClient("alice", "wrong"))
+	s.assertRejected(s.run(1000))
+}
+
+func TestEAP_InnerIdentityLockout(t *testing.T) {
+	f := newEAPFixture(t, EAPConfig{Methods: []string{"peap", "ttls"}})
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()}))
+	f.auth.SetLockoutTracker(lockout.NewTracker(client, lockout.Config{MaxFailures: 2, ThrottleAfter: 100, LockoutDuration: time.Minute}, zap.NewNop()))
+
+	// Failures behind the anonymous outer identity lock the inner account.
+	s := f.supplicant(t, EAPTypeTTLS, ttlsClient("alice", "wrong"))
+	s.assertRejected(s.run(1000))
+	s = f.supplicant(t, EAPTypePEAP, peapClient("alice", "wrong"))
+	s.assertRejected(s.run(1000))
+
+	s = f.supplicant(t, EAPTypeTTLS, ttlsClient("alice", "secret"))
+	s.assertRejected(s.run(1000))
+	s = f.supplicant(t, EAPTypePEAP, peapClient("EXAMPLE\\alice", "secret"))
+	s.assertRejected(s.run(1000))
+}
+
+func TestEAP_TLS(t *testing.T) {
+	f := newEAPFixture(t, EAPConfig{Methods: []string{"tls"}})
+	tlsClient := func(conn *tls.Conn) (*eapResult, error) {
+		return keyedResult(conn, nil, eapTLSKeyLabel)
+	}
+
+	alice := f.pki.issue(t, "alice", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	s := f.supplicant(t, EAPTypeTLS, tlsClient)
+	s.config.Certificates = []tls.Certificate{alice}
+	s.assertAccepted(s.run(1000))
+
+	mallory := f.pki.issue(t, "mallory", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "mallory"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	s = f.supplicant(t, EAPTypeTLS, tlsClient)
+	s.config.Certificates = []tls.Certificate{mallory}
+	s.assertRejected(s.run(1000))
+}
+
+func TestEAP_TLSMapsCertificateEmail(t *testing.T) {
+	f := newEAPFixture(t, EAPConfig{Methods: []string{"tls"}, CertificateUser: "email"})
+	cert := f.pki.issue(t, "laptop", &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "laptop-42"},
+		EmailAddresses: []string{"alice@example.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	s := f.supplicant(t, EAPTypeTLS, func(conn *tls.Conn) (*eapResult, error) {
+		return keyedResult(conn, nil, eapTLSKeyLabel)
+	})
+	s.config.Certificates = []tls.Certificate{cert}
+	s.assertAccepted(s.run(1000))
+}
+
+func TestEAP_RequiresMessageAuthenticator(t *testing.T) {
+	f := newEAPFixture(t, EAPConfig{Methods: []string{"peap", "ttls"}})
+	s := f.supplicant(t, EAPTypeTTLS, nil)
+
+	response := s.send(&EAPPacket{Code: EAPCodeResponse, Identifier: 1, Type: EAPTypeIdentity, Data: []byte("alice")}, false)
+	assert.Equal(t, byte(CodeAccessReject), response.Code)
+
+	// A retransmitted request gets the same challenge, while the supplicant
+	// asks for EAP-TTLS instead of the offered PEAP.
+	response = s.send(&EAPPacket{Code: EAPCodeResponse, Identifier: 1, Type: EAPTypeIdentity, Data: []byte("alice")}, true)
+	require.Equal(t, byte(CodeAccessChallenge), response.Code)
+	s.state = response.GetAttribute(AttrState).Value
+	start, err := ParseEAPPacket(response.GetEAPMessage())
+	require.NoError(t, err)
+	response = s.send(&EAPPacket{Code: EAPCodeResponse, Identifier: start.Identifier, Type: EAPTypeNak, Data: []byte{EAPTypeTTLS}}, true)
+	require.Equal(t, byte(CodeAccessChallenge), response.Code)
+
+	again, err := f.auth.Authenticate(context.Background(), s.lastRequest, f.client)
+	require.NoError(t, err)
+	assert.Equal(t, response.GetAttribute(AttrState), again.GetAttribute(AttrState))
+	assert.Equal(t, response.GetEAPMessage(), again.GetEAPMessage())
+}
+
+func TestEAPMessage_SplitsAcrossAttributes(t *testing.T) {
+	message := make([]byte, 600)
+	_, _ = rand.Read(message)
+	packet := &Packet{}
+	packet.AddEAPMessage(message)
+	assert.Len(t, packet.Attributes, 3)
+	assert.Equal(t, message, packet.GetEAPMessage())
+}
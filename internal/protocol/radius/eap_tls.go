@@ -0,0 +1,267 @@
+package radius
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Flags of EAP-TLS, PEAP and EAP-TTLS packets (RFC 5216). The low three bits
+// hold the version of PEAP and EAP-TTLS, which is always 0 here.
+const (
+	tlsFlagLength = 0x80
+	tlsFlagMore   = 0x40
+	tlsFlagStart  = 0x20
+)
+
+// tlsEngineTimeout bounds how long the TLS endpoint may take to process one
+// round of data.
+const tlsEngineTimeout = 10 * time.Second
+
+var errTLSEngineTimeout = errors.New("TLS engine did not respond in time")
+
+// tlsEngine runs a TLS endpoint over data that arrives in EAP packets. The
+// endpoint runs in its own goroutine and reads from the engine as from a
+// connection. When it needs more data than it has, the engine hands what it
+// wrote back to the EAP conversation and waits for the peer's next message.
+type tlsEngine struct {
+	in       chan []byte
+	waiting  chan struct{}
+	done     chan struct{}
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// buf is the unread input and out the unsent output. The goroutine
+	// only touches them between receiving from in and signalling waiting
+	// or done, so the conversation can read out in between.
+	buf []byte
+	out bytes.Buffer
+
+	result *eapResult
+	err    error
+}
+
+// startTLSEngine starts run in a goroutine and returns once it waits for
+// input or is done.
+func startTLSEngine(run func(e *tlsEngine) (*eapResult, error)) (*tlsEngine, error) {
+	e := &tlsEngine{
+		in:      make(chan []byte),
+		waiting: make(chan struct{}),
+		done:    make(chan struct{}),
+		quit:    make(chan struct{}),
+	}
+	go func() {
+		defer close(e.done)
+		e.result, e.err = run(e)
+	}()
+	if err := e.wait(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// exchange hands data from the peer to the endpoint and returns what the
+// endpoint wrote in response.
+func (e *tlsEngine) exchange(data []byte) ([]byte, error) {
+	if !e.finished() {
+		select {
+		case e.in <- data:
+		case <-e.done:
+		case <-time.After(tlsEngineTimeout):
+			e.stop()
+			return nil, errTLSEngineTimeout
+		}
+		if err := e.wait(); err != nil {
+			return nil, err
+		}
+	}
+	out := append([]byte(nil), e.out.Bytes()...)
+	e.out.Reset()
+	return out, nil
+}
+
+func (e *tlsEngine) wait() error {
+	select {
+	case <-e.waiting:
+		return nil
+	case <-e.done:
+		return nil
+	case <-time.After(tlsEngineTimeout):
+		e.stop()
+		return errTLSEngineTimeout
+	}
+}
+
+func (e *tlsEngine) finished() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop makes the endpoint's reads fail so that its goroutine ends.
+func (e *tlsEngine) stop() {
+	e.stopOnce.Do(func() { close(e.quit) })
+}
+
+// awaitRound waits for the peer's next message even if input is left. The
+// endpoint uses it for a round trip that carries no TLS data, such as the
+// acknowledgement of the end of the handshake.
+func (e *tlsEngine) awaitRound() error {
+	select {
+	case e.waiting <- struct{}{}:
+	case <-e.quit:
+		return io.EOF
+	}
+	select {
+	case data := <-e.in:
+		e.buf = append(e.buf, data...)
+		return nil
+	case <-e.quit:
+		return io.EOF
+	}
+}
+
+func (e *tlsEngine) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if err := e.awaitRound(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func (e *tlsEngine) Write(p []byte) (int, error) {
+	return e.out.Write(p)
+}
+
+func (e *tlsEngine) Close() error                       { return nil }
+func (e *tlsEngine) LocalAddr() net.Addr                { return eapAddr{} }
+func (e *tlsEngine) RemoteAddr() net.Addr               { return eapAddr{} }
+func (e *tlsEngine) SetDeadline(t time.Time) error      { return nil }
+func (e *tlsEngine) SetReadDeadline(t time.Time) error  { return nil }
+func (e *tlsEngine) SetWriteDeadline(t time.Time) error { return nil }
+
+// eapAddr is the address of both ends of a TLS tunnel in EAP.
+type eapAddr struct{}
+
+func (eapAddr) Network() string { return "eap" }
+func (eapAddr) String() string  { return "eap" }
+
+// tlsTunnel carries the TLS records of an EAP-TLS, PEAP or EAP-TTLS
+// conversation in EAP packets. Messages larger than the fragment size are
+// sent in fragments that the peer acknowledges one by one, and fragmented
+// messages from the peer are reassembled and acknowledged.
+type tlsTunnel struct {
+	engine       *tlsEngine
+	fragmentSize int
+	// started is set once the peer sent TLS data for the method.
+	started bool
+
+	incoming []byte
+	outgoing []byte
+	// first is set while no fragment of the outgoing message was sent.
+	first bool
+}
+
+// startPacket is the data of the request that starts the method.
+func (t *tlsTunnel) startPacket() []byte {
+	return []byte{tlsFlagStart}
+}
+
+// ack is the data of an acknowledgement of a fragment.
+func (t *tlsTunnel) ack() []byte {
+	return []byte{0}
+}
+
+// receive adds the data of a response to the message being reassembled. It
+// returns the message once its last fragment arrived.
+func (t *tlsTunnel) receive(data []byte) ([]byte, bool, error) {
+	if len(data) < 1 {
+		return nil, false, fmt.Errorf("TLS data without flags")
+	}
+	flags := data[0]
+	data = data[1:]
+	if flags&tlsFlagLength != 0 {
+		if len(data) < 4 {
+			return nil, false, fmt.Errorf("TLS message length missing")
+		}
+		data = data[4:]
+	}
+	if len(data) > 0 {
+		if len(t.outgoing) > 0 {
+			return nil, false, fmt.Errorf("peer sent data while a message was being fragmented")
+		}
+		t.started = true
+	}
+	t.incoming = append(t.incoming, data...)
+	if flags&tlsFlagMore != 0 {
+		return nil, false, nil
+	}
+	message := t.incoming
+	t.incoming = nil
+	return message, true, nil
+}
+
+// next returns the data of the next request for a complete message from
+// the peer, or nil when the method is done.
+func (t *tlsTunnel) next(message []byte) []byte {
+	if len(t.outgoing) == 0 {
+		out, err := t.engine.exchange(message)
+		if err != nil {
+			t.engine.stop()
+			return nil
+		}
+		if len(out) == 0 {
+			if t.engine.finished() {
+				return nil
+			}
+			// The endpoint waits for the peer without sending anything.
+			return t.ack()
+		}
+		t.outgoing = out
+		t.first = true
+	}
+	return t.fragment()
+}
+
+// fragment takes the next fragment of the outgoing message.
+func (t *tlsTunnel) fragment() []byte {
+	chunk := t.outgoing
+	var flags byte
+	if len(chunk) > t.fragmentSize {
+		chunk = chunk[:t.fragmentSize]
+		flags |= tlsFlagMore
+	}
+
+	data := []byte{flags}
+	if t.first && flags&tlsFlagMore != 0 {
+		data[0] |= tlsFlagLength
+		data = binary.BigEndian.AppendUint32(data, uint32(len(t.outgoing)))
+	}
+	data = append(data, chunk...)
+	t.outgoing = t.outgoing[len(chunk):]
+	t.first = false
+	return data
+}
+
+// result is the outcome of the method once the endpoint is done.
+func (t *tlsTunnel) result() *eapResult {
+	if !t.engine.finished() || t.engine.err != nil {
+		return nil
+	}
+	return t.engine.result
+}
+
+func (t *tlsTunnel) stop() {
+	t.engine.stop()
+}
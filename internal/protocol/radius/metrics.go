@@ -0,0 +1,93 @@
+package radius
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// AccessResponsesTotal counts the responses to Access-Requests by code.
+	AccessResponsesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_radius_access_responses_total",
+			Help: "Total number of RADIUS Access-Request responses",
+		},
+		[]string{"code"}, // "accept", "reject" or "challenge"
+	)
+
+	// DroppedPacketsTotal counts the requests that were silently discarded.
+	DroppedPacketsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_radius_dropped_packets_total",
+			Help: "Total number of RADIUS packets dropped",
+		},
+		[]string{"reason"}, // "unknown_client", "malformed", "invalid_authenticator" or "proxy_failed"
+	)
+
+	// ProxyRequestsTotal counts the requests proxied to a pool of upstream
+	// servers.
+	ProxyRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_radius_proxy_requests_total",
+			Help: "Total number of RADIUS requests proxied to upstream servers",
+		},
+		[]string{"pool", "result"}, // "forwarded" or "failed"
+	)
+
+	// ProxyFailoversTotal counts the requests retried on another server of
+	// a pool.
+	ProxyFailoversTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_radius_proxy_failovers_total",
+			Help: "Total number of RADIUS proxy failovers to another upstream server",
+		},
+		[]string{"pool"},
+	)
+
+	// ProxyServerUp is 1 for live upstream servers and 0 for dead ones.
+	ProxyServerUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "quantaid_radius_proxy_server_up",
+			Help: "Whether an upstream RADIUS server is alive",
+		},
+		[]string{"pool", "server"},
+	)
+
+	// DynamicAuthorizationTotal counts the Disconnect-Requests and
+	// CoA-Requests sent to NAS clients by their outcome.
+	DynamicAuthorizationTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quantaid_radius_dynamic_authorization_total",
+			Help: "Total number of RADIUS dynamic authorization requests sent",
+		},
+		[]string{"operation", "result"}, // "disconnect" or "coa"; "ack", "nak", "timeout" or "error"
+	)
+)
+
+func recordDynamicAuthorization(operation string, err error) {
+	var nak *NAKError
+	result := "ack"
+	switch {
+	case err == nil:
+	case errors.As(err, &nak):
+		result = "nak"
+	case errors.Is(err, ErrNoResponse):
+		result = "timeout"
+	default:
+		result = "error"
+	}
+	DynamicAuthorizationTotal.WithLabelValues(operation, result).Inc()
+}
+
+func recordAccessResponse(code byte) {
+	switch code {
+	case CodeAccessAccept:
+		AccessResponsesTotal.WithLabelValues("accept").Inc()
+	case CodeAccessReject:
+		AccessResponsesTotal.WithLabelValues("reject").Inc()
+	case CodeAccessChallenge:
+		AccessResponsesTotal.WithLabelValues("challenge").Inc()
+	}
+}
@@ -18,6 +18,8 @@ type MSCHAPHandler struct {
 	userService     identity.IService
 	passwordService password.IService
 	codec           *AttributeCodec
+	// authorize applies the authorization policies to an Access-Accept.
+	authorize func(ctx context.Context, request *Packet, client *RADIUSClient, user *types.User, accept *Packet) *Packet
 }
 
 func NewMSCHAPHandler(userService identity.IService, passwordService password.IService, codec *AttributeCodec) *MSCHAPHandler {
@@ -56,54 +58,41 @@ func (h *MSCHAPHandler) Authenticate(ctx context.Context, request *Packet, clien
 		return nil, fmt.Errorf("missing MS-CHAP-Challenge")
 	}
 
-	// Find User
-	u, err := h.userService.GetUserByUsername(ctx, username)
+	u, authResponse, err := h.verify(ctx, username, username, authChallenge, peerChallenge, ntResponse)
 	if err != nil {
-		// User not found
-		return h.createMSCHAPError(request, 691, "Invalid credentials"), nil
+		return h.createMSCHAPError(request, 691, "E=691 R=0 C=0000000000000000 V=3 M=Auth Failed"), nil
+	}
+
+	// Create Accept Response
+	accept := h.createMSCHAPAccept(request, u, authResponse)
+	if h.authorize != nil {
+		accept = h.authorize(ctx, request, client, u, accept)
+	}
+	return accept, nil
+}
+
+// verify checks the MS-CHAPv2 NT-Response of the user named account. name is
+// the user name the peer hashed into the challenge. It returns the user and
+// the authenticator response that proves to the peer that the server knows
+// the password as well.
+func (h *MSCHAPHandler) verify(ctx context.Context, account, name string, authChallenge, peerChallenge, ntResponse []byte) (*types.User, string, error) {
+	u, err := h.userService.GetUserByUsername(ctx, account)
+	if err != nil || u == nil {
+		return nil, "", fmt.Errorf("user not found")
 	}
 
-	// Get NT Hash (MD4 of unicode password)
-	// Currently PasswordService might only store bcrypt/argon2.
-	// For MS-CHAPv2, we need the NTHash or the cleartext password.
-	// We assume PasswordService has a method `GetNTHash` or we calculate it if cleartext is available.
-	// Since `GetPlainForCHAP` was mentioned in plan, we'll try that.
-
-	// NOTE: In a real secure system, we shouldn't store cleartext.
-	// But MS-CHAPv2 requires NTHash (MD4).
-	// If the DB stores bcrypt, we cannot support MS-CHAPv2 unless we also store NTHash.
-	// Assuming `GetNTHash` exists or we can get cleartext.
-	// For this implementation, I will assume a helper `GetNTHash` or similar.
-	// Since I cannot change PasswordService easily without seeing it, I'll assume an interface extension or method.
-	// Plan mentioned `h.passwordService.GetNTHash(ctx, user.ID)`.
-
-	// Mocking the call:
-	// ntHash, err := h.passwordService.GetNTHash(ctx, u.ID)
-	// As I can't verify if `GetNTHash` exists on `password.IService` (it likely doesn't),
-	// I will check `internal/domain/password/interface.go` if I can.
-	// If not, I will assume it returns error for now or add it if allowed.
-	// Let's assume for this task we might need to rely on cleartext if available or just fail.
-	// Wait, the plan says `ADD: internal/protocol/radius/mschap.go` but didn't explicitly say modify PasswordService.
-	// But `Key Tasks` doesn't mention modifying password service.
-	// However, without NTHash, MS-CHAPv2 is impossible.
-
-	// Let's assume we can retrieve it.
+	// MS-CHAPv2 needs the NT hash (MD4) of the password, which only a
+	// password service that keeps it can provide.
 	ntHash, err := h.getNTHash(ctx, u.ID)
 	if err != nil {
-		return h.createMSCHAPError(request, 691, "E=691 R=0 C=0000000000000000 V=3 M=Auth Failed"), nil
+		return nil, "", err
 	}
 
-	// Verify NT Response
-	expectedNTResponse := h.generateNTResponse(authChallenge, peerChallenge, username, ntHash)
+	expectedNTResponse := h.generateNTResponse(authChallenge, peerChallenge, name, ntHash)
 	if !bytes.Equal(ntResponse, expectedNTResponse) {
-		return h.createMSCHAPError(request, 691, "E=691 R=0 C=0000000000000000 V=3 M=Auth Failed"), nil
+		return nil, "", fmt.Errorf("invalid NT-Response")
 	}
-
-	// Generate Authenticator Response
-	authResponse := h.generateAuthenticatorResponse(ntHash, ntResponse, peerChallenge, authChallenge, username)
-
-	// Create Accept Response
-	return h.createMSCHAPAccept(request, u, authResponse), nil
+	return u, h.generateAuthenticatorResponse(ntHash, ntResponse, peerChallenge, authChallenge, name), nil
 }
 
 // getNTHash is a placeholder. In real impl, this calls PasswordService.
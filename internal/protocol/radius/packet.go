@@ -2,6 +2,7 @@ package radius
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
 	"encoding/binary"
 	"fmt"
@@ -14,6 +15,13 @@ const (
 	CodeAccountingRequest  = 4
 	CodeAccountingResponse = 5
 	CodeAccessChallenge    = 11
+	CodeStatusServer       = 12
+	CodeDisconnectRequest  = 40
+	CodeDisconnectACK      = 41
+	CodeDisconnectNAK      = 42
+	CodeCoARequest         = 43
+	CodeCoAACK             = 44
+	CodeCoANAK             = 45
 
 	MaxPacketSize = 4096
 	HeaderSize    = 20
@@ -172,3 +180,46 @@ func (p *Packet) CalculateResponseAuthenticator(requestAuth [16]byte) [16]byte {
 	copy(auth[:], h.Sum(nil))
 	return auth
 }
+
+// VerifyMessageAuthenticator checks the Message-Authenticator attribute
+// (RFC 3579) of the packet. authenticator is the packet's own authenticator
+// for a request and the request's authenticator for a response. A packet
+// without the attribute does not verify.
+func (p *Packet) VerifyMessageAuthenticator(authenticator [16]byte) bool {
+	attr := p.GetAttribute(AttrMessageAuthenticator)
+	if attr == nil || len(attr.Value) != md5.Size {
+		return false
+	}
+	return hmac.Equal(attr.Value, p.messageAuthenticator(authenticator))
+}
+
+// SignMessageAuthenticator fills in the Message-Authenticator attribute of
+// a response, if it has one, with the request's authenticator. It must be
+// called before the response authenticator is calculated.
+func (p *Packet) SignMessageAuthenticator(requestAuth [16]byte) {
+	for i := range p.Attributes {
+		if p.Attributes[i].Type == AttrMessageAuthenticator {
+			p.Attributes[i].Value = p.messageAuthenticator(requestAuth)
+			return
+		}
+	}
+}
+
+// messageAuthenticator is the HMAC-MD5 of the packet with the given
+// authenticator and a zeroed Message-Authenticator, keyed by the secret.
+func (p *Packet) messageAuthenticator(authenticator [16]byte) []byte {
+	unsigned := *p
+	unsigned.Authenticator = authenticator
+	unsigned.Attributes = make([]Attribute, len(p.Attributes))
+	for i, attr := range p.Attributes {
+		if attr.Type == AttrMessageAuthenticator {
+			attr = Attribute{Type: attr.Type, Length: 2 + md5.Size, Value: make([]byte, md5.Size)}
+		}
+		unsigned.Attributes[i] = attr
+	}
+	encoded, _ := unsigned.Encode()
+
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(encoded)
+	return mac.Sum(nil)
+}
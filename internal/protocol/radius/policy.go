@@ -0,0 +1,399 @@
+package radius
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// policyCacheTTL is how long the manager evaluates requests against the
+// policies it loaded before it reloads them, so that changes made by other
+// instances take effect.
+const policyCacheTTL = 30 * time.Second
+
+// Attributes a policy may not set, because the server computes them for
+// each request.
+var protectedAttributes = map[byte]bool{
+	AttrUserPassword:         true,
+	AttrCHAPPassword:         true,
+	AttrState:                true,
+	AttrProxyState:           true,
+	AttrEAPMessage:           true,
+	AttrMessageAuthenticator: true,
+}
+
+// Policy authorizes the users it matches: it adds reply attributes to their
+// Access-Accepts, such as a VLAN, a filter or a session timeout, or denies
+// them access.
+type Policy struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Enabled     bool   `json:"enabled"`
+	// Priority orders the policies; lower values are evaluated first.
+	Priority   int              `json:"priority"`
+	Conditions PolicyConditions `json:"conditions"`
+	// Deny rejects the requests the policy matches.
+	Deny       bool             `json:"deny,omitempty"`
+	Attributes []ReplyAttribute `json:"attributes,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	UpdatedAt  time.Time        `json:"updated_at"`
+}
+
+// PolicyConditions select the requests a policy applies to. Every
+// condition that is set must hold; an empty condition holds for all.
+type PolicyConditions struct {
+	// Clients are the IDs or names of NAS clients.
+	Clients []string `json:"clients,omitempty"`
+	// VendorTypes are vendor types of NAS clients, e.g. "cisco".
+	VendorTypes []string `json:"vendor_types,omitempty"`
+	// Groups are the IDs or names of groups, one of which the user must be
+	// a member of.
+	Groups []string `json:"groups,omitempty"`
+	// Times are windows of the week, one of which the request must fall in.
+	Times []TimeWindow `json:"times,omitempty"`
+}
+
+// TimeWindow is a time of day on some days of the week.
+type TimeWindow struct {
+	// Days are "mon" to "sun"; empty means every day.
+	Days []string `json:"days,omitempty"`
+	// Start and End are "15:04" times. A window whose end is before its
+	// start runs over midnight, on the days it starts.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Location is the IANA time zone of the window, by default the server's.
+	Location string `json:"location,omitempty"`
+}
+
+// ReplyAttribute is an attribute added to Access-Accepts, named as in the
+// dictionary, e.g. "Tunnel-Private-Group-Id" or a vendor's "Cisco-AVPair".
+type ReplyAttribute struct {
+	Name string `json:"name"`
+	// Tag groups tagged attributes such as the tunnel attributes.
+	Tag   byte   `json:"tag,omitempty"`
+	Value string `json:"value"`
+}
+
+// Authorization is the outcome of the policies for a request.
+type Authorization struct {
+	Deny bool
+	// Policies are the names of the policies that matched.
+	Policies   []string
+	Attributes []Attribute
+}
+
+// PolicyRepository stores authorization policies.
+type PolicyRepository interface {
+	CreatePolicy(ctx context.Context, policy *Policy) error
+	// GetPolicy returns types.ErrNotFound for unknown policies.
+	GetPolicy(ctx context.Context, id string) (*Policy, error)
+	ListPolicies(ctx context.Context) ([]*Policy, error)
+	UpdatePolicy(ctx context.Context, policy *Policy) error
+	DeletePolicy(ctx context.Context, id string) error
+}
+
+// PolicyManager manages the authorization policies and evaluates them when
+// users are accepted.
+type PolicyManager struct {
+	repo  PolicyRepository
+	codec *AttributeCodec
+	now   func() time.Time
+
+	mu       sync.Mutex
+	policies []*Policy
+	loadedAt time.Time
+}
+
+// NewPolicyManager creates a policy manager. Attributes are looked up and
+// encoded with codec, so dictionaries must be loaded into it first.
+func NewPolicyManager(repo PolicyRepository, codec *AttributeCodec) *PolicyManager {
+	return &PolicyManager{repo: repo, codec: codec, now: time.Now}
+}
+
+// Codec returns the codec the policy attributes are encoded with.
+func (m *PolicyManager) Codec() *AttributeCodec {
+	return m.codec
+}
+
+// CreatePolicy validates and stores a new policy.
+func (m *PolicyManager) CreatePolicy(ctx context.Context, policy *Policy) error {
+	if policy.ID == "" {
+		policy.ID = uuid.New().String()
+	}
+	if err := m.Validate(policy); err != nil {
+		return err
+	}
+	policy.CreatedAt = m.now()
+	policy.UpdatedAt = policy.CreatedAt
+	if err := m.repo.CreatePolicy(ctx, policy); err != nil {
+		return err
+	}
+	m.invalidate()
+	return nil
+}
+
+// GetPolicy returns a policy.
+func (m *PolicyManager) GetPolicy(ctx context.Context, id string) (*Policy, error) {
+	return m.repo.GetPolicy(ctx, id)
+}
+
+// ListPolicies returns all policies in the order they are evaluated.
+func (m *PolicyManager) ListPolicies(ctx context.Context) ([]*Policy, error) {
+	policies, err := m.repo.ListPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sortPolicies(policies)
+	return policies, nil
+}
+
+// UpdatePolicy validates and replaces a policy.
+func (m *PolicyManager) UpdatePolicy(ctx context.Context, policy *Policy) error {
+	existing, err := m.repo.GetPolicy(ctx, policy.ID)
+	if err != nil {
+		return err
+	}
+	if err := m.Validate(policy); err != nil {
+		return err
+	}
+	policy.CreatedAt = existing.CreatedAt
+	policy.UpdatedAt = m.now()
+	if err := m.repo.UpdatePolicy(ctx, policy); err != nil {
+		return err
+	}
+	m.invalidate()
+	return nil
+}
+
+// DeletePolicy removes a policy.
+func (m *PolicyManager) DeletePolicy(ctx context.Context, id string) error {
+	if err := m.repo.DeletePolicy(ctx, id); err != nil {
+		return err
+	}
+	m.invalidate()
+	return nil
+}
+
+// Validate checks that a policy's attributes are in the dictionary with
+// valid values and that its time windows parse.
+func (m *PolicyManager) Validate(policy *Policy) error {
+	invalid := func(format string, args ...interface{}) error {
+		return types.ErrValidation.WithDetails(map[string]string{"error": fmt.Sprintf(format, args...)})
+	}
+	if strings.TrimSpace(policy.Name) == "" {
+		return invalid("name is required")
+	}
+	for _, attr := range policy.Attributes {
+		encoded, err := m.codec.EncodeAttribute(attr.Name, attr.Tag, attr.Value)
+		if err != nil {
+			return invalid("%v", err)
+		}
+		if protectedAttributes[encoded.Type] {
+			return invalid("attribute %q cannot be set by a policy", attr.Name)
+		}
+	}
+	for _, window := range policy.Conditions.Times {
+		if _, err := window.parse(); err != nil {
+			return invalid("%v", err)
+		}
+	}
+	return nil
+}
+
+// Authorize evaluates the enabled policies for a user accepted through a
+// NAS client. Policies are evaluated in order; the first matching policy
+// that denies access ends the evaluation, and an attribute is taken from the
+// first matching policy that sets it.
+func (m *PolicyManager) Authorize(ctx context.Context, client *RADIUSClient, groups []*types.UserGroup) (*Authorization, error) {
+	policies, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	result := &Authorization{}
+	assigned := make(map[string]bool)
+	for _, policy := range policies {
+		if !policy.Enabled || !policy.matches(client, groups, now) {
+			continue
+		}
+		result.Policies = append(result.Policies, policy.Name)
+		if policy.Deny {
+			result.Deny = true
+			result.Attributes = nil
+			return result, nil
+		}
+
+		// Attributes repeated within one policy, such as several vendor
+		// AV pairs, are all added.
+		added := make(map[string]bool)
+		for _, attr := range policy.Attributes {
+			key := fmt.Sprintf("%s:%d", strings.ToLower(attr.Name), attr.Tag)
+			if assigned[key] {
+				continue
+			}
+			encoded, err := m.codec.EncodeAttribute(attr.Name, attr.Tag, attr.Value)
+			if err != nil {
+				return nil, fmt.Errorf("policy %q: %w", policy.Name, err)
+			}
+			result.Attributes = append(result.Attributes, encoded)
+			added[key] = true
+		}
+		for key := range added {
+			assigned[key] = true
+		}
+	}
+	return result, nil
+}
+
+func (m *PolicyManager) load(ctx context.Context) ([]*Policy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.policies != nil && m.now().Sub(m.loadedAt) < policyCacheTTL {
+		return m.policies, nil
+	}
+	policies, err := m.repo.ListPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sortPolicies(policies)
+	m.policies = policies
+	m.loadedAt = m.now()
+	return policies, nil
+}
+
+func (m *PolicyManager) invalidate() {
+	m.mu.Lock()
+	m.policies = nil
+	m.mu.Unlock()
+}
+
+func sortPolicies(policies []*Policy) {
+	sort.SliceStable(policies, func(i, j int) bool {
+		if policies[i].Priority != policies[j].Priority {
+			return policies[i].Priority < policies[j].Priority
+		}
+		return policies[i].Name < policies[j].Name
+	})
+}
+
+func (p *Policy) matches(client *RADIUSClient, groups []*types.UserGroup, now time.Time) bool {
+	c := p.Conditions
+	if len(c.Clients) > 0 && (client == nil || !containsFold(c.Clients, client.ID, client.Name)) {
+		return false
+	}
+	if len(c.VendorTypes) > 0 && (client == nil || !containsFold(c.VendorTypes, client.VendorType)) {
+		return false
+	}
+	if len(c.Groups) > 0 {
+		member := false
+		for _, group := range groups {
+			if containsFold(c.Groups, group.ID, group.Name) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return false
+		}
+	}
+	if len(c.Times) > 0 {
+		within := false
+		for _, window := range c.Times {
+			if window.contains(now) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold reports whether any of values is in list, ignoring case.
+func containsFold(list []string, values ...string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if value != "" && strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parsedWindow is a TimeWindow with its fields parsed; start and end are
+// minutes after midnight.
+type parsedWindow struct {
+	days       map[time.Weekday]bool
+	start, end int
+	location   *time.Location
+}
+
+func (w TimeWindow) parse() (*parsedWindow, error) {
+	parsed := &parsedWindow{location: time.Local}
+	if w.Location != "" {
+		location, err := time.LoadLocation(w.Location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %q", w.Location)
+		}
+		parsed.location = location
+	}
+	if len(w.Days) > 0 {
+		parsed.days = make(map[time.Weekday]bool)
+		for _, day := range w.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q", day)
+			}
+			parsed.days[weekday] = true
+		}
+	}
+	for _, t := range []struct {
+		value string
+		into  *int
+	}{{w.Start, &parsed.start}, {w.End, &parsed.end}} {
+		clock, err := time.Parse("15:04", t.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q", t.value)
+		}
+		*t.into = clock.Hour()*60 + clock.Minute()
+	}
+	return parsed, nil
+}
+
+func (w TimeWindow) contains(now time.Time) bool {
+	parsed, err := w.parse()
+	if err != nil {
+		return false
+	}
+	local := now.In(parsed.location)
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	if parsed.start <= parsed.end {
+		return parsed.onDay(day) && minute >= parsed.start && minute < parsed.end
+	}
+	// Over midnight: the evening of a listed day or the morning after it.
+	if minute >= parsed.start {
+		return parsed.onDay(day)
+	}
+	return minute < parsed.end && parsed.onDay((day+6)%7)
+}
+
+func (w *parsedWindow) onDay(day time.Weekday) bool {
+	return w.days == nil || w.days[day]
+}
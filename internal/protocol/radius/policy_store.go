@@ -0,0 +1,201 @@
+package radius
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/turtacn/QuantaID/internal/storage/postgresql/models"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gorm.io/gorm"
+)
+
+// MemoryPolicyRepository keeps policies in memory.
+type MemoryPolicyRepository struct {
+	mu       sync.RWMutex
+	policies map[string]Policy
+}
+
+// NewMemoryPolicyRepository creates an empty in-memory policy repository.
+func NewMemoryPolicyRepository() *MemoryPolicyRepository {
+	return &MemoryPolicyRepository{policies: make(map[string]Policy)}
+}
+
+func (r *MemoryPolicyRepository) CreatePolicy(ctx context.Context, policy *Policy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.policies[policy.ID]; ok {
+		return types.ErrConflict
+	}
+	r.policies[policy.ID] = *policy
+	return nil
+}
+
+func (r *MemoryPolicyRepository) GetPolicy(ctx context.Context, id string) (*Policy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	policy, ok := r.policies[id]
+	if !ok {
+		return nil, types.ErrNotFound
+	}
+	return &policy, nil
+}
+
+func (r *MemoryPolicyRepository) ListPolicies(ctx context.Context) ([]*Policy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	policies := make([]*Policy, 0, len(r.policies))
+	for _, policy := range r.policies {
+		policy := policy
+		policies = append(policies, &policy)
+	}
+	return policies, nil
+}
+
+func (r *MemoryPolicyRepository) UpdatePolicy(ctx context.Context, policy *Policy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.policies[policy.ID]; !ok {
+		return types.ErrNotFound
+	}
+	r.policies[policy.ID] = *policy
+	return nil
+}
+
+func (r *MemoryPolicyRepository) DeletePolicy(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.policies[id]; !ok {
+		return types.ErrNotFound
+	}
+	delete(r.policies, id)
+	return nil
+}
+
+// GormPolicyRepository stores policies in the radius_policies table.
+type GormPolicyRepository struct {
+	db *gorm.DB
+}
+
+// NewGormPolicyRepository creates a policy repository on a database.
+func NewGormPolicyRepository(db *gorm.DB) *GormPolicyRepository {
+	return &GormPolicyRepository{db: db}
+}
+
+func (r *GormPolicyRepository) CreatePolicy(ctx context.Context, policy *Policy) error {
+	model, err := policyToModel(policy)
+	if err != nil {
+		return err
+	}
+	return r.db.WithContext(ctx).Create(model).Error
+}
+
+func (r *GormPolicyRepository) GetPolicy(ctx context.Context, id string) (*Policy, error) {
+	var model models.RadiusPolicy
+	if err := r.db.WithContext(ctx).Where("id = ?", id).First(&model).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, types.ErrNotFound
+		}
+		return nil, err
+	}
+	return policyFromModel(&model)
+}
+
+func (r *GormPolicyRepository) ListPolicies(ctx context.Context) ([]*Policy, error) {
+	var rows []models.RadiusPolicy
+	if err := r.db.WithContext(ctx).Order("priority, name").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	policies := make([]*Policy, 0, len(rows))
+	for i := range rows {
+		policy, err := policyFromModel(&rows[i])
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (r *GormPolicyRepository) UpdatePolicy(ctx context.Context, policy *Policy) error {
+	model, err := policyToModel(policy)
+	if err != nil {
+		return err
+	}
+	result := r.db.WithContext(ctx).Model(&models.RadiusPolicy{}).Where("id = ?", policy.ID).Updates(map[string]interface{}{
+		"name":        model.Name,
+		"description": model.Description,
+		"enabled":     model.Enabled,
+		"priority":    model.Priority,
+		"deny":        model.Deny,
+		"conditions":  model.Conditions,
+		"attributes":  model.Attributes,
+		"updated_at":  model.UpdatedAt,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormPolicyRepository) DeletePolicy(ctx context.Context, id string) error {
+	result := r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.RadiusPolicy{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+func policyToModel(policy *Policy) (*models.RadiusPolicy, error) {
+	conditions, err := json.Marshal(policy.Conditions)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := json.Marshal(policy.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	return &models.RadiusPolicy{
+		ID:          policy.ID,
+		Name:        policy.Name,
+		Description: policy.Description,
+		Enabled:     policy.Enabled,
+		Priority:    policy.Priority,
+		Deny:        policy.Deny,
+		Conditions:  conditions,
+		Attributes:  attributes,
+		CreatedAt:   policy.CreatedAt,
+		UpdatedAt:   policy.UpdatedAt,
+	}, nil
+}
+
+func policyFromModel(model *models.RadiusPolicy) (*Policy, error) {
+	policy := &Policy{
+		ID:          model.ID,
+		Name:        model.Name,
+		Description: model.Description,
+		Enabled:     model.Enabled,
+		Priority:    model.Priority,
+		Deny:        model.Deny,
+		CreatedAt:   model.CreatedAt,
+		UpdatedAt:   model.UpdatedAt,
+	}
+	if len(model.Conditions) > 0 {
+		if err := json.Unmarshal(model.Conditions, &policy.Conditions); err != nil {
+			return nil, err
+		}
+	}
+	if len(model.Attributes) > 0 {
+		if err := json.Unmarshal(model.Attributes, &policy.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
@@ -0,0 +1,271 @@
+package radius
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+const ciscoDictionary = `
+# Cisco
+VENDOR		Cisco				9
+
+BEGIN-VENDOR	Cisco
+ATTRIBUTE	Cisco-AVPair			1	string
+ATTRIBUTE	Cisco-Disconnect-Cause		195	integer
+VALUE	Cisco-Disconnect-Cause		Idle-Timeout		4
+END-VENDOR	Cisco
+`
+
+func TestAttributeCodec_LoadDictionary(t *testing.T) {
+	codec := NewAttributeCodec()
+	require.NoError(t, codec.LoadDictionary(strings.NewReader(ciscoDictionary)))
+
+	attr, err := codec.EncodeAttribute("Cisco-AVPair", 0, "shell:priv-lvl=15")
+	require.NoError(t, err)
+	assert.Equal(t, byte(AttrVendorSpecific), attr.Type)
+	vendor, vendorType, value, err := codec.DecodeVendorSpecific(attr.Value)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(9), vendor)
+	assert.Equal(t, byte(1), vendorType)
+	assert.Equal(t, "shell:priv-lvl=15", string(value))
+
+	attr, err = codec.EncodeAttribute("cisco-disconnect-cause", 0, "Idle-Timeout")
+	require.NoError(t, err)
+	_, _, value, err = codec.DecodeVendorSpecific(attr.Value)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 4}, value)
+
+	err = codec.LoadDictionary(strings.NewReader("BEGIN-VENDOR Aruba\n"))
+	assert.ErrorContains(t, err, "line 1")
+}
+
+func TestAttributeCodec_EncodeTaggedAttributes(t *testing.T) {
+	codec := NewAttributeCodec()
+
+	attr, err := codec.EncodeAttribute("Tunnel-Type", 1, "VLAN")
+	require.NoError(t, err)
+	assert.Equal(t, Attribute{Type: AttrTunnelType, Length: 6, Value: []byte{1, 0, 0, 13}}, attr)
+
+	attr, err = codec.EncodeAttribute("Tunnel-Private-Group-Id", 0, "100")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("100"), attr.Value)
+	attr, err = codec.EncodeAttribute("Tunnel-Private-Group-Id", 2, "100")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\x02100"), attr.Value)
+
+	_, err = codec.EncodeAttribute("Filter-Id", 1, "guests")
+	assert.Error(t, err)
+	_, err = codec.EncodeAttribute("Session-Timeout", 0, "an hour")
+	assert.Error(t, err)
+	_, err = codec.EncodeAttribute("MS-MPPE-Send-Key", 0, "0x00")
+	assert.Error(t, err)
+}
+
+type policyFixture struct {
+	manager *PolicyManager
+	auth    *Authenticator
+	alice   *types.User
+	switch1 *RADIUSClient
+	wlc     *RADIUSClient
+	now     time.Time
+}
+
+func newPolicyFixture(t *testing.T) *policyFixture {
+	ctx := context.Background()
+	repo := memory.NewIdentityMemoryRepository()
+	alice := &types.User{Username: "alice", Status: types.UserStatusActive}
+	require.NoError(t, repo.CreateUser(ctx, alice))
+	engineering := &types.UserGroup{Name: "engineering"}
+	require.NoError(t, repo.CreateGroup(ctx, engineering))
+	require.NoError(t, repo.AddUserToGroup(ctx, alice.ID, engineering.ID))
+	svc := identity.NewService(repo, repo, utils.NewCryptoManager("test-secret"), utils.NewZapLoggerWrapper(zap.NewNop()))
+
+	codec := NewAttributeCodec()
+	require.NoError(t, codec.LoadDictionary(strings.NewReader(ciscoDictionary)))
+	f := &policyFixture{
+		manager: NewPolicyManager(NewMemoryPolicyRepository(), codec),
+		alice:   alice,
+		switch1: &RADIUSClient{ID: "c-1", Name: "access-switch-1", VendorType: "cisco", Secret: "testing123"},
+		wlc:     &RADIUSClient{ID: "c-2", Name: "wlc", VendorType: "aruba", Secret: "testing123"},
+		// A Wednesday.
+		now: time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC),
+	}
+	f.manager.now = func() time.Time { return f.now }
+	f.auth = NewAuthenticator(svc, eapPasswords{alice.ID: "secret"}, codec, AuthenticatorConfig{DefaultSessionTimeout: 3600})
+	f.auth.SetPolicyManager(f.manager)
+	return f
+}
+
+func (f *policyFixture) create(t *testing.T, policy *Policy) {
+	policy.Enabled = true
+	require.NoError(t, f.manager.CreatePolicy(context.Background(), policy))
+}
+
+func (f *policyFixture) papRequest(client *RADIUSClient, password string) *Packet {
+	request := &Packet{Code: CodeAccessRequest, Secret: []byte(client.Secret)}
+	_, _ = rand.Read(request.Authenticator[:])
+	request.AddAttribute(AttrUserName, []byte("alice"))
+	request.AddAttribute(AttrUserPassword, f.auth.codec.EncodePassword(password, request.Authenticator, []byte(client.Secret)))
+	return request
+}
+
+func (f *policyFixture) authenticate(t *testing.T, client *RADIUSClient) *Packet {
+	response, err := f.auth.Authenticate(context.Background(), f.papRequest(client, "secret"), client)
+	require.NoError(t, err)
+	return response
+}
+
+func vlanPolicy(name string, priority int, vlan string) *Policy {
+	return &Policy{
+		Name:     name,
+		Priority: priority,
+		Attributes: []ReplyAttribute{
+			{Name: "Tunnel-Type", Value: "VLAN"},
+			{Name: "Tunnel-Medium-Type", Value: "IEEE-802"},
+			{Name: "Tunnel-Private-Group-Id", Value: vlan},
+		},
+	}
+}
+
+func TestPolicy_GroupVLANOnSwitches(t *testing.T) {
+	f := newPolicyFixture(t)
+
+	engineering := vlanPolicy("engineering vlan", 10, "120")
+	engineering.Conditions = PolicyConditions{Groups: []string{"Engineering"}, VendorTypes: []string{"cisco"}}
+	engineering.Attributes = append(engineering.Attributes,
+		ReplyAttribute{Name: "Session-Timeout", Value: "28800"},
+		ReplyAttribute{Name: "Cisco-AVPair", Value: "ip:inacl#1=permit ip any any"},
+		ReplyAttribute{Name: "Cisco-AVPair", Value: "ip:inacl#2=deny ip any any"},
+	)
+	f.create(t, engineering)
+	fallback := vlanPolicy("default vlan", 100, "999")
+	fallback.Attributes = append(fallback.Attributes, ReplyAttribute{Name: "Filter-Id", Value: "default"})
+	f.create(t, fallback)
+
+	response := f.authenticate(t, f.switch1)
+	require.Equal(t, byte(CodeAccessAccept), response.Code)
+	assert.Equal(t, "120", response.GetString(AttrTunnelPrivateGroupID))
+	assert.Equal(t, []byte{0, 0, 0, 13}, response.GetAttribute(AttrTunnelType).Value)
+	// The policy's Session-Timeout replaces the default one.
+	var timeouts [][]byte
+	var avpairs []string
+	for _, attr := range response.Attributes {
+		switch attr.Type {
+		case AttrSessionTimeout:
+			timeouts = append(timeouts, attr.Value)
+		case AttrVendorSpecific:
+			_, _, value, err := f.auth.codec.DecodeVendorSpecific(attr.Value)
+			require.NoError(t, err)
+			avpairs = append(avpairs, string(value))
+		}
+	}
+	assert.Equal(t, [][]byte{encodeInteger(28800)}, timeouts)
+	assert.Equal(t, []string{"ip:inacl#1=permit ip any any", "ip:inacl#2=deny ip any any"}, avpairs)
+	// Attributes the first policy did not set come from the fallback.
+	assert.Equal(t, "default", response.GetString(AttrFilterId))
+
+	response = f.authenticate(t, f.wlc)
+	require.Equal(t, byte(CodeAccessAccept), response.Code)
+	assert.Equal(t, "999", response.GetString(AttrTunnelPrivateGroupID))
+}
+
+func TestPolicy_TimeOfDayDeny(t *testing.T) {
+	f := newPolicyFixture(t)
+	f.create(t, &Policy{
+		Name: "no wireless at night",
+		Deny: true,
+		Conditions: PolicyConditions{
+			Clients: []string{"wlc"},
+			Times:   []TimeWindow{{Start: "20:00", End: "06:00", Location: "UTC"}},
+		},
+	})
+
+	assert.Equal(t, byte(CodeAccessAccept), f.authenticate(t, f.wlc).Code)
+
+	f.now = time.Date(2026, 10, 14, 23, 30, 0, 0, time.UTC)
+	assert.Equal(t, byte(CodeAccessReject), f.authenticate(t, f.wlc).Code)
+	assert.Equal(t, byte(CodeAccessAccept), f.authenticate(t, f.switch1).Code)
+
+	// After midnight the window still holds from the evening before.
+	f.now = time.Date(2026, 10, 15, 5, 59, 0, 0, time.UTC)
+	assert.Equal(t, byte(CodeAccessReject), f.authenticate(t, f.wlc).Code)
+}
+
+func TestTimeWindow_Days(t *testing.T) {
+	window := TimeWindow{Days: []string{"mon", "Tue"}, Start: "22:00", End: "02:00", Location: "UTC"}
+	// Monday evening, Tuesday morning, Wednesday morning.
+	assert.True(t, window.contains(time.Date(2026, 10, 12, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, window.contains(time.Date(2026, 10, 13, 1, 0, 0, 0, time.UTC)))
+	assert.True(t, window.contains(time.Date(2026, 10, 14, 1, 0, 0, 0, time.UTC)))
+	assert.False(t, window.contains(time.Date(2026, 10, 15, 1, 0, 0, 0, time.UTC)))
+	assert.False(t, window.contains(time.Date(2026, 10, 13, 12, 0, 0, 0, time.UTC)))
+}
+
+func TestPolicyManager_CRUD(t *testing.T) {
+	ctx := context.Background()
+	f := newPolicyFixture(t)
+
+	for _, invalid := range []*Policy{
+		{},
+		{Name: "unknown", Attributes: []ReplyAttribute{{Name: "Aruba-User-Role", Value: "staff"}}},
+		{Name: "protected", Attributes: []ReplyAttribute{{Name: "EAP-Message", Value: "0x03010004"}}},
+		{Name: "bad window", Conditions: PolicyConditions{Times: []TimeWindow{{Start: "9am", End: "17:00"}}}},
+		{Name: "bad day", Conditions: PolicyConditions{Times: []TimeWindow{{Days: []string{"someday"}, Start: "09:00", End: "17:00"}}}},
+	} {
+		err := f.manager.CreatePolicy(ctx, invalid)
+		assert.ErrorIs(t, err, types.ErrValidation, invalid.Name)
+	}
+
+	policy := vlanPolicy("guests", 50, "300")
+	f.create(t, policy)
+	assert.Equal(t, "300", f.authenticate(t, f.switch1).GetString(AttrTunnelPrivateGroupID))
+
+	// Changes take effect at once.
+	policy.Attributes[2].Value = "301"
+	require.NoError(t, f.manager.UpdatePolicy(ctx, policy))
+	assert.Equal(t, "301", f.authenticate(t, f.switch1).GetString(AttrTunnelPrivateGroupID))
+
+	policies, err := f.manager.ListPolicies(ctx)
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	assert.False(t, policies[0].CreatedAt.IsZero())
+
+	require.NoError(t, f.manager.DeletePolicy(ctx, policy.ID))
+	assert.Nil(t, f.authenticate(t, f.switch1).GetAttribute(AttrTunnelPrivateGroupID))
+	_, err = f.manager.GetPolicy(ctx, policy.ID)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+	assert.ErrorIs(t, f.manager.UpdatePolicy(ctx, policy), types.ErrNotFound)
+}
+
+func TestPolicy_AppliesToEAP(t *testing.T) {
+	f := newEAPFixture(t, EAPConfig{Methods: []string{"ttls"}})
+	manager := NewPolicyManager(NewMemoryPolicyRepository(), f.auth.codec)
+	f.auth.SetPolicyManager(manager)
+	require.NoError(t, manager.CreatePolicy(context.Background(), &Policy{
+		Name:       "dot1x vlan",
+		Enabled:    true,
+		Conditions: PolicyConditions{Clients: []string{"switch"}},
+		Attributes: []ReplyAttribute{{Name: "Tunnel-Private-Group-Id", Value: "42"}},
+	}))
+
+	s := f.supplicant(t, EAPTypeTTLS, ttlsClient("alice", "secret"))
+	response := s.run(1000)
+	s.assertAccepted(response)
+	assert.Equal(t, "42", response.GetString(AttrTunnelPrivateGroupID))
+
+	require.NoError(t, manager.CreatePolicy(context.Background(), &Policy{Name: "closed", Enabled: true, Deny: true}))
+	s = f.supplicant(t, EAPTypeTTLS, ttlsClient("alice", "secret"))
+	s.assertRejected(s.run(1000))
+}
@@ -1,155 +1,692 @@
 package radius
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultRealm is the name of the realm of the users whose realm is not
+// configured, or who have none.
+const DefaultRealm = "DEFAULT"
+
+const (
+	defaultProxyTimeout   = 3 * time.Second
+	defaultStatusInterval = 10 * time.Second
 )
 
+// ErrNoResponse is returned when a server or NAS does not answer a request,
+// retransmissions included.
+var ErrNoResponse = errors.New("no response")
+
+// ProxyConfig configures the proxying of requests to upstream RADIUS
+// servers, by the realm of the user.
 type ProxyConfig struct {
-	Enabled         bool
-	UpstreamServers []UpstreamServer
-	RetryCount      int
-	Timeout         time.Duration
+	Pools  []PoolConfig
+	Realms []RealmConfig
+	// RetryCount is how many times a request is retransmitted to a server
+	// that does not answer, before failing over to the next one.
+	RetryCount int
+	// Timeout is how long a response is waited for, 3s by default.
+	Timeout time.Duration
+	// StatusInterval is how often dead servers are probed with
+	// Status-Server, 10s by default.
+	StatusInterval time.Duration
+}
+
+// PoolConfig configures a pool of upstream servers, which share the
+// requests of its realms by weight.
+type PoolConfig struct {
+	Name    string
+	Servers []UpstreamServer
 }
 
 type UpstreamServer struct {
+	// Address is the authentication address of the server, port 1812 by
+	// default.
 	Address string
-	Secret  string
-	Weight  int
+	// AcctAddress is the accounting address of the server, by default the
+	// port after the authentication port.
+	AcctAddress string
+	Secret      string
+	// Weight is the share of the requests of the pool the server gets,
+	// 1 by default.
+	Weight int
 }
 
+// RealmConfig routes the users of a realm, named user@realm or
+// realm\user, to a pool. The realm DefaultRealm routes the users of the
+// realms that are not configured.
+type RealmConfig struct {
+	Name string
+	Pool string
+	// StripRealm removes the realm from the User-Name sent upstream.
+	StripRealm bool
+}
+
+// Proxy forwards the Access-Requests and Accounting-Requests of the users
+// of configured realms to pools of upstream servers. Servers that do not
+// answer are marked dead until they answer a Status-Server probe
+// (RFC 5997).
 type Proxy struct {
-	config ProxyConfig
-	conns  map[string]*net.UDPConn
-	mu     sync.Mutex
+	config       ProxyConfig
+	pools        []*pool
+	realms       map[string]*realm
+	defaultRealm *realm
+	codec        *AttributeCodec
+	state        uint32
+	logger       *zap.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
 }
 
-func NewProxy(config ProxyConfig) *Proxy {
-	return &Proxy{
+type realm struct {
+	pool  *pool
+	strip bool
+}
+
+func NewProxy(config ProxyConfig, logger *zap.Logger) (*Proxy, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultProxyTimeout
+	}
+	if config.StatusInterval <= 0 {
+		config.StatusInterval = defaultStatusInterval
+	}
+	p := &Proxy{
 		config: config,
-		conns:  make(map[string]*net.UDPConn),
+		realms: make(map[string]*realm),
+		codec:  NewAttributeCodec(),
+		logger: logger,
 	}
+
+	pools := make(map[string]*pool)
+	for _, pc := range config.Pools {
+		if pc.Name == "" || pools[pc.Name] != nil {
+			return nil, fmt.Errorf("RADIUS proxy pool name %q is empty or not unique", pc.Name)
+		}
+		if len(pc.Servers) == 0 {
+			return nil, fmt.Errorf("RADIUS proxy pool %s has no servers", pc.Name)
+		}
+		pl := &pool{name: pc.Name}
+		for _, sc := range pc.Servers {
+			server, err := newUpstream(pl, sc)
+			if err != nil {
+				return nil, fmt.Errorf("RADIUS proxy pool %s: %w", pc.Name, err)
+			}
+			pl.servers = append(pl.servers, server)
+		}
+		pools[pc.Name] = pl
+		p.pools = append(p.pools, pl)
+	}
+
+	for _, rc := range config.Realms {
+		pl := pools[rc.Pool]
+		if pl == nil {
+			return nil, fmt.Errorf("RADIUS proxy realm %s has unknown pool %q", rc.Name, rc.Pool)
+		}
+		r := &realm{pool: pl, strip: rc.StripRealm}
+		if rc.Name == DefaultRealm {
+			if p.defaultRealm != nil {
+				return nil, fmt.Errorf("RADIUS proxy realm %s is configured twice", rc.Name)
+			}
+			p.defaultRealm = r
+			continue
+		}
+		key := strings.ToLower(rc.Name)
+		if key == "" || p.realms[key] != nil {
+			return nil, fmt.Errorf("RADIUS proxy realm name %q is empty or not unique", rc.Name)
+		}
+		p.realms[key] = r
+	}
+	return p, nil
 }
 
-func (p *Proxy) Forward(ctx context.Context, request *Packet, client *RADIUSClient) (*Packet, error) {
-	if !p.config.Enabled || len(p.config.UpstreamServers) == 0 {
-		return nil, fmt.Errorf("proxy not enabled or no upstream servers")
+// Start probes the dead servers until Stop is called.
+func (p *Proxy) Start() {
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go p.probeLoop()
+}
+
+// Stop stops the probes and closes the connections to the servers.
+func (p *Proxy) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+		p.wg.Wait()
+		p.stop = nil
 	}
+	for _, pl := range p.pools {
+		for _, server := range pl.servers {
+			server.close()
+		}
+	}
+}
 
-	// Simple round-robin or first available selection
-	// Real world: use weights, health checks.
-	upstream := p.config.UpstreamServers[0]
+// ShouldProxy reports whether the realm of the user of a request is served
+// by upstream servers.
+func (p *Proxy) ShouldProxy(request *Packet) bool {
+	_, _, ok := p.route(request)
+	return ok
+}
 
-	// Connect if not connected
-	conn, err := p.getConn(upstream.Address)
-	if err != nil {
-		return nil, err
+// Forward sends a request to a server of the pool of the user's realm and
+// returns the reply for the client, to be signed with the client's secret.
+// Servers that do not answer are marked dead and the next one of the pool
+// is tried. When all servers are dead, they are tried all the same.
+func (p *Proxy) Forward(ctx context.Context, request *Packet, client *RADIUSClient) (*Packet, error) {
+	r, userName, ok := p.route(request)
+	if !ok {
+		return nil, fmt.Errorf("realm of user %q is not proxied", request.GetString(AttrUserName))
+	}
+	// The authenticator is replaced upstream, so it must be checked here.
+	if request.Code == CodeAccountingRequest && request.Authenticator != request.CalculateResponseAuthenticator([16]byte{}) {
+		return nil, fmt.Errorf("invalid Accounting-Request authenticator")
 	}
 
-	// Re-encode packet with upstream secret?
-	// Actually RADIUS proxying involves re-calculating authenticator or attributes?
-	// RFC 2865: "The proxy server... MUST replace the Request Authenticator... with a new random one."
-	// We need to re-package the request.
+	state := make([]byte, 4)
+	binary.BigEndian.PutUint32(state, atomic.AddUint32(&p.state, 1))
+	includeDead := !r.pool.anyAlive()
+	tried := make(map[*upstream]bool)
+	for {
+		server := r.pool.next(tried, includeDead)
+		if server == nil {
+			ProxyRequestsTotal.WithLabelValues(r.pool.name, "failed").Inc()
+			return nil, fmt.Errorf("no server of RADIUS proxy pool %s answered", r.pool.name)
+		}
+		if len(tried) > 0 {
+			ProxyFailoversTotal.WithLabelValues(r.pool.name).Inc()
+		}
+		tried[server] = true
 
-	// 1. Create new request based on original
-	// But actually we might just forward bytes if we act as transparent proxy,
-	// but we must update Authenticator/Secret relationship.
-	// Since `Packet` struct has the decoded attributes, we can just re-encode with new Secret.
+		upstreamRequest := p.upstreamRequest(request, server, userName, state)
+		response, err := p.exchange(ctx, server, upstreamRequest, p.config.RetryCount)
+		if err == nil {
+			server.setAlive(true, p.logger)
+			ProxyRequestsTotal.WithLabelValues(r.pool.name, "forwarded").Inc()
+			return p.reply(response, upstreamRequest, request, state)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		p.logger.Warn("upstream RADIUS server failed", zap.String("pool", r.pool.name),
+			zap.String("server", server.address), zap.Error(err))
+		server.setAlive(false, p.logger)
+	}
+}
 
-	proxyPacket := &Packet{
-		Code:       request.Code,
-		Identifier: request.Identifier, // Use same ID or map IDs? If same ID, we might have collisions if multiple clients map to same upstream.
-		// Usually proxies manage a map of (UpstreamID) -> (ClientAddr, ClientID)
-		Attributes: make([]Attribute, len(request.Attributes)),
-		Secret:     []byte(upstream.Secret),
+// route returns the realm of the user of a request and the User-Name to
+// send upstream.
+func (p *Proxy) route(request *Packet) (*realm, string, bool) {
+	name := request.GetString(AttrUserName)
+	realmName, user := splitRealm(name)
+	r := p.realms[strings.ToLower(realmName)]
+	if realmName == "" || r == nil {
+		r = p.defaultRealm
+	}
+	if r == nil {
+		return nil, "", false
+	}
+	if r.strip {
+		return r, user, true
 	}
-	copy(proxyPacket.Attributes, request.Attributes)
+	return r, name, true
+}
 
-	// Add Proxy-State?
+// splitRealm splits a user name of the form user@realm or realm\user into
+// its realm and the name without it.
+func splitRealm(name string) (realm, user string) {
+	if i := strings.LastIndexByte(name, '@'); i >= 0 {
+		return name[i+1:], name[:i]
+	}
+	if i := strings.IndexByte(name, '\\'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
 
-	// Generate new Authenticator for the upstream leg
-	// copy(proxyPacket.Authenticator[:], generateRandomAuth())
-	// For simplicity, let's keep original for now (though RFC says change it).
-	proxyPacket.Authenticator = request.Authenticator
+// upstreamRequest returns a copy of a request for a server. Access-Requests
+// get a new authenticator (RFC 2865, section 2.3), under which the
+// User-Password is encrypted again, and a Proxy-State is appended so the
+// reply can be matched to the request.
+func (p *Proxy) upstreamRequest(request *Packet, server *upstream, userName string, state []byte) *Packet {
+	out := &Packet{Code: request.Code, Secret: server.secret}
+	if request.Code == CodeAccessRequest {
+		_, _ = rand.Read(out.Authenticator[:])
+	}
+	for _, attr := range request.Attributes {
+		value := attr.Value
+		switch attr.Type {
+		case AttrUserName:
+			value = []byte(userName)
+		case AttrUserPassword:
+			password := p.codec.DecodePassword(attr.Value, request.Authenticator, request.Secret)
+			value = p.codec.EncodePassword(password, out.Authenticator, server.secret)
+		}
+		out.AddAttribute(attr.Type, value)
+	}
+	// Without a CHAP-Challenge, the request authenticator is the challenge.
+	if request.GetAttribute(AttrCHAPPassword) != nil && request.GetAttribute(AttrCHAPChallenge) == nil {
+		out.AddAttribute(AttrCHAPChallenge, append([]byte(nil), request.Authenticator[:]...))
+	}
+	out.AddAttribute(AttrProxyState, state)
+	return out
+}
 
-	// Encode
-	data, err := proxyPacket.Encode()
-	if err != nil {
-		return nil, err
+// reply turns the response of a server to sent into the reply to the
+// client's request: the Proxy-State added by the proxy is removed, and
+// the attributes encrypted with the server's secret are encrypted with the
+// client's.
+func (p *Proxy) reply(response, sent, request *Packet, state []byte) (*Packet, error) {
+	last := -1
+	for i, attr := range response.Attributes {
+		if attr.Type == AttrProxyState {
+			last = i
+		}
+	}
+	if last < 0 || !bytes.Equal(response.Attributes[last].Value, state) {
+		return nil, fmt.Errorf("upstream response does not carry the Proxy-State of the request")
 	}
 
-	// Send
-	conn.SetWriteDeadline(time.Now().Add(p.config.Timeout))
-	if _, err := conn.Write(data); err != nil {
-		return nil, err
+	reply := &Packet{Code: response.Code, Identifier: request.Identifier, Secret: request.Secret}
+	for i, attr := range response.Attributes {
+		if i == last {
+			continue
+		}
+		value := attr.Value
+		switch attr.Type {
+		case AttrTunnelPassword:
+			// A tag precedes the salt.
+			if len(value) > 1 {
+				value = append([]byte{value[0]}, resalt(value[1:], sent, request)...)
+			}
+		case AttrVendorSpecific:
+			vendor, vendorType, vsa, err := p.codec.DecodeVendorSpecific(value)
+			if err == nil && vendor == VendorMicrosoft && (vendorType == MSMPPESendKey || vendorType == MSMPPERecvKey) {
+				value = p.codec.EncodeVendorSpecific(vendor, vendorType, resalt(vsa, sent, request))
+			}
+		}
+		reply.AddAttribute(attr.Type, value)
 	}
+	return reply, nil
+}
 
-	// Wait for response
-	// This is synchronous and blocks the worker.
-	// In high performance proxy, this is async with ID mapping.
-	// For P6, synchronous simple forwarding.
-	respBuf := make([]byte, 4096)
-	conn.SetReadDeadline(time.Now().Add(p.config.Timeout))
-	n, _, err := conn.ReadFromUDP(respBuf)
-	if err != nil {
-		return nil, err
+// resalt re-encrypts a salt-encrypted value (RFC 2868, section 3.5) of a
+// response to the upstream request from into one of a reply to request to.
+func resalt(value []byte, from, to *Packet) []byte {
+	if len(value) < 2+md5.Size || (len(value)-2)%md5.Size != 0 {
+		return value
+	}
+	salt := value[:2]
+	result := append([]byte(nil), salt...)
+	prevFrom := append(append([]byte(nil), from.Authenticator[:]...), salt...)
+	prevTo := append(append([]byte(nil), to.Authenticator[:]...), salt...)
+	for i := 2; i < len(value); i += md5.Size {
+		cipher := value[i : i+md5.Size]
+		h := md5.New()
+		h.Write(from.Secret)
+		h.Write(prevFrom)
+		fromKey := h.Sum(nil)
+		h = md5.New()
+		h.Write(to.Secret)
+		h.Write(prevTo)
+		toKey := h.Sum(nil)
+
+		block := make([]byte, md5.Size)
+		for j := range block {
+			block[j] = cipher[j] ^ fromKey[j] ^ toKey[j]
+		}
+		result = append(result, block...)
+		prevFrom, prevTo = cipher, block
 	}
+	return result
+}
 
-	// Parse response with upstream secret
-	respPacket, err := ParsePacket(respBuf[:n], []byte(upstream.Secret))
+// exchange sends a request to the authentication or accounting address of
+// a server and returns its response.
+func (p *Proxy) exchange(ctx context.Context, server *upstream, request *Packet, retries int) (*Packet, error) {
+	conn, err := server.conn(request.Code == CodeAccountingRequest)
 	if err != nil {
 		return nil, err
 	}
+	return conn.exchange(ctx, request, p.config.Timeout, retries)
+}
 
-	// We need to return this packet to the client.
-	// We must switch secret back to Client Secret?
-	// The `server.go` will handle encoding the returned packet using `client.Secret`.
-	// So we just return the parsed packet structure.
-	// But `server.go` expects `respPacket` to be constructed such that `Encode` uses `respPacket.Secret`.
-	// So we should set `respPacket.Secret` to `client.Secret` before returning?
-	// Or `server.go` handles it?
-	// `server.go` calls `response.Encode()`. `response.Secret` is used.
-	// So yes, we must swap the secret to the Client's secret so the client can verify it.
+func (p *Proxy) probeLoop() {
+	defer p.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	respPacket.Secret = []byte(client.Secret)
+	ticker := time.NewTicker(p.config.StatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.probe(ctx)
+		}
+	}
+}
 
-	// Also, if we changed the Request Authenticator, we need to ensure the Response Authenticator calculation is correct for the Client.
-	// ResponseAuth = MD5(Code+ID+Length+RequestAuth+Attributes+Secret)
-	// The `respPacket` from upstream has Auth valid for UpstreamSecret + UpstreamRequestAuth.
-	// We need to recalculate it for ClientSecret + ClientRequestAuth.
-	// Fortunately, `server.go` usually recalculates auth before sending?
-	// Let's check `server.go` (to be written).
-	// Ideally `server.go` logic:
-	//   response = handler.Handle()
-	//   response.Authenticator = response.CalculateResponseAuthenticator(request.Authenticator)
-	//   conn.Write(response.Encode())
+// probe sends a Status-Server request (RFC 5997) to each dead server, and
+// marks those that answer alive.
+func (p *Proxy) probe(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, pl := range p.pools {
+		for _, server := range pl.servers {
+			if server.isAlive() {
+				continue
+			}
+			wg.Add(1)
+			go func(server *upstream) {
+				defer wg.Done()
+				request := &Packet{Code: CodeStatusServer, Secret: server.secret}
+				_, _ = rand.Read(request.Authenticator[:])
+				request.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+				if _, err := p.exchange(ctx, server, request, 0); err == nil {
+					server.setAlive(true, p.logger)
+				}
+			}(server)
+		}
+	}
+	wg.Wait()
+}
 
-	// If `server.go` does that, then we are good.
+// pool is a set of servers sharing requests by smooth weighted round-robin.
+type pool struct {
+	name    string
+	servers []*upstream
+	mu      sync.Mutex
+}
 
-	return respPacket, nil
+// next picks the server for a request among the live servers not tried
+// yet, or among all the servers not tried yet with includeDead.
+func (p *pool) next(tried map[*upstream]bool, includeDead bool) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *upstream
+	total := 0
+	for _, s := range p.servers {
+		if tried[s] || (!s.alive && !includeDead) {
+			continue
+		}
+		s.current += s.weight
+		total += s.weight
+		if best == nil || s.current > best.current {
+			best = s
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
 }
 
-func (p *Proxy) getConn(address string) (*net.UDPConn, error) {
+func (p *pool) anyAlive() bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	for _, s := range p.servers {
+		if s.alive {
+			return true
+		}
+	}
+	return false
+}
+
+// upstream is a server of a pool.
+type upstream struct {
+	pool        *pool
+	address     string
+	acctAddress string
+	secret      []byte
+	weight      int
+
+	// current and alive are guarded by the pool's mutex.
+	current int
+	alive   bool
+
+	mu   sync.Mutex
+	auth *upstreamConn
+	acct *upstreamConn
+}
+
+func newUpstream(pl *pool, config UpstreamServer) (*upstream, error) {
+	if config.Secret == "" {
+		return nil, fmt.Errorf("server %s has no secret", config.Address)
+	}
+	host, port, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		host, port = config.Address, "1812"
+	}
+	authPort, err := strconv.Atoi(port)
+	if host == "" || err != nil {
+		return nil, fmt.Errorf("invalid server address %q", config.Address)
+	}
+	s := &upstream{
+		pool:        pl,
+		address:     net.JoinHostPort(host, port),
+		acctAddress: config.AcctAddress,
+		secret:      []byte(config.Secret),
+		weight:      config.Weight,
+		alive:       true,
+	}
+	if s.acctAddress == "" {
+		s.acctAddress = net.JoinHostPort(host, strconv.Itoa(authPort+1))
+	}
+	if s.weight <= 0 {
+		s.weight = 1
+	}
+	ProxyServerUp.WithLabelValues(pl.name, s.address).Set(1)
+	return s, nil
+}
+
+func (s *upstream) isAlive() bool {
+	s.pool.mu.Lock()
+	defer s.pool.mu.Unlock()
+	return s.alive
+}
 
-	if conn, ok := p.conns[address]; ok {
-		return conn, nil
+func (s *upstream) setAlive(alive bool, logger *zap.Logger) {
+	s.pool.mu.Lock()
+	changed := s.alive != alive
+	s.alive = alive
+	s.pool.mu.Unlock()
+	if !changed {
+		return
 	}
+	if alive {
+		ProxyServerUp.WithLabelValues(s.pool.name, s.address).Set(1)
+		logger.Info("upstream RADIUS server is alive", zap.String("pool", s.pool.name), zap.String("server", s.address))
+	} else {
+		ProxyServerUp.WithLabelValues(s.pool.name, s.address).Set(0)
+		logger.Warn("upstream RADIUS server is dead", zap.String("pool", s.pool.name), zap.String("server", s.address))
+	}
+}
 
+// conn returns the connection to the accounting or authentication address
+// of the server, opening it on first use.
+func (s *upstream) conn(accounting bool) (*upstreamConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, address := &s.auth, s.address
+	if accounting {
+		c, address = &s.acct, s.acctAddress
+	}
+	if *c == nil {
+		conn, err := dialUpstream(address, s.secret)
+		if err != nil {
+			return nil, err
+		}
+		*c = conn
+	}
+	return *c, nil
+}
+
+func (s *upstream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range []**upstreamConn{&s.auth, &s.acct} {
+		if *c != nil {
+			(*c).conn.Close()
+			*c = nil
+		}
+	}
+}
+
+// upstreamConn is a UDP socket to a server address, shared by concurrent
+// requests, which get distinct identifiers.
+type upstreamConn struct {
+	conn    *net.UDPConn
+	secret  []byte
+	mu      sync.Mutex
+	next    byte
+	pending map[byte]chan []byte
+	// done is closed when the socket is.
+	done chan struct{}
+}
+
+func dialUpstream(address string, secret []byte) (*upstreamConn, error) {
 	raddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		return nil, err
 	}
-
 	conn, err := net.DialUDP("udp", nil, raddr)
 	if err != nil {
 		return nil, err
 	}
+	c := &upstreamConn{conn: conn, secret: secret, pending: make(map[byte]chan []byte), done: make(chan struct{})}
+	go c.read()
+	return c, nil
+}
+
+// read passes the responses to the requests waiting for them, until the
+// socket is closed.
+func (c *upstreamConn) read() {
+	defer close(c.done)
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// An ICMP error from a server that is down.
+			continue
+		}
+		if n < HeaderSize {
+			continue
+		}
+		c.mu.Lock()
+		ch := c.pending[buf[1]]
+		c.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+		}
+	}
+}
+
+// exchange sends a request with a free identifier, signed with the
+// server's secret, and waits for its response, retransmitting the request
+// after each timeout. Responses that fail verification are ignored.
+func (c *upstreamConn) exchange(ctx context.Context, request *Packet, timeout time.Duration, retries int) (*Packet, error) {
+	id, ch, err := c.reserve()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(id)
+
+	request.Identifier = id
+	if request.Code == CodeAccessRequest || request.Code == CodeStatusServer {
+		request.SignMessageAuthenticator(request.Authenticator)
+	} else {
+		// The Message-Authenticator and authenticator of Accounting-Requests
+		// and dynamic authorization requests are computed over a zero
+		// authenticator.
+		request.SignMessageAuthenticator([16]byte{})
+		request.Authenticator = request.CalculateResponseAuthenticator([16]byte{})
+	}
+	data, err := request.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if _, err := c.conn.Write(data); err != nil {
+			return nil, err
+		}
+		response, err := c.await(ctx, ch, request.Authenticator, timeout)
+		if err != ErrNoResponse {
+			return response, err
+		}
+	}
+	return nil, ErrNoResponse
+}
+
+func (c *upstreamConn) await(ctx context.Context, ch chan []byte, requestAuth [16]byte, timeout time.Duration) (*Packet, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, ErrNoResponse
+		case <-c.done:
+			return nil, net.ErrClosed
+		case data := <-ch:
+			response, err := ParsePacket(data, c.secret)
+			if err != nil || response.Authenticator != response.CalculateResponseAuthenticator(requestAuth) {
+				continue
+			}
+			if response.GetAttribute(AttrMessageAuthenticator) != nil && !response.VerifyMessageAuthenticator(requestAuth) {
+				continue
+			}
+			return response, nil
+		}
+	}
+}
+
+// reserve returns a free identifier and the channel of its responses.
+func (c *upstreamConn) reserve() (byte, chan []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < 256; i++ {
+		id := c.next
+		c.next++
+		if c.pending[id] == nil {
+			ch := make(chan []byte, 1)
+			c.pending[id] = ch
+			return id, ch, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("no free identifier for %s", c.conn.RemoteAddr())
+}
 
-	p.conns[address] = conn
-	return conn, nil
+func (c *upstreamConn) release(id byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
 }
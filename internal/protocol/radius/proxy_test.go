@@ -0,0 +1,276 @@
+package radius
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeUpstream is an upstream server that accepts all Access-Requests,
+// with its address as Reply-Message, and acknowledges Accounting-Requests
+// and Status-Server probes, on one address.
+type fakeUpstream struct {
+	conn   *net.UDPConn
+	secret []byte
+	silent atomic.Bool
+
+	mu       sync.Mutex
+	requests []*Packet
+}
+
+func newFakeUpstream(t *testing.T, secret string) *fakeUpstream {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	u := &fakeUpstream{conn: conn, secret: []byte(secret)}
+	t.Cleanup(func() { conn.Close() })
+	go u.serve()
+	return u
+}
+
+func (u *fakeUpstream) addr() string {
+	return u.conn.LocalAddr().String()
+}
+
+func (u *fakeUpstream) server(weight int) UpstreamServer {
+	return UpstreamServer{Address: u.addr(), AcctAddress: u.addr(), Secret: string(u.secret), Weight: weight}
+}
+
+func (u *fakeUpstream) received() []*Packet {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]*Packet(nil), u.requests...)
+}
+
+func (u *fakeUpstream) serve() {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request, err := ParsePacket(buf[:n], u.secret)
+		if err != nil || u.silent.Load() {
+			continue
+		}
+		u.mu.Lock()
+		u.requests = append(u.requests, request)
+		u.mu.Unlock()
+
+		var response *Packet
+		switch request.Code {
+		case CodeAccessRequest:
+			response = request.CreateResponse(CodeAccessAccept)
+			response.AddAttribute(AttrReplyMessage, []byte(u.addr()))
+		case CodeAccountingRequest:
+			response = request.CreateResponse(CodeAccountingResponse)
+		case CodeStatusServer:
+			response = request.CreateResponse(CodeAccessAccept)
+		default:
+			continue
+		}
+		for _, attr := range request.Attributes {
+			if attr.Type == AttrProxyState {
+				response.AddAttribute(AttrProxyState, attr.Value)
+			}
+		}
+		response.Authenticator = response.CalculateResponseAuthenticator(request.Authenticator)
+		data, _ := response.Encode()
+		u.conn.WriteToUDP(data, addr)
+	}
+}
+
+func newTestProxy(t *testing.T, pools []PoolConfig, realms []RealmConfig) *Proxy {
+	proxy, err := NewProxy(ProxyConfig{Pools: pools, Realms: realms, Timeout: 200 * time.Millisecond, StatusInterval: time.Hour}, zap.NewNop())
+	require.NoError(t, err)
+	return proxy
+}
+
+func TestSplitRealm(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"bob@corp.example":    {"corp.example", "bob"},
+		`CORP\bob`:            {"CORP", "bob"},
+		"bob":                 {"", "bob"},
+		"a@b@corp.example":    {"corp.example", "a@b"},
+		`CORP\bob@eu.example`: {"eu.example", `CORP\bob`},
+	} {
+		realm, user := splitRealm(name)
+		assert.Equal(t, want, [2]string{realm, user}, name)
+	}
+}
+
+func TestProxy_RealmRouting(t *testing.T) {
+	f := newPolicyFixture(t)
+	client := f.switch1
+	clients := NewClientManager(nil)
+	clients.cache["127.0.0.1"] = client
+
+	upstream := newFakeUpstream(t, "upstream-secret")
+	proxy := newTestProxy(t,
+		[]PoolConfig{{Name: "corp", Servers: []UpstreamServer{upstream.server(1)}}},
+		[]RealmConfig{{Name: "corp.example", Pool: "corp", StripRealm: true}, {Name: "PARTNER", Pool: "corp"}})
+	server := NewServer(f.auth, nil, clients, proxy, ServerConfig{WorkerCount: 2}, zap.NewNop())
+	ctx := context.Background()
+	require.NoError(t, server.Start(ctx))
+	t.Cleanup(func() { require.NoError(t, server.Stop(ctx)) })
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: server.authConn.LocalAddr().(*net.UDPAddr).Port})
+	require.NoError(t, err)
+	defer conn.Close()
+	exchange := func(request *Packet) *Packet {
+		data, err := request.Encode()
+		require.NoError(t, err)
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+		buf := make([]byte, MaxPacketSize)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		response, err := ParsePacket(buf[:n], []byte(client.Secret))
+		require.NoError(t, err)
+		assert.Equal(t, response.CalculateResponseAuthenticator(request.Authenticator), response.Authenticator)
+		return response
+	}
+	request := func(userName string) *Packet {
+		request := f.papRequest(client, "secret")
+		request.Attributes[0].Value = []byte(userName)
+		request.Attributes[0].Length = byte(2 + len(userName))
+		request.AddAttribute(AttrProxyState, []byte("nas-state"))
+		return request
+	}
+
+	// Users without a configured realm are authenticated locally.
+	response := exchange(request("alice"))
+	assert.Equal(t, byte(CodeAccessAccept), response.Code)
+	assert.Empty(t, upstream.received())
+
+	// The realm is stripped, the password encrypted for the upstream under a
+	// new authenticator, and only the NAS's Proxy-State comes back.
+	nasRequest := request("bob@Corp.Example")
+	response = exchange(nasRequest)
+	assert.Equal(t, byte(CodeAccessAccept), response.Code)
+	assert.Equal(t, upstream.addr(), response.GetString(AttrReplyMessage))
+	var states []string
+	for _, attr := range response.Attributes {
+		if attr.Type == AttrProxyState {
+			states = append(states, string(attr.Value))
+		}
+	}
+	assert.Equal(t, []string{"nas-state"}, states)
+
+	received := upstream.received()
+	require.Len(t, received, 1)
+	forwarded := received[0]
+	assert.Equal(t, "bob", forwarded.GetString(AttrUserName))
+	assert.NotEqual(t, nasRequest.Authenticator, forwarded.Authenticator)
+	assert.Equal(t, "secret", f.auth.codec.DecodePassword(forwarded.GetAttribute(AttrUserPassword).Value, forwarded.Authenticator, upstream.secret))
+	var forwardedStates int
+	for _, attr := range forwarded.Attributes {
+		if attr.Type == AttrProxyState {
+			forwardedStates++
+		}
+	}
+	assert.Equal(t, 2, forwardedStates)
+
+	// Prefix realms are matched, and kept without stripping.
+	exchange(request(`partner\carol`))
+	received = upstream.received()
+	require.Len(t, received, 2)
+	assert.Equal(t, `partner\carol`, received[1].GetString(AttrUserName))
+}
+
+func TestProxy_WeightedRoundRobinAndFailover(t *testing.T) {
+	a := newFakeUpstream(t, "secret-a")
+	b := newFakeUpstream(t, "secret-b")
+	proxy := newTestProxy(t,
+		[]PoolConfig{{Name: "weighted", Servers: []UpstreamServer{a.server(3), b.server(1)}}},
+		[]RealmConfig{{Name: DefaultRealm, Pool: "weighted"}})
+	t.Cleanup(proxy.Stop)
+	client := &RADIUSClient{Secret: "testing123"}
+	ctx := context.Background()
+	forward := func() *Packet {
+		request := &Packet{Code: CodeAccessRequest, Secret: []byte(client.Secret)}
+		_, _ = rand.Read(request.Authenticator[:])
+		request.AddAttribute(AttrUserName, []byte("bob"))
+		response, err := proxy.Forward(ctx, request, client)
+		require.NoError(t, err)
+		return response
+	}
+
+	for i := 0; i < 8; i++ {
+		forward()
+	}
+	assert.Len(t, a.received(), 6)
+	assert.Len(t, b.received(), 2)
+
+	// A server that does not answer is marked dead and the request fails over.
+	failovers := testutil.ToFloat64(ProxyFailoversTotal.WithLabelValues("weighted"))
+	a.silent.Store(true)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, b.addr(), forward().GetString(AttrReplyMessage))
+	}
+	assert.Equal(t, failovers+1, testutil.ToFloat64(ProxyFailoversTotal.WithLabelValues("weighted")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(ProxyServerUp.WithLabelValues("weighted", a.addr())))
+
+	// A dead server comes back once it answers a Status-Server probe.
+	proxy.probe(ctx)
+	assert.Equal(t, float64(0), testutil.ToFloat64(ProxyServerUp.WithLabelValues("weighted", a.addr())))
+	a.silent.Store(false)
+	proxy.probe(ctx)
+	assert.Equal(t, float64(1), testutil.ToFloat64(ProxyServerUp.WithLabelValues("weighted", a.addr())))
+	received := a.received()
+	assert.Equal(t, byte(CodeStatusServer), received[len(received)-1].Code)
+	assert.Equal(t, a.addr(), forward().GetString(AttrReplyMessage))
+}
+
+func TestProxy_Accounting(t *testing.T) {
+	upstream := newFakeUpstream(t, "upstream-secret")
+	proxy := newTestProxy(t,
+		[]PoolConfig{{Name: "corp", Servers: []UpstreamServer{upstream.server(1)}}},
+		[]RealmConfig{{Name: "corp.example", Pool: "corp"}})
+	t.Cleanup(proxy.Stop)
+	client := &RADIUSClient{Secret: "testing123"}
+
+	request := &Packet{Code: CodeAccountingRequest, Identifier: 7, Secret: []byte(client.Secret)}
+	request.AddAttribute(AttrUserName, []byte("bob@corp.example"))
+	request.AddAttribute(AttrAcctStatusType, []byte{0, 0, 0, AcctStatusStart})
+	request.AddAttribute(AttrAcctSessionId, []byte("session-1"))
+	request.Authenticator = request.CalculateResponseAuthenticator([16]byte{})
+
+	response, err := proxy.Forward(context.Background(), request, client)
+	require.NoError(t, err)
+	assert.Equal(t, byte(CodeAccountingResponse), response.Code)
+	assert.Equal(t, byte(7), response.Identifier)
+	assert.Nil(t, response.GetAttribute(AttrProxyState))
+
+	received := upstream.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, received[0].CalculateResponseAuthenticator([16]byte{}), received[0].Authenticator)
+	assert.Equal(t, "session-1", received[0].GetString(AttrAcctSessionId))
+
+	// Requests with a wrong authenticator are not forwarded.
+	request.Authenticator[0] ^= 1
+	_, err = proxy.Forward(context.Background(), request, client)
+	assert.Error(t, err)
+	assert.Len(t, upstream.received(), 1)
+}
+
+func TestResalt(t *testing.T) {
+	from := &Packet{Secret: []byte("upstream-secret")}
+	to := &Packet{Secret: []byte("testing123")}
+	_, _ = rand.Read(from.Authenticator[:])
+	_, _ = rand.Read(to.Authenticator[:])
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+
+	value := resalt(encodeMPPEKey(key, from.Secret, from.Authenticator), from, to)
+	assert.Equal(t, key, decodeMPPEKey(value, to.Secret, to.Authenticator))
+}
@@ -2,6 +2,7 @@ package radius
 
 import (
 	"context"
+	"crypto/md5"
 	"fmt"
 	"net"
 	"sync"
@@ -79,6 +80,10 @@ func (s *Server) Start(ctx context.Context) error {
 		go s.acctWorker(ctx, i)
 	}
 
+	if s.proxy != nil {
+		s.proxy.Start()
+	}
+
 	s.logger.Info("RADIUS server started",
 		zap.Int("auth_port", s.config.AuthPort),
 		zap.Int("acct_port", s.config.AcctPort))
@@ -93,6 +98,9 @@ func (s *Server) Stop(ctx context.Context) error {
 	if s.acctConn != nil {
 		s.acctConn.Close()
 	}
+	if s.proxy != nil {
+		s.proxy.Stop()
+	}
 
 	done := make(chan struct{})
 	go func() {
@@ -187,28 +195,44 @@ func (s *Server) handleAuthRequest(ctx context.Context, data []byte, addr *net.U
 	client, err := s.clientManager.GetByIP(ctx, addr.IP.String())
 	if err != nil || client == nil {
 		s.logger.Warn("unknown NAS client", zap.String("ip", addr.IP.String()))
+		DroppedPacketsTotal.WithLabelValues("unknown_client").Inc()
 		return
 	}
 
 	packet, err := ParsePacket(data, []byte(client.Secret))
 	if err != nil {
 		s.logger.Error("packet parse error", zap.Error(err))
+		DroppedPacketsTotal.WithLabelValues("malformed").Inc()
 		return
 	}
 
-	// Should check Message-Authenticator here if required?
-	// RFC 3579 requires Message-Authenticator for EAP. We aren't doing EAP yet.
-
+	if packet.Code == CodeStatusServer {
+		s.handleStatusServer(s.authConn, packet, addr, CodeAccessAccept)
+		return
+	}
 	if packet.Code != CodeAccessRequest {
 		return
 	}
 
-	var response *Packet
-
-	// Proxy check
-	// if s.proxy != nil && s.proxy.ShouldProxy(packet) { ... }
+	// A request with an invalid Message-Authenticator is silently discarded
+	// (RFC 3579, section 3.2). EAP requests must carry one.
+	if packet.GetAttribute(AttrMessageAuthenticator) != nil || packet.GetAttribute(AttrEAPMessage) != nil {
+		if !packet.VerifyMessageAuthenticator(packet.Authenticator) {
+			s.logger.Warn("invalid Message-Authenticator", zap.String("ip", addr.IP.String()))
+			DroppedPacketsTotal.WithLabelValues("invalid_authenticator").Inc()
+			return
+		}
+	}
 
-	if s.authenticator != nil {
+	var response *Packet
+	if s.proxy != nil && s.proxy.ShouldProxy(packet) {
+		response, err = s.proxy.Forward(ctx, packet, client)
+		if err != nil {
+			s.logger.Warn("proxy error", zap.Error(err))
+			DroppedPacketsTotal.WithLabelValues("proxy_failed").Inc()
+			return
+		}
+	} else if s.authenticator != nil {
 		response, err = s.authenticator.Authenticate(ctx, packet, client)
 		if err != nil {
 			s.logger.Error("auth error", zap.Error(err))
@@ -217,8 +241,10 @@ func (s *Server) handleAuthRequest(ctx context.Context, data []byte, addr *net.U
 	} else {
 		response = s.createRejectResponse(packet, "Server not configured")
 	}
+	recordAccessResponse(response.Code)
 
 	// Calculate Response Authenticator
+	response.SignMessageAuthenticator(packet.Authenticator)
 	response.Authenticator = response.CalculateResponseAuthenticator(packet.Authenticator)
 
 	respData, err := response.Encode()
@@ -234,21 +260,34 @@ func (s *Server) handleAcctRequest(ctx context.Context, data []byte, addr *net.U
 	client, err := s.clientManager.GetByIP(ctx, addr.IP.String())
 	if err != nil || client == nil {
 		s.logger.Warn("unknown NAS client", zap.String("ip", addr.IP.String()))
+		DroppedPacketsTotal.WithLabelValues("unknown_client").Inc()
 		return
 	}
 
 	packet, err := ParsePacket(data, []byte(client.Secret))
 	if err != nil {
 		s.logger.Error("packet parse error", zap.Error(err))
+		DroppedPacketsTotal.WithLabelValues("malformed").Inc()
 		return
 	}
 
+	if packet.Code == CodeStatusServer {
+		s.handleStatusServer(s.acctConn, packet, addr, CodeAccountingResponse)
+		return
+	}
 	if packet.Code != CodeAccountingRequest {
 		return
 	}
 
 	var response *Packet
-	if s.accounting != nil {
+	if s.proxy != nil && s.proxy.ShouldProxy(packet) {
+		response, err = s.proxy.Forward(ctx, packet, client)
+		if err != nil {
+			s.logger.Warn("proxy error", zap.Error(err))
+			DroppedPacketsTotal.WithLabelValues("proxy_failed").Inc()
+			return
+		}
+	} else if s.accounting != nil {
 		response, err = s.accounting.Handle(ctx, packet, client, addr)
 		if err != nil {
 			s.logger.Error("accounting error", zap.Error(err))
@@ -257,12 +296,32 @@ func (s *Server) handleAcctRequest(ctx context.Context, data []byte, addr *net.U
 	}
 
 	if response != nil {
+		response.SignMessageAuthenticator(packet.Authenticator)
 		response.Authenticator = response.CalculateResponseAuthenticator(packet.Authenticator)
 		respData, _ := response.Encode()
 		s.acctConn.WriteToUDP(respData, addr)
 	}
 }
 
+// handleStatusServer answers a Status-Server request (RFC 5997), which
+// must carry a valid Message-Authenticator, with a response of code.
+func (s *Server) handleStatusServer(conn *net.UDPConn, request *Packet, addr *net.UDPAddr, code byte) {
+	if !request.VerifyMessageAuthenticator(request.Authenticator) {
+		DroppedPacketsTotal.WithLabelValues("invalid_authenticator").Inc()
+		return
+	}
+	response := request.CreateResponse(code)
+	response.AddAttribute(AttrMessageAuthenticator, make([]byte, md5.Size))
+	response.SignMessageAuthenticator(request.Authenticator)
+	response.Authenticator = response.CalculateResponseAuthenticator(request.Authenticator)
+	respData, err := response.Encode()
+	if err != nil {
+		s.logger.Error("response encode error", zap.Error(err))
+		return
+	}
+	conn.WriteToUDP(respData, addr)
+}
+
 func (s *Server) createRejectResponse(request *Packet, message string) *Packet {
 	response := request.CreateResponse(CodeAccessReject)
 	response.AddAttribute(AttrReplyMessage, []byte(message))
@@ -0,0 +1,56 @@
+package radius
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestServer_AccessRequests(t *testing.T) {
+	f := newPolicyFixture(t)
+	client := f.switch1
+	client.IPAddress = "127.0.0.1"
+	clients := NewClientManager(nil)
+	clients.cache[client.IPAddress] = client
+
+	server := NewServer(f.auth, nil, clients, nil, ServerConfig{WorkerCount: 2}, zap.NewNop())
+	ctx := context.Background()
+	require.NoError(t, server.Start(ctx))
+	t.Cleanup(func() { require.NoError(t, server.Stop(ctx)) })
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: server.authConn.LocalAddr().(*net.UDPAddr).Port})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	exchange := func(password string) *Packet {
+		request := f.papRequest(client, password)
+		data, err := request.Encode()
+		require.NoError(t, err)
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+
+		buf := make([]byte, MaxPacketSize)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		response, err := ParsePacket(buf[:n], []byte(client.Secret))
+		require.NoError(t, err)
+		assert.Equal(t, response.CalculateResponseAuthenticator(request.Authenticator), response.Authenticator)
+		return response
+	}
+
+	accepts := testutil.ToFloat64(AccessResponsesTotal.WithLabelValues("accept"))
+	rejects := testutil.ToFloat64(AccessResponsesTotal.WithLabelValues("reject"))
+
+	assert.Equal(t, byte(CodeAccessAccept), exchange("secret").Code)
+	assert.Equal(t, byte(CodeAccessReject), exchange("wrong").Code)
+
+	assert.Equal(t, accepts+1, testutil.ToFloat64(AccessResponsesTotal.WithLabelValues("accept")))
+	assert.Equal(t, rejects+1, testutil.ToFloat64(AccessResponsesTotal.WithLabelValues("reject")))
+}
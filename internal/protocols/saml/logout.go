@@ -0,0 +1,676 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	goredis "github.com/redis/go-redis/v9"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxLogoutMessageSize bounds how much a deflated logout message may expand to.
+	maxLogoutMessageSize = 1 << 20
+	// logoutStateTTL is how long each service provider has to answer a
+	// propagated LogoutRequest.
+	logoutStateTTL = 10 * time.Minute
+	// statusPartialLogout tells the service provider that started a logout
+	// that not every other service provider confirmed it.
+	statusPartialLogout = "urn:oasis:names:tc:SAML:2.0:status:PartialLogout"
+)
+
+// redirectSignatureHashes are the HTTP-Redirect binding signature algorithms
+// accepted from service providers.
+var redirectSignatureHashes = map[string]crypto.Hash{
+	dsig.RSASHA256SignatureMethod: crypto.SHA256,
+	dsig.RSASHA384SignatureMethod: crypto.SHA384,
+	dsig.RSASHA512SignatureMethod: crypto.SHA512,
+}
+
+// participant is a service provider a session signed in to, with the NameID
+// and session index its assertion carried.
+type participant struct {
+	EntityID     string `json:"entity_id"`
+	NameID       string `json:"name_id"`
+	NameIDFormat string `json:"name_id_format,omitempty"`
+	SessionIndex string `json:"session_index"`
+}
+
+// sessionRef is the IdP session behind a session index.
+type sessionRef struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+}
+
+// logoutState is a logout being propagated to the other service providers of
+// the ended sessions, one front-channel LogoutRequest at a time.
+type logoutState struct {
+	ID string `json:"-"`
+	// EntityID, RequestID and RelayState answer the service provider that
+	// started the logout once the others are done.
+	EntityID   string `json:"entity_id"`
+	RequestID  string `json:"request_id"`
+	RelayState string `json:"relay_state,omitempty"`
+	// PendingEntityID and PendingRequestID are the LogoutRequest awaiting a
+	// LogoutResponse.
+	PendingEntityID  string        `json:"pending_entity_id,omitempty"`
+	PendingRequestID string        `json:"pending_request_id,omitempty"`
+	Remaining        []participant `json:"remaining,omitempty"`
+	Partial          bool          `json:"partial,omitempty"`
+}
+
+// SetLogoutStore sets where the service providers each session signed in to
+// are recorded. With one, a logout at any of them ends the sessions it names
+// and is propagated to the others; without one, Single Logout only ends the
+// session of the browser that sends the LogoutRequest.
+func (s *Service) SetLogoutStore(store redis.RedisClientInterface) {
+	s.store = store
+}
+
+// HandleSLO handles Single Logout with either the HTTP-Redirect or the
+// HTTP-POST binding. A LogoutRequest from a service provider must be signed
+// with the certificate in its configuration. It ends the sessions the request
+// names, or the browser's session, and sends a signed LogoutRequest to every
+// other service provider those sessions signed in to. Their LogoutResponses
+// come back here, and the last one is answered with a signed LogoutResponse
+// at the slo_url of the service provider that started the logout.
+func (s *Service) HandleSLO(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("SAMLResponse") != "" {
+		s.continueLogout(w, r)
+		return
+	}
+	raw, relayState, err := parseLogoutMessage(r, "SAMLRequest")
+	if err != nil {
+		s.logger.Warn(r.Context(), "Invalid SAML LogoutRequest", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var unverified saml.LogoutRequest
+	if err := xml.Unmarshal(raw, &unverified); err != nil || unverified.Issuer == nil || unverified.Issuer.Value == "" {
+		s.logger.Warn(r.Context(), "Invalid SAML LogoutRequest", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	sp, err := s.lookupServiceProvider(r.Context(), unverified.Issuer.Value)
+	if err != nil {
+		s.logger.Warn(r.Context(), "SAML LogoutRequest from unknown service provider",
+			zap.String("entity_id", unverified.Issuer.Value), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	logoutReq, err := s.verifyLogoutRequest(r, raw, sp)
+	if err != nil {
+		s.logger.Warn(r.Context(), "Rejected SAML LogoutRequest",
+			zap.String("entity_id", sp.entityID), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	remaining, err := s.endSessions(w, r, sp, logoutReq)
+	if err != nil {
+		s.logger.Error(r.Context(), "Failed to end sessions for SAML logout", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	s.propagateLogout(w, r, &logoutState{
+		EntityID:   sp.entityID,
+		RequestID:  logoutReq.ID,
+		RelayState: relayState,
+		Remaining:  remaining,
+	})
+}
+
+// verifyLogoutRequest checks the signature of a LogoutRequest and that it is
+// addressed to this IdP and has not expired.
+func (s *Service) verifyLogoutRequest(r *http.Request, raw []byte, sp *serviceProvider) (*saml.LogoutRequest, error) {
+	signed, err := verifyLogoutMessage(r, "SAMLRequest", raw, sp)
+	if err != nil {
+		return nil, err
+	}
+	var req saml.LogoutRequest
+	if err := xml.Unmarshal(signed, &req); err != nil {
+		return nil, fmt.Errorf("cannot parse request: %w", err)
+	}
+	if req.Issuer == nil || req.Issuer.Value != sp.entityID {
+		return nil, errors.New("issuer does not match the signing service provider")
+	}
+	if req.Destination != "" && req.Destination != s.IDP.LogoutURL.String() {
+		return nil, fmt.Errorf("expected destination %q, not %q", s.IDP.LogoutURL.String(), req.Destination)
+	}
+	now := saml.TimeNow()
+	if req.IssueInstant.Add(saml.MaxIssueDelay).Before(now) {
+		return nil, fmt.Errorf("request expired at %s", req.IssueInstant.Add(saml.MaxIssueDelay))
+	}
+	if req.NotOnOrAfter != nil && !now.Before(*req.NotOnOrAfter) {
+		return nil, fmt.Errorf("request expired at %s", req.NotOnOrAfter.Format(time.RFC3339))
+	}
+	return &req, nil
+}
+
+// endSessions ends the sessions a verified LogoutRequest names, and the
+// browser's own session, and returns the other service providers they
+// signed in to. A request with a SessionIndex names that session; one
+// without names every session the principal has with the service provider.
+func (s *Service) endSessions(w http.ResponseWriter, r *http.Request, sp *serviceProvider, req *saml.LogoutRequest) ([]participant, error) {
+	ctx := r.Context()
+	var indexes []string
+	if s.store != nil && s.sessions != nil && req.NameID != nil && req.NameID.Value != "" {
+		if req.SessionIndex != nil && req.SessionIndex.Value != "" {
+			indexes = append(indexes, req.SessionIndex.Value)
+		} else {
+			found, err := s.store.SMembers(ctx, nameIDKey(sp.entityID, req.NameID.Value))
+			if err != nil {
+				return nil, err
+			}
+			indexes = append(indexes, found...)
+		}
+	}
+
+	var remaining []participant
+	for _, index := range indexes {
+		// The service provider can only end sessions it took part in.
+		if ok, err := s.isParticipant(ctx, index, sp.entityID, req.NameID.Value); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		ref, participants, err := s.takeSession(ctx, index)
+		if err != nil {
+			return nil, err
+		}
+		if ref == nil {
+			continue
+		}
+		if err := s.sessions.DeleteSession(ctx, ref.UserID, ref.SessionID); err != nil {
+			return nil, err
+		}
+		s.logger.Info(ctx, "Ended session for SAML logout",
+			zap.String("user_id", ref.UserID), zap.String("entity_id", sp.entityID))
+		remaining = appendParticipants(remaining, participants, sp.entityID)
+	}
+
+	if session := s.currentSession(r); session != nil {
+		if err := s.sessions.DeleteSession(ctx, session.UserID, session.ID); err != nil {
+			return nil, err
+		}
+		if s.store != nil {
+			_, participants, err := s.takeSession(ctx, sessionIndex(session.ID))
+			if err != nil {
+				return nil, err
+			}
+			remaining = appendParticipants(remaining, participants, sp.entityID)
+		}
+		s.logger.Info(ctx, "Ended session for SAML logout",
+			zap.String("user_id", session.UserID), zap.String("entity_id", sp.entityID))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     redis.SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return remaining, nil
+}
+
+// propagateLogout sends the next remaining service provider a signed
+// LogoutRequest, or answers the one that started the logout when none are
+// left. Service providers that cannot be sent one make the logout partial.
+func (s *Service) propagateLogout(w http.ResponseWriter, r *http.Request, state *logoutState) {
+	ctx := r.Context()
+	for len(state.Remaining) > 0 {
+		next := state.Remaining[0]
+		state.Remaining = state.Remaining[1:]
+		target, err := s.logoutRequestURL(ctx, state, next)
+		if err != nil {
+			s.logger.Warn(ctx, "Cannot propagate SAML logout",
+				zap.String("entity_id", next.EntityID), zap.Error(err))
+			state.Partial = true
+			continue
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	s.finishLogout(w, r, state)
+}
+
+// logoutRequestURL saves the logout state and returns the signed
+// LogoutRequest that tells a participant about the logout.
+func (s *Service) logoutRequestURL(ctx context.Context, state *logoutState, p participant) (string, error) {
+	sp, err := s.lookupServiceProvider(ctx, p.EntityID)
+	if err != nil {
+		return "", err
+	}
+	if sp.sloURL == "" {
+		return "", errors.New("service provider has no slo_url")
+	}
+	requestID, err := randomID(20)
+	if err != nil {
+		return "", err
+	}
+	stateID, err := randomID(32)
+	if err != nil {
+		return "", err
+	}
+	req := &saml.LogoutRequest{
+		ID:           "id-" + requestID,
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		Destination:  sp.sloURL,
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  s.IDP.MetadataURL.String(),
+		},
+		NameID: &saml.NameID{
+			Format:          p.NameIDFormat,
+			Value:           p.NameID,
+			NameQualifier:   s.IDP.MetadataURL.String(),
+			SPNameQualifier: sp.entityID,
+		},
+		SessionIndex: &saml.SessionIndex{Value: p.SessionIndex},
+	}
+	if err := s.logoutSigner().SignLogoutRequest(req); err != nil {
+		return "", err
+	}
+	state.PendingEntityID = sp.entityID
+	state.PendingRequestID = req.ID
+	state.ID = stateID
+	if err := s.saveLogoutState(ctx, state); err != nil {
+		return "", err
+	}
+	return req.Redirect(state.ID).String(), nil
+}
+
+// continueLogout handles a participant's LogoutResponse and carries on with
+// the logout it belongs to.
+func (s *Service) continueLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	raw, stateID, err := parseLogoutMessage(r, "SAMLResponse")
+	if err != nil {
+		s.logger.Warn(ctx, "Invalid SAML LogoutResponse", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	state, err := s.consumeLogoutState(ctx, stateID)
+	if err != nil {
+		s.logger.Warn(ctx, "Invalid SAML logout state", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := s.verifyLogoutResponse(r, raw, state); err != nil {
+		s.logger.Warn(ctx, "Rejected SAML LogoutResponse",
+			zap.String("entity_id", state.PendingEntityID), zap.Error(err))
+		state.Partial = true
+	}
+	state.PendingEntityID, state.PendingRequestID = "", ""
+	s.propagateLogout(w, r, state)
+}
+
+// verifyLogoutResponse checks that a LogoutResponse is the signed, successful
+// answer to the pending LogoutRequest.
+func (s *Service) verifyLogoutResponse(r *http.Request, raw []byte, state *logoutState) error {
+	sp, err := s.lookupServiceProvider(r.Context(), state.PendingEntityID)
+	if err != nil {
+		return err
+	}
+	signed, err := verifyLogoutMessage(r, "SAMLResponse", raw, sp)
+	if err != nil {
+		return err
+	}
+	var resp saml.LogoutResponse
+	if err := xml.Unmarshal(signed, &resp); err != nil {
+		return fmt.Errorf("cannot parse response: %w", err)
+	}
+	if resp.Issuer == nil || resp.Issuer.Value != sp.entityID {
+		return errors.New("issuer does not match the signing service provider")
+	}
+	if resp.InResponseTo != state.PendingRequestID {
+		return fmt.Errorf("expected a response to %q, not %q", state.PendingRequestID, resp.InResponseTo)
+	}
+	if resp.Status.StatusCode.Value != saml.StatusSuccess {
+		return fmt.Errorf("logout failed with status %s", resp.Status.StatusCode.Value)
+	}
+	return nil
+}
+
+// finishLogout answers the service provider that started the logout.
+func (s *Service) finishLogout(w http.ResponseWriter, r *http.Request, state *logoutState) {
+	sp, err := s.lookupServiceProvider(r.Context(), state.EntityID)
+	if err != nil || sp.sloURL == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("You have been signed out.\n"))
+		return
+	}
+	// The status may change after the response is built, so it is signed last.
+	unsigned := s.logoutSigner()
+	unsigned.SignatureMethod = ""
+	resp, err := unsigned.MakeLogoutResponse(sp.sloURL, state.RequestID)
+	if err == nil && state.Partial {
+		resp.Status.StatusCode.StatusCode = &saml.StatusCode{Value: statusPartialLogout}
+	}
+	if err == nil {
+		err = s.logoutSigner().SignLogoutResponse(resp)
+	}
+	if err != nil {
+		s.logger.Error(r.Context(), "Failed to sign SAML LogoutResponse", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, resp.Redirect(state.RelayState).String(), http.StatusFound)
+}
+
+// logoutSigner signs logout messages as the IdP. crewjam only builds them on
+// the service provider side, so the IdP poses as one.
+func (s *Service) logoutSigner() *saml.ServiceProvider {
+	return &saml.ServiceProvider{
+		EntityID:        s.IDP.MetadataURL.String(),
+		Key:             s.key,
+		Certificate:     s.IDP.Certificate,
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+	}
+}
+
+// recordParticipant remembers that the browser's session signed in to a
+// service provider, so that a later logout can be propagated to it.
+func (s *Service) recordParticipant(r *http.Request, sp *serviceProvider, released *saml.Session) error {
+	if s.store == nil {
+		return nil
+	}
+	session := s.currentSession(r)
+	if session == nil {
+		return nil
+	}
+	ttl := time.Until(released.ExpireTime)
+	if ttl <= 0 {
+		return nil
+	}
+	p, err := json.Marshal(participant{
+		EntityID:     sp.entityID,
+		NameID:       released.NameID,
+		NameIDFormat: released.NameIDFormat,
+		SessionIndex: released.Index,
+	})
+	if err != nil {
+		return err
+	}
+	ref, err := json.Marshal(sessionRef{UserID: session.UserID, SessionID: session.ID})
+	if err != nil {
+		return err
+	}
+	ctx := r.Context()
+	_, err = s.store.Client().TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Set(ctx, sessionRefKey(released.Index), ref, ttl)
+		pipe.HSet(ctx, participantsKey(released.Index), sp.entityID, p)
+		pipe.Expire(ctx, participantsKey(released.Index), ttl)
+		pipe.SAdd(ctx, nameIDKey(sp.entityID, released.NameID), released.Index)
+		pipe.Expire(ctx, nameIDKey(sp.entityID, released.NameID), ttl)
+		return nil
+	})
+	return err
+}
+
+// isParticipant reports whether a session signed in to a service provider
+// under the given NameID.
+func (s *Service) isParticipant(ctx context.Context, index, entityID, nameID string) (bool, error) {
+	data, err := s.store.Client().HGet(ctx, participantsKey(index), entityID).Result()
+	if err != nil {
+		if errors.Is(err, goredis.Nil) {
+			return false, nil
+		}
+		return false, err
+	}
+	var p participant
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return false, err
+	}
+	return p.NameID == nameID, nil
+}
+
+// takeSession reads and forgets what was recorded about a session index, so
+// that concurrent logouts end it and notify its participants only once.
+func (s *Service) takeSession(ctx context.Context, index string) (*sessionRef, map[string]participant, error) {
+	var refCmd *goredis.StringCmd
+	var participantsCmd *goredis.MapStringStringCmd
+	_, err := s.store.Client().TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		refCmd = pipe.GetDel(ctx, sessionRefKey(index))
+		participantsCmd = pipe.HGetAll(ctx, participantsKey(index))
+		pipe.Del(ctx, participantsKey(index))
+		return nil
+	})
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		return nil, nil, err
+	}
+
+	var ref *sessionRef
+	if data, err := refCmd.Result(); err == nil {
+		ref = &sessionRef{}
+		if err := json.Unmarshal([]byte(data), ref); err != nil {
+			return nil, nil, err
+		}
+	}
+	participants := make(map[string]participant)
+	for entityID, data := range participantsCmd.Val() {
+		var p participant
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return nil, nil, err
+		}
+		participants[entityID] = p
+	}
+	if ref == nil {
+		// The session is gone; there is nothing to end or propagate.
+		return nil, nil, nil
+	}
+	return ref, participants, nil
+}
+
+func (s *Service) saveLogoutState(ctx context.Context, state *logoutState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(ctx, logoutStateKey(state.ID), data, logoutStateTTL)
+}
+
+// consumeLogoutState fetches and deletes a logout state, so that each
+// LogoutResponse is accepted once.
+func (s *Service) consumeLogoutState(ctx context.Context, id string) (*logoutState, error) {
+	if id == "" {
+		return nil, errors.New("missing RelayState")
+	}
+	if s.store == nil {
+		return nil, errors.New("no logout in progress")
+	}
+	data, err := s.store.Client().GetDel(ctx, logoutStateKey(id)).Result()
+	if err != nil {
+		if errors.Is(err, goredis.Nil) {
+			return nil, errors.New("unknown or expired logout")
+		}
+		return nil, err
+	}
+	var state logoutState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, err
+	}
+	state.ID = id
+	return &state, nil
+}
+
+// appendParticipants adds the participants other than the service provider
+// that started the logout.
+func appendParticipants(list []participant, participants map[string]participant, except string) []participant {
+	for entityID, p := range participants {
+		if entityID != except {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// sessionIndex identifies a session to service providers; it must not be the
+// session ID, which is a bearer credential.
+func sessionIndex(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func sessionRefKey(index string) string {
+	return "saml_session:" + index
+}
+
+func participantsKey(index string) string {
+	return "saml_participants:" + index
+}
+
+func nameIDKey(entityID, nameID string) string {
+	sum := sha256.Sum256([]byte(entityID + "\x00" + nameID))
+	return "saml_name_id:" + hex.EncodeToString(sum[:])
+}
+
+func logoutStateKey(id string) string {
+	return "saml_logout:" + id
+}
+
+// verifyLogoutMessage checks that a logout message was signed with the
+// service provider's certificate and returns the XML the signature covers.
+// The HTTP-Redirect binding signs the query string; otherwise the message
+// carries an enveloped XML signature.
+func verifyLogoutMessage(r *http.Request, param string, raw []byte, sp *serviceProvider) ([]byte, error) {
+	if sp.certificate == "" {
+		return nil, errors.New("service provider has no certificate to verify logout messages with")
+	}
+	cert, err := parseCertificate(sp.certificate)
+	if err != nil {
+		return nil, err
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Get("Signature") != "" {
+		if err := verifyRedirectSignature(r, param, cert); err != nil {
+			return nil, err
+		}
+		return raw, nil
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, fmt.Errorf("cannot parse message: %w", err)
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("empty message")
+	}
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{cert},
+	})
+	validationContext.IdAttribute = "ID"
+	verified, err := validationContext.Validate(doc.Root())
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	// Only what the signature covers is read from here on.
+	out := etree.NewDocument()
+	out.SetRoot(verified)
+	return out.WriteToBytes()
+}
+
+// verifyRedirectSignature checks the signature of the HTTP-Redirect binding,
+// computed over the message, RelayState and SigAlg parameters exactly as
+// they were encoded in the query string.
+func verifyRedirectSignature(r *http.Request, param string, cert *x509.Certificate) error {
+	encoded := make(map[string]string)
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		encoded[name] = pair
+	}
+	var signed []string
+	for _, name := range []string{param, "RelayState", "SigAlg"} {
+		if pair, ok := encoded[name]; ok {
+			signed = append(signed, pair)
+		}
+	}
+
+	query := r.URL.Query()
+	hash, ok := redirectSignatureHashes[query.Get("SigAlg")]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %q", query.Get("SigAlg"))
+	}
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	if err != nil {
+		return fmt.Errorf("cannot decode signature: %w", err)
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("service provider certificate does not hold an RSA key")
+	}
+	if now := saml.TimeNow(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.New("service provider certificate is not valid at this time")
+	}
+	h := hash.New()
+	h.Write([]byte(strings.Join(signed, "&")))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	return nil
+}
+
+// parseLogoutMessage decodes a LogoutRequest or LogoutResponse sent with the
+// HTTP-Redirect binding (deflated) or the HTTP-POST binding.
+func parseLogoutMessage(r *http.Request, param string) ([]byte, string, error) {
+	var raw []byte
+	var relayState string
+	switch r.Method {
+	case http.MethodGet:
+		compressed, err := base64.StdEncoding.DecodeString(r.URL.Query().Get(param))
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot decode %s: %w", param, err)
+		}
+		raw, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxLogoutMessageSize))
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot decompress %s: %w", param, err)
+		}
+		relayState = r.URL.Query().Get("RelayState")
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			return nil, "", err
+		}
+		var err error
+		raw, err = base64.StdEncoding.DecodeString(r.PostForm.Get(param))
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot decode %s: %w", param, err)
+		}
+		relayState = r.PostForm.Get("RelayState")
+	default:
+		return nil, "", errors.New("method not allowed")
+	}
+	if len(raw) == 0 {
+		return nil, "", fmt.Errorf("missing %s", param)
+	}
+	return raw, relayState, nil
+}
+
+func randomID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
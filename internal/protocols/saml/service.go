@@ -1,28 +1,45 @@
 package saml
 
 import (
+	"bytes"
+	"compress/flate"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
 )
 
+// loginPath is where users without a session are sent to sign in.
+const loginPath = "/auth/login"
+
 // Service now acts as a wrapper around the crewjam/saml IdentityProvider
-// and implements the necessary provider interfaces.
+// and implements the necessary provider interfaces. Service providers are the
+// SAML applications in the application registry.
 type Service struct {
 	logger         utils.Logger
 	appRepo        types.ApplicationRepository
 	identityDomain identity.IService
 	crypto         *utils.CryptoManager
+	sessions       *redis.SessionManager
+	store          redis.RedisClientInterface
+	key            *rsa.PrivateKey
 	IDP            *saml.IdentityProvider
 }
 
 // NewService creates a new SAML protocol service and configures the underlying IdP.
+// The IdP's endpoints live under baseURL; its entity ID is baseURL + "/metadata".
 func NewService(
 	logger utils.Logger,
 	appRepo types.ApplicationRepository,
@@ -30,13 +47,18 @@ func NewService(
 	crypto *utils.CryptoManager,
 	idpKey *rsa.PrivateKey,
 	idpCert *x509.Certificate,
-	idpIssuerURL string,
+	baseURL string,
 ) (*Service, error) {
-	ssoURL, err := url.Parse(idpIssuerURL + "/sso")
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	metadataURL, err := url.Parse(baseURL + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	ssoURL, err := url.Parse(baseURL + "/sso")
 	if err != nil {
 		return nil, err
 	}
-	metadataURL, err := url.Parse(idpIssuerURL)
+	logoutURL, err := url.Parse(baseURL + "/slo")
 	if err != nil {
 		return nil, err
 	}
@@ -46,67 +68,194 @@ func NewService(
 		appRepo:        appRepo,
 		identityDomain: identityDomain,
 		crypto:         crypto,
+		key:            idpKey,
 	}
 
 	s.IDP = &saml.IdentityProvider{
 		SSOURL:                  *ssoURL,
 		MetadataURL:             *metadataURL,
+		LogoutURL:               *logoutURL,
 		Key:                     idpKey,
 		Certificate:             idpCert,
+		Logger:                  idpLogger(logger),
 		ServiceProviderProvider: s,
 		SessionProvider:         s,
+		AssertionMaker:          s,
 	}
 	return s, nil
 }
 
-// GetServiceProvider looks up a service provider by its metadata URL (entityID).
+// SetSessionManager sets the session manager used to find the signed-in user.
+// Without one every request is sent to the login page.
+func (s *Service) SetSessionManager(sessions *redis.SessionManager) {
+	s.sessions = sessions
+}
+
+// GetServiceProvider looks up a service provider by its entityID.
 // This method implements the saml.ServiceProviderProvider interface.
 func (s *Service) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
-	// In a real implementation, we would look up the application by its entity ID
-	// from s.appRepo and construct the EntityDescriptor from its configuration.
-	// For now, we return a hardcoded dummy SP.
-	acsURL, _ := url.Parse("http://localhost:3000/v1/auth/saml/acs")
-
-	return &saml.EntityDescriptor{
-		EntityID: serviceProviderID,
-		SPSSODescriptors: []saml.SPSSODescriptor{
-			{
-				AssertionConsumerServices: []saml.IndexedEndpoint{
-					{
-						Binding:  saml.HTTPPostBinding,
-						Location: acsURL.String(),
-						Index:    1,
-					},
-				},
-			},
-		},
-	}, nil
+	sp, err := s.lookupServiceProvider(r.Context(), serviceProviderID)
+	if err != nil {
+		return nil, err
+	}
+	return sp.entityDescriptor(), nil
 }
 
 // GetSession retrieves the currently authenticated user session.
-// This method implements the saml.SessionProvider interface.
+// This method implements the saml.SessionProvider interface. Users without a
+// session are redirected to the login page, which brings them back here.
 func (s *Service) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
-	// This is where you would integrate with your actual session management.
-	// If the user is not logged in, you must redirect them to a login page and return nil.
-	// Returning nil signals to the IdP that a new authentication flow should be initiated.
-	// For this example, we create a dummy session for a hardcoded user.
-
+	session := s.currentSession(r)
+	if session == nil {
+		s.redirectToLogin(w, r, req)
+		return nil
+	}
+	authTime := session.AuthTime
+	if authTime.IsZero() {
+		authTime = session.CreatedAt
+	}
+	index := sessionIndex(session.ID)
 	return &saml.Session{
-		ID:           s.crypto.GenerateUUID(),
-		NameID:       "test.user@example.com",
-		NameIDFormat: "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress",
-		UserEmail:    "test.user@example.com",
-		UserName:     "Test User",
-		Groups:       []string{"Admins", "Developers"},
+		ID:         index,
+		CreateTime: authTime,
+		ExpireTime: session.ExpiresAt,
+		Index:      index,
+		NameID:     session.UserID,
+	}
+}
+
+// MakeAssertion releases the signed-in user to a service provider, with the
+// NameID format and attributes configured for it.
+// This method implements the saml.AssertionMaker interface.
+func (s *Service) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	ctx := req.HTTPRequest.Context()
+	sp, err := s.lookupServiceProvider(ctx, req.ServiceProviderMetadata.EntityID)
+	if err != nil {
+		return err
+	}
+	user, err := s.identityDomain.GetUser(ctx, session.NameID)
+	if err != nil {
+		return err
+	}
+	if user.Status != types.UserStatusActive {
+		return fmt.Errorf("user %s is %s", user.ID, user.Status)
+	}
+	userGroups, err := s.identityDomain.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	groups := make([]string, 0, len(userGroups))
+	for _, g := range userGroups {
+		groups = append(groups, g.Name)
+	}
+
+	released, err := sp.release(session, user, groups)
+	if err != nil {
+		return err
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, released); err != nil {
+		return err
+	}
+	if err := s.recordParticipant(req.HTTPRequest, sp, released); err != nil {
+		return fmt.Errorf("cannot record session for logout: %w", err)
 	}
+	s.logger.Info(ctx, "Issued SAML assertion",
+		zap.String("user_id", user.ID),
+		zap.String("application_id", sp.app.ID),
+		zap.String("entity_id", sp.entityID))
+	return nil
 }
 
-// HandleSSO now delegates directly to the underlying IdP's ServeSSO method.
+// HandleSSO now delegates directly to the underlying IdP's ServeSSO method,
+// which accepts both the HTTP-Redirect and HTTP-POST bindings.
 func (s *Service) HandleSSO(w http.ResponseWriter, r *http.Request) {
 	s.IDP.ServeSSO(w, r)
 }
 
-// HandleMetadata now delegates directly to the underlying IdP's ServeMetadata method.
+// HandleIDPInitiated signs the user in to an application without a request
+// from it. The application's first ACS URL receives the assertion.
+func (s *Service) HandleIDPInitiated(w http.ResponseWriter, r *http.Request, applicationID string) {
+	app, err := s.appRepo.GetApplicationByID(r.Context(), applicationID)
+	if err != nil || app == nil || app.Protocol != types.ProtocolSAML || app.Status == types.ApplicationStatusInactive {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	s.IDP.ServeIDPInitiated(w, r, stringValue(app.ProtocolConfig["entity_id"]), r.URL.Query().Get("RelayState"))
+}
+
+// HandleMetadata serves the IdP's metadata, including its signing certificate
+// and the NameID formats applications may use.
 func (s *Service) HandleMetadata(w http.ResponseWriter, r *http.Request) {
-	s.IDP.ServeMetadata(w, r)
-}
\ No newline at end of file
+	metadata := s.IDP.Metadata()
+	metadata.IDPSSODescriptors[0].NameIDFormats = []saml.NameIDFormat{
+		NameIDFormatEmail, NameIDFormatPersistent, NameIDFormatTransient, NameIDFormatUnspecified,
+	}
+	buf, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(buf)
+}
+
+// currentSession returns the user's session, or nil if they are not signed in.
+func (s *Service) currentSession(r *http.Request) *types.UserSession {
+	if s.sessions == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(redis.SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	session, err := s.sessions.GetSession(r.Context(), cookie.Value, r)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+// redirectToLogin sends the user to the login page, to return to this request
+// afterwards. A request that arrived with the HTTP-POST binding is first
+// re-sent with the HTTP-Redirect binding so that it survives the round trip,
+// and so that a SameSite=Lax session cookie accompanies it.
+func (s *Service) redirectToLogin(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) {
+	if r.Method == http.MethodPost && req != nil && len(req.RequestBuffer) > 0 {
+		target, err := s.redirectBindingURL(req)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, loginPath+"?"+url.Values{"return_to": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+}
+
+// redirectBindingURL encodes an AuthnRequest for the HTTP-Redirect binding.
+func (s *Service) redirectBindingURL(req *saml.IdpAuthnRequest) (string, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(req.RequestBuffer); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	query := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(buf.Bytes())}}
+	if req.RelayState != "" {
+		query.Set("RelayState", req.RelayState)
+	}
+	return s.IDP.SSOURL.Path + "?" + query.Encode(), nil
+}
+
+// idpLogger adapts the service logger to the logger crewjam reports errors to.
+func idpLogger(l utils.Logger) logger.Interface {
+	if zl, ok := l.(*utils.ZapLogger); ok {
+		return zap.NewStdLog(zl.Logger)
+	}
+	return logger.DefaultLogger
+}
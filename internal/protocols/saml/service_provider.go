@@ -0,0 +1,300 @@
+package saml
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/crewjam/saml"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// NameID formats an application can ask for in its "name_id_format" setting.
+const (
+	NameIDFormatEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	NameIDFormatTransient   = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+	NameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+)
+
+// nameIDFormats also accepts the short names of the supported formats.
+var nameIDFormats = map[string]string{
+	"email":                 NameIDFormatEmail,
+	"persistent":            NameIDFormatPersistent,
+	"transient":             NameIDFormatTransient,
+	"unspecified":           NameIDFormatUnspecified,
+	NameIDFormatEmail:       NameIDFormatEmail,
+	NameIDFormatPersistent:  NameIDFormatPersistent,
+	NameIDFormatTransient:   NameIDFormatTransient,
+	NameIDFormatUnspecified: NameIDFormatUnspecified,
+}
+
+const attrNameFormatBasic = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+
+// spPageSize is how many applications are read at a time when looking up a
+// service provider by entity ID.
+const spPageSize = 100
+
+// serviceProvider is a SAML application as configured in its ProtocolConfig:
+//
+//	entity_id           the SP's entity ID (required)
+//	acs_url             one or more HTTP-POST assertion consumer service URLs (required)
+//	slo_url             where LogoutRequests and LogoutResponses are sent
+//	certificate         the SP's PEM certificate, used to check its signatures;
+//	                    required for Single Logout
+//	encrypt_assertions  encrypt assertions to the SP's certificate
+//	name_id_format      email, persistent, transient or unspecified, or a full URN
+//	attribute_mapping   SAML attribute name to user field (id, username, email,
+//	                    phone, groups or any custom attribute)
+type serviceProvider struct {
+	app               *types.Application
+	entityID          string
+	acsURLs           []string
+	sloURL            string
+	certificate       string
+	encryptAssertions bool
+	nameIDFormat      string
+	attributeMapping  map[string]string
+}
+
+// newServiceProvider reads a service provider from a SAML application.
+func newServiceProvider(app *types.Application) (*serviceProvider, error) {
+	cfg := app.ProtocolConfig
+	sp := &serviceProvider{
+		app:              app,
+		entityID:         stringValue(cfg["entity_id"]),
+		acsURLs:          stringList(cfg["acs_url"]),
+		sloURL:           stringValue(cfg["slo_url"]),
+		nameIDFormat:     NameIDFormatEmail,
+		attributeMapping: map[string]string{},
+	}
+	if sp.entityID == "" || len(sp.acsURLs) == 0 {
+		return nil, fmt.Errorf("application %s: entity_id and acs_url are required", app.ID)
+	}
+	if format := stringValue(cfg["name_id_format"]); format != "" {
+		urn, ok := nameIDFormats[format]
+		if !ok {
+			return nil, fmt.Errorf("application %s: unsupported name_id_format %q", app.ID, format)
+		}
+		sp.nameIDFormat = urn
+	}
+	if certPEM := stringValue(cfg["certificate"]); certPEM != "" {
+		cert, err := parseCertificate(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("application %s: %w", app.ID, err)
+		}
+		sp.certificate = base64.StdEncoding.EncodeToString(cert.Raw)
+	}
+	sp.encryptAssertions, _ = cfg["encrypt_assertions"].(bool)
+	if sp.encryptAssertions && sp.certificate == "" {
+		return nil, fmt.Errorf("application %s: encrypt_assertions requires a certificate", app.ID)
+	}
+	if mapping, ok := cfg["attribute_mapping"].(map[string]interface{}); ok {
+		for name, field := range mapping {
+			sp.attributeMapping[name] = stringValue(field)
+		}
+	}
+	return sp, nil
+}
+
+// lookupServiceProvider finds the active SAML application with the given
+// entity ID. It returns os.ErrNotExist when there is none, as crewjam expects.
+func (s *Service) lookupServiceProvider(ctx context.Context, entityID string) (*serviceProvider, error) {
+	for offset := 0; ; offset += spPageSize {
+		apps, err := s.appRepo.ListApplications(ctx, types.PaginationQuery{Offset: offset, PageSize: spPageSize})
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			if app.Protocol != types.ProtocolSAML || app.Status == types.ApplicationStatusInactive {
+				continue
+			}
+			if stringValue(app.ProtocolConfig["entity_id"]) == entityID {
+				return newServiceProvider(app)
+			}
+		}
+		if len(apps) < spPageSize {
+			return nil, os.ErrNotExist
+		}
+	}
+}
+
+// entityDescriptor builds the SP metadata crewjam uses to address and
+// encrypt assertions.
+func (sp *serviceProvider) entityDescriptor() *saml.EntityDescriptor {
+	descriptor := saml.SPSSODescriptor{
+		SSODescriptor: saml.SSODescriptor{
+			RoleDescriptor: saml.RoleDescriptor{
+				ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			},
+			NameIDFormats: []saml.NameIDFormat{saml.NameIDFormat(sp.nameIDFormat)},
+		},
+	}
+	if sp.certificate != "" {
+		// crewjam encrypts to any certificate whose use is not "signing".
+		descriptor.KeyDescriptors = append(descriptor.KeyDescriptors, sp.keyDescriptor("signing"))
+		if sp.encryptAssertions {
+			descriptor.KeyDescriptors = append(descriptor.KeyDescriptors, sp.keyDescriptor("encryption"))
+		}
+	}
+	if sp.sloURL != "" {
+		descriptor.SingleLogoutServices = []saml.Endpoint{{Binding: saml.HTTPRedirectBinding, Location: sp.sloURL}}
+	}
+	for i, acsURL := range sp.acsURLs {
+		descriptor.AssertionConsumerServices = append(descriptor.AssertionConsumerServices, saml.IndexedEndpoint{
+			Binding:  saml.HTTPPostBinding,
+			Location: acsURL,
+			Index:    i + 1,
+		})
+	}
+	return &saml.EntityDescriptor{
+		EntityID:         sp.entityID,
+		SPSSODescriptors: []saml.SPSSODescriptor{descriptor},
+	}
+}
+
+func (sp *serviceProvider) keyDescriptor(use string) saml.KeyDescriptor {
+	return saml.KeyDescriptor{
+		Use: use,
+		KeyInfo: saml.KeyInfo{
+			X509Data: saml.X509Data{X509Certificates: []saml.X509Certificate{{Data: sp.certificate}}},
+		},
+	}
+}
+
+// release builds the session crewjam turns into an assertion for this SP:
+// the NameID in the SP's format and the attributes it is allowed to see.
+func (sp *serviceProvider) release(session *saml.Session, user *types.User, groups []string) (*saml.Session, error) {
+	released := &saml.Session{
+		ID:           session.ID,
+		CreateTime:   session.CreateTime,
+		ExpireTime:   session.ExpireTime,
+		Index:        session.Index,
+		NameIDFormat: sp.nameIDFormat,
+	}
+	switch sp.nameIDFormat {
+	case NameIDFormatEmail:
+		released.NameID = string(user.Email)
+	case NameIDFormatPersistent:
+		released.NameID = user.ID
+	case NameIDFormatTransient:
+		released.NameID = transientNameID()
+	default:
+		released.NameID = user.Username
+	}
+	if released.NameID == "" {
+		return nil, fmt.Errorf("user %s has no value for NameID format %s", user.ID, sp.nameIDFormat)
+	}
+
+	if len(sp.attributeMapping) == 0 {
+		released.UserName = user.Username
+		released.UserEmail = string(user.Email)
+		released.Groups = groups
+		return released, nil
+	}
+
+	names := make([]string, 0, len(sp.attributeMapping))
+	for name := range sp.attributeMapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := userField(user, groups, sp.attributeMapping[name])
+		if len(values) == 0 {
+			continue
+		}
+		attr := saml.Attribute{Name: name, NameFormat: attrNameFormatBasic}
+		for _, v := range values {
+			attr.Values = append(attr.Values, saml.AttributeValue{Type: "xs:string", Value: v})
+		}
+		released.CustomAttributes = append(released.CustomAttributes, attr)
+	}
+	return released, nil
+}
+
+// userField returns the values of a user field named in an attribute mapping.
+func userField(user *types.User, groups []string, field string) []string {
+	switch field {
+	case "id":
+		return []string{user.ID}
+	case "username":
+		return []string{user.Username}
+	case "email":
+		return nonEmpty(string(user.Email))
+	case "phone":
+		return nonEmpty(string(user.Phone))
+	case "groups":
+		return groups
+	}
+	return stringList(user.Attributes[field])
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// parseCertificate accepts a PEM certificate or bare base64 DER, the form
+// certificates take in SAML metadata.
+func parseCertificate(data string) (*x509.Certificate, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(data)); block != nil {
+		der = block.Bytes
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(whitespace.ReplaceAllString(data, ""))
+		if err != nil {
+			return nil, fmt.Errorf("certificate is neither PEM nor base64: %w", err)
+		}
+		der = decoded
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func transientNameID() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return "_" + hex.EncodeToString(b)
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return strings.TrimSpace(s)
+}
+
+// stringList reads a setting that may hold a single string or a list.
+func stringList(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return nonEmpty(strings.TrimSpace(val))
+	case []string:
+		return val
+	case []interface{}:
+		var out []string
+		for _, item := range val {
+			if item != nil && item != "" {
+				out = append(out, fmt.Sprint(item))
+			}
+		}
+		return out
+	case nil:
+		return nil
+	default:
+		return []string{fmt.Sprint(val)}
+	}
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
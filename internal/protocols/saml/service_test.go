@@ -0,0 +1,514 @@
+package saml
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	goredis "github.com/redis/go-redis/v9"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+type fakeApplicationRepository struct {
+	types.ApplicationRepository
+	apps []*types.Application
+}
+
+func (f *fakeApplicationRepository) GetApplicationByID(ctx context.Context, id string) (*types.Application, error) {
+	for _, app := range f.apps {
+		if app.ID == id {
+			return app, nil
+		}
+	}
+	return nil, types.ErrNotFound
+}
+
+func (f *fakeApplicationRepository) ListApplications(ctx context.Context, pq types.PaginationQuery) ([]*types.Application, error) {
+	if pq.Offset >= len(f.apps) {
+		return nil, nil
+	}
+	end := pq.Offset + pq.PageSize
+	if end > len(f.apps) {
+		end = len(f.apps)
+	}
+	return f.apps[pq.Offset:end], nil
+}
+
+// testIdP is a QuantaID SAML IdP whose login page signs in alice at once.
+type testIdP struct {
+	server   *httptest.Server
+	service  *Service
+	apps     *fakeApplicationRepository
+	sessions *redis.SessionManager
+	userID   string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+	sessions := redis.NewSessionManager(client, redis.SessionConfig{DefaultTTL: time.Hour}, zap.NewNop(),
+		&redis.GoogleUUIDGenerator{}, &redis.RealClock{}, redis.NewMetrics("saml_test", prometheus.NewRegistry()))
+
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{
+		Username:   "alice",
+		Email:      "alice@example.com",
+		Status:     types.UserStatusActive,
+		Attributes: map[string]interface{}{"department": "engineering"},
+	}
+	require.NoError(t, users.CreateUser(ctx, user))
+	group := &types.UserGroup{Name: "admins"}
+	require.NoError(t, users.CreateGroup(ctx, group))
+	require.NoError(t, users.AddUserToGroup(ctx, user.ID, group.ID))
+	logger := utils.NewZapLoggerWrapper(zap.NewNop())
+	crypto := utils.NewCryptoManager("test-secret")
+	identityService := identity.NewService(users, users, crypto, logger)
+
+	idp := &testIdP{apps: &fakeApplicationRepository{}, sessions: sessions, userID: user.ID}
+	router := mux.NewRouter()
+	idp.server = httptest.NewServer(router)
+	t.Cleanup(idp.server.Close)
+
+	key, cert, err := GenerateKeyPair("idp", time.Hour)
+	require.NoError(t, err)
+	idp.service, err = NewService(logger, idp.apps, identityService, crypto, key, cert, idp.server.URL+"/saml")
+	require.NoError(t, err)
+	idp.service.SetSessionManager(sessions)
+	idp.service.SetLogoutStore(client)
+
+	router.HandleFunc("/saml/metadata", idp.service.HandleMetadata).Methods("GET")
+	router.HandleFunc("/saml/sso", idp.service.HandleSSO).Methods("GET", "POST")
+	router.HandleFunc("/saml/slo", idp.service.HandleSLO).Methods("GET", "POST")
+	router.HandleFunc("/saml/launch/{id}", func(w http.ResponseWriter, r *http.Request) {
+		idp.service.HandleIDPInitiated(w, r, mux.Vars(r)["id"])
+	}).Methods("GET")
+	router.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessions.CreateSession(r.Context(), user.ID, r)
+		require.NoError(t, err)
+		http.SetCookie(w, &http.Cookie{Name: redis.SessionCookieName, Value: session.ID, Path: "/"})
+		http.Redirect(w, r, r.URL.Query().Get("return_to"), http.StatusFound)
+	}).Methods("GET")
+	return idp
+}
+
+// newTestSP starts a crewjam service provider protecting /hello, which
+// echoes the NameID and attributes of the assertion it received.
+func newTestSP(t *testing.T, idp *testIdP) (*samlsp.Middleware, *httptest.Server) {
+	resp, err := http.Get(idp.server.URL + "/saml/metadata")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	idpMetadata, err := samlsp.ParseMetadata(body)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	key, cert, err := GenerateKeyPair("sp", time.Hour)
+	require.NoError(t, err)
+	spURL, _ := url.Parse(server.URL)
+	sp, err := samlsp.New(samlsp.Options{
+		URL:                *spURL,
+		Key:                key,
+		Certificate:        cert,
+		IDPMetadata:        idpMetadata,
+		AllowIDPInitiated:  true,
+		DefaultRedirectURI: "/hello",
+	})
+	require.NoError(t, err)
+	mux.Handle("/saml/", sp)
+	// samlsp does not answer LogoutRequests from the IdP.
+	mux.HandleFunc("/saml/slo", func(w http.ResponseWriter, r *http.Request) {
+		raw, relayState, err := parseLogoutMessage(r, "SAMLRequest")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req saml.LogoutRequest
+		if err := xml.Unmarshal(raw, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target, err := sp.ServiceProvider.MakeRedirectLogoutResponse(req.ID, relayState)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	})
+	mux.Handle("/hello", sp.RequireAccount(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := samlsp.SessionFromContext(r.Context()).(samlsp.JWTSessionClaims)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"sub": claims.Subject, "attributes": claims.Attributes})
+	})))
+	return sp, server
+}
+
+// register adds the SP to the IdP's application registry.
+func (idp *testIdP) register(id string, sp *samlsp.Middleware, config map[string]interface{}) {
+	cfg := types.JSONB{
+		"entity_id":   sp.ServiceProvider.MetadataURL.String(),
+		"acs_url":     sp.ServiceProvider.AcsURL.String(),
+		"slo_url":     sp.ServiceProvider.SloURL.String(),
+		"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: sp.ServiceProvider.Certificate.Raw})),
+	}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	idp.apps.apps = append(idp.apps.apps, &types.Application{ID: id, Protocol: types.ProtocolSAML, Status: types.ApplicationStatusActive, ProtocolConfig: cfg})
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return &http.Client{Jar: jar}
+}
+
+var formField = regexp.MustCompile(`name="(\w+)" value="([^"]*)"`)
+var formAction = regexp.MustCompile(`action="([^"]+)"`)
+
+// submitForm posts the auto-submitting form of a SAML POST binding page.
+func submitForm(t *testing.T, browser *http.Client, page *http.Response) (*http.Response, url.Values) {
+	defer page.Body.Close()
+	body, err := io.ReadAll(page.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, page.StatusCode, string(body))
+	action := formAction.FindStringSubmatch(string(body))
+	require.NotNil(t, action, string(body))
+	form := url.Values{}
+	for _, field := range formField.FindAllStringSubmatch(string(body), -1) {
+		form.Set(field[1], html.UnescapeString(field[2]))
+	}
+	resp, err := browser.PostForm(html.UnescapeString(action[1]), form)
+	require.NoError(t, err)
+	return resp, form
+}
+
+func readClaims(t *testing.T, resp *http.Response) (string, map[string][]string) {
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var out struct {
+		Sub        string              `json:"sub"`
+		Attributes map[string][]string `json:"attributes"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	return out.Sub, out.Attributes
+}
+
+func TestService_SPInitiatedRedirectBinding(t *testing.T) {
+	idp := newTestIdP(t)
+	sp, spServer := newTestSP(t, idp)
+	idp.register("wiki", sp, nil)
+	browser := newBrowser(t)
+
+	// The SP redirects to the IdP, which sends the user through the login
+	// page and back before answering with a signed assertion.
+	page, err := browser.Get(spServer.URL + "/hello")
+	require.NoError(t, err)
+	resp, form := submitForm(t, browser, page)
+
+	response, err := base64.StdEncoding.DecodeString(form.Get("SAMLResponse"))
+	require.NoError(t, err)
+	assert.Contains(t, string(response), "<ds:Signature")
+	assert.NotContains(t, string(response), "EncryptedAssertion")
+
+	sub, attributes := readClaims(t, resp)
+	assert.Equal(t, "alice@example.com", sub)
+	assert.Equal(t, []string{"alice"}, attributes["uid"])
+	assert.Equal(t, []string{"alice@example.com"}, attributes["mail"])
+	assert.Equal(t, []string{"admins"}, attributes["eduPersonAffiliation"])
+}
+
+func TestService_SPInitiatedPostBindingWithEncryptionAndMapping(t *testing.T) {
+	idp := newTestIdP(t)
+	sp, spServer := newTestSP(t, idp)
+	sp.Binding = saml.HTTPPostBinding
+	idp.register("crm", sp, map[string]interface{}{
+		"encrypt_assertions": true,
+		"name_id_format":     "persistent",
+		"attribute_mapping": map[string]interface{}{
+			"login":      "username",
+			"memberOf":   "groups",
+			"department": "department",
+		},
+	})
+	browser := newBrowser(t)
+
+	// The SP's page posts the AuthnRequest to the IdP.
+	page, err := browser.Get(spServer.URL + "/hello")
+	require.NoError(t, err)
+	page, _ = submitForm(t, browser, page)
+	resp, form := submitForm(t, browser, page)
+
+	response, err := base64.StdEncoding.DecodeString(form.Get("SAMLResponse"))
+	require.NoError(t, err)
+	assert.Contains(t, string(response), "EncryptedAssertion")
+
+	sub, attributes := readClaims(t, resp)
+	assert.Equal(t, idp.userID, sub)
+	assert.Equal(t, []string{"alice"}, attributes["login"])
+	assert.Equal(t, []string{"admins"}, attributes["memberOf"])
+	assert.Equal(t, []string{"engineering"}, attributes["department"])
+	assert.Empty(t, attributes["mail"], "only mapped attributes are released")
+}
+
+func TestService_IDPInitiated(t *testing.T) {
+	idp := newTestIdP(t)
+	sp, _ := newTestSP(t, idp)
+	idp.register("wiki", sp, map[string]interface{}{"name_id_format": "transient"})
+	browser := newBrowser(t)
+
+	page, err := browser.Get(idp.server.URL + "/saml/launch/wiki")
+	require.NoError(t, err)
+	resp, _ := submitForm(t, browser, page)
+	sub, _ := readClaims(t, resp)
+	assert.True(t, strings.HasPrefix(sub, "_"), "transient NameIDs are random")
+
+	resp, err = browser.Get(idp.server.URL + "/saml/launch/unknown")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestService_UnknownServiceProvider(t *testing.T) {
+	idp := newTestIdP(t)
+	_, spServer := newTestSP(t, idp)
+
+	resp, err := newBrowser(t).Get(spServer.URL + "/hello")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// signIn signs the browser in to the IdP and then to each application.
+func (idp *testIdP) signIn(t *testing.T, browser *http.Client, applicationIDs ...string) {
+	for _, id := range applicationIDs {
+		page, err := browser.Get(idp.server.URL + "/saml/launch/" + id)
+		require.NoError(t, err)
+		resp, _ := submitForm(t, browser, page)
+		resp.Body.Close()
+	}
+}
+
+// signedIn reports whether the browser still has an IdP session.
+func (idp *testIdP) signedIn(t *testing.T, browser *http.Client, applicationID string) bool {
+	// Without one the launch is sent to the login page, which signs in again.
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	defer func() { browser.CheckRedirect = nil }()
+	resp, err := browser.Get(idp.server.URL + "/saml/launch/" + applicationID)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// follow requests a URL without following its redirect.
+func follow(t *testing.T, browser *http.Client, target string) *url.URL {
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	defer func() { browser.CheckRedirect = nil }()
+	resp, err := browser.Get(target)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location, err := resp.Location()
+	require.NoError(t, err)
+	return location
+}
+
+func TestService_SingleLogout(t *testing.T) {
+	idp := newTestIdP(t)
+	sp, _ := newTestSP(t, idp)
+	idp.register("wiki", sp, nil)
+	browser := newBrowser(t)
+	idp.signIn(t, browser, "wiki")
+
+	// Unsigned LogoutRequests are refused.
+	logoutURL, err := sp.ServiceProvider.MakeRedirectLogoutRequest("alice@example.com", "state-1")
+	require.NoError(t, err)
+	resp, err := browser.Get(logoutURL.String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.True(t, idp.signedIn(t, browser, "wiki"))
+
+	sp.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+	logoutURL, err = sp.ServiceProvider.MakeRedirectLogoutRequest("alice@example.com", "state-1")
+	require.NoError(t, err)
+	location := follow(t, browser, logoutURL.String())
+
+	// The SP accepts the IdP's signed LogoutResponse.
+	assert.Equal(t, sp.ServiceProvider.SloURL.Path, location.Path)
+	assert.Equal(t, "state-1", location.Query().Get("RelayState"))
+	require.NoError(t, sp.ServiceProvider.ValidateLogoutResponseRequest(httptest.NewRequest("GET", location.String(), nil)))
+
+	// The IdP session is gone.
+	assert.False(t, idp.signedIn(t, browser, "wiki"))
+}
+
+func TestService_SingleLogoutPropagatesToOtherServiceProviders(t *testing.T) {
+	idp := newTestIdP(t)
+	wiki, _ := newTestSP(t, idp)
+	chat, _ := newTestSP(t, idp)
+	idp.register("wiki", wiki, nil)
+	idp.register("chat", chat, map[string]interface{}{"name_id_format": "persistent"})
+	wiki.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+	chat.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+	browser := newBrowser(t)
+	idp.signIn(t, browser, "wiki", "chat")
+
+	logoutURL, err := wiki.ServiceProvider.MakeRedirectLogoutRequest("alice@example.com", "state-1")
+	require.NoError(t, err)
+	location := follow(t, browser, logoutURL.String())
+
+	// chat is sent a LogoutRequest signed by the IdP, for the NameID it knows.
+	assert.Equal(t, chat.ServiceProvider.SloURL.String(), location.Scheme+"://"+location.Host+location.Path)
+	request := httptest.NewRequest("GET", location.String(), nil)
+	raw, _, err := parseLogoutMessage(request, "SAMLRequest")
+	require.NoError(t, err)
+	idpCert := &serviceProvider{certificate: base64.StdEncoding.EncodeToString(idp.service.IDP.Certificate.Raw)}
+	signed, err := verifyLogoutMessage(request, "SAMLRequest", raw, idpCert)
+	require.NoError(t, err)
+	var logoutReq saml.LogoutRequest
+	require.NoError(t, xml.Unmarshal(signed, &logoutReq))
+	assert.Equal(t, idp.userID, logoutReq.NameID.Value)
+	require.NotNil(t, logoutReq.SessionIndex)
+	assert.NotEmpty(t, logoutReq.SessionIndex.Value)
+
+	// chat answers, and the IdP then answers wiki.
+	location = follow(t, browser, location.String())
+	assert.Equal(t, idp.service.IDP.LogoutURL.Path, location.Path)
+	location = follow(t, browser, location.String())
+	assert.Equal(t, wiki.ServiceProvider.SloURL.Path, location.Path)
+	assert.Equal(t, "state-1", location.Query().Get("RelayState"))
+	final := httptest.NewRequest("GET", location.String(), nil)
+	require.NoError(t, wiki.ServiceProvider.ValidateLogoutResponseRequest(final))
+	raw, _, err = parseLogoutMessage(final, "SAMLResponse")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), statusPartialLogout)
+	assert.False(t, idp.signedIn(t, browser, "wiki"))
+
+	// A LogoutResponse is accepted once.
+	resp, err := browser.Get(idp.service.IDP.LogoutURL.String() + "?" + request.URL.RawQuery)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestService_SingleLogoutWithoutSessionCookie(t *testing.T) {
+	idp := newTestIdP(t)
+	sp, _ := newTestSP(t, idp)
+	idp.register("wiki", sp, nil)
+	sp.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+	browser := newBrowser(t)
+	idp.signIn(t, browser, "wiki")
+
+	// A back-end or cross-site POST carries no cookie; the signed NameID
+	// names the sessions to end.
+	logoutReq, err := sp.ServiceProvider.MakeLogoutRequest(idp.service.IDP.LogoutURL.String(), "alice@example.com")
+	require.NoError(t, err)
+	body, err := logoutReq.Bytes()
+	require.NoError(t, err)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(idp.service.IDP.LogoutURL.String(), url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(body)},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.False(t, idp.signedIn(t, browser, "wiki"))
+
+	// Another service provider cannot end sessions it is not part of.
+	other, _ := newTestSP(t, idp)
+	idp.register("other", other, nil)
+	other.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+	idp.signIn(t, browser, "wiki")
+	logoutReq, err = other.ServiceProvider.MakeLogoutRequest(idp.service.IDP.LogoutURL.String(), "alice@example.com")
+	require.NoError(t, err)
+	body, err = logoutReq.Bytes()
+	require.NoError(t, err)
+	resp, err = client.PostForm(idp.service.IDP.LogoutURL.String(), url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(body)},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.True(t, idp.signedIn(t, browser, "wiki"))
+}
+
+func TestVerifyRedirectSignature(t *testing.T) {
+	key, cert, err := GenerateKeyPair("sp", time.Hour)
+	require.NoError(t, err)
+	signedQuery := func(sigAlg string, hash crypto.Hash) string {
+		query := "SAMLRequest=" + url.QueryEscape("request") + "&RelayState=state&SigAlg=" + url.QueryEscape(sigAlg)
+		h := hash.New()
+		h.Write([]byte(query))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+		require.NoError(t, err)
+		return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	}
+
+	query := signedQuery(dsig.RSASHA256SignatureMethod, crypto.SHA256)
+	assert.NoError(t, verifyRedirectSignature(httptest.NewRequest("GET", "/slo?"+query, nil), "SAMLRequest", cert))
+	assert.Error(t, verifyRedirectSignature(httptest.NewRequest("GET", "/slo?"+strings.Replace(query, "state", "other", 1), nil), "SAMLRequest", cert))
+	assert.Error(t, verifyRedirectSignature(httptest.NewRequest("GET", "/slo?"+signedQuery(dsig.RSASHA1SignatureMethod, crypto.SHA1), nil), "SAMLRequest", cert))
+}
+
+func TestNewServiceProvider(t *testing.T) {
+	_, cert, err := GenerateKeyPair("sp", time.Hour)
+	require.NoError(t, err)
+	certB64 := base64.StdEncoding.EncodeToString(cert.Raw)
+
+	sp, err := newServiceProvider(&types.Application{ID: "app", ProtocolConfig: types.JSONB{
+		"entity_id":   "https://sp.example.com",
+		"acs_url":     []interface{}{"https://sp.example.com/acs", "https://sp.example.com/acs2"},
+		"certificate": certB64,
+	}})
+	require.NoError(t, err)
+	ed := sp.entityDescriptor()
+	require.Len(t, ed.SPSSODescriptors[0].AssertionConsumerServices, 2)
+	require.Len(t, ed.SPSSODescriptors[0].KeyDescriptors, 1)
+	assert.Equal(t, "signing", ed.SPSSODescriptors[0].KeyDescriptors[0].Use)
+	parsed, err := x509.ParseCertificate(cert.Raw)
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(parsed.Raw), ed.SPSSODescriptors[0].KeyDescriptors[0].KeyInfo.X509Data.X509Certificates[0].Data)
+
+	for name, cfg := range map[string]types.JSONB{
+		"missing acs":              {"entity_id": "https://sp.example.com"},
+		"bad name id format":       {"entity_id": "x", "acs_url": "https://sp/acs", "name_id_format": "bogus"},
+		"encryption without a key": {"entity_id": "x", "acs_url": "https://sp/acs", "encrypt_assertions": true},
+		"bad certificate":          {"entity_id": "x", "acs_url": "https://sp/acs", "certificate": "not a cert"},
+	} {
+		_, err := newServiceProvider(&types.Application{ID: "app", ProtocolConfig: cfg})
+		assert.Error(t, err, name)
+	}
+}
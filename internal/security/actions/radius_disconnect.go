@@ -0,0 +1,46 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/turtacn/QuantaID/internal/protocol/radius"
+	"github.com/turtacn/QuantaID/internal/security/automator"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gorm.io/gorm"
+)
+
+// DisconnectRADIUSAction implements the SecurityAction interface to end a user's
+// RADIUS network sessions with Disconnect-Requests to their NAS.
+type DisconnectRADIUSAction struct {
+	db  *gorm.DB
+	dac *radius.DAClient
+}
+
+// NewDisconnectRADIUSAction creates a new instance of DisconnectRADIUSAction.
+func NewDisconnectRADIUSAction(db *gorm.DB, dac *radius.DAClient) *DisconnectRADIUSAction {
+	return &DisconnectRADIUSAction{db: db, dac: dac}
+}
+
+// ID returns the unique identifier for the action.
+func (a *DisconnectRADIUSAction) ID() string {
+	return "radius_disconnect"
+}
+
+// Execute disconnects all active RADIUS accounting sessions of the given user.
+func (a *DisconnectRADIUSAction) Execute(ctx context.Context, input automator.ActionInput) error {
+	if input.UserID == "" {
+		return fmt.Errorf("UserID is required for DisconnectRADIUSAction")
+	}
+
+	var user types.User
+	if err := a.db.WithContext(ctx).Select("username").Where("id = ?", input.UserID).First(&user).Error; err != nil {
+		return fmt.Errorf("failed to find user %s: %w", input.UserID, err)
+	}
+
+	if _, err := a.dac.DisconnectUser(ctx, user.Username); err != nil {
+		return fmt.Errorf("failed to disconnect RADIUS sessions for user %s: %w", input.UserID, err)
+	}
+
+	return nil
+}
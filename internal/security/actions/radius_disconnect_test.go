@@ -0,0 +1,117 @@
+package actions
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/turtacn/QuantaID/internal/protocol/radius"
+	"github.com/turtacn/QuantaID/internal/security/automator"
+	"github.com/turtacn/QuantaID/internal/storage/postgresql/models"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+type accountingSessions []*models.RadiusAccounting
+
+func (s accountingSessions) GetSession(ctx context.Context, sessionID string) (*models.RadiusAccounting, error) {
+	for _, session := range s {
+		if session.SessionID == sessionID {
+			return session, nil
+		}
+	}
+	return nil, types.ErrNotFound
+}
+
+func (s accountingSessions) ActiveSessions(ctx context.Context, username string) ([]*models.RadiusAccounting, error) {
+	var active []*models.RadiusAccounting
+	for _, session := range s {
+		if session.Username == username {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+type staticClients map[string]*radius.RADIUSClient
+
+func (c staticClients) GetByIP(ctx context.Context, ip string) (*radius.RADIUSClient, error) {
+	return c[ip], nil
+}
+
+// disconnectingNAS acknowledges every Disconnect-Request and records the
+// sessions it was asked to end.
+type disconnectingNAS struct {
+	conn   *net.UDPConn
+	secret []byte
+
+	mu    sync.Mutex
+	ended []string
+}
+
+func newDisconnectingNAS(t *testing.T, secret string) *disconnectingNAS {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	nas := &disconnectingNAS{conn: conn, secret: []byte(secret)}
+	go nas.serve()
+	return nas
+}
+
+func (n *disconnectingNAS) serve() {
+	buf := make([]byte, radius.MaxPacketSize)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request, err := radius.ParsePacket(buf[:size], n.secret)
+		if err != nil || request.Code != radius.CodeDisconnectRequest {
+			continue
+		}
+		n.mu.Lock()
+		n.ended = append(n.ended, request.GetString(radius.AttrAcctSessionId))
+		n.mu.Unlock()
+		response := request.CreateResponse(radius.CodeDisconnectACK)
+		response.Authenticator = response.CalculateResponseAuthenticator(request.Authenticator)
+		data, _ := response.Encode()
+		n.conn.WriteToUDP(data, addr)
+	}
+}
+
+func (n *disconnectingNAS) endedSessions() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.ended...)
+}
+
+func TestDisconnectRADIUSAction(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.Exec("CREATE TABLE users (id TEXT PRIMARY KEY, username TEXT)").Error)
+	require.NoError(t, db.Exec("INSERT INTO users (id, username) VALUES ('user-1', 'alice')").Error)
+
+	nas := newDisconnectingNAS(t, "testing123")
+	dac := radius.NewDAClient(accountingSessions{
+		{SessionID: "s-1", Username: "alice", ClientAddress: "127.0.0.1", StatusType: radius.AcctStatusStart},
+		{SessionID: "s-2", Username: "bob", ClientAddress: "127.0.0.1", StatusType: radius.AcctStatusStart},
+	}, staticClients{"127.0.0.1": {IPAddress: "127.0.0.1", Secret: "testing123"}}, radius.NewAttributeCodec(), radius.DAClientConfig{
+		Port:    nas.conn.LocalAddr().(*net.UDPAddr).Port,
+		Timeout: 200 * time.Millisecond,
+	}, zap.NewNop())
+	action := NewDisconnectRADIUSAction(db, dac)
+	assert.Equal(t, "radius_disconnect", action.ID())
+
+	require.NoError(t, action.Execute(context.Background(), automator.ActionInput{UserID: "user-1"}))
+	assert.Equal(t, []string{"s-1"}, nas.endedSessions())
+
+	assert.Error(t, action.Execute(context.Background(), automator.ActionInput{}))
+	assert.Error(t, action.Execute(context.Background(), automator.ActionInput{UserID: "unknown"}))
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/turtacn/QuantaID/internal/domain/auth"
 	"github.com/turtacn/QuantaID/internal/metrics"
+	"github.com/turtacn/QuantaID/internal/server/middleware"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 )
@@ -15,8 +16,16 @@ import (
 type AuthServiceInterface interface {
 	LoginWithPassword(ctx context.Context, req auth.AuthnRequest, serviceConfig auth.Config) (*types.AuthResult, error)
 	VerifyMFAChallenge(ctx context.Context, req *types.VerifyMFARequest, serviceConfig auth.Config) (*types.AuthResult, error)
+	ChangePassword(ctx context.Context, req auth.ChangePasswordRequest) error
+	StartPasswordless(ctx context.Context, req auth.PasswordlessStartRequest) (*auth.PasswordlessStart, error)
+	CompletePasswordless(ctx context.Context, req auth.PasswordlessCompleteRequest, serviceConfig auth.Config) (*types.AuthResult, error)
 }
 
+// passwordlessFlowCookie holds the flow ID of a passwordless login on the
+// device that started it, so that a magic link opened in the same browser
+// completes a same-device login.
+const passwordlessFlowCookie = "qid_passwordless_flow"
+
 // AuthHandlers provides HTTP handlers for authentication-related endpoints.
 type AuthHandlers struct {
 	authService AuthServiceInterface
@@ -38,11 +47,17 @@ func (h *AuthHandlers) Login(w http.ResponseWriter, r *http.Request) {
 		WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
 		return
 	}
+	// Failed logins are counted per source address, which the client must not choose.
+	req.IPAddress = r.RemoteAddr
+	req.UserAgent = r.UserAgent()
 
 	authResult, err := h.authService.LoginWithPassword(r.Context(), req, auth.Config{})
 	if err != nil {
 		metrics.AuthLoginTotal.WithLabelValues("fail").Inc()
 		if appErr, ok := err.(*types.Error); ok {
+			if retryAfter := appErr.Details["retry_after"]; retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
 			WriteJSONError(w, appErr, appErr.HttpStatus)
 		} else {
 			WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
@@ -80,6 +95,119 @@ func (h *AuthHandlers) VerifyMFA(w http.ResponseWriter, r *http.Request) {
 	WriteJSON(w, http.StatusOK, authResult.Token)
 }
 
+// ChangePassword is the HTTP handler for changing a password with the current
+// one, in the session the request was authenticated in. Users whose password
+// expired set a new one here without a session.
+func (h *AuthHandlers) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req auth.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	req.IPAddress = r.RemoteAddr
+	// The session is the one the request was authenticated in, never one the body names.
+	req.UserID, _ = r.Context().Value(middleware.UserIDContextKey).(string)
+	req.SessionID = sessionID(r)
+
+	if err := h.authService.ChangePassword(r.Context(), req); err != nil {
+		if appErr, ok := err.(*types.Error); ok {
+			if retryAfter := appErr.Details["retry_after"]; retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			WriteJSONError(w, appErr, appErr.HttpStatus)
+		} else {
+			WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartPasswordless is the HTTP handler that emails a magic link or a code
+// for a passwordless login.
+func (h *AuthHandlers) StartPasswordless(w http.ResponseWriter, r *http.Request) {
+	var req auth.PasswordlessStartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	req.IPAddress = r.RemoteAddr
+
+	start, err := h.authService.StartPasswordless(r.Context(), req)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	// The cookie is also sent to the confirmation page of the magic link,
+	// which completes a same-device login with it.
+	http.SetCookie(w, &http.Cookie{
+		Name:     passwordlessFlowCookie,
+		Value:    start.FlowID,
+		Path:     "/",
+		MaxAge:   start.ExpiresIn,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	WriteJSON(w, http.StatusAccepted, start)
+}
+
+// CompletePasswordless is the HTTP handler that completes a passwordless
+// login with a JSON body; the flow ID defaults to the one in the cookie set
+// by StartPasswordless. Magic links opened in a browser are completed by the
+// confirmation page of the UI instead, which starts a browser session.
+func (h *AuthHandlers) CompletePasswordless(w http.ResponseWriter, r *http.Request) {
+	var req auth.PasswordlessCompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJSONError(w, types.ErrBadRequest.WithCause(err), http.StatusBadRequest)
+		return
+	}
+	if req.FlowID == "" {
+		if cookie, err := r.Cookie(passwordlessFlowCookie); err == nil {
+			req.FlowID = cookie.Value
+		}
+	}
+	req.IPAddress = r.RemoteAddr
+
+	authResult, err := h.authService.CompletePasswordless(r.Context(), req, auth.Config{})
+	if err != nil {
+		metrics.AuthLoginTotal.WithLabelValues("fail").Inc()
+		writeAuthError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     passwordlessFlowCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if authResult.IsMfaRequired {
+		WriteJSON(w, http.StatusOK, authResult.MFAChallenge)
+		return
+	}
+
+	metrics.AuthLoginTotal.WithLabelValues("success").Inc()
+	WriteJSON(w, http.StatusOK, authResult.Token)
+}
+
+// writeAuthError writes the error of an authentication endpoint, with a
+// Retry-After header for refusals that end.
+func writeAuthError(w http.ResponseWriter, err error) {
+	appErr, ok := err.(*types.Error)
+	if !ok {
+		WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+		return
+	}
+	if retryAfter := appErr.Details["retry_after"]; retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	WriteJSONError(w, appErr, appErr.HttpStatus)
+}
+
 // Logout is the HTTP handler for the user logout endpoint.
 func (h *AuthHandlers) Logout(w http.ResponseWriter, r *http.Request) {
 	// To be implemented
@@ -30,6 +30,27 @@ func (m *MockAuthService) VerifyMFAChallenge(ctx context.Context, req *types.Ver
 	return args.Get(0).(*types.AuthResult), args.Error(1)
 }
 
+func (m *MockAuthService) ChangePassword(ctx context.Context, req auth.ChangePasswordRequest) error {
+	args := m.Called(ctx, req)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) StartPasswordless(ctx context.Context, req auth.PasswordlessStartRequest) (*auth.PasswordlessStart, error) {
+	args := m.Called(ctx, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*auth.PasswordlessStart), args.Error(1)
+}
+
+func (m *MockAuthService) CompletePasswordless(ctx context.Context, req auth.PasswordlessCompleteRequest, serviceConfig auth.Config) (*types.AuthResult, error) {
+	args := m.Called(ctx, req, serviceConfig)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*types.AuthResult), args.Error(1)
+}
+
 func (m *MockAuthService) Logout(ctx context.Context, sessionID, accessToken string) error {
 	args := m.Called(ctx, sessionID, accessToken)
 	return args.Error(0)
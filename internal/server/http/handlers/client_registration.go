@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// registrationPath is where clients register and manage their registrations.
+const registrationPath = "/oauth/register"
+
+// ClientRegistrationHandler serves the dynamic client registration endpoint
+// (RFC 7591) and the client configuration endpoint (RFC 7592).
+type ClientRegistrationHandler struct {
+	registry *oauth.ClientRegistry
+	logger   utils.Logger
+	baseURL  string
+}
+
+// NewClientRegistrationHandler creates a new ClientRegistrationHandler.
+// baseURL is the issuer identifier, used to build each client's
+// registration_client_uri.
+func NewClientRegistrationHandler(registry *oauth.ClientRegistry, logger utils.Logger, baseURL string) *ClientRegistrationHandler {
+	return &ClientRegistrationHandler{
+		registry: registry,
+		logger:   logger,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// RegisterRoutes registers the registration endpoints on the router.
+func (h *ClientRegistrationHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc(registrationPath, h.Register).Methods("POST")
+	router.HandleFunc(registrationPath+"/{clientID}", h.GetClient).Methods("GET")
+	router.HandleFunc(registrationPath+"/{clientID}", h.UpdateClient).Methods("PUT")
+	router.HandleFunc(registrationPath+"/{clientID}", h.DeleteClient).Methods("DELETE")
+}
+
+// Register handles a client registration request. When initial access
+// tokens are configured, the request must carry one as a bearer token.
+func (h *ClientRegistrationHandler) Register(w http.ResponseWriter, r *http.Request) {
+	token, _ := bearerToken(r)
+	if err := h.registry.AuthorizeRegistration(token); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+
+	var req types.ClientMetadata
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRegistrationError(w, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "request body is not valid client metadata"}))
+		return
+	}
+
+	info, err := h.registry.RegisterClient(r.Context(), &req)
+	if err != nil {
+		h.logger.Warn(r.Context(), "Rejected client registration", zap.Error(err))
+		writeRegistrationError(w, err)
+		return
+	}
+	h.logger.Info(r.Context(), "Registered OAuth client", zap.String("client_id", info.ClientID), zap.String("client_name", info.ClientName))
+
+	info.RegistrationClientURI = h.clientURI(r, info.ClientID)
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusCreated, info)
+}
+
+// GetClient returns a client's registration.
+func (h *ClientRegistrationHandler) GetClient(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	token, _ := bearerToken(r)
+	info, err := h.registry.GetClient(r.Context(), clientID, token)
+	if err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+
+	info.RegistrationClientURI = h.clientURI(r, clientID)
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, info)
+}
+
+// UpdateClient replaces a client's registered metadata.
+func (h *ClientRegistrationHandler) UpdateClient(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	token, _ := bearerToken(r)
+
+	var req types.ClientInformation
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRegistrationError(w, types.ErrInvalidClientMetadata.WithDetails(map[string]string{"error": "request body is not valid client metadata"}))
+		return
+	}
+	if req.RegistrationAccessToken != "" || req.RegistrationClientURI != "" || req.ClientIDIssuedAt != 0 || req.ClientSecretExpiresAt != 0 {
+		writeRegistrationError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "server-assigned fields must not be sent"}))
+		return
+	}
+
+	info, err := h.registry.UpdateClient(r.Context(), clientID, token, &req)
+	if err != nil {
+		h.logger.Warn(r.Context(), "Rejected client registration update", zap.Error(err), zap.String("client_id", clientID))
+		writeRegistrationError(w, err)
+		return
+	}
+
+	info.RegistrationClientURI = h.clientURI(r, clientID)
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, info)
+}
+
+// DeleteClient deregisters a client.
+func (h *ClientRegistrationHandler) DeleteClient(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["clientID"]
+	token, _ := bearerToken(r)
+	if err := h.registry.DeleteClient(r.Context(), clientID, token); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+	h.logger.Info(r.Context(), "Deregistered OAuth client", zap.String("client_id", clientID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ClientRegistrationHandler) clientURI(r *http.Request, clientID string) string {
+	return endpointBase(r, h.baseURL) + registrationPath + "/" + clientID
+}
+
+// writeRegistrationError writes a registration error response. Missing or
+// invalid bearer tokens are answered with 401 as RFC 6750 describes.
+func writeRegistrationError(w http.ResponseWriter, err error) {
+	var appErr *types.Error
+	if errors.As(err, &appErr) && appErr.Code == types.ErrInvalidToken.Code {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.Header().Set("Cache-Control", "no-store")
+		WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": appErr.Code})
+		return
+	}
+	writeOAuthError(w, err)
+}
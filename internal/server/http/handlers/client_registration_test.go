@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+func TestClientRegistrationHandler(t *testing.T) {
+	apps := fakeAppRepo{}
+	registry, err := oauth.NewClientRegistry(apps, oauth.ClientRegistryConfig{InitialAccessTokens: []string{"initial-token"}})
+	require.NoError(t, err)
+	router := mux.NewRouter()
+	NewClientRegistrationHandler(registry, utils.NewNoopLogger(), "https://op.example.com").RegisterRoutes(router)
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&buf).Encode(body))
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	metadata := types.ClientMetadata{ClientName: "CLI", RedirectURIs: []string{"https://cli.example.com/cb"}}
+	rr := send("POST", "/oauth/register", "", metadata)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	rr = send("POST", "/oauth/register", "initial-token", types.ClientMetadata{RedirectURIs: []string{"http://cli.example.com/cb"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid_redirect_uri")
+
+	rr = send("POST", "/oauth/register", "initial-token", metadata)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	var info types.ClientInformation
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.Equal(t, "https://op.example.com/oauth/register/"+info.ClientID, info.RegistrationClientURI)
+	assert.NotEmpty(t, info.ClientSecret)
+	require.Contains(t, apps, info.ClientID)
+
+	clientPath := "/oauth/register/" + info.ClientID
+	rr = send("GET", clientPath, "initial-token", nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "the initial access token does not manage clients")
+
+	rr = send("GET", clientPath, info.RegistrationAccessToken, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var got types.ClientInformation
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Empty(t, got.ClientSecret, "only a hash of the secret is stored")
+
+	update := types.ClientInformation{ClientID: info.ClientID, ClientMetadata: metadata}
+	update.ClientName = "CLI v2"
+	rr = send("PUT", clientPath, info.RegistrationAccessToken, update)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "CLI v2", apps[info.ClientID].Name)
+
+	update.RegistrationAccessToken = info.RegistrationAccessToken
+	rr = send("PUT", clientPath, info.RegistrationAccessToken, update)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "server-assigned fields are rejected")
+
+	rr = send("DELETE", clientPath, info.RegistrationAccessToken, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.NotContains(t, apps, info.ClientID)
+}
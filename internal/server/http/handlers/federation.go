@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/auth/federation"
+	"github.com/turtacn/QuantaID/pkg/utils"
+)
+
+// FederationHandlers provides the HTTP endpoints for signing in through
+// upstream identity providers.
+type FederationHandlers struct {
+	federation *federation.Service
+	logger     utils.Logger
+}
+
+// NewFederationHandlers creates a new set of federation handlers.
+func NewFederationHandlers(federation *federation.Service, logger utils.Logger) *FederationHandlers {
+	return &FederationHandlers{
+		federation: federation,
+		logger:     logger,
+	}
+}
+
+// HandleDiscovery performs home realm discovery for the email address in the
+// query, sending the user to their organization's identity provider.
+func (h *FederationHandlers) HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	h.federation.HandleDiscovery(w, r)
+}
+
+// HandleLogin starts a login at the identity provider in the path.
+func (h *FederationHandlers) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	h.federation.BeginLogin(w, r, mux.Vars(r)["providerID"])
+}
+
+// HandleLink starts linking an identity at the provider in the path to the
+// signed-in user's account.
+func (h *FederationHandlers) HandleLink(w http.ResponseWriter, r *http.Request) {
+	h.federation.BeginLink(w, r, mux.Vars(r)["providerID"])
+}
+
+// HandleCallback is the redirect URI registered with upstream OIDC providers.
+func (h *FederationHandlers) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	h.federation.HandleOIDCCallback(w, r, mux.Vars(r)["providerID"])
+}
+
+// HandleACS is the assertion consumer service registered with upstream SAML IdPs.
+func (h *FederationHandlers) HandleACS(w http.ResponseWriter, r *http.Request) {
+	h.federation.HandleSAMLACS(w, r, mux.Vars(r)["providerID"])
+}
+
+// HandleMetadata serves the service provider metadata for an upstream SAML IdP.
+func (h *FederationHandlers) HandleMetadata(w http.ResponseWriter, r *http.Request) {
+	h.federation.HandleSAMLMetadata(w, r, mux.Vars(r)["providerID"])
+}
+
+// RegisterRoutes registers the federation endpoints under /auth/federation.
+// The ACS accepts cross-site POSTs from IdPs and is not CSRF protected; the
+// login state each response must carry takes that role. HandleLink is not
+// registered here, as it needs CSRF protection.
+func (h *FederationHandlers) RegisterRoutes(r *mux.Router) {
+	fed := r.PathPrefix("/auth/federation").Subrouter()
+	fed.HandleFunc("/discover", h.HandleDiscovery).Methods("GET")
+	fed.HandleFunc("/{providerID}/login", h.HandleLogin).Methods("GET")
+	fed.HandleFunc("/{providerID}/callback", h.HandleCallback).Methods("GET")
+	fed.HandleFunc("/{providerID}/acs", h.HandleACS).Methods("POST")
+	fed.HandleFunc("/{providerID}/metadata", h.HandleMetadata).Methods("GET")
+}
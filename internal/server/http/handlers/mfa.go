@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/server/middleware"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// MFAFactorService manages the MFA factors of the signed-in user.
+type MFAFactorService interface {
+	ListMFAFactors(ctx context.Context, userID string) (*auth.MFAFactors, error)
+	EnrollTOTP(ctx context.Context, userID, sessionID string) (*types.MFAEnrollment, error)
+	ConfirmTOTP(ctx context.Context, userID, sessionID, code, ip string) (*auth.TOTPConfirmation, error)
+	RegenerateRecoveryCodes(ctx context.Context, userID, sessionID, ip string) ([]string, error)
+	SetDefaultMFAFactor(ctx context.Context, userID, factorID, ip string) (*mfa.Factor, error)
+	BeginMFAStepUp(ctx context.Context, userID, provider string) (*types.MFAChallenge, error)
+	CompleteMFAStepUp(ctx context.Context, userID, sessionID string, req *types.VerifyMFARequest, ip string) error
+	DeleteMFAFactor(ctx context.Context, userID, sessionID, factorID, ip string) error
+	RegisterPushDevice(ctx context.Context, userID, sessionID, name, token string, publicKey []byte, ip string) (*mfa.Factor, error)
+}
+
+// MFAHandlers serves the /me/mfa resource, with which users enroll and
+// manage their own MFA factors.
+type MFAHandlers struct {
+	service MFAFactorService
+}
+
+// NewMFAHandlers creates new MFA factor handlers.
+func NewMFAHandlers(service MFAFactorService) *MFAHandlers {
+	return &MFAHandlers{service: service}
+}
+
+// RegisterRoutes registers the MFA factor routes on a router for an
+// authenticated path prefix such as /me/mfa.
+func (h *MFAHandlers) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("", h.ListFactors).Methods("GET")
+	r.HandleFunc("/totp", h.EnrollTOTP).Methods("POST")
+	r.HandleFunc("/totp/confirm", h.ConfirmTOTP).Methods("POST")
+	r.HandleFunc("/recovery-codes", h.RegenerateRecoveryCodes).Methods("POST")
+	r.HandleFunc("/default", h.SetDefaultFactor).Methods("PUT")
+	r.HandleFunc("/step-up", h.BeginStepUp).Methods("POST")
+	r.HandleFunc("/step-up/verify", h.CompleteStepUp).Methods("POST")
+	r.HandleFunc("/factors/{id}", h.DeleteFactor).Methods("DELETE")
+	r.HandleFunc("/push/devices", h.RegisterPushDevice).Methods("POST")
+}
+
+// ListFactors returns the enrolled factors and the number of unused recovery codes.
+func (h *MFAHandlers) ListFactors(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	factors, err := h.service.ListMFAFactors(r.Context(), userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, factors)
+}
+
+// EnrollTOTP starts a TOTP enrollment and returns the secret, its
+// provisioning URL and a QR code of the URL.
+func (h *MFAHandlers) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	enrollment, err := h.service.EnrollTOTP(r.Context(), userID, sessionID(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusCreated, enrollment)
+}
+
+// ConfirmTOTP completes a TOTP enrollment with a code from the app.
+func (h *MFAHandlers) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		WriteJSONError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"reason": "code is required"}), http.StatusBadRequest)
+		return
+	}
+	confirmation, err := h.service.ConfirmTOTP(r.Context(), userID, sessionID(r), req.Code, r.RemoteAddr)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, confirmation)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes and returns the new ones.
+func (h *MFAHandlers) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	codes, err := h.service.RegenerateRecoveryCodes(r.Context(), userID, sessionID(r), r.RemoteAddr)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+// SetDefaultFactor makes the factor in the request the default one.
+func (h *MFAHandlers) SetDefaultFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		FactorID string `json:"factor_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FactorID == "" {
+		WriteJSONError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"reason": "factor_id is required"}), http.StatusBadRequest)
+		return
+	}
+	factor, err := h.service.SetDefaultMFAFactor(r.Context(), userID, req.FactorID, r.RemoteAddr)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, factor)
+}
+
+// BeginStepUp challenges the user to verify a factor, optionally of the
+// provider in the request.
+func (h *MFAHandlers) BeginStepUp(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Provider string `json:"provider"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteJSONError(w, types.ErrInvalidRequest.WithCause(err), http.StatusBadRequest)
+			return
+		}
+	}
+	challenge, err := h.service.BeginMFAStepUp(r.Context(), userID, req.Provider)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, challenge)
+}
+
+// CompleteStepUp verifies the answer to a step-up challenge.
+func (h *MFAHandlers) CompleteStepUp(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	var req types.VerifyMFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeID == "" || req.Code == "" {
+		WriteJSONError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"reason": "challenge_id and code are required"}), http.StatusBadRequest)
+		return
+	}
+	if err := h.service.CompleteMFAStepUp(r.Context(), userID, sessionID(r), &req, r.RemoteAddr); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteFactor removes a factor. It needs a recent step-up.
+func (h *MFAHandlers) DeleteFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.service.DeleteMFAFactor(r.Context(), userID, sessionID(r), mux.Vars(r)["id"], r.RemoteAddr); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterPushDevice enrolls a device for push approvals with its push
+// token and the Ed25519 public key it signs its responses with.
+func (h *MFAHandlers) RegisterPushDevice(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name      string `json:"name"`
+		Token     string `json:"token"`
+		PublicKey []byte `json:"public_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || len(req.PublicKey) == 0 {
+		WriteJSONError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"reason": "token and public_key are required"}), http.StatusBadRequest)
+		return
+	}
+	factor, err := h.service.RegisterPushDevice(r.Context(), userID, sessionID(r), req.Name, req.Token, req.PublicKey, r.RemoteAddr)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusCreated, factor)
+}
+
+func (h *MFAHandlers) userID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, ok := r.Context().Value(middleware.UserIDContextKey).(string)
+	if !ok || userID == "" {
+		WriteJSONError(w, types.ErrUnauthorized, http.StatusUnauthorized)
+		return "", false
+	}
+	return userID, true
+}
+
+// sessionID returns the session the request was authenticated in, which
+// step-ups are recorded against. It is empty for tokens without a session.
+func sessionID(r *http.Request) string {
+	id, _ := r.Context().Value(middleware.SessionIDContextKey).(string)
+	return id
+}
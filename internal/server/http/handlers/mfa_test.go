@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/server/middleware"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+type MockMFAFactorService struct {
+	mock.Mock
+}
+
+func (m *MockMFAFactorService) ListMFAFactors(ctx context.Context, userID string) (*auth.MFAFactors, error) {
+	args := m.Called(ctx, userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*auth.MFAFactors), args.Error(1)
+}
+
+func (m *MockMFAFactorService) EnrollTOTP(ctx context.Context, userID, sessionID string) (*types.MFAEnrollment, error) {
+	args := m.Called(ctx, userID, sessionID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*types.MFAEnrollment), args.Error(1)
+}
+
+func (m *MockMFAFactorService) ConfirmTOTP(ctx context.Context, userID, sessionID, code, ip string) (*auth.TOTPConfirmation, error) {
+	args := m.Called(ctx, userID, sessionID, code, ip)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*auth.TOTPConfirmation), args.Error(1)
+}
+
+func (m *MockMFAFactorService) RegenerateRecoveryCodes(ctx context.Context, userID, sessionID, ip string) ([]string, error) {
+	args := m.Called(ctx, userID, sessionID, ip)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockMFAFactorService) SetDefaultMFAFactor(ctx context.Context, userID, factorID, ip string) (*mfa.Factor, error) {
+	args := m.Called(ctx, userID, factorID, ip)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*mfa.Factor), args.Error(1)
+}
+
+func (m *MockMFAFactorService) BeginMFAStepUp(ctx context.Context, userID, provider string) (*types.MFAChallenge, error) {
+	args := m.Called(ctx, userID, provider)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*types.MFAChallenge), args.Error(1)
+}
+
+func (m *MockMFAFactorService) CompleteMFAStepUp(ctx context.Context, userID, sessionID string, req *types.VerifyMFARequest, ip string) error {
+	args := m.Called(ctx, userID, sessionID, req, ip)
+	return args.Error(0)
+}
+
+func (m *MockMFAFactorService) DeleteMFAFactor(ctx context.Context, userID, sessionID, factorID, ip string) error {
+	args := m.Called(ctx, userID, sessionID, factorID, ip)
+	return args.Error(0)
+}
+
+func (m *MockMFAFactorService) RegisterPushDevice(ctx context.Context, userID, sessionID, name, token string, publicKey []byte, ip string) (*mfa.Factor, error) {
+	args := m.Called(ctx, userID, sessionID, name, token, publicKey, ip)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*mfa.Factor), args.Error(1)
+}
+
+func newMFARouter(service MFAFactorService) *mux.Router {
+	router := mux.NewRouter()
+	NewMFAHandlers(service).RegisterRoutes(router.PathPrefix("/me/mfa").Subrouter())
+	return router
+}
+
+func mfaRequest(method, path string, body interface{}, userID string) *http.Request {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	if userID != "" {
+		ctx := context.WithValue(req.Context(), middleware.UserIDContextKey, userID)
+		req = req.WithContext(context.WithValue(ctx, middleware.SessionIDContextKey, "session-1"))
+	}
+	return req
+}
+
+func TestMFAHandlers_RequireUser(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newMFARouter(new(MockMFAFactorService)).ServeHTTP(rr, mfaRequest("GET", "/me/mfa", nil, ""))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestMFAHandlers_EnrollAndConfirmTOTP(t *testing.T) {
+	service := new(MockMFAFactorService)
+	router := newMFARouter(service)
+	service.On("EnrollTOTP", mock.Anything, "user-1", "session-1").Return(&types.MFAEnrollment{Secret: "SECRET", URL: "otpauth://totp/QuantaID:alice"}, nil)
+	service.On("ConfirmTOTP", mock.Anything, "user-1", "session-1", "123456", mock.Anything).Return(&auth.TOTPConfirmation{
+		Factor:        &mfa.Factor{ID: "factor-1", Type: "totp"},
+		RecoveryCodes: []string{"code-1"},
+	}, nil)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("POST", "/me/mfa/totp", nil, "user-1"))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Contains(t, rr.Body.String(), "otpauth://")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("POST", "/me/mfa/totp/confirm", map[string]string{}, "user-1"))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("POST", "/me/mfa/totp/confirm", map[string]string{"code": "123456"}, "user-1"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var confirmation auth.TOTPConfirmation
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &confirmation))
+	assert.Equal(t, []string{"code-1"}, confirmation.RecoveryCodes)
+}
+
+func TestMFAHandlers_DeleteNeedsStepUp(t *testing.T) {
+	service := new(MockMFAFactorService)
+	router := newMFARouter(service)
+	service.On("DeleteMFAFactor", mock.Anything, "user-1", "session-1", "factor-1", mock.Anything).Return(types.ErrStepUpRequired).Once()
+	service.On("CompleteMFAStepUp", mock.Anything, "user-1", "session-1", &types.VerifyMFARequest{ChallengeID: "challenge-1", Code: "123456"}, mock.Anything).Return(nil)
+	service.On("DeleteMFAFactor", mock.Anything, "user-1", "session-1", "factor-1", mock.Anything).Return(nil)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("DELETE", "/me/mfa/factors/factor-1", nil, "user-1"))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "step_up_required")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("POST", "/me/mfa/step-up/verify", map[string]string{"challenge_id": "challenge-1", "code": "123456"}, "user-1"))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("DELETE", "/me/mfa/factors/factor-1", nil, "user-1"))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	service.AssertExpectations(t)
+}
+
+func TestMFAHandlers_RegisterPushDevice(t *testing.T) {
+	service := new(MockMFAFactorService)
+	router := newMFARouter(service)
+	key := bytes.Repeat([]byte{1}, 32)
+	service.On("RegisterPushDevice", mock.Anything, "user-1", "session-1", "Phone", "device-token", key, mock.Anything).Return(&mfa.Factor{ID: "factor-1", Type: "push"}, nil)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("POST", "/me/mfa/push/devices", map[string]string{"name": "Phone"}, "user-1"))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, mfaRequest("POST", "/me/mfa/push/devices", map[string]interface{}{"name": "Phone", "token": "device-token", "public_key": key}, "user-1"))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Contains(t, rr.Body.String(), "factor-1")
+	service.AssertExpectations(t)
+}
@@ -3,20 +3,51 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
 	auth_service "github.com/turtacn/QuantaID/internal/services/auth"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/auth/protocols"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 	"go.uber.org/zap"
 )
 
+// loginPath is the UI login page unauthenticated users are sent to.
+const loginPath = "/auth/login"
+
+// authorizeParams lists the authorization request parameters carried through
+// the login and consent steps.
+var authorizeParams = []string{
+	"response_type", "client_id", "redirect_uri", "scope", "state", "nonce",
+	"code_challenge", "code_challenge_method",
+	"prompt", "max_age", "login_hint", "acr_values",
+}
+
+// PageRenderer renders server-side HTML pages. It is satisfied by ui.Renderer.
+type PageRenderer interface {
+	Render(w http.ResponseWriter, req *http.Request, tmplName string, data interface{})
+}
+
 // OAuthHandler handles OAuth 2.1 requests.
 type OAuthHandler struct {
-	oauthAdapter *protocols.OAuthAdapter
-	logger       utils.Logger
+	oauthAdapter   *protocols.OAuthAdapter
+	oidcAdapter    *protocols.OIDCAdapter
+	crypto         *utils.CryptoManager
+	sessionManager *redis.SessionManager
+	consents       oauth.ConsentRepository
+	renderer       PageRenderer
+	deviceFlow     *oauth.DeviceFlowHandler
+	logger         utils.Logger
 }
 
 // NewOAuthHandlers creates a new OAuthHandler.
@@ -29,75 +60,514 @@ func NewOAuthHandlers(authService *auth_service.ApplicationService, identityServ
 		zap.Any("redisClient", authService.GetRedisClient() != nil),
 		zap.Any("cryptoManager", authService.GetCryptoManager() != nil),
 	)
+	crypto := authService.GetCryptoManager().(*utils.CryptoManager)
 	adapter := protocols.NewOAuthAdapter().(*protocols.OAuthAdapter)
+	adapter.SetLogger(logger)
 	adapter.SetUserRepo(authService.GetUserRepo())
 	adapter.SetAppRepo(authService.GetAppRepo())
 	adapter.SetRedis(authService.GetRedisClient())
-	adapter.SetOIDCAdapter(protocols.NewOIDCAdapter(authService.GetCryptoManager().(*utils.CryptoManager)))
+	adapter.SetCryptoManager(crypto)
+	oidcAdapter := protocols.NewOIDCAdapter(crypto)
+	oidcAdapter.SetUserRepo(authService.GetUserRepo())
+	adapter.SetOIDCAdapter(oidcAdapter)
 
 	return &OAuthHandler{
 		oauthAdapter: adapter,
+		oidcAdapter:  oidcAdapter,
+		crypto:       crypto,
 		logger:       logger,
 	}
 }
 
-// Authorize handles the authorization endpoint.
+// OIDCAdapter returns the OpenID Connect adapter that issues this handler's ID tokens.
+func (h *OAuthHandler) OIDCAdapter() *protocols.OIDCAdapter {
+	return h.oidcAdapter
+}
+
+// SetSessionManager sets the session manager used to resolve the logged-in
+// user and to end the session behind a reused refresh token.
+func (h *OAuthHandler) SetSessionManager(sessionManager *redis.SessionManager) {
+	h.sessionManager = sessionManager
+	h.oauthAdapter.SetSessionRevoker(sessionManager)
+}
+
+// SetConsentRepository sets the store for consents granted to clients.
+func (h *OAuthHandler) SetConsentRepository(consents oauth.ConsentRepository) {
+	h.consents = consents
+}
+
+// SetTokenRepository sets the repository holding the access token deny list,
+// enabling access token revocation.
+func (h *OAuthHandler) SetTokenRepository(repo auth.TokenRepository) {
+	h.oauthAdapter.SetTokenRepository(repo)
+}
+
+// SetTokenFamilyRepository enables refresh token reuse detection. auditor
+// records detected reuse and may be nil.
+func (h *OAuthHandler) SetTokenFamilyRepository(repo auth.TokenFamilyRepository, auditor protocols.RefreshTokenAuditor) {
+	h.oauthAdapter.SetTokenFamilyRepository(repo)
+	if auditor != nil {
+		h.oauthAdapter.SetAuditor(auditor)
+	}
+}
+
+// SetDeviceFlow enables the device authorization endpoint and the device_code grant.
+func (h *OAuthHandler) SetDeviceFlow(deviceFlow *oauth.DeviceFlowHandler) {
+	h.deviceFlow = deviceFlow
+	h.oauthAdapter.SetDeviceFlow(deviceFlow)
+}
+
+// SetRenderer sets the renderer used for the consent page.
+func (h *OAuthHandler) SetRenderer(renderer PageRenderer) {
+	h.renderer = renderer
+}
+
+// Authorize handles the authorization endpoint. The user is identified by the
+// session cookie; users without a session are sent to the login page and
+// returned here afterwards. A consent page is shown unless the user already
+// granted the client every requested scope.
+//
+// The OpenID Connect prompt (none, login, consent), max_age, login_hint and
+// acr_values parameters are honored.
 func (h *OAuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement proper session management to get the user ID
-	req := &types.AuthRequest{
-		Protocol: "oauth",
-		Credentials: map[string]string{
-			"response_type":         r.URL.Query().Get("response_type"),
-			"client_id":             r.URL.Query().Get("client_id"),
-			"redirect_uri":          r.URL.Query().Get("redirect_uri"),
-			"scope":                 r.URL.Query().Get("scope"),
-			"state":                 r.URL.Query().Get("state"),
-			"code_challenge":        r.URL.Query().Get("code_challenge"),
-			"code_challenge_method": r.URL.Query().Get("code_challenge_method"),
-			"user_id":               "test_user",
-		},
-	}
-
-	resp, err := h.oauthAdapter.HandleAuthRequest(r.Context(), req)
+	params := make(map[string]string, len(authorizeParams))
+	for _, name := range authorizeParams {
+		params[name] = r.URL.Query().Get(name)
+	}
+
+	app, err := h.oauthAdapter.ValidateAuthRequest(r.Context(), params)
+	if err != nil {
+		h.logger.Warn(r.Context(), "Rejected authorization request", zap.Error(err), zap.String("client_id", params["client_id"]))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// From here on the redirect_uri is trusted, so errors go back to the client.
+	prompts := strings.Fields(params["prompt"])
+	promptNone := hasValue(prompts, "none")
+	if promptNone && len(prompts) > 1 {
+		redirectError(w, r, params, types.ErrInvalidRequest.Code)
+		return
+	}
+	if _, err := parseMaxAge(params["max_age"]); err != nil {
+		redirectError(w, r, params, types.ErrInvalidRequest.Code)
+		return
+	}
+
+	session := h.currentSession(r)
+	if session == nil || reauthenticationRequired(session, params, prompts) {
+		if promptNone {
+			redirectError(w, r, params, "login_required")
+			return
+		}
+		h.redirectToLogin(w, r, params)
+		return
+	}
+
+	scopes := strings.Fields(params["scope"])
+	consent, err := h.consents.GetConsent(r.Context(), session.UserID, params["client_id"])
+	if err != nil {
+		h.logger.Error(r.Context(), "Failed to load consent", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !consent.Covers(scopes) || hasValue(prompts, "consent") {
+		if promptNone {
+			redirectError(w, r, params, "consent_required")
+			return
+		}
+		h.renderer.Render(w, r, "consent.html", map[string]interface{}{
+			"ClientName": app.Name,
+			"ClientID":   params["client_id"],
+			"Scopes":     scopes,
+			"Params":     params,
+		})
+		return
+	}
+
+	h.issueCode(w, r, session, params)
+}
+
+// Consent handles the consent form submitted from the authorization endpoint.
+func (h *OAuthHandler) Consent(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	params := make(map[string]string, len(authorizeParams))
+	for _, name := range authorizeParams {
+		params[name] = r.PostForm.Get(name)
+	}
+
+	if _, err := h.oauthAdapter.ValidateAuthRequest(r.Context(), params); err != nil {
+		h.logger.Warn(r.Context(), "Rejected consent submission", zap.Error(err), zap.String("client_id", params["client_id"]))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session := h.currentSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.PostForm.Get("action") != "approve" {
+		redirectError(w, r, params, types.ErrAccessDenied.Code)
+		return
+	}
+
+	consent, err := h.consents.GetConsent(r.Context(), session.UserID, params["client_id"])
+	if err != nil {
+		h.logger.Error(r.Context(), "Failed to load consent", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if consent == nil {
+		consent = &oauth.Consent{UserID: session.UserID, ClientID: params["client_id"]}
+	}
+	consent.Grant(strings.Fields(params["scope"]), time.Now().UTC())
+	if err := h.consents.SaveConsent(r.Context(), consent); err != nil {
+		h.logger.Error(r.Context(), "Failed to save consent", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	h.issueCode(w, r, session, params)
+}
+
+// redirectToLogin sends the user to the login page, returning to this
+// authorization request afterwards. prompt=login and max_age are dropped from
+// the return URL since the login that follows satisfies them.
+func (h *OAuthHandler) redirectToLogin(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	returnParams := url.Values{}
+	for name, value := range params {
+		if value != "" && name != "max_age" {
+			returnParams.Set(name, value)
+		}
+	}
+	var prompts []string
+	for _, p := range strings.Fields(params["prompt"]) {
+		if p != "login" {
+			prompts = append(prompts, p)
+		}
+	}
+	if len(prompts) > 0 {
+		returnParams.Set("prompt", strings.Join(prompts, " "))
+	} else {
+		returnParams.Del("prompt")
+	}
+
+	loginParams := url.Values{"return_to": {r.URL.Path + "?" + returnParams.Encode()}}
+	if params["login_hint"] != "" {
+		loginParams.Set("login_hint", params["login_hint"])
+	}
+	http.Redirect(w, r, loginPath+"?"+loginParams.Encode(), http.StatusFound)
+}
+
+// reauthenticationRequired reports whether the request demands a fresher
+// or stronger login than the session holds. A session meeting none of the
+// requested acr values must log in again, stepping up to one of them.
+func reauthenticationRequired(session *types.UserSession, params map[string]string, prompts []string) bool {
+	if hasValue(prompts, "login") {
+		return true
+	}
+	if required := mfa.RequiredACR(strings.Fields(params["acr_values"])); required != "" && !mfa.SatisfiesACR(session.ACR, required) {
+		return true
+	}
+	maxAge, _ := parseMaxAge(params["max_age"])
+	return maxAge >= 0 && time.Since(sessionAuthTime(session)) > time.Duration(maxAge)*time.Second
+}
+
+// parseMaxAge parses the max_age parameter, returning -1 when it is absent.
+func parseMaxAge(value string) (int64, error) {
+	if value == "" {
+		return -1, nil
+	}
+	maxAge, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || maxAge < 0 {
+		return 0, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "invalid max_age"})
+	}
+	return maxAge, nil
+}
+
+// sessionAuthTime returns when the session's user authenticated. Sessions
+// created before auth times were recorded fall back to their creation time.
+func sessionAuthTime(session *types.UserSession) time.Time {
+	if session.AuthTime.IsZero() {
+		return session.CreatedAt
+	}
+	return session.AuthTime
+}
+
+func hasValue(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// issueCode mints an authorization code for the session's user and redirects
+// back to the client. The code records how the user authenticated so the ID
+// token can report it.
+func (h *OAuthHandler) issueCode(w http.ResponseWriter, r *http.Request, session *types.UserSession, params map[string]string) {
+	authn := &protocols.AuthenticationContext{
+		AuthTime:  sessionAuthTime(session),
+		ACR:       mfa.SelectACR(session.ACR, strings.Fields(params["acr_values"])),
+		AMR:       session.AuthMethods,
+		SessionID: session.ID,
+	}
+
+	credentials := make(map[string]string, len(params)+4)
+	for k, v := range params {
+		credentials[k] = v
+	}
+	for k, v := range authn.Credentials() {
+		credentials[k] = v
+	}
+	credentials["user_id"] = session.UserID
+
+	resp, err := h.oauthAdapter.HandleAuthRequest(r.Context(), &types.AuthRequest{
+		Protocol:    "oauth",
+		Credentials: credentials,
+	})
 	if err != nil {
 		h.logger.Error(r.Context(), "Error handling auth request", zap.Error(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	redirectURL := resp.RedirectURI + "?code=" + resp.Code + "&state=" + resp.State
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	redirectWithParams(w, r, resp.RedirectURI, url.Values{
+		"code":  {resp.Code},
+		"state": {resp.State},
+	})
+}
+
+// currentSession returns the session identified by the session cookie, or nil.
+func (h *OAuthHandler) currentSession(r *http.Request) *types.UserSession {
+	if h.sessionManager == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(redis.SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	session, err := h.sessionManager.GetSession(r.Context(), cookie.Value, r)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+// redirectError returns an authorization error to the client's redirect_uri.
+func redirectError(w http.ResponseWriter, r *http.Request, params map[string]string, code string) {
+	redirectWithParams(w, r, params["redirect_uri"], url.Values{
+		"error": {code},
+		"state": {params["state"]},
+	})
 }
 
-// Token handles the token endpoint.
+// redirectWithParams redirects to target with params merged into its query string.
+func redirectWithParams(w http.ResponseWriter, r *http.Request, target string, params url.Values) {
+	u, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, vs := range params {
+		if len(vs) > 0 && vs[0] != "" {
+			q.Set(k, vs[0])
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Token handles the token endpoint. Clients may authenticate with
+// client_secret_basic, client_secret_post or private_key_jwt.
 func (h *OAuthHandler) Token(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, types.ErrInvalidRequest)
+		return
+	}
 
+	creds := clientCredentials(r)
 	req := types.TokenRequest{
-		GrantType:    r.Form.Get("grant_type"),
-		Code:         r.Form.Get("code"),
-		RedirectURI:  r.Form.Get("redirect_uri"),
-		ClientID:     r.Form.Get("client_id"),
-		ClientSecret: r.Form.Get("client_secret"),
-		CodeVerifier: r.Form.Get("code_verifier"),
-		RefreshToken: r.Form.Get("refresh_token"),
+		GrantType:           r.PostForm.Get("grant_type"),
+		Code:                r.PostForm.Get("code"),
+		RedirectURI:         r.PostForm.Get("redirect_uri"),
+		ClientID:            creds.ClientID,
+		ClientSecret:        creds.ClientSecret,
+		ClientAssertionType: creds.ClientAssertionType,
+		ClientAssertion:     creds.ClientAssertion,
+		CodeVerifier:        r.PostForm.Get("code_verifier"),
+		RefreshToken:        r.PostForm.Get("refresh_token"),
+		DeviceCode:          r.PostForm.Get("device_code"),
 	}
 
 	resp, err := h.oauthAdapter.HandleTokenRequest(r.Context(), &req)
 	if err != nil {
-		h.logger.Error(r.Context(), "Error handling token request", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.logger.Warn(r.Context(), "Error handling token request", zap.Error(err), zap.String("client_id", req.ClientID))
+		writeOAuthError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	WriteJSON(w, http.StatusOK, resp)
+}
+
+// DeviceAuthorization handles the device authorization endpoint (RFC 8628
+// section 3.1). Devices are usually public clients and identify themselves by
+// client_id alone; confidential clients must authenticate.
+func (h *OAuthHandler) DeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if h.deviceFlow == nil {
+		writeOAuthError(w, types.ErrUnsupportedGrantType)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, types.ErrInvalidRequest)
+		return
+	}
+
+	client, err := h.oauthAdapter.AuthenticateClient(r.Context(), clientCredentials(r))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	if !client.AllowsGrantType(oauth.DeviceCodeGrantType) {
+		writeOAuthError(w, types.ErrUnauthorizedClient.WithDetails(map[string]string{"error": "client is not registered for the device_code grant"}))
+		return
+	}
+
+	resp, err := h.deviceFlow.HandleDeviceAuthorizationRequest(r.Context(), client.ID, r.PostForm.Get("scope"))
+	if err != nil {
+		h.logger.Error(r.Context(), "Error handling device authorization request", zap.Error(err), zap.String("client_id", client.ID))
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, resp)
+}
+
+// Introspect handles the token introspection endpoint (RFC 7662). Only
+// confidential clients, such as resource servers and gateways, may call it.
+func (h *OAuthHandler) Introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, types.ErrInvalidRequest)
+		return
+	}
+
+	client, err := h.oauthAdapter.AuthenticateClient(r.Context(), clientCredentials(r))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	if client.IsPublic() {
+		writeOAuthError(w, types.ErrInvalidClient.WithDetails(map[string]string{"error": "public clients cannot introspect tokens"}))
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "token is required"}))
+		return
+	}
+
+	info, err := h.oauthAdapter.IntrospectToken(r.Context(), token, r.PostForm.Get("token_type_hint"))
+	if err != nil {
+		h.logger.Error(r.Context(), "Error introspecting token", zap.Error(err), zap.String("client_id", client.ID))
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, info)
 }
 
-func (h *OAuthHandler) Discovery(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
+// Revoke handles the token revocation endpoint (RFC 7009). Public clients may
+// revoke their own tokens by client_id. Unknown tokens are answered with 200.
+func (h *OAuthHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, types.ErrInvalidRequest)
+		return
+	}
+
+	client, err := h.oauthAdapter.AuthenticateClient(r.Context(), clientCredentials(r))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "token is required"}))
+		return
+	}
+
+	if err := h.oauthAdapter.RevokeToken(r.Context(), token, r.PostForm.Get("token_type_hint"), client.ID); err != nil {
+		h.logger.Warn(r.Context(), "Error revoking token", zap.Error(err), zap.String("client_id", client.ID))
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
 }
 
+// clientCredentials extracts client authentication from a parsed form request:
+// HTTP Basic, the client_id/client_secret form fields, or a client assertion.
+func clientCredentials(r *http.Request) protocols.ClientCredentials {
+	creds := protocols.ClientCredentials{
+		ClientID:            r.PostForm.Get("client_id"),
+		ClientSecret:        r.PostForm.Get("client_secret"),
+		ClientAssertionType: r.PostForm.Get("client_assertion_type"),
+		ClientAssertion:     r.PostForm.Get("client_assertion"),
+	}
+	if id, secret, ok := r.BasicAuth(); ok {
+		// RFC 6749 section 2.3.1: the credentials are form-encoded before base64 encoding.
+		creds.ClientID, creds.ClientSecret = formUnescape(id), formUnescape(secret)
+	}
+	return creds
+}
+
+func formUnescape(s string) string {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// writeOAuthError writes an RFC 6749 section 5.2 error response. Client
+// errors are answered with 400, except invalid_client which is 401.
+func writeOAuthError(w http.ResponseWriter, err error) {
+	var appErr *types.Error
+	if !errors.As(err, &appErr) {
+		appErr = types.ErrInternal
+	}
+	status := appErr.HttpStatus
+	if status < http.StatusInternalServerError && status != http.StatusUnauthorized {
+		status = http.StatusBadRequest
+	}
+
+	body := map[string]string{"error": appErr.Code}
+	if description := appErr.Details["error"]; description != "" {
+		body["error_description"] = description
+	}
+	if appErr.Code == types.ErrInvalidClient.Code {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, status, body)
+}
+
+// JWKS handles the JSON Web Key Set endpoint. It publishes every key that may
+// still verify a live token: the active key, the next key, and retained retired keys.
 func (h *OAuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.crypto.JWKS())
 }
@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/auth/protocols"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+)
+
+type fakeAppRepo map[string]*types.Application
+
+func (r fakeAppRepo) GetApplicationByClientID(ctx context.Context, clientID string) (*types.Application, error) {
+	if app, ok := r[clientID]; ok {
+		return app, nil
+	}
+	return nil, fmt.Errorf("client %s not found", clientID)
+}
+func (r fakeAppRepo) CreateApplication(ctx context.Context, app *types.Application) error {
+	r[app.ID] = app
+	return nil
+}
+func (r fakeAppRepo) GetApplicationByID(ctx context.Context, id string) (*types.Application, error) {
+	return nil, nil
+}
+func (r fakeAppRepo) GetApplicationByName(ctx context.Context, name string) (*types.Application, error) {
+	return nil, nil
+}
+func (r fakeAppRepo) UpdateApplication(ctx context.Context, app *types.Application) error {
+	r[app.ID] = app
+	return nil
+}
+func (r fakeAppRepo) DeleteApplication(ctx context.Context, id string) error {
+	delete(r, id)
+	return nil
+}
+func (r fakeAppRepo) ListApplications(ctx context.Context, pq types.PaginationQuery) ([]*types.Application, error) {
+	return nil, nil
+}
+
+type recordingRenderer struct{ rendered string }
+
+func (r *recordingRenderer) Render(w http.ResponseWriter, req *http.Request, tmplName string, data interface{}) {
+	r.rendered = tmplName
+	w.WriteHeader(http.StatusOK)
+}
+
+type authorizeFixture struct {
+	handler  *OAuthHandler
+	sessions *redis.SessionManager
+	consents oauth.ConsentRepository
+	renderer *recordingRenderer
+	userID   string
+}
+
+func newAuthorizeFixture(t *testing.T) *authorizeFixture {
+	mr := miniredis.RunT(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+	logger := utils.NewNoopLogger()
+
+	adapter := protocols.NewOAuthAdapter().(*protocols.OAuthAdapter)
+	adapter.SetLogger(logger)
+	adapter.SetRedis(client)
+	adapter.SetAppRepo(fakeAppRepo{"rp": {
+		Name:       "Relying Party",
+		ClientType: types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{
+			"redirect_uris": []string{"https://rp.example.com/cb"},
+			"client_secret": "rp-secret",
+		},
+	}})
+
+	f := &authorizeFixture{
+		sessions: redis.NewSessionManager(client, redis.SessionConfig{DefaultTTL: time.Hour}, zap.NewNop(),
+			&redis.GoogleUUIDGenerator{}, &redis.RealClock{}, redis.NewMetrics("oauth_test", prometheus.NewRegistry())),
+		consents: redis.NewRedisConsentRepository(client),
+		renderer: &recordingRenderer{},
+		userID:   "user-1",
+	}
+	f.handler = &OAuthHandler{oauthAdapter: adapter, logger: logger}
+	f.handler.SetSessionManager(f.sessions)
+	f.handler.SetConsentRepository(f.consents)
+	f.handler.SetRenderer(f.renderer)
+	return f
+}
+
+// authorize sends an authorization request with the given extra parameters,
+// carrying the session cookie when sessionID is set.
+func (f *authorizeFixture) authorize(sessionID string, extra url.Values) *httptest.ResponseRecorder {
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"rp"},
+		"redirect_uri":  {"https://rp.example.com/cb"},
+		"scope":         {"openid profile"},
+		"state":         {"af0ifjsldkj"},
+	}
+	for k, v := range extra {
+		q[k] = v
+	}
+	req := httptest.NewRequest("GET", "/oauth/authorize?"+q.Encode(), nil)
+	if sessionID != "" {
+		req.AddCookie(&http.Cookie{Name: redis.SessionCookieName, Value: sessionID})
+	}
+	rr := httptest.NewRecorder()
+	f.handler.Authorize(rr, req)
+	return rr
+}
+
+func (f *authorizeFixture) login(t *testing.T, grantConsent bool) *types.UserSession {
+	return f.loginAt(t, grantConsent, []string{"pwd"}, mfa.ACRPassword)
+}
+
+// loginAt starts a session authenticated with the given amr and acr.
+func (f *authorizeFixture) loginAt(t *testing.T, grantConsent bool, amr []string, acr string) *types.UserSession {
+	ctx := context.Background()
+	session, err := f.sessions.CreateSession(ctx, f.userID, nil, redis.WithAuthentication(amr, acr))
+	require.NoError(t, err)
+	if grantConsent {
+		consent := &oauth.Consent{UserID: f.userID, ClientID: "rp"}
+		consent.Grant([]string{"openid", "profile"}, time.Now())
+		require.NoError(t, f.consents.SaveConsent(ctx, consent))
+	}
+	return session
+}
+
+func redirectQuery(t *testing.T, rr *httptest.ResponseRecorder) (*url.URL, url.Values) {
+	require.Equal(t, http.StatusFound, rr.Code)
+	u, err := url.Parse(rr.Header().Get("Location"))
+	require.NoError(t, err)
+	return u, u.Query()
+}
+
+func TestOAuthHandler_Authorize_PromptNone(t *testing.T) {
+	f := newAuthorizeFixture(t)
+
+	u, q := redirectQuery(t, f.authorize("", url.Values{"prompt": {"none"}}))
+	assert.Equal(t, "rp.example.com", u.Host)
+	assert.Equal(t, "login_required", q.Get("error"))
+	assert.Equal(t, "af0ifjsldkj", q.Get("state"))
+
+	session := f.login(t, false)
+	_, q = redirectQuery(t, f.authorize(session.ID, url.Values{"prompt": {"none"}}))
+	assert.Equal(t, "consent_required", q.Get("error"))
+
+	_, q = redirectQuery(t, f.authorize(session.ID, url.Values{"prompt": {"none login"}}))
+	assert.Equal(t, "invalid_request", q.Get("error"))
+}
+
+func TestOAuthHandler_Authorize_LoginRedirect(t *testing.T) {
+	f := newAuthorizeFixture(t)
+
+	u, q := redirectQuery(t, f.authorize("", url.Values{"login_hint": {"alice"}, "max_age": {"60"}}))
+	assert.Equal(t, "/auth/login", u.Path)
+	assert.Equal(t, "alice", q.Get("login_hint"))
+	returnTo, err := url.Parse(q.Get("return_to"))
+	require.NoError(t, err)
+	assert.Equal(t, "/oauth/authorize", returnTo.Path)
+	assert.Equal(t, "rp", returnTo.Query().Get("client_id"))
+	assert.Empty(t, returnTo.Query().Get("max_age"), "max_age is satisfied by the login that follows")
+
+	// prompt=login forces a fresh login even with a session, and is dropped from the return URL.
+	session := f.login(t, true)
+	u, q = redirectQuery(t, f.authorize(session.ID, url.Values{"prompt": {"login consent"}}))
+	assert.Equal(t, "/auth/login", u.Path)
+	returnTo, err = url.Parse(q.Get("return_to"))
+	require.NoError(t, err)
+	assert.Equal(t, "consent", returnTo.Query().Get("prompt"))
+}
+
+func TestOAuthHandler_Authorize_ConsentAndCode(t *testing.T) {
+	f := newAuthorizeFixture(t)
+	session := f.login(t, true)
+
+	// Consent already covers the scopes: a code is issued without a prompt.
+	u, q := redirectQuery(t, f.authorize(session.ID, nil))
+	assert.Equal(t, "rp.example.com", u.Host)
+	assert.NotEmpty(t, q.Get("code"))
+	assert.Equal(t, "af0ifjsldkj", q.Get("state"))
+
+	// prompt=consent shows the consent page anyway.
+	rr := f.authorize(session.ID, url.Values{"prompt": {"consent"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "consent.html", f.renderer.rendered)
+
+	// A scope that was never granted needs consent.
+	f.renderer.rendered = ""
+	rr = f.authorize(session.ID, url.Values{"scope": {"openid email"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "consent.html", f.renderer.rendered)
+}
+
+// TestOAuthHandler_Authorize_ACRValues follows an authorization request with
+// acr_values through the flow an OpenID Connect relying party sees: a session
+// below the requested acr is sent to log in again (or gets login_required with
+// prompt=none), and the ID token of a session meeting it reports the acr.
+func TestOAuthHandler_Authorize_ACRValues(t *testing.T) {
+	f := newAuthorizeFixture(t)
+	crypto := utils.NewCryptoManager("test-secret")
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{Username: "alice", Status: types.UserStatusActive}
+	require.NoError(t, users.CreateUser(context.Background(), user))
+	f.userID = user.ID
+	oidc := protocols.NewOIDCAdapter(crypto)
+	oidc.SetUserRepo(users)
+	f.handler.oauthAdapter.SetCryptoManager(crypto)
+	f.handler.oauthAdapter.SetUserRepo(users)
+	f.handler.oauthAdapter.SetOIDCAdapter(oidc)
+	f.handler.SetTokenRepository(memory.NewAuthMemoryRepository())
+	acrValues := url.Values{"acr_values": {mfa.ACRMFA}, "nonce": {"n-0S6"}}
+
+	password := f.login(t, true)
+	u, q := redirectQuery(t, f.authorize(password.ID, acrValues))
+	assert.Equal(t, "/auth/login", u.Path)
+	returnTo, err := url.Parse(q.Get("return_to"))
+	require.NoError(t, err)
+	assert.Equal(t, mfa.ACRMFA, returnTo.Query().Get("acr_values"), "the login steps up to the requested acr")
+
+	promptNone := url.Values{"prompt": {"none"}}
+	for k, v := range acrValues {
+		promptNone[k] = v
+	}
+	_, q = redirectQuery(t, f.authorize(password.ID, promptNone))
+	assert.Equal(t, "login_required", q.Get("error"))
+
+	stepped := f.loginAt(t, true, []string{"pwd", "otp"}, mfa.ACRMFA)
+	u, q = redirectQuery(t, f.authorize(stepped.ID, acrValues))
+	assert.Equal(t, "rp.example.com", u.Host)
+	require.NotEmpty(t, q.Get("code"))
+
+	rr := postForm(f.handler.Token, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {q.Get("code")},
+		"redirect_uri": {"https://rp.example.com/cb"},
+	})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var tokens types.TokenResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &tokens))
+	claims, err := crypto.ValidateJWT(tokens.IDToken)
+	require.NoError(t, err)
+	assert.Equal(t, mfa.ACRMFA, claims["acr"])
+	assert.Equal(t, []interface{}{"pwd", "otp"}, claims["amr"])
+	assert.Equal(t, "n-0S6", claims["nonce"])
+}
+
+func TestReauthenticationRequired(t *testing.T) {
+	session := &types.UserSession{AuthTime: time.Now().Add(-10 * time.Minute)}
+
+	assert.False(t, reauthenticationRequired(session, map[string]string{}, nil))
+	assert.True(t, reauthenticationRequired(session, map[string]string{}, []string{"login"}))
+	assert.True(t, reauthenticationRequired(session, map[string]string{"max_age": "300"}, nil))
+	assert.False(t, reauthenticationRequired(session, map[string]string{"max_age": "3600"}, nil))
+	assert.True(t, reauthenticationRequired(session, map[string]string{"acr_values": mfa.ACRMFA}, nil))
+	session.ACR = mfa.ACRPhishingResistant
+	assert.False(t, reauthenticationRequired(session, map[string]string{"acr_values": mfa.ACRMFA}, nil))
+	assert.False(t, reauthenticationRequired(session, map[string]string{"acr_values": "urn:example:unknown"}, nil))
+
+	_, err := parseMaxAge("-1")
+	assert.Error(t, err)
+}
+
+// postForm sends a client-authenticated form POST to handler.
+func postForm(handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("rp", "rp-secret")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestOAuthHandler_IntrospectAndRevoke(t *testing.T) {
+	f := newAuthorizeFixture(t)
+	f.handler.oauthAdapter.SetCryptoManager(utils.NewCryptoManager("test-secret"))
+	f.handler.SetTokenRepository(memory.NewAuthMemoryRepository())
+
+	rr := postForm(f.handler.Token, url.Values{"grant_type": {"client_credentials"}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var tokens types.TokenResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &tokens))
+
+	introspect := func() types.TokenIntrospection {
+		rr := postForm(f.handler.Introspect, url.Values{"token": {tokens.AccessToken}})
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+		var info types.TokenIntrospection
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+		return info
+	}
+
+	info := introspect()
+	assert.True(t, info.Active)
+	assert.Equal(t, "rp", info.ClientID)
+	assert.Equal(t, "Bearer", info.TokenType)
+
+	rr = postForm(f.handler.Revoke, url.Values{"token": {tokens.AccessToken}, "token_type_hint": {"access_token"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Body.String())
+	assert.False(t, introspect().Active)
+
+	// Introspection requires client authentication.
+	req := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"token": {tokens.AccessToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	f.handler.Introspect(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+}
+
+func TestOAuthHandler_DeviceAuthorizationGrant(t *testing.T) {
+	ctx := context.Background()
+	f := newAuthorizeFixture(t)
+	crypto := utils.NewCryptoManager("test-secret")
+	f.handler.oauthAdapter.SetCryptoManager(crypto)
+	f.handler.oauthAdapter.SetOIDCAdapter(protocols.NewOIDCAdapter(crypto))
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{Username: "alice"}
+	require.NoError(t, users.CreateUser(ctx, user))
+	f.handler.oauthAdapter.SetUserRepo(users)
+
+	mr := miniredis.RunT(t)
+	devices := redis.NewRedisDeviceCodeRepository(redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})))
+	deviceFlow := oauth.NewDeviceFlowHandler(devices, nil, oauth.DeviceFlowConfig{VerificationURI: "https://op.example.com/device"})
+	f.handler.SetDeviceFlow(deviceFlow)
+
+	rr := postForm(f.handler.DeviceAuthorization, url.Values{"scope": {"openid profile"}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	var authz oauth.DeviceAuthorizationResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &authz))
+	assert.NotEmpty(t, authz.DeviceCode)
+	assert.Regexp(t, `^[A-Z]{4}-[A-Z]{4}$`, authz.UserCode)
+	assert.Equal(t, "https://op.example.com/device?user_code="+authz.UserCode, authz.VerificationURIComplete)
+	assert.Equal(t, 5, authz.Interval)
+
+	poll := func() *httptest.ResponseRecorder {
+		return postForm(f.handler.Token, url.Values{"grant_type": {oauth.DeviceCodeGrantType}, "device_code": {authz.DeviceCode}})
+	}
+	oauthError := func(rr *httptest.ResponseRecorder) string {
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		return body["error"]
+	}
+	// allowNextPoll moves the previous poll back past the polling interval.
+	allowNextPoll := func() {
+		require.NoError(t, devices.Update(ctx, authz.DeviceCode, map[string]interface{}{"last_polled_at": time.Now().Add(-time.Minute)}))
+	}
+
+	rr = poll()
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "authorization_pending", oauthError(rr))
+
+	rr = poll()
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "slow_down", oauthError(rr))
+
+	session := f.login(t, false)
+	require.NoError(t, deviceFlow.ActivateDeviceCodeForSession(ctx, authz.UserCode, user.ID, session.ID, session.AuthTime))
+
+	allowNextPoll()
+	rr = poll()
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var tokens types.TokenResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &tokens))
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, "openid profile", tokens.Scope)
+
+	// Device codes are single use.
+	rr = poll()
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "invalid_grant", oauthError(rr))
+}
@@ -2,74 +2,189 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
 	"github.com/turtacn/QuantaID/pkg/auth/protocols"
+	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 	"go.uber.org/zap"
 )
 
+// clientAuthMethods are the client authentication methods accepted at the
+// token, introspection and revocation endpoints.
+var clientAuthMethods = []string{"client_secret_basic", "client_secret_post", "private_key_jwt"}
+
+// clientAuthSigningAlgs are the algorithms accepted for private_key_jwt assertions.
+var clientAuthSigningAlgs = protocols.ClientAssertionSigningAlgs
+
 // OIDCHandler handles OIDC requests.
 type OIDCHandler struct {
 	oidcAdapter *protocols.OIDCAdapter
 	logger      utils.Logger
 	baseURL     string
+	deviceFlow   bool
+	registration bool
 }
 
-// NewOIDCHandler creates a new OIDCHandler.
+// NewOIDCHandler creates a new OIDCHandler. baseURL is the issuer identifier;
+// when it is not an absolute URL, endpoints are advertised on the host the
+// discovery request was received on.
 func NewOIDCHandler(oidcAdapter *protocols.OIDCAdapter, logger utils.Logger, baseURL string) *OIDCHandler {
 	return &OIDCHandler{
 		oidcAdapter: oidcAdapter,
 		logger:      logger,
-		baseURL:     baseURL,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
 	}
 }
 
-// UserInfo handles the userinfo endpoint.
+// EnableDeviceFlow advertises the device authorization endpoint and grant.
+func (h *OIDCHandler) EnableDeviceFlow() {
+	h.deviceFlow = true
+}
+
+// EnableRegistration advertises the dynamic client registration endpoint.
+func (h *OIDCHandler) EnableRegistration() {
+	h.registration = true
+}
+
+// UserInfo handles the userinfo endpoint. The access token is accepted in the
+// Authorization header or, for POST requests, the access_token form field.
 func (h *OIDCHandler) UserInfo(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
+	accessToken, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="userinfo"`)
 		http.Error(w, "Authorization header required", http.StatusUnauthorized)
 		return
 	}
 
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-		http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
-		return
-	}
-	accessToken := parts[1]
-
 	userInfo, err := h.oidcAdapter.GetUserInfo(r.Context(), accessToken)
 	if err != nil {
+		var appErr *types.Error
+		if errors.As(err, &appErr) && appErr.Code == types.ErrInvalidToken.Code {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, appErr.Message, http.StatusUnauthorized)
+			return
+		}
 		h.logger.Error(r.Context(), "Error getting user info", zap.Error(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	json.NewEncoder(w).Encode(userInfo)
 }
 
-// Discovery handles the .well-known/openid-configuration endpoint.
+// bearerToken extracts an RFC 6750 bearer token from the request.
+func bearerToken(r *http.Request) (string, bool) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] == "" {
+			return "", false
+		}
+		return parts[1], true
+	}
+	if r.Method == http.MethodPost {
+		if token := r.PostFormValue("access_token"); token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// Discovery handles the .well-known/openid-configuration endpoint. Scopes and
+// claims are taken from the claims mapper's rules, and the signing algorithm
+// from the active signing key.
 func (h *OIDCHandler) Discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.metadata(r))
+}
+
+// AuthorizationServerMetadata handles the OAuth 2.0 authorization server
+// metadata endpoint (RFC 8414) for clients that do not use OpenID Connect.
+// The OpenID Connect fields are valid metadata too, so the document is the
+// same as the discovery document.
+func (h *OIDCHandler) AuthorizationServerMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.metadata(r))
+}
+
+// metadata returns the provider metadata advertised by Discovery and
+// AuthorizationServerMetadata.
+func (h *OIDCHandler) metadata(r *http.Request) map[string]interface{} {
+	base := h.endpointBase(r)
+	issuer := h.baseURL
+	if issuer == "" {
+		issuer = base
+	}
+
+	scopes := []string{"openid"}
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "azp", "at_hash"}
+	if mapper := h.oidcAdapter.ClaimsMapper(); mapper != nil {
+		scopes = append(scopes, mapper.Scopes()...)
+		claims = append(claims, mapper.Claims()...)
+	}
+
 	discovery := map[string]interface{}{
-		"issuer":                 h.baseURL,
-		"authorization_endpoint": h.baseURL + "/oauth/authorize",
-		"token_endpoint":         h.baseURL + "/oauth/token",
-		"userinfo_endpoint":      h.baseURL + "/oauth/userinfo",
-		"jwks_uri":               h.baseURL + "/.well-known/jwks.json",
-		"response_types_supported": []string{"code"},
-		"subject_types_supported":  []string{"public"},
-		"id_token_signing_alg_values_supported": []string{"RS256"},
-		"scopes_supported":       []string{"openid", "profile", "email"},
-		"token_endpoint_auth_methods_supported": []string{"client_secret_post"},
-		"claims_supported":       []string{"sub", "iss", "aud", "exp", "iat", "name", "email", "email_verified"},
+		"issuer":                                                   issuer,
+		"authorization_endpoint":                                   base + "/oauth/authorize",
+		"token_endpoint":                                           base + "/oauth/token",
+		"userinfo_endpoint":                                        base + "/oauth/userinfo",
+		"jwks_uri":                                                 base + "/.well-known/jwks.json",
+		"response_types_supported":                                 []string{"code"},
+		"response_modes_supported":                                 []string{"query"},
+		"grant_types_supported":                                    []string{"authorization_code", "refresh_token", "client_credentials"},
+		"subject_types_supported":                                  []string{"public"},
+		"id_token_signing_alg_values_supported":                    []string{h.oidcAdapter.SigningAlgorithm()},
+		"scopes_supported":                                         scopes,
+		"claims_supported":                                         claims,
+		"acr_values_supported":                                     mfa.SupportedACRValues,
+		"prompt_values_supported":                                  []string{"none", "login", "consent"},
+		"introspection_endpoint":                                   base + "/oauth/introspect",
+		"revocation_endpoint":                                      base + "/oauth/revoke",
+		"token_endpoint_auth_methods_supported":                    clientAuthMethods,
+		"token_endpoint_auth_signing_alg_values_supported":         clientAuthSigningAlgs,
+		"introspection_endpoint_auth_methods_supported":            clientAuthMethods,
+		"introspection_endpoint_auth_signing_alg_values_supported": clientAuthSigningAlgs,
+		"revocation_endpoint_auth_methods_supported":               clientAuthMethods,
+		"revocation_endpoint_auth_signing_alg_values_supported":    clientAuthSigningAlgs,
+		"code_challenge_methods_supported":                         []string{"S256"},
+		"claims_parameter_supported":                               false,
+		"request_parameter_supported":                              false,
+		"request_uri_parameter_supported":                          false,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(discovery)
+	if h.deviceFlow {
+		discovery["device_authorization_endpoint"] = base + "/oauth/device_authorization"
+		discovery["grant_types_supported"] = append(discovery["grant_types_supported"].([]string), oauth.DeviceCodeGrantType)
+	}
+
+	if h.registration {
+		discovery["registration_endpoint"] = base + registrationPath
+	}
+	return discovery
+}
+
+// endpointBase returns the base URL endpoints are advertised under.
+func (h *OIDCHandler) endpointBase(r *http.Request) string {
+	return endpointBase(r, h.baseURL)
+}
+
+// endpointBase returns baseURL when it is an absolute URL, and otherwise the
+// host the request was received on.
+func endpointBase(r *http.Request, baseURL string) string {
+	if strings.HasPrefix(baseURL, "https://") || strings.HasPrefix(baseURL, "http://") {
+		return baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
 }
 
 // JWKS handles the .well-known/jwks.json endpoint.
@@ -55,6 +55,39 @@ func TestOIDCHandler_Discovery(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "http://localhost:8080", discovery["issuer"])
 	assert.Equal(t, "http://localhost:8080/oauth/authorize", discovery["authorization_endpoint"])
+	assert.Equal(t, "http://localhost:8080/oauth/userinfo", discovery["userinfo_endpoint"])
+	assert.Equal(t, []interface{}{"RS256"}, discovery["id_token_signing_alg_values_supported"])
+	assert.Contains(t, discovery["scopes_supported"], "openid")
+	assert.Contains(t, discovery["scopes_supported"], "email")
+	assert.Contains(t, discovery["claims_supported"], "auth_time")
+	assert.Contains(t, discovery["acr_values_supported"], "urn:quantaid:acr:mfa")
+	assert.Contains(t, discovery["token_endpoint_auth_methods_supported"], "client_secret_basic")
+	assert.Equal(t, false, discovery["request_uri_parameter_supported"])
+	assert.Equal(t, []interface{}{"S256"}, discovery["code_challenge_methods_supported"])
+
+	// OAuth clients read the same metadata from the RFC 8414 endpoint.
+	rr = httptest.NewRecorder()
+	handler.AuthorizationServerMetadata(rr, httptest.NewRequest("GET", "/.well-known/oauth-authorization-server", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var metadata map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &metadata))
+	assert.Equal(t, discovery, metadata)
+}
+
+func TestOIDCHandler_UserInfo_InvalidToken(t *testing.T) {
+	logger := utils.NewNoopLogger()
+	handler := NewOIDCHandler(protocols.NewOIDCAdapter(utils.NewCryptoManager("test-secret")), logger, "http://localhost:8080")
+
+	rr := httptest.NewRecorder()
+	handler.UserInfo(rr, httptest.NewRequest("GET", "/oauth/userinfo", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req := httptest.NewRequest("GET", "/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	rr = httptest.NewRecorder()
+	handler.UserInfo(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
 }
 
 func TestOIDCHandler_JWKS(t *testing.T) {
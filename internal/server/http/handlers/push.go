@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// PushApprovalService records the answers of devices to push approvals.
+type PushApprovalService interface {
+	RespondPushApproval(ctx context.Context, resp *mfa.PushResponse) error
+}
+
+// PushHandlers serves the endpoint devices answer push approvals at. It is
+// not authenticated with a session; responses are signed with the key the
+// device registered.
+type PushHandlers struct {
+	service PushApprovalService
+}
+
+// NewPushHandlers creates new push approval handlers.
+func NewPushHandlers(service PushApprovalService) *PushHandlers {
+	return &PushHandlers{service: service}
+}
+
+// Respond records a device's approve or deny decision. The signature is the
+// base64 Ed25519 signature of the response's SignedMessage.
+func (h *PushHandlers) Respond(w http.ResponseWriter, r *http.Request) {
+	var req mfa.PushResponse
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ApprovalID == "" || req.DeviceID == "" || len(req.Signature) == 0 {
+		WriteJSONError(w, types.ErrInvalidRequest.WithDetails(map[string]string{"reason": "approval_id, device_id and signature are required"}), http.StatusBadRequest)
+		return
+	}
+	if err := h.service.RespondPushApproval(r.Context(), &req); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
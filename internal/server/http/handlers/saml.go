@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"github.com/gorilla/mux"
 	"github.com/turtacn/QuantaID/internal/protocols/saml"
 	"github.com/turtacn/QuantaID/pkg/utils"
 	"net/http"
+	"path"
+	"strings"
 )
 
 // SAMLHandlers provides HTTP handlers for SAML protocol endpoints.
@@ -41,4 +44,29 @@ func (h *SAMLHandlers) HandleSSO(w http.ResponseWriter, r *http.Request) {
 // metadata generation to the SAML protocol service.
 func (h *SAMLHandlers) HandleMetadata(w http.ResponseWriter, r *http.Request) {
 	h.samlService.HandleMetadata(w, r)
-}
\ No newline at end of file
+}
+
+// HandleSLO is the handler for the Single Logout endpoint. It ends the user's
+// session in response to a Service Provider's signed LogoutRequest and tells
+// the other Service Providers of the session.
+func (h *SAMLHandlers) HandleSLO(w http.ResponseWriter, r *http.Request) {
+	h.samlService.HandleSLO(w, r)
+}
+
+// HandleIDPInitiated starts IdP-initiated SSO to the application in the path,
+// posting an unsolicited assertion to its ACS URL.
+func (h *SAMLHandlers) HandleIDPInitiated(w http.ResponseWriter, r *http.Request) {
+	h.samlService.HandleIDPInitiated(w, r, mux.Vars(r)["applicationID"])
+}
+
+// RegisterRoutes registers the IdP endpoints at the paths of the URLs the
+// SAML service advertises in its metadata. None of them take CSRF tokens:
+// Service Providers post to them cross-site.
+func (h *SAMLHandlers) RegisterRoutes(r *mux.Router) {
+	idp := h.samlService.IDP
+	base := strings.TrimSuffix(path.Dir(idp.MetadataURL.Path), "/")
+	r.HandleFunc(idp.MetadataURL.Path, h.HandleMetadata).Methods("GET")
+	r.HandleFunc(idp.SSOURL.Path, h.HandleSSO).Methods("GET", "POST")
+	r.HandleFunc(idp.LogoutURL.Path, h.HandleSLO).Methods("GET", "POST")
+	r.HandleFunc(base+"/launch/{applicationID}", h.HandleIDPInitiated).Methods("GET")
+}
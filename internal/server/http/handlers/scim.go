@@ -65,7 +65,7 @@ func (h *SCIMHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	// But `CreateUser` requires it. We generate a secure random password.
 	// This user should probably be set to a status requiring password reset,
 	// or just rely on external IdP federation.
-	password, err := utils.GenerateRandomString(32)
+	password, err := utils.GenerateRandomPassword(32)
 	if err != nil {
 		h.logger.Error(r.Context(), "Failed to generate random password", zap.Error(err))
 		h.writeError(w, http.StatusInternalServerError, "", "Internal server error")
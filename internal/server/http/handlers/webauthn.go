@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -8,16 +11,25 @@ import (
 
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/metrics"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/types"
 )
 
+// PasskeyLoginService issues the session and tokens of a passkey login.
+type PasskeyLoginService interface {
+	LoginWithPasskey(ctx context.Context, user *types.User, serviceConfig auth.Config) (*types.AuthResult, error)
+}
+
 // WebAuthnHandler handles WebAuthn registration and login requests.
 type WebAuthnHandler struct {
 	provider   *mfa.WebAuthnProvider
 	userRepo   identity.UserRepository
 	redis      redis.RedisClientInterface
+	logins     PasskeyLoginService
+	sessions   *redis.SessionManager
 }
 
 // NewWebAuthnHandler creates a new WebAuthnHandler.
@@ -29,6 +41,18 @@ func NewWebAuthnHandler(provider *mfa.WebAuthnProvider, userRepo identity.UserRe
 	}
 }
 
+// SetLoginService sets the service that signs in the users of discoverable
+// passkey logins.
+func (h *WebAuthnHandler) SetLoginService(logins PasskeyLoginService) {
+	h.logins = logins
+}
+
+// SetSessionManager sets the session manager that starts the browser session
+// of a discoverable passkey login.
+func (h *WebAuthnHandler) SetSessionManager(sessions *redis.SessionManager) {
+	h.sessions = sessions
+}
+
 // Helper to construct types.Error
 func newError(code string, message string, cause error, status int) *types.Error {
 	err := &types.Error{
@@ -154,8 +178,11 @@ func (h *WebAuthnHandler) beginLoginForUser(w http.ResponseWriter, r *http.Reque
 
 	// Use a random session ID to prevent DoS on the user ID key
 	// The client must return this session ID in the FinishLogin request
-	// Simple random string generation (in production use crypto/rand)
-	loginSessionID := fmt.Sprintf("%d", time.Now().UnixNano())
+	loginSessionID, err := newLoginSessionID()
+	if err != nil {
+		WriteJSONError(w, newError("INTERNAL_ERROR", "Failed to create session ID", err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
 	sessionKey := fmt.Sprintf("webauthn:login:%s", loginSessionID)
 	sessionBytes, _ := json.Marshal(sessionData)
@@ -220,3 +247,138 @@ func (h *WebAuthnHandler) FinishLogin(w http.ResponseWriter, r *http.Request) {
 		"user_id": user.ID,
 	})
 }
+
+// BeginDiscoverableLogin handles the initiation of a passkey login without a
+// username. With "conditional" set, the options are for the autofill of the
+// username field (conditional mediation).
+func (h *WebAuthnHandler) BeginDiscoverableLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Conditional bool `json:"conditional"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteJSONError(w, newError("INVALID_REQUEST", "Malformed request", err, http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	options, sessionData, err := h.provider.BeginDiscoverableLogin(ctx, req.Conditional)
+	if err != nil {
+		WriteJSONError(w, newError("WEBAUTHN_ERROR", "Failed to begin login", err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	loginSessionID, err := newLoginSessionID()
+	if err != nil {
+		WriteJSONError(w, newError("INTERNAL_ERROR", "Failed to create session ID", err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sessionBytes, _ := json.Marshal(sessionData)
+	if err := h.redis.Set(ctx, fmt.Sprintf("webauthn:login:%s", loginSessionID), sessionBytes, 5*time.Minute); err != nil {
+		WriteJSONError(w, newError("REDIS_ERROR", "Failed to save session", err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var respMap map[string]interface{}
+	optsBytes, _ := json.Marshal(options)
+	json.Unmarshal(optsBytes, &respMap)
+	respMap["session_id"] = loginSessionID
+
+	WriteJSON(w, http.StatusOK, respMap)
+}
+
+// FinishDiscoverableLogin handles the completion of a passkey login without a
+// username. The user is the one the passkey belongs to; when a login service
+// is set the response carries their tokens.
+func (h *WebAuthnHandler) FinishDiscoverableLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		WriteJSONError(w, newError("INVALID_REQUEST", "Session ID query parameter required", nil, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// The session is consumed before verifying, so that it is answered only once.
+	sessionKey := fmt.Sprintf("webauthn:login:%s", sessionID)
+	sessionBytesStr, err := h.redis.Client().GetDel(ctx, sessionKey).Result()
+	if err != nil {
+		WriteJSONError(w, newError("SESSION_EXPIRED", "Session expired or invalid", err, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal([]byte(sessionBytesStr), &sessionData); err != nil {
+		WriteJSONError(w, newError("INTERNAL_ERROR", "Failed to unmarshal session", err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(sessionData.UserID) != 0 {
+		WriteJSONError(w, newError("INVALID_REQUEST", "Not a discoverable login session", nil, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	user, credential, err := h.provider.FinishDiscoverableLogin(ctx, h.userRepo.GetUserByID, sessionData, r)
+	if err != nil {
+		metrics.AuthLoginTotal.WithLabelValues("fail").Inc()
+		WriteJSONError(w, newError("AUTH_FAILED", "Authentication failed", err, http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if h.logins == nil {
+		WriteJSON(w, http.StatusOK, map[string]interface{}{
+			"status":        "authenticated",
+			"credential_id": credential.ID,
+			"user_id":       user.ID,
+		})
+		return
+	}
+
+	authResult, err := h.logins.LoginWithPasskey(ctx, user, auth.Config{})
+	if err != nil {
+		metrics.AuthLoginTotal.WithLabelValues("fail").Inc()
+		if appErr, ok := err.(*types.Error); ok {
+			WriteJSONError(w, appErr, appErr.HttpStatus)
+		} else {
+			WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+		}
+		return
+	}
+	if h.sessions != nil {
+		if err := h.startSession(w, r, authResult.Session); err != nil {
+			WriteJSONError(w, types.ErrInternal.WithCause(err), http.StatusInternalServerError)
+			return
+		}
+	}
+	metrics.AuthLoginTotal.WithLabelValues("success").Inc()
+	WriteJSON(w, http.StatusOK, authResult.Token)
+}
+
+// startSession starts the browser session of a passkey login, with the
+// authentication methods and acr of the login's session.
+func (h *WebAuthnHandler) startSession(w http.ResponseWriter, r *http.Request, login *types.UserSession) error {
+	session, err := h.sessions.CreateSession(r.Context(), login.UserID, r, redis.WithAuthentication(login.AuthMethods, login.ACR))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     redis.SessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// newLoginSessionID returns an unguessable ID for a WebAuthn login session.
+func newLoginSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
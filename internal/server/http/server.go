@@ -2,8 +2,11 @@ package http
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -14,16 +17,26 @@ import (
 	"github.com/turtacn/QuantaID/internal/api/privacy"
 	i_audit "github.com/turtacn/QuantaID/internal/audit"
 	"github.com/turtacn/QuantaID/internal/audit/sinks"
+	"github.com/turtacn/QuantaID/internal/config"
 	"github.com/turtacn/QuantaID/internal/auth/adaptive"
+	"github.com/turtacn/QuantaID/internal/auth/federation"
+	"github.com/turtacn/QuantaID/internal/auth/lockout"
 	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/auth/passwordless"
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 	"github.com/turtacn/QuantaID/internal/domain/auth"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/internal/domain/password"
 	"github.com/turtacn/QuantaID/internal/domain/policy"
 	domain_privacy "github.com/turtacn/QuantaID/internal/domain/privacy"
 	"github.com/turtacn/QuantaID/internal/domain/apikey"
 	"github.com/turtacn/QuantaID/internal/metrics"
 	"github.com/turtacn/QuantaID/internal/policy/engine"
+	"github.com/turtacn/QuantaID/internal/protocol/radius"
 	"github.com/turtacn/QuantaID/internal/protocols/saml"
+	"github.com/turtacn/QuantaID/internal/security/actions"
+	"github.com/turtacn/QuantaID/internal/security/automator"
 	"github.com/turtacn/QuantaID/internal/services/application"
 	audit_service "github.com/turtacn/QuantaID/internal/services/audit"
 	auth_service "github.com/turtacn/QuantaID/internal/services/auth"
@@ -36,11 +49,15 @@ import (
 	"github.com/turtacn/QuantaID/internal/domain/webhook"
 	"github.com/turtacn/QuantaID/internal/worker"
 	"github.com/turtacn/QuantaID/internal/server/http/handlers"
+	httpmiddleware "github.com/turtacn/QuantaID/internal/server/http/middleware"
 	"github.com/turtacn/QuantaID/internal/server/http/ui"
 	"github.com/turtacn/QuantaID/internal/server/middleware"
 	"github.com/turtacn/QuantaID/internal/storage/memory"
 	"github.com/turtacn/QuantaID/internal/storage/postgresql"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/auth/protocols"
+	"github.com/turtacn/QuantaID/pkg/notification"
+	"github.com/turtacn/QuantaID/pkg/notification/smtp"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 	"go.opentelemetry.io/otel/trace"
@@ -78,6 +95,8 @@ type Services struct {
 	AuthzService          *authorization.Service
 	AppService            *application.ApplicationService
 	SamlService           *saml.Service
+	FederationService     *federation.Service
+	IdentityProviders     auth.IdentityProviderRepository
 	CryptoManager         *utils.CryptoManager
 	IdentityDomainService identity.IService
 	DevCenterService      *platform.DevCenterService
@@ -88,9 +107,19 @@ type Services struct {
 	WebhookWorker         *worker.WebhookSender
 	RecoveryService       *auth.RecoveryService
 	SessionManager        *redis.SessionManager
+	ConsentRepository     oauth.ConsentRepository
+	TokenRepository       auth.TokenRepository
+	TokenFamilyRepository auth.TokenFamilyRepository
+	DeviceFlow            *oauth.DeviceFlowHandler
 	Renderer              *ui.Renderer
 	WebAuthnProvider      *mfa.WebAuthnProvider
 	PrivacyService        *privacy_service.Service
+	LockoutTracker        *lockout.Tracker
+	RADIUSPolicies        *radius.PolicyManager
+	RADIUSClients         *radius.ClientManager
+	RADIUSAccounting      *radius.AccountingHandler
+	RADIUSDynamicAuth     *radius.DAClient
+	PasswordService       password.IService
 }
 
 // NewServer creates a new HTTP server instance.
@@ -129,6 +158,7 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 	var sessionRepo auth.SessionRepository
 	var tokenRepo auth.TokenRepository
 	var auditRepo auth.AuditLogRepository
+	var idpRepo auth.IdentityProviderRepository
 	var policyRepo policy.PolicyRepository
 	var rbacRepo policy.RBACRepository
 	var appRepo types.ApplicationRepository
@@ -165,7 +195,7 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 		pgIdRepo := postgresql.NewPostgresIdentityRepository(db)
 		idRepo = pgIdRepo
 		groupRepo = pgIdRepo
-		_, auditRepo = postgresql.NewPostgresAuthRepository(db)
+		idpRepo, auditRepo = postgresql.NewPostgresAuthRepository(db)
 		policyRepo = postgresql.NewPostgresPolicyRepository(db)
 		rbacRepo = postgresql.NewRBACRepository(db)
 		appRepo = postgresql.NewPostgresApplicationRepository(db)
@@ -193,6 +223,25 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 		return nil, fmt.Errorf("invalid storage mode: %s", appCfg.Storage.Mode)
 	}
 
+	// Refresh token families for OAuth refresh token rotation
+	var tokenFamilyRepo auth.TokenFamilyRepository
+	switch {
+	case appCfg.OIDC.TokenFamilyStore == "postgres" && db != nil:
+		tokenFamilyRepo = postgresql.NewPostgresTokenFamilyRepository(db)
+	case redisClient != nil:
+		tokenFamilyRepo = redis.NewRedisTokenFamilyRepository(redisClient, protocols.RefreshTokenTTL)
+	}
+
+	// OAuth device authorization grant
+	var deviceFlow *oauth.DeviceFlowHandler
+	if redisClient != nil {
+		deviceFlowCfg := appCfg.OIDC.DeviceFlow
+		if deviceFlowCfg.VerificationURI == "" {
+			deviceFlowCfg.VerificationURI = strings.TrimSuffix(cryptoManager.Issuer(), "/") + "/device"
+		}
+		deviceFlow = oauth.NewDeviceFlowHandler(redis.NewRedisDeviceCodeRepository(redisClient), nil, deviceFlowCfg)
+	}
+
 	// Session Manager
 	sessionManager := redis.NewSessionManager(
 		redisClient,
@@ -251,14 +300,54 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 	authzService := authorization.NewService(evaluator, auditService)
 
 	identityDomainService := identity.NewService(idRepo, groupRepo, cryptoManager, logger)
+
+	// Password policy, enforced wherever passwords are set
+	var passwordPolicy *passwordpolicy.Engine
+	if appCfg.Security.PasswordPolicy.Enabled {
+		passwordPolicy, err = newPasswordPolicy(appCfg.Security.PasswordPolicy, cryptoManager, redisClient, utils.ZapLoggerFrom(logger))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize password policy: %w", err)
+		}
+		passwordPolicy.SetGroupSource(identityDomainService)
+		identityDomainService.SetPasswordPolicy(passwordPolicy)
+	}
+	// Password checks and changes of the directory protocols
+	passwordService := password.NewService(idRepo, cryptoManager, logger)
+	if passwordPolicy != nil {
+		passwordService.SetPasswordPolicy(passwordPolicy)
+	}
 	identityAppService := identity_service.NewApplicationService(identityDomainService, auditService, logger)
 
+	// SAML 2.0 Identity Provider
+	var samlService *saml.Service
+	if appCfg.SAML.Enabled && appRepo != nil {
+		samlService, err = newSAMLService(appCfg.SAML, logger, appRepo, identityDomainService, cryptoManager)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize SAML IdP: %w", err)
+		}
+		samlService.SetSessionManager(sessionManager)
+		samlService.SetLogoutStore(redisClient)
+	}
+
+	// Sign-in through upstream identity providers
+	var federationService *federation.Service
+	if appCfg.Federation.Enabled && idpRepo != nil && redisClient != nil {
+		federationService, err = newFederationService(appCfg.Federation, logger, idpRepo, identityDomainService, redisClient, sessionManager, cryptoManager)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize federation: %w", err)
+		}
+	}
+
 	mfaRepo := postgresql.NewPostgresMFARepository(db)
 
 	webAuthnConfig := mfa.WebAuthnConfig{
 		RPID:          appCfg.WebAuthn.RPID,
 		RPDisplayName: appCfg.WebAuthn.RPDisplayName,
 		RPOrigin:      appCfg.WebAuthn.Origin,
+		Attestation: mfa.AttestationPolicy{
+			Conveyance:     appCfg.WebAuthn.Attestation,
+			AllowedAAGUIDs: appCfg.WebAuthn.AllowedAAGUIDs,
+		},
 	}
 	webAuthnProvider, err := mfa.NewWebAuthnProvider(webAuthnConfig, mfaRepo)
 	if err != nil {
@@ -269,6 +358,20 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 	if webAuthnProvider != nil {
 		mfaManager.RegisterProvider("webauthn", webAuthnProvider)
 	}
+	mfaManager.RegisterProvider("totp", mfa.NewTOTPProvider(mfaRepo, cryptoManager))
+	mfaManager.RegisterProvider("recovery", mfa.NewRecoveryCodeProvider(mfaRepo, cryptoManager))
+	if appCfg.Security.MFA.Push.Enabled {
+		pushGateway := mfa.NewHTTPPushGateway(appCfg.Security.MFA.Push.GatewayURL, nil)
+		mfaManager.RegisterProvider("push", mfa.NewPushProvider(mfaRepo, redisClient, pushGateway, mfa.PushConfig{
+			TTL: appCfg.Security.MFA.Push.TTL,
+		}))
+	}
+	mfaManager.SetFactorStore(mfaRepo)
+	mfaManager.SetChallengeStore(redisClient, mfa.ChallengeConfig{
+		TTL:         appCfg.Security.MFA.ChallengeTTL,
+		MaxAttempts: appCfg.Security.MFA.MaxAttempts,
+		StepUpTTL:   appCfg.Security.MFA.StepUpTTL,
+	})
 	policyEngine := authorization.NewPolicyEngine(evaluator)
 
 	geoDB, err := adaptive.NewGeoIPReader("data/GeoLite2-City.mmdb")
@@ -279,7 +382,47 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 
 	riskEngine := adaptive.NewRiskEngine(appCfg.Security.Risk, redisClient, geoManager, geoDB, logger.(*utils.ZapLogger).Logger)
 
-	authDomainService := auth.NewService(identityDomainService, sessionRepo, tokenRepo, auditRepo, nil, cryptoManager, logger, riskEngine, policyEngine, mfaManager, appRepo, redisClient)
+	authDomainService := auth.NewService(identityDomainService, sessionRepo, tokenRepo, auditRepo, tokenFamilyRepo, cryptoManager, logger, riskEngine, policyEngine, mfaManager, appRepo, redisClient)
+	if geoDB != nil {
+		authDomainService.SetGeoLocator(adaptive.NewGeoLocator(geoDB))
+	}
+
+	// Lockout and throttling of failed logins
+	var lockoutTracker *lockout.Tracker
+	if appCfg.Security.Lockout.Enabled && redisClient != nil {
+		lockoutTracker = newLockoutTracker(appCfg.Security.Lockout, redisClient, utils.ZapLoggerFrom(logger))
+		lockoutTracker.SetAuditor(auditService)
+		authDomainService.SetLockoutTracker(lockoutTracker)
+	}
+	if passwordPolicy != nil {
+		authDomainService.SetPasswordPolicy(passwordPolicy)
+	}
+	authDomainService.SetSessionRevoker(sessionManager)
+
+	// RADIUS authorization policies, managed over the admin API
+	var radiusPolicies *radius.PolicyManager
+	var radiusClients *radius.ClientManager
+	var radiusAccounting *radius.AccountingHandler
+	var radiusDynamicAuth *radius.DAClient
+	if appCfg.RADIUS.Enabled {
+		radiusPolicies, err = newRADIUSPolicies(appCfg.RADIUS, db)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize RADIUS policies: %w", err)
+		}
+		// NAS clients and accounting records are only kept in the database.
+		if db != nil {
+			radiusClients = radius.NewClientManager(db)
+			radiusAccounting = radius.NewAccountingHandler(db)
+			radiusDynamicAuth = radius.NewDAClient(radiusAccounting, radiusClients, radiusPolicies.Codec(), radius.DAClientConfig{
+				Port:       appCfg.RADIUS.DynamicAuthorization.Port,
+				Timeout:    appCfg.RADIUS.DynamicAuthorization.Timeout,
+				RetryCount: appCfg.RADIUS.DynamicAuthorization.RetryCount,
+			}, utils.ZapLoggerFrom(logger))
+		}
+	}
+
+	// Automated responses to risky logins
+	authDomainService.SetSecurityAutomator(newSecurityAutomator(appCfg.Security.ResponsePolicies, redisClient, sessionManager, db, radiusDynamicAuth, utils.ZapLoggerFrom(logger)))
 	tracer := trace.NewNoopTracerProvider().Tracer("quantid-test")
 
 	authAppService := auth_service.NewApplicationService(authDomainService, auditService, logger, auth_service.Config{
@@ -310,11 +453,25 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 		return nil, fmt.Errorf("failed to initialize UI renderer: %w", err)
 	}
 
-	otpProvider := mfa.NewOTPProvider(redisClient, nil, cryptoManager, mfa.OTPConfig{
+	notifications := notification.NewManager()
+	if appCfg.Notification.SMTP.Host != "" {
+		notifications = notification.NewManager(smtp.NewSMTPSender(appCfg.Notification.SMTP))
+	}
+
+	// Passwordless login by email
+	if appCfg.Security.Passwordless.Enabled && redisClient != nil {
+		authDomainService.SetPasswordless(newPasswordless(appCfg.Security.Passwordless, redisClient, notifications, cryptoManager, utils.ZapLoggerFrom(logger)))
+	}
+
+	otpProvider := mfa.NewOTPProvider(redisClient, notifications, cryptoManager, mfa.OTPConfig{
 		TTL:    15 * time.Minute,
 		Length: 6,
 	})
+	mfaManager.SetOTPProvider(otpProvider)
 	recoveryService := auth.NewRecoveryService(idRepo, otpProvider, cryptoManager, sessionManager, logger.(*utils.ZapLogger).Logger)
+	if passwordPolicy != nil {
+		recoveryService.SetPasswordPolicy(passwordPolicy)
+	}
 
 	privacyService := privacy_service.NewService(db, sessionManager, auditService, privacyRepo, idRepo, auditRepo, appCfg)
 
@@ -323,6 +480,9 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 		AuthService:           authAppService,
 		AuthzService:          authzService,
 		AppService:            appService,
+		SamlService:           samlService,
+		FederationService:     federationService,
+		IdentityProviders:     idpRepo,
 		CryptoManager:         cryptoManager,
 		IdentityDomainService: identityDomainService,
 		DevCenterService:      devCenterSvc,
@@ -333,9 +493,19 @@ func NewServerWithConfig(httpCfg Config, appCfg *utils.Config, logger utils.Logg
 		WebhookWorker:         webhookWorker,
 		RecoveryService:       recoveryService,
 		SessionManager:        sessionManager,
+		ConsentRepository:     redis.NewRedisConsentRepository(redisClient),
+		TokenRepository:       tokenRepo,
+		TokenFamilyRepository: tokenFamilyRepo,
+		DeviceFlow:            deviceFlow,
 		Renderer:              renderer,
 		WebAuthnProvider:      webAuthnProvider,
 		PrivacyService:        privacyService,
+		LockoutTracker:        lockoutTracker,
+		RADIUSPolicies:        radiusPolicies,
+		RADIUSClients:         radiusClients,
+		RADIUSAccounting:      radiusAccounting,
+		RADIUSDynamicAuth:     radiusDynamicAuth,
+		PasswordService:       passwordService,
 	}
 
 	return NewServer(httpCfg, logger, services, appCfg, db, redisClient), nil
@@ -403,9 +573,44 @@ func (s *Server) registerRoutes(services Services, appCfg *utils.Config) {
 	s.Router.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	oauthHandlers := handlers.NewOAuthHandlers(services.AuthService, services.IdentityService, s.logger)
-	s.Router.HandleFunc("/oauth/authorize", oauthHandlers.Authorize).Methods("GET")
+	oauthHandlers.SetSessionManager(services.SessionManager)
+	oauthHandlers.SetConsentRepository(services.ConsentRepository)
+	oauthHandlers.SetRenderer(services.Renderer)
+	if services.TokenRepository != nil {
+		oauthHandlers.SetTokenRepository(services.TokenRepository)
+	}
+	if services.TokenFamilyRepository != nil {
+		oauthHandlers.SetTokenFamilyRepository(services.TokenFamilyRepository, services.AuditService)
+	}
+	s.Router.Handle("/oauth/authorize", httpmiddleware.CSRFMiddleware(http.HandlerFunc(oauthHandlers.Authorize))).Methods("GET")
+	s.Router.Handle("/oauth/authorize", httpmiddleware.CSRFMiddleware(http.HandlerFunc(oauthHandlers.Consent))).Methods("POST")
 	s.Router.HandleFunc("/oauth/token", oauthHandlers.Token).Methods("POST")
-	s.Router.HandleFunc("/.well-known/openid-configuration", oauthHandlers.Discovery).Methods("GET")
+	s.Router.HandleFunc("/oauth/introspect", oauthHandlers.Introspect).Methods("POST")
+	s.Router.HandleFunc("/oauth/revoke", oauthHandlers.Revoke).Methods("POST")
+	if services.DeviceFlow != nil {
+		oauthHandlers.SetDeviceFlow(services.DeviceFlow)
+		s.Router.HandleFunc("/oauth/device_authorization", oauthHandlers.DeviceAuthorization).Methods("POST")
+	}
+
+	if len(appCfg.OIDC.ClaimsMapping) > 0 {
+		oauthHandlers.OIDCAdapter().SetClaimsMapper(oauth.NewClaimsMapper(appCfg.OIDC.ClaimsMapping))
+	}
+	oidcHandlers := handlers.NewOIDCHandler(oauthHandlers.OIDCAdapter(), s.logger, services.CryptoManager.Issuer())
+	if services.DeviceFlow != nil {
+		oidcHandlers.EnableDeviceFlow()
+	}
+	if appCfg.OIDC.Registration.Enabled && services.AuthService.GetAppRepo() != nil {
+		registry, err := oauth.NewClientRegistry(services.AuthService.GetAppRepo(), appCfg.OIDC.Registration)
+		if err != nil {
+			s.logger.Error(context.Background(), "Dynamic client registration disabled", zap.Error(err))
+		} else {
+			handlers.NewClientRegistrationHandler(registry, s.logger, services.CryptoManager.Issuer()).RegisterRoutes(s.Router)
+			oidcHandlers.EnableRegistration()
+		}
+	}
+	s.Router.HandleFunc("/oauth/userinfo", oidcHandlers.UserInfo).Methods("GET", "POST")
+	s.Router.HandleFunc("/.well-known/openid-configuration", oidcHandlers.Discovery).Methods("GET")
+	s.Router.HandleFunc("/.well-known/oauth-authorization-server", oidcHandlers.AuthorizationServerMetadata).Methods("GET")
 	s.Router.HandleFunc("/.well-known/jwks.json", oauthHandlers.JWKS).Methods("GET")
 
 	apiV1 := s.Router.PathPrefix("/api/v1").Subrouter()
@@ -432,8 +637,19 @@ func (s *Server) registerRoutes(services Services, appCfg *utils.Config) {
 	}
 
 	apiV1.HandleFunc("/auth/login", authHandlers.Login).Methods("POST")
+	apiV1.HandleFunc("/auth/mfa/verify", authHandlers.VerifyMFA).Methods("POST")
+	apiV1.Handle("/auth/password/change", authMiddleware.ExecuteOptional(http.HandlerFunc(authHandlers.ChangePassword))).Methods("POST")
+	apiV1.HandleFunc("/auth/passwordless/start", authHandlers.StartPasswordless).Methods("POST")
+	apiV1.HandleFunc("/auth/passwordless/complete", authHandlers.CompletePasswordless).Methods("POST")
 	apiV1.HandleFunc("/users", identityHandlers.CreateUser).Methods("POST")
 
+	// Self-service MFA enrollment and factor management
+	meMFARouter := apiV1.PathPrefix("/me/mfa").Subrouter()
+	meMFARouter.Use(authMiddleware.Execute)
+	handlers.NewMFAHandlers(services.AuthService).RegisterRoutes(meMFARouter)
+	// Devices answer push approvals with responses signed by their key
+	apiV1.HandleFunc("/mfa/push/respond", handlers.NewPushHandlers(services.AuthService).Respond).Methods("POST")
+
 	// Protected route for getting a user
 	getUserHandler := http.HandlerFunc(identityHandlers.GetUser)
 	protectedGetUserRoute := authMiddleware.Execute(authzUserReadMiddleware.Execute(getUserHandler))
@@ -445,6 +661,11 @@ func (s *Server) registerRoutes(services Services, appCfg *utils.Config) {
 	adminRouter.HandleFunc("/users", adminUserHandlers.ListUsers).Methods("GET")
 	adminRouter.HandleFunc("/users/{userID}/ban", adminUserHandlers.BanUser).Methods("POST")
 	adminRouter.HandleFunc("/users/{userID}/unban", adminUserHandlers.UnbanUser).Methods("POST")
+	if services.LockoutTracker != nil {
+		adminUserHandlers.SetLockoutTracker(services.LockoutTracker)
+		adminRouter.HandleFunc("/users/{userID}/lockout", adminUserHandlers.GetLockout).Methods("GET")
+		adminRouter.HandleFunc("/users/{userID}/unlock", adminUserHandlers.UnlockUser).Methods("POST")
+	}
 
 	devcenterHandlers := handlers.NewDevCenterHandler(services.DevCenterService)
 	devcenterAdminMiddleware := middleware.NewAuthorizationMiddleware(services.AuthzService, policy.Action("devcenter.admin"), "devcenter")
@@ -466,22 +687,74 @@ func (s *Server) registerRoutes(services Services, appCfg *utils.Config) {
 	webhookRouter.HandleFunc("/{id}", webhookHandler.DeleteSubscription).Methods("DELETE")
 	webhookRouter.HandleFunc("/{id}/rotate-secret", webhookHandler.RotateSecret).Methods("POST")
 
+	// Upstream identity provider management
+	if services.IdentityProviders != nil {
+		idpHandler := admin.NewIdentityProviderHandler(services.IdentityProviders, s.logger)
+		idpHandler.RegisterRoutes(adminRouter.PathPrefix("/identity-providers").Subrouter())
+	}
+
+	// RADIUS authorization policy management
+	if services.RADIUSPolicies != nil {
+		radiusPolicyHandler := admin.NewRADIUSPolicyHandler(services.RADIUSPolicies, s.logger)
+		radiusPolicyHandler.RegisterRoutes(adminRouter.PathPrefix("/radius/policies").Subrouter())
+	}
+	if services.RADIUSDynamicAuth != nil {
+		radiusSessionHandler := admin.NewRADIUSSessionHandler(services.RADIUSDynamicAuth, s.logger)
+		radiusSessionHandler.RegisterRoutes(adminRouter.PathPrefix("/radius/sessions").Subrouter())
+	}
+
 	// UI Handlers (Self-Service)
 	recoveryHandler := ui.NewRecoveryHandler(services.RecoveryService, services.Renderer, s.logger.(*utils.ZapLogger).Logger)
 	deviceHandler := ui.NewDeviceHandler(services.SessionManager, services.Renderer, s.logger.(*utils.ZapLogger).Logger)
 	securityLogHandler := ui.NewSecurityLogHandler(services.AuditService, services.Renderer, s.logger.(*utils.ZapLogger).Logger)
+	uiAuthHandler := ui.NewAuthHandler(services.Renderer, services.AuthService, services.SessionManager, utils.ZapLoggerFrom(s.logger))
+	if services.FederationService != nil {
+		uiAuthHandler.EnableFederation()
+		federationHandlers := handlers.NewFederationHandlers(services.FederationService, s.logger)
+		federationHandlers.RegisterRoutes(s.Router)
+		s.Router.Handle("/auth/federation/{providerID}/link", httpmiddleware.CSRFMiddleware(http.HandlerFunc(federationHandlers.HandleLink))).Methods("POST")
+	}
+	consentHandler := ui.NewConsentHandler(services.ConsentRepository, services.AuthService.GetAppRepo(), services.Renderer, utils.ZapLoggerFrom(s.logger))
 
 	authRouter := s.Router.PathPrefix("/auth").Subrouter()
+	authRouter.Handle("/login", httpmiddleware.CSRFMiddleware(http.HandlerFunc(uiAuthHandler.ShowLoginPage))).Methods("GET")
+	authRouter.Handle("/login", httpmiddleware.CSRFMiddleware(http.HandlerFunc(uiAuthHandler.HandleLogin))).Methods("POST")
+	authRouter.Handle("/mfa", httpmiddleware.CSRFMiddleware(http.HandlerFunc(uiAuthHandler.ShowMFAPage))).Methods("GET")
+	authRouter.Handle("/mfa", httpmiddleware.CSRFMiddleware(http.HandlerFunc(uiAuthHandler.HandleMFA))).Methods("POST")
+	authRouter.Handle("/passwordless", httpmiddleware.CSRFMiddleware(http.HandlerFunc(uiAuthHandler.ShowPasswordlessPage))).Methods("GET")
+	authRouter.Handle("/passwordless", httpmiddleware.CSRFMiddleware(http.HandlerFunc(uiAuthHandler.HandlePasswordless))).Methods("POST")
 	authRouter.HandleFunc("/forgot-password", recoveryHandler.ShowForgotPassword).Methods("GET")
 	authRouter.HandleFunc("/forgot-password", recoveryHandler.HandleForgotPassword).Methods("POST")
 	authRouter.HandleFunc("/reset-password", recoveryHandler.ShowResetPassword).Methods("GET")
 	authRouter.HandleFunc("/reset-password", recoveryHandler.HandleResetPassword).Methods("POST")
 
+	// The portal also accepts the browser session cookie, so its forms are CSRF protected.
+	portalAuthMiddleware := middleware.NewAuthMiddleware(services.CryptoManager, s.logger, services.IdentityDomainService)
+	portalAuthMiddleware.SetSessionManager(services.SessionManager)
+
+	if services.DeviceFlow != nil {
+		deviceVerificationHandler := ui.NewDeviceVerificationHandler(services.DeviceFlow, services.AuthService.GetAppRepo(), services.SessionManager, services.Renderer, utils.ZapLoggerFrom(s.logger))
+		s.Router.Handle("/device", httpmiddleware.CSRFMiddleware(http.HandlerFunc(deviceVerificationHandler.ShowVerification))).Methods("GET")
+		s.Router.Handle("/device", httpmiddleware.CSRFMiddleware(http.HandlerFunc(deviceVerificationHandler.HandleVerification))).Methods("POST")
+	}
+
 	portalRouter := s.Router.PathPrefix("/portal").Subrouter()
-	portalRouter.Use(authMiddleware.Execute)
+	portalRouter.Use(portalAuthMiddleware.Execute, httpmiddleware.CSRFMiddleware)
 	portalRouter.HandleFunc("/devices", deviceHandler.ListDevices).Methods("GET")
 	portalRouter.HandleFunc("/devices/revoke/{id}", deviceHandler.RevokeDevice).Methods("POST")
 	portalRouter.HandleFunc("/security-log", securityLogHandler.ShowSecurityLog).Methods("GET")
+	portalRouter.HandleFunc("/consents", consentHandler.ListConsents).Methods("GET")
+	portalRouter.HandleFunc("/consents/revoke/{clientID}", consentHandler.RevokeConsent).Methods("POST")
+
+	mfaHandler := ui.NewMFAHandler(services.AuthService, services.Renderer, utils.ZapLoggerFrom(s.logger))
+	portalRouter.HandleFunc("/mfa", mfaHandler.ShowFactors).Methods("GET")
+	portalRouter.HandleFunc("/mfa/totp", mfaHandler.EnrollTOTP).Methods("POST")
+	portalRouter.HandleFunc("/mfa/totp/confirm", mfaHandler.ConfirmTOTP).Methods("POST")
+	portalRouter.HandleFunc("/mfa/recovery-codes", mfaHandler.RegenerateRecoveryCodes).Methods("POST")
+	portalRouter.HandleFunc("/mfa/step-up", mfaHandler.BeginStepUp).Methods("POST")
+	portalRouter.HandleFunc("/mfa/step-up/verify", mfaHandler.CompleteStepUp).Methods("POST")
+	portalRouter.HandleFunc("/mfa/{id}/default", mfaHandler.SetDefaultFactor).Methods("POST")
+	portalRouter.HandleFunc("/mfa/{id}/delete", mfaHandler.DeleteFactor).Methods("POST")
 
 	// WebAuthn Routes
 	if services.WebAuthnProvider != nil {
@@ -494,6 +767,21 @@ func (s *Server) registerRoutes(services Services, appCfg *utils.Config) {
 
 		apiV1.HandleFunc("/webauthn/login/begin", webauthnHandler.BeginLogin).Methods("POST")
 		apiV1.HandleFunc("/webauthn/login/finish", webauthnHandler.FinishLogin).Methods("POST")
+
+		// Passkey login without a username
+		webauthnHandler.SetLoginService(services.AuthService)
+		webauthnHandler.SetSessionManager(services.SessionManager)
+		apiV1.HandleFunc("/webauthn/login/discoverable/begin", webauthnHandler.BeginDiscoverableLogin).Methods("POST")
+		apiV1.HandleFunc("/webauthn/login/discoverable/finish", webauthnHandler.FinishDiscoverableLogin).Methods("POST")
+
+		passkeyHandler := ui.NewPasskeyHandler(services.WebAuthnProvider, services.Renderer, utils.ZapLoggerFrom(s.logger))
+		portalRouter.HandleFunc("/passkeys", passkeyHandler.ListPasskeys).Methods("GET")
+		portalRouter.HandleFunc("/passkeys/{id}/rename", passkeyHandler.RenamePasskey).Methods("POST")
+		portalRouter.HandleFunc("/passkeys/{id}/delete", passkeyHandler.DeletePasskey).Methods("POST")
+	}
+
+	if services.SamlService != nil {
+		handlers.NewSAMLHandlers(services.SamlService, s.logger).RegisterRoutes(s.Router)
 	}
 
 	// Privacy routes
@@ -507,6 +795,159 @@ func (s *Server) registerRoutes(services Services, appCfg *utils.Config) {
 	s.Router.HandleFunc("/readyz", s.readyzHandler).Methods("GET")
 }
 
+// newSAMLService creates the SAML IdP with the configured signing key pair,
+// or a temporary one when none is configured.
+func newSAMLService(cfg utils.SAMLConfig, logger utils.Logger, appRepo types.ApplicationRepository, identityDomain identity.IService, cryptoManager *utils.CryptoManager) (*saml.Service, error) {
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = strings.TrimSuffix(cryptoManager.Issuer(), "/") + "/saml"
+	}
+
+	var key *rsa.PrivateKey
+	var cert *x509.Certificate
+	var err error
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		key, cert, err = saml.LoadKeyPair(cfg.CertFile, cfg.KeyFile)
+	} else {
+		logger.Warn(context.Background(), "No SAML signing key configured; generating a temporary one")
+		key, cert, err = saml.GenerateKeyPair(baseURL, 365*24*time.Hour)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saml.NewService(logger, appRepo, identityDomain, cryptoManager, key, cert, baseURL)
+}
+
+// newFederationService creates the service that signs users in through
+// upstream identity providers.
+func newFederationService(cfg utils.FederationConfig, logger utils.Logger, idpRepo auth.IdentityProviderRepository, identityDomain identity.IService, redisClient redis.RedisClientInterface, sessionManager *redis.SessionManager, cryptoManager *utils.CryptoManager) (*federation.Service, error) {
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = strings.TrimSuffix(cryptoManager.Issuer(), "/") + "/auth/federation"
+	}
+	federationService := federation.NewService(logger, idpRepo, identityDomain, redisClient, sessionManager, baseURL)
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		key, cert, err := saml.LoadKeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		federationService.SetServiceProviderKey(key, cert)
+	}
+	return federationService, nil
+}
+
+// newLockoutTracker creates the tracker of failed logins, shared by all
+// protocols that check passwords.
+func newLockoutTracker(cfg utils.LockoutConfig, redisClient redis.RedisClientInterface, logger *zap.Logger) *lockout.Tracker {
+	return lockout.NewTracker(redisClient, lockout.Config{
+		MaxFailures:         cfg.MaxFailures,
+		FailureWindow:       cfg.FailureWindow,
+		LockoutDuration:     cfg.LockoutDuration,
+		ThrottleAfter:       cfg.ThrottleAfter,
+		BaseDelay:           cfg.BaseDelay,
+		MaxDelay:            cfg.MaxDelay,
+		SourceMaxFailures:   cfg.SourceMaxFailures,
+		SprayThreshold:      cfg.SprayThreshold,
+		SourceBlockDuration: cfg.SourceBlockDuration,
+	}, logger)
+}
+
+// newSecurityAutomator creates the engine that runs the actions of the
+// response policies. Actions that need the database, or a RADIUS dynamic
+// authorization client, are only available when there is one.
+func newSecurityAutomator(policies []config.ResponsePolicy, redisClient redis.RedisClientInterface, sessionManager *redis.SessionManager, db *gorm.DB, dac *radius.DAClient, logger *zap.Logger) *automator.Engine {
+	engine := automator.NewEngine(&config.SecurityConfig{ResponsePolicies: policies}, logger)
+	engine.RegisterAction(actions.NewBlockIPAction(redisClient))
+	engine.RegisterAction(actions.NewKillSessionAction(sessionManager))
+	if db != nil {
+		engine.RegisterAction(actions.NewLockUserAction(db))
+	}
+	if db != nil && dac != nil {
+		engine.RegisterAction(actions.NewDisconnectRADIUSAction(db, dac))
+	}
+	return engine
+}
+
+// newRADIUSPolicies creates the manager of the RADIUS authorization
+// policies, whose attributes are looked up in the standard dictionary and
+// the configured vendor dictionaries. Policies are kept in the database when
+// there is one and in memory otherwise.
+func newRADIUSPolicies(cfg utils.RADIUSConfig, db *gorm.DB) (*radius.PolicyManager, error) {
+	codec := radius.NewAttributeCodec()
+	for _, path := range cfg.Dictionaries {
+		if err := codec.LoadDictionaryFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var repo radius.PolicyRepository = radius.NewMemoryPolicyRepository()
+	if db != nil {
+		repo = radius.NewGormPolicyRepository(db)
+	}
+	return radius.NewPolicyManager(repo, codec), nil
+}
+
+// newPasswordless creates the service of the passwordless logins, whose magic
+// links are signed with a key derived from the JWT secret.
+func newPasswordless(cfg utils.PasswordlessConfig, redisClient redis.RedisClientInterface, notifications notification.Manager, cryptoManager *utils.CryptoManager, logger *zap.Logger) *passwordless.Service {
+	linkURL := cfg.LinkURL
+	if linkURL == "" {
+		linkURL = strings.TrimSuffix(cryptoManager.Issuer(), "/") + "/auth/passwordless"
+	}
+	return passwordless.NewService(redisClient, notifications, passwordless.Config{
+		TTL:         cfg.TTL,
+		CodeLength:  cfg.CodeLength,
+		MaxAttempts: cfg.MaxAttempts,
+		SendLimit:   cfg.SendLimit,
+		SourceLimit: cfg.SourceLimit,
+		SendWindow:  cfg.SendWindow,
+		LinkURL:     linkURL,
+		SigningKey:  cryptoManager.DeriveKey("passwordless-link"),
+	}, logger)
+}
+
+// newPasswordPolicy creates the password policy engine, with the password
+// history in Redis and the breached-password corpus loaded from its file.
+func newPasswordPolicy(cfg utils.PasswordPolicyConfig, hasher passwordpolicy.Hasher, redisClient redis.RedisClientInterface, logger *zap.Logger) (*passwordpolicy.Engine, error) {
+	rules := func(r utils.PasswordPolicyRules) passwordpolicy.Policy {
+		return passwordpolicy.Policy{
+			MinLength:        r.MinLength,
+			RequireUppercase: r.RequireUppercase,
+			RequireLowercase: r.RequireLowercase,
+			RequireDigit:     r.RequireDigit,
+			RequireSymbol:    r.RequireSymbol,
+			MinStrength:      r.MinStrength,
+			HistorySize:      r.HistorySize,
+			MaxAge:           r.MaxAge,
+			CheckBreached:    r.CheckBreached,
+		}
+	}
+	config := passwordpolicy.Config{
+		Default: rules(cfg.Default),
+		Tenants: map[string]passwordpolicy.Policy{},
+		Groups:  map[string]passwordpolicy.Policy{},
+	}
+	for tenant, r := range cfg.Tenants {
+		config.Tenants[tenant] = rules(r)
+	}
+	for group, r := range cfg.Groups {
+		config.Groups[group] = rules(r)
+	}
+
+	engine := passwordpolicy.NewEngine(config, hasher, logger)
+	if redisClient != nil {
+		engine.SetHistoryStore(passwordpolicy.NewRedisHistoryStore(redisClient))
+	}
+	if cfg.BreachedHashesFile != "" {
+		corpus, err := passwordpolicy.LoadCorpus(cfg.BreachedHashesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load breached password hashes: %w", err)
+		}
+		logger.Info("Loaded breached password hashes", zap.Int("count", corpus.Len()))
+		engine.SetBreachCorpus(corpus)
+	}
+	return engine, nil
+}
+
 // Start begins listening for and serving HTTP requests.
 func (s *Server) Start() {
 	s.logger.Info(context.Background(), "Starting HTTP server", zap.String("address", s.httpServer.Addr))
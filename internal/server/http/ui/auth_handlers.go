@@ -1,26 +1,84 @@
 package ui
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
 )
 
+// defaultLoginRedirect is where users land after logging in without a return_to target.
+const defaultLoginRedirect = "/portal/devices"
+
+// mfaChallengeCookieName is the cookie that carries the MFA challenge of a
+// login between the login form and the MFA page. The challenge itself is
+// kept server-side and bound to the user it was issued for.
+const mfaChallengeCookieName = "qid_mfa_challenge"
+
+// LoginService authenticates a user with a username and password or a
+// passwordless magic link and completes the MFA step of the login when one
+// is required.
+type LoginService interface {
+	LoginWithPassword(ctx context.Context, req auth.AuthnRequest, serviceConfig auth.Config) (*types.AuthResult, error)
+	CompletePasswordless(ctx context.Context, req auth.PasswordlessCompleteRequest, serviceConfig auth.Config) (*types.AuthResult, error)
+	PendingMFAChallenge(ctx context.Context, challengeID string) (*mfa.LoginChallenge, error)
+	VerifyMFAChallenge(ctx context.Context, req *types.VerifyMFARequest, serviceConfig auth.Config) (*types.AuthResult, error)
+}
+
 // AuthHandler handles UI-based authentication flows.
 type AuthHandler struct {
-	renderer *Renderer
+	renderer       *Renderer
+	authService    LoginService
+	sessionManager *redis.SessionManager
+	logger         *zap.Logger
+	federation     bool
 }
 
 // NewAuthHandler creates a new AuthHandler.
-func NewAuthHandler(renderer *Renderer) *AuthHandler {
-	return &AuthHandler{renderer: renderer}
+func NewAuthHandler(renderer *Renderer, authService LoginService, sessionManager *redis.SessionManager, logger *zap.Logger) *AuthHandler {
+	return &AuthHandler{
+		renderer:       renderer,
+		authService:    authService,
+		sessionManager: sessionManager,
+		logger:         logger,
+	}
+}
+
+// EnableFederation offers sign-in through the user's organization on the
+// login page, starting with home realm discovery by email address.
+func (h *AuthHandler) EnableFederation() {
+	h.federation = true
 }
 
-// ShowLoginPage renders the login page.
+// ShowLoginPage renders the login page. An OpenID Connect login_hint is used
+// to prefill the username.
 func (h *AuthHandler) ShowLoginPage(w http.ResponseWriter, r *http.Request) {
-	h.renderer.Render(w, r, "login.html", nil)
+	data := map[string]string{
+		"ReturnTo": safeReturnTo(r.URL.Query().Get("return_to")),
+		"Username": r.URL.Query().Get("login_hint"),
+	}
+	h.render(w, r, data)
 }
 
-// HandleLogin processes the login form submission.
-// TODO: Integrate with the actual authentication service.
+// render renders the login page, with the organization sign-in form when
+// federation is enabled.
+func (h *AuthHandler) render(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if h.federation {
+		data["Federation"] = "true"
+	}
+	h.renderer.Render(w, r, "login.html", data)
+}
+
+// HandleLogin processes the login form submission. On success it starts a
+// browser session and returns the user to the page that required the login,
+// such as an OAuth authorization request.
 func (h *AuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
@@ -29,48 +87,202 @@ func (h *AuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	returnTo := safeReturnTo(r.FormValue("return_to"))
 
-	// --- Placeholder Logic ---
-	// In a real implementation, you would call your auth service here.
-	// e.g., auth.Authenticate(username, password)
-	if username == "admin" && password == "password" {
-		// On success, redirect to a dashboard or the original URL.
-		// For now, let's assume MFA is required and redirect to the MFA page.
-		http.Redirect(w, r, "/auth/mfa", http.StatusFound)
-	} else {
-		// On failure, re-render the login page with an error.
+	result, err := h.authService.LoginWithPassword(r.Context(), auth.AuthnRequest{
+		Username:  username,
+		Password:  password,
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+		ClientID:  returnToClientID(returnTo),
+		ACRValues: returnToACRValues(returnTo),
+	}, auth.Config{})
+	if err != nil {
+		h.logger.Info("UI login failed", zap.String("username", username), zap.Error(err))
+		message := "Invalid username or password"
+		if errors.Is(err, types.ErrUserLocked) || errors.Is(err, types.ErrTooManyRequests) {
+			message = "Too many failed sign-in attempts. Please try again later."
+		} else if errors.Is(err, types.ErrPasswordExpired) {
+			message = "Your password has expired. Use \"Forgot password\" to set a new one."
+		} else if errors.Is(err, types.ErrMfaRequired) {
+			message = "This application requires a second factor you have not enrolled."
+		}
 		data := map[string]string{
-			"Error":    "Invalid username or password",
+			"Error":    message,
 			"Username": username,
+			"ReturnTo": returnTo,
+		}
+		h.render(w, r, data)
+		return
+	}
+
+	if result.IsMfaRequired {
+		if result.MFAChallenge == nil {
+			h.logger.Error("MFA required without a challenge", zap.String("username", username))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
 		}
-		h.renderer.Render(w, r, "login.html", data)
+		h.setMFAChallengeCookie(w, r, result.MFAChallenge.ChallengeID, 0)
+		http.Redirect(w, r, withReturnTo("/auth/mfa", returnTo), http.StatusFound)
+		return
 	}
+
+	h.startSession(w, r, result.User.ID, []string{"pwd"}, mfa.ACRPassword, returnTo)
 }
 
-// ShowMFAPage renders the MFA challenge page.
+// ShowMFAPage renders the MFA step of a login, offering the providers the
+// pending challenge can be answered with.
 func (h *AuthHandler) ShowMFAPage(w http.ResponseWriter, r *http.Request) {
-	h.renderer.Render(w, r, "mfa_challenge.html", nil)
+	returnTo := safeReturnTo(r.URL.Query().Get("return_to"))
+	challenge, ok := h.pendingChallenge(w, r, returnTo)
+	if !ok {
+		return
+	}
+	h.renderMFA(w, r, challenge, challenge.Provider, returnTo, "")
 }
 
-// HandleMFA processes the MFA submission.
+// HandleMFA verifies the answer to the pending MFA challenge and, once it
+// verifies, starts the browser session of the login.
 func (h *AuthHandler) HandleMFA(w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle TOTP and WebAuthn submissions.
-	http.Redirect(w, r, "/dashboard", http.StatusFound) // Placeholder
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	returnTo := safeReturnTo(r.FormValue("return_to"))
+	challenge, ok := h.pendingChallenge(w, r, returnTo)
+	if !ok {
+		return
+	}
+	provider := r.FormValue("provider")
+
+	result, err := h.authService.VerifyMFAChallenge(r.Context(), &types.VerifyMFARequest{
+		ChallengeID: challenge.ID,
+		Code:        strings.TrimSpace(r.FormValue("code")),
+		Provider:    provider,
+	}, auth.Config{})
+	switch {
+	case errors.Is(err, types.ErrMfaCodeInvalid):
+		h.renderMFA(w, r, challenge, provider, returnTo, "Invalid code. Please try again.")
+		return
+	case errors.Is(err, types.ErrAuthorizationPending):
+		h.renderMFA(w, r, challenge, provider, returnTo, "Approve the sign-in on your device, then continue.")
+		return
+	case err != nil:
+		h.logger.Info("UI MFA verification failed", zap.String("userID", challenge.UserID), zap.Error(err))
+		h.setMFAChallengeCookie(w, r, "", -1)
+		h.render(w, r, map[string]string{
+			"Error":    "Your sign-in could not be verified. Please sign in again.",
+			"ReturnTo": returnTo,
+		})
+		return
+	}
+
+	h.setMFAChallengeCookie(w, r, "", -1)
+	amr := append([]string{"pwd"}, result.Session.AuthMethods...)
+	h.startSession(w, r, result.User.ID, amr, result.Session.ACR, returnTo)
+}
+
+// pendingChallenge returns the MFA challenge of the login in progress. When
+// there is none, or it expired, the user is sent back to the login page.
+func (h *AuthHandler) pendingChallenge(w http.ResponseWriter, r *http.Request, returnTo string) (*mfa.LoginChallenge, bool) {
+	cookie, err := r.Cookie(mfaChallengeCookieName)
+	if err == nil && cookie.Value != "" {
+		challenge, err := h.authService.PendingMFAChallenge(r.Context(), cookie.Value)
+		if err == nil {
+			return challenge, true
+		}
+		h.setMFAChallengeCookie(w, r, "", -1)
+	}
+	http.Redirect(w, r, withReturnTo("/auth/login", returnTo), http.StatusFound)
+	return nil, false
 }
 
-// ShowConsentPage renders the OIDC consent page.
-func (h *AuthHandler) ShowConsentPage(w http.ResponseWriter, r *http.Request) {
-	// In a real OIDC flow, you would fetch details about the client application
-	// and the requested scopes from the request context or a session store.
-	dummyData := map[string]interface{}{
-		"ClientName": "Example App",
-		"Scopes":     []string{"openid", "profile", "email"},
+// renderMFA renders the MFA page for a challenge with the provider to answer
+// it with preselected.
+func (h *AuthHandler) renderMFA(w http.ResponseWriter, r *http.Request, challenge *mfa.LoginChallenge, provider, returnTo, message string) {
+	if !challenge.Allows(provider) {
+		provider = challenge.Provider
 	}
-	h.renderer.Render(w, r, "consent.html", dummyData)
+	h.renderer.Render(w, r, "mfa_challenge.html", map[string]interface{}{
+		"Providers": challenge.Providers,
+		"Provider":  provider,
+		"ReturnTo":  returnTo,
+		"Error":     message,
+	})
+}
+
+// setMFAChallengeCookie sets the cookie carrying the MFA challenge of the
+// login, or clears it with a negative maxAge.
+func (h *AuthHandler) setMFAChallengeCookie(w http.ResponseWriter, r *http.Request, challengeID string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfaChallengeCookieName,
+		Value:    challengeID,
+		Path:     "/auth/mfa",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
-// HandleConsent processes the user's decision on the OIDC consent page.
-func (h *AuthHandler) HandleConsent(w http.ResponseWriter, r *http.Request) {
-	// TODO: Process the user's consent (allow/deny) and complete the OIDC flow.
-	http.Error(w, "Not Implemented", http.StatusNotImplemented)
+// startSession starts the browser session of a completed login and returns
+// the user to the page that required it.
+func (h *AuthHandler) startSession(w http.ResponseWriter, r *http.Request, userID string, amr []string, acr, returnTo string) {
+	session, err := h.sessionManager.CreateSession(r.Context(), userID, r, redis.WithAuthentication(amr, acr))
+	if err != nil {
+		h.logger.Error("Failed to create session", zap.String("userID", userID), zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     redis.SessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if returnTo == "" {
+		returnTo = defaultLoginRedirect
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// withReturnTo adds a return_to target to a local path.
+func withReturnTo(path, returnTo string) string {
+	if returnTo == "" {
+		return path
+	}
+	return path + "?return_to=" + url.QueryEscape(returnTo)
+}
+
+// safeReturnTo only allows local, path-absolute return targets so the login
+// page cannot be used as an open redirect.
+func safeReturnTo(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return ""
+	}
+	return target
+}
+
+// returnToClientID returns the client ID of an authorization request the
+// login returns to, so that MFA approvals can name the application.
+func returnToClientID(returnTo string) string {
+	target, err := url.Parse(returnTo)
+	if err != nil {
+		return ""
+	}
+	return target.Query().Get("client_id")
+}
+
+// returnToACRValues returns the acr values requested by an authorization
+// request the login returns to, so that the login can step up to them.
+func returnToACRValues(returnTo string) []string {
+	target, err := url.Parse(returnTo)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(target.Query().Get("acr_values"))
 }
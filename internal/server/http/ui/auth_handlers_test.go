@@ -1,22 +1,96 @@
 package ui
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	goredis "github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"html/template"
 	"github.com/turtacn/QuantaID/web"
+	"go.uber.org/zap"
 
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
 	"github.com/turtacn/QuantaID/internal/server/http/middleware"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
 )
 
+// fakeLoginService accepts admin/password and requires MFA for mfa-user/password.
+// The MFA challenge of mfa-user is answered with the TOTP code 123456.
+type fakeLoginService struct{}
+
+const (
+	fakeChallengeID      = "challenge-1"
+	fakeMFACode          = "123456"
+	fakeMagicLinkToken   = "magic-token"
+	fakePasswordlessFlow = "flow-1"
+)
+
+func (fakeLoginService) LoginWithPassword(ctx context.Context, req auth.AuthnRequest, serviceConfig auth.Config) (*types.AuthResult, error) {
+	if req.Password != "password" {
+		return nil, errors.New("invalid credentials")
+	}
+	switch req.Username {
+	case "admin":
+		return &types.AuthResult{User: &types.User{ID: "user-admin", Username: "admin"}}, nil
+	case "mfa-user":
+		return &types.AuthResult{
+			User:          &types.User{ID: "user-mfa", Username: "mfa-user"},
+			IsMfaRequired: true,
+			MFAChallenge:  &types.MFAChallenge{ChallengeID: fakeChallengeID, MFAProvider: "totp"},
+		}, nil
+	}
+	return nil, errors.New("invalid credentials")
+}
+
+// CompletePasswordless accepts the magic link token of a same-device flow
+// completed with its flow ID.
+func (fakeLoginService) CompletePasswordless(ctx context.Context, req auth.PasswordlessCompleteRequest, serviceConfig auth.Config) (*types.AuthResult, error) {
+	if req.Token != fakeMagicLinkToken {
+		return nil, types.ErrInvalidToken
+	}
+	if req.FlowID != fakePasswordlessFlow {
+		return nil, types.ErrDeviceMismatch
+	}
+	return &types.AuthResult{
+		User:    &types.User{ID: "user-admin", Username: "admin"},
+		Session: &types.UserSession{AuthMethods: []string{"otp"}, ACR: mfa.ACRPassword},
+	}, nil
+}
+
+func (fakeLoginService) PendingMFAChallenge(ctx context.Context, challengeID string) (*mfa.LoginChallenge, error) {
+	if challengeID != fakeChallengeID {
+		return nil, types.ErrMfaChallengeInvalid
+	}
+	return &mfa.LoginChallenge{ID: challengeID, UserID: "user-mfa", Providers: []string{"recovery", "totp"}, Provider: "totp"}, nil
+}
+
+func (f fakeLoginService) VerifyMFAChallenge(ctx context.Context, req *types.VerifyMFARequest, serviceConfig auth.Config) (*types.AuthResult, error) {
+	if _, err := f.PendingMFAChallenge(ctx, req.ChallengeID); err != nil {
+		return nil, err
+	}
+	if req.Provider != "totp" || req.Code != fakeMFACode {
+		return nil, types.ErrMfaCodeInvalid
+	}
+	return &types.AuthResult{
+		User:    &types.User{ID: "user-mfa", Username: "mfa-user"},
+		Session: &types.UserSession{AuthMethods: []string{"otp", "mfa"}, ACR: mfa.ACRMFA},
+	}, nil
+}
+
 // TestLoginRenderIsolation focuses ONLY on rendering the login page
 // to isolate template parsing and inheritance issues.
 func TestLoginRenderIsolation(t *testing.T) {
@@ -59,25 +133,40 @@ func TestLoginRenderIsolation(t *testing.T) {
 }
 
 // setupTestServer configures a test server with the UI handlers and middleware.
-func setupTestServer() (http.Handler, error) {
+func setupTestServer(t *testing.T) (http.Handler, error) {
+	server, _, err := setupTestServerWithSessions(t)
+	return server, err
+}
+
+// setupTestServerWithSessions is setupTestServer that also returns the
+// session manager browser sessions are created in.
+func setupTestServerWithSessions(t *testing.T) (http.Handler, *redis.SessionManager, error) {
 	renderer, err := NewRenderer()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	authHandler := NewAuthHandler(renderer)
+	mr := miniredis.RunT(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+	sessionManager := redis.NewSessionManager(client, redis.SessionConfig{DefaultTTL: time.Hour}, zap.NewNop(),
+		&redis.GoogleUUIDGenerator{}, &redis.RealClock{}, redis.NewMetrics("ui_test", prometheus.NewRegistry()))
+
+	authHandler := NewAuthHandler(renderer, fakeLoginService{}, sessionManager, zap.NewNop())
 
 	r := mux.NewRouter()
 	r.HandleFunc("/auth/login", authHandler.ShowLoginPage).Methods("GET")
 	r.HandleFunc("/auth/login", authHandler.HandleLogin).Methods("POST")
 	r.HandleFunc("/auth/mfa", authHandler.ShowMFAPage).Methods("GET")
+	r.HandleFunc("/auth/mfa", authHandler.HandleMFA).Methods("POST")
+	r.HandleFunc("/auth/passwordless", authHandler.ShowPasswordlessPage).Methods("GET")
+	r.HandleFunc("/auth/passwordless", authHandler.HandlePasswordless).Methods("POST")
 
 	// Wrap the router with the CSRF middleware for a realistic test
-	return middleware.CSRFMiddleware(r), nil
+	return middleware.CSRFMiddleware(r), sessionManager, nil
 }
 
 func TestAuthHandler_ShowLoginPage(t *testing.T) {
-	server, err := setupTestServer()
+	server, err := setupTestServer(t)
 	require.NoError(t, err)
 
 	req := httptest.NewRequest("GET", "/auth/login", nil)
@@ -112,7 +201,7 @@ func TestAuthHandler_ShowLoginPage(t *testing.T) {
 }
 
 func TestAuthHandler_HandleLogin(t *testing.T) {
-	server, err := setupTestServer()
+	server, err := setupTestServer(t)
 	require.NoError(t, err)
 
 	// --- Step 1: GET the login page to get a valid CSRF token and cookie ---
@@ -140,9 +229,76 @@ func TestAuthHandler_HandleLogin(t *testing.T) {
 
 		server.ServeHTTP(rrPost, reqPost)
 
-		// Assert a redirect to the MFA page
+		// Assert a redirect to the default page with a session cookie set
+		assert.Equal(t, http.StatusFound, rrPost.Code)
+		assert.Equal(t, defaultLoginRedirect, rrPost.Header().Get("Location"))
+		var sessionCookie *http.Cookie
+		for _, c := range rrPost.Result().Cookies() {
+			if c.Name == redis.SessionCookieName {
+				sessionCookie = c
+			}
+		}
+		require.NotNil(t, sessionCookie)
+		assert.NotEmpty(t, sessionCookie.Value)
+		assert.True(t, sessionCookie.HttpOnly)
+	})
+
+	t.Run("Login Returns To Original Page", func(t *testing.T) {
+		form := url.Values{}
+		form.Add("username", "admin")
+		form.Add("password", "password")
+		form.Add("return_to", "/oauth/authorize?client_id=app")
+		form.Add("_csrf", csrfToken)
+
+		reqPost := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+		reqPost.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		reqPost.AddCookie(csrfCookie)
+		rrPost := httptest.NewRecorder()
+
+		server.ServeHTTP(rrPost, reqPost)
+
+		assert.Equal(t, http.StatusFound, rrPost.Code)
+		assert.Equal(t, "/oauth/authorize?client_id=app", rrPost.Header().Get("Location"))
+	})
+
+	t.Run("Open Redirect Rejected", func(t *testing.T) {
+		form := url.Values{}
+		form.Add("username", "admin")
+		form.Add("password", "password")
+		form.Add("return_to", "//evil.example.com/")
+		form.Add("_csrf", csrfToken)
+
+		reqPost := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+		reqPost.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		reqPost.AddCookie(csrfCookie)
+		rrPost := httptest.NewRecorder()
+
+		server.ServeHTTP(rrPost, reqPost)
+
+		assert.Equal(t, http.StatusFound, rrPost.Code)
+		assert.Equal(t, defaultLoginRedirect, rrPost.Header().Get("Location"))
+	})
+
+	t.Run("MFA Required", func(t *testing.T) {
+		form := url.Values{}
+		form.Add("username", "mfa-user")
+		form.Add("password", "password")
+		form.Add("_csrf", csrfToken)
+
+		reqPost := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+		reqPost.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		reqPost.AddCookie(csrfCookie)
+		rrPost := httptest.NewRecorder()
+
+		server.ServeHTTP(rrPost, reqPost)
+
 		assert.Equal(t, http.StatusFound, rrPost.Code)
 		assert.Equal(t, "/auth/mfa", rrPost.Header().Get("Location"))
+		challengeCookie := findCookie(rrPost.Result(), mfaChallengeCookieName)
+		require.NotNil(t, challengeCookie)
+		assert.Equal(t, fakeChallengeID, challengeCookie.Value)
+		assert.True(t, challengeCookie.HttpOnly)
+		assert.Nil(t, findCookie(rrPost.Result(), redis.SessionCookieName))
 	})
 
 	// --- Test Case 2: Failed Login (Bad Password) ---
@@ -184,3 +340,148 @@ func TestAuthHandler_HandleLogin(t *testing.T) {
 		assert.Equal(t, http.StatusForbidden, rrPost.Code)
 	})
 }
+
+func TestAuthHandler_LoginWithMFA(t *testing.T) {
+	server, sessionManager, err := setupTestServerWithSessions(t)
+	require.NoError(t, err)
+	returnTo := "/oauth/authorize?client_id=app"
+
+	reqGet := httptest.NewRequest("GET", "/auth/login", nil)
+	rrGet := httptest.NewRecorder()
+	server.ServeHTTP(rrGet, reqGet)
+	require.Equal(t, http.StatusOK, rrGet.Code)
+	csrfCookie := findCookie(rrGet.Result(), "_csrf")
+	require.NotNil(t, csrfCookie)
+	doc, err := goquery.NewDocumentFromReader(rrGet.Body)
+	require.NoError(t, err)
+	csrfToken, _ := doc.Find("input[name='_csrf']").Attr("value")
+
+	post := func(path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		form.Set("_csrf", csrfToken)
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(csrfCookie)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The password is accepted and the browser is sent to the MFA step.
+	rr := post("/auth/login", url.Values{"username": {"mfa-user"}, "password": {"password"}, "return_to": {returnTo}})
+	require.Equal(t, http.StatusFound, rr.Code)
+	mfaPage := rr.Header().Get("Location")
+	assert.Equal(t, "/auth/mfa?return_to="+url.QueryEscape(returnTo), mfaPage)
+	challengeCookie := findCookie(rr.Result(), mfaChallengeCookieName)
+	require.NotNil(t, challengeCookie)
+
+	// Without the challenge cookie there is no MFA step to complete.
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", mfaPage, nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/auth/login?return_to="+url.QueryEscape(returnTo), rr.Header().Get("Location"))
+
+	// The MFA page offers the providers of the challenge.
+	req := httptest.NewRequest("GET", mfaPage, nil)
+	req.AddCookie(csrfCookie)
+	req.AddCookie(challengeCookie)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	doc, err = goquery.NewDocumentFromReader(rr.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 2, doc.Find("select[name='provider'] option").Length())
+	selected, _ := doc.Find("select[name='provider'] option[selected]").Attr("value")
+	assert.Equal(t, "totp", selected)
+	hiddenReturnTo, _ := doc.Find("input[name='return_to']").Attr("value")
+	assert.Equal(t, returnTo, hiddenReturnTo)
+
+	// A wrong code keeps the user on the MFA page without a session.
+	rr = post("/auth/mfa", url.Values{"provider": {"totp"}, "code": {"000000"}, "return_to": {returnTo}}, challengeCookie)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Invalid code")
+	assert.Nil(t, findCookie(rr.Result(), redis.SessionCookieName))
+
+	// The right code completes the login with an MFA session.
+	rr = post("/auth/mfa", url.Values{"provider": {"totp"}, "code": {fakeMFACode}, "return_to": {returnTo}}, challengeCookie)
+	require.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, returnTo, rr.Header().Get("Location"))
+	cleared := findCookie(rr.Result(), mfaChallengeCookieName)
+	require.NotNil(t, cleared)
+	assert.True(t, cleared.MaxAge < 0)
+	sessionCookie := findCookie(rr.Result(), redis.SessionCookieName)
+	require.NotNil(t, sessionCookie)
+
+	session, err := sessionManager.GetSession(context.Background(), sessionCookie.Value, httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "user-mfa", session.UserID)
+	assert.Equal(t, []string{"pwd", "otp", "mfa"}, session.AuthMethods)
+	assert.Equal(t, mfa.ACRMFA, session.ACR)
+}
+
+func findCookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestAuthHandler_PasswordlessLink(t *testing.T) {
+	server, sessionManager, err := setupTestServerWithSessions(t)
+	require.NoError(t, err)
+	flowCookie := &http.Cookie{Name: passwordlessFlowCookieName, Value: fakePasswordlessFlow}
+
+	// Opening the link only renders a confirmation form.
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/passwordless?token="+fakeMagicLinkToken, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, findCookie(rr.Result(), redis.SessionCookieName))
+	csrfCookie := findCookie(rr.Result(), "_csrf")
+	require.NotNil(t, csrfCookie)
+	doc, err := goquery.NewDocumentFromReader(rr.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "post", doc.Find("form").AttrOr("method", ""))
+	assert.Equal(t, fakeMagicLinkToken, doc.Find("input[name='token']").AttrOr("value", ""))
+	csrfToken := doc.Find("input[name='_csrf']").AttrOr("value", "")
+
+	post := func(form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		form.Set("_csrf", csrfToken)
+		req := httptest.NewRequest("POST", "/auth/passwordless", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(csrfCookie)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr = post(url.Values{"token": {fakeMagicLinkToken}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "device you requested it from")
+	assert.Nil(t, findCookie(rr.Result(), redis.SessionCookieName))
+
+	rr = post(url.Values{"token": {"forged"}}, flowCookie)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid or has expired")
+
+	// Submitting the form completes the login with a browser session.
+	rr = post(url.Values{"token": {fakeMagicLinkToken}}, flowCookie)
+	require.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, defaultLoginRedirect, rr.Header().Get("Location"))
+	cleared := findCookie(rr.Result(), passwordlessFlowCookieName)
+	require.NotNil(t, cleared)
+	assert.True(t, cleared.MaxAge < 0)
+	sessionCookie := findCookie(rr.Result(), redis.SessionCookieName)
+	require.NotNil(t, sessionCookie)
+
+	session, err := sessionManager.GetSession(context.Background(), sessionCookie.Value, httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "user-admin", session.UserID)
+	assert.Equal(t, []string{"otp"}, session.AuthMethods)
+}
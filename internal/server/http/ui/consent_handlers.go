@@ -0,0 +1,94 @@
+package ui
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/internal/server/middleware"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// ConsentInfo describes a consent grant for display in the portal.
+type ConsentInfo struct {
+	ClientID   string
+	ClientName string
+	Scopes     []string
+	GrantedAt  string
+}
+
+// ConsentHandler lets users review and revoke the access they granted to OAuth clients.
+type ConsentHandler struct {
+	consents oauth.ConsentRepository
+	appRepo  types.ApplicationRepository
+	renderer *Renderer
+	logger   *zap.Logger
+}
+
+// NewConsentHandler creates a new ConsentHandler.
+func NewConsentHandler(consents oauth.ConsentRepository, appRepo types.ApplicationRepository, renderer *Renderer, logger *zap.Logger) *ConsentHandler {
+	return &ConsentHandler{
+		consents: consents,
+		appRepo:  appRepo,
+		renderer: renderer,
+		logger:   logger,
+	}
+}
+
+// ListConsents renders the applications the user has authorized.
+func (h *ConsentHandler) ListConsents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDContextKey)
+	if userID == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	consents, err := h.consents.ListConsents(r.Context(), userID.(string))
+	if err != nil {
+		h.logger.Error("Failed to list consents", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	apps := make([]ConsentInfo, 0, len(consents))
+	for _, c := range consents {
+		name := c.ClientID
+		if h.appRepo != nil {
+			if app, err := h.appRepo.GetApplicationByClientID(r.Context(), c.ClientID); err == nil && app != nil {
+				name = app.Name
+			}
+		}
+		apps = append(apps, ConsentInfo{
+			ClientID:   c.ClientID,
+			ClientName: name,
+			Scopes:     c.Scopes,
+			GrantedAt:  c.GrantedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	data := map[string]interface{}{
+		"Consents": apps,
+	}
+
+	h.renderer.Render(w, r, "portal/consents.html", data)
+}
+
+// RevokeConsent removes the user's consent for a client. The client will have
+// to ask for consent again on its next authorization request.
+func (h *ConsentHandler) RevokeConsent(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDContextKey)
+	if userID == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	clientID := mux.Vars(r)["clientID"]
+	if err := h.consents.RevokeConsent(r.Context(), userID.(string), clientID); err != nil {
+		h.logger.Error("Failed to revoke consent", zap.String("clientID", clientID), zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/portal/consents", http.StatusSeeOther)
+}
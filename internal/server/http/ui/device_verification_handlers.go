@@ -0,0 +1,132 @@
+package ui
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// DeviceVerificationHandler serves the verification page of the OAuth device
+// authorization grant, where a logged-in user enters the code shown on a
+// device and approves or denies its access request.
+type DeviceVerificationHandler struct {
+	deviceFlow     *oauth.DeviceFlowHandler
+	appRepo        types.ApplicationRepository
+	sessionManager *redis.SessionManager
+	renderer       *Renderer
+	logger         *zap.Logger
+}
+
+// NewDeviceVerificationHandler creates a new DeviceVerificationHandler.
+func NewDeviceVerificationHandler(deviceFlow *oauth.DeviceFlowHandler, appRepo types.ApplicationRepository, sessionManager *redis.SessionManager, renderer *Renderer, logger *zap.Logger) *DeviceVerificationHandler {
+	return &DeviceVerificationHandler{
+		deviceFlow:     deviceFlow,
+		appRepo:        appRepo,
+		sessionManager: sessionManager,
+		renderer:       renderer,
+		logger:         logger,
+	}
+}
+
+// ShowVerification renders the user code form or, when the user_code
+// parameter is present, the request it belongs to for confirmation. Users
+// without a session are sent to the login page and returned here afterwards.
+func (h *DeviceVerificationHandler) ShowVerification(w http.ResponseWriter, r *http.Request) {
+	if h.currentSession(r) == nil {
+		http.Redirect(w, r, "/auth/login?"+url.Values{"return_to": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+		return
+	}
+
+	userCode := r.URL.Query().Get("user_code")
+	if userCode == "" {
+		h.renderer.Render(w, r, "device.html", map[string]interface{}{})
+		return
+	}
+	h.renderConfirmation(w, r, userCode)
+}
+
+// HandleVerification processes the user code form and the approve or deny
+// decision for a device.
+func (h *DeviceVerificationHandler) HandleVerification(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	session := h.currentSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userCode := r.PostForm.Get("user_code")
+	var err error
+	switch r.PostForm.Get("action") {
+	case "approve":
+		authTime := session.AuthTime
+		if authTime.IsZero() {
+			authTime = session.CreatedAt
+		}
+		err = h.deviceFlow.ActivateDeviceCodeForSession(r.Context(), userCode, session.UserID, session.ID, authTime)
+	case "deny":
+		err = h.deviceFlow.DenyDeviceCode(r.Context(), userCode)
+	default:
+		// The code was entered on the form; ask the user to confirm the request.
+		h.renderConfirmation(w, r, userCode)
+		return
+	}
+	if err != nil {
+		h.logger.Info("Device verification failed", zap.String("userID", session.UserID), zap.Error(err))
+		h.renderer.Render(w, r, "device.html", map[string]interface{}{
+			"Error": "The code is invalid or has expired.",
+		})
+		return
+	}
+
+	h.renderer.Render(w, r, "device.html", map[string]interface{}{
+		"Done":     true,
+		"Approved": r.PostForm.Get("action") == "approve",
+	})
+}
+
+// renderConfirmation shows which client is asking for access with userCode.
+func (h *DeviceVerificationHandler) renderConfirmation(w http.ResponseWriter, r *http.Request, userCode string) {
+	record, err := h.deviceFlow.LookupUserCode(r.Context(), userCode)
+	if err != nil {
+		h.renderer.Render(w, r, "device.html", map[string]interface{}{
+			"Error":    "The code is invalid or has expired.",
+			"UserCode": userCode,
+		})
+		return
+	}
+
+	clientName := record.ClientID
+	if h.appRepo != nil {
+		if app, err := h.appRepo.GetApplicationByClientID(r.Context(), record.ClientID); err == nil && app != nil && app.Name != "" {
+			clientName = app.Name
+		}
+	}
+	h.renderer.Render(w, r, "device.html", map[string]interface{}{
+		"Confirm":    true,
+		"UserCode":   strings.ToUpper(userCode),
+		"ClientName": clientName,
+		"Scopes":     strings.Fields(record.Scope),
+	})
+}
+
+// currentSession returns the session identified by the session cookie, or nil.
+func (h *DeviceVerificationHandler) currentSession(r *http.Request) *types.UserSession {
+	cookie, err := r.Cookie(redis.SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	session, err := h.sessionManager.GetSession(r.Context(), cookie.Value, r)
+	if err != nil {
+		return nil
+	}
+	return session
+}
@@ -0,0 +1,96 @@
+package ui
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/internal/server/http/middleware"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+)
+
+func TestDeviceVerificationHandler(t *testing.T) {
+	ctx := context.Background()
+	renderer, err := NewRenderer()
+	require.NoError(t, err)
+
+	mr := miniredis.RunT(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+	sessionManager := redis.NewSessionManager(client, redis.SessionConfig{DefaultTTL: time.Hour}, zap.NewNop(),
+		&redis.GoogleUUIDGenerator{}, &redis.RealClock{}, redis.NewMetrics("device_ui_test", prometheus.NewRegistry()))
+	devices := redis.NewRedisDeviceCodeRepository(client)
+	deviceFlow := oauth.NewDeviceFlowHandler(devices, nil, oauth.DeviceFlowConfig{VerificationURI: "/device"})
+	handler := NewDeviceVerificationHandler(deviceFlow, nil, sessionManager, renderer, zap.NewNop())
+
+	r := mux.NewRouter()
+	r.HandleFunc("/device", handler.ShowVerification).Methods("GET")
+	r.HandleFunc("/device", handler.HandleVerification).Methods("POST")
+	server := middleware.CSRFMiddleware(r)
+
+	authz, err := deviceFlow.HandleDeviceAuthorizationRequest(ctx, "tv", "openid profile")
+	require.NoError(t, err)
+
+	// Users must log in first, and come back to the code they were given.
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/device?user_code="+authz.UserCode, nil))
+	require.Equal(t, http.StatusFound, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/auth/login", location.Path)
+	assert.Equal(t, "/device?user_code="+authz.UserCode, location.Query().Get("return_to"))
+
+	session, err := sessionManager.CreateSession(ctx, "user-1", nil)
+	require.NoError(t, err)
+	sessionCookie := &http.Cookie{Name: redis.SessionCookieName, Value: session.ID}
+
+	req := httptest.NewRequest("GET", "/device?user_code="+strings.ToLower(authz.UserCode), nil)
+	req.AddCookie(sessionCookie)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(rr.Body.String()))
+	require.NoError(t, err)
+	assert.Contains(t, doc.Find("p strong").First().Text(), "tv")
+	assert.Equal(t, 1, doc.Find("button[value='approve']").Length())
+	csrfToken, _ := doc.Find("input[name='_csrf']").Attr("value")
+	csrfCookie := rr.Result().Cookies()[0]
+
+	form := url.Values{"_csrf": {csrfToken}, "user_code": {authz.UserCode}, "action": {"approve"}}
+	req = httptest.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(sessionCookie)
+	req.AddCookie(csrfCookie)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Your device is now connected")
+
+	record, err := devices.GetByDeviceCode(ctx, authz.DeviceCode)
+	require.NoError(t, err)
+	assert.Equal(t, oauth.DeviceCodeStatusAuthorized, record.Status)
+	assert.Equal(t, "user-1", record.UserID)
+	assert.Equal(t, session.ID, record.SessionID)
+
+	// The code cannot be used a second time.
+	req = httptest.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(sessionCookie)
+	req.AddCookie(csrfCookie)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	assert.Contains(t, rr.Body.String(), "invalid or has expired")
+}
@@ -0,0 +1,237 @@
+package ui
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/server/middleware"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// MFAFactorManager manages the MFA factors of a user.
+type MFAFactorManager interface {
+	ListMFAFactors(ctx context.Context, userID string) (*auth.MFAFactors, error)
+	EnrollTOTP(ctx context.Context, userID, sessionID string) (*types.MFAEnrollment, error)
+	ConfirmTOTP(ctx context.Context, userID, sessionID, code, ip string) (*auth.TOTPConfirmation, error)
+	RegenerateRecoveryCodes(ctx context.Context, userID, sessionID, ip string) ([]string, error)
+	SetDefaultMFAFactor(ctx context.Context, userID, factorID, ip string) (*mfa.Factor, error)
+	BeginMFAStepUp(ctx context.Context, userID, provider string) (*types.MFAChallenge, error)
+	CompleteMFAStepUp(ctx context.Context, userID, sessionID string, req *types.VerifyMFARequest, ip string) error
+	DeleteMFAFactor(ctx context.Context, userID, sessionID, factorID, ip string) error
+}
+
+// MFAFactorInfo describes an MFA factor for display in the portal.
+type MFAFactorInfo struct {
+	ID        string
+	Type      string
+	Default   bool
+	CanDelete bool
+	CreatedAt string
+	LastUsed  string
+}
+
+// MFAHandler lets users enroll and manage their MFA factors.
+type MFAHandler struct {
+	factors  MFAFactorManager
+	renderer *Renderer
+	logger   *zap.Logger
+}
+
+// NewMFAHandler creates a new MFAHandler.
+func NewMFAHandler(factors MFAFactorManager, renderer *Renderer, logger *zap.Logger) *MFAHandler {
+	return &MFAHandler{
+		factors:  factors,
+		renderer: renderer,
+		logger:   logger,
+	}
+}
+
+// ShowFactors renders the MFA factors of the user.
+func (h *MFAHandler) ShowFactors(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	h.renderFactors(w, r, userID, nil)
+}
+
+// EnrollTOTP starts a TOTP enrollment and shows the QR code to scan.
+func (h *MFAHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	enrollment, err := h.factors.EnrollTOTP(r.Context(), userID, currentSessionID(r))
+	if err != nil {
+		h.logger.Error("Failed to start TOTP enrollment", zap.Error(err))
+		redirectToMFA(w, r, "error", stepUpMessage(err, "The authenticator app could not be set up."))
+		return
+	}
+	h.renderer.Render(w, r, "portal/mfa_totp.html", map[string]interface{}{
+		// The QR code is a data URL generated by the server.
+		"QRCode": template.URL(enrollment.QRCode),
+		"Secret": enrollment.Secret,
+	})
+}
+
+// ConfirmTOTP completes a TOTP enrollment with the code in the form, and
+// shows the user's first recovery codes if they were issued.
+func (h *MFAHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	confirmation, err := h.factors.ConfirmTOTP(r.Context(), userID, currentSessionID(r), r.FormValue("code"), r.RemoteAddr)
+	if err != nil {
+		redirectToMFA(w, r, "error", stepUpMessage(err, "The code did not verify. Start the setup again and enter the current code from the app."))
+		return
+	}
+	if len(confirmation.RecoveryCodes) > 0 {
+		h.renderer.Render(w, r, "portal/mfa_recovery_codes.html", map[string]interface{}{
+			"Codes": confirmation.RecoveryCodes,
+		})
+		return
+	}
+	redirectToMFA(w, r, "notice", "Your authenticator app is set up.")
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes and shows the new ones.
+func (h *MFAHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	codes, err := h.factors.RegenerateRecoveryCodes(r.Context(), userID, currentSessionID(r), r.RemoteAddr)
+	if err != nil {
+		redirectToMFA(w, r, "error", stepUpMessage(err, "New recovery codes could not be generated."))
+		return
+	}
+	h.renderer.Render(w, r, "portal/mfa_recovery_codes.html", map[string]interface{}{
+		"Codes": codes,
+	})
+}
+
+// SetDefaultFactor makes a factor the one challenged first at login.
+func (h *MFAHandler) SetDefaultFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := h.factors.SetDefaultMFAFactor(r.Context(), userID, mux.Vars(r)["id"], r.RemoteAddr); err != nil {
+		redirectToMFA(w, r, "error", "The default method could not be changed.")
+		return
+	}
+	redirectToMFA(w, r, "notice", "Your default method was changed.")
+}
+
+// BeginStepUp challenges the user to verify a factor before a sensitive change.
+func (h *MFAHandler) BeginStepUp(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	challenge, err := h.factors.BeginMFAStepUp(r.Context(), userID, r.FormValue("provider"))
+	if err != nil {
+		redirectToMFA(w, r, "error", "Verification could not be started.")
+		return
+	}
+	h.renderFactors(w, r, userID, challenge)
+}
+
+// CompleteStepUp verifies the code of a step-up challenge.
+func (h *MFAHandler) CompleteStepUp(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	req := &types.VerifyMFARequest{
+		ChallengeID: r.FormValue("challenge_id"),
+		Provider:    r.FormValue("provider"),
+		Code:        r.FormValue("code"),
+	}
+	if err := h.factors.CompleteMFAStepUp(r.Context(), userID, currentSessionID(r), req, r.RemoteAddr); err != nil {
+		redirectToMFA(w, r, "error", "The code did not verify.")
+		return
+	}
+	redirectToMFA(w, r, "notice", "Verified. You can now remove methods and regenerate recovery codes for a few minutes.")
+}
+
+// DeleteFactor removes a factor after a step-up.
+func (h *MFAHandler) DeleteFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.factors.DeleteMFAFactor(r.Context(), userID, currentSessionID(r), mux.Vars(r)["id"], r.RemoteAddr); err != nil {
+		redirectToMFA(w, r, "error", stepUpMessage(err, "The method could not be removed."))
+		return
+	}
+	redirectToMFA(w, r, "notice", "The method was removed.")
+}
+
+func (h *MFAHandler) renderFactors(w http.ResponseWriter, r *http.Request, userID string, stepUp *types.MFAChallenge) {
+	factors, err := h.factors.ListMFAFactors(r.Context(), userID)
+	if err != nil {
+		h.logger.Error("Failed to list MFA factors", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]MFAFactorInfo, 0, len(factors.Factors))
+	for _, f := range factors.Factors {
+		info := MFAFactorInfo{
+			ID:        f.ID,
+			Type:      f.Type,
+			Default:   f.Default,
+			CanDelete: f.Type != "recovery",
+			CreatedAt: f.CreatedAt.Format("2006-01-02 15:04:05"),
+			LastUsed:  "Never",
+		}
+		if f.LastUsedAt != nil {
+			info.LastUsed = f.LastUsedAt.Format("2006-01-02 15:04:05")
+		}
+		infos = append(infos, info)
+	}
+
+	data := map[string]interface{}{
+		"Factors":                infos,
+		"RecoveryCodesRemaining": factors.RecoveryCodesRemaining,
+		"StepUp":                 stepUp,
+		"Error":                  r.URL.Query().Get("error"),
+		"Notice":                 r.URL.Query().Get("notice"),
+	}
+	h.renderer.Render(w, r, "portal/mfa.html", data)
+}
+
+func currentUserID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, ok := r.Context().Value(middleware.UserIDContextKey).(string)
+	if !ok || userID == "" {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return "", false
+	}
+	return userID, true
+}
+
+// currentSessionID returns the session the portal request was signed in with.
+func currentSessionID(r *http.Request) string {
+	id, _ := r.Context().Value(middleware.SessionIDContextKey).(string)
+	return id
+}
+
+func redirectToMFA(w http.ResponseWriter, r *http.Request, kind, message string) {
+	http.Redirect(w, r, "/portal/mfa?"+kind+"="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+// stepUpMessage tells the user to verify first when a change needs a step-up.
+func stepUpMessage(err error, fallback string) string {
+	if appErr, ok := err.(*types.Error); ok && appErr.Code == types.ErrStepUpRequired.Code {
+		return "Verify one of your methods first."
+	}
+	return fallback
+}
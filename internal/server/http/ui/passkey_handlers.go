@@ -0,0 +1,128 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/server/middleware"
+	"go.uber.org/zap"
+)
+
+// PasskeyStore manages the passkeys of a user.
+type PasskeyStore interface {
+	ListPasskeys(ctx context.Context, userID string) ([]*mfa.Passkey, error)
+	RenamePasskey(ctx context.Context, userID, passkeyID, name string) error
+	DeletePasskey(ctx context.Context, userID, passkeyID string) error
+}
+
+// PasskeyInfo describes a passkey for display in the portal.
+type PasskeyInfo struct {
+	ID        string
+	Name      string
+	Synced    bool
+	CreatedAt string
+	LastUsed  string
+}
+
+// PasskeyHandler lets users review, rename and delete their passkeys.
+type PasskeyHandler struct {
+	passkeys PasskeyStore
+	renderer *Renderer
+	logger   *zap.Logger
+}
+
+// NewPasskeyHandler creates a new PasskeyHandler.
+func NewPasskeyHandler(passkeys PasskeyStore, renderer *Renderer, logger *zap.Logger) *PasskeyHandler {
+	return &PasskeyHandler{
+		passkeys: passkeys,
+		renderer: renderer,
+		logger:   logger,
+	}
+}
+
+// ListPasskeys renders the passkeys of the user.
+func (h *PasskeyHandler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDContextKey)
+	if userID == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	passkeys, err := h.passkeys.ListPasskeys(r.Context(), userID.(string))
+	if err != nil {
+		h.logger.Error("Failed to list passkeys", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]PasskeyInfo, 0, len(passkeys))
+	for _, p := range passkeys {
+		info := PasskeyInfo{
+			ID:        p.ID,
+			Name:      p.Name,
+			Synced:    p.Synced,
+			CreatedAt: p.CreatedAt.Format("2006-01-02 15:04:05"),
+			LastUsed:  "Never",
+		}
+		if p.LastUsedAt != nil {
+			info.LastUsed = p.LastUsedAt.Format("2006-01-02 15:04:05")
+		}
+		infos = append(infos, info)
+	}
+
+	data := map[string]interface{}{
+		"Passkeys": infos,
+		"Error":    r.URL.Query().Get("error"),
+	}
+
+	h.renderer.Render(w, r, "portal/passkeys.html", data)
+}
+
+// RenamePasskey gives a passkey the name in the form.
+func (h *PasskeyHandler) RenamePasskey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDContextKey)
+	if userID == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	passkeyID := mux.Vars(r)["id"]
+	err := h.passkeys.RenamePasskey(r.Context(), userID.(string), passkeyID, r.FormValue("name"))
+	if errors.Is(err, mfa.ErrPasskeyNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.logger.Warn("Failed to rename passkey", zap.String("passkeyID", passkeyID), zap.Error(err))
+		http.Redirect(w, r, "/portal/passkeys?error=The+name+must+have+1+to+64+characters.", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/portal/passkeys", http.StatusSeeOther)
+}
+
+// DeletePasskey removes a passkey of the user.
+func (h *PasskeyHandler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserIDContextKey)
+	if userID == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	passkeyID := mux.Vars(r)["id"]
+	err := h.passkeys.DeletePasskey(r.Context(), userID.(string), passkeyID)
+	if errors.Is(err, mfa.ErrPasskeyNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to delete passkey", zap.String("passkeyID", passkeyID), zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/portal/passkeys", http.StatusSeeOther)
+}
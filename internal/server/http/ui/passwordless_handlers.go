@@ -0,0 +1,80 @@
+package ui
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// passwordlessFlowCookieName is the cookie set when a passwordless login is
+// started. It holds the flow ID that a same-device magic link must be
+// completed with.
+const passwordlessFlowCookieName = "qid_passwordless_flow"
+
+// ShowPasswordlessPage renders the confirmation page of a magic link.
+// Opening the link does not sign in, so that mail scanners which follow
+// links cannot use it up. The login is completed by the form the page posts.
+func (h *AuthHandler) ShowPasswordlessPage(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Redirect(w, r, "/auth/login", http.StatusFound)
+		return
+	}
+	h.renderer.Render(w, r, "passwordless_confirm.html", map[string]string{"Token": token})
+}
+
+// HandlePasswordless completes a passwordless login with the magic link
+// token posted by the confirmation page and starts the browser session, or
+// continues with the MFA step of the login.
+func (h *AuthHandler) HandlePasswordless(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	req := auth.PasswordlessCompleteRequest{
+		Token:     r.FormValue("token"),
+		IPAddress: r.RemoteAddr,
+	}
+	if cookie, err := r.Cookie(passwordlessFlowCookieName); err == nil {
+		req.FlowID = cookie.Value
+	}
+
+	result, err := h.authService.CompletePasswordless(r.Context(), req, auth.Config{})
+	if err != nil {
+		h.logger.Info("UI passwordless login failed", zap.Error(err))
+		message := "This sign-in link is invalid or has expired. Please request a new one."
+		if errors.Is(err, types.ErrDeviceMismatch) {
+			message = "Open the sign-in link on the device you requested it from."
+		}
+		h.render(w, r, map[string]string{"Error": message})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     passwordlessFlowCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if result.IsMfaRequired {
+		if result.MFAChallenge == nil {
+			h.logger.Error("MFA required without a challenge", zap.String("userID", result.User.ID))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		h.setMFAChallengeCookie(w, r, result.MFAChallenge.ChallengeID, 0)
+		http.Redirect(w, r, "/auth/mfa", http.StatusFound)
+		return
+	}
+
+	amr, acr := []string{"otp"}, ""
+	if result.Session != nil {
+		amr, acr = result.Session.AuthMethods, result.Session.ACR
+	}
+	h.startSession(w, r, result.User.ID, amr, acr, "")
+}
@@ -1,9 +1,11 @@
 package ui
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/pkg/types"
 	"go.uber.org/zap"
 )
 
@@ -56,8 +58,13 @@ func (h *RecoveryHandler) HandleResetPassword(w http.ResponseWriter, r *http.Req
 	err := h.service.VerifyAndReset(r.Context(), email, code, password)
 	if err != nil {
 		h.logger.Warn("Password reset failed", zap.Error(err))
+		message := "Invalid code or request failed."
+		var appErr *types.Error
+		if errors.As(err, &appErr) && appErr.Code == types.ErrPasswordPolicy.Code {
+			message = "The new " + appErr.Details["message"] + "."
+		}
 		data := map[string]interface{}{
-			"Error": "Invalid code or request failed.",
+			"Error": message,
 			"Email": email,
 		}
 		h.renderer.Render(w, r, "auth/reset_password.html", data)
@@ -6,14 +6,18 @@ import (
 	"strings"
 
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/utils"
 )
 
 // AuthMiddleware validates JWT tokens and adds user info to the context.
+// When a session manager is set, browser requests without a bearer token are
+// authenticated by their session cookie instead.
 type AuthMiddleware struct {
 	cryptoManager         *utils.CryptoManager
 	logger                utils.Logger
 	identityDomainService identity.IService
+	sessionManager        *redis.SessionManager
 }
 
 // NewAuthMiddleware creates a new authentication middleware.
@@ -25,31 +29,26 @@ func NewAuthMiddleware(cryptoManager *utils.CryptoManager, logger utils.Logger,
 	}
 }
 
+// SetSessionManager enables session cookie authentication.
+func (m *AuthMiddleware) SetSessionManager(sessionManager *redis.SessionManager) {
+	m.sessionManager = sessionManager
+}
+
 // Execute is the middleware handler function.
 func (m *AuthMiddleware) Execute(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		userID, sessionID, ok := m.authenticate(r)
+		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		ctx := context.WithValue(r.Context(), UserIDContextKey, userID)
+		if sessionID != "" {
+			ctx = context.WithValue(ctx, SessionIDContextKey, sessionID)
 		}
 
-		tokenString := parts[1]
-		claims, err := m.cryptoManager.ValidateJWT(tokenString)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		ctx := context.WithValue(r.Context(), UserIDContextKey, claims["sub"].(string))
-
-		user, err := m.identityDomainService.GetUser(ctx, claims["sub"].(string))
+		user, err := m.identityDomainService.GetUser(ctx, userID)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -64,3 +63,59 @@ func (m *AuthMiddleware) Execute(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// ExecuteOptional authenticates requests that carry a bearer token or a
+// session cookie like Execute, and passes on the others unauthenticated, for
+// endpoints that also serve users who cannot sign in.
+func (m *AuthMiddleware) ExecuteOptional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, sessionID, ok := m.authenticate(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), UserIDContextKey, userID)
+		if sessionID != "" {
+			ctx = context.WithValue(ctx, SessionIDContextKey, sessionID)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticate resolves the user ID and session ID from the bearer token or,
+// failing that, the session cookie. Tokens not issued for a session have no
+// session ID.
+func (m *AuthMiddleware) authenticate(r *http.Request) (string, string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return m.authenticateSession(r)
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return "", "", false
+	}
+
+	claims, err := m.cryptoManager.ValidateJWT(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	sub, ok := claims["sub"].(string)
+	sid, _ := claims["sid"].(string)
+	return sub, sid, ok && sub != ""
+}
+
+func (m *AuthMiddleware) authenticateSession(r *http.Request) (string, string, bool) {
+	if m.sessionManager == nil {
+		return "", "", false
+	}
+	cookie, err := r.Cookie(redis.SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", "", false
+	}
+	session, err := m.sessionManager.GetSession(r.Context(), cookie.Value, r)
+	if err != nil {
+		return "", "", false
+	}
+	return session.UserID, session.ID, true
+}
@@ -5,4 +5,7 @@ type contextKey string
 const (
 	UserIDContextKey contextKey = "user_id"
 	GroupsContextKey contextKey = "groups"
+	// SessionIDContextKey holds the session a request was authenticated in:
+	// the session cookie, or the sid claim of a bearer token.
+	SessionIDContextKey contextKey = "session_id"
 )
@@ -81,6 +81,117 @@ func (s *Service) RecordLoginFailed(ctx context.Context, userID, ip, traceID str
 	s.dispatchWebhook(ctx, "login.failed", event)
 }
 
+// RecordRefreshTokenReuse records that a rotated OAuth refresh token was
+// presented again, and that its token family and session were revoked.
+func (s *Service) RecordRefreshTokenReuse(ctx context.Context, userID, clientID, familyID, sessionID string) {
+	event := &events.AuditEvent{
+		ID:        generateAuditID(),
+		Timestamp: time.Now().UTC(),
+		Category:  "auth",
+		Action:    "refresh_token_reuse",
+		UserID:    userID,
+		Result:    events.ResultFailure,
+		Details: map[string]any{
+			"client_id":  clientID,
+			"family_id":  familyID,
+			"session_id": sessionID,
+		},
+	}
+	s.pipeline.Emit(ctx, event)
+	s.dispatchWebhook(ctx, "token.reuse_detected", event)
+}
+
+// RecordAccountLocked records that an account was locked after repeated
+// failed logins.
+func (s *Service) RecordAccountLocked(ctx context.Context, username, ip string, failures int, until time.Time) {
+	event := &events.AuditEvent{
+		ID:        generateAuditID(),
+		Timestamp: time.Now().UTC(),
+		Category:  "auth",
+		Action:    "account_locked",
+		IP:        ip,
+		Result:    events.ResultFailure,
+		Details: map[string]any{
+			"username":     username,
+			"failures":     failures,
+			"locked_until": until.UTC(),
+		},
+	}
+	s.pipeline.Emit(ctx, event)
+	s.dispatchWebhook(ctx, "account.locked", event)
+}
+
+// RecordAccountUnlocked records that an administrator ended the lockout of an account.
+func (s *Service) RecordAccountUnlocked(ctx context.Context, username, actor string) {
+	event := &events.AuditEvent{
+		ID:        generateAuditID(),
+		Timestamp: time.Now().UTC(),
+		Category:  "admin",
+		Action:    "account_unlocked",
+		UserID:    actor,
+		Result:    events.ResultSuccess,
+		Details: map[string]any{
+			"username": username,
+		},
+	}
+	s.pipeline.Emit(ctx, event)
+	s.dispatchWebhook(ctx, "account.unlocked", event)
+}
+
+// RecordPasswordSpray records that failed logins for many accounts came from
+// one address, and that the address was blocked.
+func (s *Service) RecordPasswordSpray(ctx context.Context, ip string, usernames []string) {
+	event := &events.AuditEvent{
+		ID:        generateAuditID(),
+		Timestamp: time.Now().UTC(),
+		Category:  "risk",
+		Action:    "password_spray",
+		IP:        ip,
+		Result:    events.ResultFailure,
+		Details: map[string]any{
+			"accounts":  len(usernames),
+			"usernames": usernames,
+		},
+	}
+	s.pipeline.Emit(ctx, event)
+	s.dispatchWebhook(ctx, "security.password_spray", event)
+}
+
+// RecordPasswordChanged records that a user changed their password.
+func (s *Service) RecordPasswordChanged(ctx context.Context, username, ip string) {
+	event := &events.AuditEvent{
+		ID:        generateAuditID(),
+		Timestamp: time.Now().UTC(),
+		Category:  "auth",
+		Action:    "password_changed",
+		IP:        ip,
+		Result:    events.ResultSuccess,
+		Details: map[string]any{
+			"username": username,
+		},
+	}
+	s.pipeline.Emit(ctx, event)
+	s.dispatchWebhook(ctx, "user.password_changed", event)
+}
+
+// RecordMFAChange records a change a user made to their MFA factors, such as
+// "mfa.factor_enrolled", "mfa.factor_deleted", "mfa.default_factor_changed",
+// "mfa.recovery_codes_regenerated" or "mfa.step_up".
+func (s *Service) RecordMFAChange(ctx context.Context, userID, ip, action string, result events.Result, details map[string]any) {
+	event := &events.AuditEvent{
+		ID:        generateAuditID(),
+		Timestamp: time.Now().UTC(),
+		Category:  "auth",
+		Action:    action,
+		UserID:    userID,
+		IP:        ip,
+		Result:    result,
+		Details:   details,
+	}
+	s.pipeline.Emit(ctx, event)
+	s.dispatchWebhook(ctx, "user."+action, event)
+}
+
 // RecordUserCreated records a user creation event.
 func (s *Service) RecordUserCreated(ctx context.Context, user *types.User, ip, traceID string) {
 	event := &events.AuditEvent{
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/pkg/audit/events"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// ListMFAFactors returns the enrolled MFA factors of a user.
+func (s *ApplicationService) ListMFAFactors(ctx context.Context, userID string) (*auth.MFAFactors, error) {
+	factors, err := s.authDomain.ListMFAFactors(ctx, userID)
+	if err != nil {
+		return nil, appError(err)
+	}
+	return factors, nil
+}
+
+// EnrollTOTP starts the enrollment of a TOTP authenticator app.
+func (s *ApplicationService) EnrollTOTP(ctx context.Context, userID, sessionID string) (*types.MFAEnrollment, error) {
+	enrollment, err := s.authDomain.EnrollTOTP(ctx, userID, sessionID)
+	if err != nil {
+		return nil, appError(err)
+	}
+	return enrollment, nil
+}
+
+// ConfirmTOTP completes a TOTP enrollment with a code from the app.
+func (s *ApplicationService) ConfirmTOTP(ctx context.Context, userID, sessionID, code, ip string) (*auth.TOTPConfirmation, error) {
+	confirmation, err := s.authDomain.ConfirmTOTP(ctx, userID, sessionID, code)
+	if err != nil {
+		s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.factor_enrolled", events.ResultFailure, map[string]any{"type": "totp", "reason": err.Error()})
+		return nil, appError(err)
+	}
+	s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.factor_enrolled", events.ResultSuccess, map[string]any{"type": "totp", "factor_id": confirmation.Factor.ID})
+	if len(confirmation.RecoveryCodes) > 0 {
+		s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.recovery_codes_regenerated", events.ResultSuccess, map[string]any{"count": len(confirmation.RecoveryCodes)})
+	}
+	return confirmation, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user.
+func (s *ApplicationService) RegenerateRecoveryCodes(ctx context.Context, userID, sessionID, ip string) ([]string, error) {
+	codes, err := s.authDomain.RegenerateRecoveryCodes(ctx, userID, sessionID)
+	if err != nil {
+		return nil, appError(err)
+	}
+	s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.recovery_codes_regenerated", events.ResultSuccess, map[string]any{"count": len(codes)})
+	return codes, nil
+}
+
+// SetDefaultMFAFactor makes a factor the one a login challenges first.
+func (s *ApplicationService) SetDefaultMFAFactor(ctx context.Context, userID, factorID, ip string) (*mfa.Factor, error) {
+	factor, err := s.authDomain.SetDefaultMFAFactor(ctx, userID, factorID)
+	if err != nil {
+		return nil, appError(err)
+	}
+	s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.default_factor_changed", events.ResultSuccess, map[string]any{"type": factor.Type, "factor_id": factor.ID})
+	return factor, nil
+}
+
+// BeginMFAStepUp challenges a signed-in user to verify one of their factors.
+func (s *ApplicationService) BeginMFAStepUp(ctx context.Context, userID, provider string) (*types.MFAChallenge, error) {
+	challenge, err := s.authDomain.BeginMFAStepUp(ctx, userID, provider)
+	if err != nil {
+		return nil, appError(err)
+	}
+	return challenge, nil
+}
+
+// CompleteMFAStepUp verifies the answer to a step-up challenge.
+func (s *ApplicationService) CompleteMFAStepUp(ctx context.Context, userID, sessionID string, req *types.VerifyMFARequest, ip string) error {
+	if err := s.authDomain.CompleteMFAStepUp(ctx, userID, sessionID, req); err != nil {
+		s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.step_up", events.ResultFailure, map[string]any{"provider": req.Provider, "reason": err.Error()})
+		return appError(err)
+	}
+	s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.step_up", events.ResultSuccess, map[string]any{"provider": req.Provider})
+	return nil
+}
+
+// DeleteMFAFactor removes a factor of a user after a recent step-up.
+func (s *ApplicationService) DeleteMFAFactor(ctx context.Context, userID, sessionID, factorID, ip string) error {
+	factor, err := s.authDomain.DeleteMFAFactor(ctx, userID, sessionID, factorID)
+	if err != nil {
+		s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.factor_deleted", events.ResultFailure, map[string]any{"factor_id": factorID, "reason": err.Error()})
+		return appError(err)
+	}
+	s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.factor_deleted", events.ResultSuccess, map[string]any{"type": factor.Type, "factor_id": factor.ID})
+	return nil
+}
+
+// RegisterPushDevice enrolls a device for push approvals.
+func (s *ApplicationService) RegisterPushDevice(ctx context.Context, userID, sessionID, name, token string, publicKey []byte, ip string) (*mfa.Factor, error) {
+	factor, err := s.authDomain.RegisterPushDevice(ctx, userID, sessionID, name, token, publicKey)
+	if err != nil {
+		s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.factor_enrolled", events.ResultFailure, map[string]any{"type": "push", "reason": err.Error()})
+		return nil, appError(err)
+	}
+	s.auditService.RecordMFAChange(ctx, userID, ip, "mfa.factor_enrolled", events.ResultSuccess, map[string]any{"type": "push", "factor_id": factor.ID})
+	return factor, nil
+}
+
+// RespondPushApproval records a device's signed answer to a push approval.
+func (s *ApplicationService) RespondPushApproval(ctx context.Context, resp *mfa.PushResponse) error {
+	if err := s.authDomain.RespondPushApproval(ctx, resp); err != nil {
+		return appError(err)
+	}
+	return nil
+}
+
+// appError returns err as an API error.
+func appError(err error) *types.Error {
+	if appErr, ok := err.(*types.Error); ok {
+		return appErr
+	}
+	return types.ErrInternal.WithCause(err)
+}
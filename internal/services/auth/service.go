@@ -5,6 +5,7 @@ import (
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/internal/services/audit"
+	"github.com/turtacn/QuantaID/internal/auth/mfa"
 	"github.com/turtacn/QuantaID/internal/domain/auth"
 	"github.com/turtacn/QuantaID/internal/metrics"
 	"github.com/turtacn/QuantaID/pkg/types"
@@ -124,6 +125,65 @@ func (s *ApplicationService) Logout(ctx context.Context, req LogoutRequest) *typ
 	return nil
 }
 
+// ChangePassword replaces the password of a user who proves the current one.
+func (s *ApplicationService) ChangePassword(ctx context.Context, req auth.ChangePasswordRequest) error {
+	if err := s.authDomain.ChangePassword(ctx, req); err != nil {
+		if appErr, ok := err.(*types.Error); ok {
+			return appErr
+		}
+		return types.ErrInternal.WithCause(err)
+	}
+	s.auditService.RecordPasswordChanged(ctx, req.Username, req.IPAddress)
+	return nil
+}
+
+// StartPasswordless emails a magic link or a code for a passwordless login.
+func (s *ApplicationService) StartPasswordless(ctx context.Context, req auth.PasswordlessStartRequest) (*auth.PasswordlessStart, error) {
+	start, err := s.authDomain.StartPasswordless(ctx, req)
+	if err != nil {
+		if appErr, ok := err.(*types.Error); ok {
+			return nil, appErr
+		}
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	return start, nil
+}
+
+// CompletePasswordless completes a passwordless login with its magic link or code.
+func (s *ApplicationService) CompletePasswordless(ctx context.Context, req auth.PasswordlessCompleteRequest, serviceConfig auth.Config) (*types.AuthResult, error) {
+	authResp, err := s.authDomain.CompletePasswordless(ctx, req, serviceConfig)
+	if err != nil {
+		s.auditService.RecordLoginFailed(ctx, "", req.IPAddress, "", err.Error(), map[string]any{"method": "passwordless"})
+		if appErr, ok := err.(*types.Error); ok {
+			return nil, appErr
+		}
+		return nil, types.ErrInternal.WithCause(err)
+	}
+
+	metrics.OauthTokensIssuedTotal.Inc()
+	return authResp, nil
+}
+
+// LoginWithPasskey creates a session and tokens for a user who signed in with a passkey.
+func (s *ApplicationService) LoginWithPasskey(ctx context.Context, user *types.User, serviceConfig auth.Config) (*types.AuthResult, error) {
+	authResp, err := s.authDomain.LoginWithPasskey(ctx, user, serviceConfig)
+	if err != nil {
+		s.auditService.RecordLoginFailed(ctx, user.ID, "", "", err.Error(), map[string]any{"method": "passkey"})
+		if appErr, ok := err.(*types.Error); ok {
+			return nil, appErr
+		}
+		return nil, types.ErrInternal.WithCause(err)
+	}
+
+	metrics.OauthTokensIssuedTotal.Inc()
+	return authResp, nil
+}
+
+// PendingMFAChallenge returns the MFA challenge of a login that is still to be answered.
+func (s *ApplicationService) PendingMFAChallenge(ctx context.Context, challengeID string) (*mfa.LoginChallenge, error) {
+	return s.authDomain.PendingMFAChallenge(ctx, challengeID)
+}
+
 func (s *ApplicationService) VerifyMFAChallenge(ctx context.Context, req *types.VerifyMFARequest, serviceConfig auth.Config) (*types.AuthResult, error) {
 	return s.authDomain.VerifyMFAChallenge(ctx, req, serviceConfig)
 }
@@ -3,6 +3,7 @@ package identity
 import (
 	"context"
 
+	"github.com/turtacn/QuantaID/internal/auth/passwordpolicy"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/internal/services/audit"
 	"github.com/turtacn/QuantaID/pkg/types"
@@ -92,6 +93,10 @@ func (s *ApplicationService) DeleteUser(ctx context.Context, userID string) erro
 	return s.identityDomain.DeleteUser(ctx, userID)
 }
 
+func (s *ApplicationService) RemoveUserFromGroup(ctx context.Context, userID, groupID string) error {
+	return s.identityDomain.RemoveUserFromGroup(ctx, userID, groupID)
+}
+
 func (s *ApplicationService) GetUserByExternalID(ctx context.Context, externalID, sourceID string) (*types.User, error) {
 	return s.identityDomain.GetUserByExternalID(ctx, externalID, sourceID)
 }
@@ -120,6 +125,10 @@ func (s *ApplicationService) GetUser(ctx context.Context, userID string) (*types
 	return s.identityDomain.GetUser(ctx, userID)
 }
 
+func (s *ApplicationService) SetPasswordPolicy(engine *passwordpolicy.Engine) {
+	s.identityDomain.SetPasswordPolicy(engine)
+}
+
 func (s *ApplicationService) GetUserByUsername(ctx context.Context, username string) (*types.User, error) {
 	return s.identityDomain.GetUserByUsername(ctx, username)
 }
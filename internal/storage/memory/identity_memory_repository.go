@@ -3,6 +3,8 @@ package memory
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/google/uuid"
@@ -111,7 +113,7 @@ func (r *IdentityMemoryRepository) GetUserByUsername(ctx context.Context, userna
 			return user, nil
 		}
 	}
-	return nil, fmt.Errorf("user with username '%s' not found", username)
+	return nil, types.ErrUserNotFound
 }
 
 func (r *IdentityMemoryRepository) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
@@ -123,7 +125,7 @@ func (r *IdentityMemoryRepository) GetUserByEmail(ctx context.Context, email str
 			return user, nil
 		}
 	}
-	return nil, fmt.Errorf("user with email '%s' not found", email)
+	return nil, types.ErrUserNotFound
 }
 
 func (r *IdentityMemoryRepository) GetUserByExternalID(ctx context.Context, externalID, sourceID string) (*types.User, error) {
@@ -167,22 +169,72 @@ func (r *IdentityMemoryRepository) ListUsers(ctx context.Context, filter types.U
 
 	users := make([]*types.User, 0, len(r.users))
 	for _, user := range r.users {
-		users = append(users, user)
+		if r.matchesFilter(user, filter) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	if filter.PageSize <= 0 {
+		return users, len(users), nil
 	}
-    // Note: Simple implementation without sorting. Pagination on a map is not deterministic.
-    start := (filter.Page - 1) * filter.PageSize
-    end := start + filter.PageSize
 
-    if start > len(users) {
-        return []*types.User{}, 0, nil
-    }
-    if end > len(users) {
-        end = len(users)
-    }
+	start := (filter.Page - 1) * filter.PageSize
+	end := start + filter.PageSize
+	if start < 0 {
+		start = 0
+	}
+	if start > len(users) {
+		return []*types.User{}, len(users), nil
+	}
+	if end > len(users) {
+		end = len(users)
+	}
 
 	return users[start:end], len(users), nil
 }
 
+// matchesFilter reports whether a user meets the criteria of a UserFilter.
+// The caller must hold the lock.
+func (r *IdentityMemoryRepository) matchesFilter(user *types.User, filter types.UserFilter) bool {
+	if query := strings.ToLower(filter.Query); query != "" &&
+		!strings.Contains(strings.ToLower(user.Username), query) && !strings.Contains(strings.ToLower(string(user.Email)), query) {
+		return false
+	}
+	if len(filter.Status) > 0 && !containsStatus(filter.Status, user.Status) {
+		return false
+	}
+	if len(filter.Usernames) > 0 && !containsFold(filter.Usernames, user.Username) {
+		return false
+	}
+	if len(filter.Emails) > 0 && !containsFold(filter.Emails, string(user.Email)) {
+		return false
+	}
+	if filter.GroupID != "" {
+		if _, ok := r.userGroups[user.ID][filter.GroupID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func containsStatus(statuses []types.UserStatus, status types.UserStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *IdentityMemoryRepository) ChangeUserStatus(ctx context.Context, userID string, newStatus types.UserStatus) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -296,16 +348,16 @@ func (r *IdentityMemoryRepository) ListGroups(ctx context.Context, pq identity.P
 	for _, group := range r.groups {
 		groups = append(groups, group)
 	}
-    // Note: Simple implementation without sorting.
-    start := pq.Offset
-    end := start + pq.PageSize
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	start := pq.Offset
+	end := start + pq.PageSize
 
-    if start > len(groups) {
-        return []*types.UserGroup{}, nil
-    }
-    if end > len(groups) {
-        end = len(groups)
-    }
+	if start > len(groups) {
+		return []*types.UserGroup{}, nil
+	}
+	if end > len(groups) {
+		end = len(groups)
+	}
 	return groups[start:end], nil
 }
 
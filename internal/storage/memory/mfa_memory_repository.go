@@ -66,3 +66,12 @@ func (r *MFAFactorMemoryRepository) GetMFAFactorsByUserID(ctx context.Context, u
 
 	return userFactors, nil
 }
+
+// DeleteMFAFactor removes an MFA factor from memory.
+func (r *MFAFactorMemoryRepository) DeleteMFAFactor(ctx context.Context, factorID uuid.UUID) error {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.factors, factorID.String())
+	return nil
+}
@@ -3,6 +3,7 @@ package postgresql
 import (
 	"context"
 	"errors"
+	"strings"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"gorm.io/gorm"
@@ -66,13 +67,26 @@ func (r *PostgresIdentityRepository) ListUsers(ctx context.Context, filter types
 	query := r.db.WithContext(ctx).Model(&types.User{})
 
 	if filter.Query != "" {
-		query = query.Where("username LIKE ? OR email LIKE ?", "%"+filter.Query+"%", "%"+filter.Query+"%")
+		query = query.Where("username ILIKE ? OR email ILIKE ?", "%"+filter.Query+"%", "%"+filter.Query+"%")
 	}
 
 	if len(filter.Status) > 0 {
 		query = query.Where("status IN ?", filter.Status)
 	}
 
+	if len(filter.Usernames) > 0 {
+		query = query.Where("LOWER(username) IN ?", lowerAll(filter.Usernames))
+	}
+
+	if len(filter.Emails) > 0 {
+		query = query.Where("LOWER(email) IN ?", lowerAll(filter.Emails))
+	}
+
+	if filter.GroupID != "" {
+		members := r.db.Table("user_group_memberships").Select("user_id").Where("user_group_id = ?", filter.GroupID)
+		query = query.Where("id IN (?)", members)
+	}
+
 	err := query.Count(&total).Error
 	if err != nil {
 		return nil, 0, err
@@ -92,6 +106,14 @@ func (r *PostgresIdentityRepository) ListUsers(ctx context.Context, filter types
 	return users, int(total), err
 }
 
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(v)
+	}
+	return lowered
+}
+
 func (r *PostgresIdentityRepository) ChangeUserStatus(ctx context.Context, userID string, newStatus types.UserStatus) error {
 	return r.db.WithContext(ctx).Model(&types.User{}).Where("id = ?", userID).Update("status", newStatus).Error
 }
@@ -139,7 +161,7 @@ func (r *PostgresIdentityRepository) DeleteGroup(ctx context.Context, id string)
 
 func (r *PostgresIdentityRepository) ListGroups(ctx context.Context, pq identity.PaginationQuery) ([]*types.UserGroup, error) {
 	var groups []*types.UserGroup
-	err := r.db.WithContext(ctx).Offset(pq.Offset).Limit(pq.PageSize).Find(&groups).Error
+	err := r.db.WithContext(ctx).Order("name").Offset(pq.Offset).Limit(pq.PageSize).Find(&groups).Error
 	return groups, err
 }
 
@@ -0,0 +1,25 @@
+-- Up Migration
+-- Refresh tokens are stored as hex-encoded SHA-256 hashes, never in plaintext.
+CREATE TABLE IF NOT EXISTS oauth_token_families (
+    family_id       VARCHAR(64) PRIMARY KEY,
+    original_token  VARCHAR(64) NOT NULL,
+    current_token   VARCHAR(64) NOT NULL,
+    user_id         VARCHAR(64) NOT NULL,
+    client_id       VARCHAR(128) NOT NULL,
+    session_id      VARCHAR(64),
+    revoked_at      TIMESTAMP WITH TIME ZONE,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_oauth_token_families_user ON oauth_token_families(user_id);
+CREATE INDEX IF NOT EXISTS idx_oauth_token_families_revoked_at ON oauth_token_families(revoked_at);
+
+-- Every refresh token a family has issued, so reuse of a rotated token can be traced to its family.
+CREATE TABLE IF NOT EXISTS oauth_family_tokens (
+    token       VARCHAR(64) PRIMARY KEY,
+    family_id   VARCHAR(64) NOT NULL REFERENCES oauth_token_families(family_id) ON DELETE CASCADE,
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_oauth_family_tokens_family ON oauth_family_tokens(family_id);
@@ -0,0 +1,15 @@
+-- RADIUS authorization policies: reply attributes by NAS client, group and time of day
+CREATE TABLE IF NOT EXISTS radius_policies (
+    id          VARCHAR(64) PRIMARY KEY,
+    name        VARCHAR(128) NOT NULL,
+    description TEXT,
+    enabled     BOOLEAN DEFAULT true,
+    priority    INT NOT NULL DEFAULT 0,
+    deny        BOOLEAN DEFAULT false,
+    conditions  JSONB DEFAULT '{}',
+    attributes  JSONB DEFAULT '[]',
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_radius_policies_priority ON radius_policies(priority);
@@ -0,0 +1,3 @@
+-- Dynamic authorization requests are sent to the RADIUS client accounting
+-- came from, rather than to the NAS-IP-Address the NAS reports.
+ALTER TABLE radius_accounting ADD COLUMN IF NOT EXISTS client_address VARCHAR(45);
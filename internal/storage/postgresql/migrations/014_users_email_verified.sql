@@ -0,0 +1,8 @@
+-- Email verification moved from the email_verified attribute to its own
+-- column. Carry the attribute over so that verified users stay verified.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE users
+SET email_verified = email_verified OR COALESCE(attributes->>'email_verified', '') = 'true',
+    attributes = attributes - 'email_verified'
+WHERE attributes ? 'email_verified';
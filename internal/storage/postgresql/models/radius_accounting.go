@@ -12,6 +12,7 @@ type RadiusAccounting struct {
 	Username       string    `gorm:"type:varchar(256)" json:"username"`
 	NASIdentifier  string    `gorm:"type:varchar(128)" json:"nas_identifier"`
 	NASIPAddress   string    `gorm:"type:varchar(45)" json:"nas_ip_address"`
+	ClientAddress  string    `gorm:"type:varchar(45)" json:"client_address"` // RADIUS client the accounting came from
 	NASPort        int       `gorm:"type:int" json:"nas_port"`
 	StatusType     int       `gorm:"type:int;not null" json:"status_type"`
 	SessionTime    int       `gorm:"type:int;default:0" json:"session_time"`
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RadiusPolicy is an authorization policy that selects the reply attributes
+// of RADIUS Access-Accepts.
+type RadiusPolicy struct {
+	ID          string          `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	Name        string          `gorm:"type:varchar(128);not null" json:"name"`
+	Description string          `gorm:"type:text" json:"description"`
+	Enabled     bool            `gorm:"default:true" json:"enabled"`
+	Priority    int             `gorm:"not null;default:0;index" json:"priority"`
+	Deny        bool            `gorm:"default:false" json:"deny"`
+	Conditions  json.RawMessage `gorm:"type:jsonb;default:'{}'" json:"conditions"`
+	Attributes  json.RawMessage `gorm:"type:jsonb;default:'[]'" json:"attributes"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// TableName overrides the table name used by GORM.
+func (RadiusPolicy) TableName() string {
+	return "radius_policies"
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// OAuthTokenFamily is a chain of rotated OAuth refresh tokens. Tokens are
+// stored as hashes, see auth.HashRefreshToken.
+type OAuthTokenFamily struct {
+	FamilyID      string     `gorm:"primaryKey;type:varchar(64)"`
+	OriginalToken string     `gorm:"type:varchar(64);not null"`
+	CurrentToken  string     `gorm:"type:varchar(64);not null"`
+	UserID        string     `gorm:"index;type:varchar(64);not null"`
+	ClientID      string     `gorm:"type:varchar(128);not null"`
+	SessionID     string     `gorm:"type:varchar(64)"`
+	RevokedAt     *time.Time `gorm:"index"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// TableName overrides the table name used by GORM.
+func (OAuthTokenFamily) TableName() string {
+	return "oauth_token_families"
+}
+
+// OAuthFamilyToken records a refresh token issued by a token family.
+type OAuthFamilyToken struct {
+	Token     string    `gorm:"primaryKey;type:varchar(64)"`
+	FamilyID  string    `gorm:"index;type:varchar(64);not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// TableName overrides the table name used by GORM.
+func (OAuthFamilyToken) TableName() string {
+	return "oauth_family_tokens"
+}
@@ -58,3 +58,28 @@ func (r *PostgresMFARepository) DeleteFactor(ctx context.Context, factorID uuid.
 func (r *PostgresMFARepository) CreateVerificationLog(ctx context.Context, log *types.MFAVerificationLog) error {
 	return r.db.WithContext(ctx).Create(log).Error
 }
+
+// CreateMFAFactor adds a new MFA factor for a user. It lets the repository
+// back the TOTP and recovery code providers.
+func (r *PostgresMFARepository) CreateMFAFactor(ctx context.Context, factor *types.MFAFactor) error {
+	return r.CreateFactor(ctx, factor)
+}
+
+// GetMFAFactorsByUserID retrieves all MFA factors for a user by the string form of its ID.
+func (r *PostgresMFARepository) GetMFAFactorsByUserID(ctx context.Context, userID string) ([]*types.MFAFactor, error) {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return nil, err
+	}
+	return r.GetUserFactors(ctx, id)
+}
+
+// UpdateMFAFactor updates an existing MFA factor.
+func (r *PostgresMFARepository) UpdateMFAFactor(ctx context.Context, factor *types.MFAFactor) error {
+	return r.UpdateFactor(ctx, factor)
+}
+
+// DeleteMFAFactor removes an MFA factor.
+func (r *PostgresMFARepository) DeleteMFAFactor(ctx context.Context, factorID uuid.UUID) error {
+	return r.DeleteFactor(ctx, factorID)
+}
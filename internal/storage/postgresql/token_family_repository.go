@@ -0,0 +1,136 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/turtacn/QuantaID/internal/storage/postgresql/models"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PostgresTokenFamilyRepository provides a GORM-based implementation of the
+// auth.TokenFamilyRepository interface. Tokens are stored as the hashes the
+// caller passes in.
+type PostgresTokenFamilyRepository struct {
+	db *gorm.DB
+}
+
+// NewPostgresTokenFamilyRepository creates a new PostgreSQL token family repository.
+func NewPostgresTokenFamilyRepository(db *gorm.DB) *PostgresTokenFamilyRepository {
+	return &PostgresTokenFamilyRepository{db: db}
+}
+
+// CreateFamily stores a new token family and the tokens it has issued.
+func (r *PostgresTokenFamilyRepository) CreateFamily(ctx context.Context, family *types.TokenFamily) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		record := toTokenFamilyModel(family)
+		if err := tx.Create(record).Error; err != nil {
+			return err
+		}
+		return saveFamilyTokens(tx, family)
+	})
+}
+
+// GetFamilyByToken retrieves the family that issued a refresh token.
+func (r *PostgresTokenFamilyRepository) GetFamilyByToken(ctx context.Context, token string) (*types.TokenFamily, error) {
+	var issued models.OAuthFamilyToken
+	if err := r.db.WithContext(ctx).First(&issued, "token = ?", token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, types.ErrNotFound
+		}
+		return nil, err
+	}
+	return r.GetFamilyByID(ctx, issued.FamilyID)
+}
+
+// GetFamilyByID retrieves a token family by its ID.
+func (r *PostgresTokenFamilyRepository) GetFamilyByID(ctx context.Context, familyID string) (*types.TokenFamily, error) {
+	db := r.db.WithContext(ctx)
+	var record models.OAuthTokenFamily
+	if err := db.First(&record, "family_id = ?", familyID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, types.ErrNotFound
+		}
+		return nil, err
+	}
+
+	var issued []models.OAuthFamilyToken
+	if err := db.Where("family_id = ?", familyID).Order("created_at").Find(&issued).Error; err != nil {
+		return nil, err
+	}
+
+	family := &types.TokenFamily{
+		FamilyID:      record.FamilyID,
+		OriginalToken: record.OriginalToken,
+		CurrentToken:  record.CurrentToken,
+		UserID:        record.UserID,
+		ClientID:      record.ClientID,
+		SessionID:     record.SessionID,
+		CreatedAt:     record.CreatedAt,
+		RevokedAt:     record.RevokedAt,
+	}
+	for _, t := range issued {
+		family.IssuedTokens = append(family.IssuedTokens, t.Token)
+	}
+	return family, nil
+}
+
+// RotateFamily makes next the family's current token. The conditional UPDATE
+// lets only one of several concurrent refreshes of the same token through.
+func (r *PostgresTokenFamilyRepository) RotateFamily(ctx context.Context, familyID, current, next string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.OAuthTokenFamily{}).
+			Where("family_id = ? AND current_token = ? AND revoked_at IS NULL", familyID, current).
+			Update("current_token", next)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			var count int64
+			if err := tx.Model(&models.OAuthTokenFamily{}).Where("family_id = ?", familyID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				return types.ErrNotFound
+			}
+			return types.ErrConflict
+		}
+		return tx.Create(&models.OAuthFamilyToken{Token: next, FamilyID: familyID}).Error
+	})
+}
+
+// RevokeFamily marks a family as revoked.
+func (r *PostgresTokenFamilyRepository) RevokeFamily(ctx context.Context, familyID string) error {
+	result := r.db.WithContext(ctx).Model(&models.OAuthTokenFamily{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now().UTC())
+	return result.Error
+}
+
+func toTokenFamilyModel(family *types.TokenFamily) *models.OAuthTokenFamily {
+	return &models.OAuthTokenFamily{
+		FamilyID:      family.FamilyID,
+		OriginalToken: family.OriginalToken,
+		CurrentToken:  family.CurrentToken,
+		UserID:        family.UserID,
+		ClientID:      family.ClientID,
+		SessionID:     family.SessionID,
+		CreatedAt:     family.CreatedAt,
+		RevokedAt:     family.RevokedAt,
+	}
+}
+
+// saveFamilyTokens records the family's issued tokens, skipping those already stored.
+func saveFamilyTokens(tx *gorm.DB, family *types.TokenFamily) error {
+	if len(family.IssuedTokens) == 0 {
+		return nil
+	}
+	tokens := make([]models.OAuthFamilyToken, 0, len(family.IssuedTokens))
+	for _, token := range family.IssuedTokens {
+		tokens = append(tokens, models.OAuthFamilyToken{Token: token, FamilyID: family.FamilyID})
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&tokens).Error
+}
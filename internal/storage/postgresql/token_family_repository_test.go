@@ -0,0 +1,68 @@
+package postgresql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/storage/postgresql/models"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTokenFamilyRepository(t *testing.T) *PostgresTokenFamilyRepository {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.OAuthTokenFamily{}, &models.OAuthFamilyToken{}))
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	return NewPostgresTokenFamilyRepository(db)
+}
+
+func TestPostgresTokenFamilyRepository(t *testing.T) {
+	ctx := context.Background()
+	repo := newTokenFamilyRepository(t)
+
+	require.NoError(t, repo.CreateFamily(ctx, &types.TokenFamily{
+		FamilyID:      "family-1",
+		OriginalToken: "rt-1",
+		CurrentToken:  "rt-1",
+		IssuedTokens:  []string{"rt-1"},
+		UserID:        "user-1",
+		ClientID:      "rp",
+		SessionID:     "session-1",
+		CreatedAt:     time.Now().UTC(),
+	}))
+
+	require.NoError(t, repo.RotateFamily(ctx, "family-1", "rt-1", "rt-2"))
+	// A concurrent refresh of the same token loses the race and issues nothing.
+	assert.ErrorIs(t, repo.RotateFamily(ctx, "family-1", "rt-1", "rt-3"), types.ErrConflict)
+	assert.ErrorIs(t, repo.RotateFamily(ctx, "unknown", "rt-1", "rt-3"), types.ErrNotFound)
+	_, err := repo.GetFamilyByToken(ctx, "rt-3")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	// Rotated tokens still lead back to their family.
+	got, err := repo.GetFamilyByToken(ctx, "rt-1")
+	require.NoError(t, err)
+	assert.Equal(t, "family-1", got.FamilyID)
+	assert.Equal(t, "rt-1", got.OriginalToken)
+	assert.Equal(t, "rt-2", got.CurrentToken)
+	assert.ElementsMatch(t, []string{"rt-1", "rt-2"}, got.IssuedTokens)
+	assert.Equal(t, "session-1", got.SessionID)
+	assert.Nil(t, got.RevokedAt)
+
+	require.NoError(t, repo.RevokeFamily(ctx, "family-1"))
+	got, err = repo.GetFamilyByToken(ctx, "rt-2")
+	require.NoError(t, err)
+	assert.NotNil(t, got.RevokedAt)
+
+	// A revoked family cannot be rotated.
+	assert.ErrorIs(t, repo.RotateFamily(ctx, "family-1", "rt-2", "rt-3"), types.ErrConflict)
+
+	_, err = repo.GetFamilyByToken(ctx, "unknown")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
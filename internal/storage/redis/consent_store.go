@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+)
+
+const (
+	consentKeyPrefix      = "oauth_consent:"
+	userConsentsKeyPrefix = "oauth_consents:"
+)
+
+// RedisConsentRepository provides a Redis-backed implementation of oauth.ConsentRepository.
+// Consents do not expire; they live until the user revokes them.
+type RedisConsentRepository struct {
+	client RedisClientInterface
+}
+
+// NewRedisConsentRepository creates a new Redis consent repository.
+func NewRedisConsentRepository(client RedisClientInterface) *RedisConsentRepository {
+	return &RedisConsentRepository{client: client}
+}
+
+func consentKey(userID, clientID string) string {
+	return fmt.Sprintf("%s%s:%s", consentKeyPrefix, userID, clientID)
+}
+
+// GetConsent retrieves the consent a user granted to a client.
+func (r *RedisConsentRepository) GetConsent(ctx context.Context, userID, clientID string) (*oauth.Consent, error) {
+	val, err := r.client.Get(ctx, consentKey(userID, clientID))
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get consent: %w", err)
+	}
+
+	var consent oauth.Consent
+	if err := json.Unmarshal([]byte(val), &consent); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal consent: %w", err)
+	}
+	return &consent, nil
+}
+
+// SaveConsent stores a consent and indexes it under the user.
+func (r *RedisConsentRepository) SaveConsent(ctx context.Context, consent *oauth.Consent) error {
+	data, err := json.Marshal(consent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal consent: %w", err)
+	}
+	if err := r.client.Set(ctx, consentKey(consent.UserID, consent.ClientID), data, 0); err != nil {
+		return fmt.Errorf("failed to store consent: %w", err)
+	}
+	if err := r.client.SAdd(ctx, userConsentsKeyPrefix+consent.UserID, consent.ClientID); err != nil {
+		return fmt.Errorf("failed to index consent: %w", err)
+	}
+	return nil
+}
+
+// ListConsents returns all consents a user has granted, ordered by client ID.
+func (r *RedisConsentRepository) ListConsents(ctx context.Context, userID string) ([]*oauth.Consent, error) {
+	clientIDs, err := r.client.SMembers(ctx, userConsentsKeyPrefix+userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list consents: %w", err)
+	}
+	sort.Strings(clientIDs)
+
+	consents := make([]*oauth.Consent, 0, len(clientIDs))
+	for _, clientID := range clientIDs {
+		consent, err := r.GetConsent(ctx, userID, clientID)
+		if err != nil {
+			return nil, err
+		}
+		if consent == nil {
+			// Index entry without a consent record, lazily cleanup
+			_ = r.client.SRem(ctx, userConsentsKeyPrefix+userID, clientID)
+			continue
+		}
+		consents = append(consents, consent)
+	}
+	return consents, nil
+}
+
+// RevokeConsent removes the consent a user granted to a client.
+func (r *RedisConsentRepository) RevokeConsent(ctx context.Context, userID, clientID string) error {
+	if err := r.client.Del(ctx, consentKey(userID, clientID)); err != nil {
+		return fmt.Errorf("failed to delete consent: %w", err)
+	}
+	if err := r.client.SRem(ctx, userConsentsKeyPrefix+userID, clientID); err != nil {
+		return fmt.Errorf("failed to unindex consent: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// RedisDeviceCodeRepository provides a Redis-backed implementation of
+// oauth.DeviceCodeRepository. A record is stored under device_code:<code> and
+// indexed by device_user_code:<user code>; both keys expire with the code.
+type RedisDeviceCodeRepository struct {
+	client RedisClientInterface
+}
+
+// NewRedisDeviceCodeRepository creates a new Redis device code repository.
+func NewRedisDeviceCodeRepository(client RedisClientInterface) *RedisDeviceCodeRepository {
+	return &RedisDeviceCodeRepository{client: client}
+}
+
+func deviceCodeKey(deviceCode string) string {
+	return fmt.Sprintf("device_code:%s", deviceCode)
+}
+
+func deviceUserCodeKey(userCode string) string {
+	return fmt.Sprintf("device_user_code:%s", userCode)
+}
+
+// Create stores a new device code record.
+func (r *RedisDeviceCodeRepository) Create(ctx context.Context, record *oauth.DeviceCodeRecord) error {
+	if err := r.save(ctx, record); err != nil {
+		return err
+	}
+	if err := r.client.Set(ctx, deviceUserCodeKey(record.UserCode), record.DeviceCode, time.Until(record.ExpiresAt)); err != nil {
+		return fmt.Errorf("failed to index device code: %w", err)
+	}
+	return nil
+}
+
+// GetByDeviceCode retrieves a record by its device code.
+func (r *RedisDeviceCodeRepository) GetByDeviceCode(ctx context.Context, deviceCode string) (*oauth.DeviceCodeRecord, error) {
+	data, err := r.client.Get(ctx, deviceCodeKey(deviceCode))
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, types.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get device code: %w", err)
+	}
+	var record oauth.DeviceCodeRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal device code: %w", err)
+	}
+	return &record, nil
+}
+
+// GetByUserCode retrieves a record by its normalized user code.
+func (r *RedisDeviceCodeRepository) GetByUserCode(ctx context.Context, userCode string) (*oauth.DeviceCodeRecord, error) {
+	deviceCode, err := r.client.Get(ctx, deviceUserCodeKey(userCode))
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, types.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get user code: %w", err)
+	}
+	return r.GetByDeviceCode(ctx, deviceCode)
+}
+
+// UpdateStatus sets the status of a record.
+func (r *RedisDeviceCodeRepository) UpdateStatus(ctx context.Context, deviceCode, status string) error {
+	return r.Update(ctx, deviceCode, map[string]interface{}{"status": status})
+}
+
+// MarkUsed deletes a record once its tokens have been issued, so the device
+// code cannot be redeemed twice. The record is read and deleted in one GETDEL,
+// so of concurrent polls only one claims it; the others get types.ErrNotFound.
+func (r *RedisDeviceCodeRepository) MarkUsed(ctx context.Context, deviceCode string) error {
+	data, err := r.client.Client().GetDel(ctx, deviceCodeKey(deviceCode)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return types.ErrNotFound
+		}
+		return fmt.Errorf("failed to claim device code: %w", err)
+	}
+	var record oauth.DeviceCodeRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return fmt.Errorf("failed to unmarshal device code: %w", err)
+	}
+	if err := r.client.Del(ctx, deviceUserCodeKey(record.UserCode)); err != nil {
+		return fmt.Errorf("failed to delete user code: %w", err)
+	}
+	return nil
+}
+
+// Update sets the given fields of a record. The record is rewritten in a
+// transaction watching its key, so an update never restores a record that
+// MarkUsed deleted or overwrites a concurrent update; such an update fails
+// with types.ErrConflict.
+func (r *RedisDeviceCodeRepository) Update(ctx context.Context, deviceCode string, updates map[string]interface{}) error {
+	key := deviceCodeKey(deviceCode)
+	err := r.client.Client().Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return types.ErrNotFound
+			}
+			return fmt.Errorf("failed to get device code: %w", err)
+		}
+		var record oauth.DeviceCodeRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return fmt.Errorf("failed to unmarshal device code: %w", err)
+		}
+		if err := applyDeviceCodeUpdates(&record, updates); err != nil {
+			return err
+		}
+		ttl, encoded, err := encodeDeviceCode(&record)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, encoded, ttl).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return types.ErrConflict
+	}
+	return err
+}
+
+func applyDeviceCodeUpdates(record *oauth.DeviceCodeRecord, updates map[string]interface{}) error {
+	for field, value := range updates {
+		var ok bool
+		switch field {
+		case "status":
+			record.Status, ok = value.(string)
+		case "user_id":
+			record.UserID, ok = value.(string)
+		case "session_id":
+			record.SessionID, ok = value.(string)
+		case "auth_time":
+			record.AuthTime, ok = value.(time.Time)
+		case "last_polled_at":
+			record.LastPolledAt, ok = value.(time.Time)
+		case "interval":
+			record.Interval, ok = value.(int)
+		}
+		if !ok {
+			return fmt.Errorf("invalid device code update %q: %v", field, value)
+		}
+	}
+	return nil
+}
+
+func encodeDeviceCode(record *oauth.DeviceCodeRecord) (time.Duration, []byte, error) {
+	ttl := time.Until(record.ExpiresAt)
+	if ttl <= 0 {
+		// Keep expired records briefly so the device is told expired_token.
+		ttl = time.Minute
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to marshal device code: %w", err)
+	}
+	return ttl, data, nil
+}
+
+func (r *RedisDeviceCodeRepository) save(ctx context.Context, record *oauth.DeviceCodeRecord) error {
+	ttl, data, err := encodeDeviceCode(record)
+	if err != nil {
+		return err
+	}
+	if err := r.client.Set(ctx, deviceCodeKey(record.DeviceCode), data, ttl); err != nil {
+		return fmt.Errorf("failed to store device code: %w", err)
+	}
+	return nil
+}
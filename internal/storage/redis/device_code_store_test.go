@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+func TestRedisDeviceCodeRepository(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	repo := NewRedisDeviceCodeRepository(NewRedisClientWrapper(redis.NewClient(&redis.Options{Addr: mr.Addr()})))
+
+	require.NoError(t, repo.Create(ctx, &oauth.DeviceCodeRecord{
+		DeviceCode: "device-code",
+		UserCode:   "WDJBMJHT",
+		ClientID:   "tv",
+		Status:     oauth.DeviceCodeStatusPending,
+		ExpiresAt:  time.Now().Add(10 * time.Minute),
+		Interval:   5,
+	}))
+	assert.Greater(t, mr.TTL("device_code:device-code"), 9*time.Minute)
+
+	authTime := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, repo.Update(ctx, "device-code", map[string]interface{}{
+		"status":     oauth.DeviceCodeStatusAuthorized,
+		"user_id":    "user-1",
+		"session_id": "session-1",
+		"auth_time":  authTime,
+		"interval":   10,
+	}))
+
+	record, err := repo.GetByUserCode(ctx, "WDJBMJHT")
+	require.NoError(t, err)
+	assert.Equal(t, oauth.DeviceCodeStatusAuthorized, record.Status)
+	assert.Equal(t, "user-1", record.UserID)
+	assert.Equal(t, "session-1", record.SessionID)
+	assert.True(t, authTime.Equal(record.AuthTime))
+	assert.Equal(t, 10, record.Interval)
+
+	assert.Error(t, repo.Update(ctx, "device-code", map[string]interface{}{"interval": "10"}))
+
+	require.NoError(t, repo.MarkUsed(ctx, "device-code"))
+	_, err = repo.GetByDeviceCode(ctx, "device-code")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+	_, err = repo.GetByUserCode(ctx, "WDJBMJHT")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	// A used code can neither be redeemed again nor brought back by an update.
+	assert.ErrorIs(t, repo.MarkUsed(ctx, "device-code"), types.ErrNotFound)
+	assert.ErrorIs(t, repo.Update(ctx, "device-code", map[string]interface{}{"last_polled_at": time.Now()}), types.ErrNotFound)
+	assert.False(t, mr.Exists("device_code:device-code"))
+}
+
+func TestRedisDeviceCodeRepository_ConcurrentRedemption(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	repo := NewRedisDeviceCodeRepository(NewRedisClientWrapper(redis.NewClient(&redis.Options{Addr: mr.Addr()})))
+	require.NoError(t, repo.Create(ctx, &oauth.DeviceCodeRecord{
+		DeviceCode: "device-code",
+		UserCode:   "WDJBMJHT",
+		ClientID:   "tv",
+		Status:     oauth.DeviceCodeStatusAuthorized,
+		ExpiresAt:  time.Now().Add(10 * time.Minute),
+	}))
+
+	var redeemed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := repo.MarkUsed(ctx, "device-code"); err == nil {
+				redeemed.Add(1)
+			} else {
+				assert.ErrorIs(t, err, types.ErrNotFound)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), redeemed.Load())
+}
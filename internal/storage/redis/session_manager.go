@@ -14,6 +14,10 @@ import (
 	"go.uber.org/zap"
 )
 
+// SessionCookieName is the name of the browser cookie that carries the session ID
+// issued by the UI login flow.
+const SessionCookieName = "qid_session"
+
 // SessionManager provides a robust, centralized mechanism for handling user sessions.
 type SessionManager struct {
 	client        RedisClientInterface
@@ -33,6 +37,30 @@ type SessionConfig struct {
 	MaxSessionsPerUser  int           `yaml:"max_sessions_per_user"`
 }
 
+// SessionOption customizes a session before it is stored.
+type SessionOption func(*types.UserSession)
+
+// WithAuthentication records how the user authenticated, as OpenID Connect amr
+// values and the acr the login satisfied.
+func WithAuthentication(methods []string, acr string) SessionOption {
+	return func(s *types.UserSession) {
+		s.AuthMethods = methods
+		s.ACR = acr
+	}
+}
+
+// withAuthenticationOf carries the authentication details of an existing
+// session over to a new one, keeping the original auth time.
+func withAuthenticationOf(old *types.UserSession) SessionOption {
+	return func(s *types.UserSession) {
+		if !old.AuthTime.IsZero() {
+			s.AuthTime = old.AuthTime
+		}
+		s.AuthMethods = old.AuthMethods
+		s.ACR = old.ACR
+	}
+}
+
 // NewSessionManager creates a new session manager.
 func NewSessionManager(client RedisClientInterface, config SessionConfig, logger *zap.Logger, uuidGenerator UUIDGenerator, clock Clock, metrics *Metrics) *SessionManager {
 	return &SessionManager{
@@ -53,7 +81,7 @@ func computeDeviceFingerprint(r *http.Request) string {
 }
 
 // CreateSession creates a new session for a user.
-func (sm *SessionManager) CreateSession(ctx context.Context, userID string, r *http.Request) (*types.UserSession, error) {
+func (sm *SessionManager) CreateSession(ctx context.Context, userID string, r *http.Request, opts ...SessionOption) (*types.UserSession, error) {
 	if sm.config.MaxSessionsPerUser > 0 {
 		if err := sm.enforceMaxSessions(ctx, userID); err != nil {
 			sm.logger.Warn("Failed to enforce max sessions", zap.String("userID", userID), zap.Error(err))
@@ -70,6 +98,15 @@ func (sm *SessionManager) CreateSession(ctx context.Context, userID string, r *h
 		CreatedAt:     now,
 		ExpiresAt:     now.Add(sm.config.DefaultTTL),
 		LastRotatedAt: now,
+		AuthTime:      now,
+	}
+	if r != nil {
+		session.IPAddress = r.RemoteAddr
+		session.UserAgent = r.UserAgent()
+		session.DeviceFingerprint = computeDeviceFingerprint(r)
+	}
+	for _, opt := range opts {
+		opt(session)
 	}
 
 	sessionKey := fmt.Sprintf("session:%s", sessionID)
@@ -108,7 +145,8 @@ func (sm *SessionManager) CreateSession(ctx context.Context, userID string, r *h
 	return session, nil
 }
 
-// GetSession retrieves and validates a session.
+// GetSession retrieves and validates a session. The device binding check is
+// skipped when r is nil, which is only appropriate for administrative lookups.
 func (sm *SessionManager) GetSession(ctx context.Context, sessionID string, r *http.Request) (*types.UserSession, error) {
 	key := fmt.Sprintf("session:%s", sessionID)
 
@@ -134,7 +172,7 @@ func (sm *SessionManager) GetSession(ctx context.Context, sessionID string, r *h
 		return nil, types.ErrSessionExpired
 	}
 
-	if sm.config.EnableDeviceBinding && session.DeviceFingerprint != computeDeviceFingerprint(r) {
+	if sm.config.EnableDeviceBinding && r != nil && session.DeviceFingerprint != computeDeviceFingerprint(r) {
 		sm.logger.Warn("Device fingerprint mismatch", zap.String("sessionID", sessionID))
 		return nil, types.ErrDeviceMismatch
 	}
@@ -219,7 +257,7 @@ func (sm *SessionManager) RotateSession(ctx context.Context, oldSessionID string
 	}
 
 	// Create the new session first.
-	newSession, err := sm.CreateSession(ctx, oldSession.UserID, r)
+	newSession, err := sm.CreateSession(ctx, oldSession.UserID, r, withAuthenticationOf(oldSession))
 	if err != nil {
 		return nil, fmt.Errorf("could not create new session during rotation: %w", err)
 	}
@@ -43,17 +43,27 @@ func TestSessionManager_RotateSession(t *testing.T) {
 		IPAddress:         "192.0.2.1:1234",
 		UserAgent:         "curl/7.64.1",
 		DeviceFingerprint: "47DEQpj8HBSa+/TImW+5JCeuQeRKm5NMpJWZG3hSuFU=",
+		AuthTime:          now.Add(-time.Hour),
+		AuthMethods:       []string{"pwd", "otp"},
+		ACR:               "urn:quantaid:acr:mfa",
 	}
 	oldSessionJSON, _ := json.Marshal(oldSession)
 	mock.ExpectGet("session:" + oldSessionID).SetVal(string(oldSessionJSON))
 
 	newSessionID := "new-session-id"
 	newSession := &types.UserSession{
-		ID:            newSessionID,
-		UserID:        "user-123",
-		CreatedAt:     now,
-		ExpiresAt:     now.Add(24 * time.Hour),
-		LastRotatedAt: now,
+		ID:                newSessionID,
+		UserID:            "user-123",
+		IPAddress:         "192.0.2.1:1234",
+		UserAgent:         "curl/7.64.1",
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(24 * time.Hour),
+		DeviceFingerprint: computeDeviceFingerprint(req),
+		LastRotatedAt:     now,
+		// Rotation keeps the original authentication details.
+		AuthTime:    now.Add(-time.Hour),
+		AuthMethods: []string{"pwd", "otp"},
+		ACR:         "urn:quantaid:acr:mfa",
 	}
 	newSessionJSON, _ := json.Marshal(newSession)
 
@@ -0,0 +1,162 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+// RedisTokenFamilyRepository provides a Redis-backed implementation of the
+// auth.TokenFamilyRepository interface. A family is stored under
+// token_family:<id>, and every refresh token hash it has issued points back to
+// it from token_family_token:<hash>, so reuse of a rotated token can be
+// detected. Rotation and revocation run as Lua scripts so that concurrent
+// refreshes cannot both rotate the same token.
+type RedisTokenFamilyRepository struct {
+	client RedisClientInterface
+	ttl    time.Duration
+}
+
+// NewRedisTokenFamilyRepository creates a new Redis token family repository.
+// Families are kept for ttl after their last rotation, which should be at
+// least the refresh token lifetime.
+func NewRedisTokenFamilyRepository(client RedisClientInterface, ttl time.Duration) *RedisTokenFamilyRepository {
+	return &RedisTokenFamilyRepository{client: client, ttl: ttl}
+}
+
+func tokenFamilyKey(familyID string) string {
+	return fmt.Sprintf("token_family:%s", familyID)
+}
+
+func tokenFamilyTokenKey(token string) string {
+	return fmt.Sprintf("token_family_token:%s", token)
+}
+
+// CreateFamily stores a new token family.
+func (r *RedisTokenFamilyRepository) CreateFamily(ctx context.Context, family *types.TokenFamily) error {
+	return r.save(ctx, family)
+}
+
+// GetFamilyByToken retrieves the family that issued a refresh token.
+func (r *RedisTokenFamilyRepository) GetFamilyByToken(ctx context.Context, token string) (*types.TokenFamily, error) {
+	familyID, err := r.client.Get(ctx, tokenFamilyTokenKey(token))
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, types.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get token family index: %w", err)
+	}
+	return r.GetFamilyByID(ctx, familyID)
+}
+
+// GetFamilyByID retrieves a token family by its ID.
+func (r *RedisTokenFamilyRepository) GetFamilyByID(ctx context.Context, familyID string) (*types.TokenFamily, error) {
+	data, err := r.client.Get(ctx, tokenFamilyKey(familyID))
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, types.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get token family: %w", err)
+	}
+	var family types.TokenFamily
+	if err := json.Unmarshal([]byte(data), &family); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token family: %w", err)
+	}
+	return &family, nil
+}
+
+// rotateFamilyScript swaps a family's current token for the next one while
+// the presented token is still current and the family is not revoked, and
+// indexes only the new token. It returns 1 on success, 0 if the rotation lost
+// to another rotation or a revocation and -1 if the family does not exist.
+var rotateFamilyScript = redis.NewScript(`
+local data = redis.call('GET', KEYS[1])
+if not data then
+  return -1
+end
+local family = cjson.decode(data)
+if family.CurrentToken ~= ARGV[1] or (family.RevokedAt ~= nil and family.RevokedAt ~= cjson.null) then
+  return 0
+end
+family.CurrentToken = ARGV[2]
+if type(family.IssuedTokens) ~= 'table' then
+  family.IssuedTokens = {}
+end
+table.insert(family.IssuedTokens, ARGV[2])
+redis.call('SET', KEYS[1], cjson.encode(family), 'PX', ARGV[3])
+redis.call('SET', KEYS[2], ARGV[4], 'PX', ARGV[3])
+return 1
+`)
+
+// revokeFamilyScript marks a family as revoked unless it already is. It
+// returns -1 if the family does not exist.
+var revokeFamilyScript = redis.NewScript(`
+local data = redis.call('GET', KEYS[1])
+if not data then
+  return -1
+end
+local family = cjson.decode(data)
+if family.RevokedAt == nil or family.RevokedAt == cjson.null then
+  family.RevokedAt = ARGV[1]
+  redis.call('SET', KEYS[1], cjson.encode(family), 'PX', ARGV[2])
+end
+return 1
+`)
+
+// RotateFamily atomically makes next the family's current token. Only the
+// new token's index entry is written; those of earlier tokens are left to
+// expire with the tokens themselves.
+func (r *RedisTokenFamilyRepository) RotateFamily(ctx context.Context, familyID, current, next string) error {
+	result, err := rotateFamilyScript.Run(ctx, r.client.Client(),
+		[]string{tokenFamilyKey(familyID), tokenFamilyTokenKey(next)},
+		current, next, r.ttl.Milliseconds(), familyID).Int()
+	if err != nil {
+		return fmt.Errorf("failed to rotate token family: %w", err)
+	}
+	switch result {
+	case -1:
+		return types.ErrNotFound
+	case 0:
+		return types.ErrConflict
+	}
+	return nil
+}
+
+// RevokeFamily marks a family as revoked. Its index entries are kept so that
+// later use of any of its tokens is still recognised.
+func (r *RedisTokenFamilyRepository) RevokeFamily(ctx context.Context, familyID string) error {
+	revokedAt, err := time.Now().UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	result, err := revokeFamilyScript.Run(ctx, r.client.Client(),
+		[]string{tokenFamilyKey(familyID)}, string(revokedAt), r.ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	if result == -1 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+func (r *RedisTokenFamilyRepository) save(ctx context.Context, family *types.TokenFamily) error {
+	data, err := json.Marshal(family)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token family: %w", err)
+	}
+	if err := r.client.Set(ctx, tokenFamilyKey(family.FamilyID), data, r.ttl); err != nil {
+		return fmt.Errorf("failed to store token family: %w", err)
+	}
+	for _, token := range family.IssuedTokens {
+		if err := r.client.Set(ctx, tokenFamilyTokenKey(token), family.FamilyID, r.ttl); err != nil {
+			return fmt.Errorf("failed to index token family: %w", err)
+		}
+	}
+	return nil
+}
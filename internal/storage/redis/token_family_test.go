@@ -0,0 +1,70 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/pkg/types"
+)
+
+func TestRedisTokenFamilyRepository(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	repo := NewRedisTokenFamilyRepository(NewRedisClientWrapper(redis.NewClient(&redis.Options{Addr: mr.Addr()})), time.Hour)
+
+	family := &types.TokenFamily{
+		FamilyID:      "family-1",
+		OriginalToken: "rt-1",
+		CurrentToken:  "rt-1",
+		IssuedTokens:  []string{"rt-1"},
+		UserID:        "user-1",
+		ClientID:      "rp",
+		SessionID:     "session-1",
+	}
+	require.NoError(t, repo.CreateFamily(ctx, family))
+
+	require.NoError(t, repo.RotateFamily(ctx, "family-1", "rt-1", "rt-2"))
+	// A concurrent refresh of the same token loses the race.
+	assert.ErrorIs(t, repo.RotateFamily(ctx, "family-1", "rt-1", "rt-3"), types.ErrConflict)
+	assert.ErrorIs(t, repo.RotateFamily(ctx, "unknown", "rt-1", "rt-3"), types.ErrNotFound)
+	assert.False(t, mr.Exists("token_family_token:rt-3"))
+
+	// Rotated tokens still lead back to their family.
+	got, err := repo.GetFamilyByToken(ctx, "rt-1")
+	require.NoError(t, err)
+	assert.Equal(t, "rt-2", got.CurrentToken)
+	assert.Equal(t, []string{"rt-1", "rt-2"}, got.IssuedTokens)
+	assert.Equal(t, "session-1", got.SessionID)
+	assert.Nil(t, got.RevokedAt)
+	assert.Equal(t, time.Hour, mr.TTL("token_family_token:rt-1"))
+
+	// Rotation writes only the new token's index entry.
+	mr.FastForward(30 * time.Minute)
+	require.NoError(t, repo.RotateFamily(ctx, "family-1", "rt-2", "rt-3"))
+	assert.Equal(t, 30*time.Minute, mr.TTL("token_family_token:rt-1"))
+	assert.Equal(t, time.Hour, mr.TTL("token_family_token:rt-3"))
+
+	require.NoError(t, repo.RevokeFamily(ctx, "family-1"))
+	got, err = repo.GetFamilyByToken(ctx, "rt-2")
+	require.NoError(t, err)
+	assert.NotNil(t, got.RevokedAt)
+	assert.Equal(t, "rt-3", got.CurrentToken)
+	assert.Equal(t, "session-1", got.SessionID)
+	revokedAt := *got.RevokedAt
+	require.NoError(t, repo.RevokeFamily(ctx, "family-1"))
+	got, err = repo.GetFamilyByID(ctx, "family-1")
+	require.NoError(t, err)
+	assert.True(t, revokedAt.Equal(*got.RevokedAt), "revoking twice keeps the first revocation time")
+
+	// A revoked family cannot be rotated.
+	assert.ErrorIs(t, repo.RotateFamily(ctx, "family-1", "rt-3", "rt-4"), types.ErrConflict)
+	assert.ErrorIs(t, repo.RevokeFamily(ctx, "unknown"), types.ErrNotFound)
+
+	_, err = repo.GetFamilyByToken(ctx, "unknown")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
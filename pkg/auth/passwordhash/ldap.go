@@ -0,0 +1,72 @@
+package passwordhash
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// LDAPSHA verifies the "{SHA}" and salted "{SSHA}", "{SSHA256}" and
+// "{SSHA512}" hashes of LDAP directories such as OpenLDAP: the base64 of
+// the digest of the password and salt, followed by the salt.
+type LDAPSHA struct{}
+
+var ldapSchemes = map[string]struct {
+	newHash func() hash.Hash
+	size    int
+	salted  bool
+}{
+	"{SHA}":     {sha1.New, sha1.Size, false},
+	"{SSHA}":    {sha1.New, sha1.Size, true},
+	"{SHA256}":  {sha256.New, sha256.Size, false},
+	"{SSHA256}": {sha256.New, sha256.Size, true},
+	"{SHA512}":  {sha512.New, sha512.Size, false},
+	"{SSHA512}": {sha512.New, sha512.Size, true},
+}
+
+// Name returns "ldap-sha".
+func (LDAPSHA) Name() string {
+	return "ldap-sha"
+}
+
+// Matches reports whether the hash is an LDAP SHA hash.
+func (LDAPSHA) Matches(hash string) bool {
+	_, ok := ldapSchemes[ldapPrefix(hash)]
+	return ok
+}
+
+// Verify reports whether the password matches the LDAP SHA hash.
+func (LDAPSHA) Verify(password, encoded string) (bool, error) {
+	prefix := ldapPrefix(encoded)
+	scheme, ok := ldapSchemes[prefix]
+	if !ok {
+		return false, fmt.Errorf("unsupported ldap hash scheme")
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded[len(prefix):])
+	if err != nil || len(raw) < scheme.size || (!scheme.salted && len(raw) != scheme.size) {
+		return false, fmt.Errorf("malformed %s hash", prefix)
+	}
+	digest, salt := raw[:scheme.size], raw[scheme.size:]
+
+	h := scheme.newHash()
+	h.Write([]byte(password))
+	h.Write(salt)
+	return subtle.ConstantTimeCompare(h.Sum(nil), digest) == 1, nil
+}
+
+// ldapPrefix returns the upper-cased "{SCHEME}" prefix of the hash.
+func ldapPrefix(hash string) string {
+	if !strings.HasPrefix(hash, "{") {
+		return ""
+	}
+	end := strings.Index(hash, "}")
+	if end < 0 {
+		return ""
+	}
+	return strings.ToUpper(hash[:end+1])
+}
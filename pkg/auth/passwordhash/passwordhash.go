@@ -0,0 +1,106 @@
+// Package passwordhash hashes passwords and verifies password hashes in the
+// formats of the systems users are migrated from. Hashes are identified by
+// their prefix, such as the "$argon2id$" of the PHC string format, so hashes
+// of several schemes can be verified side by side, and a hash in any but the
+// preferred scheme can be replaced the next time its password is known.
+package passwordhash
+
+import (
+	"errors"
+)
+
+// ErrUnknownFormat is returned for hashes no registered scheme recognizes.
+var ErrUnknownFormat = errors.New("unknown password hash format")
+
+// Scheme verifies password hashes of one format.
+type Scheme interface {
+	// Name returns the name of the scheme, such as "argon2id".
+	Name() string
+	// Matches reports whether the hash is in the scheme's format.
+	Matches(hash string) bool
+	// Verify reports whether the password matches the hash.
+	Verify(password, hash string) (bool, error)
+}
+
+// Hasher is a scheme that also produces hashes.
+type Hasher interface {
+	Scheme
+	// Hash returns a hash of the password with a fresh salt.
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether a hash of the scheme was produced with
+	// other parameters than the hasher's.
+	NeedsRehash(hash string) bool
+}
+
+// Registry hashes passwords with a preferred hasher and verifies hashes of
+// all of its schemes.
+type Registry struct {
+	preferred Hasher
+	schemes   []Scheme
+}
+
+// NewRegistry creates a registry that hashes with preferred and verifies
+// hashes of preferred and the other schemes.
+func NewRegistry(preferred Hasher, schemes ...Scheme) *Registry {
+	return &Registry{
+		preferred: preferred,
+		schemes:   append([]Scheme{preferred}, schemes...),
+	}
+}
+
+// NewDefaultRegistry creates a registry that hashes with Argon2id and the
+// given parameters and verifies bcrypt, PBKDF2, SHA-crypt and LDAP salted
+// SHA hashes.
+func NewDefaultRegistry(params Argon2Params) *Registry {
+	return NewRegistry(NewArgon2id(params), LegacySchemes()...)
+}
+
+// LegacySchemes returns the schemes of imported hashes.
+func LegacySchemes() []Scheme {
+	return []Scheme{
+		NewBcrypt(0),
+		PBKDF2{},
+		SHACrypt{},
+		LDAPSHA{},
+	}
+}
+
+// Preferred returns the hasher new hashes are produced with.
+func (r *Registry) Preferred() Hasher {
+	return r.preferred
+}
+
+// Identify returns the scheme of the hash.
+func (r *Registry) Identify(hash string) (Scheme, error) {
+	for _, scheme := range r.schemes {
+		if scheme.Matches(hash) {
+			return scheme, nil
+		}
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Hash returns a hash of the password in the preferred scheme.
+func (r *Registry) Hash(password string) (string, error) {
+	return r.preferred.Hash(password)
+}
+
+// Verify reports whether the password matches the hash, in whichever scheme
+// the hash is.
+func (r *Registry) Verify(password, hash string) (bool, error) {
+	scheme, err := r.Identify(hash)
+	if err != nil {
+		return false, err
+	}
+	return scheme.Verify(password, hash)
+}
+
+// NeedsRehash reports whether the hash should be replaced by one in the
+// preferred scheme, because it is in another scheme or was produced with
+// other parameters.
+func (r *Registry) NeedsRehash(hash string) bool {
+	if !r.preferred.Matches(hash) {
+		return true
+	}
+	return r.preferred.NeedsRehash(hash)
+}
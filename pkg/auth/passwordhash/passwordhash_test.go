@@ -0,0 +1,76 @@
+package passwordhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_VerifiesLegacyHashes(t *testing.T) {
+	registry := NewDefaultRegistry(Argon2Params{Memory: 1024, Iterations: 1})
+
+	for _, tc := range []struct {
+		scheme, password, hash string
+	}{
+		{"sha-crypt", "Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"sha-crypt", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"sha-crypt", "Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"pbkdf2", "correct horse", "$pbkdf2-sha256$29000$AQIDBAUGBwgJCgsM$DQcg6O505GCfWeUWBpNS356Jc4foEUhvjhEAEb.OHO0"},
+		{"pbkdf2", "correct horse", "pbkdf2_sha256$260000$Xk3fG9qQ2sL1$Hn/I6KdhLeph1rgLKD1C3up0rKxmQHZKgZ/5hCzalpQ="},
+		{"ldap-sha", "correct horse", "{SSHA}qITZK2p4w2s2QGYCc5XrYthNLFJzNGx0"},
+		{"ldap-sha", "correct horse", "{SHA}L55TUjtiq8FBorTWAZ0jy6g129A="},
+		{"bcrypt", "secret", "$2a$04$zBfNDdKC9ohu/SecDhg0jexwh/njPAtboQOXqoH71uYScuE8Z5o2C"},
+	} {
+		scheme, err := registry.Identify(tc.hash)
+		require.NoError(t, err, tc.hash)
+		assert.Equal(t, tc.scheme, scheme.Name(), tc.hash)
+
+		ok, err := registry.Verify(tc.password, tc.hash)
+		require.NoError(t, err, tc.hash)
+		assert.True(t, ok, tc.hash)
+
+		ok, err = registry.Verify("wrong", tc.hash)
+		require.NoError(t, err, tc.hash)
+		assert.False(t, ok, tc.hash)
+
+		assert.True(t, registry.NeedsRehash(tc.hash), tc.hash)
+	}
+
+	_, err := registry.Verify("secret", "plaintext")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func TestRegistry_HashesWithArgon2id(t *testing.T) {
+	registry := NewDefaultRegistry(Argon2Params{Memory: 1024, Iterations: 1})
+
+	hash, err := registry.Hash("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+
+	ok, err := registry.Verify("secret", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = registry.Verify("Secret", hash)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, registry.NeedsRehash(hash))
+
+	// Changed parameters call for a new hash, which still verifies until then.
+	stronger := NewDefaultRegistry(Argon2Params{Memory: 2048, Iterations: 1})
+	assert.True(t, stronger.NeedsRehash(hash))
+	ok, err = stronger.Verify("secret", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRegistry_PreferredBcrypt(t *testing.T) {
+	registry := NewRegistry(NewBcrypt(4), NewArgon2id(Argon2Params{Memory: 1024, Iterations: 1}))
+
+	hash, err := registry.Hash("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$2a$04$"), hash)
+	assert.False(t, registry.NeedsRehash(hash))
+	assert.True(t, NewRegistry(NewBcrypt(5)).NeedsRehash(hash))
+}
@@ -0,0 +1,87 @@
+package passwordhash
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// PBKDF2 verifies PBKDF2 hashes in the formats of passlib,
+// "$pbkdf2-sha256$<rounds>$<salt>$<hash>" in its adapted base64, and Django,
+// "pbkdf2_sha256$<rounds>$<salt>$<hash>" in base64, with SHA-1, SHA-256 or
+// SHA-512.
+type PBKDF2 struct{}
+
+var pbkdf2Digests = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// passlibBase64 is passlib's "adapted base64", which uses "." for "+".
+var passlibBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// Name returns "pbkdf2".
+func (PBKDF2) Name() string {
+	return "pbkdf2"
+}
+
+// Matches reports whether the hash is a PBKDF2 hash of passlib or Django.
+func (PBKDF2) Matches(hash string) bool {
+	return strings.HasPrefix(hash, "$pbkdf2") || strings.HasPrefix(hash, "pbkdf2_")
+}
+
+// Verify reports whether the password matches the PBKDF2 hash.
+func (PBKDF2) Verify(password, encoded string) (bool, error) {
+	var digest, salt, key []byte
+	var algorithm string
+	var rounds int
+	var err error
+
+	parts := strings.Split(encoded, "$")
+	switch {
+	case len(parts) == 5 && parts[0] == "" && strings.HasPrefix(parts[1], "pbkdf2"):
+		// passlib; plain "$pbkdf2$" is SHA-1.
+		algorithm = strings.TrimPrefix(strings.TrimPrefix(parts[1], "pbkdf2"), "-")
+		if algorithm == "" {
+			algorithm = "sha1"
+		}
+		rounds, err = strconv.Atoi(parts[2])
+		if err == nil {
+			salt, err = passlibBase64.DecodeString(parts[3])
+		}
+		if err == nil {
+			key, err = passlibBase64.DecodeString(parts[4])
+		}
+	case len(parts) == 4 && strings.HasPrefix(parts[0], "pbkdf2_"):
+		// Django, whose salt is used as it is.
+		algorithm = strings.TrimPrefix(parts[0], "pbkdf2_")
+		rounds, err = strconv.Atoi(parts[1])
+		salt = []byte(parts[2])
+		if err == nil {
+			key, err = base64.StdEncoding.DecodeString(parts[3])
+		}
+	default:
+		return false, fmt.Errorf("malformed pbkdf2 hash")
+	}
+	if err != nil || rounds <= 0 || len(key) == 0 {
+		return false, fmt.Errorf("malformed pbkdf2 hash")
+	}
+	newHash, ok := pbkdf2Digests[algorithm]
+	if !ok {
+		return false, fmt.Errorf("unsupported pbkdf2 digest %q", algorithm)
+	}
+
+	digest, err = pbkdf2.Key(newHash, password, salt, rounds, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(digest, key) == 1, nil
+}
@@ -0,0 +1,189 @@
+package passwordhash
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHACrypt verifies the SHA-256 ("$5$") and SHA-512 ("$6$") crypt hashes of
+// glibc, as found in /etc/shadow and many Unix directories.
+type SHACrypt struct{}
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// The orders in which the bytes of the final digests are encoded.
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// Name returns "sha-crypt".
+func (SHACrypt) Name() string {
+	return "sha-crypt"
+}
+
+// Matches reports whether the hash is a SHA-256 or SHA-512 crypt hash.
+func (SHACrypt) Matches(hash string) bool {
+	return strings.HasPrefix(hash, "$5$") || strings.HasPrefix(hash, "$6$")
+}
+
+// Verify reports whether the password matches the crypt hash.
+func (SHACrypt) Verify(password, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 4 {
+		return false, fmt.Errorf("malformed sha-crypt hash")
+	}
+	settings := parts[:len(parts)-1]
+	computed, err := shaCrypt(password, strings.Join(settings, "$"))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(encoded)) == 1, nil
+}
+
+// shaCrypt computes the crypt hash of the password for the settings, such as
+// "$6$rounds=10000$salt", following Ulrich Drepper's specification.
+func shaCrypt(password, settings string) (string, error) {
+	parts := strings.Split(settings, "$")
+	if len(parts) < 3 || parts[0] != "" {
+		return "", fmt.Errorf("malformed sha-crypt settings")
+	}
+	var newHash func() hash.Hash
+	var order [][3]int
+	switch parts[1] {
+	case "5":
+		newHash, order = sha256.New, sha256CryptOrder
+	case "6":
+		newHash, order = sha512.New, sha512CryptOrder
+	default:
+		return "", fmt.Errorf("unsupported sha-crypt variant %q", parts[1])
+	}
+
+	rounds, customRounds := shaCryptDefaultRounds, false
+	rest := parts[2:]
+	if strings.HasPrefix(rest[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(rest[0], "rounds="))
+		if err != nil {
+			return "", fmt.Errorf("malformed sha-crypt rounds")
+		}
+		rounds, customRounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds), true
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return "", fmt.Errorf("malformed sha-crypt settings")
+	}
+	salt := []byte(rest[0])
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	key := []byte(password)
+
+	h := newHash()
+	h.Write(key)
+	h.Write(salt)
+	h.Write(key)
+	b := h.Sum(nil)
+
+	h = newHash()
+	h.Write(key)
+	h.Write(salt)
+	h.Write(repeatTo(b, len(key)))
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(key)
+		}
+	}
+	a := h.Sum(nil)
+
+	h = newHash()
+	for range key {
+		h.Write(key)
+	}
+	p := repeatTo(h.Sum(nil), len(key))
+
+	h = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatTo(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h = newHash()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$" + parts[1] + "$")
+	if customRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.Write(salt)
+	out.WriteString("$")
+	for _, o := range order {
+		encodeCrypt64(&out, c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+	if len(c) == sha256.Size {
+		encodeCrypt64(&out, 0, c[31], c[30], 3)
+	} else {
+		encodeCrypt64(&out, 0, 0, c[63], 2)
+	}
+	return out.String(), nil
+}
+
+// repeatTo returns b repeated up to n bytes.
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+// encodeCrypt64 writes n characters of the 24 bits b2 b1 b0 in the crypt
+// alphabet, least significant first.
+func encodeCrypt64(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
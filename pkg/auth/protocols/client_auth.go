@@ -0,0 +1,242 @@
+package protocols
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// ClientAssertionTypeJWTBearer is the client_assertion_type for private_key_jwt
+// client authentication (RFC 7523).
+const ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// ClientAssertionSigningAlgs are the algorithms accepted for client assertions.
+var ClientAssertionSigningAlgs = []string{"RS256", "PS256", "ES256", "EdDSA"}
+
+// ClientCredentials are the client authentication parameters of a request to
+// the token, introspection or revocation endpoint.
+type ClientCredentials struct {
+	ClientID            string
+	ClientSecret        string
+	ClientAssertionType string
+	ClientAssertion     string
+}
+
+// AuthenticatedClient is a client whose credentials have been verified.
+type AuthenticatedClient struct {
+	ID          string
+	Application *types.Application
+}
+
+// IsPublic reports whether the client is a public client, which has no credentials.
+func (c *AuthenticatedClient) IsPublic() bool {
+	return c.Application.ClientType == types.ClientTypePublic
+}
+
+// AllowsGrantType reports whether the client may use a grant type. Clients
+// without registered grant_types may use any grant the server supports.
+func (c *AuthenticatedClient) AllowsGrantType(grantType string) bool {
+	var registered []string
+	switch v := c.Application.ProtocolConfig["grant_types"].(type) {
+	case []string:
+		registered = v
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				registered = append(registered, s)
+			}
+		}
+	default:
+		return true
+	}
+	for _, g := range registered {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHTTPClient fetches client jwks_uri documents. The URI is chosen by
+// whoever registered the client, so only public https addresses are fetched.
+var clientHTTPClient = utils.NewPublicHTTPClient(5 * time.Second)
+
+// maxClientJWKSSize bounds the jwks_uri documents read.
+const maxClientJWKSSize = 64 << 10
+
+// AuthenticateClient authenticates a client with client_secret_basic,
+// client_secret_post or private_key_jwt. Public clients are identified by
+// client_id alone; callers decide whether that is acceptable.
+func (a *OAuthAdapter) AuthenticateClient(ctx context.Context, creds ClientCredentials) (*AuthenticatedClient, error) {
+	if creds.ClientAssertion != "" || creds.ClientAssertionType != "" {
+		if creds.ClientAssertionType != ClientAssertionTypeJWTBearer {
+			return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "unsupported client_assertion_type"})
+		}
+		return a.authenticateClientAssertion(ctx, creds.ClientID, creds.ClientAssertion)
+	}
+
+	if creds.ClientID == "" {
+		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "client authentication required"})
+	}
+	app, err := a.appRepo.GetApplicationByClientID(ctx, creds.ClientID)
+	if err != nil {
+		return nil, types.ErrInvalidClient.WithCause(err)
+	}
+	client := &AuthenticatedClient{ID: creds.ClientID, Application: app}
+	if client.IsPublic() {
+		return client, nil
+	}
+
+	if !oauth.HasClientSecret(app.ProtocolConfig) {
+		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "client has no secret; use private_key_jwt"})
+	}
+	if !oauth.CheckClientSecret(app.ProtocolConfig, creds.ClientSecret) {
+		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "invalid client_secret"})
+	}
+	return client, nil
+}
+
+// authenticateClientAssertion verifies a private_key_jwt assertion against the
+// keys registered for the client in its "jwks" or "jwks_uri" protocol config.
+func (a *OAuthAdapter) authenticateClientAssertion(ctx context.Context, clientID, assertion string) (*AuthenticatedClient, error) {
+	unverified, _, err := jwt.NewParser().ParseUnverified(assertion, jwt.MapClaims{})
+	if err != nil {
+		return nil, types.ErrInvalidClient.WithCause(err)
+	}
+	claims := unverified.Claims.(jwt.MapClaims)
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	if iss == "" || iss != sub || (clientID != "" && clientID != iss) {
+		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "assertion iss and sub must be the client_id"})
+	}
+
+	app, err := a.appRepo.GetApplicationByClientID(ctx, iss)
+	if err != nil {
+		return nil, types.ErrInvalidClient.WithCause(err)
+	}
+	keys, err := clientKeys(ctx, app)
+	if err != nil {
+		return nil, types.ErrInvalidClient.WithCause(err)
+	}
+
+	token, err := jwt.Parse(assertion, func(t *jwt.Token) (interface{}, error) {
+		candidates := keys.Keys
+		if kid, _ := t.Header["kid"].(string); kid != "" {
+			candidates = keys.Key(kid)
+		}
+		set := jwt.VerificationKeySet{}
+		for _, k := range candidates {
+			if k.Valid() && k.IsPublic() {
+				set.Keys = append(set.Keys, k.Key)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, fmt.Errorf("no registered key matches the assertion")
+		}
+		return set, nil
+	},
+		jwt.WithValidMethods(ClientAssertionSigningAlgs),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, types.ErrInvalidClient.WithCause(err)
+	}
+
+	verified := token.Claims.(jwt.MapClaims)
+	aud, _ := verified.GetAudience()
+	if !a.isOwnAudience(aud) {
+		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "assertion audience is not this server"})
+	}
+
+	// Each assertion is accepted once: remember its jti until it expires.
+	jti, _ := verified["jti"].(string)
+	if jti == "" {
+		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "assertion has no jti"})
+	}
+	exp, _ := verified.GetExpirationTime()
+	fresh, err := a.redis.SetNX(ctx, "client_assertion:"+iss+":"+jti, 1, time.Until(exp.Time)+time.Minute).Result()
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	if !fresh {
+		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "assertion has already been used"})
+	}
+
+	return &AuthenticatedClient{ID: iss, Application: app}, nil
+}
+
+// isOwnAudience reports whether an assertion audience names this server: its
+// issuer identifier or one of its endpoints.
+func (a *OAuthAdapter) isOwnAudience(aud []string) bool {
+	if a.crypto == nil {
+		return false
+	}
+	issuer := strings.TrimSuffix(a.crypto.Issuer(), "/")
+	for _, v := range aud {
+		if v == issuer || strings.HasPrefix(v, issuer+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKeys returns the public keys registered for a client, either inline
+// under "jwks" or by reference under "jwks_uri".
+func clientKeys(ctx context.Context, app *types.Application) (*jose.JSONWebKeySet, error) {
+	var raw []byte
+	switch v := app.ProtocolConfig["jwks"].(type) {
+	case string:
+		raw = []byte(v)
+	case nil:
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+
+	if raw == nil {
+		uri, _ := app.ProtocolConfig["jwks_uri"].(string)
+		if uri == "" {
+			return nil, fmt.Errorf("client has no registered keys")
+		}
+		if u, err := url.Parse(uri); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("client jwks_uri must be an https URL")
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := clientHTTPClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch client jwks: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch client jwks: status %d", resp.StatusCode)
+		}
+		var keys jose.JSONWebKeySet
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxClientJWKSSize)).Decode(&keys); err != nil {
+			return nil, fmt.Errorf("invalid client jwks: %w", err)
+		}
+		return &keys, nil
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, fmt.Errorf("invalid client jwks: %w", err)
+	}
+	return &keys, nil
+}
@@ -0,0 +1,236 @@
+package protocols
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"go.uber.org/zap"
+)
+
+// Token type hints accepted by the introspection and revocation endpoints.
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// inactiveToken is the introspection response for any token that is not
+// currently valid. RFC 7662 forbids saying why.
+var inactiveToken = &types.TokenIntrospection{Active: false}
+
+// IntrospectToken reports whether token is an active access or refresh token
+// issued by this server (RFC 7662). The hint only decides which kind of token
+// is tried first.
+func (a *OAuthAdapter) IntrospectToken(ctx context.Context, token, hint string) (*types.TokenIntrospection, error) {
+	if hint == TokenTypeHintRefreshToken {
+		if info, err := a.introspectRefreshToken(ctx, token); info != nil || err != nil {
+			return info, err
+		}
+		if info, err := a.introspectAccessToken(ctx, token); info != nil || err != nil {
+			return info, err
+		}
+		return inactiveToken, nil
+	}
+	if info, err := a.introspectAccessToken(ctx, token); info != nil || err != nil {
+		return info, err
+	}
+	if info, err := a.introspectRefreshToken(ctx, token); info != nil || err != nil {
+		return info, err
+	}
+	return inactiveToken, nil
+}
+
+// introspectAccessToken returns nil when token is not an access token, and
+// inactiveToken when it is one that has been revoked.
+func (a *OAuthAdapter) introspectAccessToken(ctx context.Context, token string) (*types.TokenIntrospection, error) {
+	claims, ok := a.parseAccessToken(token)
+	if !ok {
+		return nil, nil
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti != "" && a.tokenRepo != nil {
+		denied, err := a.tokenRepo.IsInDenyList(ctx, jti)
+		if err != nil {
+			return nil, types.ErrInternal.WithCause(err)
+		}
+		if denied {
+			return inactiveToken, nil
+		}
+	}
+
+	info := &types.TokenIntrospection{
+		Active:    true,
+		TokenType: "Bearer",
+		Jti:       jti,
+		Exp:       numericClaim(claims["exp"]),
+		Iat:       numericClaim(claims["iat"]),
+	}
+	info.Scope, _ = claims["scope"].(string)
+	info.ClientID, _ = claims["client_id"].(string)
+	info.Sub, _ = claims["sub"].(string)
+	info.Iss, _ = claims["iss"].(string)
+	return info, nil
+}
+
+// introspectRefreshToken returns nil when token is not a live refresh token.
+func (a *OAuthAdapter) introspectRefreshToken(ctx context.Context, token string) (*types.TokenIntrospection, error) {
+	data, ok := a.refreshTokenData(ctx, token)
+	if !ok {
+		return nil, nil
+	}
+	info := &types.TokenIntrospection{
+		Active:    true,
+		TokenType: TokenTypeHintRefreshToken,
+		Exp:       numericClaim(data["expires_at"]),
+		Iat:       numericClaim(data["issued_at"]),
+	}
+	info.Scope, _ = data["scope"].(string)
+	info.ClientID, _ = data["client_id"].(string)
+	info.Sub, _ = data["user_id"].(string)
+	if a.crypto != nil {
+		info.Iss = a.crypto.Issuer()
+	}
+	return info, nil
+}
+
+// RevokeToken revokes an access or refresh token on behalf of clientID
+// (RFC 7009). Unknown and already invalid tokens are not an error; a token
+// issued to another client is.
+func (a *OAuthAdapter) RevokeToken(ctx context.Context, token, hint, clientID string) error {
+	if hint == TokenTypeHintRefreshToken {
+		if found, err := a.revokeRefreshToken(ctx, token, clientID); found || err != nil {
+			return err
+		}
+		_, err := a.revokeAccessToken(ctx, token, clientID)
+		return err
+	}
+	if found, err := a.revokeAccessToken(ctx, token, clientID); found || err != nil {
+		return err
+	}
+	_, err := a.revokeRefreshToken(ctx, token, clientID)
+	return err
+}
+
+func (a *OAuthAdapter) revokeAccessToken(ctx context.Context, token, clientID string) (bool, error) {
+	claims, ok := a.parseAccessToken(token)
+	if !ok {
+		return false, nil
+	}
+	if owner, _ := claims["client_id"].(string); owner != clientID {
+		return true, types.ErrUnauthorizedClient.WithDetails(map[string]string{"error": "token was issued to another client"})
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" || a.tokenRepo == nil {
+		a.logger.Warn(ctx, "access token cannot be revoked", zap.String("client_id", clientID))
+		return true, nil
+	}
+	ttl := time.Until(time.Unix(numericClaim(claims["exp"]), 0))
+	if ttl <= 0 {
+		return true, nil
+	}
+	if err := a.tokenRepo.AddToDenyList(ctx, jti, ttl); err != nil {
+		return true, types.ErrInternal.WithCause(err)
+	}
+	return true, nil
+}
+
+func (a *OAuthAdapter) revokeRefreshToken(ctx context.Context, token, clientID string) (bool, error) {
+	data, ok := a.refreshTokenData(ctx, token)
+	owner, _ := data["client_id"].(string)
+	// A token that has been rotated is no longer stored, but its family
+	// still knows it.
+	var family *types.TokenFamily
+	if a.families != nil {
+		var err error
+		family, err = a.families.GetFamilyByToken(ctx, auth.HashRefreshToken(token))
+		if err != nil && !errors.Is(err, types.ErrNotFound) {
+			return ok, types.ErrInternal.WithCause(err)
+		}
+		if !ok && family != nil {
+			owner = family.ClientID
+		}
+	}
+	if !ok && family == nil {
+		return false, nil
+	}
+	if owner != clientID {
+		return true, types.ErrUnauthorizedClient.WithDetails(map[string]string{"error": "token was issued to another client"})
+	}
+	if err := a.redis.Del(ctx, refreshTokenKey(auth.HashRefreshToken(token))); err != nil {
+		return true, types.ErrInternal.WithCause(err)
+	}
+	// Revoking any refresh token of a rotation chain ends the whole chain,
+	// including its live token.
+	if family != nil {
+		if err := a.families.RevokeFamily(ctx, family.FamilyID); err != nil && !errors.Is(err, types.ErrNotFound) {
+			return true, types.ErrInternal.WithCause(err)
+		}
+		if err := a.redis.Del(ctx, refreshTokenKey(family.CurrentToken)); err != nil {
+			return true, types.ErrInternal.WithCause(err)
+		}
+	}
+	return true, nil
+}
+
+// parseAccessToken verifies a JWT access token issued by this server. ID
+// tokens are signed with the same keys but carry no scope claim.
+func (a *OAuthAdapter) parseAccessToken(token string) (map[string]interface{}, bool) {
+	var claims map[string]interface{}
+	if a.crypto != nil {
+		parsed, err := a.crypto.ValidateJWT(token)
+		if err != nil {
+			return nil, false
+		}
+		claims = parsed
+	} else {
+		parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+			}
+			return a.jwtSecret, nil
+		})
+		if err != nil {
+			return nil, false
+		}
+		claims = parsed.Claims.(jwt.MapClaims)
+	}
+	if _, ok := claims["scope"]; !ok {
+		return nil, false
+	}
+	return claims, true
+}
+
+// refreshTokenData loads the data stored for a refresh token.
+func (a *OAuthAdapter) refreshTokenData(ctx context.Context, token string) (map[string]interface{}, bool) {
+	val, err := a.redis.Get(ctx, refreshTokenKey(auth.HashRefreshToken(token)))
+	if err != nil {
+		return nil, false
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(val), &data); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// numericClaim converts a JSON number claim to an int64.
+func numericClaim(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case json.Number:
+		i, _ := n.Int64()
+		return i
+	default:
+		return 0
+	}
+}
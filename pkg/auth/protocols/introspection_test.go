@@ -0,0 +1,229 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
+	"github.com/turtacn/QuantaID/internal/storage/redis"
+	"github.com/turtacn/QuantaID/pkg/types"
+	"github.com/turtacn/QuantaID/pkg/utils"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func newIntrospectionAdapter(t *testing.T, apps map[string]*types.Application) *OAuthAdapter {
+	mr := miniredis.RunT(t)
+	crypto := utils.NewCryptoManager("test-secret")
+	crypto.SetIssuer("https://op.example.com")
+
+	appRepo := new(MockApplicationRepository)
+	for id, app := range apps {
+		appRepo.On("GetApplicationByClientID", mock.Anything, id).Return(app, nil)
+	}
+	return &OAuthAdapter{
+		logger:    utils.NewZapLoggerWrapper(zap.NewNop()),
+		appRepo:   appRepo,
+		redis:     redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})),
+		crypto:    crypto,
+		tokenRepo: memory.NewAuthMemoryRepository(),
+	}
+}
+
+func TestOAuthAdapter_IntrospectAndRevokeTokens(t *testing.T) {
+	ctx := context.Background()
+	adapter := newIntrospectionAdapter(t, nil)
+	user := &types.User{ID: "user-123"}
+
+	tokens, err := adapter.generateTokens(ctx, user, "read write", "", "rp", nil, nil)
+	require.NoError(t, err)
+
+	info, err := adapter.IntrospectToken(ctx, tokens.AccessToken, "")
+	require.NoError(t, err)
+	assert.True(t, info.Active)
+	assert.Equal(t, "Bearer", info.TokenType)
+	assert.Equal(t, "read write", info.Scope)
+	assert.Equal(t, "rp", info.ClientID)
+	assert.Equal(t, "user-123", info.Sub)
+	assert.Greater(t, info.Exp, time.Now().Unix())
+
+	info, err = adapter.IntrospectToken(ctx, tokens.RefreshToken, TokenTypeHintAccessToken)
+	require.NoError(t, err)
+	assert.True(t, info.Active)
+	assert.Equal(t, TokenTypeHintRefreshToken, info.TokenType)
+	assert.Equal(t, "rp", info.ClientID)
+	assert.Equal(t, "user-123", info.Sub)
+
+	// Only the client the token was issued to may revoke it.
+	err = adapter.RevokeToken(ctx, tokens.AccessToken, "", "other")
+	var appErr *types.Error
+	if assert.ErrorAs(t, err, &appErr) {
+		assert.Equal(t, types.ErrUnauthorizedClient.Code, appErr.Code)
+	}
+
+	require.NoError(t, adapter.RevokeToken(ctx, tokens.AccessToken, "", "rp"))
+	require.NoError(t, adapter.RevokeToken(ctx, tokens.RefreshToken, TokenTypeHintRefreshToken, "rp"))
+	for _, token := range []string{tokens.AccessToken, tokens.RefreshToken} {
+		info, err = adapter.IntrospectToken(ctx, token, "")
+		require.NoError(t, err)
+		assert.Equal(t, &types.TokenIntrospection{Active: false}, info)
+	}
+
+	// Unknown tokens are inactive and revoking them succeeds.
+	info, err = adapter.IntrospectToken(ctx, "not-a-token", "")
+	require.NoError(t, err)
+	assert.False(t, info.Active)
+	assert.NoError(t, adapter.RevokeToken(ctx, "not-a-token", "", "rp"))
+}
+
+func TestOAuthAdapter_RevokingRotatedTokenRevokesFamily(t *testing.T) {
+	ctx := context.Background()
+	adapter := newIntrospectionAdapter(t, map[string]*types.Application{
+		"rp": {ClientType: types.ClientTypeConfidential, ProtocolConfig: map[string]interface{}{"client_secret": "s3cret"}},
+	})
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{ID: "user-123", Username: "alice"}
+	require.NoError(t, users.CreateUser(ctx, user))
+	adapter.userRepo = users
+	adapter.SetTokenFamilyRepository(redis.NewRedisTokenFamilyRepository(adapter.redis, RefreshTokenTTL))
+
+	first, err := adapter.generateTokens(ctx, user, "offline_access", "", "rp", nil, nil)
+	require.NoError(t, err)
+	second, err := adapter.HandleTokenRequest(ctx, &types.TokenRequest{GrantType: "refresh_token", RefreshToken: first.RefreshToken, ClientID: "rp", ClientSecret: "s3cret"})
+	require.NoError(t, err)
+
+	// The rotated token is no longer live, but revoking it still ends the chain.
+	err = adapter.RevokeToken(ctx, first.RefreshToken, TokenTypeHintRefreshToken, "other")
+	assert.Error(t, err)
+	require.NoError(t, adapter.RevokeToken(ctx, first.RefreshToken, TokenTypeHintRefreshToken, "rp"))
+
+	info, err := adapter.IntrospectToken(ctx, second.RefreshToken, TokenTypeHintRefreshToken)
+	require.NoError(t, err)
+	assert.False(t, info.Active)
+	_, err = adapter.HandleTokenRequest(ctx, &types.TokenRequest{GrantType: "refresh_token", RefreshToken: second.RefreshToken, ClientID: "rp", ClientSecret: "s3cret"})
+	assert.Error(t, err)
+}
+
+func TestClientKeys_JWKSURI(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "ES256", Use: "sig"}}})
+	require.NoError(t, err)
+	body := jwks
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	app := func(uri string) *types.Application {
+		return &types.Application{ProtocolConfig: map[string]interface{}{"jwks_uri": uri}}
+	}
+
+	_, err = clientKeys(ctx, app("http://keys.example.com/jwks"))
+	assert.Error(t, err, "jwks_uri must use https")
+
+	// The test server listens on a loopback address, which is not fetched.
+	_, err = clientKeys(ctx, app(server.URL))
+	assert.ErrorIs(t, err, utils.ErrNonPublicAddress)
+
+	original := clientHTTPClient
+	clientHTTPClient = server.Client()
+	defer func() { clientHTTPClient = original }()
+	keys, err := clientKeys(ctx, app(server.URL))
+	require.NoError(t, err)
+	assert.Len(t, keys.Key("k1"), 1)
+
+	body = append([]byte(`{"keys":[`), bytes.Repeat([]byte(" "), maxClientJWKSSize)...)
+	_, err = clientKeys(ctx, app(server.URL))
+	assert.Error(t, err, "oversized documents are not read")
+}
+
+func TestOAuthAdapter_AuthenticateClient(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "ES256", Use: "sig"}}})
+	require.NoError(t, err)
+
+	adapter := newIntrospectionAdapter(t, map[string]*types.Application{
+		"gateway": {ClientType: types.ClientTypeConfidential, ProtocolConfig: map[string]interface{}{"client_secret": "s3cret"}},
+		"spa":     {ClientType: types.ClientTypePublic, ProtocolConfig: map[string]interface{}{}},
+		"service": {ClientType: types.ClientTypeConfidential, ProtocolConfig: map[string]interface{}{"jwks": string(jwks)}},
+	})
+
+	client, err := adapter.AuthenticateClient(ctx, ClientCredentials{ClientID: "gateway", ClientSecret: "s3cret"})
+	require.NoError(t, err)
+	assert.Equal(t, "gateway", client.ID)
+	assert.False(t, client.IsPublic())
+
+	_, err = adapter.AuthenticateClient(ctx, ClientCredentials{ClientID: "gateway", ClientSecret: "wrong"})
+	assert.Error(t, err)
+
+	client, err = adapter.AuthenticateClient(ctx, ClientCredentials{ClientID: "spa"})
+	require.NoError(t, err)
+	assert.True(t, client.IsPublic())
+
+	assertion := func(aud string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss": "service",
+			"sub": "service",
+			"aud": aud,
+			"jti": utils.GenerateUUID(),
+			"exp": time.Now().Add(time.Minute).Unix(),
+		})
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	signed := assertion("https://op.example.com/oauth/token")
+	creds := ClientCredentials{ClientAssertionType: ClientAssertionTypeJWTBearer, ClientAssertion: signed}
+	client, err = adapter.AuthenticateClient(ctx, creds)
+	require.NoError(t, err)
+	assert.Equal(t, "service", client.ID)
+
+	_, err = adapter.AuthenticateClient(ctx, creds)
+	assert.Error(t, err, "assertions cannot be replayed")
+
+	_, err = adapter.AuthenticateClient(ctx, ClientCredentials{ClientAssertionType: ClientAssertionTypeJWTBearer, ClientAssertion: assertion("https://other.example.com")})
+	assert.Error(t, err, "assertions must be addressed to this server")
+
+	_, err = adapter.AuthenticateClient(ctx, ClientCredentials{ClientID: "gateway", ClientAssertionType: ClientAssertionTypeJWTBearer, ClientAssertion: assertion("https://op.example.com")})
+	assert.Error(t, err, "client_id must match the assertion issuer")
+}
+
+func TestOAuthAdapter_RegisteredGrantTypes(t *testing.T) {
+	ctx := context.Background()
+	adapter := newIntrospectionAdapter(t, map[string]*types.Application{
+		"web": {ClientType: types.ClientTypeConfidential, ProtocolConfig: map[string]interface{}{
+			"client_secret": "s3cret",
+			"grant_types":   []interface{}{"authorization_code"},
+		}},
+		"legacy": {ClientType: types.ClientTypeConfidential, ProtocolConfig: map[string]interface{}{"client_secret": "s3cret"}},
+	})
+
+	_, err := adapter.HandleTokenRequest(ctx, &types.TokenRequest{GrantType: "client_credentials", ClientID: "web", ClientSecret: "s3cret"})
+	var appErr *types.Error
+	if assert.ErrorAs(t, err, &appErr) {
+		assert.Equal(t, types.ErrUnauthorizedClient.Code, appErr.Code)
+	}
+
+	// Clients without registered grant types may use any grant.
+	_, err = adapter.HandleTokenRequest(ctx, &types.TokenRequest{GrantType: "client_credentials", ClientID: "legacy", ClientSecret: "s3cret"})
+	assert.NoError(t, err)
+}
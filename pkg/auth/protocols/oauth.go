@@ -5,12 +5,15 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/prometheus/client_golang/prometheus"
+	goredis "github.com/redis/go-redis/v9"
 	"github.com/turtacn/QuantaID/internal/domain/auth"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/plugins"
 	"github.com/turtacn/QuantaID/pkg/types"
@@ -18,6 +21,10 @@ import (
 	"go.uber.org/zap"
 )
 
+// RefreshTokenTTL is the lifetime of an issued refresh token. Rotation issues
+// a new token with a fresh lifetime.
+const RefreshTokenTTL = 7 * 24 * time.Hour
+
 // OAuthAdapter implements the IProtocolAdapter for OAuth 2.1.
 type OAuthAdapter struct {
 	plugins.BasePlugin
@@ -26,7 +33,24 @@ type OAuthAdapter struct {
 	appRepo     types.ApplicationRepository
 	userRepo    identity.UserRepository
 	jwtSecret   []byte
+	crypto      *utils.CryptoManager
 	oidcAdapter *OIDCAdapter
+	tokenRepo   auth.TokenRepository
+	families    auth.TokenFamilyRepository
+	sessions    SessionRevoker
+	auditor     RefreshTokenAuditor
+	deviceFlow  *oauth.DeviceFlowHandler
+}
+
+// SessionRevoker ends login sessions. It is satisfied by *redis.SessionManager.
+type SessionRevoker interface {
+	RevokeSession(ctx context.Context, userID, sessionID string) error
+}
+
+// RefreshTokenAuditor records refresh token reuse, which indicates that a
+// refresh token has leaked.
+type RefreshTokenAuditor interface {
+	RecordRefreshTokenReuse(ctx context.Context, userID, clientID, familyID, sessionID string)
 }
 
 // NewOAuthAdapter is the factory function for this plugin.
@@ -55,13 +79,13 @@ func (a *OAuthAdapter) Initialize(ctx context.Context, config types.ConnectorCon
 	return nil
 }
 
-// HandleAuthRequest processes an incoming OAuth 2.1 authentication request.
-func (a *OAuthAdapter) HandleAuthRequest(ctx context.Context, request *types.AuthRequest) (*types.AuthResponse, error) {
+// ValidateAuthRequest checks an authorization request against the registered
+// client before any user interaction takes place. Errors returned here must be
+// shown to the user rather than redirected, since the redirect_uri is untrusted.
+func (a *OAuthAdapter) ValidateAuthRequest(ctx context.Context, oauthRequest map[string]string) (*types.Application, error) {
 	if a.appRepo == nil {
-		panic("OAuthAdapter.appRepo is nil in HandleAuthRequest")
+		panic("OAuthAdapter.appRepo is nil in ValidateAuthRequest")
 	}
-	oauthRequest := request.Credentials
-	a.logger.Info(ctx, "handling auth request", zap.Any("request", oauthRequest))
 	if oauthRequest["response_type"] != "code" {
 		return nil, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "unsupported response_type"})
 	}
@@ -71,7 +95,7 @@ func (a *OAuthAdapter) HandleAuthRequest(ctx context.Context, request *types.Aut
 		return nil, types.ErrInvalidClient.WithCause(err)
 	}
 
-	redirectURIs, ok := app.ProtocolConfig["redirect_uris"].([]string)
+	redirectURIs, ok := RedirectURIs(app)
 	if !ok {
 		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "invalid client configuration"})
 	}
@@ -92,6 +116,45 @@ func (a *OAuthAdapter) HandleAuthRequest(ctx context.Context, request *types.Aut
 			return nil, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "public clients must use pkce"})
 		}
 	}
+	// The plain method would send the verifier itself through the browser.
+	if oauthRequest["code_challenge"] != "" && oauthRequest["code_challenge_method"] != "S256" {
+		return nil, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "code_challenge_method must be S256"})
+	}
+	return app, nil
+}
+
+// RedirectURIs returns the redirect URIs registered for an application. The
+// list may be stored as []string or, once round-tripped through JSON, []interface{}.
+func RedirectURIs(app *types.Application) ([]string, bool) {
+	switch v := app.ProtocolConfig["redirect_uris"].(type) {
+	case []string:
+		return v, true
+	case []interface{}:
+		uris := make([]string, 0, len(v))
+		for _, u := range v {
+			s, ok := u.(string)
+			if !ok {
+				return nil, false
+			}
+			uris = append(uris, s)
+		}
+		return uris, true
+	default:
+		return nil, false
+	}
+}
+
+// HandleAuthRequest processes an incoming OAuth 2.1 authentication request.
+// The caller is responsible for authenticating the user and supplying user_id.
+func (a *OAuthAdapter) HandleAuthRequest(ctx context.Context, request *types.AuthRequest) (*types.AuthResponse, error) {
+	oauthRequest := request.Credentials
+	a.logger.Info(ctx, "handling auth request", zap.Any("request", oauthRequest))
+	if _, err := a.ValidateAuthRequest(ctx, oauthRequest); err != nil {
+		return nil, err
+	}
+	if oauthRequest["user_id"] == "" {
+		return nil, types.ErrAccessDenied.WithDetails(map[string]string{"error": "user is not authenticated"})
+	}
 
 	code := generateRandomString(32)
 	authCodeData := map[string]interface{}{
@@ -103,6 +166,9 @@ func (a *OAuthAdapter) HandleAuthRequest(ctx context.Context, request *types.Aut
 		"scope":            oauthRequest["scope"],
 		"nonce":            oauthRequest["nonce"],
 	}
+	if authn := authenticationFromCredentials(oauthRequest); authn != nil {
+		authCodeData["authentication"] = authn.data()
+	}
 	authCodeJSON, _ := json.Marshal(authCodeData)
 
 	if err := a.redis.Set(ctx, "authcode:"+code, authCodeJSON, 10*time.Minute); err != nil {
@@ -125,26 +191,49 @@ func (a *OAuthAdapter) HandleTokenRequest(ctx context.Context, request *types.To
 		return a.handleRefreshToken(ctx, request)
 	case "client_credentials":
 		return a.handleClientCredentials(ctx, request)
+	case oauth.DeviceCodeGrantType:
+		if a.deviceFlow == nil {
+			return nil, types.ErrUnsupportedGrantType
+		}
+		return a.handleDeviceCode(ctx, request)
 	default:
 		return nil, types.ErrUnsupportedGrantType
 	}
 }
 
+// handleAuthorizationCode redeems an authorization code. The code is claimed
+// with GETDEL before any check can fail, so it is single use even when
+// several requests present it at once.
 func (a *OAuthAdapter) handleAuthorizationCode(ctx context.Context, request *types.TokenRequest) (*types.TokenResponse, error) {
-	val, err := a.redis.Get(ctx, "authcode:"+request.Code)
+	val, err := a.redis.Client().GetDel(ctx, "authcode:"+request.Code).Result()
 	if err != nil {
-		return nil, types.ErrInvalidGrant.WithCause(err)
+		if errors.Is(err, goredis.Nil) {
+			return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "invalid or already used authorization code"})
+		}
+		return nil, types.ErrInternal.WithCause(err)
 	}
 
 	var authCodeData map[string]interface{}
-	json.Unmarshal([]byte(val), &authCodeData)
+	if err := json.Unmarshal([]byte(val), &authCodeData); err != nil {
+		return nil, types.ErrInvalidGrant.WithCause(err)
+	}
 
-	if !auth.VerifyPKCE(request.CodeVerifier, authCodeData["code_challenge"].(string), authCodeData["challenge_method"].(string)) {
-		return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "pkce verification failed"})
+	client, err := a.authenticateForGrant(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	clientID, _ := authCodeData["client_id"].(string)
+	if client.ID != clientID {
+		return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "code was issued to another client"})
+	}
+	if redirectURI, _ := authCodeData["redirect_uri"].(string); request.RedirectURI != redirectURI {
+		return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "redirect_uri mismatch"})
 	}
 
-	if err := a.redis.Del(ctx, "authcode:"+request.Code); err != nil {
-		a.logger.Error(ctx, "failed to delete auth code", zap.Error(err))
+	codeChallenge, _ := authCodeData["code_challenge"].(string)
+	challengeMethod, _ := authCodeData["challenge_method"].(string)
+	if codeChallenge != "" && !auth.VerifyPKCE(request.CodeVerifier, codeChallenge, challengeMethod) {
+		return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "pkce verification failed"})
 	}
 
 	user, err := a.userRepo.GetUserByID(ctx, authCodeData["user_id"].(string))
@@ -152,69 +241,183 @@ func (a *OAuthAdapter) handleAuthorizationCode(ctx context.Context, request *typ
 		return nil, types.ErrInternal.WithCause(err)
 	}
 
-	return a.generateTokens(ctx, user, authCodeData["scope"].(string), authCodeData["nonce"].(string), authCodeData["client_id"].(string))
+	scope, _ := authCodeData["scope"].(string)
+	nonce, _ := authCodeData["nonce"].(string)
+	return a.generateTokens(ctx, user, scope, nonce, clientID, authenticationFromData(authCodeData["authentication"]), nil)
 }
 
+// handleRefreshToken rotates a refresh token. When token families are
+// configured, presenting a token that has already been rotated revokes the
+// whole family and the login session it came from.
+//
+// The token is claimed with GETDEL and the family rotated with a conditional
+// update, so of several concurrent requests with the same token only one
+// gets new tokens.
 func (a *OAuthAdapter) handleRefreshToken(ctx context.Context, request *types.TokenRequest) (*types.TokenResponse, error) {
-	val, err := a.redis.Get(ctx, "refresh_token:"+request.RefreshToken)
+	client, err := a.authenticateForGrant(ctx, request)
 	if err != nil {
-		return nil, types.ErrInvalidGrant.WithCause(err)
+		return nil, err
 	}
+	tokenHash := auth.HashRefreshToken(request.RefreshToken)
 
-	var tokenData map[string]interface{}
-	json.Unmarshal([]byte(val), &tokenData)
+	var family *types.TokenFamily
+	if a.families != nil {
+		family, err = a.families.GetFamilyByToken(ctx, tokenHash)
+		if err != nil && !errors.Is(err, types.ErrNotFound) {
+			return nil, types.ErrInternal.WithCause(err)
+		}
+		if family != nil {
+			if family.RevokedAt != nil {
+				return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "refresh token has been revoked"})
+			}
+			if family.CurrentToken != tokenHash {
+				a.revokeReusedFamily(ctx, family)
+				return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "refresh token has already been used"})
+			}
+		}
+	}
 
-	user, err := a.userRepo.GetUserByID(ctx, tokenData["user_id"].(string))
+	tokenData, ok := a.refreshTokenData(ctx, request.RefreshToken)
+	if !ok {
+		return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "invalid refresh token"})
+	}
+	clientID, _ := tokenData["client_id"].(string)
+	if clientID != client.ID {
+		return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "refresh token was issued to another client"})
+	}
+	userID, _ := tokenData["user_id"].(string)
+	user, err := a.userRepo.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, types.ErrInternal.WithCause(err)
 	}
 
-	if err := a.redis.Del(ctx, "refresh_token:"+request.RefreshToken); err != nil {
-		a.logger.Error(ctx, "failed to delete refresh token", zap.Error(err))
+	// Claim the token. Only the request that deletes it may rotate it.
+	if _, err := a.redis.Client().GetDel(ctx, refreshTokenKey(tokenHash)).Result(); err != nil {
+		if errors.Is(err, goredis.Nil) {
+			return nil, types.ErrInvalidGrant.WithDetails(map[string]string{"error": "refresh token has already been used"})
+		}
+		return nil, types.ErrInternal.WithCause(err)
 	}
 
-	return a.generateTokens(ctx, user, tokenData["scope"].(string), "", tokenData["client_id"].(string))
+	scope, _ := tokenData["scope"].(string)
+	return a.generateTokens(ctx, user, scope, "", clientID, authenticationFromData(tokenData["authentication"]), family)
+}
+
+// refreshTokenKey returns the Redis key of the data stored for a refresh
+// token, by the token's hash.
+func refreshTokenKey(tokenHash string) string {
+	return "refresh_token:" + tokenHash
+}
+
+// revokeReusedFamily responds to reuse of a rotated refresh token. Either the
+// client or an attacker holds a stolen token, and there is no telling which,
+// so the family's live token and its login session are revoked.
+func (a *OAuthAdapter) revokeReusedFamily(ctx context.Context, family *types.TokenFamily) {
+	a.logger.Warn(ctx, "refresh token reuse detected",
+		zap.String("family_id", family.FamilyID),
+		zap.String("user_id", family.UserID),
+		zap.String("client_id", family.ClientID),
+	)
+	if err := a.families.RevokeFamily(ctx, family.FamilyID); err != nil {
+		a.logger.Error(ctx, "failed to revoke token family", zap.Error(err), zap.String("family_id", family.FamilyID))
+	}
+	if err := a.redis.Del(ctx, refreshTokenKey(family.CurrentToken)); err != nil {
+		a.logger.Error(ctx, "failed to delete refresh token", zap.Error(err))
+	}
+	if family.SessionID != "" && a.sessions != nil {
+		if err := a.sessions.RevokeSession(ctx, family.UserID, family.SessionID); err != nil {
+			a.logger.Error(ctx, "failed to revoke session", zap.Error(err), zap.String("session_id", family.SessionID))
+		}
+	}
+	if a.auditor != nil {
+		a.auditor.RecordRefreshTokenReuse(ctx, family.UserID, family.ClientID, family.FamilyID, family.SessionID)
+	}
 }
 
 func (a *OAuthAdapter) handleClientCredentials(ctx context.Context, request *types.TokenRequest) (*types.TokenResponse, error) {
-	app, err := a.appRepo.GetApplicationByClientID(ctx, request.ClientID)
+	client, err := a.authenticateForGrant(ctx, request)
 	if err != nil {
-		return nil, types.ErrInvalidClient.WithCause(err)
+		return nil, err
+	}
+	if client.IsPublic() {
+		return nil, types.ErrUnauthorizedClient.WithDetails(map[string]string{"error": "public clients cannot use client_credentials"})
 	}
 
-	clientSecret, ok := app.ProtocolConfig["client_secret"].(string)
-	if !ok {
-		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "invalid client configuration"})
+	return a.generateTokens(ctx, nil, "", "", client.ID, nil, nil)
+}
+
+// handleDeviceCode redeems a device code once the user has approved it on the
+// verification page (RFC 8628 section 3.4).
+func (a *OAuthAdapter) handleDeviceCode(ctx context.Context, request *types.TokenRequest) (*types.TokenResponse, error) {
+	if request.DeviceCode == "" {
+		return nil, types.ErrInvalidRequest.WithDetails(map[string]string{"error": "device_code is required"})
 	}
-	if clientSecret != request.ClientSecret {
-		return nil, types.ErrInvalidClient.WithDetails(map[string]string{"error": "invalid client_secret"})
+	client, err := a.authenticateForGrant(ctx, request)
+	if err != nil {
+		return nil, err
 	}
 
-	return a.generateTokens(ctx, nil, "", "", request.ClientID)
+	record, err := a.deviceFlow.PollDeviceCode(ctx, request.DeviceCode, client.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := a.userRepo.GetUserByID(ctx, record.UserID)
+	if err != nil {
+		return nil, types.ErrInvalidGrant.WithCause(err)
+	}
+
+	var authn *AuthenticationContext
+	if !record.AuthTime.IsZero() || record.SessionID != "" {
+		authn = &AuthenticationContext{AuthTime: record.AuthTime, SessionID: record.SessionID}
+	}
+	return a.generateTokens(ctx, user, record.Scope, "", client.ID, authn, nil)
+}
+
+// authenticateForGrant authenticates the client of a token request and checks
+// that the grant is among the client's registered grant_types, if it has any.
+func (a *OAuthAdapter) authenticateForGrant(ctx context.Context, request *types.TokenRequest) (*AuthenticatedClient, error) {
+	client, err := a.AuthenticateClient(ctx, tokenRequestCredentials(request))
+	if err != nil {
+		return nil, err
+	}
+	if !client.AllowsGrantType(request.GrantType) {
+		return nil, types.ErrUnauthorizedClient.WithDetails(map[string]string{"error": "client is not registered for grant type " + request.GrantType})
+	}
+	return client, nil
 }
 
-func (a *OAuthAdapter) generateTokens(ctx context.Context, user *types.User, scope, nonce, clientID string) (*types.TokenResponse, error) {
-	accessToken, err := a.generateAccessToken(ctx, user, scope)
+// tokenRequestCredentials returns the client authentication parameters of a token request.
+func tokenRequestCredentials(request *types.TokenRequest) ClientCredentials {
+	return ClientCredentials{
+		ClientID:            request.ClientID,
+		ClientSecret:        request.ClientSecret,
+		ClientAssertionType: request.ClientAssertionType,
+		ClientAssertion:     request.ClientAssertion,
+	}
+}
+
+// generateTokens issues the token response. authn describes the user's login
+// and is carried into the ID token and any refreshed ID token. family is the
+// token family being rotated, or nil to start a new one.
+func (a *OAuthAdapter) generateTokens(ctx context.Context, user *types.User, scope, nonce, clientID string, authn *AuthenticationContext, family *types.TokenFamily) (*types.TokenResponse, error) {
+	accessToken, err := a.generateAccessToken(ctx, user, scope, clientID)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken := generateRandomString(64)
+	// Refresh tokens are only issued on behalf of a user.
+	refreshToken := ""
 	if user != nil {
-		refreshTokenData := map[string]interface{}{
-			"user_id":   user.ID,
-			"scope":     scope,
-			"client_id": clientID,
-		}
-		marshalledData, _ := json.Marshal(refreshTokenData)
-		if err := a.redis.Set(ctx, "refresh_token:"+refreshToken, marshalledData, 7*24*time.Hour); err != nil {
-			return nil, types.ErrInternal.WithCause(err)
+		refreshToken = generateRandomString(64)
+		if err := a.storeRefreshToken(ctx, refreshToken, user, scope, clientID, authn, family); err != nil {
+			return nil, err
 		}
 	}
 
 	idToken := ""
 	if user != nil && utils.ScopeContains(scope, "openid") {
-		idToken, err = a.oidcAdapter.generateIDToken(ctx, user, scope, nonce, clientID)
+		idToken, err = a.oidcAdapter.generateIDToken(ctx, user, scope, nonce, clientID, accessToken, authn)
 		if err != nil {
 			return nil, err
 		}
@@ -230,11 +433,61 @@ func (a *OAuthAdapter) generateTokens(ctx context.Context, user *types.User, sco
 	}, nil
 }
 
-func (a *OAuthAdapter) generateAccessToken(ctx context.Context, user *types.User, scope string) (string, error) {
+// storeRefreshToken records a new refresh token and, when token families are
+// configured, rotates family to it. Only the token's hash is stored.
+func (a *OAuthAdapter) storeRefreshToken(ctx context.Context, refreshToken string, user *types.User, scope, clientID string, authn *AuthenticationContext, family *types.TokenFamily) error {
+	now := time.Now()
+	tokenHash := auth.HashRefreshToken(refreshToken)
+	refreshTokenData := map[string]interface{}{
+		"user_id":    user.ID,
+		"scope":      scope,
+		"client_id":  clientID,
+		"issued_at":  now.Unix(),
+		"expires_at": now.Add(RefreshTokenTTL).Unix(),
+	}
+	if authn != nil {
+		refreshTokenData["authentication"] = authn.data()
+	}
+
+	if a.families != nil {
+		if family == nil {
+			family = &types.TokenFamily{
+				FamilyID:      utils.GenerateUUID(),
+				OriginalToken: tokenHash,
+				CurrentToken:  tokenHash,
+				IssuedTokens:  []string{tokenHash},
+				UserID:        user.ID,
+				ClientID:      clientID,
+				CreatedAt:     now.UTC(),
+			}
+			if authn != nil {
+				family.SessionID = authn.SessionID
+			}
+			if err := a.families.CreateFamily(ctx, family); err != nil {
+				return types.ErrInternal.WithCause(err)
+			}
+		} else if err := a.families.RotateFamily(ctx, family.FamilyID, family.CurrentToken, tokenHash); err != nil {
+			if errors.Is(err, types.ErrConflict) {
+				return types.ErrInvalidGrant.WithDetails(map[string]string{"error": "refresh token has already been used"})
+			}
+			return types.ErrInternal.WithCause(err)
+		}
+		refreshTokenData["family_id"] = family.FamilyID
+	}
+
+	marshalledData, _ := json.Marshal(refreshTokenData)
+	if err := a.redis.Set(ctx, refreshTokenKey(tokenHash), marshalledData, RefreshTokenTTL); err != nil {
+		return types.ErrInternal.WithCause(err)
+	}
+	return nil
+}
+
+func (a *OAuthAdapter) generateAccessToken(ctx context.Context, user *types.User, scope, clientID string) (string, error) {
 	claims := jwt.MapClaims{
-		"exp":   time.Now().Add(time.Hour * 1).Unix(),
-		"iat":   time.Now().Unix(),
-		"scope": scope,
+		"exp":       time.Now().Add(time.Hour * 1).Unix(),
+		"iat":       time.Now().Unix(),
+		"scope":     scope,
+		"client_id": clientID,
 	}
 	if user != nil {
 		claims["sub"] = user.ID
@@ -242,13 +495,19 @@ func (a *OAuthAdapter) generateAccessToken(ctx context.Context, user *types.User
 
 	if utils.ScopeContains(scope, "email") {
 		claims["email"] = user.Email
-		claims["email_verified"] = user.Status == types.UserStatusActive
+		claims["email_verified"] = user.IsEmailVerified()
 	}
 
 	if utils.ScopeContains(scope, "profile") {
 		claims["name"] = user.Attributes["name"]
 	}
 
+	if a.crypto != nil {
+		claims["iss"] = a.crypto.Issuer()
+		claims["jti"] = a.crypto.GenerateUUID()
+		return a.crypto.SignJWT(map[string]interface{}(claims))
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(a.jwtSecret)
 }
@@ -262,6 +521,11 @@ func generateRandomString(n int) string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// SetLogger sets the logger for adapters built without Initialize.
+func (a *OAuthAdapter) SetLogger(logger utils.Logger) {
+	a.logger = logger
+}
+
 // SetUserRepo sets the user repository for the adapter.
 func (a *OAuthAdapter) SetUserRepo(repo identity.UserRepository) {
 	a.userRepo = repo
@@ -277,6 +541,41 @@ func (a *OAuthAdapter) SetRedis(redis redis.RedisClientInterface) {
 	a.redis = redis
 }
 
+// SetCryptoManager sets the crypto manager used to sign access tokens with the
+// server's signing key set instead of the adapter's shared secret.
+func (a *OAuthAdapter) SetCryptoManager(crypto *utils.CryptoManager) {
+	a.crypto = crypto
+}
+
+// SetTokenRepository sets the repository holding the access token deny list
+// used by introspection and revocation.
+func (a *OAuthAdapter) SetTokenRepository(repo auth.TokenRepository) {
+	a.tokenRepo = repo
+}
+
+// SetTokenFamilyRepository enables refresh token rotation with reuse
+// detection. Without it, refreshing still rotates the token but a replayed
+// token is only rejected, not treated as a compromise.
+func (a *OAuthAdapter) SetTokenFamilyRepository(repo auth.TokenFamilyRepository) {
+	a.families = repo
+}
+
+// SetSessionRevoker sets the session store used to end the login session of
+// a token family on reuse.
+func (a *OAuthAdapter) SetSessionRevoker(sessions SessionRevoker) {
+	a.sessions = sessions
+}
+
+// SetAuditor sets the recorder for refresh token reuse events.
+func (a *OAuthAdapter) SetAuditor(auditor RefreshTokenAuditor) {
+	a.auditor = auditor
+}
+
+// SetDeviceFlow enables the device authorization grant.
+func (a *OAuthAdapter) SetDeviceFlow(handler *oauth.DeviceFlowHandler) {
+	a.deviceFlow = handler
+}
+
 // SetOIDCAdapter sets the oidc adapter for the adapter.
 func (a *OAuthAdapter) SetOIDCAdapter(adapter *OIDCAdapter) {
 	a.oidcAdapter = adapter
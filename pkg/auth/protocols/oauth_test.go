@@ -2,13 +2,20 @@ package protocols
 
 import (
 	"context"
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/QuantaID/internal/domain/auth"
+	"github.com/turtacn/QuantaID/internal/storage/memory"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 	"go.uber.org/zap"
+	"sync"
 	"testing"
+	"time"
 )
 
 type MockApplicationRepository struct {
@@ -72,6 +79,7 @@ func TestOAuthAdapter_HandleAuthRequest(t *testing.T) {
 			"state":                 "test_state",
 			"code_challenge":        "test_code_challenge",
 			"code_challenge_method": "S256",
+			"user_id":               "user-123",
 		},
 	}
 
@@ -79,4 +87,365 @@ func TestOAuthAdapter_HandleAuthRequest(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, resp)
 	assert.NotEmpty(t, resp.Code)
+
+	// No code is minted without an authenticated user.
+	delete(req.Credentials, "user_id")
+	_, err = adapter.HandleAuthRequest(context.Background(), req)
+	assert.Error(t, err)
+
+	// The plain PKCE method offers no protection and is refused.
+	req.Credentials["user_id"] = "user-123"
+	req.Credentials["code_challenge_method"] = "plain"
+	_, err = adapter.HandleAuthRequest(context.Background(), req)
+	assert.Error(t, err)
+}
+
+func TestOAuthAdapter_AuthorizationCodeIssuesIDToken(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	crypto := utils.NewCryptoManager("test-secret")
+	crypto.SetIssuer("https://op.example.com")
+
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{
+		ID:            "user-123",
+		Username:      "alice",
+		Email:         types.EncryptedString("alice@example.com"),
+		EmailVerified: true,
+		Status:        types.UserStatusActive,
+		Attributes:    map[string]interface{}{"name": "Alice Example"},
+	}
+	assert.NoError(t, users.CreateUser(ctx, user))
+
+	mockAppRepo := new(MockApplicationRepository)
+	mockAppRepo.On("GetApplicationByClientID", mock.Anything, "rp").Return(&types.Application{
+		ClientType: types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{
+			"redirect_uris": []string{"https://rp.example.com/cb"},
+			"client_secret": "rp-secret",
+		},
+	}, nil)
+
+	oidc := NewOIDCAdapter(crypto)
+	oidc.SetUserRepo(users)
+	adapter := &OAuthAdapter{
+		logger:      utils.NewZapLoggerWrapper(zap.NewNop()),
+		appRepo:     mockAppRepo,
+		userRepo:    users,
+		redis:       redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})),
+		crypto:      crypto,
+		oidcAdapter: oidc,
+	}
+
+	authTime := time.Now().Add(-5 * time.Minute).Truncate(time.Second)
+	credentials := map[string]string{
+		"response_type": "code",
+		"client_id":     "rp",
+		"redirect_uri":  "https://rp.example.com/cb",
+		"scope":         "openid profile email",
+		"state":         "xyz",
+		"nonce":         "n-0S6",
+		"user_id":       user.ID,
+	}
+	authn := &AuthenticationContext{AuthTime: authTime, ACR: "urn:quantaid:acr:pwd", AMR: []string{"pwd"}}
+	for k, v := range authn.Credentials() {
+		credentials[k] = v
+	}
+	authResp, err := adapter.HandleAuthRequest(ctx, &types.AuthRequest{Credentials: credentials})
+	assert.NoError(t, err)
+
+	tokenReq := &types.TokenRequest{
+		GrantType:    "authorization_code",
+		Code:         authResp.Code,
+		RedirectURI:  "https://rp.example.com/cb",
+		ClientID:     "rp",
+		ClientSecret: "rp-secret",
+	}
+	tokenResp, err := adapter.HandleTokenRequest(ctx, tokenReq)
+	assert.NoError(t, err)
+
+	claims, err := crypto.ValidateJWT(tokenResp.IDToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://op.example.com", claims["iss"])
+	assert.Equal(t, "rp", claims["aud"])
+	assert.Equal(t, "n-0S6", claims["nonce"])
+	assert.Equal(t, float64(authTime.Unix()), claims["auth_time"])
+	assert.Equal(t, "urn:quantaid:acr:pwd", claims["acr"])
+	assert.Equal(t, []interface{}{"pwd"}, claims["amr"])
+	assert.Equal(t, tokenHash(tokenResp.AccessToken, "HS256"), claims["at_hash"])
+	assert.Equal(t, "Alice Example", claims["name"])
+	assert.Equal(t, "alice@example.com", claims["email"])
+	assert.Equal(t, true, claims["email_verified"])
+
+	userInfo, err := oidc.GetUserInfo(ctx, tokenResp.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, userInfo["sub"])
+	assert.Equal(t, "alice", userInfo["preferred_username"])
+	assert.NotContains(t, userInfo, "iat")
+
+	// Authorization codes are single use.
+	_, err = adapter.HandleTokenRequest(ctx, tokenReq)
+	assert.Error(t, err)
+}
+
+func TestOAuthAdapter_AuthorizationCodeRequiresClientAuthentication(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	mockAppRepo := new(MockApplicationRepository)
+	mockAppRepo.On("GetApplicationByClientID", mock.Anything, "rp").Return(&types.Application{
+		ClientType: types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{
+			"redirect_uris": []string{"https://rp.example.com/cb"},
+			"client_secret": "rp-secret",
+		},
+	}, nil)
+	mockAppRepo.On("GetApplicationByClientID", mock.Anything, "other").Return(&types.Application{
+		ClientType:     types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{"client_secret": "other-secret"},
+	}, nil)
+	adapter := &OAuthAdapter{
+		logger:  utils.NewZapLoggerWrapper(zap.NewNop()),
+		appRepo: mockAppRepo,
+		redis:   redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})),
+	}
+
+	for name, tc := range map[string]struct {
+		req  types.TokenRequest
+		code string
+	}{
+		"wrong secret":       {types.TokenRequest{ClientID: "rp", ClientSecret: "nope", RedirectURI: "https://rp.example.com/cb"}, types.ErrInvalidClient.Code},
+		"other client":       {types.TokenRequest{ClientID: "other", ClientSecret: "other-secret", RedirectURI: "https://rp.example.com/cb"}, types.ErrInvalidGrant.Code},
+		"wrong redirect_uri": {types.TokenRequest{ClientID: "rp", ClientSecret: "rp-secret", RedirectURI: "https://evil.example.com/cb"}, types.ErrInvalidGrant.Code},
+	} {
+		t.Run(name, func(t *testing.T) {
+			authResp, err := adapter.HandleAuthRequest(ctx, &types.AuthRequest{Credentials: map[string]string{
+				"response_type": "code",
+				"client_id":     "rp",
+				"redirect_uri":  "https://rp.example.com/cb",
+				"scope":         "openid",
+				"user_id":       "user-123",
+			}})
+			assert.NoError(t, err)
+
+			req := tc.req
+			req.GrantType = "authorization_code"
+			req.Code = authResp.Code
+			_, err = adapter.HandleTokenRequest(ctx, &req)
+			var appErr *types.Error
+			if assert.ErrorAs(t, err, &appErr) {
+				assert.Equal(t, tc.code, appErr.Code)
+			}
+		})
+	}
+}
+
+func TestOAuthAdapter_ConcurrentCodeRedemptionIssuesOnce(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{ID: "user-123", Username: "alice"}
+	require.NoError(t, users.CreateUser(ctx, user))
+	mockAppRepo := new(MockApplicationRepository)
+	mockAppRepo.On("GetApplicationByClientID", mock.Anything, "rp").Return(&types.Application{
+		ClientType: types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{
+			"redirect_uris": []string{"https://rp.example.com/cb"},
+			"client_secret": "rp-secret",
+		},
+	}, nil)
+	adapter := &OAuthAdapter{
+		logger:   utils.NewZapLoggerWrapper(zap.NewNop()),
+		appRepo:  mockAppRepo,
+		userRepo: users,
+		redis:    redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()})),
+		crypto:   utils.NewCryptoManager("test-secret"),
+	}
+
+	authResp, err := adapter.HandleAuthRequest(ctx, &types.AuthRequest{Credentials: map[string]string{
+		"response_type": "code",
+		"client_id":     "rp",
+		"redirect_uri":  "https://rp.example.com/cb",
+		"scope":         "profile",
+		"user_id":       user.ID,
+	}})
+	require.NoError(t, err)
+
+	const attempts = 32
+	var wg sync.WaitGroup
+	issued := make(chan *types.TokenResponse, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := adapter.HandleTokenRequest(ctx, &types.TokenRequest{
+				GrantType:    "authorization_code",
+				Code:         authResp.Code,
+				RedirectURI:  "https://rp.example.com/cb",
+				ClientID:     "rp",
+				ClientSecret: "rp-secret",
+			})
+			if err == nil {
+				issued <- resp
+			} else {
+				var appErr *types.Error
+				if assert.ErrorAs(t, err, &appErr) {
+					assert.Equal(t, types.ErrInvalidGrant.Code, appErr.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(issued)
+	assert.Len(t, issued, 1, "an authorization code may be redeemed only once")
+}
+
+type recordingSessionRevoker struct{ revoked []string }
+
+func (r *recordingSessionRevoker) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	r.revoked = append(r.revoked, userID+"/"+sessionID)
+	return nil
+}
+
+type recordingReuseAuditor struct{ families []string }
+
+func (r *recordingReuseAuditor) RecordRefreshTokenReuse(ctx context.Context, userID, clientID, familyID, sessionID string) {
+	r.families = append(r.families, familyID)
+}
+
+func TestOAuthAdapter_RefreshTokenRotationAndReuse(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{ID: "user-123", Username: "alice"}
+	assert.NoError(t, users.CreateUser(ctx, user))
+
+	mockAppRepo := new(MockApplicationRepository)
+	mockAppRepo.On("GetApplicationByClientID", mock.Anything, "rp").Return(&types.Application{
+		ClientType:     types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{"client_secret": "rp-secret"},
+	}, nil)
+	mockAppRepo.On("GetApplicationByClientID", mock.Anything, "other").Return(&types.Application{
+		ClientType:     types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{"client_secret": "other-secret"},
+	}, nil)
+
+	sessions := &recordingSessionRevoker{}
+	auditor := &recordingReuseAuditor{}
+	adapter := &OAuthAdapter{
+		logger:   utils.NewZapLoggerWrapper(zap.NewNop()),
+		appRepo:  mockAppRepo,
+		userRepo: users,
+		redis:    client,
+		crypto:   utils.NewCryptoManager("test-secret"),
+	}
+	adapter.SetTokenFamilyRepository(redis.NewRedisTokenFamilyRepository(client, RefreshTokenTTL))
+	adapter.SetSessionRevoker(sessions)
+	adapter.SetAuditor(auditor)
+
+	authn := &AuthenticationContext{AuthTime: time.Now(), SessionID: "session-1"}
+	first, err := adapter.generateTokens(ctx, user, "offline_access", "", "rp", authn, nil)
+	assert.NoError(t, err)
+
+	refresh := func(token, clientID, secret string) (*types.TokenResponse, error) {
+		return adapter.HandleTokenRequest(ctx, &types.TokenRequest{
+			GrantType:    "refresh_token",
+			RefreshToken: token,
+			ClientID:     clientID,
+			ClientSecret: secret,
+		})
+	}
+
+	// A refresh token cannot be used by another client.
+	_, err = refresh(first.RefreshToken, "other", "other-secret")
+	assert.Error(t, err)
+
+	second, err := refresh(first.RefreshToken, "rp", "rp-secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	third, err := refresh(second.RefreshToken, "rp", "rp-secret")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions.revoked)
+
+	// Replaying a rotated token revokes the family, including the live token,
+	// and ends the login session it came from.
+	_, err = refresh(first.RefreshToken, "rp", "rp-secret")
+	var appErr *types.Error
+	if assert.ErrorAs(t, err, &appErr) {
+		assert.Equal(t, types.ErrInvalidGrant.Code, appErr.Code)
+	}
+	_, err = refresh(third.RefreshToken, "rp", "rp-secret")
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{user.ID + "/session-1"}, sessions.revoked)
+	assert.Len(t, auditor.families, 1)
+}
+
+func TestOAuthAdapter_ConcurrentRefreshRotatesOnce(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewRedisClientWrapper(goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+
+	users := memory.NewIdentityMemoryRepository()
+	user := &types.User{ID: "user-123", Username: "alice"}
+	require.NoError(t, users.CreateUser(ctx, user))
+	mockAppRepo := new(MockApplicationRepository)
+	mockAppRepo.On("GetApplicationByClientID", mock.Anything, "rp").Return(&types.Application{
+		ClientType:     types.ClientTypeConfidential,
+		ProtocolConfig: map[string]interface{}{"client_secret": "rp-secret"},
+	}, nil)
+	adapter := &OAuthAdapter{
+		logger:   utils.NewZapLoggerWrapper(zap.NewNop()),
+		appRepo:  mockAppRepo,
+		userRepo: users,
+		redis:    client,
+		crypto:   utils.NewCryptoManager("test-secret"),
+	}
+	adapter.SetTokenFamilyRepository(redis.NewRedisTokenFamilyRepository(client, RefreshTokenTTL))
+
+	first, err := adapter.generateTokens(ctx, user, "offline_access", "", "rp", nil, nil)
+	require.NoError(t, err)
+
+	// Redis holds only the token's hash.
+	for _, key := range mr.Keys() {
+		assert.NotContains(t, key, first.RefreshToken)
+		assert.NotContains(t, stringValue(mr, key), first.RefreshToken)
+	}
+
+	const attempts = 8
+	var wg sync.WaitGroup
+	results := make(chan *types.TokenResponse, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := adapter.HandleTokenRequest(ctx, &types.TokenRequest{
+				GrantType:    "refresh_token",
+				RefreshToken: first.RefreshToken,
+				ClientID:     "rp",
+				ClientSecret: "rp-secret",
+			})
+			if err == nil {
+				results <- resp
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var issued []*types.TokenResponse
+	for resp := range results {
+		issued = append(issued, resp)
+	}
+	require.Len(t, issued, 1, "only one concurrent refresh may rotate the token")
+	family, err := adapter.families.GetFamilyByToken(ctx, auth.HashRefreshToken(issued[0].RefreshToken))
+	require.NoError(t, err)
+	assert.Equal(t, auth.HashRefreshToken(issued[0].RefreshToken), family.CurrentToken)
+}
+
+// stringValue returns the value of a string key, or "" for other types.
+func stringValue(mr *miniredis.Miniredis, key string) string {
+	value, _ := mr.Get(key)
+	return value
 }
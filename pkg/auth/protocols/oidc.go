@@ -3,10 +3,16 @@ package protocols
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/turtacn/QuantaID/internal/domain/identity"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
 	"github.com/turtacn/QuantaID/pkg/plugins"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
@@ -21,6 +27,79 @@ type OIDCAdapter struct {
 	privateKey   *rsa.PrivateKey
 	userRepo     identity.UserRepository
 	jwtSecret    []byte
+	crypto       *utils.CryptoManager
+	claimsMapper *oauth.ClaimsMapper
+}
+
+// AuthenticationContext describes when and how the end-user authenticated.
+// It is reported in the ID token as the auth_time, acr and amr claims.
+// SessionID links the tokens issued from it to the login session.
+type AuthenticationContext struct {
+	AuthTime  time.Time
+	ACR       string
+	AMR       []string
+	SessionID string
+}
+
+// Credentials encodes the context as authorization request credentials.
+func (c *AuthenticationContext) Credentials() map[string]string {
+	return map[string]string{
+		"auth_time":  strconv.FormatInt(c.AuthTime.Unix(), 10),
+		"acr":        c.ACR,
+		"amr":        strings.Join(c.AMR, " "),
+		"session_id": c.SessionID,
+	}
+}
+
+// authenticationFromCredentials decodes the context written by Credentials.
+// It returns nil when the request carries no authentication time.
+func authenticationFromCredentials(credentials map[string]string) *AuthenticationContext {
+	authTime, err := strconv.ParseInt(credentials["auth_time"], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &AuthenticationContext{
+		AuthTime:  time.Unix(authTime, 0),
+		ACR:       credentials["acr"],
+		AMR:       strings.Fields(credentials["amr"]),
+		SessionID: credentials["session_id"],
+	}
+}
+
+// data returns the context in the form stored alongside authorization codes and refresh tokens.
+func (c *AuthenticationContext) data() map[string]interface{} {
+	if c == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"auth_time":  c.AuthTime.Unix(),
+		"acr":        c.ACR,
+		"amr":        c.AMR,
+		"session_id": c.SessionID,
+	}
+}
+
+// authenticationFromData decodes a context stored by data after a JSON round trip.
+func authenticationFromData(v interface{}) *AuthenticationContext {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	authTime, ok := m["auth_time"].(float64)
+	if !ok {
+		return nil
+	}
+	authn := &AuthenticationContext{AuthTime: time.Unix(int64(authTime), 0)}
+	authn.ACR, _ = m["acr"].(string)
+	authn.SessionID, _ = m["session_id"].(string)
+	if amr, ok := m["amr"].([]interface{}); ok {
+		for _, method := range amr {
+			if s, ok := method.(string); ok {
+				authn.AMR = append(authn.AMR, s)
+			}
+		}
+	}
+	return authn
 }
 
 // NewOIDCAdapter is the factory function for this plugin.
@@ -31,6 +110,8 @@ func NewOIDCAdapter(crypto *utils.CryptoManager) *OIDCAdapter {
 			PluginType: types.PluginTypeProtocolAdapter,
 		},
 		oauthAdapter: &OAuthAdapter{},
+		crypto:       crypto,
+		claimsMapper: oauth.NewClaimsMapper(oauth.DefaultMappingRules()),
 	}
 }
 
@@ -60,64 +141,137 @@ func (a *OIDCAdapter) HandleTokenRequest(ctx context.Context, request *types.Tok
 	return a.oauthAdapter.HandleTokenRequest(ctx, request)
 }
 
-func (a *OIDCAdapter) generateIDToken(ctx context.Context, user *types.User, scope, nonce, clientID string) (string, error) {
-	claims := jwt.MapClaims{
-		"iss":   "https://localhost:8080",
-		"sub":   user.ID,
-		"aud":   clientID,
-		"exp":   time.Now().Add(time.Hour * 1).Unix(),
-		"iat":   time.Now().Unix(),
-		"nonce": nonce,
+// generateIDToken issues an ID token for the user. The access token issued
+// alongside it is bound through the at_hash claim.
+func (a *OIDCAdapter) generateIDToken(ctx context.Context, user *types.User, scope, nonce, clientID, accessToken string, authn *AuthenticationContext) (string, error) {
+	claims, err := a.claimsMapper.MapClaims(ctx, user, strings.Fields(scope))
+	if err != nil {
+		return "", err
 	}
 
-	if utils.ScopeContains(scope, "email") {
-		claims["email"] = user.Email
-		claims["email_verified"] = user.Status == types.UserStatusActive
+	now := time.Now()
+	claims["iss"] = a.Issuer()
+	claims["sub"] = user.ID
+	claims["aud"] = clientID
+	claims["azp"] = clientID
+	claims["exp"] = now.Add(time.Hour * 1).Unix()
+	claims["iat"] = now.Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if authn != nil {
+		claims["auth_time"] = authn.AuthTime.Unix()
+		if authn.ACR != "" {
+			claims["acr"] = authn.ACR
+		}
+		if len(authn.AMR) > 0 {
+			claims["amr"] = authn.AMR
+		}
+	}
+	if accessToken != "" {
+		claims["at_hash"] = tokenHash(accessToken, a.SigningAlgorithm())
 	}
 
-	if utils.ScopeContains(scope, "profile") {
-		claims["name"] = user.Attributes["name"]
+	if a.crypto != nil && (a.usesKeySet() || a.privateKey == nil) {
+		return a.crypto.SignJWT(claims)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims(claims))
 	return token.SignedString(a.privateKey)
 }
 
+// tokenHash computes an at_hash value: the left half of the token's hash, using
+// the hash function of the ID token's signing algorithm.
+func tokenHash(token, alg string) string {
+	var sum []byte
+	if alg == utils.AlgEdDSA {
+		h := sha512.Sum512([]byte(token))
+		sum = h[:]
+	} else {
+		h := sha256.Sum256([]byte(token))
+		sum = h[:]
+	}
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// usesKeySet reports whether tokens are signed by the crypto manager's rotating key set.
+func (a *OIDCAdapter) usesKeySet() bool {
+	return a.crypto != nil && a.crypto.KeyManager() != nil
+}
+
+// SigningAlgorithm returns the algorithm ID tokens are currently signed with.
+func (a *OIDCAdapter) SigningAlgorithm() string {
+	if a.usesKeySet() {
+		if key, err := a.crypto.KeyManager().ActiveKey(); err == nil {
+			return key.Algorithm
+		}
+	}
+	if a.privateKey != nil || a.crypto == nil {
+		return utils.AlgRS256
+	}
+	return "HS256"
+}
+
+// Issuer returns the value of the "iss" claim in ID tokens.
+func (a *OIDCAdapter) Issuer() string {
+	if a.crypto != nil {
+		return a.crypto.Issuer()
+	}
+	return "https://localhost:8080"
+}
+
+// GetUserInfo returns the claims released for the access token's scopes, as
+// configured by the claims mapper.
 func (a *OIDCAdapter) GetUserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error) {
-	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
-		return a.jwtSecret, nil
-	})
-	if err != nil {
-		return nil, types.ErrInvalidToken.WithCause(err)
+	var claims jwt.MapClaims
+	if a.crypto != nil {
+		validated, err := a.crypto.ValidateJWT(accessToken)
+		if err != nil {
+			return nil, types.ErrInvalidToken.WithCause(err)
+		}
+		claims = jwt.MapClaims(validated)
+	} else {
+		token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
+			return a.jwtSecret, nil
+		})
+		if err != nil {
+			return nil, types.ErrInvalidToken.WithCause(err)
+		}
+
+		var ok bool
+		claims, ok = token.Claims.(jwt.MapClaims)
+		if !ok || !token.Valid {
+			return nil, types.ErrInvalidToken.WithDetails(map[string]string{"error": "invalid claims"})
+		}
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || !token.Valid {
-		return nil, types.ErrInvalidToken.WithDetails(map[string]string{"error": "invalid claims"})
+	userID, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+	if userID == "" || !utils.ScopeContains(scope, "openid") {
+		return nil, types.ErrInvalidToken.WithDetails(map[string]string{"error": "token was not issued for openid"})
 	}
 
-	userID := claims["sub"].(string)
 	user, err := a.userRepo.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, types.ErrUserNotFound.WithCause(err)
 	}
 
-	userInfo := map[string]interface{}{
-		"sub": user.ID,
-	}
-	if utils.ScopeContains(claims["scope"].(string), "profile") {
-		userInfo["name"] = claims["name"]
-	}
-	if utils.ScopeContains(claims["scope"].(string), "email") {
-		userInfo["email"] = claims["email"]
-		userInfo["email_verified"] = claims["email_verified"]
+	userInfo, err := a.claimsMapper.MapClaims(ctx, user, strings.Fields(scope))
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
 	}
-
+	delete(userInfo, "iat")
 	return userInfo, nil
 }
 
 // GetJWKS returns the JSON Web Key Set.
 func (a *OIDCAdapter) GetJWKS() jose.JSONWebKeySet {
+	if a.usesKeySet() {
+		return a.crypto.JWKS()
+	}
+	if a.privateKey == nil {
+		return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	}
 	return jose.JSONWebKeySet{
 		Keys: []jose.JSONWebKey{
 			{
@@ -135,6 +289,16 @@ func (a *OIDCAdapter) SetUserRepo(repo identity.UserRepository) {
 	a.userRepo = repo
 }
 
+// SetClaimsMapper sets the scope to claim rules used for ID tokens and userinfo.
+func (a *OIDCAdapter) SetClaimsMapper(mapper *oauth.ClaimsMapper) {
+	a.claimsMapper = mapper
+}
+
+// ClaimsMapper returns the scope to claim rules used for ID tokens and userinfo.
+func (a *OIDCAdapter) ClaimsMapper() *oauth.ClaimsMapper {
+	return a.claimsMapper
+}
+
 // SetPrivateKey sets the private key for the adapter.
 func (a *OIDCAdapter) SetPrivateKey(key *rsa.PrivateKey) {
 	a.privateKey = key
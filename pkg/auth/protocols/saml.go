@@ -2,15 +2,19 @@ package protocols
 
 import (
 	"context"
+	"net/url"
 	"github.com/turtacn/QuantaID/pkg/plugins"
 	"github.com/turtacn/QuantaID/pkg/types"
 	"github.com/turtacn/QuantaID/pkg/utils"
 )
 
-// SAMLAdapter implements the IProtocolAdapter for SAML 2.0.
+// SAMLAdapter implements the IProtocolAdapter for SAML 2.0. SAML SSO is a
+// browser flow served by the IdP's HTTP endpoints, so the adapter hands
+// requests over to the IdP's SSO URL, set as "sso_url" in its config.
 type SAMLAdapter struct {
 	plugins.BasePlugin
 	logger utils.Logger
+	ssoURL string
 }
 
 // NewSAMLAdapter is the factory function for this plugin.
@@ -26,6 +30,7 @@ func NewSAMLAdapter() plugins.IPlugin {
 // Initialize sets up the adapter.
 func (a *SAMLAdapter) Initialize(ctx context.Context, config types.ConnectorConfig, logger utils.Logger) error {
 	a.logger = logger
+	a.ssoURL, _ = config.Config["sso_url"].(string)
 	a.logger.Info(ctx, "Initializing SAML 2.0 Adapter")
 	return nil
 }
@@ -38,15 +43,25 @@ func (a *SAMLAdapter) HandleAuthRequest(ctx context.Context, request *types.Auth
 	}
 
 	a.logger.Info(ctx, "Handling SAML request")
-	return a.handleSSORequest(ctx, samlRequestData)
+	return a.handleSSORequest(ctx, samlRequestData, request.Credentials["RelayState"])
 }
 
-func (a *SAMLAdapter) handleSSORequest(ctx context.Context, samlRequestData string) (*types.AuthResponse, error) {
-	a.logger.Info(ctx, "Processing SAML SSO request")
-	return nil, types.ErrInternal.WithDetails(map[string]string{"status": "not implemented"})
-}
+// handleSSORequest redirects an HTTP-Redirect binding AuthnRequest to the IdP.
+func (a *SAMLAdapter) handleSSORequest(ctx context.Context, samlRequestData, relayState string) (*types.AuthResponse, error) {
+	if a.ssoURL == "" {
+		return nil, types.ErrInternal.WithDetails(map[string]string{"error": "SAML IdP is not configured"})
+	}
+	target, err := url.Parse(a.ssoURL)
+	if err != nil {
+		return nil, types.ErrInternal.WithCause(err)
+	}
+	query := target.Query()
+	query.Set("SAMLRequest", samlRequestData)
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	target.RawQuery = query.Encode()
 
-func (a *SAMLAdapter) buildSAMLAssertion(user *types.User) string {
-	return "<saml:Assertion>...</saml:Assertion>"
+	a.logger.Info(ctx, "Redirecting SAML SSO request to the IdP")
+	return &types.AuthResponse{NextStep: "redirect", RedirectURI: target.String()}, nil
 }
-
@@ -0,0 +1,29 @@
+package notification
+
+import (
+	"fmt"
+)
+
+// StaticManager is a Manager over a fixed set of notifiers, keyed by their type.
+type StaticManager struct {
+	notifiers map[string]Notifier
+}
+
+// NewManager creates a manager of the notifiers. A later notifier replaces an
+// earlier one of the same type.
+func NewManager(notifiers ...Notifier) *StaticManager {
+	m := &StaticManager{notifiers: make(map[string]Notifier)}
+	for _, n := range notifiers {
+		m.notifiers[n.Type()] = n
+	}
+	return m
+}
+
+// GetNotifier returns the notifier of a type, such as "email".
+func (m *StaticManager) GetNotifier(method string) (Notifier, error) {
+	n, ok := m.notifiers[method]
+	if !ok {
+		return nil, fmt.Errorf("no %s notifier configured", method)
+	}
+	return n, nil
+}
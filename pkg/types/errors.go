@@ -82,8 +82,12 @@ var (
 	ErrTokenExpired          = NewError("token_expired", "The provided token has expired", http.StatusUnauthorized, codes.Unauthenticated)
 	ErrMfaRequired           = NewError("mfa_required", "Multi-factor authentication is required", http.StatusUnauthorized, codes.Unauthenticated)
 	ErrMfaChallengeInvalid   = NewError("mfa_challenge_invalid", "The MFA challenge is invalid or has expired", http.StatusBadRequest, codes.InvalidArgument)
+	ErrMfaCodeInvalid        = NewError("mfa_code_invalid", "The MFA code is invalid", http.StatusUnauthorized, codes.Unauthenticated)
+	ErrStepUpRequired        = NewError("step_up_required", "A recent MFA verification is required for this action", http.StatusForbidden, codes.PermissionDenied)
 	ErrUserLocked            = NewError("user_locked", "The user account is locked", http.StatusForbidden, codes.PermissionDenied)
 	ErrUserDisabled          = NewError("user_disabled", "The user account is disabled", http.StatusForbidden, codes.PermissionDenied)
+	ErrPasswordPolicy        = NewError("password_policy_violation", "The password does not meet the password policy", http.StatusBadRequest, codes.InvalidArgument)
+	ErrPasswordExpired       = NewError("password_expired", "The password has expired and must be changed", http.StatusForbidden, codes.PermissionDenied)
 	ErrPluginLoadFailed      = NewError("plugin_load_failed", "Failed to load plugin", http.StatusInternalServerError, codes.Internal)
 	ErrPluginNotFound        = NewError("plugin_not_found", "The requested plugin was not found", http.StatusNotFound, codes.NotFound)
 	ErrPluginInitFailed      = NewError("plugin_init_failed", "Failed to initialize plugin", http.StatusInternalServerError, codes.Internal)
@@ -92,11 +96,17 @@ var (
 	ErrInvalidClient         = NewError("invalid_client", "Client authentication failed (e.g., unknown client, no client authentication included, or unsupported authentication method).", http.StatusUnauthorized, codes.Unauthenticated)
 	ErrInvalidGrant          = NewError("invalid_grant", "The provided authorization grant (e.g., authorization code, resource owner credentials) or refresh token is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client.", http.StatusBadRequest, codes.InvalidArgument)
 	ErrUnsupportedGrantType  = NewError("unsupported_grant_type", "The authorization grant type is not supported by the authorization server.", http.StatusBadRequest, codes.InvalidArgument)
+	ErrUnauthorizedClient    = NewError("unauthorized_client", "The authenticated client is not authorized to use this grant type or to act on this token.", http.StatusBadRequest, codes.PermissionDenied)
+	ErrInvalidRedirectURI    = NewError("invalid_redirect_uri", "The value of one or more redirection URIs is invalid.", http.StatusBadRequest, codes.InvalidArgument)
+	ErrInvalidClientMetadata = NewError("invalid_client_metadata", "The value of one of the client metadata fields is invalid.", http.StatusBadRequest, codes.InvalidArgument)
+	ErrInvalidSoftwareStatement    = NewError("invalid_software_statement", "The software statement presented is invalid.", http.StatusBadRequest, codes.InvalidArgument)
+	ErrUnapprovedSoftwareStatement = NewError("unapproved_software_statement", "The software statement presented is not approved for use by this server.", http.StatusBadRequest, codes.PermissionDenied)
 	ErrUserNotFound          = NewError("user_not_found", "The user was not found.", http.StatusNotFound, codes.NotFound)
 	ErrSessionExpired        = NewError("session_expired", "The user session has expired.", http.StatusUnauthorized, codes.Unauthenticated)
 	ErrDeviceMismatch        = NewError("device_mismatch", "The device fingerprint does not match the session.", http.StatusUnauthorized, codes.Unauthenticated)
 	ErrMaxSessionsExceeded   = NewError("max_sessions_exceeded", "The maximum number of concurrent sessions has been exceeded.", http.StatusForbidden, codes.PermissionDenied)
 	ErrAuthorizationPending  = NewError("authorization_pending", "The authorization request is still pending as the end-user has not yet completed the user interaction steps.", http.StatusBadRequest, codes.Unavailable)
+	ErrSlowDown              = NewError("slow_down", "The client is polling too quickly and should increase its polling interval.", http.StatusBadRequest, codes.ResourceExhausted)
 	ErrAccessDenied          = NewError("access_denied", "The resource owner or authorization server denied the request.", http.StatusForbidden, codes.PermissionDenied)
 	ErrExpiredToken          = NewError("expired_token", "The token has expired.", http.StatusBadRequest, codes.Unauthenticated)
 )
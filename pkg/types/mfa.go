@@ -19,6 +19,7 @@ type MFAFactor struct {
 	PhoneNumber  string         `gorm:"type:varchar(20)" json:"phone_number"`
 	BackupCodes  datatypes.JSON `gorm:"type:jsonb" json:"-"`
 	Metadata     datatypes.JSON `gorm:"type:jsonb" json:"metadata,omitempty"`
+	IsDefault    bool           `gorm:"not null;default:false" json:"is_default"`
 	LastUsedAt   *time.Time     `gorm:"type:timestamp" json:"last_used_at"`
 	CreatedAt    time.Time      `gorm:"autoCreateTime" json:"created_at"`
 	UpdatedAt    time.Time      `gorm:"autoUpdateTime" json:"updated_at"`
@@ -48,6 +49,9 @@ type VerifyMFARequest struct {
 	ChallengeID string `json:"challenge_id"`
 	Code        string `json:"code"`
 	UserID      string `json:"user_id"`
+	// Provider is the MFA provider the code is for. It defaults to the
+	// provider the challenge was issued with.
+	Provider string `json:"provider,omitempty"`
 }
 
 // MFAMethod represents an MFA method that is available to the user.
@@ -63,6 +67,8 @@ type MFAEnrollment struct {
 	Secret string `json:"secret"`
 	// URL is the provisioning URL for the QR code.
 	URL string `json:"url"`
+	// QRCode is the provisioning URL as a PNG QR code, in a data URL.
+	QRCode string `json:"qr_code,omitempty"`
 	// RecoveryCodes are the one-time codes the user can use if they lose their device.
 	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
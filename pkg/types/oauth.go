@@ -1,5 +1,10 @@
 package types
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // TokenRequest represents the request to the token endpoint.
 type TokenRequest struct {
 	GrantType    string `json:"grant_type"`
@@ -11,6 +16,11 @@ type TokenRequest struct {
 	RefreshToken string `json:"refresh_token"`
 	UserID       string `json:"user_id"`
 	Scope        string `json:"scope"`
+	// ClientAssertionType and ClientAssertion carry private_key_jwt client authentication.
+	ClientAssertionType string `json:"client_assertion_type"`
+	ClientAssertion     string `json:"client_assertion"`
+	// DeviceCode is redeemed by the device authorization grant.
+	DeviceCode string `json:"device_code"`
 }
 
 // TokenResponse represents the successful response from the token endpoint.
@@ -23,6 +33,35 @@ type TokenResponse struct {
 	Scope        string `json:"scope,omitempty"`
 }
 
+// TokenFamily represents a chain of rotated refresh tokens. Every refresh
+// replaces CurrentToken; presenting any other token of the family is reuse.
+// The tokens are held as hashes, never in plaintext.
+type TokenFamily struct {
+	FamilyID      string
+	OriginalToken string
+	CurrentToken  string
+	IssuedTokens  []string // All refresh tokens issued in this family.
+	UserID        string
+	ClientID      string
+	SessionID     string // The login session the family was issued from, if any.
+	CreatedAt     time.Time
+	RevokedAt     *time.Time
+}
+
+// TokenIntrospection represents the response from the token introspection
+// endpoint (RFC 7662). Only Active is set for inactive tokens.
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
 // UserInfo represents the user information returned by the UserInfo endpoint.
 type UserInfo struct {
 	Subject         string `json:"sub"`
@@ -47,22 +86,36 @@ type UserInfo struct {
 	UpdatedAt       int64  `json:"updated_at,omitempty"`
 }
 
-// Client represents an OAuth 2.0 client.
-type Client struct {
-	ID                      string   `json:"id"`
-	Secret                  string   `json:"secret"`
-	RedirectURIs            []string `json:"redirect_uris"`
-	GrantTypes              []string `json:"grant_types"`
-	ResponseTypes           []string `json:"response_types"`
-	ClientName              string   `json:"client_name"`
-	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+// ClientMetadata is the metadata a client registers with the server (RFC 7591
+// section 2). It is stored in the ProtocolConfig of the client's Application.
+type ClientMetadata struct {
+	RedirectURIs            []string        `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string        `json:"grant_types,omitempty"`
+	ResponseTypes           []string        `json:"response_types,omitempty"`
+	ClientName              string          `json:"client_name,omitempty"`
+	ClientURI               string          `json:"client_uri,omitempty"`
+	LogoURI                 string          `json:"logo_uri,omitempty"`
+	Scope                   string          `json:"scope,omitempty"`
+	Contacts                []string        `json:"contacts,omitempty"`
+	JWKSURI                 string          `json:"jwks_uri,omitempty"`
+	JWKS                    json.RawMessage `json:"jwks,omitempty"`
+	SoftwareID              string          `json:"software_id,omitempty"`
+	SoftwareVersion         string          `json:"software_version,omitempty"`
+	// SoftwareStatement is a signed JWT asserting metadata values, which take
+	// precedence over the plain values above.
+	SoftwareStatement string `json:"software_statement,omitempty"`
 }
 
-// ClientMetadata represents the metadata for a new client registration.
-type ClientMetadata struct {
-	RedirectURIs            []string `json:"redirect_uris"`
-	GrantTypes              []string `json:"grant_types"`
-	ResponseTypes           []string `json:"response_types"`
-	ClientName              string   `json:"client_name"`
-	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+// ClientInformation is the response of the registration endpoint and of the
+// client configuration endpoint (RFC 7591 section 3.2.1, RFC 7592 section 3).
+type ClientInformation struct {
+	ClientMetadata
+	ClientID         string `json:"client_id"`
+	ClientSecret     string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt int64  `json:"client_id_issued_at,omitempty"`
+	// ClientSecretExpiresAt is 0 when the secret does not expire.
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
 }
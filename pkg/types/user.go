@@ -13,6 +13,9 @@ type User struct {
 	Username string `json:"username" gorm:"uniqueIndex;not null"`
 	// Email is the user's email address, also used for communication and recovery.
 	Email EncryptedString `json:"email" gorm:"uniqueIndex"`
+	// EmailVerified records that the user proved control of Email, by a
+	// passwordless login or through an identity provider that vouches for it.
+	EmailVerified bool `json:"emailVerified" gorm:"not null;default:false"`
 	// Phone is the user's phone number.
 	Phone EncryptedString `json:"phone,omitempty" gorm:"index"`
 	// Password is the hashed password of the user. It is not exposed in API responses.
@@ -43,8 +46,15 @@ type User struct {
 
 // UserFilter defines the criteria for listing users.
 type UserFilter struct {
+	// Query matches usernames and email addresses containing it, ignoring case.
 	Query      string
 	Status     []UserStatus
+	// Usernames and Emails restrict the list to users with one of the given
+	// usernames or email addresses, compared case-insensitively.
+	Usernames  []string
+	Emails     []string
+	// GroupID restricts the list to members of a group.
+	GroupID    string
 	Page       int
 	PageSize   int
 	SortBy     string
@@ -108,6 +118,12 @@ type UserSession struct {
 	DeviceFingerprint string `json:"deviceFingerprint,omitempty"`
 	// LastRotatedAt is the timestamp when the session ID was last rotated.
 	LastRotatedAt time.Time `json:"lastRotatedAt"`
+	// AuthTime is when the user last actively authenticated. It survives session rotation.
+	AuthTime time.Time `json:"authTime"`
+	// AuthMethods lists the authentication methods used, as OpenID Connect amr values (e.g., "pwd", "otp").
+	AuthMethods []string `json:"authMethods,omitempty"`
+	// ACR is the authentication context class reference the login satisfied.
+	ACR string `json:"acr,omitempty"`
 }
 
 // UserLifecycleState defines the lifecycle state of a user, typically for provisioning workflows.
@@ -141,6 +157,17 @@ func (u *User) HasRole(roleName string) bool {
 	return false
 }
 
+// IsEmailVerified reports whether the user proved control of Email. Users
+// verified before the EmailVerified column existed carry the flag in
+// Attributes until migration 014 moves it into the column.
+func (u *User) IsEmailVerified() bool {
+	if u.EmailVerified {
+		return true
+	}
+	verified, _ := u.Attributes["email_verified"].(bool)
+	return verified
+}
+
 // SyncState represents the state of a sync operation.
 type SyncState struct {
 	ID            string    `json:"id" gorm:"primaryKey"`
@@ -7,6 +7,7 @@ import (
 	"time"
 	"github.com/spf13/viper"
 	"github.com/turtacn/QuantaID/internal/config"
+	"github.com/turtacn/QuantaID/internal/domain/oauth"
 	"github.com/turtacn/QuantaID/internal/storage/redis"
 	"github.com/turtacn/QuantaID/pkg/notification/smtp"
 	"go.uber.org/zap"
@@ -52,6 +53,104 @@ type SecurityConfig struct {
 	Risk              config.RiskConfig       `mapstructure:"adaptive_risk"`
 	RateLimit         RateLimitConfig         `mapstructure:"rate_limit"`
 	DeviceTrust       DeviceTrustConfig       `mapstructure:"device_trust"`
+	MFA               MFAChallengeConfig      `mapstructure:"mfa"`
+	Lockout           LockoutConfig           `mapstructure:"lockout"`
+	PasswordPolicy    PasswordPolicyConfig    `mapstructure:"password_policy"`
+	PasswordHashing   PasswordHashingConfig   `mapstructure:"password_hashing"`
+	Passwordless      PasswordlessConfig      `mapstructure:"passwordless"`
+	// ResponsePolicies are the security actions run on risky logins.
+	ResponsePolicies []config.ResponsePolicy `mapstructure:"response_policies"`
+}
+
+// PasswordlessConfig configures logins with a magic link or a code sent by
+// email. Messages are sent through the SMTP server of the notification config.
+type PasswordlessConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	TTL         time.Duration `mapstructure:"ttl"`
+	CodeLength  int           `mapstructure:"code_length"`
+	MaxAttempts int           `mapstructure:"max_attempts"`
+	SendLimit   int           `mapstructure:"send_limit"`
+	SourceLimit int           `mapstructure:"source_limit"`
+	SendWindow  time.Duration `mapstructure:"send_window"`
+	// LinkURL is where magic links point. Defaults to the JWT issuer +
+	// "/auth/passwordless", the confirmation page that completes the login.
+	LinkURL string `mapstructure:"link_url"`
+}
+
+// PasswordHashingConfig configures how passwords are hashed. Hashes in other
+// schemes, such as imported ones, are verified and replaced by hashes in the
+// configured scheme at the next successful login.
+type PasswordHashingConfig struct {
+	// Algorithm is "argon2id" (the default) or "bcrypt".
+	Algorithm  string       `mapstructure:"algorithm"`
+	BcryptCost int          `mapstructure:"bcrypt_cost"`
+	Argon2     Argon2Config `mapstructure:"argon2"`
+}
+
+// Argon2Config holds the cost parameters of Argon2id.
+type Argon2Config struct {
+	MemoryKiB   uint32 `mapstructure:"memory_kib"`
+	Iterations  uint32 `mapstructure:"iterations"`
+	Parallelism uint8  `mapstructure:"parallelism"`
+	SaltLength  uint32 `mapstructure:"salt_length"`
+	KeyLength   uint32 `mapstructure:"key_length"`
+}
+
+// PasswordPolicyConfig configures the policy passwords are validated against
+// when they are set. Tenant policies replace the default one; group policies
+// tighten whichever applies.
+type PasswordPolicyConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// BreachedHashesFile lists SHA-1 hashes of breached passwords, one per line.
+	BreachedHashesFile string                         `mapstructure:"breached_hashes_file"`
+	Default            PasswordPolicyRules            `mapstructure:"default"`
+	Tenants            map[string]PasswordPolicyRules `mapstructure:"tenants"`
+	Groups             map[string]PasswordPolicyRules `mapstructure:"groups"`
+}
+
+// PasswordPolicyRules are the rules of one password policy.
+type PasswordPolicyRules struct {
+	MinLength        int           `mapstructure:"min_length"`
+	RequireUppercase bool          `mapstructure:"require_uppercase"`
+	RequireLowercase bool          `mapstructure:"require_lowercase"`
+	RequireDigit     bool          `mapstructure:"require_digit"`
+	RequireSymbol    bool          `mapstructure:"require_symbol"`
+	MinStrength      int           `mapstructure:"min_strength"`
+	HistorySize      int           `mapstructure:"history_size"`
+	MaxAge           time.Duration `mapstructure:"max_age"`
+	CheckBreached    bool          `mapstructure:"check_breached"`
+}
+
+// LockoutConfig configures the lockout and throttling of failed logins.
+type LockoutConfig struct {
+	Enabled             bool          `mapstructure:"enabled"`
+	MaxFailures         int           `mapstructure:"max_failures"`
+	FailureWindow       time.Duration `mapstructure:"failure_window"`
+	LockoutDuration     time.Duration `mapstructure:"lockout_duration"`
+	ThrottleAfter       int           `mapstructure:"throttle_after"`
+	BaseDelay           time.Duration `mapstructure:"base_delay"`
+	MaxDelay            time.Duration `mapstructure:"max_delay"`
+	SourceMaxFailures   int           `mapstructure:"source_max_failures"`
+	SprayThreshold      int           `mapstructure:"spray_threshold"`
+	SourceBlockDuration time.Duration `mapstructure:"source_block_duration"`
+}
+
+// MFAChallengeConfig configures the MFA challenges of password logins.
+type MFAChallengeConfig struct {
+	ChallengeTTL time.Duration `mapstructure:"challenge_ttl"`
+	MaxAttempts  int           `mapstructure:"max_attempts"`
+	// StepUpTTL is how long a step-up verification allows users to remove
+	// factors and regenerate recovery codes.
+	StepUpTTL time.Duration `mapstructure:"step_up_ttl"`
+	Push      PushMFAConfig `mapstructure:"push"`
+}
+
+// PushMFAConfig configures push approvals with number matching. Until a
+// push service is integrated, notifications are posted to GatewayURL.
+type PushMFAConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	TTL        time.Duration `mapstructure:"ttl"`
+	GatewayURL string        `mapstructure:"gateway_url"`
 }
 
 type DeviceTrustConfig struct {
@@ -100,27 +199,191 @@ type WebAuthnConfig struct {
 	RPID          string `mapstructure:"rp_id"`
 	Origin        string `mapstructure:"origin"`
 	RPDisplayName string `mapstructure:"rp_display_name"`
+	// Attestation is the attestation conveyance asked of authenticators:
+	// "none" (the default), "indirect" or "direct".
+	Attestation string `mapstructure:"attestation"`
+	// AllowedAAGUIDs restricts registration to these authenticator models.
+	AllowedAAGUIDs []string `mapstructure:"allowed_aaguids"`
+}
+
+// LDAPConfig configures the LDAP server, which serves users and groups as a
+// directory and authenticates simple binds.
+type LDAPConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Address is the plain LDAP listener, which offers StartTLS when a
+	// certificate is configured. Empty leaves it out.
+	Address string `mapstructure:"address"`
+	// LDAPSAddress is the LDAP over TLS listener. Empty leaves it out.
+	LDAPSAddress string `mapstructure:"ldaps_address"`
+	BaseDN       string `mapstructure:"base_dn"`
+	// CertFile and KeyFile hold the PEM certificate of LDAPS and StartTLS.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	StartTLS bool   `mapstructure:"start_tls"`
+	// RequireTLS refuses binds with credentials on connections that are
+	// not protected by LDAPS or StartTLS.
+	RequireTLS bool          `mapstructure:"require_tls"`
+	SizeLimit  int           `mapstructure:"size_limit"`
+	TimeLimit  time.Duration `mapstructure:"time_limit"`
+	// Local serves the users and groups of QuantaID. Turned off with
+	// upstreams configured, the server only proxies the upstreams.
+	Local bool `mapstructure:"local"`
+	// Upstreams are directories served below a suffix of the tree, whose
+	// entries are bound to upstream.
+	Upstreams []LDAPUpstreamConfig `mapstructure:"upstreams"`
+}
+
+// LDAPUpstreamConfig configures an upstream directory, such as Active
+// Directory, proxied by the LDAP server.
+type LDAPUpstreamConfig struct {
+	Name string `mapstructure:"name"`
+	// URLs are the servers of the directory, in order of preference.
+	URLs         []string `mapstructure:"urls"`
+	BindDN       string   `mapstructure:"bind_dn"`
+	BindPassword string   `mapstructure:"bind_password"`
+	// BaseDN is the upstream entry served as Suffix in the tree.
+	BaseDN string `mapstructure:"base_dn"`
+	Suffix string `mapstructure:"suffix"`
+	// CacheTTL is how long search results are reused; 0 disables caching.
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	// CAFile verifies the certificates of ldaps:// servers instead of the
+	// system roots.
+	CAFile             string `mapstructure:"ca_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
 }
 
 type RADIUSConfig struct {
-	Enabled      bool          `mapstructure:"enabled"`
-	AuthPort     int           `mapstructure:"auth_port"`
-	AcctPort     int           `mapstructure:"acct_port"`
-	ReadTimeout  time.Duration `mapstructure:"read_timeout"`
-	WriteTimeout time.Duration `mapstructure:"write_timeout"`
-	WorkerCount  int           `mapstructure:"worker_count"`
-	Proxy        ProxyConfig   `mapstructure:"proxy"`
+	Enabled      bool            `mapstructure:"enabled"`
+	AuthPort     int             `mapstructure:"auth_port"`
+	AcctPort     int             `mapstructure:"acct_port"`
+	ReadTimeout  time.Duration   `mapstructure:"read_timeout"`
+	WriteTimeout time.Duration   `mapstructure:"write_timeout"`
+	WorkerCount  int             `mapstructure:"worker_count"`
+	Proxy        ProxyConfig     `mapstructure:"proxy"`
+	EAP          RADIUSEAPConfig `mapstructure:"eap"`
+	// Dictionaries are vendor dictionary files in the FreeRADIUS format,
+	// whose attributes authorization policies can set.
+	Dictionaries []string `mapstructure:"dictionaries"`
+	// DynamicAuthorization configures the Disconnect-Requests and
+	// CoA-Requests sent to the NAS of accounting sessions.
+	DynamicAuthorization RADIUSDynamicAuthConfig `mapstructure:"dynamic_authorization"`
+}
+
+// RADIUSDynamicAuthConfig configures dynamic authorization (RFC 5176).
+type RADIUSDynamicAuthConfig struct {
+	// Port is the port NAS clients receive the requests on.
+	Port    int           `mapstructure:"port"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// RetryCount is how many times a request is retransmitted to a NAS
+	// that does not answer.
+	RetryCount int `mapstructure:"retry_count"`
 }
 
+// RADIUSEAPConfig configures EAP authentication for 802.1X.
+type RADIUSEAPConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Methods are the EAP methods offered, in order of preference: "peap",
+	// "ttls" and "tls".
+	Methods  []string `mapstructure:"methods"`
+	CertFile string   `mapstructure:"cert_file"`
+	KeyFile  string   `mapstructure:"key_file"`
+	// CAFile holds the CAs that client certificates of EAP-TLS must chain to.
+	CAFile string `mapstructure:"ca_file"`
+	// CertificateUser selects the client certificate field that names the
+	// user in EAP-TLS: "common_name" or "email".
+	CertificateUser string        `mapstructure:"certificate_user"`
+	FragmentSize    int           `mapstructure:"fragment_size"`
+	SessionTimeout  time.Duration `mapstructure:"session_timeout"`
+}
+
+// ProxyConfig configures the proxying of RADIUS requests to upstream
+// servers by the realm of the user.
 type ProxyConfig struct {
-	Enabled         bool             `mapstructure:"enabled"`
-	UpstreamServers []UpstreamServer `mapstructure:"upstream_servers"`
+	Enabled bool                `mapstructure:"enabled"`
+	Pools   []RADIUSPoolConfig  `mapstructure:"pools"`
+	Realms  []RADIUSRealmConfig `mapstructure:"realms"`
+	// RetryCount is how many times a request is retransmitted to a server
+	// before failing over to the next server of the pool.
+	RetryCount int           `mapstructure:"retry_count"`
+	Timeout    time.Duration `mapstructure:"timeout"`
+	// StatusInterval is how often dead servers are probed with
+	// Status-Server.
+	StatusInterval time.Duration `mapstructure:"status_interval"`
+}
+
+// RADIUSPoolConfig configures a pool of upstream servers.
+type RADIUSPoolConfig struct {
+	Name    string           `mapstructure:"name"`
+	Servers []UpstreamServer `mapstructure:"servers"`
 }
 
 type UpstreamServer struct {
 	Address string `mapstructure:"address"`
-	Secret  string `mapstructure:"secret"`
-	Weight  int    `mapstructure:"weight"`
+	// AcctAddress defaults to the port after the one of Address.
+	AcctAddress string `mapstructure:"acct_address"`
+	Secret      string `mapstructure:"secret"`
+	Weight      int    `mapstructure:"weight"`
+}
+
+// RADIUSRealmConfig routes the users of a realm, user@realm or
+// realm\user, to a pool. The DEFAULT realm takes the other users.
+type RADIUSRealmConfig struct {
+	Name       string `mapstructure:"name"`
+	Pool       string `mapstructure:"pool"`
+	StripRealm bool   `mapstructure:"strip_realm"`
+}
+
+// OIDCConfig holds OpenID Provider settings.
+type OIDCConfig struct {
+	// ClaimsMapping maps scopes to the claims released in ID tokens and userinfo.
+	// The standard OpenID Connect scopes are used when it is empty.
+	ClaimsMapping []oauth.MappingRule `mapstructure:"claims_mapping"`
+	// TokenFamilyStore selects where refresh token families are kept for
+	// rotation and reuse detection: "redis" (the default) or "postgres".
+	TokenFamilyStore string `mapstructure:"token_family_store"`
+	// DeviceFlow configures the device authorization grant. The verification
+	// URI defaults to the issuer's /device page.
+	DeviceFlow oauth.DeviceFlowConfig `mapstructure:"device_flow"`
+	// Registration configures dynamic client registration (RFC 7591).
+	Registration oauth.ClientRegistryConfig `mapstructure:"registration"`
+}
+
+// SAMLConfig holds SAML 2.0 Identity Provider settings. Service providers
+// are the applications registered with the "saml" protocol.
+type SAMLConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// BaseURL is where the IdP endpoints are served; the entity ID is
+	// BaseURL + "/metadata". Defaults to the JWT issuer + "/saml".
+	BaseURL string `mapstructure:"base_url"`
+	// CertFile and KeyFile hold the PEM signing certificate and RSA key. A
+	// temporary pair is generated when they are empty.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// FederationConfig holds settings for signing in through upstream OIDC and
+// SAML identity providers, which are managed through the admin API.
+type FederationConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// BaseURL is where the federation endpoints are served: the OIDC redirect
+	// URI is BaseURL/<provider id>/callback and the SAML ACS is
+	// BaseURL/<provider id>/acs. Defaults to the JWT issuer + "/auth/federation".
+	BaseURL string `mapstructure:"base_url"`
+	// CertFile and KeyFile hold a PEM certificate and RSA key used to sign
+	// SAML AuthnRequests and decrypt assertions. Both are optional.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// JWTConfig holds configuration for token signing.
+type JWTConfig struct {
+	Secret           string        `mapstructure:"secret"`
+	Issuer           string        `mapstructure:"issuer"`
+	SigningAlgorithm string        `mapstructure:"signing_algorithm"` // "HS256", "RS256", "ES256" or "EdDSA"
+	KeySetFile       string        `mapstructure:"key_set_file"`      // Persisted key set for asymmetric algorithms
+	RotationInterval time.Duration `mapstructure:"rotation_interval"`
+	RetentionPeriod  time.Duration `mapstructure:"retention_period"` // How long retired keys stay in the JWKS
 }
 
 // Config holds all configuration for the application.
@@ -140,7 +403,12 @@ type Config struct {
 	MultiTenant  MultiTenantConfig  `mapstructure:"multitenant"`
 	Portal       PortalConfig       `mapstructure:"portal"`
 	Profile      ProfileConfig      `mapstructure:"profile"`
+	LDAP         LDAPConfig         `mapstructure:"ldap"`
 	RADIUS       RADIUSConfig       `mapstructure:"radius"`
+	JWT          JWTConfig          `mapstructure:"jwt"`
+	OIDC         OIDCConfig         `mapstructure:"oidc"`
+	SAML         SAMLConfig         `mapstructure:"saml"`
+	Federation   FederationConfig   `mapstructure:"federation"`
 }
 
 type ProfileConfig struct {
@@ -298,6 +566,23 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("opa.url", "http://localhost:8181/v1/data/quantaid/authz/allow")
 	v.SetDefault("portal.access_history_retention_days", 90)
 
+	// JWT signing defaults
+	v.SetDefault("jwt.issuer", "QuantaID")
+	v.SetDefault("jwt.signing_algorithm", "RS256")
+	v.SetDefault("jwt.key_set_file", "data/jwks.json")
+	v.SetDefault("jwt.rotation_interval", 30*24*time.Hour)
+	v.SetDefault("jwt.retention_period", 24*time.Hour)
+
+	// LDAP defaults
+	v.SetDefault("ldap.enabled", false)
+	v.SetDefault("ldap.address", ":389")
+	v.SetDefault("ldap.base_dn", "dc=quantaid,dc=local")
+	v.SetDefault("ldap.start_tls", true)
+	v.SetDefault("ldap.require_tls", false)
+	v.SetDefault("ldap.size_limit", 1000)
+	v.SetDefault("ldap.time_limit", "30s")
+	v.SetDefault("ldap.local", true)
+
 	// RADIUS defaults
 	v.SetDefault("radius.enabled", false)
 	v.SetDefault("radius.auth_port", 1812)
@@ -306,6 +591,17 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("radius.write_timeout", "5s")
 	v.SetDefault("radius.worker_count", 10)
 	v.SetDefault("radius.proxy.enabled", false)
+	v.SetDefault("radius.proxy.retry_count", 1)
+	v.SetDefault("radius.proxy.timeout", "3s")
+	v.SetDefault("radius.proxy.status_interval", "10s")
+	v.SetDefault("radius.eap.enabled", false)
+	v.SetDefault("radius.eap.methods", []string{"peap", "ttls", "tls"})
+	v.SetDefault("radius.eap.certificate_user", "common_name")
+	v.SetDefault("radius.eap.fragment_size", 1000)
+	v.SetDefault("radius.eap.session_timeout", "1m")
+	v.SetDefault("radius.dynamic_authorization.port", 3799)
+	v.SetDefault("radius.dynamic_authorization.timeout", "3s")
+	v.SetDefault("radius.dynamic_authorization.retry_count", 2)
 
 	// Session Evaluation Defaults
 	v.SetDefault("security.session_evaluation.enabled", true)
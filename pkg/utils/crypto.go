@@ -3,22 +3,29 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
+	"github.com/turtacn/QuantaID/pkg/auth/passwordhash"
 	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2"
 	"io"
+	"strings"
 	"time"
 )
 
 // CryptoManager provides cryptographic utility functions, such as password hashing,
 // JWT generation/validation, and UUID creation.
 type CryptoManager struct {
-	jwtSecret []byte
-	aesKey    []byte
+	jwtSecret  []byte
+	aesKey     []byte
+	issuer     string
+	keyManager *KeyManager
+	passwords  *passwordhash.Registry
 }
 
 // NewCryptoManager creates a new CryptoManager with the given JWT secret.
@@ -34,9 +41,50 @@ func NewCryptoManager(jwtSecret string) *CryptoManager {
 	return &CryptoManager{
 		jwtSecret: []byte(jwtSecret),
 		aesKey:    hash[:], // Use the 32-byte hash as the AES key
+		issuer:    "QuantaID",
+		passwords: passwordhash.NewDefaultRegistry(passwordhash.DefaultArgon2Params),
 	}
 }
 
+// SetPasswordHasher replaces the registry passwords are hashed and verified
+// with. By default passwords are hashed with Argon2id and imported bcrypt,
+// PBKDF2, SHA-crypt and LDAP SHA hashes are verified.
+func (cm *CryptoManager) SetPasswordHasher(registry *passwordhash.Registry) {
+	cm.passwords = registry
+}
+
+// SetKeyManager switches JWT signing from the shared HS256 secret to the asymmetric
+// key set managed by km. Once set, HS256 tokens are no longer accepted.
+func (cm *CryptoManager) SetKeyManager(km *KeyManager) {
+	cm.keyManager = km
+}
+
+// KeyManager returns the asymmetric signing key manager, or nil when HS256 is in use.
+func (cm *CryptoManager) KeyManager() *KeyManager {
+	return cm.keyManager
+}
+
+// SetIssuer sets the value of the "iss" claim in issued tokens.
+func (cm *CryptoManager) SetIssuer(issuer string) {
+	if issuer != "" {
+		cm.issuer = issuer
+	}
+}
+
+// Issuer returns the value of the "iss" claim in issued tokens.
+func (cm *CryptoManager) Issuer() string {
+	return cm.issuer
+}
+
+// DeriveKey derives a key for a purpose, such as signing magic links, from the
+// JWT secret. Keys of different purposes are independent of each other and
+// of the secret, and the same on every server instance.
+func (cm *CryptoManager) DeriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, cm.jwtSecret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
 // Encrypt encrypts plaintext using AES-GCM and returns it as a hex-encoded string.
 func (cm *CryptoManager) Encrypt(plaintext string) (string, error) {
 	block, err := aes.NewCipher(cm.aesKey)
@@ -89,7 +137,8 @@ func (cm *CryptoManager) Decrypt(ciphertextHex string) (string, error) {
 	return string(plaintext), nil
 }
 
-// HashPassword generates a bcrypt hash of a given password.
+// HashPassword hashes a password with the preferred scheme of the password
+// hasher, Argon2id unless configured otherwise.
 //
 // Parameters:
 //   - password: The plain-text password to hash.
@@ -97,11 +146,11 @@ func (cm *CryptoManager) Decrypt(ciphertextHex string) (string, error) {
 // Returns:
 //   The hashed password as a string, or an error if hashing fails.
 func (cm *CryptoManager) HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := cm.passwords.Hash(password)
 	if err != nil {
 		return "", fmt.Errorf("failed to hash password: %w", err)
 	}
-	return string(bytes), nil
+	return hash, nil
 }
 
 // GenerateRandomString generates a cryptographically secure random string of specified length.
@@ -118,23 +167,49 @@ func GenerateRandomString(length int) (string, error) {
 	return string(bytes), nil
 }
 
+// GenerateRandomPassword generates a random password of the specified length
+// (at least 4) containing a lowercase letter, an uppercase letter, a digit and
+// a symbol, so that it meets password policies on character classes. It is
+// used for accounts whose password nobody is meant to know.
+func GenerateRandomPassword(length int) (string, error) {
+	for {
+		password, err := GenerateRandomString(length)
+		if err != nil {
+			return "", err
+		}
+		if strings.ContainsAny(password, "abcdefghijklmnopqrstuvwxyz") &&
+			strings.ContainsAny(password, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") &&
+			strings.ContainsAny(password, "0123456789") &&
+			strings.ContainsAny(password, "!@#$%^&*()_+") {
+			return password, nil
+		}
+	}
+}
+
 // GenerateUUID generates a new version 4 UUID as a string.
 // Used when CryptoManager instance is not available (e.g., simple helpers)
 func GenerateUUID() string {
 	return uuid.New().String()
 }
 
-// CheckPasswordHash compares a plain-text password with a bcrypt hash to see if they match.
+// CheckPasswordHash compares a plain-text password with a hash in any scheme
+// the password hasher verifies.
 //
 // Parameters:
 //   - password: The plain-text password.
-//   - hash: The bcrypt hash to compare against.
+//   - hash: The stored password hash.
 //
 // Returns:
 //   True if the password matches the hash, false otherwise.
 func (cm *CryptoManager) CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	ok, err := cm.passwords.Verify(password, hash)
+	return err == nil && ok
+}
+
+// NeedsRehash reports whether a password hash should be replaced by a hash in
+// the preferred scheme and parameters, the next time the password is known.
+func (cm *CryptoManager) NeedsRehash(hash string) bool {
+	return cm.passwords.NeedsRehash(hash)
 }
 
 // GenerateJWT creates and signs a new JSON Web Token (JWT).
@@ -153,13 +228,25 @@ func (cm *CryptoManager) GenerateJWT(userID string, duration time.Duration, clai
 	}
 
 	claims["sub"] = userID
-	claims["iss"] = "QuantaID"
+	claims["iss"] = cm.issuer
 	claims["iat"] = time.Now().Unix()
 	claims["exp"] = time.Now().Add(duration).Unix()
 	claims["jti"] = uuid.New().String() // Add a unique identifier for the token
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(cm.jwtSecret)
+	return cm.SignJWT(claims)
+}
+
+// SignJWT signs the given claims as-is, without adding any standard claims.
+// With a key manager configured the token is signed by the active key and carries
+// its "kid" header; otherwise it is signed with HS256 and the shared secret.
+func (cm *CryptoManager) SignJWT(claims jwt.MapClaims) (string, error) {
+	var signedToken string
+	var err error
+	if cm.keyManager != nil {
+		signedToken, err = cm.keyManager.Sign(claims)
+	} else {
+		signedToken, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(cm.jwtSecret)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to sign JWT: %w", err)
 	}
@@ -175,12 +262,7 @@ func (cm *CryptoManager) GenerateJWT(userID string, duration time.Duration, clai
 // Returns:
 //   The claims from the token as a map if the token is valid, or an error otherwise.
 func (cm *CryptoManager) ValidateJWT(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return cm.jwtSecret, nil
-	})
+	token, err := jwt.Parse(tokenString, cm.keyFunc)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse JWT: %w", err)
@@ -193,6 +275,39 @@ func (cm *CryptoManager) ValidateJWT(tokenString string) (jwt.MapClaims, error)
 	return nil, fmt.Errorf("invalid token")
 }
 
+// keyFunc resolves the verification key for a token. Asymmetric tokens are looked up
+// by "kid" in the key set, and the header algorithm must match the key's algorithm.
+func (cm *CryptoManager) keyFunc(token *jwt.Token) (interface{}, error) {
+	if cm.keyManager == nil {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return cm.jwtSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("token has no kid header")
+	}
+	publicKey, alg, err := cm.keyManager.PublicKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return publicKey, nil
+}
+
+// JWKS returns the public signing keys as a JSON Web Key Set. It is empty when
+// tokens are signed with the shared HS256 secret.
+func (cm *CryptoManager) JWKS() jose.JSONWebKeySet {
+	if cm.keyManager == nil {
+		return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	}
+	return cm.keyManager.JWKS()
+}
+
 // GenerateUUID generates a new version 4 UUID as a string.
 //
 // Returns:
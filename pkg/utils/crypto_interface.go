@@ -9,6 +9,7 @@ import (
 type CryptoManagerInterface interface {
 	HashPassword(password string) (string, error)
 	CheckPasswordHash(password, hash string) bool
+	NeedsRehash(hash string) bool
 	GenerateJWT(userID string, duration time.Duration, claims jwt.MapClaims) (string, error)
 	ValidateJWT(tokenString string) (jwt.MapClaims, error)
 	GenerateUUID() string
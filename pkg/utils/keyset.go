@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// KeyStatus describes where a signing key is in its rotation lifecycle.
+type KeyStatus string
+
+const (
+	// KeyStatusActive is the single key currently used to sign new tokens.
+	KeyStatusActive KeyStatus = "active"
+	// KeyStatusNext is pre-published in the JWKS so relying parties can cache it before it becomes active.
+	KeyStatusNext KeyStatus = "next"
+	// KeyStatusRetired no longer signs tokens but is still published until every token it signed has expired.
+	KeyStatusRetired KeyStatus = "retired"
+)
+
+// Supported asymmetric JWT signing algorithms.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// SigningKey is a single asymmetric key in the signing key set.
+type SigningKey struct {
+	KeyID       string     `json:"kid"`
+	Algorithm   string     `json:"alg"`
+	Status      KeyStatus  `json:"status"`
+	PrivateKey  string     `json:"private_key"` // PKCS#8 PEM
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+
+	signer crypto.Signer
+}
+
+// Signer returns the parsed private key, decoding it from PEM on first use.
+// KeyManager decodes every key when it loads the set, so later calls are read-only.
+func (k *SigningKey) Signer() (crypto.Signer, error) {
+	if k.signer != nil {
+		return k.signer, nil
+	}
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("key %s: invalid PEM data", k.KeyID)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: failed to parse private key: %w", k.KeyID, err)
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key %s: unsupported private key type %T", k.KeyID, parsed)
+	}
+	k.signer = signer
+	return signer, nil
+}
+
+// SigningMethod returns the jwt signing method matching the key's algorithm.
+func (k *SigningKey) SigningMethod() (jwt.SigningMethod, error) {
+	switch k.Algorithm {
+	case AlgRS256:
+		return jwt.SigningMethodRS256, nil
+	case AlgES256:
+		return jwt.SigningMethodES256, nil
+	case AlgEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", k.Algorithm)
+	}
+}
+
+// KeyStore persists the signing key set so that keys survive restarts.
+type KeyStore interface {
+	// Load returns all persisted keys. An empty slice means no key set has been created yet.
+	Load(ctx context.Context) ([]*SigningKey, error)
+	// Save replaces the persisted key set.
+	Save(ctx context.Context, keys []*SigningKey) error
+}
+
+// KeyManagerConfig controls key generation and the rotation schedule.
+type KeyManagerConfig struct {
+	// Algorithm is the algorithm used for newly generated keys (RS256, ES256 or EdDSA).
+	Algorithm string
+	// RotationInterval is how long a key stays active before it is rotated out.
+	RotationInterval time.Duration
+	// RetentionPeriod is how long a retired key stays published. It must be at least
+	// the lifetime of the longest-lived token signed with it.
+	RetentionPeriod time.Duration
+}
+
+// KeyManager owns the asymmetric signing key set used for JWTs. It keeps exactly one
+// active key, one pre-published next key, and any retired keys that may still have
+// live tokens, and rotates them on a schedule.
+type KeyManager struct {
+	mu     sync.RWMutex
+	store  KeyStore
+	config KeyManagerConfig
+	keys   []*SigningKey
+	now    func() time.Time
+}
+
+// NewKeyManager loads the key set from the store, creating and persisting an initial
+// active and next key if the store is empty.
+func NewKeyManager(ctx context.Context, store KeyStore, config KeyManagerConfig) (*KeyManager, error) {
+	if config.Algorithm == "" {
+		config.Algorithm = AlgRS256
+	}
+	if !IsAsymmetricAlgorithm(config.Algorithm) {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", config.Algorithm)
+	}
+	km := &KeyManager{
+		store:  store,
+		config: config,
+		now:    time.Now,
+	}
+	keys, err := store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	for _, key := range keys {
+		if _, err := key.Signer(); err != nil {
+			return nil, err
+		}
+	}
+	km.keys = keys
+
+	if km.findByStatus(KeyStatusActive) == nil || km.findByStatus(KeyStatusNext) == nil {
+		if err := km.ensureKeys(); err != nil {
+			return nil, err
+		}
+		if err := km.store.Save(ctx, km.keys); err != nil {
+			return nil, fmt.Errorf("failed to persist signing keys: %w", err)
+		}
+	}
+	return km, nil
+}
+
+// ActiveKey returns the key currently used for signing.
+func (km *KeyManager) ActiveKey() (*SigningKey, error) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	key := km.findByStatus(KeyStatusActive)
+	if key == nil {
+		return nil, fmt.Errorf("no active signing key")
+	}
+	return key, nil
+}
+
+// PublicKey returns the public key and algorithm for a published key ID.
+func (km *KeyManager) PublicKey(kid string) (crypto.PublicKey, string, error) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	for _, key := range km.keys {
+		if key.KeyID != kid || !km.isPublished(key) {
+			continue
+		}
+		signer, err := key.Signer()
+		if err != nil {
+			return nil, "", err
+		}
+		return signer.Public(), key.Algorithm, nil
+	}
+	return nil, "", fmt.Errorf("unknown signing key: %s", kid)
+}
+
+// Sign signs the claims with the active key and sets the kid header.
+func (km *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	key, err := km.ActiveKey()
+	if err != nil {
+		return "", err
+	}
+	method, err := key.SigningMethod()
+	if err != nil {
+		return "", err
+	}
+	signer, err := key.Signer()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.KeyID
+	return token.SignedString(signer)
+}
+
+// JWKS returns the public JSON Web Key Set: the active key, the next key, and every
+// retired key that is still inside its retention period.
+func (km *KeyManager) JWKS() jose.JSONWebKeySet {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	for _, key := range km.keys {
+		if !km.isPublished(key) {
+			continue
+		}
+		signer, err := key.Signer()
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       signer.Public(),
+			KeyID:     key.KeyID,
+			Algorithm: key.Algorithm,
+			Use:       "sig",
+		})
+	}
+	return set
+}
+
+// Keys returns a snapshot of the key set metadata, newest first.
+func (km *KeyManager) Keys() []SigningKey {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	out := make([]SigningKey, 0, len(km.keys))
+	for _, key := range km.keys {
+		k := *key
+		k.PrivateKey = ""
+		k.signer = nil
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Rotate retires the active key, promotes the next key to active, generates a new next
+// key, prunes retired keys past their retention period, and persists the result.
+func (km *KeyManager) Rotate(ctx context.Context) error {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	return km.rotateLocked(ctx)
+}
+
+// RotateIfDue rotates the key set when the active key has exceeded the rotation
+// interval, and prunes expired retired keys otherwise.
+func (km *KeyManager) RotateIfDue(ctx context.Context) error {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	active := km.findByStatus(KeyStatusActive)
+	if km.config.RotationInterval > 0 && active != nil && active.ActivatedAt != nil &&
+		!km.now().Before(active.ActivatedAt.Add(km.config.RotationInterval)) {
+		return km.rotateLocked(ctx)
+	}
+	if km.pruneLocked() {
+		return km.store.Save(ctx, km.keys)
+	}
+	return nil
+}
+
+// Start runs the rotation schedule until the context is cancelled.
+func (km *KeyManager) Start(ctx context.Context, checkInterval time.Duration) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = km.RotateIfDue(ctx)
+		}
+	}
+}
+
+func (km *KeyManager) rotateLocked(ctx context.Context) error {
+	now := km.now()
+	if active := km.findByStatus(KeyStatusActive); active != nil {
+		active.Status = KeyStatusRetired
+		active.RetiredAt = &now
+	}
+	if next := km.findByStatus(KeyStatusNext); next != nil {
+		next.Status = KeyStatusActive
+		next.ActivatedAt = &now
+	}
+	if err := km.ensureKeys(); err != nil {
+		return err
+	}
+	km.pruneLocked()
+	if err := km.store.Save(ctx, km.keys); err != nil {
+		return fmt.Errorf("failed to persist signing keys: %w", err)
+	}
+	return nil
+}
+
+// ensureKeys fills in a missing active or next key.
+func (km *KeyManager) ensureKeys() error {
+	now := km.now()
+	if km.findByStatus(KeyStatusActive) == nil {
+		if next := km.findByStatus(KeyStatusNext); next != nil {
+			next.Status = KeyStatusActive
+			next.ActivatedAt = &now
+		} else {
+			key, err := newSigningKey(km.config.Algorithm, now)
+			if err != nil {
+				return err
+			}
+			key.Status = KeyStatusActive
+			key.ActivatedAt = &now
+			km.keys = append(km.keys, key)
+		}
+	}
+	if km.findByStatus(KeyStatusNext) == nil {
+		key, err := newSigningKey(km.config.Algorithm, now)
+		if err != nil {
+			return err
+		}
+		key.Status = KeyStatusNext
+		km.keys = append(km.keys, key)
+	}
+	return nil
+}
+
+// pruneLocked drops retired keys whose retention period has passed. It reports whether anything changed.
+func (km *KeyManager) pruneLocked() bool {
+	kept := km.keys[:0]
+	changed := false
+	for _, key := range km.keys {
+		if km.isPublished(key) {
+			kept = append(kept, key)
+		} else {
+			changed = true
+		}
+	}
+	km.keys = kept
+	return changed
+}
+
+func (km *KeyManager) isPublished(key *SigningKey) bool {
+	if key.Status != KeyStatusRetired {
+		return true
+	}
+	return key.RetiredAt != nil && km.now().Before(key.RetiredAt.Add(km.config.RetentionPeriod))
+}
+
+func (km *KeyManager) findByStatus(status KeyStatus) *SigningKey {
+	for _, key := range km.keys {
+		if key.Status == status {
+			return key
+		}
+	}
+	return nil
+}
+
+// IsAsymmetricAlgorithm reports whether alg is one of the key-set backed signing algorithms.
+func IsAsymmetricAlgorithm(alg string) bool {
+	switch alg {
+	case AlgRS256, AlgES256, AlgEdDSA:
+		return true
+	}
+	return false
+}
+
+// newSigningKey generates a key pair and derives its kid from the public key thumbprint.
+func newSigningKey(alg string, now time.Time) (*SigningKey, error) {
+	signer, err := generatePrivateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	jwk := jose.JSONWebKey{Key: signer.Public()}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		pub, _ := x509.MarshalPKIXPublicKey(signer.Public())
+		sum := sha256.Sum256(pub)
+		thumbprint = sum[:]
+	}
+	return &SigningKey{
+		KeyID:      base64.RawURLEncoding.EncodeToString(thumbprint),
+		Algorithm:  alg,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CreatedAt:  now,
+		signer:     signer,
+	}, nil
+}
+
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case AlgRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+}
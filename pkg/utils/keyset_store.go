@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileKeyStore persists the signing key set as a JSON document on local disk.
+// The file is private to one node; replicas each using their own file will
+// sign with different keys. The file contains private keys and is written
+// with owner-only permissions.
+type FileKeyStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileKeyStore creates a key store backed by the file at path.
+func NewFileKeyStore(path string) *FileKeyStore {
+	return &FileKeyStore{path: path}
+}
+
+type keySetDocument struct {
+	Keys []*SigningKey `json:"keys"`
+}
+
+// Load reads the key set from disk. A missing file yields an empty key set.
+func (s *FileKeyStore) Load(ctx context.Context) ([]*SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key set file: %w", err)
+	}
+	var doc keySetDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode key set file: %w", err)
+	}
+	return doc.Keys, nil
+}
+
+// Save atomically replaces the key set file.
+func (s *FileKeyStore) Save(ctx context.Context, keys []*SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(keySetDocument{Keys: keys}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode key set: %w", err)
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create key set directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".jwks-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary key set file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key set: %w", err)
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set key set permissions: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write key set: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// MemoryKeyStore keeps the key set in process memory. Keys are lost on restart,
+// so it is only suitable for tests and the in-memory storage mode.
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys []*SigningKey
+}
+
+// NewMemoryKeyStore creates an empty in-memory key store.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{}
+}
+
+// Load returns the stored keys.
+func (s *MemoryKeyStore) Load(ctx context.Context) ([]*SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*SigningKey(nil), s.keys...), nil
+}
+
+// Save replaces the stored keys.
+func (s *MemoryKeyStore) Save(ctx context.Context, keys []*SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([]*SigningKey(nil), keys...)
+	return nil
+}
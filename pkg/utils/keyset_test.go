@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCryptoManager(t *testing.T, alg string, store KeyStore) (*CryptoManager, *KeyManager) {
+	km, err := NewKeyManager(context.Background(), store, KeyManagerConfig{
+		Algorithm:        alg,
+		RotationInterval: time.Hour,
+		RetentionPeriod:  2 * time.Hour,
+	})
+	require.NoError(t, err)
+	cm := NewCryptoManager("test-secret")
+	cm.SetKeyManager(km)
+	return cm, km
+}
+
+func TestKeyManager_SignAndValidate(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			cm, km := newTestCryptoManager(t, alg, NewMemoryKeyStore())
+
+			token, err := cm.GenerateJWT("user-1", time.Minute, nil)
+			require.NoError(t, err)
+
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+			require.NoError(t, err)
+			active, err := km.ActiveKey()
+			require.NoError(t, err)
+			assert.Equal(t, active.KeyID, parsed.Header["kid"])
+			assert.Equal(t, alg, parsed.Header["alg"])
+
+			claims, err := cm.ValidateJWT(token)
+			require.NoError(t, err)
+			assert.Equal(t, "user-1", claims["sub"])
+
+			// Active and next keys are both published.
+			assert.Len(t, cm.JWKS().Keys, 2)
+		})
+	}
+}
+
+func TestKeyManager_RejectsHS256WhenKeySetConfigured(t *testing.T) {
+	legacy := NewCryptoManager("test-secret")
+	token, err := legacy.GenerateJWT("user-1", time.Minute, nil)
+	require.NoError(t, err)
+
+	cm, _ := newTestCryptoManager(t, AlgRS256, NewMemoryKeyStore())
+	_, err = cm.ValidateJWT(token)
+	assert.Error(t, err)
+}
+
+func TestKeyManager_RotationKeepsRetiredKeysUntilRetentionEnds(t *testing.T) {
+	cm, km := newTestCryptoManager(t, AlgES256, NewMemoryKeyStore())
+	now := time.Now()
+	km.now = func() time.Time { return now }
+
+	oldToken, err := cm.GenerateJWT("user-1", time.Minute, nil)
+	require.NoError(t, err)
+	oldActive, _ := km.ActiveKey()
+	oldNext := km.findByStatus(KeyStatusNext)
+
+	// Not yet due.
+	require.NoError(t, km.RotateIfDue(context.Background()))
+	active, _ := km.ActiveKey()
+	assert.Equal(t, oldActive.KeyID, active.KeyID)
+
+	// Due: next key is promoted and the old active key is retired but still verifies.
+	now = now.Add(time.Hour)
+	require.NoError(t, km.RotateIfDue(context.Background()))
+	active, _ = km.ActiveKey()
+	assert.Equal(t, oldNext.KeyID, active.KeyID)
+	assert.Len(t, cm.JWKS().Keys, 3)
+	_, _, err = km.PublicKey(oldActive.KeyID)
+	assert.NoError(t, err)
+
+	newToken, err := cm.GenerateJWT("user-1", time.Minute, nil)
+	require.NoError(t, err)
+	_, err = cm.ValidateJWT(newToken)
+	assert.NoError(t, err)
+
+	// After the retention period the retired key is pruned.
+	now = now.Add(2*time.Hour + time.Second)
+	require.NoError(t, km.RotateIfDue(context.Background()))
+	_, _, err = km.PublicKey(oldActive.KeyID)
+	assert.Error(t, err)
+	_, err = cm.ValidateJWT(oldToken)
+	assert.Error(t, err)
+}
+
+func TestFileKeyStore_PersistsKeySet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	cm, km := newTestCryptoManager(t, AlgEdDSA, NewFileKeyStore(path))
+
+	token, err := cm.GenerateJWT("user-1", time.Minute, nil)
+	require.NoError(t, err)
+	require.NoError(t, km.Rotate(context.Background()))
+
+	reloaded, _ := newTestCryptoManager(t, AlgEdDSA, NewFileKeyStore(path))
+	claims, err := reloaded.ValidateJWT(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims["sub"])
+	assert.Len(t, reloaded.JWKS().Keys, 3)
+}
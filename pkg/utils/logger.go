@@ -162,3 +162,13 @@ func NewNoopLogger() Logger {
 func NewZapLoggerWrapper(logger *zap.Logger) Logger {
 	return &ZapLogger{Logger: logger}
 }
+
+// ZapLoggerFrom returns the zap.Logger behind a Logger, for components that
+// log with zap directly. Loggers not backed by zap, such as the test mocks,
+// yield a no-op logger.
+func ZapLoggerFrom(logger Logger) *zap.Logger {
+	if zl, ok := logger.(*ZapLogger); ok && zl.Logger != nil {
+		return zl.Logger
+	}
+	return zap.NewNop()
+}
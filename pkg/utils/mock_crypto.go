@@ -21,6 +21,11 @@ func (m *MockCryptoManager) CheckPasswordHash(password, hash string) bool {
 	return args.Bool(0)
 }
 
+func (m *MockCryptoManager) NeedsRehash(hash string) bool {
+	args := m.Called(hash)
+	return args.Bool(0)
+}
+
 func (m *MockCryptoManager) GenerateJWT(userID string, duration time.Duration, claims jwt.MapClaims) (string, error) {
 	args := m.Called(userID, duration, claims)
 	return args.String(0), args.Error(1)
@@ -99,6 +99,8 @@ func TestProfile_BuildFromEvents(t *testing.T) {
 
 	accessRepo := &MockAccessLogRepo{Logs: logs}
 	deviceRepo := &MockDeviceRepo{}
+	// A user verified before the email_verified column, with the flag still
+	// in its attributes.
 	user := &types.User{
 		ID: userID,
 		Attributes: map[string]interface{}{
@@ -118,6 +120,7 @@ func TestProfile_BuildFromEvents(t *testing.T) {
 	// Assert
 	assert.Equal(t, int64(6), prof.Behavior.TotalLogins)
 	assert.Greater(t, prof.Behavior.MFAUsageRate, 0.0)
+	assert.True(t, prof.QualityDetails.EmailVerified)
 
 	// Test Persistence
 	loadedProfile, err := repo.GetByUserID(context.Background(), userID)